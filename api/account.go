@@ -0,0 +1,123 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// per user and server data kept in private tiddlers, never served by the tiddler API
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"../store"
+)
+
+var (
+	// UserExists tells whether a user name is known, for @mentions; nil matches no user.
+	UserExists func(user string) (bool)
+)
+
+// privatePrefix starts the titles of the private server tiddlers, accountPrefix the per user ones.
+const (
+	privatePrefix = "$:/widdly/"
+	accountPrefix = privatePrefix + "account/"
+)
+
+// isPrivate tells whether title is a private server tiddler, under the key the store keeps it
+// (store.StoreKey), so "$:/Widdly/..." is one too when titles are case insensitive.
+func isPrivate(title string) (bool) {
+	return strings.HasPrefix(store.StoreKey(title), privatePrefix)
+}
+
+// isPrivateTiddler is isPrivate for tiddlers from All, parsing the meta only when needed.
+func isPrivateTiddler(t *store.Tiddler) (bool) {
+	if t.Js != nil {
+		title, _ := t.Js["title"].(string)
+		return isPrivate(title)
+	}
+	if store.TitleCase != store.CaseInsensitive && !bytes.Contains(t.Meta, []byte(privatePrefix)) {
+		return false
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return false
+	}
+	title, _ := js["title"].(string)
+	return isPrivate(title)
+}
+
+// checkNotPrivate rejects writes to the private tiddlers through the tiddler API.
+func checkNotPrivate(w http.ResponseWriter, title string) (ok bool) {
+	if isPrivate(title) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func accountTitle(user string, name string) (string) {
+	return accountPrefix + user + "/" + name
+}
+
+// loadAccount decodes the JSON text of the private tiddler name of user into v,
+// leaving v alone when it does not exist.
+func loadAccount(ctx context.Context, user string, name string, v interface{}) (error) {
+	return loadPrivate(ctx, accountTitle(user, name), v)
+}
+
+// saveAccount saves v as the JSON text of the private tiddler name of user.
+func saveAccount(ctx context.Context, user string, name string, v interface{}) (error) {
+	return savePrivate(ctx, accountTitle(user, name), v)
+}
+
+// loadPrivate decodes the JSON text of the private tiddler title into v,
+// leaving v alone when it does not exist.
+func loadPrivate(ctx context.Context, title string, v interface{}) (error) {
+	t, err := StoreDb.Get(ctx, title)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return err
+	}
+	text, _ := js["text"].(string)
+	if text == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(text), v)
+}
+
+// savePrivate saves v as the JSON text of the private tiddler title.
+func savePrivate(ctx context.Context, title string, v interface{}) (error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = StoreDb.Put(ctx, store.Tiddler{
+		Key: title,
+		Js: map[string]interface{}{
+			"title":    title,
+			"type":     "application/json",
+			"text":     string(data),
+			"modified": twNow(),
+		},
+		IsSys: true,
+	})
+	return err
+}
@@ -0,0 +1,284 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// edit activity per day and user: GET /stats/activity
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activityTitle is the private tiddler keeping the edit activity.
+const activityTitle = privatePrefix + "activity"
+
+var (
+	// ActivityDays is how many days of activity are kept, 0 for all.
+	ActivityDays = 2 * 366
+
+	// ActivityFlush is how long edits wait in memory before the activity is saved.
+	ActivityFlush = time.Minute
+)
+
+// DayActivity counts the edits of a user on a day.
+type DayActivity struct {
+	Created  int `json:"created"`
+	Modified int `json:"modified"`
+}
+
+// activityLog is the saved activity.
+type activityLog struct {
+	Days  map[string]map[string]*DayActivity `json:"days"`  // YYYY-MM-DD -> user -> counts
+	Edits map[string]int                     `json:"edits"` // title -> saves, all time
+}
+
+var (
+	activityMu      sync.Mutex
+	activity        *activityLog // nil until loaded
+	activityPending bool // a flush is scheduled
+)
+
+// loadActivityLocked loads the activity on first use.
+func loadActivityLocked(ctx context.Context) (error) {
+	if activity != nil {
+		return nil
+	}
+	a := &activityLog{}
+	if err := loadPrivate(ctx, activityTitle, a); err != nil {
+		return err
+	}
+	if a.Days == nil {
+		a.Days = make(map[string]map[string]*DayActivity)
+	}
+	if a.Edits == nil {
+		a.Edits = make(map[string]int)
+	}
+	activity = a
+	return nil
+}
+
+// resetActivity forgets the loaded activity, for a new store.
+func resetActivity() {
+	activityMu.Lock()
+	activity, activityPending = nil, false
+	activityMu.Unlock()
+}
+
+// trackEdit counts a save of title by the client of r, created when the tiddler is new.
+// System tiddlers and drafts are not counted.
+func trackEdit(r *http.Request, title string, created bool) {
+	if strings.HasPrefix(title, "$:/") || strings.HasPrefix(title, "Draft of '") {
+		return
+	}
+	user, _ := currentUser(r)
+	if user == "" {
+		user = AnonModifier
+	}
+	day := time.Now().Format("2006-01-02")
+
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	if err := loadActivityLocked(r.Context()); err != nil {
+		log.Println("[activity] load", err)
+		return
+	}
+	users := activity.Days[day]
+	if users == nil {
+		users = make(map[string]*DayActivity)
+		activity.Days[day] = users
+	}
+	d := users[user]
+	if d == nil {
+		d = &DayActivity{}
+		users[user] = d
+	}
+	if created {
+		d.Created++
+	} else {
+		d.Modified++
+	}
+	activity.Edits[title]++
+
+	if !activityPending {
+		activityPending = true
+		time.AfterFunc(ActivityFlush, FlushActivity)
+	}
+}
+
+// FlushActivity saves the edits counted since the last save, it is called on shutdown.
+func FlushActivity() {
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	if activityPending {
+		activityPending = false
+		saveActivityLocked()
+	}
+}
+
+// saveActivityLocked prunes the days older than ActivityDays and saves the activity.
+func saveActivityLocked() {
+	if activity == nil {
+		return
+	}
+	if ActivityDays > 0 {
+		oldest := time.Now().AddDate(0, 0, -ActivityDays).Format("2006-01-02")
+		for day := range activity.Days {
+			if day < oldest {
+				delete(activity.Days, day)
+			}
+		}
+	}
+	if err := savePrivate(context.Background(), activityTitle, activity); err != nil {
+		log.Println("[activity] save", err)
+	}
+}
+
+// dropEdits forgets the edit count of a deleted tiddler.
+func dropEdits(title string) {
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	if activity != nil {
+		delete(activity.Edits, title)
+	}
+}
+
+// activityDay is a day of GET /stats/activity.
+type activityDay struct {
+	Day      string `json:"day"`
+	Created  int    `json:"created"`
+	Modified int    `json:"modified"`
+}
+
+// activityTop is a most edited tiddler of GET /stats/activity.
+type activityTop struct {
+	Title string `json:"title"`
+	Edits int    `json:"edits"`
+}
+
+// streaks returns the current (ending today or yesterday) and longest runs of consecutive days.
+func streaks(days []activityDay, today time.Time) (current int, longest int) {
+	run := 0
+	var prev time.Time
+	for _, d := range days {
+		t, err := time.ParseInLocation("2006-01-02", d.Day, today.Location())
+		if err != nil {
+			continue
+		}
+		if run > 0 && t.Equal(prev.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		prev = t
+		if run > longest {
+			longest = run
+		}
+	}
+	y, m, dd := today.Date()
+	midnight := time.Date(y, m, dd, 0, 0, 0, 0, today.Location())
+	if run > 0 && !prev.Before(midnight.AddDate(0, 0, -1)) {
+		current = run
+	}
+	return current, longest
+}
+
+// statsActivity serves GET /stats/activity for logged in users:
+//
+//	?user=<name>             only the edits of a user, default everyone
+//	?year=2026               only that year, or ?from=2026-01-01&to=2026-12-31
+//	?top=10                  how many most edited tiddlers are listed
+//
+// It answers the days with edits, oldest first, the current and longest streaks of days
+// with edits, the edits per user and the most edited tiddlers (all time).
+func statsActivity(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if year := q.Get("year"); year != "" {
+		from, to = year + "-01-01", year + "-12-31"
+	}
+	if to == "" {
+		to = "9999-12-31"
+	}
+	only := q.Get("user")
+	top := 10
+	if n, err := strconv.Atoi(q.Get("top")); err == nil && n >= 0 {
+		top = n
+	}
+
+	activityMu.Lock()
+	if err := loadActivityLocked(r.Context()); err != nil {
+		activityMu.Unlock()
+		internalError(w, err)
+		return
+	}
+	days := []activityDay{}
+	users := map[string]*DayActivity{}
+	for day, byUser := range activity.Days {
+		if day < from || day > to {
+			continue
+		}
+		sum := activityDay{Day: day}
+		for user, d := range byUser {
+			if only != "" && user != only {
+				continue
+			}
+			sum.Created += d.Created
+			sum.Modified += d.Modified
+			if users[user] == nil {
+				users[user] = &DayActivity{}
+			}
+			users[user].Created += d.Created
+			users[user].Modified += d.Modified
+		}
+		if sum.Created + sum.Modified > 0 {
+			days = append(days, sum)
+		}
+	}
+	tops := make([]activityTop, 0, len(activity.Edits))
+	for title, n := range activity.Edits {
+		tops = append(tops, activityTop{Title: title, Edits: n})
+	}
+	activityMu.Unlock()
+
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	sort.Slice(tops, func(i, j int) bool {
+		if tops[i].Edits != tops[j].Edits {
+			return tops[i].Edits > tops[j].Edits
+		}
+		return tops[i].Title < tops[j].Title
+	})
+	if len(tops) > top {
+		tops = tops[:top]
+	}
+	current, longest := streaks(days, time.Now())
+	writeJSON(w, map[string]interface{}{
+		"days":           days,
+		"users":          users,
+		"top":            tops,
+		"current_streak": current,
+		"longest_streak": longest,
+	})
+}
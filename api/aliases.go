@@ -0,0 +1,251 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// aliases of renamed tiddlers
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+// aliasesTitle is the private tiddler keeping the old titles of renamed tiddlers.
+const aliasesTitle = privatePrefix + "aliases"
+
+// renameWindow is how long the rename of a saved draft waits for the old title to be deleted.
+const renameWindow = time.Minute
+
+// Alias points an old title at the tiddler it was renamed to.
+type Alias struct {
+	To      string `json:"to"`
+	Renamed string `json:"renamed"` // TiddlyWiki date
+}
+
+var (
+	aliasMu sync.Mutex
+
+	// pendingRenames are the renames of the saved drafts, old title to new,
+	// until the old title is deleted (TiddlyWiki deletes the draft, then the old title).
+	pendingRenames = make(map[string]pendingRename)
+)
+
+type pendingRename struct {
+	to string
+	at time.Time
+}
+
+func loadAliases(ctx context.Context) (map[string]Alias, error) {
+	aliases := make(map[string]Alias)
+	err := loadPrivate(ctx, aliasesTitle, &aliases)
+	return aliases, err
+}
+
+// addAlias records the rename of from to to; the aliases of from follow it to to,
+// and an alias named to is dropped, the title is taken again.
+func addAlias(ctx context.Context, from string, to string) {
+	if from == to || isPrivate(from) || isPrivate(to) {
+		return
+	}
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	aliases, err := loadAliases(ctx)
+	if err != nil {
+		log.Println("[alias] load", err)
+		return
+	}
+	now := twNow()
+	for old, a := range aliases {
+		if a.To == from {
+			aliases[old] = Alias{To: to, Renamed: now}
+		}
+	}
+	delete(aliases, to)
+	aliases[from] = Alias{To: to, Renamed: now}
+	if err := savePrivate(ctx, aliasesTitle, aliases); err != nil {
+		log.Println("[alias] save", err)
+	}
+}
+
+// dropAliasesTo forgets the aliases of the deleted (not renamed) tiddler title.
+func dropAliasesTo(ctx context.Context, title string) {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	aliases, err := loadAliases(ctx)
+	if err != nil || len(aliases) == 0 {
+		return
+	}
+	n := len(aliases)
+	for old, a := range aliases {
+		if a.To == title {
+			delete(aliases, old)
+		}
+	}
+	if len(aliases) == n {
+		return
+	}
+	if err := savePrivate(ctx, aliasesTitle, aliases); err != nil {
+		log.Println("[alias] save", err)
+	}
+}
+
+// draftRename returns the old and new titles of the draft js renaming a tiddler.
+func draftRename(js map[string]interface{}) (string, string, bool) {
+	flat := store.FlatFields(js)
+	from, to := flat["draft.of"], flat["draft.title"]
+	return from, to, from != "" && to != "" && from != to
+}
+
+// noteDelete works out how the aliases follow the deletion of title, reading what it needs
+// (drafts, the uuid of title) before the deletion; the aliases change only when the returned
+// apply is called, once the deletion succeeded.
+// Saving a renaming draft in TiddlyWiki saves the new title and deletes the draft and then
+// the old title, so the old title becomes an alias of the new one when it is deleted
+// after such a draft (or while it is still there), or, with UUIDs, when another tiddler took its uuid.
+func noteDelete(ctx context.Context, title string) (apply func(context.Context)) {
+	if strings.HasPrefix(title, "Draft ") {
+		t, err := StoreDb.Get(ctx, title)
+		if err != nil {
+			return func(context.Context) {}
+		}
+		js, err := t.Fields()
+		if err != nil {
+			return func(context.Context) {}
+		}
+		from, to, ok := draftRename(js)
+		if !ok {
+			return func(context.Context) {}
+		}
+		return func(context.Context) {
+			aliasMu.Lock()
+			pendingRenames[from] = pendingRename{to: to, at: time.Now()}
+			aliasMu.Unlock()
+		}
+	}
+
+	aliasMu.Lock()
+	p, ok := pendingRenames[title]
+	aliasMu.Unlock()
+	if ok && time.Since(p.at) > renameWindow {
+		ok = false
+	}
+	if !ok {
+		if t, err := StoreDb.Get(ctx, "Draft of '" + title + "'"); err == nil {
+			if js, err := t.Fields(); err == nil {
+				if from, to, renamed := draftRename(js); renamed && from == title {
+					p, ok = pendingRename{to: to, at: time.Now()}, true
+				}
+			}
+		}
+	}
+	to := ""
+	if ok {
+		if _, err := StoreDb.Get(ctx, p.to); err == nil {
+			to = p.to
+		}
+	}
+	if to == "" {
+		to = renamedTo(ctx, title) // long after the draft was saved
+	}
+
+	return func(ctx context.Context) {
+		aliasMu.Lock()
+		delete(pendingRenames, title)
+		for old, p := range pendingRenames {
+			if time.Since(p.at) > renameWindow {
+				delete(pendingRenames, old)
+			}
+		}
+		aliasMu.Unlock()
+		if to != "" {
+			addAlias(ctx, title, to)
+			return
+		}
+		dropAliasesTo(ctx, title)
+	}
+}
+
+// serveAlias redirects the GET of the missing tiddler title to the tiddler it was renamed to,
+// with 301 Moved Permanently to the same endpoint (tiddler JSON or /raw/). It reports false without an alias.
+func serveAlias(w http.ResponseWriter, r *http.Request, title string) (bool) {
+	aliases, err := loadAliases(r.Context())
+	if err != nil {
+		return false
+	}
+	a, ok := aliases[title]
+	if !ok {
+		return false
+	}
+	if hide, err := isHidden(r, a.To); err != nil || hide {
+		return false
+	}
+	w.Header().Set("Location", "./" + url.PathEscape(a.To)) // ./ as a title may look like a scheme
+	w.WriteHeader(http.StatusMovedPermanently)
+	return true
+}
+
+// aliasesHandler serves /aliases/: GET lists the aliases, old title to Alias,
+// DELETE /aliases/<old title> drops one (admins).
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	old := strings.TrimPrefix(r.URL.Path, "/aliases/")
+	switch r.Method {
+	case "GET":
+		aliases, err := loadAliases(r.Context())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		hidden, err := hiddenFor(r)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		for old, a := range aliases {
+			if isHiddenTitle(hidden, a.To) {
+				delete(aliases, old)
+			}
+		}
+		writeJSON(w, aliases)
+
+	case "DELETE":
+		if !checkAdmin(w, r) || !checkWritable(w, r) {
+			return
+		}
+		aliasMu.Lock()
+		defer aliasMu.Unlock()
+		aliases, err := loadAliases(r.Context())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if _, ok := aliases[old]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(aliases, old)
+		if err := savePrivate(r.Context(), aliasesTitle, aliases); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
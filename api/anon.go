@@ -0,0 +1,240 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// anonymous edits of a public scratchpad
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AnonPrefix lets guests create and edit the tiddlers whose title starts with it, empty for disable.
+	AnonPrefix = ""
+
+	// AnonRate is how many tiddlers a guest address may save per hour.
+	AnonRate = 20
+
+	// AnonMaxSize caps the size of a tiddler saved by a guest.
+	AnonMaxSize int64 = 16 * 1024
+
+	// AnonWork is the proof of work a guest save needs, in leading zero bits, 0 for none.
+	// See anonChallenge.
+	AnonWork = 0
+)
+
+// AnonModifier is the modifier and creator of the tiddlers saved by guests.
+const AnonModifier = "GUEST"
+
+// anonChallengeAge is how long a challenge of anonChallenge may be used.
+const anonChallengeAge = 10 * time.Minute
+
+var (
+	anonMu     sync.Mutex
+	anonSaves  = make(map[string]*anonWindow) // by client address
+	anonUsed   = make(map[string]time.Time)   // spent challenges, until they expire
+	anonSecret = make([]byte, 32)
+)
+
+type anonWindow struct {
+	n     int
+	reset time.Time
+}
+
+func init() {
+	if _, err := rand.Read(anonSecret); err != nil {
+		panic(err)
+	}
+}
+
+// isAnonTitle tells whether guests may save title.
+func isAnonTitle(title string) (bool) {
+	return AnonPrefix != "" && strings.HasPrefix(title, AnonPrefix) && !isPrivate(title)
+}
+
+func clientAddr(r *http.Request) (string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// remoteIP is clientAddr, but the first X-Forwarded-For address behind a reverse proxy on the same host.
+func remoteIP(r *http.Request) (string) {
+	addr := clientAddr(r)
+	if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	return addr
+}
+
+// checkAnon checks a save of a guest for the proof of work, the size and the rate limit,
+// and rewrites the body with AnonModifier as modifier and creator.
+func checkAnon(w http.ResponseWriter, r *http.Request) (ok bool) {
+	if r.ContentLength > AnonMaxSize {
+		http.Error(w, "tiddler too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if AnonWork > 0 && !checkWork(r.Header.Get("X-Proof-Of-Work")) {
+		http.Error(w, "missing or wrong proof of work, see /anon/challenge", http.StatusForbidden)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, AnonMaxSize))
+	if err != nil {
+		http.Error(w, "tiddler too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	var js map[string]interface{}
+	if json.Unmarshal(body, &js) != nil || js == nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return false
+	}
+
+	if !anonAllow(clientAddr(r), time.Now()) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "too many edits, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	js["modifier"] = AnonModifier
+	js["creator"] = AnonModifier
+	body, err = json.Marshal(js)
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return true
+}
+
+// anonAllow counts a save of addr, false when it is over AnonRate in the current hour.
+func anonAllow(addr string, now time.Time) (bool) {
+	anonMu.Lock()
+	defer anonMu.Unlock()
+
+	if len(anonSaves) > 4096 {
+		for a, win := range anonSaves {
+			if now.After(win.reset) {
+				delete(anonSaves, a)
+			}
+		}
+	}
+	win := anonSaves[addr]
+	if win == nil || now.After(win.reset) {
+		win = &anonWindow{reset: now.Add(time.Hour)}
+		anonSaves[addr] = win
+	}
+	if win.n >= AnonRate {
+		return false
+	}
+	win.n++
+	return true
+}
+
+func anonSign(stamp string) (string) {
+	mac := hmac.New(sha256.New, anonSecret)
+	mac.Write([]byte(stamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// anonChallenge serves GET /anon/challenge, {"challenge": "...", "bits": 20}.
+// The client finds a nonce so that sha256("<challenge>:<nonce>") starts with bits zero bits,
+// and sends "X-Proof-Of-Work: <challenge>:<nonce>" with its save or guest comment. Each challenge is good for one save.
+func anonChallenge(w http.ResponseWriter, r *http.Request) {
+	if AnonPrefix == "" && !CommentGuests {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		internalError(w, err)
+		return
+	}
+	stamp := strconv.FormatInt(time.Now().Unix(), 10) + "." + hex.EncodeToString(nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]interface{}{
+		"challenge": stamp + "." + anonSign(stamp),
+		"bits":      AnonWork,
+	})
+}
+
+// checkWork verifies a X-Proof-Of-Work header and spends its challenge.
+func checkWork(proof string) (bool) {
+	i := strings.LastIndexByte(proof, ':')
+	if i < 0 {
+		return false
+	}
+	challenge := proof[:i]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(anonSign(parts[0] + "." + parts[1]))) {
+		return false
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(sec, 0)
+	now := time.Now()
+	if now.Sub(issued) > anonChallengeAge || issued.After(now.Add(time.Minute)) {
+		return false
+	}
+	if leadingZeros(sha256.Sum256([]byte(proof))) < AnonWork {
+		return false
+	}
+
+	anonMu.Lock()
+	defer anonMu.Unlock()
+	for c, until := range anonUsed {
+		if now.After(until) {
+			delete(anonUsed, c)
+		}
+	}
+	if _, used := anonUsed[challenge]; used {
+		return false
+	}
+	anonUsed[challenge] = issued.Add(anonChallengeAge)
+	return true
+}
+
+func leadingZeros(sum [sha256.Size]byte) (int) {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -15,15 +15,23 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"../store"
 )
@@ -37,26 +45,82 @@ var (
 	// Authenticate is a hook that lets the client of the package to provide authentication.
 	Authenticate func(user string, pwd string) (bool)
 
-	// ServeBase is a callback that should serve the index page.
-	ServeBase = func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "index.html")
-	}
+	// IsAdmin tells whether a logged in user may moderate and change the wiki settings,
+	// nil makes every logged in user an admin.
+	IsAdmin func(user string) (bool)
+
+	// ServeBase is a callback that should serve the index page, nil serves the IndexFiles.
+	ServeBase http.HandlerFunc
 )
 
 func InitHandle(mux *Mux) {
-	mux.HandleFunc("/", withLogging(index))
-	mux.HandleFunc("/status", withLogging(status))
-	mux.HandleFunc("/challenge/tiddlywebplugins.tiddlyspace.cookie_form", withLogging(login)) // POST, user=ee&password=11&tiddlyweb_redirect=%2Fstatus
-	mux.HandleFunc("/logout", withLogging(logout)) // POST
-	mux.HandleFunc("/recipes/all/tiddlers.json", withLogging(list))
-	mux.HandleFunc("/recipes/all/tiddlers/", withLogging(tiddler))
-	mux.HandleFunc("/bags/bag/tiddlers/", withLogging(remove))
+	handle := func(pattern string, f http.HandlerFunc) {
+		mux.HandleFunc(pattern, withLogging(withReady(withDevice(withDecompress(withGzip(withPlugins(f)))))))
+	}
+
+	mux.HandleFunc("/ready", ready) // not logged, probed often
+
+	handle("/", index)
+	handle("/status", status)
+	handle("/challenge/tiddlywebplugins.tiddlyspace.cookie_form", login) // POST, user=ee&password=11&tiddlyweb_redirect=%2Fstatus
+	handle("/logout", logout) // POST, GET to confirm
+	handle("/session/ttl", sessionTTL)
+	handle("/session/keepalive", sessionKeepalive)
+	handle("/recipes/all/tiddlers.json", list)
+	handle("/recipes/all/tiddlers/", tiddler)
+	handle("/recipes/all/atomic", atomicSave)
+	handle("/bags/bag/tiddlers/", remove)
+	handle("/raw/", raw)
+	handle("/files/", files)
+	handle("/dav/", dav)
+	handle("/calendar.ics", calendar)
+	handle("/export", export)
+	handle("/queries/", queries)
+	handle("/aliases/", aliasesHandler)
+	handle("/uuid/", uuidHandler)
+	handle("/query", query)
+	handle("/clip", clip)
+	handle("/quick", quick)
+	handle("/pair", pair)
+	handle("/blog/", blog)
+	handle("/comments", comments)
+	handle("/anon/challenge", anonChallenge)
+	handle("/account/", account)
+	handle("/admin/settings", adminSettings)
+	handle("/admin/stats", adminStats)
+	handle("/admin/retag", adminRetag)
+	handle("/admin/audit", adminAudit)
+	handle("/admin/maintenance", adminMaintenance)
+	handle("/admin/publish", adminPublish)
+	handle("/stats/activity", statsActivity)
+	handle("/metrics", metricsHandler)
+
+	for _, p := range pluginlist {
+		for pattern, f := range p.Routes {
+			handle(pattern, f)
+		}
+	}
 }
 
-// internalError logs err to the standard error and returns HTTP 500 Internal Server Error.
+// internalError logs err to the standard error and returns HTTP 500 Internal Server Error,
+// or 503 Service Unavailable for the writes of a read-only store.
+// Both carry the request id, which the log line starts with.
 func internalError(w http.ResponseWriter, err error) {
+	if err == store.ErrReadOnly {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logError(w, err)
+	http.Error(w, withResponseID(w, "internal server error"), http.StatusInternalServerError)
+}
+
+// logError logs err of the request answered by w, with its id.
+func logError(w http.ResponseWriter, err error) {
+	if id := responseID(w); id != "" {
+		log.Printf("ERR [%s] %v", id, err)
+		return
+	}
 	log.Println("ERR", err)
-	http.Error(w, "internal server error", http.StatusInternalServerError)
 }
 
 // logRequest logs the incoming request.
@@ -65,17 +129,50 @@ func logRequest(r *http.Request) {
 	if err != nil {
 		host = r.RemoteAddr
 	}
-	log.Println(host, r.Method, r.URL, r.Referer(), r.UserAgent())
+	log.Printf("[%s] %s %s %s %s %s", RequestID(r), host, r.Method, r.URL, r.Referer(), r.UserAgent())
 }
 
-// withLogging is a logging middleware.
+// withLogging is a logging middleware, giving every request an id first.
 func withLogging(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
 		logRequest(r)
+		noteActive(r)
 		f(w, r)
 	}
 }
 
+// currentUser returns the user of a logged in session, without starting a session.
+func currentUser(r *http.Request) (string, bool) {
+	sess := Sess.sessionOf(r)
+	if sess == nil || !sess.IsLogin() {
+		return "", false
+	}
+	uid, ok := sess.Get("uid")
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(uid), true
+}
+
+// isAdmin tells whether the request comes from a logged in admin.
+func isAdmin(r *http.Request) (bool) {
+	user, ok := currentUser(r)
+	if !ok {
+		return false
+	}
+	return IsAdmin == nil || IsAdmin(user)
+}
+
+// checkAdmin refuses the request with 403 Forbidden unless it comes from a logged in admin.
+func checkAdmin(w http.ResponseWriter, r *http.Request) (ok bool) {
+	if !isAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func checkAuth(w http.ResponseWriter, r *http.Request) (ok bool) {
 	_, err := Sess.GetSID(r)
 	if err != nil { // do not add cookie
@@ -90,7 +187,7 @@ func checkAuth(w http.ResponseWriter, r *http.Request) (ok bool) {
 	}
 
 	if !sess.IsLogin() {
-		Sess.Destroy(w, r)
+		Sess.DestroySession(w, sess)
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return ok
 	}
@@ -101,13 +198,18 @@ func checkAuth(w http.ResponseWriter, r *http.Request) (ok bool) {
 func index(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "HEAD":
+		// the PutSaver reads the ETag of the page here and sends it back as If-Match
+		if etag, err := indexETag(); err == nil {
+			w.Header().Set("ETag", etag)
+		}
 		return
 	case "OPTIONS":
-		w.Header().Add("Allow", "GET, HEAD, PUT, OPTIONS")
+		w.Header().Add("Allow", "GET, HEAD, PUT, PATCH, OPTIONS")
 		w.Header().Add("DAV", "1, 2") // hack for WebDAV sync adaptor/saver
+		w.Header().Set("Accept-Encoding", acceptEncoding()) // compressed PUT bodies
 		return
 	case "PUT":
-		if !checkAuth(w, r) {
+		if !checkAuth(w, r) || !checkIndexUpload(w, r) || !checkWritable(w, r) {
 			return
 		}
 
@@ -116,21 +218,34 @@ func index(w http.ResponseWriter, r *http.Request) {
 			internalError(w, err)
 			return
 		}
-		err = ioutil.WriteFile("index.html", b, 0644)
+		indexMu.Lock()
+		defer indexMu.Unlock()
+		if !checkIfMatch(w, r) || !checkIndexPage(w, b) {
+			return
+		}
+		err = writeIndex(w, b)
 		if err != nil {
 			internalError(w, err)
 			return
 		}
 		return
+	case "PATCH":
+		if !checkAuth(w, r) || !checkIndexUpload(w, r) || !checkWritable(w, r) {
+			return
+		}
+		patchIndex(w, r)
+		return
 	default:
 	}
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
-	gzw := TryGzipResponse(w, r)
-	defer gzw.Close()
-	ServeBase(gzw, r)
+	if ServeBase == nil {
+		serveIndex(w, r)
+		return
+	}
+	ServeBase(w, r)
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
@@ -147,29 +262,108 @@ func login(w http.ResponseWriter, r *http.Request) {
 	user := r.Form.Get("user")
 	pwd := r.Form.Get("password")
 
-	if Authenticate != nil {
-		ok := Authenticate(user, pwd)
-		if ok {
-			sess, err := Sess.Start(w, r)
-			if err != nil {
-				internalError(w, err)
-				return
-			}
+	if Authenticate == nil || !Authenticate(user, pwd) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"error":"wrong user name or password","request_id":%q}`+"\n", responseID(w))
+		return
+	}
 
-			if sess.IsLogin() {
-				return
-			}
-			sess.Login(user)
-		}
+	sess, err := Sess.Rotate(w, r)
+	if err != nil {
+		internalError(w, err)
+		return
 	}
+	sess.Login(user)
+	touchLogin(r.Context(), user)
+	RunHooks(EventLogin, map[string]interface{}{"user": user})
+	writeJSON(w, loginInfo{
+		Username:  user,
+		Admin:     IsAdmin == nil || IsAdmin(user),
+		Write:     readOnlyReason() == "",
+		CSRFToken: csrfToken(sess),
+	})
+}
+
+// loginInfo is the response of a successful login.
+type loginInfo struct {
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"` // may moderate and change the settings
+	Write    bool   `json:"write"` // may edit now, false while read-only
+
+	CSRFToken string `json:"csrf_token"` // for POST /logout, also sent by /status
 }
 
+// logout ends the session. POST needs the CSRF token of the session, see checkCSRF,
+// and answers {"ok":true,"username":"GUEST"}, also when there was no session to end.
+// GET only shows a page to confirm, so link prefetchers cannot log anyone out.
 func logout(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+	sess := Sess.sessionOf(r)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if sess == nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		logoutPage.Execute(w, csrfToken(sess))
+	case "POST":
+		if sess != nil && !checkCSRF(r, sess) {
+			http.Error(w, "missing or wrong CSRF token", http.StatusForbidden)
+			return
+		}
+		forgetDevice(w, r)
+		Sess.Destroy(w, r)
+		writeJSON(w, map[string]interface{}{"ok": true, "username": "GUEST"})
+	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
-	Sess.Destroy(w, r)
+}
+
+type statusSpace struct {
+	Recipe string `json:"recipe"`
+}
+
+// statusInfo is the /status response.
+type statusInfo struct {
+	Username string      `json:"username"`
+	Space    statusSpace `json:"space"`
+
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Maintenance bool `json:"maintenance,omitempty"`
+	Banner   string `json:"banner,omitempty"`
+	Build    *BuildInfo `json:"build,omitempty"`
+
+	// of logged in users, from their Profile
+	DisplayName string `json:"display_name,omitempty"`
+	Role        string `json:"role,omitempty"` // admin or user
+	Theme       string `json:"theme,omitempty"`
+	LastLogin   string `json:"last_login,omitempty"`
+}
+
+func writeStatus(w http.ResponseWriter, user string, p *Profile) {
+	st := &statusInfo{
+		Username: user,
+		Space: statusSpace{"all"},
+		Build: Build,
+	}
+	if p != nil {
+		st.DisplayName, st.Theme, st.LastLogin = p.DisplayName, p.Theme, p.LastLogin
+		st.Role = userRole(user)
+	}
+	if reason := readOnlyReason(); reason != "" {
+		st.ReadOnly = true
+		st.Maintenance = maintenanceReason() != ""
+		st.Banner = reason
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(st)
+	if err != nil {
+		logError(w, err)
+	}
 }
 
 // status serves the status JSON.
@@ -179,12 +373,9 @@ func status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gusetret := []byte(`{"username":"GUEST","space":{"recipe":"all"}}`)
-
 	_, err := Sess.GetSID(r)
 	if err != nil { // do not add cookie
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(gusetret)
+		writeStatus(w, "GUEST", nil)
 		return
 	}
 
@@ -194,74 +385,237 @@ func status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
 	uid, ok := sess.Get("uid")
 	if ok {
-		ret := fmt.Sprintf(`{"username":"%s","space":{"recipe":"all"}}`, uid)
-		w.Write([]byte(ret))
+		user := fmt.Sprint(uid)
+		p, err := loadProfile(r.Context(), user)
+		if err != nil {
+			log.Println("[profile]", user, err)
+		}
+		w.Header().Set(CSRFHeader, csrfToken(sess))
+		writeStatus(w, user, p)
 	} else {
-		Sess.Destroy(w, r)
-		w.Write(gusetret)
+		Sess.DestroySession(w, sess)
+		writeStatus(w, "GUEST", nil)
 	}
 }
 
-// list serves a JSON list of (mostly) skinny tiddlers.
+// ListMaxLimit is the default and largest ?limit= of a page of the tiddler list.
+var ListMaxLimit = 1000
+
+// NextPageHeader tells the ?after= of the next page of the tiddler list, URL encoded;
+// it is missing on the last page.
+const NextPageHeader = "X-Next-After"
+
+// list serves a JSON list of (mostly) skinny tiddlers, sorted by title
+// or by ?sort=title|modified|created&order=asc|desc.
+// With ?limit= or ?after= it serves a page of the list in title order, see listPage.
 func list(w http.ResponseWriter, r *http.Request) {
-	_, err := Sess.GetSID(r)
-	if err == nil { // renew session
-		_, err := Sess.Start(w, r)
-		if err != nil {
-			internalError(w, err)
+	Sess.Renew(w, r)
+
+	q := r.URL.Query()
+	order, err := store.ParseOrder(q.Get("sort"), q.Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if q.Get("limit") != "" || q.Get("after") != "" {
+		listPage(w, r, order, hidden)
+		return
+	}
+	e, err := cachedList(r.Context(), hidden, order)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ContentSHA256Header, respCache.textSumOf(e))
+	writeCached(w, r, e)
+}
+
+// listPage serves at most ?limit= tiddlers of the list with a key after ?after= (from the start
+// when empty), so a large wiki can be read a page at a time. The pages are not cached.
+func listPage(w http.ResponseWriter, r *http.Request, order store.Order, hidden map[string]time.Time) {
+	q := r.URL.Query()
+	if !order.IsDefault() {
+		http.Error(w, "limit and after only work with the title order", http.StatusBadRequest)
+		return
+	}
+	limit := ListMaxLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
 			return
 		}
+		if limit <= 0 || n < limit {
+			limit = n
+		}
 	}
 
-	tiddlers, err := StoreDb.All(r.Context())
+	tiddlers, err := store.AllPage(r.Context(), StoreDb, q.Get("after"), limit)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	if limit > 0 && len(tiddlers) == limit {
+		w.Header().Set(NextPageHeader, url.QueryEscape(store.KeyOf(tiddlers[len(tiddlers)-1])))
+	}
+	tiddlers = withoutHidden(tiddlers, hidden)
 
 	w.Header().Set("Content-Type", "application/json")
-	gzw := TryGzipResponse(w, r)
-	defer gzw.Close()
-	err = json.NewEncoder(gzw).Encode(tiddlers)
+	err = json.NewEncoder(w).Encode(tiddlers)
 	if err != nil {
-		log.Println("ERR", err)
+		logError(w, err)
 	}
 }
 
+// cachedList returns the tiddler list without the hidden titles, from the response cache when possible.
+func cachedList(ctx context.Context, hidden map[string]time.Time, order store.Order) (*cacheEntry, error) {
+	key := "list"
+	if hidden != nil {
+		key = "list/guest"
+	}
+	if !order.IsDefault() {
+		key += fmt.Sprintf("/%s/%v", order.By, order.Desc)
+	}
+
+	return cached(key, CacheList, func() ([]byte, error) {
+		tiddlers, err := store.AllOrdered(ctx, StoreDb, order)
+		if err != nil {
+			return nil, err
+		}
+		tiddlers = withoutHidden(tiddlers, hidden)
+
+		var buf bytes.Buffer
+		err = json.NewEncoder(&buf).Encode(tiddlers)
+		return buf.Bytes(), err
+	})
+}
+
 // getTiddler serves a fat tiddler.
 func getTiddler(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
 
-	t, err := StoreDb.Get(r.Context(), key)
+	hide, err := isHidden(r, key)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	if hide {
+		http.NotFound(w, r)
+		return
+	}
+
+	if CacheTiddler {
+		if e := respCache.get("tiddler/" + key); e != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(ContentSHA256Header, respCache.textSumOf(e))
+			writeCached(w, r, e)
+			return
+		}
+	}
+	if ss, ok := StoreDb.(store.StreamStore); ok && StreamThreshold > 0 {
+		if getTiddlerStream(w, r, ss, key) {
+			return
+		}
+	}
 
-	data, err := t.MarshalJSON()
+	e, err := cached("tiddler/" + key, CacheTiddler, func() ([]byte, error) {
+		t, err := StoreDb.Get(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		return t.MarshalJSON()
+	})
+	if err == store.ErrNotFound {
+		if !serveCrossWiki(w, r, key) && !serveAlias(w, r, key) && !serveTemplate(w, r, key) {
+			http.NotFound(w, r)
+		}
+		return
+	}
 	if err != nil {
 		internalError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if len(data) > 1024 {
-		gzw := TryGzipResponse(w, r)
-		defer gzw.Close()
-		gzw.Write(data)
-	} else {
-		w.Write(data)
+	w.Header().Set(ContentSHA256Header, respCache.textSumOf(e))
+	writeCached(w, r, e)
+}
+
+// getTiddlerStream streams a tiddler larger than StreamThreshold without buffering (or caching) it.
+// It reports false, without writing anything, for smaller or missing tiddlers.
+func getTiddlerStream(w http.ResponseWriter, r *http.Request, ss store.StreamStore, key string) (bool) {
+	meta, text, size, err := ss.GetStream(r.Context(), key)
+	if err != nil {
+		return false
 	}
+	defer text.Close()
+	if size <= StreamThreshold {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", ContentSHA256Header) // known once the text is sent
+	h := sha256.New()
+	err = store.WriteFatJSON(w, meta, io.TeeReader(text, h))
+	if err != nil {
+		logError(w, err)
+		return true
+	}
+	w.Header().Set(ContentSHA256Header, hex.EncodeToString(h.Sum(nil)))
+	return true
+}
+
+// newPutTiddler fills the server side fields (bag, uuid) of a tiddler sent by the client.
+func newPutTiddler(ctx context.Context, key string, js map[string]interface{}) (store.Tiddler) {
+	js["bag"] = "bag"
+
+	isSys := strings.HasPrefix(key, "$:/")
+	isDraft := false
+	fields, ok := js["fields"].(map[string]interface{})
+	if ok {
+		_, isDraft = fields["draft.of"]
+	}
+	if !isDraft {
+		assignUUID(ctx, key, js)
+	}
+
+	return store.Tiddler{
+		Key:  key,
+		IsDraft: isDraft,
+		IsSys: isSys,
+
+		Js: js,
+	}
+}
+
+func setETag(w http.ResponseWriter, key string, rev int, sum []byte) {
+	w.Header().Set("ETag", etagOf(key, rev, sum))
+}
+
+// etagOf returns the TiddlyWeb ETag of revision rev of key, saved from a body with MD5 sum.
+func etagOf(key string, rev int, sum []byte) (string) {
+	return fmt.Sprintf(`"bag/%s/%d:%032x"`, url.QueryEscape(key), rev, sum)
 }
 
 // putTiddler saves a tiddler.
 func putTiddler(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
 
+	if ss, ok := StoreDb.(store.StreamStore); ok && StreamThreshold > 0 && r.ContentLength > StreamThreshold && !mustSanitize(r) {
+		putTiddlerStream(w, r, ss, key)
+		return
+	}
+
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
@@ -270,45 +624,111 @@ func putTiddler(w http.ResponseWriter, r *http.Request) {
 
 	var js map[string]interface{}
 	err = json.Unmarshal(buf, &js)
-	if err != nil {
+	if err != nil || js == nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	js["bag"] = "bag"
-
-	isSys := strings.HasPrefix(key, "$:/")
-	isDraft := false
-	fields, ok := js["fields"].(map[string]interface{})
-	if ok {
-		_, isDraft = fields["draft.of"]
+	text, _ := js["text"].(string)
+	if !checkTextSum(w, r, text) {
+		return
 	}
+	if !checkArchived(w, r, key, js) {
+		return
+	}
+	sanitizeFields(r, js)
+	stripFields(js)
+	old := oldText(r.Context(), key, js)
+	text, _ = js["text"].(string)
+	rev, err := StoreDb.Put(r.Context(), newPutTiddler(r.Context(), key, js))
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	notifyEdit(r, key, text, old)
+	trackEdit(r, key, rev <= 2) // new tiddlers start at revision 2
 
-	rev, err := StoreDb.Put(r.Context(), store.Tiddler{
-		//Meta: buf,
+	sum := md5.Sum(buf)
+	setETag(w, key, rev, sum[:])
+	w.Header().Set(ContentSHA256Header, textSum(text))
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		Key:  key,
-		IsDraft: isDraft,
-		IsSys: isSys,
+// putTiddlerStream saves a large tiddler, spooling its text to a temp file instead of memory.
+func putTiddlerStream(w http.ResponseWriter, r *http.Request, ss store.StreamStore, key string) {
+	h := md5.New()
+	js, text, err := parseStreamBody(io.TeeReader(r.Body, h))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(text.Name())
+	defer text.Close()
+	textHash, ok := checkStreamSum(w, r, text)
+	if !ok {
+		return
+	}
+	if !checkArchived(w, r, key, js) {
+		return
+	}
+	var body io.Reader = text
+	stripped, isImage, err := stripStream(js, text)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	mentioned, old := "", ""
+	if isImage {
+		body = strings.NewReader(stripped)
+		textHash = textSum(stripped)
+	} else {
+		mentioned, err = streamMentions(text)
+		if err == nil {
+			_, err = text.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if mentioned != "" {
+			old = oldStreamMentions(r.Context(), ss, key)
+		}
+	}
 
-		Js: js,
-	})
+	rev, err := ss.PutStream(r.Context(), newPutTiddler(r.Context(), key, js), body)
+	respCache.Invalidate()
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	notifyEdit(r, key, mentioned, old)
+	trackEdit(r, key, rev <= 2)
 
-	etag := fmt.Sprintf(`"bag/%s/%d:%032x"`, url.QueryEscape(key), rev, md5.Sum([]byte(buf)))
-	w.Header().Set("ETag", etag)
+	setETag(w, key, rev, h.Sum(nil))
+	w.Header().Set(ContentSHA256Header, textHash)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func tiddler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case "POST":
+		comment(w, r)
 	case "GET":
 		getTiddler(w, r)
 	case "PUT":
-		if !checkAuth(w, r) {
+		key := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
+		if _, logged := currentUser(r); !logged && isAnonTitle(key) {
+			if !checkWritable(w, r) || !checkAnon(w, r) {
+				return
+			}
+			putTiddler(w, r)
+			return
+		}
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		if !checkNotPrivate(w, key) || !checkSystemEdit(w, r, key) {
 			return
 		}
 		putTiddler(w, r)
@@ -323,15 +743,24 @@ func remove(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if !checkAuth(w, r) {
+	if !checkAuth(w, r) || !checkWritable(w, r) {
 		return
 	}
 
 	key := strings.TrimPrefix(r.URL.Path, "/bags/bag/tiddlers/")
+	if !checkNotPrivate(w, key) || !checkSystemEdit(w, r, key) || !checkArchived(w, r, key, nil) {
+		return
+	}
+	aliases := noteDelete(r.Context(), key)
 	err := StoreDb.Delete(r.Context(), key)
+	respCache.Invalidate()
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	aliases(r.Context())
+	user, _ := currentUser(r)
+	notify(r.Context(), user, "delete", key, "", "")
+	dropEdits(key)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -14,31 +14,52 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"../store"
+	"../store/flatFile"
 )
 
 type testStore struct {
-	get func(context.Context, string) (store.Tiddler, error)
-	all func(context.Context) ([]store.Tiddler, error)
+	get func(context.Context, string) (*store.Tiddler, error)
+	all func(context.Context) ([]*store.Tiddler, error)
 	put func(context.Context, store.Tiddler) (int, error)
 	del func(context.Context, string) error
 }
 
-func (ts *testStore) Get(ctx context.Context, key string) (store.Tiddler, error) {
+func (ts *testStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
 	if ts.get == nil {
-		return store.Tiddler{}, nil
+		return nil, store.ErrNotFound
 	}
 	return ts.get(ctx, key)
 }
 
-func (ts *testStore) All(ctx context.Context) ([]store.Tiddler, error) {
+func (ts *testStore) All(ctx context.Context) ([]*store.Tiddler, error) {
 	if ts.all == nil {
 		return nil, nil
 	}
@@ -59,8 +80,355 @@ func (ts *testStore) Delete(ctx context.Context, key string) error {
 	return ts.del(ctx, key)
 }
 
+func (ts *testStore) Close() error {
+	return nil
+}
+
+func (ts *testStore) SetMaxHistory(rev int) {
+}
+
+func (ts *testStore) SetMaxHistorySize(size int64) {
+}
+
+// memStore is a minimal in-memory TiddlerStore for benchmarks.
+type memStore struct {
+	lock sync.RWMutex
+	meta map[string][]byte
+	text map[string]string
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		meta: make(map[string][]byte),
+		text: make(map[string]string),
+	}
+}
+
+func (ms *memStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	key = store.StoreKey(key) // as the backends
+	meta, ok := ms.meta[key]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return store.NewTiddler(meta, []byte(ms.text[key]))
+}
+
+func (ms *memStore) All(_ context.Context) ([]*store.Tiddler, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	tiddlers := make([]*store.Tiddler, 0, len(ms.meta))
+	for _, meta := range ms.meta {
+		t, _ := store.NewTiddler(meta, nil)
+		tiddlers = append(tiddlers, t)
+	}
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+func (ms *memStore) Put(_ context.Context, tiddler store.Tiddler) (int, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	meta, err := (&store.Tiddler{Js: tiddler.Js}).MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+	key := store.StoreKey(tiddler.Key)
+	ms.meta[key] = meta
+	ms.text[key] = text
+	return 1, nil
+}
+
+func (ms *memStore) Delete(_ context.Context, key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key = store.StoreKey(key)
+	delete(ms.meta, key)
+	delete(ms.text, key)
+	return nil
+}
+
+func (ms *memStore) Close() error {
+	return nil
+}
+
+func (ms *memStore) SetMaxHistory(rev int) {
+}
+
+func (ms *memStore) SetMaxHistorySize(size int64) {
+}
+
+func setStore(db store.TiddlerStore) {
+	StoreDb = db
+	Invalidate()
+}
+
+// loginCookie returns the cookie of a new logged in session.
+func loginCookie(t testing.TB, user string) *http.Cookie {
+	sid, err := genSID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := Sess.newSession(sid, nil)
+	if sess == nil {
+		t.Fatal(ErrSessionLimit)
+	}
+	sess.Login(user)
+	return &http.Cookie{Name: CookieName, Value: sid}
+}
+
+// loginFrom logs user in through the login handler from the address and browser addr and agent.
+func loginFrom(t testing.TB, user string, addr string, agent string) *http.Cookie {
+	r := httptest.NewRequest("POST", "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=" + user + "&password=ok"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("User-Agent", agent)
+	r.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	login(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == CookieName {
+			return c
+		}
+	}
+	t.Fatalf("login %s: got %d", user, w.Code)
+	return nil
+}
+
+func TestAccountSessions(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { Authenticate = nil }()
+	Authenticate = func(user string, pwd string) bool { return pwd == "ok" }
+	laptop := loginFrom(t, "sessions-me", "192.0.2.1:1234", "Firefox")
+	loginFrom(t, "sessions-me", "198.51.100.7:1234", "Phone")
+	loginFrom(t, "sessions-other", "192.0.2.1:1234", "Firefox")
+
+	listSessions := func() []sessionInfo {
+		r := httptest.NewRequest("GET", "/account/sessions", nil)
+		r.AddCookie(laptop)
+		w := httptest.NewRecorder()
+		account(w, r)
+		var list []sessionInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("list: %d %s", w.Code, w.Body.String())
+		}
+		return list
+	}
+	list := listSessions()
+	if len(list) != 2 {
+		t.Fatalf("want 2 sessions, got %+v", list)
+	}
+	var phone sessionInfo
+	for _, s := range list {
+		switch {
+		case s.Current && s.IP == "192.0.2.1" && s.UserAgent == "Firefox":
+		case !s.Current && s.IP == "198.51.100.7" && s.UserAgent == "Phone":
+			phone = s
+		default:
+			t.Errorf("unexpected session %+v", s)
+		}
+		if s.Created.IsZero() || s.ID == laptop.Value {
+			t.Errorf("want the creation time and no SID, got %+v", s)
+		}
+	}
+
+	del := func(origin string) int {
+		r := httptest.NewRequest("DELETE", "/account/sessions/" + phone.ID, nil)
+		r.AddCookie(laptop)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		account(w, r)
+		return w.Code
+	}
+	if code := del("http://evil.example"); code != http.StatusForbidden {
+		t.Errorf("want a cross-site delete refused, got %d", code)
+	}
+	if code := del("http://example.com"); code != http.StatusNoContent {
+		t.Fatalf("want the phone logged out, got %d", code)
+	}
+	if list := listSessions(); len(list) != 1 || !list[0].Current {
+		t.Errorf("want the laptop session left, got %+v", list)
+	}
+	if code := del("http://example.com"); code != http.StatusNotFound {
+		t.Errorf("want 404 for a gone session, got %d", code)
+	}
+}
+
+func TestSessionBind(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { Authenticate = nil; SessionBind = "" }()
+	Authenticate = func(user string, pwd string) bool { return pwd == "ok" }
+	cookie := loginFrom(t, "me", "192.0.2.1:1234", "Firefox")
+
+	for _, tc := range []struct {
+		bind, addr, fwd string
+		ok             bool
+	}{
+		{"", "198.51.100.7:1", "", true},
+		{"ip", "192.0.2.1:2", "", true},
+		{"ip", "192.0.2.77:1", "", false},
+		{"subnet", "192.0.2.77:1", "", true},
+		{"subnet", "198.51.100.7:1", "", false},
+		{"subnet", "127.0.0.1:1", "192.0.2.9", true}, // behind a reverse proxy
+		{"subnet", "127.0.0.1:1", "198.51.100.7", false},
+	} {
+		SessionBind = tc.bind
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.RemoteAddr = tc.addr
+		if tc.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tc.fwd)
+		}
+		r.AddCookie(cookie)
+		if _, ok := currentUser(r); ok != tc.ok {
+			t.Errorf("bind %q from %s %s: want logged in %v", tc.bind, tc.addr, tc.fwd, tc.ok)
+		}
+	}
+}
+
+func TestSessionTTL(t *testing.T) {
+	setStore(newMemStore())
+	defer func(d time.Duration) { SessionTimeout = d }(SessionTimeout)
+	SessionTimeout = time.Hour
+	cookie := loginCookie(t, "me")
+
+	get := func(handler http.HandlerFunc, method string, cookie *http.Cookie) (*httptest.ResponseRecorder, sessionTTLState) {
+		r := httptest.NewRequest(method, "/session/ttl", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var st sessionTTLState
+		json.Unmarshal(w.Body.Bytes(), &st)
+		return w, st
+	}
+
+	if _, st := get(sessionTTL, "GET", nil); st.LoggedIn || st.TTL != 0 || st.Timeout != 3600 {
+		t.Errorf("guest: want no session, got %+v", st)
+	}
+	if w, _ := get(sessionKeepalive, "POST", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("guest keepalive: want 401, got %d", w.Code)
+	}
+
+	sid := cookie.Value
+	sess := Sess.getSession(sid)
+	sess.lock.Lock()
+	sess.t = time.Now().Add(2 * time.Minute) // idle for 58 minutes
+	sess.lock.Unlock()
+	sess.save()
+
+	w, st := get(sessionTTL, "GET", cookie)
+	if !st.LoggedIn || st.TTL > 120 || st.TTL < 100 || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("want about 2 minutes left, not extended, got %+v %v", st, w.Header())
+	}
+	if _, st := get(sessionTTL, "GET", cookie); st.TTL > 120 {
+		t.Errorf("want /session/ttl not to extend the session, got %+v", st)
+	}
+	if w, _ := get(sessionKeepalive, "GET", cookie); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want keepalive POST only, got %d", w.Code)
+	}
+	w, st = get(sessionKeepalive, "POST", cookie)
+	if w.Code != 200 || st.TTL < 3500 || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("want the session extended by an hour, got %d %+v", w.Code, st)
+	}
+	if _, st := get(sessionTTL, "GET", cookie); st.TTL < 3500 {
+		t.Errorf("want the extension saved, got %+v", st)
+	}
+}
+
+func TestDevicePairing(t *testing.T) {
+	setStore(newMemStore())
+	desktop := loginCookie(t, "pair-me")
+
+	r := httptest.NewRequest("POST", "/account/pair", nil)
+	r.AddCookie(desktop)
+	r.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	account(w, r)
+	var info pairInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("pair: %d %s", w.Code, w.Body.String())
+	}
+	if info.URL != "http://example.com/pair?code=" + info.Code || len(info.Code) != 9 {
+		t.Errorf("unexpected code %+v", info)
+	}
+
+	// opening the link must not use the code up
+	w = httptest.NewRecorder()
+	pair(w, httptest.NewRequest("GET", "/pair?code=" + info.Code, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), info.Code) {
+		t.Errorf("pair page: %d %s", w.Code, w.Body.String())
+	}
+
+	usePair := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/pair", strings.NewReader("name=Phone&code=" + url.QueryEscape(code)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		pair(w, r)
+		return w
+	}
+	w = usePair(strings.ToLower(strings.Replace(info.Code, "-", " ", 1)))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("pairing: %d %s", w.Code, w.Body.String())
+	}
+	var sid, device *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case CookieName:
+			sid = c
+		case DeviceCookieName:
+			device = c
+		}
+	}
+	if sid == nil || device == nil {
+		t.Fatalf("want a session and a device cookie, got %v", w.Result().Cookies())
+	}
+	if w := usePair(info.Code); w.Code != http.StatusForbidden {
+		t.Errorf("want a used code refused, got %d", w.Code)
+	}
+
+	// the device logs in again once its session expired
+	Sess.destroy(sid.Value)
+	phoneUser := func() (string, bool, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.AddCookie(sid)
+		r.AddCookie(device)
+		w := httptest.NewRecorder()
+		var user string
+		var ok bool
+		withDevice(func(w http.ResponseWriter, r *http.Request) { user, ok = currentUser(r) })(w, r)
+		return user, ok, w
+	}
+	if user, ok, w := phoneUser(); !ok || user != "pair-me" || len(w.Result().Cookies()) != 2 {
+		t.Fatalf("want the device logged in again, got %q %v %v", user, ok, w.Result().Cookies())
+	}
+
+	r = httptest.NewRequest("GET", "/account/devices", nil)
+	r.AddCookie(desktop)
+	w = httptest.NewRecorder()
+	account(w, r)
+	var list []deviceInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Name != "Phone" || list[0].Current {
+		t.Fatalf("devices: %d %s", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("DELETE", "/account/devices/" + list[0].ID, nil)
+	r.AddCookie(desktop)
+	r.Header.Set("Origin", "http://example.com")
+	w = httptest.NewRecorder()
+	account(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unpair: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok, _ := phoneUser(); ok {
+		t.Error("want an unpaired device logged out")
+	}
+}
+
 func TestIndex(t *testing.T) {
-	ServeIndex = func(w http.ResponseWriter, r *http.Request) {
+	ServeBase = func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/html")
 		w.Write([]byte("index"))
 	}
@@ -81,6 +449,7 @@ func TestIndex(t *testing.T) {
 }
 
 func TestStatus(t *testing.T) {
+	setStore(newMemStore())
 	r := httptest.NewRequest("GET", "/status", nil)
 	w := httptest.NewRecorder()
 	status(w, r)
@@ -91,21 +460,162 @@ func TestStatus(t *testing.T) {
 	if want := "application/json"; ct != want {
 		t.Errorf("want %s, got %v", want, ct)
 	}
-	body := w.Body.String()
-	if want := `{"username":"me","space":{"recipe":"all"}}`; body != want {
+	body := strings.TrimRight(w.Body.String(), "\n")
+	if want := `{"username":"GUEST","space":{"recipe":"all"}}`; body != want {
+		t.Errorf("want %q, got %q", want, body)
+	}
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	r.AddCookie(loginCookie(t, "me"))
+	w = httptest.NewRecorder()
+	status(w, r)
+	body = strings.TrimRight(w.Body.String(), "\n")
+	if want := `{"username":"me","space":{"recipe":"all"},"role":"admin"}`; body != want {
 		t.Errorf("want %q, got %q", want, body)
 	}
 }
 
+func TestProfile(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { Authenticate, IsAdmin = nil, nil }()
+	Authenticate = func(user string, pwd string) bool { return true }
+	IsAdmin = func(user string) bool { return false }
+
+	r := httptest.NewRequest("POST", "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=me&password=x"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	login(w, r)
+	cookie := w.Result().Cookies()[0]
+
+	r = httptest.NewRequest("PUT", "/account/profile", strings.NewReader(`{"display_name":"Me Myself","theme":"$:/themes/tiddlywiki/snowwhite","last_login":"1"}`))
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	account(w, r)
+	if w.Code != 200 {
+		t.Fatalf("PUT profile: got %d %q", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	status(w, r)
+	var st statusInfo
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if st.DisplayName != "Me Myself" || st.Role != "user" || st.Theme != "$:/themes/tiddlywiki/snowwhite" || len(st.LastLogin) != 17 {
+		t.Errorf("status: got %+v", st)
+	}
+}
+
+func TestLoginRotatesSID(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { Authenticate = nil }()
+	Authenticate = func(user string, pwd string) bool { return pwd == "ok" }
+
+	planted, err := genSID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sess.newSession(planted, nil) // e.g. set by an attacker before the victim logs in
+
+	r := httptest.NewRequest("POST", "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=me&password=ok"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: planted})
+	w := httptest.NewRecorder()
+	login(w, r)
+
+	var sid string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == CookieName {
+			sid = c.Value
+		}
+	}
+	if sid == "" || sid == planted {
+		t.Fatalf("want a fresh SID, got %q", sid)
+	}
+	if Sess.getSession(planted) != nil {
+		t.Errorf("pre-login session kept")
+	}
+	if sess := Sess.getSession(sid); sess == nil || !sess.IsLogin() {
+		t.Errorf("new session not logged in")
+	}
+}
+
+func TestSIDValidation(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	count := func() int {
+		return Sess.Stats().Active
+	}
+	unknown, _ := genSID()
+
+	for _, sid := range []string{"crawler-junk", "x" + unknown, unknown[:10] + "!" + unknown[11:], unknown} {
+		before := count()
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: sid})
+		w := httptest.NewRecorder()
+		list(w, r)
+		if count() != before || len(w.Result().Cookies()) != 0 {
+			t.Errorf("%q: session created or renewed", sid)
+		}
+	}
+
+	// a stale cookie is answered as a guest, without leaving a session behind
+	for _, h := range []http.HandlerFunc{status, func(w http.ResponseWriter, r *http.Request) { checkAuth(w, r) }} {
+		before := count()
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: unknown})
+		h(httptest.NewRecorder(), r)
+		if count() != before {
+			t.Errorf("stale cookie: %d sessions left, want %d", count(), before)
+		}
+	}
+
+	cookie := loginCookie(t, "me")
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	list(w, r)
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("existing session not renewed")
+	}
+}
+
+func TestLoginResponse(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { Authenticate, IsAdmin = nil, nil }()
+	Authenticate = func(user string, pwd string) bool { return pwd == "ok" }
+	IsAdmin = func(user string) bool { return user == "boss" }
+
+	post := func(form string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login(w, r)
+		return w
+	}
+
+	w := post("user=joe&password=bad")
+	if w.Code != 401 || !strings.Contains(w.Body.String(), `"error"`) || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong password: want 401 JSON without cookie, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = post("user=joe&password=ok")
+	var info loginInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if w.Code != 200 || info.Username != "joe" || info.Admin || !info.Write {
+		t.Errorf("login: got %d %+v", w.Code, info)
+	}
+}
+
 func TestList(t *testing.T) {
-	Store = &testStore{
-		all: func(context.Context) ([]store.Tiddler, error) {
-			return []store.Tiddler{
-				{"tiddler1", []byte(`{"author":"robpike"}`), "", false},
-				{"tiddler2", []byte(`{"author":"bradfitz"}`), "text", false},
+	setStore(&testStore{
+		all: func(context.Context) ([]*store.Tiddler, error) {
+			return []*store.Tiddler{
+				{Meta: []byte(`{"author":"robpike"}`)},
+				{Meta: []byte(`{"author":"bradfitz"}`)},
 			}, nil
 		},
-	}
+	})
 	r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
 	w := httptest.NewRecorder()
 	list(w, r)
@@ -122,17 +632,97 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListOrder(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for _, td := range [][3]string{{"b", "20200101000000000", "20190101000000000"}, {"c", "20210101000000000", "20180101000000000"}, {"a", "20190101000000000", "20200101000000000"}} {
+		ms.Put(ctx, store.Tiddler{Key: td[0], Js: map[string]interface{}{"title": td[0], "modified": td[1], "created": td[2]}})
+	}
+
+	titles := func(query string) (string, int) {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json" + query, nil)
+		w := httptest.NewRecorder()
+		list(w, r)
+		var got []struct{ Title string }
+		json.Unmarshal(w.Body.Bytes(), &got)
+		s := ""
+		for _, td := range got {
+			s += td.Title
+		}
+		return s, w.Code
+	}
+	for query, want := range map[string]string{
+		"":                           "abc",
+		"?order=desc":                "cba",
+		"?sort=modified":             "abc",
+		"?sort=modified&order=desc":  "cba",
+		"?sort=created":              "cba",
+		"?sort=created&order=desc":   "abc",
+	} {
+		if got, code := titles(query); code != 200 || got != want {
+			t.Errorf("%q: want %q, got %d %q", query, want, code, got)
+		}
+	}
+	if _, code := titles("?sort=size"); code != 400 {
+		t.Errorf("unknown sort: want 400, got %d", code)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for _, title := range []string{"d", "b", "e", "a", "c"} {
+		ms.Put(ctx, store.Tiddler{Key: title, Js: map[string]interface{}{"title": title}})
+	}
+
+	page := func(query string) (string, string, int) {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json" + query, nil)
+		w := httptest.NewRecorder()
+		list(w, r)
+		var got []struct{ Title string }
+		json.Unmarshal(w.Body.Bytes(), &got)
+		s := ""
+		for _, td := range got {
+			s += td.Title
+		}
+		return s, w.Header().Get(NextPageHeader), w.Code
+	}
+	var all, after string
+	for n := 0; n < 5; n++ {
+		got, next, code := page("?limit=2&after=" + after)
+		if code != 200 {
+			t.Fatalf("page %d: want 200, got %d", n, code)
+		}
+		all += got
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if all != "abcde" {
+		t.Errorf("want abcde, got %q", all)
+	}
+	if got, next, _ := page("?after=b"); got != "cde" || next != "" {
+		t.Errorf("after b: want cde without next page, got %q %q", got, next)
+	}
+	for _, query := range []string{"?limit=0", "?limit=x", "?limit=2&sort=modified"} {
+		if _, _, code := page(query); code != 400 {
+			t.Errorf("%q: want 400, got %d", query, code)
+		}
+	}
+}
+
 func TestGetTiddler(t *testing.T) {
-	Store = &testStore{
-		get: func(_ context.Context, key string) (store.Tiddler, error) {
+	setStore(&testStore{
+		get: func(_ context.Context, key string) (*store.Tiddler, error) {
 			if key != "tiddler2" {
-				return store.Tiddler{}, nil
+				return nil, store.ErrNotFound
 			}
-			return store.Tiddler{
-				"tiddler2", []byte(`{"author":"bradfitz"}`), "text of the second tiddler", true,
-			}, nil
+			return store.NewTiddler([]byte(`{"author":"bradfitz"}`), []byte("text of the second tiddler"))
 		},
-	}
+	})
 	r := httptest.NewRequest("GET", "/recipes/all/tiddlers/tiddler2", nil)
 	w := httptest.NewRecorder()
 	tiddler(w, r)
@@ -144,34 +734,35 @@ func TestGetTiddler(t *testing.T) {
 		t.Errorf("want %s, got %v", want, ct)
 	}
 	body := w.Body.String()
-	if want := `{"author":"bradfitz","text":"text of the second tiddler"}`; body != want {
+	if want := `{"author":"bradfitz","bag":"bag","revision":1,"text":"text of the second tiddler"}`; body != want { // upgraded, see store.UpgradeMeta
 		t.Errorf("want %q, got %q", want, body)
 	}
 }
 
 func TestPutTiddler(t *testing.T) {
 	putCalled := false
-	Store = &testStore{
+	setStore(&testStore{
 		put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
 			putCalled = true
 			if tiddler.Key != "tiddler2" {
 				return 0, errors.New(`expected key to be "tiddler2"`)
 			}
-			if string(tiddler.Meta) != `{"author":"bradfitz","bag":"bag"}` {
-				return 0, errors.New(`expected meta to be ""`)
+			if tiddler.Js["author"] != "bradfitz" || tiddler.Js["bag"] != "bag" {
+				return 0, errors.New(`expected author "bradfitz" in bag "bag"`)
 			}
-			if tiddler.Text != "text of the second tiddler" {
+			if tiddler.Js["text"] != "text of the second tiddler" {
 				return 0, errors.New(`expected text to be "text of the second tiddler"`)
 			}
 			return 1, nil
 		},
-	}
+	})
 	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`
 		{
 			"author": "bradfitz",
 			"text" :"text of the second tiddler"
 		}
 	`))
+	r.AddCookie(loginCookie(t, "me"))
 	w := httptest.NewRecorder()
 	tiddler(w, r)
 	if w.Code != 204 {
@@ -186,9 +777,160 @@ func TestPutTiddler(t *testing.T) {
 	}
 }
 
+func TestPutTiddlerForbidden(t *testing.T) {
+	setStore(&testStore{})
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 403 {
+		t.Errorf("want 403 Forbidden, got %d", w.Code)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	setStore(&testStore{
+		put: func(context.Context, store.Tiddler) (int, error) {
+			t.Error("Store.Put called in read-only mode")
+			return 1, nil
+		},
+	})
+	atomic.StoreInt32(&lowDisk, 1)
+	defer atomic.StoreInt32(&lowDisk, 0)
+
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/tiddler2", strings.NewReader(`{}`))
+	r.AddCookie(loginCookie(t, "me"))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("want 507, got %d", w.Code)
+	}
+
+	defer func(dir string) { FilesDir = dir }(FilesDir)
+	FilesDir = t.TempDir()
+	ioutil.WriteFile(filepath.Join(FilesDir, "a.txt"), []byte("a"), 0644)
+	r = httptest.NewRequest("DELETE", "/files/a.txt", nil)
+	r.AddCookie(loginCookie(t, "me"))
+	w = httptest.NewRecorder()
+	files(w, r)
+	if _, err := os.Stat(filepath.Join(FilesDir, "a.txt")); w.Code != http.StatusInsufficientStorage || err != nil {
+		t.Errorf("file delete: want 507 and the file kept, got %d %v", w.Code, err)
+	}
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	status(w, r)
+	if body := w.Body.String(); !strings.Contains(body, `"read_only":true`) {
+		t.Errorf("want read_only in status, got %q", body)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	setStore(newMemStore())
+	ReadOnlyStore = true
+	defer func() { ReadOnlyStore = false }()
+
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Note", strings.NewReader(`{"title":"Note"}`))
+	r.AddCookie(loginCookie(t, "me"))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "read-only copy") {
+		t.Errorf("want 503 for a read-only copy, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	internalError(w, store.ErrReadOnly)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("want 503 for store.ErrReadOnly, got %d", w.Code)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	setStore(newMemStore())
+	defer func() { IsAdmin = nil; maintenance = maintenanceState{} }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	toggle := func(body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/maintenance?retry=60", strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		adminMaintenance(w, r)
+		return w
+	}
+	put := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Note", strings.NewReader(`{"title":"Note"}`))
+		r.AddCookie(loginCookie(t, "me"))
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+
+	if w := toggle("on", loginCookie(t, "joe")); w.Code != http.StatusForbidden {
+		t.Errorf("user: want 403, got %d", w.Code)
+	}
+	if w := toggle("maybe", loginCookie(t, "boss")); w.Code != http.StatusBadRequest {
+		t.Errorf("want 400 for a bad state, got %d", w.Code)
+	}
+	if w := toggle("on backup until 3:00", loginCookie(t, "boss")); w.Code != 200 || !strings.Contains(w.Body.String(), `"on":true`) {
+		t.Fatalf("want maintenance on, got %d %s", w.Code, w.Body.String())
+	}
+
+	w := put()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("want 503 with Retry-After 60, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	r := httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	status(w, r)
+	if body := w.Body.String(); !strings.Contains(body, `"maintenance":true`) || !strings.Contains(body, `"banner":"maintenance: backup until 3:00"`) {
+		t.Errorf("want the maintenance banner in status, got %q", body)
+	}
+
+	toggle("off", loginCookie(t, "boss"))
+	if w := put(); w.Code != http.StatusNoContent {
+		t.Errorf("want saves again after off, got %d", w.Code)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	h := withLogging(func(w http.ResponseWriter, r *http.Request) {
+		internalError(w, errors.New("boom"))
+	})
+	get := func(addr string, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers/Note", nil)
+		r.RemoteAddr = addr
+		if id != "" {
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := get("192.0.2.1:1234", "spoofed")
+	id := w.Header().Get(RequestIDHeader)
+	if len(id) != 16 {
+		t.Fatalf("want a new id, got %q", id)
+	}
+	if !strings.Contains(w.Body.String(), "(request " + id + ")") {
+		t.Errorf("want the id in the error, got %q", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "ERR [" + id + "] boom") || strings.Count(logs.String(), id) != 2 {
+		t.Errorf("want the request and its error logged with the id, got %q", logs.String())
+	}
+
+	if id := get("127.0.0.1:1234", "proxy-1.a_b").Header().Get(RequestIDHeader); id != "proxy-1.a_b" {
+		t.Errorf("want the id of the proxy kept, got %q", id)
+	}
+	if id := get("127.0.0.1:1234", "bad id\n").Header().Get(RequestIDHeader); len(id) != 16 {
+		t.Errorf("want a bad id replaced, got %q", id)
+	}
+}
+
 func TestDeleteTiddler(t *testing.T) {
 	delCalled := false
-	Store = &testStore{
+	setStore(&testStore{
 		del: func(_ context.Context, key string) error {
 			delCalled = true
 			if key != "tiddler2" {
@@ -196,8 +938,9 @@ func TestDeleteTiddler(t *testing.T) {
 			}
 			return nil
 		},
-	}
+	})
 	r := httptest.NewRequest("DELETE", "/bags/bag/tiddlers/tiddler2", nil)
+	r.AddCookie(loginCookie(t, "me"))
 	w := httptest.NewRecorder()
 	remove(w, r)
 	if w.Code != 204 {
@@ -207,3 +950,3059 @@ func TestDeleteTiddler(t *testing.T) {
 		t.Errorf("expected Store.Delete to be called")
 	}
 }
+
+// BenchmarkListSave measures a save followed by a full list through the whole mux.
+func BenchmarkListSave(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			ms := newMemStore()
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("Tiddler %06d", i)
+				ms.Put(context.Background(), store.Tiddler{
+					Key: key,
+					Js:  map[string]interface{}{"title": key, "tags": "bench", "text": "lorem ipsum"},
+				})
+			}
+			setStore(ms)
+
+			mux := NewRootMux()
+			InitHandle(mux)
+			cookie := loginCookie(b, "me")
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("Tiddler %06d", i%n)
+				r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/"+url.PathEscape(key), strings.NewReader(`{"title":"`+key+`","text":"edited"}`))
+				r.AddCookie(cookie)
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				if w.Code != http.StatusNoContent {
+					b.Fatalf("save: want 204, got %d", w.Code)
+				}
+
+				r = httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				w = httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("list: want 200, got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	defer func(list []*Plugin) { pluginlist = list }(pluginlist)
+	pluginlist = make([]*Plugin, 0)
+	defer setStore(StoreDb)
+	setStore(newMemStore())
+
+	order := func(name string) Middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Plugins", name)
+				next(w, r)
+			}
+		}
+	}
+	if err := RegPlugin(&Plugin{Name: "outer", Middleware: order("outer")}); err != nil {
+		t.Fatal(err)
+	}
+	err := RegPlugin(&Plugin{
+		Name:       "inner",
+		Middleware: order("inner"),
+		Routes: map[string]http.HandlerFunc{
+			"/hello": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegPlugin(&Plugin{Name: "OUTER", Middleware: order("x")}); err != ErrPluginExist {
+		t.Errorf("same name: want ErrPluginExist, got %v", err)
+	}
+	if err := RegPlugin(&Plugin{Name: "empty"}); err != ErrPluginEmpty {
+		t.Errorf("no middleware or routes: want ErrPluginEmpty, got %v", err)
+	}
+	if list := ListPlugin(); len(list) != 2 || list[0] != "outer" || list[1] != "inner" {
+		t.Errorf("want [outer inner], got %v", list)
+	}
+
+	mux := NewRootMux()
+	InitHandle(mux)
+	for path, body := range map[string]string{"/hello": "hello", "/status": `"username":"GUEST"`} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), body) {
+			t.Errorf("%s: want 200 with %s, got %d %s", path, body, w.Code, w.Body)
+		}
+		if got := w.Header()["X-Plugins"]; len(got) != 2 || got[0] != "outer" || got[1] != "inner" {
+			t.Errorf("%s: want middlewares outer then inner, got %v", path, got)
+		}
+	}
+}
+
+func TestHandlerBase(t *testing.T) {
+	h := Handler(Config{
+		Store: &testStore{},
+		ServeBase: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("index"))
+		},
+		Base: "/wiki/",
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/wiki/", h)
+
+	for path, want := range map[string]int{"/wiki/": 200, "/wiki/status": 200, "/status": 404} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: want %d, got %d", path, want, w.Code)
+		}
+	}
+}
+
+func TestLazyOpen(t *testing.T) {
+	defer func() { gate = nil }()
+	opens, jobs := 0, make(chan bool, 1)
+	h := Handler(Config{
+		Open: func() (store.TiddlerStore, error) {
+			opens++
+			if opens == 1 {
+				return nil, errors.New("not mounted yet")
+			}
+			return &testStore{}, nil
+		},
+		WarmUp: true,
+		OnReady: func() { jobs <- true },
+	})
+
+	get := func(path string) (int) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if code := get("/ready"); code != 503 || opens != 0 {
+		t.Fatalf("/ready: want 503 without opening, got %d after %d opens", code, opens)
+	}
+	if code := get("/status"); code != 503 {
+		t.Errorf("failed open: want 503, got %d", code)
+	}
+	if code := get("/status"); code != 200 {
+		t.Errorf("second open: want 200, got %d", code)
+	}
+	if code := get("/ready"); code != 200 || opens != 2 {
+		t.Errorf("/ready: want 200 after 2 opens, got %d after %d", code, opens)
+	}
+	select {
+	case <-jobs:
+	case <-time.After(time.Second):
+		t.Error("OnReady not called")
+	}
+	if respCache.get("list") == nil {
+		t.Error("want the list warmed up")
+	}
+}
+
+func TestRaw(t *testing.T) {
+	setStore(&testStore{
+		get: func(_ context.Context, key string) (*store.Tiddler, error) {
+			switch key {
+			case "logo.png":
+				return store.NewTiddler([]byte(`{"type":"image/png"}`), []byte("iVBORw0K"))
+			case "icon":
+				return store.NewTiddler([]byte(`{"type":"image/svg+xml"}`), []byte("<svg/>"))
+			}
+			return nil, store.ErrNotFound
+		},
+	})
+	for _, c := range []struct{ path, ct, body string }{
+		{"/raw/logo.png", "image/png", "\x89PNG\r\n"},
+		{"/raw/icon", "image/svg+xml", "<svg/>"},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		w := httptest.NewRecorder()
+		raw(w, r)
+		if ct := w.Header().Get("Content-Type"); ct != c.ct {
+			t.Errorf("%s: want %s, got %s", c.path, c.ct, ct)
+		}
+		if body := w.Body.String(); body != c.body {
+			t.Errorf("%s: want %q, got %q", c.path, c.body, body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/raw/missing", nil)
+	w := httptest.NewRecorder()
+	raw(w, r)
+	if w.Code != 404 {
+		t.Errorf("want 404, got %d", w.Code)
+	}
+}
+
+// memBlobs is a BlobBackend in memory, signing URLs when signed is set
+// and opening seekable files when seek is set.
+type memBlobs struct {
+	m      map[string][]byte
+	signed bool
+	seek   bool
+}
+
+type seekNopCloser struct {
+	*bytes.Reader
+}
+
+func (seekNopCloser) Close() error {
+	return nil
+}
+
+func (mb *memBlobs) Get(_ context.Context, name string) (io.ReadCloser, *BlobInfo, error) {
+	data, ok := mb.m[name]
+	if !ok {
+		return nil, nil, ErrBlobNotFound
+	}
+	if mb.seek {
+		return seekNopCloser{bytes.NewReader(data)}, &BlobInfo{Size: int64(len(data))}, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), &BlobInfo{Size: int64(len(data))}, nil
+}
+
+func (mb *memBlobs) Put(_ context.Context, name string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	mb.m[name] = data
+	return err
+}
+
+func (mb *memBlobs) Delete(_ context.Context, name string) error {
+	if _, ok := mb.m[name]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(mb.m, name)
+	return nil
+}
+
+func (mb *memBlobs) SignedURL(_ context.Context, name string, ttl time.Duration) (string, error) {
+	if !mb.signed {
+		return "", nil
+	}
+	return "https://blobs.example.com/" + name + "?expires=" + ttl.String(), nil
+}
+
+func (mb *memBlobs) Close() error {
+	return nil
+}
+
+func TestBlobFiles(t *testing.T) {
+	mb := &memBlobs{m: make(map[string][]byte)}
+	Blobs = mb
+	defer func() { Blobs = nil }()
+	setStore(newMemStore())
+	cookie := loginCookie(t, "me")
+	do := func(method string, path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		files(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/files/img/a.png", "png", nil); w.Code != 403 {
+		t.Errorf("guest PUT: want 403, got %d", w.Code)
+	}
+	if w := do("PUT", "/files/img/../img/a.png", "png", cookie); w.Code != 204 || string(mb.m["img/a.png"]) != "png" {
+		t.Fatalf("PUT: want 204, got %d %v", w.Code, mb.m)
+	}
+
+	w := do("GET", "/files/img/a.png", "", nil)
+	if w.Code != 200 || w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("proxied GET: got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	mb.signed = true
+	w = do("GET", "/files/img/a.png", "", nil)
+	if loc := w.Header().Get("Location"); w.Code != 302 || loc != "https://blobs.example.com/img/a.png?expires=15m0s" {
+		t.Errorf("signed GET: want redirect, got %d %q", w.Code, loc)
+	}
+	defer func(ttl time.Duration) { BlobURLTTL = ttl }(BlobURLTTL)
+	BlobURLTTL = 0
+	if w := do("GET", "/files/img/a.png", "", nil); w.Code != 200 {
+		t.Errorf("-files-url-ttl 0: want proxied, got %d", w.Code)
+	}
+
+	if w := do("DELETE", "/files/img/a.png", "", cookie); w.Code != 204 || len(mb.m) != 0 {
+		t.Errorf("DELETE: want 204, got %d", w.Code)
+	}
+	if w := do("GET", "/files/img/a.png", "", nil); w.Code != 404 {
+		t.Errorf("missing: want 404, got %d", w.Code)
+	}
+}
+
+func TestRange(t *testing.T) {
+	defer func(dir string) { FilesDir, Blobs = dir, nil }(FilesDir)
+	FilesDir = t.TempDir()
+	media := []byte("0123456789abcdef")
+	ioutil.WriteFile(filepath.Join(FilesDir, "a.ogg"), media, 0644)
+	ms := newMemStore()
+	setStore(ms)
+	ms.Put(context.Background(), store.Tiddler{Key: "clip", Js: map[string]interface{}{
+		"title": "clip", "type": "audio/ogg", "text": base64.StdEncoding.EncodeToString(media), "modified": "20200102030405000",
+	}})
+
+	get := func(h http.HandlerFunc, path string, rng string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	check := func(name string, h http.HandlerFunc, path string) {
+		if w := get(h, path, ""); w.Code != 200 || w.Header().Get("Accept-Ranges") != "bytes" || w.Body.String() != string(media) {
+			t.Errorf("%s: want whole file with Accept-Ranges, got %d %v", name, w.Code, w.Header())
+		}
+		w := get(h, path, "bytes=4-9")
+		if w.Code != 206 || w.Body.String() != "456789" || w.Header().Get("Content-Range") != "bytes 4-9/16" {
+			t.Errorf("%s: want 206 456789, got %d %q %v", name, w.Code, w.Body.String(), w.Header())
+		}
+		if w := get(h, path, "bytes=-3"); w.Code != 206 || w.Body.String() != "def" {
+			t.Errorf("%s: suffix: want 206 def, got %d %q", name, w.Code, w.Body.String())
+		}
+		if w := get(h, path, "bytes=20-"); w.Code != 416 {
+			t.Errorf("%s: want 416, got %d", name, w.Code)
+		}
+	}
+	check("raw", raw, "/raw/clip")
+	check("files", files, "/files/a.ogg")
+	Blobs = &memBlobs{m: map[string][]byte{"a.ogg": media}, seek: true}
+	check("blobs", files, "/files/a.ogg")
+
+	if w := get(raw, "/raw/clip", ""); w.Header().Get("Last-Modified") != "Thu, 02 Jan 2020 03:04:05 GMT" {
+		t.Errorf("raw: want Last-Modified of the tiddler, got %v", w.Header())
+	}
+	Blobs = &memBlobs{m: map[string][]byte{"a.ogg": media}}
+	if w := get(files, "/files/a.ogg", "bytes=4-9"); w.Code != 200 || w.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("unseekable blob: want 200 without ranges, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestThumb(t *testing.T) {
+	defer func(dir string, widths []int) { FilesDir, ThumbWidths = dir, widths }(FilesDir, ThumbWidths)
+	FilesDir = t.TempDir()
+	ThumbWidths = []int{16, 32}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	ioutil.WriteFile(filepath.Join(FilesDir, "a.png"), buf.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(FilesDir, "a.txt"), []byte("text"), 0644)
+
+	size := func(w *httptest.ResponseRecorder) image.Point {
+		cfg, err := png.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatalf("%d %q: %v", w.Code, w.Body.String(), err)
+		}
+		return image.Pt(cfg.Width, cfg.Height)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(path, "/raw/") {
+			raw(w, r)
+		} else {
+			files(w, r)
+		}
+		return w
+	}
+
+	for query, want := range map[string]image.Point{"": {64, 32}, "?w=10": {16, 8}, "?w=17": {32, 16}, "?w=33": {64, 32}, "?w=x": {64, 32}} {
+		if got := size(get("/files/a.png" + query)); got != want {
+			t.Errorf("%s: want %v, got %v", query, want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(FilesDir, ".thumbs", "16", "a.png")); err != nil {
+		t.Errorf("variant not cached: %v", err)
+	}
+	if w := get("/files/a.txt?w=16"); w.Body.String() != "text" {
+		t.Errorf("not an image: got %q", w.Body.String())
+	}
+
+	r := httptest.NewRequest("DELETE", "/files/a.png", nil)
+	r.AddCookie(loginCookie(t, "me"))
+	files(httptest.NewRecorder(), r)
+	if _, err := os.Stat(filepath.Join(FilesDir, ".thumbs", "16", "a.png")); !os.IsNotExist(err) {
+		t.Errorf("variant kept after DELETE: %v", err)
+	}
+
+	setStore(&testStore{
+		get: func(_ context.Context, key string) (*store.Tiddler, error) {
+			return store.NewTiddler([]byte(`{"type":"image/png"}`), []byte(base64.StdEncoding.EncodeToString(buf.Bytes())))
+		},
+	})
+	if got := size(get("/raw/logo?w=16")); got != image.Pt(16, 8) {
+		t.Errorf("tiddler: want 16x8, got %v", got)
+	}
+}
+
+func TestStripMeta(t *testing.T) {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	jpeg.Encode(&buf, img, nil)
+	plain := buf.Bytes()
+
+	exif := append(exifOrientation(6), "GPS 48.85N 2.35E"...)
+	binary.BigEndian.PutUint16(exif[2:], uint16(len(exif) - 2))
+	tagged := append([]byte{}, plain[:2]...)
+	tagged = append(tagged, exif...)
+	tagged = append(tagged, "\xff\xfe\x00\x0aComment!"...)
+	tagged = append(tagged, plain[2:]...)
+
+	out := stripImageMeta(tagged)
+	if bytes.Contains(out, []byte("GPS")) || bytes.Contains(out, []byte("Comment!")) {
+		t.Errorf("JPEG metadata kept")
+	}
+	if o := readOrientation(out[bytes.Index(out, []byte("Exif\x00\x00")) + 6:]); o != 6 {
+		t.Errorf("want orientation 6, got %d", o)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG: %v", err)
+	}
+	if out := stripImageMeta(plain); !bytes.Equal(out, plain) {
+		t.Errorf("JPEG without metadata changed")
+	}
+
+	buf.Reset()
+	png.Encode(&buf, img)
+	chunk := []byte("\x00\x00\x00\x0atEXtGPS\x0048.85N\x00\x00\x00\x00")
+	tagged = append(append(append([]byte{}, buf.Bytes()[:33]...), chunk...), buf.Bytes()[33:]...)
+	out = stripImageMeta(tagged)
+	if !bytes.Equal(out, buf.Bytes()) {
+		t.Errorf("PNG text chunk kept")
+	}
+}
+
+func TestStreamStripMeta(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStore(db)
+	defer func(n int64) { StreamThreshold = n }(StreamThreshold)
+	StreamThreshold = 16
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	plain := buf.Bytes()
+	exif := append(exifOrientation(1), "GPS 48.85N 2.35E"...)
+	binary.BigEndian.PutUint16(exif[2:], uint16(len(exif) - 2))
+	tagged := append(append(append([]byte{}, plain[:2]...), exif...), plain[2:]...)
+
+	body, _ := json.Marshal(map[string]interface{}{"title": "photo", "type": "image/jpeg", "text": base64.StdEncoding.EncodeToString(tagged)})
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/photo", bytes.NewReader(body))
+	r.AddCookie(loginCookie(t, "me"))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 204 {
+		t.Fatalf("want 204, got %d %q", w.Code, w.Body.String())
+	}
+
+	td, err := db.Get(context.Background(), "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := td.Fields()
+	text, _ := js["text"].(string)
+	data, _ := base64.StdEncoding.DecodeString(text)
+	if len(data) == 0 || bytes.Contains(data, []byte("GPS")) {
+		t.Errorf("streamed JPEG metadata kept: %d bytes", len(data))
+	}
+	if got := w.Header().Get(ContentSHA256Header); got != textSum(text) {
+		t.Errorf("want the sum of the stripped text, got %s", got)
+	}
+}
+
+func TestScanUpload(t *testing.T) {
+	defer func(dir string, scanners []Scanner) { FilesDir, Scanners = dir, scanners }(FilesDir, Scanners)
+	FilesDir = t.TempDir()
+	Scanners = []Scanner{func(_ context.Context, name string, r io.Reader) error {
+		data, _ := ioutil.ReadAll(r)
+		if bytes.Contains(data, []byte("EICAR")) {
+			return &ScanRejected{Reason: "Eicar-Test-Signature"}
+		}
+		if name == "down.txt" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	cookie := loginCookie(t, "me")
+	put := func(name string, body string) int {
+		r := httptest.NewRequest("PUT", "/files/" + name, strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		files(w, r)
+		return w.Code
+	}
+
+	if code := put("ok.txt", "hello"); code != 204 {
+		t.Errorf("clean: want 204, got %d", code)
+	}
+	if code := put("bad.txt", "X5O!P%@AP EICAR"); code != 422 {
+		t.Errorf("infected: want 422, got %d", code)
+	}
+	if code := put("down.txt", "hello"); code != 503 {
+		t.Errorf("scanner down: want 503, got %d", code)
+	}
+	for name, want := range map[string]bool{"ok.txt": true, "bad.txt": false, "down.txt": false} {
+		if _, err := os.Stat(filepath.Join(FilesDir, name)); (err == nil) != want {
+			t.Errorf("%s: want saved %v", name, want)
+		}
+	}
+}
+
+func TestStreamTiddler(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStore(db)
+	defer func(n int64) { StreamThreshold = n }(StreamThreshold)
+	StreamThreshold = 16
+
+	text := strings.Repeat("large \"tiddler\"\n", 100)
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+	body, _ := json.Marshal(map[string]interface{}{"title": "big", "text": text, "tags": "a"})
+	put := func(hash string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/big", bytes.NewReader(body))
+		r.AddCookie(loginCookie(t, "me"))
+		r.Header.Set(ContentSHA256Header, hash)
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+	if w := put(strings.Repeat("0", 64)); w.Code != 400 {
+		t.Errorf("wrong sum: want 400, got %d", w.Code)
+	}
+	w := put(sum)
+	if w.Code != 204 || w.Header().Get(ContentSHA256Header) != sum {
+		t.Fatalf("want 204 with the sum, got %d %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers/big", nil)
+	w = httptest.NewRecorder()
+	tiddler(w, r)
+	var js map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &js); err != nil {
+		t.Fatalf("%v: %q", err, w.Body.String())
+	}
+	if js["text"] != text || js["tags"] != "a" || js["bag"] != "bag" {
+		t.Errorf("round trip mismatch: %v", js)
+	}
+	if got := w.Result().Trailer.Get(ContentSHA256Header); got != sum {
+		t.Errorf("trailer: want %s, got %q", sum, got)
+	}
+}
+
+func TestContentSHA256(t *testing.T) {
+	setStore(newMemStore())
+	defer func(s bool) { Sanitize = s }(Sanitize)
+	Sanitize = true
+	defer func() { IsAdmin = nil }()
+	IsAdmin = func(user string) bool { return false }
+	cookie := loginCookie(t, "me")
+	do := func(method string, body string, hash string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/recipes/all/tiddlers/a", strings.NewReader(body))
+		r.AddCookie(cookie)
+		if hash != "" {
+			r.Header.Set(ContentSHA256Header, hash)
+		}
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+
+	sent := `<b>x</b><script>y()</script>`
+	body := `{"title":"a","type":"text/html","text":"<b>x</b><script>y()</script>"}`
+	if w := do("PUT", body, sum("other")); w.Code != 400 {
+		t.Errorf("mismatch: want 400, got %d", w.Code)
+	}
+	w := do("PUT", body, strings.ToUpper(sum(sent)))
+	if w.Code != 204 || w.Header().Get(ContentSHA256Header) != sum("<b>x</b>") {
+		t.Errorf("PUT: want 204 with the sum of the sanitized text, got %d %v", w.Code, w.Header())
+	}
+	for i := 0; i < 2; i++ { // stored, then cached
+		if w := do("GET", "", ""); w.Header().Get(ContentSHA256Header) != sum("<b>x</b>") {
+			t.Errorf("GET %d: got %v %s", i, w.Header(), w.Body.String())
+		}
+	}
+	if w := do("PUT", `{"title":"a"}`, ""); w.Code != 204 || w.Header().Get(ContentSHA256Header) != sum("") {
+		t.Errorf("no text: got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestDav(t *testing.T) {
+	setStore(newMemStore())
+	Authenticate = func(user, pwd string) bool { return user == "joe" && pwd == "secret" }
+	defer func() { Authenticate = nil }()
+
+	do := func(method, path, body string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth {
+			r.SetBasicAuth("joe", "secret")
+		}
+		w := httptest.NewRecorder()
+		dav(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/dav/Hello.tid", "tags: a\n\nhi", false); w.Code != 401 {
+		t.Errorf("PUT without auth: want 401, got %d", w.Code)
+	}
+	if w := do("PUT", "/dav/%24%253A%252Fconfig.tid", "title: ignored\n\nhi", true); w.Code != 201 {
+		t.Fatalf("PUT: want 201, got %d", w.Code)
+	}
+	if w := do("GET", "/dav/%24%253A%252Fconfig.tid", "", false); w.Body.String() != "title: $:/config\n\nhi" {
+		t.Errorf("GET: got %q", w.Body.String())
+	}
+
+	w := do("PROPFIND", "/dav/", "", false)
+	if w.Code != 207 || !strings.Contains(w.Body.String(), "<D:href>/dav/$%253A%252Fconfig.tid</D:href>") {
+		t.Errorf("PROPFIND: got %d %s", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest("MOVE", "/dav/%24%253A%252Fconfig.tid", nil)
+	r.SetBasicAuth("joe", "secret")
+	r.Header.Set("Destination", "http://example.com/dav/Renamed.tid")
+	w = httptest.NewRecorder()
+	dav(w, r)
+	if w.Code != 201 {
+		t.Errorf("MOVE: want 201, got %d", w.Code)
+	}
+	if w := do("GET", "/dav/Renamed.tid", "", false); w.Body.String() != "title: Renamed\n\nhi" {
+		t.Errorf("GET after MOVE: got %q", w.Body.String())
+	}
+
+	if w := do("DELETE", "/dav/Renamed.tid", "", true); w.Code != 204 {
+		t.Errorf("DELETE: want 204, got %d", w.Code)
+	}
+	if w := do("GET", "/dav/Renamed.tid", "", false); w.Code != 404 {
+		t.Errorf("GET after DELETE: want 404, got %d", w.Code)
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	for _, js := range []map[string]interface{}{
+		{"title": "Dentist, 2nd", "tags": []interface{}{"health"}, "fields": map[string]interface{}{"due": "2024-05-01"}},
+		{"title": "Call", "fields": map[string]interface{}{"event-date": "20240502093000000"}},
+		{"title": "No date"},
+		{"title": "Done", "tags": []interface{}{"done"}, "fields": map[string]interface{}{"due": "2024-05-03"}},
+	} {
+		ms.Put(context.Background(), store.Tiddler{Key: js["title"].(string), Js: js})
+	}
+	defer func() { CalendarFilter = nil }()
+	CalendarFilter, _ = ParseFilter("[!tag[done]]")
+
+	r := httptest.NewRequest("GET", "/calendar.ics", nil)
+	w := httptest.NewRecorder()
+	calendar(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		"SUMMARY:Dentist\\, 2nd\r\n", "DTSTART;VALUE=DATE:20240501\r\n", "CATEGORIES:health\r\n",
+		"SUMMARY:Call\r\n", "DTSTART:20240502T093000Z\r\n", "URL:http://example.com/#Call\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in %s", want, body)
+		}
+	}
+	if strings.Contains(body, "No date") || strings.Contains(body, "Done") {
+		t.Errorf("unexpected event in %s", body)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	for _, js := range []map[string]interface{}{
+		{"title": "Pancakes", "tags": []interface{}{"Recipe"}, "revision": 3, "text": "mix, fry", "fields": map[string]interface{}{"serves": "4"}},
+		{"title": "Bread", "tags": []interface{}{"Recipe", "baking"}, "text": "knead"},
+		{"title": "Note", "text": "x"},
+		{"title": "$:/config/x", "text": "y"},
+	} {
+		ms.Put(context.Background(), store.Tiddler{Key: js["title"].(string), Js: js})
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/export?" + query, nil)
+		w := httptest.NewRecorder()
+		export(w, r)
+		return w
+	}
+
+	w := get("filter=" + url.QueryEscape("[tag[Recipe]]") + "&format=csv")
+	want := "title,serves,tags,text\nBread,,Recipe baking,knead\nPancakes,4,Recipe,\"mix, fry\"\n"
+	if w.Body.String() != want {
+		t.Errorf("csv: want %q, got %q", want, w.Body.String())
+	}
+
+	w = get("fields=title,tags")
+	want = `[{"tags":"Recipe baking","title":"Bread"},{"title":"Note"},{"tags":"Recipe","title":"Pancakes"}]`
+	if w.Body.String() != want || w.Header().Get("Content-Disposition") != `attachment; filename="tiddlers.json"` {
+		t.Errorf("json: want %s, got %s", want, w.Body.String())
+	}
+
+	if w := get("filter=" + url.QueryEscape("[tag[x")); w.Code != 400 {
+		t.Errorf("bad filter: want 400, got %d", w.Code)
+	}
+	if w := get("format=xml"); w.Code != 400 {
+		t.Errorf("bad format: want 400, got %d", w.Code)
+	}
+}
+
+func TestEmbargo(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	future := time.Now().Add(time.Hour).UTC().Format("20060102150405000")
+	past := time.Now().Add(-time.Hour).UTC().Format("2006-01-02T15:04:05Z07:00")
+	for _, js := range []map[string]interface{}{
+		{"title": "Draft post", "fields": map[string]interface{}{"publish-at": future}},
+		{"title": "Old post", "fields": map[string]interface{}{"publish-at": past}},
+	} {
+		ms.Put(context.Background(), store.Tiddler{Key: js["title"].(string), Js: js})
+	}
+
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		switch {
+		case strings.HasPrefix(path, "/recipes/all/tiddlers/"):
+			getTiddler(w, r)
+		default:
+			list(w, r)
+		}
+		return w
+	}
+
+	body := get("/recipes/all/tiddlers.json", nil).Body.String()
+	if strings.Contains(body, "Draft post") || !strings.Contains(body, "Old post") {
+		t.Errorf("guest list: got %s", body)
+	}
+	if w := get("/recipes/all/tiddlers/Draft%20post", nil); w.Code != 404 {
+		t.Errorf("guest get: want 404, got %d", w.Code)
+	}
+
+	cookie := loginCookie(t, "me")
+	if body := get("/recipes/all/tiddlers.json", cookie).Body.String(); !strings.Contains(body, "Draft post") {
+		t.Errorf("user list: got %s", body)
+	}
+	if w := get("/recipes/all/tiddlers/Draft%20post", cookie); w.Code != 200 {
+		t.Errorf("user get: want 200, got %d", w.Code)
+	}
+
+	// the time passes
+	embargo.lock.Lock()
+	embargo.next = time.Now().Add(-time.Second)
+	embargo.until = nil
+	embargo.lock.Unlock()
+	ms.Put(context.Background(), store.Tiddler{Key: "Draft post", Js: map[string]interface{}{"title": "Draft post", "fields": map[string]interface{}{"publish-at": past}}})
+	if body := get("/recipes/all/tiddlers.json", nil).Body.String(); !strings.Contains(body, "Draft post") {
+		t.Errorf("guest list after publish: got %s", body)
+	}
+}
+
+func TestHiddenCase(t *testing.T) {
+	defer func(policy string) { store.TitleCase = policy }(store.TitleCase)
+	store.TitleCase = store.CaseInsensitive
+	ms := newMemStore()
+	setStore(ms)
+	future := time.Now().Add(time.Hour).UTC().Format("20060102150405000")
+	for _, js := range []map[string]interface{}{
+		{"title": "$:/widdly/users/admin", "text": "hash"},
+		{"title": "Draft Post", "fields": map[string]interface{}{"publish-at": future}},
+	} {
+		ms.Put(context.Background(), store.Tiddler{Key: js["title"].(string), Js: js})
+	}
+
+	for _, path := range []string{"/recipes/all/tiddlers/$:/Widdly/users/admin", "/recipes/all/tiddlers/draft%20post"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		getTiddler(w, r)
+		if w.Code != 404 {
+			t.Errorf("%s: want 404, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if w := httptest.NewRecorder(); checkNotPrivate(w, "$:/WIDDLY/users/eve") {
+		t.Errorf("put private: not refused")
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	link := func(title string) string { return "#" + url.PathEscape(title) }
+	for _, c := range []struct{ typ, text, want string }{
+		{"", "! Title\n\n''bold'' //it// [[A B]] [[txt|X]] `c<d>`", "<h1>Title</h1>\n<p><strong>bold</strong> <em>it</em> <a href=\"#A%20B\">A B</a> <a href=\"#X\">txt</a> <code>c&lt;d&gt;</code></p>\n"},
+		{"", "* a\n* b\n# c", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>\n"},
+		{"", "[ext[x|javascript:alert(1)]] <script>", "<p><a href=\"#\">x</a> &lt;script&gt;</p>\n"},
+		{"text/x-markdown", "## Sub\n**b** *i* [l](#My%20Note) ![p](files/a.png)", "<h2>Sub</h2>\n<p><strong>b</strong> <em>i</em> <a href=\"#My%20Note\">l</a> <img src=\"files/a.png\" alt=\"p\"></p>\n"},
+		{"text/x-markdown", "```\n<b>\n```", "<pre><code>&lt;b&gt;</code></pre>\n"},
+		{"application/json", "{\"a\":1}", "<pre>{&#34;a&#34;:1}</pre>"},
+	} {
+		if got := string(RenderText(c.typ, c.text, link)); got != c.want {
+			t.Errorf("%q: want %q, got %q", c.text, c.want, got)
+		}
+	}
+}
+
+func TestBlog(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	defer func(n int) { BlogPageSize = n }(BlogPageSize)
+	BlogPageSize = 1
+	for _, js := range []map[string]interface{}{
+		{"title": "First", "tags": []interface{}{"Public/Blog"}, "created": "20240101000000000", "text": "see [[Second]] and [[Wiki]]"},
+		{"title": "Second", "tags": []interface{}{"Public/Blog", "go"}, "created": "20240201000000000", "text": "''two''"},
+		{"title": "Private", "created": "20240301000000000", "text": "secret"},
+	} {
+		ms.Put(context.Background(), store.Tiddler{Key: js["title"].(string), Js: js})
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		blog(w, r)
+		return w
+	}
+
+	body := get("/blog/").Body.String()
+	if !strings.Contains(body, `<a href="./Second">Second</a>`) || strings.Contains(body, "First") || !strings.Contains(body, `href="?page=2"`) {
+		t.Errorf("index: got %s", body)
+	}
+	body = get("/blog/?page=2").Body.String()
+	if !strings.Contains(body, "First") || !strings.Contains(body, `href="?page=1"`) {
+		t.Errorf("page 2: got %s", body)
+	}
+	body = get("/blog/First").Body.String()
+	if !strings.Contains(body, `<a href="./Second">Second</a> and <a href="../#Wiki">Wiki</a>`) {
+		t.Errorf("post: got %s", body)
+	}
+	if w := get("/blog/Private"); w.Code != 404 {
+		t.Errorf("untagged: want 404, got %d", w.Code)
+	}
+	body = get("/blog/feed.atom").Body.String()
+	if !strings.Contains(body, "<id>http://example.com/blog/Second</id>") || !strings.Contains(body, "&lt;strong&gt;two&lt;/strong&gt;") || strings.Contains(body, "First") {
+		t.Errorf("feed: got %s", body)
+	}
+}
+
+func TestComments(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	ms.Put(context.Background(), store.Tiddler{Key: "Plan", Js: map[string]interface{}{"title": "Plan", "text": "x"}})
+	defer func() { CommentGuests, IsAdmin = false, nil }()
+	CommentGuests = true
+	IsAdmin = func(user string) bool { return user == "boss" }
+
+	post := func(path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+	list := func(query string, cookie *http.Cookie) []commentInfo {
+		r := httptest.NewRequest("GET", "/comments?" + query, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		comments(w, r)
+		var list []commentInfo
+		json.Unmarshal(w.Body.Bytes(), &list)
+		return list
+	}
+	joe, boss := loginCookie(t, "joe"), loginCookie(t, "boss")
+
+	w := post("/recipes/all/tiddlers/Plan/comments", `{"text":"nice","creator":"boss"}`, joe)
+	if w.Code != 201 {
+		t.Fatalf("user comment: want 201, got %d", w.Code)
+	}
+	var c commentInfo
+	json.Unmarshal(w.Body.Bytes(), &c)
+	if c.Author != "joe" || c.Status != "approved" || !strings.HasPrefix(c.Title, "Plan/comments/") {
+		t.Errorf("user comment: got %+v", c)
+	}
+
+	w = post("/recipes/all/tiddlers/Plan/comments", `{"text":"spam?","name":"Eve"}`, nil)
+	var g commentInfo
+	json.Unmarshal(w.Body.Bytes(), &g)
+	if w.Code != 201 || g.Status != "pending" || g.Author != "Eve (guest)" {
+		t.Errorf("guest comment: got %d %+v", w.Code, g)
+	}
+	if w := post("/recipes/all/tiddlers/Missing/comments", `{"text":"x"}`, joe); w.Code != 404 {
+		t.Errorf("missing tiddler: want 404, got %d", w.Code)
+	}
+
+	if l := list("title=Plan", nil); len(l) != 1 {
+		t.Errorf("guest list: want approved comment only, got %+v", l)
+	}
+	if l := list("status=pending", boss); len(l) != 1 || l[0].Title != g.Title {
+		t.Errorf("moderation queue: got %+v", l)
+	}
+
+	action := "/recipes/all/tiddlers/" + url.PathEscape(g.Title) + "/approve"
+	if w := post(action, "", joe); w.Code != 403 {
+		t.Errorf("approve by user: want 403, got %d", w.Code)
+	}
+	if w := post(action, "", boss); w.Code != 204 {
+		t.Errorf("approve by admin: want 204, got %d", w.Code)
+	}
+	if l := list("title=Plan", nil); len(l) != 2 {
+		t.Errorf("after approve: got %+v", l)
+	}
+
+	if w := post("/recipes/all/tiddlers/" + url.PathEscape(c.Title) + "/delete", "", joe); w.Code != 204 {
+		t.Errorf("delete own comment: want 204, got %d", w.Code)
+	}
+	if l := list("title=Plan", nil); len(l) != 1 {
+		t.Errorf("after delete: got %+v", l)
+	}
+
+	defer func(rate int) { AnonRate = rate }(AnonRate)
+	AnonRate = 1
+	guest := func() int {
+		r := httptest.NewRequest("POST", "/recipes/all/tiddlers/Plan/comments", strings.NewReader(`{"text":"again"}`))
+		r.RemoteAddr = "10.0.7.1:1234"
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w.Code
+	}
+	if code := guest(); code != 201 {
+		t.Errorf("guest comment: want 201, got %d", code)
+	}
+	if code := guest(); code != 429 {
+		t.Errorf("guest over the rate: want 429, got %d", code)
+	}
+}
+
+func TestStreamMentions(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStore(db)
+	resetWatchers()
+	defer func(n int64) { StreamThreshold = n }(StreamThreshold)
+	StreamThreshold = 16
+	defer func() { UserExists = nil }()
+	UserExists = func(user string) bool { return user == "ann" || user == "bob" }
+
+	put := func(text string) {
+		body, _ := json.Marshal(map[string]interface{}{"title": "Big", "text": text})
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Big", bytes.NewReader(body))
+		r.AddCookie(loginCookie(t, "me"))
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		if w.Code != 204 {
+			t.Fatalf("want 204, got %d", w.Code)
+		}
+	}
+	inbox := func(user string) (n int) {
+		var list []Notification
+		loadAccount(context.Background(), user, "notifications", &list)
+		for _, no := range list {
+			if no.Kind == "mention" && no.Title == "Big" {
+				n++
+			}
+		}
+		return n
+	}
+	filler := strings.Repeat("word ", 20000) // over a chunk of streamMentions
+	put(filler + "ask @ann\n" + filler)
+	if inbox("ann") != 1 || inbox("bob") != 0 {
+		t.Errorf("want ann mentioned, got ann %d bob %d", inbox("ann"), inbox("bob"))
+	}
+	put(filler + "ask @ann and @bob\n" + filler)
+	if inbox("ann") != 1 || inbox("bob") != 1 {
+		t.Errorf("want only bob newly mentioned, got ann %d bob %d", inbox("ann"), inbox("bob"))
+	}
+
+	got, _ := streamMentions(strings.NewReader("@ann x@bob (@bob) mail@ann.org"))
+	if got != " @ann @bob" {
+		t.Errorf("streamMentions: got %q", got)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	resetWatchers()
+	ms.Put(context.Background(), store.Tiddler{Key: "Plan", Js: map[string]interface{}{"title": "Plan", "text": "x"}})
+	defer func() { UserExists = nil }()
+	UserExists = func(user string) bool { return user == "ann" || user == "bob" }
+
+	do := func(method string, path string, body string, cookie *http.Cookie, h http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	inbox := func(cookie *http.Cookie) []Notification {
+		w := do("GET", "/account/notifications?unread=1", "", cookie, account)
+		var list []Notification
+		json.Unmarshal(w.Body.Bytes(), &list)
+		return list
+	}
+	ann, bob := loginCookie(t, "ann"), loginCookie(t, "bob")
+
+	if w := do("GET", "/account/notifications", "", nil, account); w.Code != 401 {
+		t.Errorf("guest: want 401, got %d", w.Code)
+	}
+	if w := do("PUT", "/account/watch/Plan", "", ann, account); w.Code != 204 {
+		t.Fatalf("watch: want 204, got %d", w.Code)
+	}
+
+	do("PUT", "/recipes/all/tiddlers/Plan", `{"text":"ask @bob, mail me@example.com"}`, ann, tiddler)
+	do("PUT", "/recipes/all/tiddlers/Plan", `{"text":"ask @bob again, @carol"}`, bob, tiddler)
+	do("PUT", "/recipes/all/tiddlers/Plan", `{"text":"still @bob"}`, ann, tiddler)
+
+	if l := inbox(bob); len(l) != 1 || l[0].Kind != "mention" || l[0].By != "ann" {
+		t.Errorf("bob: want one mention, got %+v", l)
+	}
+	if l := inbox(ann); len(l) != 1 || l[0].Kind != "change" || l[0].By != "bob" {
+		t.Errorf("ann: want one change by bob, got %+v", l)
+	}
+
+	if w := do("POST", "/account/notifications/read", "", ann, account); w.Code != 204 {
+		t.Errorf("mark read: want 204, got %d", w.Code)
+	}
+	if l := inbox(ann); len(l) != 0 {
+		t.Errorf("ann: want all read, got %+v", l)
+	}
+
+	if w := do("PUT", "/recipes/all/tiddlers/" + url.PathEscape(accountTitle("ann", "watch")), `{}`, bob, tiddler); w.Code != 403 {
+		t.Errorf("private tiddler write: want 403, got %d", w.Code)
+	}
+	w := do("GET", "/recipes/all/tiddlers.json", "", ann, list)
+	if strings.Contains(w.Body.String(), accountPrefix) {
+		t.Errorf("private tiddlers listed: %s", w.Body.String())
+	}
+	w = do("GET", "/account/watch", "", ann, account)
+	if strings.TrimSpace(w.Body.String()) != `["Plan"]` {
+		t.Errorf("watch list: got %s", w.Body.String())
+	}
+}
+
+func TestCompressedBody(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	cookie := loginCookie(t, "joe")
+	defer func(n int64) { MaxDecodedBody = n }(MaxDecodedBody)
+
+	put := func(enc string, body []byte) int {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Big", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", enc)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		withDecompress(tiddler)(w, r)
+		return w.Code
+	}
+
+	text := strings.Repeat("compress me ", 1000)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintf(gz, `{"title":"Big","text":%q}`, text)
+	gz.Close()
+
+	if code := put("gzip", buf.Bytes()); code != 204 {
+		t.Fatalf("gzip body: want 204, got %d", code)
+	}
+	if ms.text["Big"] != text {
+		t.Errorf("gzip body: text mangled, got %d bytes", len(ms.text["Big"]))
+	}
+	if code := put("br", buf.Bytes()); code != 415 {
+		t.Errorf("unknown encoding: want 415, got %d", code)
+	}
+	if code := put("gzip", []byte("not gzip")); code != 400 {
+		t.Errorf("broken gzip: want 400, got %d", code)
+	}
+
+	MaxDecodedBody = 1024
+	if code := put("gzip", buf.Bytes()); code == 204 {
+		t.Errorf("over the cap: want an error, got %d", code)
+	}
+}
+
+func TestPatchIndex(t *testing.T) {
+	defer func() { IndexCheck = true }()
+	IndexCheck = false // small test pages
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	old := []byte("<html><div id=storeArea>old tiddler</div></html>")
+	ioutil.WriteFile("index.html", old, 0644)
+
+	patch := func(base string, edits string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"base":%q,"edits":%s}`, base, edits)
+		r := httptest.NewRequest("PATCH", "/", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		patchIndex(w, r)
+		return w
+	}
+
+	w := patch(indexSum(old), `[{"at":24,"del":3,"ins":"new"},{"at":41,"del":0,"ins":"<!-- -->"}]`)
+	if w.Code != 200 {
+		t.Fatalf("want 200, got %d %s", w.Code, w.Body.String())
+	}
+	data, _ := ioutil.ReadFile("index.html")
+	if want := "<html><div id=storeArea>new tiddler</div><!-- --></html>"; string(data) != want {
+		t.Errorf("want %q, got %q", want, data)
+	}
+	if !strings.Contains(w.Body.String(), indexSum(data)) {
+		t.Errorf("want the new sha256, got %s", w.Body.String())
+	}
+
+	if w := patch(indexSum(old), `[]`); w.Code != 409 {
+		t.Errorf("stale base: want 409, got %d", w.Code)
+	}
+	if w := patch(indexSum(data), `[{"at":10,"del":1,"ins":""},{"at":5,"del":1,"ins":""}]`); w.Code != 400 {
+		t.Errorf("unsorted edits: want 400, got %d", w.Code)
+	}
+	if w := patch(indexSum(data), `[{"at":50,"del":99,"ins":""}]`); w.Code != 400 {
+		t.Errorf("edit past the end: want 400, got %d", w.Code)
+	}
+}
+
+func TestPutIndexIfMatch(t *testing.T) {
+	defer func() { IndexCheck = true }()
+	IndexCheck = false // small test pages
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	ioutil.WriteFile("index.html", []byte("v1"), 0644)
+	cookie := loginCookie(t, "joe")
+
+	do := func(method string, body string, ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.AddCookie(cookie)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		index(w, r)
+		return w
+	}
+
+	v1 := do("HEAD", "", "").Header().Get("ETag")
+	if v1 != `"` + indexSum([]byte("v1")) + `"` {
+		t.Fatalf("HEAD: got ETag %q", v1)
+	}
+
+	w := do("PUT", "v2 from tab A", v1)
+	v2 := w.Header().Get("ETag")
+	if w.Code != 200 || v2 == "" || v2 == v1 {
+		t.Fatalf("PUT: got %d, ETag %q", w.Code, v2)
+	}
+	if w := do("PUT", "v2 from tab B", v1); w.Code != 412 {
+		t.Errorf("stale If-Match: want 412, got %d", w.Code)
+	}
+	if data, _ := ioutil.ReadFile("index.html"); string(data) != "v2 from tab A" {
+		t.Errorf("overwritten: %q", data)
+	}
+	if w := do("PUT", "v3", ""); w.Code != 200 {
+		t.Errorf("no If-Match: want 200, got %d", w.Code)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	defer func() { IsAdmin = nil; applySettings(nil) }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	boss, joe := loginCookie(t, "boss"), loginCookie(t, "joe")
+
+	do := func(method string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/settings", strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		adminSettings(w, r)
+		return w
+	}
+
+	if w := do("GET", "", joe); w.Code != 403 {
+		t.Errorf("user: want 403, got %d", w.Code)
+	}
+	if w := do("PUT", `{"gzip_level": 0, "read_only": true, "max_history": -5}`, boss); w.Code != 400 {
+		t.Errorf("bad value: want 400, got %d", w.Code)
+	}
+	if gzipLevel() != GzipLevel || readOnlyReason() != "" {
+		t.Errorf("invalid change partly applied")
+	}
+	if w := do("PUT", `{"gzip": 1}`, boss); w.Code != 400 {
+		t.Errorf("unknown setting: want 400, got %d", w.Code)
+	}
+
+	if w := do("PUT", `{"gzip_level": 0, "read_only": true}`, boss); w.Code != 200 {
+		t.Fatalf("change: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	if gzipLevel() != 0 || readOnlyReason() == "" {
+		t.Errorf("change not applied: %+v", currentSettings())
+	}
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/x", strings.NewReader(`{}`))
+	r.AddCookie(joe)
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 503 {
+		t.Errorf("read-only: want 503, got %d", w.Code)
+	}
+
+	applySettings(nil) // as after a restart
+	loadSettings(context.Background())
+	if !currentSettings().ReadOnly {
+		t.Errorf("saved settings not loaded")
+	}
+
+	if w := do("DELETE", "", boss); w.Code != 204 {
+		t.Errorf("reset: want 204, got %d", w.Code)
+	}
+	if readOnlyReason() != "" || gzipLevel() != GzipLevel {
+		t.Errorf("reset: got %+v", currentSettings())
+	}
+}
+
+func TestServeIndex(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	defer func(files []string) { IndexFiles = files }(IndexFiles)
+	IndexFiles = []string{"main.html", "empty.html"}
+
+	get := func(gzip bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if gzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		serveIndex(w, r)
+		return w
+	}
+
+	w := get(false)
+	if w.Code != 404 || !strings.Contains(w.Body.String(), "main.html") {
+		t.Errorf("missing: want a setup page naming main.html, got %d %q", w.Code, w.Body.String())
+	}
+
+	ioutil.WriteFile("empty.html", []byte("<p>empty</p>"), 0644)
+	w = get(false)
+	if w.Body.String() != "<p>empty</p>" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("fallback: got %q %v", w.Body.String(), w.Header())
+	}
+
+	ioutil.WriteFile("main.html", []byte("<p>main</p>"), 0644)
+	ioutil.WriteFile("main.html.gz", []byte("precompressed"), 0644)
+	w = get(true)
+	if w.Body.String() != "precompressed" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("precompressed: got %q %v", w.Body.String(), w.Header())
+	}
+	if w := get(false); w.Body.String() != "<p>main</p>" {
+		t.Errorf("no gzip: got %q", w.Body.String())
+	}
+
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes("main.html.gz", old, old)
+	if w := get(true); w.Body.String() == "precompressed" {
+		t.Errorf("stale .gz served")
+	}
+}
+
+func TestIndexUpload(t *testing.T) {
+	defer func() { IndexCheck = true }()
+	IndexCheck = false // small test pages
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	ioutil.WriteFile("index.html", []byte("v1"), 0644)
+	defer func() { IsAdmin, IndexUpload = nil, "admin" }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+
+	put := func(user string) int {
+		r := httptest.NewRequest("PUT", "/", strings.NewReader("new page"))
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		index(w, r)
+		return w.Code
+	}
+
+	if code := put("joe"); code != 403 {
+		t.Errorf("editor: want 403, got %d", code)
+	}
+	if code := put("boss"); code != 200 {
+		t.Errorf("admin: want 200, got %d", code)
+	}
+	IndexUpload = "user"
+	if code := put("joe"); code != 200 {
+		t.Errorf("editor allowed: want 200, got %d", code)
+	}
+	IndexUpload = "off"
+	if code := put("boss"); code != 403 {
+		t.Errorf("disabled: want 403, got %d", code)
+	}
+}
+
+func TestIndexCheck(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	ioutil.WriteFile("index.html", []byte("old"), 0644)
+	padding := strings.Repeat("x", MinIndexSize)
+
+	put := func(page string) int {
+		r := httptest.NewRequest("PUT", "/", strings.NewReader(page))
+		r.AddCookie(loginCookie(t, "joe"))
+		w := httptest.NewRecorder()
+		index(w, r)
+		return w.Code
+	}
+
+	for _, page := range []string{
+		"<html>" + padding + `<div id="storeArea"></div>`,
+		"<!DOCTYPE html><p>hacked</p>" + padding,
+		`<!doctype html><div id="storeArea"></div>`,
+	} {
+		if code := put(page); code != 422 {
+			t.Errorf("%.30q: want 422, got %d", page, code)
+		}
+	}
+	if data, _ := ioutil.ReadFile("index.html"); string(data) != "old" {
+		t.Errorf("replaced by a rejected page")
+	}
+	if rejected, _ := filepath.Glob("index.html.rejected-*"); len(rejected) == 0 {
+		t.Errorf("rejected page not kept")
+	}
+
+	if code := put("\xef\xbb\xbf<!doctype html>\n" + padding + `<script class="tiddlywiki-tiddler-store" type="application/json">[]</script>`); code != 200 {
+		t.Errorf("TiddlyWiki page: want 200, got %d", code)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	s := NewSession()
+	defer s.Close()
+	defer func(n int) { SessionCountLimit = n }(SessionCountLimit)
+	SessionCountLimit = 3
+
+	user, _ := genSID()
+	s.newSession(user, nil).Login("me")
+	for i := 0; i < 10; i++ {
+		sid, _ := genSID()
+		if s.newSession(sid, nil) == nil {
+			t.Fatal("no session under the limit")
+		}
+	}
+
+	st := s.Stats()
+	if st.Active != 3 || st.Created != 11 || st.Evicted != 8 {
+		t.Errorf("want 3 active, 11 created, 8 evicted, got %+v", st)
+	}
+	if s.getSession(user) == nil {
+		t.Errorf("logged in session evicted before guests")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer func() { Metrics, MetricsToken = false, "" }()
+	get := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		metricsHandler(w, r)
+		return w
+	}
+
+	if w := get(""); w.Code != 404 {
+		t.Errorf("disabled: want 404, got %d", w.Code)
+	}
+	Metrics, MetricsToken = true, "s3cret"
+	if w := get("Bearer nope"); w.Code != 401 {
+		t.Errorf("bad token: want 401, got %d", w.Code)
+	}
+	w := get("Bearer s3cret")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "# TYPE widdly_sessions_evicted_total counter\n") {
+		t.Errorf("want metrics, got %d %q", w.Code, w.Body.String())
+	}
+
+	defer setStore(StoreDb)
+	setStore(statsStore{newMemStore()})
+	w = get("Bearer s3cret")
+	if !strings.Contains(w.Body.String(), "# TYPE widdly_store_file_bytes gauge\nwiddly_store_file_bytes 4096\n") {
+		t.Errorf("want the store gauges, got %q", w.Body.String())
+	}
+}
+
+// statsStore is a memStore reporting a fixed file size.
+type statsStore struct {
+	*memStore
+}
+
+func (statsStore) Stats(_ context.Context) ([]store.Stat, error) {
+	return []store.Stat{{Name: "file_bytes", Help: "Size of the file.", Value: 4096}}, nil
+}
+
+func TestResponseCache(t *testing.T) {
+	defer setStore(StoreDb)
+	ms := newMemStore()
+	setStore(ms)
+	ms.Put(context.Background(), store.Tiddler{Key: "A", Js: map[string]interface{}{"title": "A", "text": "one"}})
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if path == "/recipes/all/tiddlers.json" {
+			list(w, r)
+		} else {
+			tiddler(w, r)
+		}
+		return w.Body.String()
+	}
+
+	if body := get("/recipes/all/tiddlers/A"); !strings.Contains(body, `"one"`) {
+		t.Fatalf("want text one, got %s", body)
+	}
+	get("/recipes/all/tiddlers.json")
+
+	// a change behind the back of the handlers is not seen until the generation changes
+	ms.Put(context.Background(), store.Tiddler{Key: "A", Js: map[string]interface{}{"title": "A", "text": "two"}})
+	ms.Put(context.Background(), store.Tiddler{Key: "B", Js: map[string]interface{}{"title": "B", "text": "b"}})
+	if body := get("/recipes/all/tiddlers/A"); !strings.Contains(body, `"one"`) {
+		t.Errorf("tiddler not cached: %s", body)
+	}
+	if body := get("/recipes/all/tiddlers.json"); strings.Contains(body, `"B"`) {
+		t.Errorf("list not cached: %s", body)
+	}
+
+	// a save through the API starts a new generation
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/C", strings.NewReader(`{"title":"C","text":"c"}`))
+	r.AddCookie(loginCookie(t, "me"))
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	if w.Code != 204 {
+		t.Fatalf("save: want 204, got %d", w.Code)
+	}
+	if body := get("/recipes/all/tiddlers/A"); !strings.Contains(body, `"two"`) {
+		t.Errorf("stale tiddler after a save: %s", body)
+	}
+	if body := get("/recipes/all/tiddlers.json"); !strings.Contains(body, `"B"`) || !strings.Contains(body, `"C"`) {
+		t.Errorf("stale list after a save: %s", body)
+	}
+
+	defer func() { CacheList, CacheTiddler = true, true }()
+	CacheList, CacheTiddler = false, false
+	ms.Put(context.Background(), store.Tiddler{Key: "A", Js: map[string]interface{}{"title": "A", "text": "three"}})
+	ms.Put(context.Background(), store.Tiddler{Key: "D", Js: map[string]interface{}{"title": "D", "text": "d"}})
+	if body := get("/recipes/all/tiddlers/A"); !strings.Contains(body, `"three"`) {
+		t.Errorf("tiddler cached when disabled: %s", body)
+	}
+	if body := get("/recipes/all/tiddlers.json"); !strings.Contains(body, `"D"`) {
+		t.Errorf("list cached when disabled: %s", body)
+	}
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	defer setStore(StoreDb)
+	setStore(newMemStore())
+	before := respCache.Stats()
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		list(w, httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil))
+	}
+	st := respCache.Stats()
+	if st.Hits - before.Hits != 2 || st.Misses - before.Misses != 1 {
+		t.Errorf("want 2 hits and 1 miss, got %+v (before %+v)", st, before)
+	}
+	if (CacheStats{Hits: 3, Misses: 1}).HitRatio() != 0.75 || (CacheStats{}).HitRatio() != 0 {
+		t.Error("wrong hit ratio")
+	}
+}
+
+func TestSessionBackend(t *testing.T) {
+	shared := newMemSessions() // e.g. redis behind two instances
+	a, b := NewSessionWith(shared), NewSessionWith(shared)
+	defer a.Close()
+
+	sid, _ := genSID()
+	a.newSession(sid, nil).Login("me")
+
+	sess := b.getSession(sid)
+	if sess == nil || !sess.IsLogin() {
+		t.Fatalf("login not shared")
+	}
+	b.destroy(sid)
+	if a.getSession(sid) != nil {
+		t.Errorf("logout not shared")
+	}
+
+	if _, err := OpenSessionBackend("nope", ""); err != ErrSessionBackend {
+		t.Errorf("unknown backend: got %v", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	post := func(cookie *http.Cookie, hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/logout", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		for i := 0; i+1 < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		logout(w, r)
+		return w
+	}
+
+	cookie := loginCookie(t, "me")
+	if w := post(cookie); w.Code != 403 {
+		t.Errorf("no token: want 403, got %d", w.Code)
+	}
+	if w := post(cookie, "Origin", "http://evil.example"); w.Code != 403 {
+		t.Errorf("cross-site: want 403, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/logout", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	logout(w, r)
+	tok := Sess.getSession(cookie.Value).val["csrf"].(string)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), tok) || Sess.getSession(cookie.Value) == nil {
+		t.Fatalf("GET: want confirmation page, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := post(cookie, CSRFHeader, "wrong"); w.Code != 403 {
+		t.Errorf("wrong token: want 403, got %d", w.Code)
+	}
+	w = post(cookie, CSRFHeader, tok)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"ok":true`) || Sess.getSession(cookie.Value) != nil {
+		t.Errorf("logout: got %d %q", w.Code, w.Body.String())
+	}
+	if w := post(cookie, CSRFHeader, tok); w.Code != 200 {
+		t.Errorf("second logout: want 200, got %d", w.Code)
+	}
+
+	cookie = loginCookie(t, "me")
+	if w := post(cookie, "Origin", "http://example.com"); w.Code != 200 {
+		t.Errorf("same origin: want 200, got %d", w.Code)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	setStore(newMemStore())
+	cookie := loginCookie(t, "me")
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/account/preferences", strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		account(w, r)
+		return w
+	}
+
+	if w := do("GET", ""); w.Code != 200 || w.Body.String() != "{}" {
+		t.Errorf("GET: want {}, got %d %q", w.Code, w.Body.String())
+	}
+	for _, bad := range []string{"", "[1]", "null", `{"a":`} {
+		if w := do("PUT", bad); w.Code != 400 {
+			t.Errorf("PUT %q: want 400, got %d", bad, w.Code)
+		}
+	}
+	if w := do("PUT", `{"tags":["todo"],"editor":{"vim":true}}`); w.Code != 204 {
+		t.Fatalf("PUT: want 204, got %d", w.Code)
+	}
+	if w := do("GET", ""); w.Body.String() != `{"tags":["todo"],"editor":{"vim":true}}` {
+		t.Errorf("GET: got %q", w.Body.String())
+	}
+	if w := do("PUT", `{"x":"`+strings.Repeat("x", int(MaxPreferences))+`"}`); w.Code != 413 {
+		t.Errorf("too large: want 413, got %d", w.Code)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+
+	accs, err := OpenAccounts(ctx, ms)
+	if err != nil || len(accs.Names()) != 0 {
+		t.Fatalf("empty store: got %v %v", accs.Names(), err)
+	}
+	err = accs.Put(ctx, &UserRecord{Name: "me", Salt: "s", Hash: "h", Role: "user", Tokens: []string{"t1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accs.Put(ctx, &UserRecord{Name: "you", Salt: "s2", Hash: "h2"})
+
+	accs, err = OpenAccounts(ctx, ms) // as after a restart
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, ok := accs.Get("me")
+	if !ok || u.Hash != "h" || u.Role != "user" || len(u.Tokens) != 1 || strings.Join(accs.Names(), ",") != "me,you" {
+		t.Errorf("reopen: got %+v %v", u, accs.Names())
+	}
+	u.Tokens[0] = "changed"
+	if u, _ := accs.Get("me"); u.Tokens[0] != "t1" {
+		t.Errorf("Get returned the cached record")
+	}
+
+	if err := accs.Delete(ctx, "you"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := accs.Get("you"); ok {
+		t.Errorf("deleted account still there")
+	}
+
+	r := httptest.NewRequest("GET", "/recipes/all/tiddlers/"+url.PathEscape(usersPrefix+"me"), nil)
+	r.AddCookie(loginCookie(t, "me"))
+	w := httptest.NewRecorder()
+	getTiddler(w, r)
+	if w.Code != 404 {
+		t.Errorf("account served: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAnonEdit(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	defer func(prefix string, rate int, work int) {
+		AnonPrefix, AnonRate, AnonWork = prefix, rate, work
+	}(AnonPrefix, AnonRate, AnonWork)
+	AnonPrefix, AnonRate, AnonWork = "Guestbook/", 2, 0
+
+	put := func(title string, addr string, hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/"+url.PathEscape(title), strings.NewReader(`{"text":"hi","modifier":"boss"}`))
+		r.RemoteAddr = addr + ":1234"
+		for i := 0; i+1 < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+
+	if w := put("Home", "10.0.0.1"); w.Code != 403 {
+		t.Errorf("outside the prefix: want 403, got %d", w.Code)
+	}
+	if w := put("Guestbook/a", "10.0.0.1"); w.Code != 204 {
+		t.Fatalf("guest save: want 204, got %d %q", w.Code, w.Body.String())
+	}
+	tid, _ := ms.Get(context.Background(), "Guestbook/a")
+	if js, _ := tid.Fields(); js["modifier"] != AnonModifier {
+		t.Errorf("want modifier %s, got %v", AnonModifier, js["modifier"])
+	}
+	put("Guestbook/b", "10.0.0.1")
+	if w := put("Guestbook/c", "10.0.0.1"); w.Code != 429 {
+		t.Errorf("over the rate: want 429, got %d", w.Code)
+	}
+	if w := put("Guestbook/c", "10.0.0.2"); w.Code != 204 {
+		t.Errorf("other address: want 204, got %d", w.Code)
+	}
+
+	AnonWork = 8
+	if w := put("Guestbook/d", "10.0.0.3"); w.Code != 403 {
+		t.Errorf("no proof of work: want 403, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	anonChallenge(w, httptest.NewRequest("GET", "/anon/challenge", nil))
+	var ch struct {
+		Challenge string
+		Bits      int
+	}
+	json.Unmarshal(w.Body.Bytes(), &ch)
+	var proof string
+	for i := 0; ; i++ {
+		proof = ch.Challenge + ":" + strconv.Itoa(i)
+		if leadingZeros(sha256.Sum256([]byte(proof))) >= ch.Bits {
+			break
+		}
+	}
+	if w := put("Guestbook/d", "10.0.0.3", "X-Proof-Of-Work", proof); w.Code != 204 {
+		t.Errorf("proof of work: want 204, got %d %q", w.Code, w.Body.String())
+	}
+	if w := put("Guestbook/e", "10.0.0.3", "X-Proof-Of-Work", proof); w.Code != 403 {
+		t.Errorf("spent challenge: want 403, got %d", w.Code)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{`<p>hi</p>`, `<p>hi</p>`},
+		{`a<script>alert(1)</script>b`, `ab`},
+		{`<scr<script>x</script>ipt>alert(1)</script>`, `alert(1)`},
+		{`<img src=x onerror="alert(1)">`, `<img src=x>`},
+		{`<img/onerror=alert(1)>`, `<img>`},
+		{`<a title=">" onclick=x>y</a>`, `<a title=">">y</a>`},
+		{`<a href=" jav&#x61;script:alert(1)">y</a>`, `<a>y</a>`},
+		{`<a href="https://x.org/">y</a>`, `<a href="https://x.org/">y</a>`},
+		{`<IFRAME SRC="x"></IFRAME><embed src=x>`, ``},
+		{`<svg><a><animate attributeName="href" values="javascript:alert(1)"/><text>y</text></a></svg>`, `<svg><a><animate attributeName="href"/><text>y</text></a></svg>`},
+		{`<set attributeName=xlink:href to="x;&#x6a;avascript:alert(1)"/>`, `<set attributeName=xlink:href/>`},
+		{`<animate attributeName="width" values="0;10"/>`, `<animate attributeName="width" values="0;10"/>`},
+		{`<animate values="a;javascript:1" attributeName="HREF"/>`, `<animate attributeName="HREF"/>`},
+	} {
+		if got := sanitizeHTML(c.in); got != c.want {
+			t.Errorf("%q: want %q, got %q", c.in, c.want, got)
+		}
+	}
+
+	ms := newMemStore()
+	setStore(ms)
+	defer func() { Sanitize, IsAdmin = false, nil }()
+	Sanitize = true
+	IsAdmin = func(user string) bool { return user == "boss" }
+
+	put := func(user string, title string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/"+url.PathEscape(title), strings.NewReader(body))
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		return w
+	}
+	if w := put("joe", "$:/core/ui/Foo", `{"text":"x"}`); w.Code != 403 {
+		t.Errorf("system tiddler by a user: want 403, got %d", w.Code)
+	}
+	if w := put("joe", "$:/StoryList", `{"list":"A"}`); w.Code != 204 {
+		t.Errorf("story list by a user: want 204, got %d", w.Code)
+	}
+	if w := put("boss", "$:/core/ui/Foo", `{"text":"x"}`); w.Code != 204 {
+		t.Errorf("system tiddler by an admin: want 204, got %d", w.Code)
+	}
+
+	put("joe", "Page", `{"type":"text/html","text":"<b onclick=x>hi</b><script>1</script>"}`)
+	tid, _ := ms.Get(context.Background(), "Page")
+	if js, _ := tid.Fields(); js["text"] != "<b>hi</b>" {
+		t.Errorf("want sanitized text, got %q", js["text"])
+	}
+	put("boss", "Page", `{"type":"text/html","text":"<script>1</script>"}`)
+	tid, _ = ms.Get(context.Background(), "Page")
+	if js, _ := tid.Fields(); js["text"] != "<script>1</script>" {
+		t.Errorf("admin text changed: %q", js["text"])
+	}
+
+	// a guest claiming to be an admin without the password
+	defer func(prefix string, rate int, work int) {
+		AnonPrefix, AnonRate, AnonWork = prefix, rate, work
+	}(AnonPrefix, AnonRate, AnonWork)
+	AnonPrefix, AnonRate, AnonWork = "Guestbook/", 100, 0
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Guestbook%2Fx", strings.NewReader(`{"type":"text/html","text":"a<script>1</script>"}`))
+	r.SetBasicAuth("boss", "wrong")
+	r.RemoteAddr = "10.0.9.1:1234"
+	w := httptest.NewRecorder()
+	tiddler(w, r)
+	tid, _ = ms.Get(context.Background(), "Guestbook/x")
+	if tid == nil {
+		t.Fatalf("guest save: got %d %q", w.Code, w.Body.String())
+	}
+	if js, _ := tid.Fields(); js["text"] != "a" {
+		t.Errorf("forged Basic user: want sanitized text, got %q", js["text"])
+	}
+}
+
+func TestAdminPrefixes(t *testing.T) {
+	defer func(p []string) { AdminPrefixes = p }(AdminPrefixes)
+	AdminPrefixes = []string{"$:/", "!$:/state/", "Config/", "!Config/Mine/", "$:/state/lock/"}
+	for title, want := range map[string]bool{
+		"Home":                 false,
+		"$:/core":              true,
+		"$:/state/popup":       false,
+		"$:/state/lock/x":      true,
+		"Config/Site":          true,
+		"Config/Mine/Settings": false,
+	} {
+		if adminOnly(title) != want {
+			t.Errorf("%q: want %v", title, want)
+		}
+	}
+
+	setStore(newMemStore())
+	defer func() { IsAdmin = nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	r := httptest.NewRequest("DELETE", "/bags/bag/tiddlers/Config%2FSite", nil)
+	r.AddCookie(loginCookie(t, "joe"))
+	w := httptest.NewRecorder()
+	remove(w, r)
+	if w.Code != 403 {
+		t.Errorf("delete by a user: want 403, got %d", w.Code)
+	}
+}
+
+func TestGzipSkip(t *testing.T) {
+	defer func(level int) { GzipLevel = level }(GzipLevel)
+	GzipLevel = 5
+	serve := func(ct string, body string, code int) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		gzw := TryGzipResponse(w, r)
+		if ct != "" {
+			gzw.Header().Set("Content-Type", ct)
+		}
+		if code != 0 {
+			gzw.WriteHeader(code)
+		}
+		gzw.Write([]byte(body))
+		gzw.Close()
+		return w
+	}
+	big := strings.Repeat("tiddler ", GzipMinSize)
+
+	if w := serve("application/json", `{"username":"GUEST"}`, 0); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"username":"GUEST"}` {
+		t.Errorf("small body compressed")
+	}
+	if w := serve("image/png", big, 0); w.Header().Get("Content-Encoding") != "" || w.Body.String() != big {
+		t.Errorf("image compressed")
+	}
+	w := serve("", big, 201)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Code != 201 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("big text: got %d %v", w.Code, w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(zr); string(data) != big {
+		t.Errorf("big text mangled")
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	defer func(level int) { GzipLevel = level }(GzipLevel)
+	GzipLevel = 5
+
+	var flushed bool
+	h := withGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		flushed = w.Header().Get("Content-Encoding") == "gzip"
+		TryGzipResponse(w, r).Write([]byte("data: 2\n\n")) // nested, as in older handlers
+	})
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if !flushed || !w.Flushed {
+		t.Fatalf("flush did not start the stream")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(zr); string(data) != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("got %q", data)
+	}
+
+	h = withGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != 204 || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+		t.Errorf("204: got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestGzipAdaptive(t *testing.T) {
+	defer func(level int, busy int32) {
+		GzipLevel, GzipAdaptive = level, false
+		atomic.StoreInt32(&cpuBusy, busy)
+	}(GzipLevel, atomic.LoadInt32(&cpuBusy))
+	GzipLevel, GzipAdaptive = 6, true
+
+	level := func(addr string, fwd string, busy int32) int {
+		atomic.StoreInt32(&cpuBusy, busy)
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers.json", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Accept-Encoding", "gzip")
+		if fwd != "" {
+			r.Header.Set("X-Forwarded-For", fwd)
+		}
+		return gzipLevelFor(r)
+	}
+	for _, c := range []struct {
+		addr, fwd string
+		busy      int32
+		want      int
+	}{
+		{"203.0.113.5:1000", "", 100, 6},
+		{"203.0.113.5:1000", "", 500, 1},
+		{"203.0.113.5:1000", "", 900, 0},
+		{"192.168.1.20:1000", "", 0, 0},
+		{"[::1]:1000", "", 0, 0},
+		{"127.0.0.1:1000", "203.0.113.5, 10.0.0.1", 0, 6},
+		{"127.0.0.1:1000", "10.1.2.3", 0, 0},
+	} {
+		if got := level(c.addr, c.fwd, c.busy); got != c.want {
+			t.Errorf("%s %q load %d: want level %d, got %d", c.addr, c.fwd, c.busy, c.want, got)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func() { Build, IsAdmin = nil, nil }()
+	Build = &BuildInfo{Version: "202601011200", Commit: "abc1234", GoVersion: "go1.x"}
+	IsAdmin = func(user string) bool { return user == "boss" }
+
+	w := httptest.NewRecorder()
+	status(w, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(w.Body.String(), `"build":{"version":"202601011200","commit":"abc1234","go_version":"go1.x"}`) {
+		t.Errorf("status: got %q", w.Body.String())
+	}
+
+	for user, code := range map[string]int{"joe": 403, "boss": 200} {
+		r := httptest.NewRequest("GET", "/admin/stats", nil)
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		adminStats(w, r)
+		if w.Code != code {
+			t.Errorf("%s: want %d, got %d", user, code, w.Code)
+		}
+		if code == 200 && !strings.Contains(w.Body.String(), `"commit":"abc1234"`) {
+			t.Errorf("stats: got %q", w.Body.String())
+		}
+	}
+}
+
+func TestRetag(t *testing.T) {
+	defer func() { IsAdmin = nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for title, tags := range map[string]interface{}{
+		"A":                 []interface{}{"old", "x"},
+		"B":                 "[[old]] new",
+		"C":                 []interface{}{"x"},
+		"$:/widdly/private": []interface{}{"old"},
+	} {
+		ms.Put(ctx, store.Tiddler{Key: title, Js: map[string]interface{}{"title": title, "tags": tags, "text": "t"}})
+	}
+
+	retag := func(user string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/retag", strings.NewReader(body))
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		adminRetag(w, r)
+		return w
+	}
+	tagsOf := func(title string) []string {
+		td, _ := ms.Get(ctx, title)
+		js, _ := td.Fields()
+		return store.TagsOf(js["tags"])
+	}
+
+	if w := retag("joe", `{"from":"old","to":"new"}`); w.Code != 403 {
+		t.Errorf("user: want 403, got %d", w.Code)
+	}
+	if w := retag("boss", `{"from":"old","to":"old"}`); w.Code != 400 {
+		t.Errorf("same tag: want 400, got %d", w.Code)
+	}
+
+	w := retag("boss", `{"from":"old","to":"new","dry_run":true}`)
+	if want := `{"from":"old","to":"new","dry_run":true,"changed":["A","B"],"merged":["B"]}`; w.Body.String() != want {
+		t.Errorf("dry run: want %s, got %s", want, w.Body.String())
+	}
+	if tags := tagsOf("A"); tags[0] != "old" {
+		t.Errorf("dry run changed A: %q", tags)
+	}
+
+	w = retag("boss", `{"from":"old","to":"new"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"changed":["A","B"]`) {
+		t.Fatalf("retag: got %d %s", w.Code, w.Body.String())
+	}
+	for title, want := range map[string]string{"A": "new x", "B": "new", "C": "x", "$:/widdly/private": "old"} {
+		if got := strings.Join(tagsOf(title), " "); got != want {
+			t.Errorf("%s: want %q, got %q", title, want, got)
+		}
+	}
+	td, _ := ms.Get(ctx, "A")
+	if js, _ := td.Fields(); js["modifier"] != "boss" || js["text"] != "t" {
+		t.Errorf("A: got %v", js)
+	}
+}
+
+// auditStore is a memStore with a fixed history divergence.
+type auditStore struct {
+	*memStore
+	repaired bool
+}
+
+func (as *auditStore) Audit(_ context.Context, repair bool) ([]store.Divergence, error) {
+	if as.repaired {
+		return []store.Divergence{}, nil
+	}
+	as.repaired = repair
+	return []store.Divergence{{Key: "A", Head: 3, Latest: 4}}, nil
+}
+
+func TestAudit(t *testing.T) {
+	defer func() { IsAdmin = nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	audit := func(method string, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/audit", nil)
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		adminAudit(w, r)
+		return w
+	}
+
+	setStore(newMemStore())
+	if w := audit("GET", "boss"); w.Code != 501 {
+		t.Errorf("no AuditStore: want 501, got %d", w.Code)
+	}
+
+	as := &auditStore{memStore: newMemStore()}
+	setStore(as)
+	if w := audit("POST", "joe"); w.Code != 403 || as.repaired {
+		t.Errorf("user: want 403, got %d", w.Code)
+	}
+	w := audit("GET", "boss")
+	if want := `{"repaired":false,"diverged":[{"key":"A","head":3,"latest":4}]}`; w.Body.String() != want || as.repaired {
+		t.Errorf("list: want %s, got %s", want, w.Body.String())
+	}
+	w = audit("POST", "boss")
+	if !as.repaired || !strings.Contains(w.Body.String(), `"repaired":true`) {
+		t.Errorf("repair: got %d %s", w.Code, w.Body.String())
+	}
+	if w := audit("GET", "boss"); !strings.Contains(w.Body.String(), `"diverged":[]`) {
+		t.Errorf("after repair: got %s", w.Body.String())
+	}
+}
+
+// batchStore is a memStore with revisions and batches.
+type batchStore struct {
+	*memStore
+	revs map[string]int
+}
+
+func (bs *batchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	for i, op := range ops {
+		if err := store.CheckRev(ops, i, bs.revs[op.Tiddler.Key]); err != nil {
+			return nil, err
+		}
+	}
+	revs := make([]int, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			bs.Delete(ctx, op.Tiddler.Key)
+			delete(bs.revs, op.Tiddler.Key)
+			continue
+		}
+		bs.Put(ctx, op.Tiddler)
+		if bs.revs[op.Tiddler.Key] == 0 {
+			bs.revs[op.Tiddler.Key] = 1
+		}
+		bs.revs[op.Tiddler.Key]++
+		revs[i] = bs.revs[op.Tiddler.Key]
+	}
+	return revs, nil
+}
+
+func TestAtomic(t *testing.T) {
+	post := func(user string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/recipes/all/atomic", strings.NewReader(body))
+		if user != "" {
+			r.AddCookie(loginCookie(t, user))
+		}
+		w := httptest.NewRecorder()
+		atomicSave(w, r)
+		return w
+	}
+
+	setStore(newMemStore())
+	if w := post("joe", `[{"title":"A","tiddler":{}}]`); w.Code != 501 {
+		t.Errorf("no BatchStore: want 501, got %d", w.Code)
+	}
+
+	bs := &batchStore{memStore: newMemStore(), revs: map[string]int{}}
+	setStore(bs)
+	ctx := context.Background()
+	bs.Batch(ctx, []store.Op{{Tiddler: store.Tiddler{Key: "Old", Js: map[string]interface{}{"title": "Old"}}}})
+
+	if w := post("", `[{"title":"A","tiddler":{}}]`); w.Code != 403 {
+		t.Errorf("guest: want 403, got %d", w.Code)
+	}
+	w := post("joe", `[{"title":"A","tiddler":{}},{"title":"$:/widdly/x","tiddler":{}}]`)
+	if w.Code != 403 || w.Header().Get(AtomicItemHeader) != "1" {
+		t.Errorf("private: want 403 for item 1, got %d %q", w.Code, w.Header().Get(AtomicItemHeader))
+	}
+	if _, err := bs.Get(ctx, "A"); err == nil {
+		t.Errorf("private: want nothing saved")
+	}
+
+	w = post("joe", `[{"title":"A","tiddler":{"text":"a"}},{"title":"Data","tiddler":{"text":"d"}},{"title":"Old","delete":true,"if_match":"\"bag/Old/2:0\""}]`)
+	if w.Code != 200 {
+		t.Fatalf("save: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	var res []atomicResult
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res) != 3 || res[0].Revision != 2 || !strings.HasPrefix(res[1].ETag, `"bag/Data/2:`) || !res[2].Deleted {
+		t.Errorf("save: got %s", w.Body.String())
+	}
+	if _, err := bs.Get(ctx, "Old"); err == nil {
+		t.Errorf("save: want Old deleted")
+	}
+
+	w = post("joe", `[{"title":"B","tiddler":{}},{"title":"A","tiddler":{"text":"x"},"if_match":"` + strings.Replace(res[0].ETag, `"`, `\"`, -1) + `"},{"title":"Data","tiddler":{},"if_match":"1"}]`)
+	if w.Code != 412 || w.Header().Get(AtomicItemHeader) != "2" || !strings.Contains(w.Body.String(), `"revision":2`) {
+		t.Errorf("conflict: want 412 for item 2, got %d %q %s", w.Code, w.Header().Get(AtomicItemHeader), w.Body.String())
+	}
+	td, _ := bs.Get(ctx, "A")
+	if js, _ := td.Fields(); js["text"] != "a" {
+		t.Errorf("conflict: want A unchanged, got %v", js)
+	}
+	if _, err := bs.Get(ctx, "B"); err == nil {
+		t.Errorf("conflict: want B not saved")
+	}
+
+	// the aliases of the deletions change only when the batch is saved
+	for _, js := range []map[string]interface{}{
+		{"title": "New"},
+		{"title": "Gone"},
+		{"title": "Draft of 'Gone'", "draft.of": "Gone", "draft.title": "New"},
+	} {
+		bs.Batch(ctx, []store.Op{{Tiddler: store.Tiddler{Key: js["title"].(string), Js: js}}})
+	}
+	w = post("joe", `[{"title":"Gone","delete":true},{"title":"Data","tiddler":{},"if_match":"1"}]`)
+	if aliases, _ := loadAliases(ctx); w.Code != 412 || aliases["Gone"].To != "" {
+		t.Errorf("conflict: want 412 without alias, got %d %v", w.Code, aliases)
+	}
+	w = post("joe", `[{"title":"Gone","delete":true}]`)
+	if aliases, _ := loadAliases(ctx); w.Code != 200 || aliases["Gone"].To != "New" {
+		t.Errorf("delete: want 200 with the alias to New, got %d %v", w.Code, aliases)
+	}
+}
+
+func TestClip(t *testing.T) {
+	defer func() { ClipToken, ClipPrivate = "", false }()
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	page := `<html><head><title>Page &amp; Co</title><script>x()</script></head><body>
+<nav><p>Home | About</p></nav>
+<div class="wrap"><article><h1 class="big">Heading</h1>
+<p style="color:red" onclick="x()">` + strings.Repeat("Some words. ", 30) + `<a href="/other">link</a></p>
+<img src="img.png" alt="pic"></article></div>
+<footer><p>(c) me</p></footer></body></html>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	}))
+	defer srv.Close()
+
+	post := func(typ string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/clip", strings.NewReader(body))
+		r.Header.Set("Content-Type", typ)
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer " + auth)
+		}
+		w := httptest.NewRecorder()
+		clip(w, r)
+		return w
+	}
+	const js = "application/json"
+	if w := post(js, "", `{}`); w.Code != 404 {
+		t.Errorf("disabled: want 404, got %d", w.Code)
+	}
+	ClipToken = "secret"
+	if w := post(js, "wrong", `{"url":"` + srv.URL + `/a"}`); w.Code != 401 {
+		t.Errorf("bad token: want 401, got %d", w.Code)
+	}
+	if w := post(js, "secret", `{"url":"` + srv.URL + `/a"}`); w.Code != 502 {
+		t.Errorf("loopback: want 502, got %d", w.Code)
+	}
+	ClipPrivate = true
+
+	w := post(js, "secret", `{"url":"` + srv.URL + `/a/b","tags":"[[to read]]"}`)
+	if want := `{"title":"Page \u0026 Co","revision":1}` + "\n"; w.Code != 201 || w.Body.String() != want {
+		t.Fatalf("fetch: want 201 %s, got %d %s", want, w.Code, w.Body.String())
+	}
+	td, _ := ms.Get(ctx, "Page & Co")
+	fields, _ := td.Fields()
+	text, _ := fields["text"].(string)
+	if flat := store.FlatFields(fields); flat["type"] != "text/html" || flat["source"] != srv.URL + "/a/b" || flat["modifier"] != "clipper" {
+		t.Errorf("fetch: got %v", fields)
+	}
+	if tags := store.TagsOf(fields["tags"]); len(tags) != 2 || tags[0] != "Clipped" || tags[1] != "to read" {
+		t.Errorf("tags: got %q", tags)
+	}
+	for _, want := range []string{"<h1>Heading</h1>", "<p>Some words.", `<a href="` + srv.URL + `/other">`, `<img src="` + srv.URL + `/a/img.png" alt="pic">`} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text: want %s in %q", want, text)
+		}
+	}
+	for _, bad := range []string{"Home", "(c) me", "x()", "style", "class", "<div"} {
+		if strings.Contains(text, bad) {
+			t.Errorf("text: %s kept in %q", bad, text)
+		}
+	}
+
+	form := url.Values{"token": {"secret"}, "url": {srv.URL}, "title": {"Page & Co"}, "html": {`<b onmouseover="x()">picked</b><script>y()</script>`}}
+	w = post("application/x-www-form-urlencoded", "", form.Encode())
+	if loc := w.Header().Get("Location"); w.Code != 303 || loc != "/#Page%20&%20Co%20%282%29" {
+		t.Errorf("form: want 303 to the new tiddler, got %d %s", w.Code, loc)
+	}
+	td, _ = ms.Get(ctx, "Page & Co (2)")
+	if fields, _ = td.Fields(); fields["text"] != "<b>picked</b>" {
+		t.Errorf("selection: got %v", fields["text"])
+	}
+
+	for _, title := range []string{"$:/widdly/users/eve", "$:/core/ui/PageTemplate"} {
+		body, _ := json.Marshal(map[string]string{"url": srv.URL, "title": title, "html": "<p>x</p>"})
+		if w := post(js, "secret", string(body)); w.Code != 403 {
+			t.Errorf("%s: want 403, got %d", title, w.Code)
+		}
+		if _, err := ms.Get(ctx, title); err != store.ErrNotFound {
+			t.Errorf("%s: saved", title)
+		}
+	}
+}
+
+func TestQuick(t *testing.T) {
+	defer func() { Authenticate = nil }()
+	Authenticate = func(user string, pwd string) bool { return user == "me" && pwd == "pw" }
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	do := func(method string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/quick", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		quick(w, r)
+		return w
+	}
+
+	if w := do("GET", nil, nil); w.Code != 200 || !strings.Contains(w.Body.String(), `name="password"`) {
+		t.Errorf("guest: want login form, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", nil, url.Values{"user": {"me"}, "password": {"no"}}); w.Code != 401 {
+		t.Errorf("wrong password: want 401, got %d", w.Code)
+	}
+	w := do("POST", nil, url.Values{"user": {"me"}, "password": {"pw"}})
+	if w.Code != 303 || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("login: want 303 with cookie, got %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	w = do("GET", cookie, nil)
+	tok := Sess.getSession(cookie.Value).val["csrf"].(string)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), tok) || !strings.Contains(w.Body.String(), "<textarea") {
+		t.Fatalf("GET: want note form, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", cookie, url.Values{"text": {"hi"}}); w.Code != 403 {
+		t.Errorf("no token: want 403, got %d", w.Code)
+	}
+
+	note := url.Values{"csrf_token": {tok}, "title": {" Shopping  list "}, "text": {"milk\r\neggs"}, "tags": {"[[to do]]"}}
+	for i, want := range []string{"Shopping list", "Shopping list (2)"} {
+		w = do("POST", cookie, note)
+		if loc := w.Header().Get("Location"); w.Code != 303 || loc != "quick?saved=" + url.QueryEscape(want) {
+			t.Fatalf("save %d: want 303 to %s, got %d %s", i, want, w.Code, loc)
+		}
+		td, err := ms.Get(ctx, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, _ := td.Fields()
+		if js["text"] != "milk\neggs" || js["modifier"] != "me" || strings.Join(store.TagsOf(js["tags"]), ",") != "to do" {
+			t.Errorf("save %d: got %v", i, js)
+		}
+	}
+	r := httptest.NewRequest("GET", "/quick?saved=Shopping+list", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	quick(w, r)
+	if !strings.Contains(w.Body.String(), `Saved <a href="./#Shopping%20list">Shopping list</a>`) {
+		t.Errorf("saved: got %s", w.Body.String())
+	}
+
+	w = do("POST", cookie, url.Values{"csrf_token": {tok}, "text": {"untitled"}})
+	if w.Code != 303 || !strings.Contains(w.Header().Get("Location"), "Quick+note+") {
+		t.Errorf("untitled: got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestArchived(t *testing.T) {
+	defer func() { IsAdmin, Authenticate = nil, nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	Authenticate = func(user, pwd string) bool { return pwd == "pw" }
+	ms := newMemStore()
+	setStore(ms)
+	do := func(h http.HandlerFunc, method string, path string, user string, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if strings.HasPrefix(path, "/dav/") {
+			r.SetBasicAuth(user, "pw")
+		} else {
+			r.AddCookie(loginCookie(t, user))
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	put := func(user string, body string) int {
+		return do(tiddler, "PUT", "/recipes/all/tiddlers/Ref", user, body)
+	}
+
+	if code := put("joe", `{"title":"Ref","tags":"old","fields":{"archived":"yes"},"text":"v1"}`); code != 204 {
+		t.Fatalf("archiving: want 204, got %d", code)
+	}
+	for name, code := range map[string]int{
+		"user PUT":     put("joe", `{"title":"Ref","text":"v2"}`),
+		"admin PUT":    put("boss", `{"title":"Ref","fields":{"archived":"yes"},"text":"v2"}`),
+		"admin DELETE": do(remove, "DELETE", "/bags/bag/tiddlers/Ref", "boss", ""),
+		"dav PUT":      do(dav, "PUT", "/dav/Ref.tid", "joe", "\nv2"),
+		"dav DELETE":   do(dav, "DELETE", "/dav/Ref.tid", "boss", ""),
+		"dav MOVE":     do(func(w http.ResponseWriter, r *http.Request) { r.Header.Set("Destination", "/dav/New.tid"); dav(w, r) }, "MOVE", "/dav/Ref.tid", "boss", ""),
+	} {
+		if code != 423 {
+			t.Errorf("%s: want 423 Locked, got %d", name, code)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/admin/retag", strings.NewReader(`{"from":"old","to":"new"}`))
+	r.AddCookie(loginCookie(t, "boss"))
+	w := httptest.NewRecorder()
+	adminRetag(w, r)
+	if want := `{"from":"old","to":"new","dry_run":false,"changed":[],"merged":[],"skipped":["Ref"]}`; w.Body.String() != want {
+		t.Errorf("retag: want %s, got %s", want, w.Body.String())
+	}
+
+	td, _ := ms.Get(context.Background(), "Ref")
+	if js, _ := td.Fields(); js["text"] != "v1" {
+		t.Errorf("archived tiddler changed: %v", js)
+	}
+	if code := put("boss", `{"title":"Ref","text":"v2"}`); code != 204 {
+		t.Fatalf("admin clearing: want 204, got %d", code)
+	}
+	if code := put("joe", `{"title":"Ref","text":"v3"}`); code != 204 {
+		t.Errorf("user PUT after clearing: want 204, got %d", code)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	defer func() { Templates = nil; applySettings(nil) }()
+	rules, err := ParseTemplates("Journal/=$:/templates/Journal\nJournal/Work/=$:/templates/Work\ntag:Meeting=$:/templates/Meeting\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Templates = rules
+	if _, err := ParseTemplates("Journal/"); err == nil {
+		t.Errorf("rule without template: want error")
+	}
+	if _, err := ParseTemplates("x=$:/widdly/users/boss"); err == nil {
+		t.Errorf("private template: want error")
+	}
+
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for title, tags := range map[string]string{"$:/templates/Journal": "Journal", "$:/templates/Work": "Journal Work", "$:/templates/Meeting": ""} {
+		ms.Put(ctx, store.Tiddler{Key: title, Js: map[string]interface{}{
+			"title": title, "tags": tags, "text": "from " + title, "modified": "20200101000000000", "revision": 3,
+			"fields": map[string]interface{}{"mood": "", "draft.of": "x"},
+		}})
+	}
+	ms.Put(ctx, store.Tiddler{Key: "Journal/Existing", Js: map[string]interface{}{"title": "Journal/Existing", "text": "mine"}})
+
+	get := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+		var js map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &js)
+		return w, js
+	}
+	for path, want := range map[string]string{
+		"/recipes/all/tiddlers/Journal%2F2020-01-01":       "$:/templates/Journal",
+		"/recipes/all/tiddlers/Journal%2FWork%2FMonday":    "$:/templates/Work",
+		"/recipes/all/tiddlers/Standup?tag=x&tag=Meeting":  "$:/templates/Meeting",
+		"/recipes/all/tiddlers/Journal%2Fx?tag=Meeting":    "$:/templates/Journal",
+	} {
+		w, js := get(path)
+		if w.Code != 200 || w.Header().Get("X-Template") != want || js["text"] != "from " + want {
+			t.Errorf("%s: want %s, got %d %v %s", path, want, w.Code, w.Header(), w.Body.String())
+		}
+		if _, ok := js["modified"]; ok || js["revision"] != nil {
+			t.Errorf("%s: template dates and revision kept: %v", path, js)
+		}
+		if fields, _ := js["fields"].(map[string]interface{}); fields["draft.of"] != nil || fields["mood"] != "" {
+			t.Errorf("%s: fields: got %v", path, js["fields"])
+		}
+	}
+	_, js := get("/recipes/all/tiddlers/Standup?tag=Meeting&tag=Daily")
+	if js["title"] != "Standup" || strings.Join(store.TagsOf(js["tags"]), ",") != "Meeting,Daily" {
+		t.Errorf("retitled and tagged: got %v", js)
+	}
+	if _, js := get("/recipes/all/tiddlers/Journal%2FExisting"); js["text"] != "mine" {
+		t.Errorf("existing tiddler: got %v", js)
+	}
+	if w, _ := get("/recipes/all/tiddlers/Other"); w.Code != 404 {
+		t.Errorf("no rule: want 404, got %d", w.Code)
+	}
+	ms.Delete(ctx, "$:/templates/Work")
+	if w, _ := get("/recipes/all/tiddlers/Journal%2FWork%2FTuesday"); w.Code != 404 {
+		t.Errorf("missing template: want 404, got %d", w.Code)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	defer func() { IsAdmin, Authenticate = nil, nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	Authenticate = func(user, pwd string) bool { return pwd == "pw" }
+	setStore(newMemStore())
+	cookie := loginCookie(t, "me")
+	do := func(h http.HandlerFunc, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(cookie)
+		r.SetBasicAuth("me", "pw")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	put := func(title string, body string) {
+		if w := do(tiddler, "PUT", "/recipes/all/tiddlers/" + url.PathEscape(title), body); w.Code != 204 {
+			t.Fatalf("PUT %s: got %d", title, w.Code)
+		}
+	}
+	del := func(title string) {
+		if w := do(remove, "DELETE", "/bags/bag/tiddlers/" + url.PathEscape(title), ""); w.Code != 204 {
+			t.Fatalf("DELETE %s: got %d", title, w.Code)
+		}
+	}
+	// rename as TiddlyWiki saves it: draft, new title, delete the draft, delete the old title
+	rename := func(from string, to string, draftFirst bool) {
+		draft := "Draft of '" + from + "'"
+		put(draft, `{"title":"` + draft + `","fields":{"draft.of":"` + from + `","draft.title":"` + to + `"},"text":"x"}`)
+		put(to, `{"title":"` + to + `","text":"x"}`)
+		if draftFirst {
+			del(draft)
+			del(from)
+		} else {
+			del(from)
+			del(draft)
+		}
+	}
+	moved := func(path string) string {
+		w := do(tiddler, "GET", path, "")
+		if w.Code != 301 {
+			return fmt.Sprint(w.Code)
+		}
+		return w.Header().Get("Location")
+	}
+
+	put("Old", `{"title":"Old","text":"x"}`)
+	rename("Old", "New: name", true)
+	if loc := moved("/recipes/all/tiddlers/Old"); loc != "./New:%20name" {
+		t.Errorf("renamed: want redirect, got %s", loc)
+	}
+	if w := do(raw, "GET", "/raw/Old", ""); w.Code != 301 || w.Header().Get("Location") != "./New:%20name" {
+		t.Errorf("raw: want redirect, got %d %v", w.Code, w.Header())
+	}
+
+	rename("New: name", "Newest", false) // the old alias follows
+	for _, old := range []string{"Old", "New: name"} {
+		if loc := moved("/recipes/all/tiddlers/" + url.PathEscape(old)); loc != "./Newest" {
+			t.Errorf("%s: want redirect to Newest, got %s", old, loc)
+		}
+	}
+
+	put("Cancelled", `{"title":"Cancelled","text":"x"}`)
+	put("Draft of 'Cancelled'", `{"title":"Draft of 'Cancelled'","fields":{"draft.of":"Cancelled","draft.title":"Nope"},"text":"x"}`)
+	del("Draft of 'Cancelled'")
+	del("Cancelled")
+	if loc := moved("/recipes/all/tiddlers/Cancelled"); loc != "404" {
+		t.Errorf("rename never saved: want 404, got %s", loc)
+	}
+
+	put("Moved", `{"title":"Moved","text":"x"}`)
+	r := httptest.NewRequest("MOVE", "/dav/Moved.tid", nil)
+	r.Header.Set("Destination", "/dav/Target.tid")
+	r.SetBasicAuth("me", "pw")
+	w := httptest.NewRecorder()
+	dav(w, r)
+	if loc := moved("/recipes/all/tiddlers/Moved"); w.Code != 201 || loc != "./Target" {
+		t.Errorf("dav MOVE: want redirect, got %d %s", w.Code, loc)
+	}
+
+	w = do(aliasesHandler, "GET", "/aliases/", "")
+	var list map[string]Alias
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 3 || list["Old"].To != "Newest" || list["Moved"].To != "Target" {
+		t.Errorf("list: got %s", w.Body.String())
+	}
+	if w := do(aliasesHandler, "DELETE", "/aliases/Moved", ""); w.Code != 403 {
+		t.Errorf("user DELETE: want 403, got %d", w.Code)
+	}
+	cookie = loginCookie(t, "boss")
+	if w := do(aliasesHandler, "DELETE", "/aliases/Moved", ""); w.Code != 204 || moved("/recipes/all/tiddlers/Moved") != "404" {
+		t.Errorf("admin DELETE: got %d", w.Code)
+	}
+
+	del("Newest") // deleted, not renamed: the old titles go too
+	if loc := moved("/recipes/all/tiddlers/Old"); loc != "404" {
+		t.Errorf("target deleted: want 404, got %s", loc)
+	}
+}
+
+func TestUUIDs(t *testing.T) {
+	defer func() { UUIDs, Authenticate = false, nil }()
+	UUIDs = true
+	Authenticate = func(user, pwd string) bool { return pwd == "pw" }
+	setStore(newMemStore())
+	ctx := context.Background()
+	cookie := loginCookie(t, "me")
+	do := func(h http.HandlerFunc, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.AddCookie(cookie)
+		r.SetBasicAuth("me", "pw")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	put := func(title string, body string) {
+		if w := do(tiddler, "PUT", "/recipes/all/tiddlers/" + url.PathEscape(title), body); w.Code != 204 {
+			t.Fatalf("PUT %s: got %d", title, w.Code)
+		}
+	}
+	del := func(title string) {
+		if w := do(remove, "DELETE", "/bags/bag/tiddlers/" + url.PathEscape(title), ""); w.Code != 204 {
+			t.Fatalf("DELETE %s: got %d", title, w.Code)
+		}
+	}
+
+	put("A", `{"title":"A","text":"x"}`)
+	id := storedUUID(ctx, "A")
+	if len(id) != 36 || id[14] != '4' {
+		t.Fatalf("want a v4 uuid, got %q", id)
+	}
+	put("A", `{"title":"A","text":"y"}`) // a client which did not reload yet
+	if got := storedUUID(ctx, "A"); got != id {
+		t.Errorf("want the uuid kept, got %q", got)
+	}
+
+	// rename, the draft carries the field
+	fields := `"fields":{"uuid":"` + id + `"`
+	put("Draft of 'A'", `{"title":"Draft of 'A'",` + fields + `,"draft.of":"A","draft.title":"B"},"text":"x"}`)
+	put("B", `{"title":"B",` + fields + `},"text":"x"}`)
+	del("Draft of 'A'")
+	aliasMu.Lock()
+	pendingRenames = make(map[string]pendingRename) // the old title deleted much later
+	aliasMu.Unlock()
+	del("A")
+	if got := storedUUID(ctx, "B"); got != id {
+		t.Errorf("renamed: want %q, got %q", id, got)
+	}
+	if w := do(tiddler, "GET", "/recipes/all/tiddlers/A", ""); w.Code != 301 {
+		t.Errorf("want the old title an alias, got %d", w.Code)
+	}
+	w := do(uuidHandler, "GET", "/uuid/" + id, "")
+	if w.Code != 302 || w.Header().Get("Location") != "../recipes/all/tiddlers/B" {
+		t.Errorf("want a redirect to B, got %d %v", w.Code, w.Header())
+	}
+
+	put("Copy of B", `{"title":"Copy of B",` + fields + `},"text":"x"}`) // a clone
+	if got := storedUUID(ctx, "Copy of B"); got == id || got == "" {
+		t.Errorf("clone: want a new uuid, got %q", got)
+	}
+
+	r := httptest.NewRequest("MOVE", "/dav/B.tid", nil)
+	r.Header.Set("Destination", "/dav/C.tid")
+	r.SetBasicAuth("me", "pw")
+	dav(httptest.NewRecorder(), r)
+	if got := storedUUID(ctx, "C"); got != id {
+		t.Errorf("dav MOVE: want %q, got %q", id, got)
+	}
+	if w := do(uuidHandler, "GET", "/uuid/" + id, ""); w.Header().Get("Location") != "../recipes/all/tiddlers/C" {
+		t.Errorf("want a redirect to C, got %v", w.Header())
+	}
+	if w := do(uuidHandler, "GET", "/uuid/nope", ""); w.Code != 404 {
+		t.Errorf("unknown uuid: want 404, got %d", w.Code)
+	}
+}
+
+func TestCrossWiki(t *testing.T) {
+	common := newMemStore()
+	ctx := context.Background()
+	for _, title := range []string{"Shared", privatePrefix + "secret"} {
+		common.Put(ctx, store.Tiddler{Key: title, Js: map[string]interface{}{"title": title, "text": "common text"}})
+	}
+	Wikis["common"] = &Wiki{Name: "common", Store: common}
+	defer delete(Wikis, "common")
+	setStore(newMemStore())
+
+	get := func(title string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/recipes/all/tiddlers/" + url.PathEscape(title), nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		getTiddler(w, r)
+		return w
+	}
+	cookie := loginCookie(t, "me")
+
+	if w := get("common:Shared", nil); w.Code != 403 {
+		t.Errorf("guest: want 403, got %d", w.Code)
+	}
+	w := get("common:Shared", cookie)
+	var js map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &js)
+	if w.Code != 200 || js["title"] != "common:Shared" || js["bag"] != "common" || js["text"] != "common text" {
+		t.Errorf("want the common tiddler, got %d %s", w.Code, w.Body.String())
+	}
+	for _, title := range []string{"common:" + privatePrefix + "secret", "common:Missing", "other:Shared"} {
+		if w := get(title, cookie); w.Code != 404 {
+			t.Errorf("%s: want 404, got %d", title, w.Code)
+		}
+	}
+
+	Wikis["common"].Guests = true
+	if w := get("common:Shared", nil); w.Code != 200 {
+		t.Errorf("open to guests: want 200, got %d", w.Code)
+	}
+	StoreDb.Put(ctx, store.Tiddler{Key: "common:Shared", Js: map[string]interface{}{"title": "common:Shared", "text": "local"}})
+	if w := get("common:Shared", cookie); !strings.Contains(w.Body.String(), `"local"`) {
+		t.Errorf("want the local tiddler first, got %s", w.Body.String())
+	}
+}
+
+func TestParseHooks(t *testing.T) {
+	hooks, err := ParseHooks("# reindex\ntiddler-saved=/bin/reindex --quiet\n\nuser-login = log-login\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].Event != EventSaved || len(hooks[0].Command) != 2 || hooks[1].Command[0] != "log-login" {
+		t.Errorf("got %+v", hooks)
+	}
+	for _, bad := range []string{"tiddler-saved", "saved=/bin/true", "user-login= "} {
+		if _, err := ParseHooks(bad); err == nil {
+			t.Errorf("%q: want an error", bad)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	defer func(timeout time.Duration) { Hooks, HookTimeout = nil, timeout }(HookTimeout)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "events")
+	script := filepath.Join(dir, "hook.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n(echo \"$WIDDLY_EVENT\"; cat; echo) >> " + out + "\n"), 0755)
+	Hooks = []Hook{
+		{Event: EventSaved, Command: []string{"/bin/sh", script}},
+		{Event: EventLogin, Command: []string{"sleep", "10"}},
+	}
+	HookTimeout = 100 * time.Millisecond
+	defer func() { Authenticate = nil }()
+	Authenticate = func(user, pwd string) bool { return pwd == "pw" }
+	setStore(newMemStore())
+
+	cookie := loginCookie(t, "me")
+	r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/Hooked", strings.NewReader(`{"title":"Hooked","text":"x"}`))
+	r.AddCookie(cookie)
+	tiddler(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("POST", "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=me&password=pw"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	login(httptest.NewRecorder(), r)
+
+	start := time.Now()
+	hookWG.Wait()
+	if d := time.Since(start); d > 5 * time.Second {
+		t.Errorf("want the slow hook killed, waited %v", d)
+	}
+	data, _ := ioutil.ReadFile(out)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var ev map[string]interface{}
+	if len(lines) != 2 || lines[0] != EventSaved || json.Unmarshal([]byte(lines[1]), &ev) != nil {
+		t.Fatalf("want one tiddler-saved event, got %q", data)
+	}
+	if ev["event"] != EventSaved || ev["title"] != "Hooked" || ev["user"] != "me" || ev["time"] == nil {
+		t.Errorf("got %v", ev)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	defer func() { IsAdmin = nil }()
+	IsAdmin = func(user string) bool { return user == "boss" }
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for title, tags := range map[string]string{"Buy milk": "Task", "Call Bob": "Task Done", "Notes": ""} {
+		ms.Put(ctx, store.Tiddler{Key: title, Js: map[string]interface{}{"title": title, "tags": store.TagsOf(tags)}})
+	}
+
+	do := func(method string, path string, body string, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			r.AddCookie(loginCookie(t, user))
+		}
+		w := httptest.NewRecorder()
+		queries(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/queries/todo", `{"filter":"[tag[Task]!tag[Done]]"}`, ""); w.Code != 403 {
+		t.Errorf("guest PUT: want 403, got %d", w.Code)
+	}
+	if w := do("PUT", "/queries/todo", `{"filter":"[tag[Task]"}`, "joe"); w.Code != 400 {
+		t.Errorf("bad filter: want 400, got %d", w.Code)
+	}
+	if w := do("PUT", "/queries/todo", `{"filter":"[tag[Task]!tag[Done]]","description":"open tasks"}`, "joe"); w.Code != 200 {
+		t.Fatalf("PUT: want 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	w := do("GET", "/queries/todo/tiddlers.json", "", "")
+	var got []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0]["title"] != "Buy milk" {
+		t.Errorf("results: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/queries/", "", ""); !strings.Contains(w.Body.String(), `"name":"todo","filter":"[tag[Task]!tag[Done]]","description":"open tasks","owner":"joe"`) {
+		t.Errorf("list: got %s", w.Body.String())
+	}
+	if w := do("GET", "/queries/missing/tiddlers.json", "", ""); w.Code != 404 {
+		t.Errorf("missing: want 404, got %d", w.Code)
+	}
+
+	if w := do("PUT", "/queries/todo", `{"filter":"[tag[Task]]"}`, "ann"); w.Code != 403 {
+		t.Errorf("other user PUT: want 403, got %d", w.Code)
+	}
+	if w := do("PUT", "/queries/todo", `{"filter":"[tag[Task]]"}`, "boss"); w.Code != 200 || !strings.Contains(w.Body.String(), `"owner":"joe"`) {
+		t.Errorf("admin PUT: got %d %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/queries/todo/tiddlers.json", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 2 {
+		t.Errorf("results after change: got %s", w.Body.String())
+	}
+
+	if w := do("DELETE", "/queries/todo", "", "ann"); w.Code != 403 {
+		t.Errorf("other user DELETE: want 403, got %d", w.Code)
+	}
+	if w := do("DELETE", "/queries/todo", "", "joe"); w.Code != 204 {
+		t.Errorf("DELETE: want 204, got %d", w.Code)
+	}
+	if w := do("GET", "/queries/todo", "", ""); w.Code != 404 {
+		t.Errorf("deleted: want 404, got %d", w.Code)
+	}
+}
+
+// revStore is a memStore reading back a fixed history.
+type revStore struct {
+	*memStore
+}
+
+func (rs revStore) ListRevisions(_ context.Context, key string) ([]store.Revision, error) {
+	return []store.Revision{{Rev: 2, Modifier: "joe", Size: 5}, {Rev: 1, Size: 3}}, nil
+}
+
+func (rs revStore) GetRevision(_ context.Context, key string, rev int) (*store.Tiddler, error) {
+	return nil, store.ErrNotFound
+}
+
+func TestQuery(t *testing.T) {
+	defer func() { QueryAPI = false }()
+	ms := newMemStore()
+	setStore(revStore{ms})
+	ctx := context.Background()
+	for _, td := range []map[string]interface{}{
+		{"title": "Home", "tags": []interface{}{"Start"}, "text": "See [[Tasks]] and [[the list|Buy milk]], {{Footer}}", "revision": 3},
+		{"title": "Buy milk", "tags": []interface{}{"Task"}, "fields": map[string]interface{}{"due": "20260102"}, "text": "Back to [[Home]]"},
+		{"title": "Call Bob", "tags": []interface{}{"Task", "Phone"}, "fields": map[string]interface{}{"due": "20260101"}, "text": "[[Home]]"},
+		{"title": "$:/config/x", "text": "[[Home]]"},
+	} {
+		ms.Put(ctx, store.Tiddler{Key: td["title"].(string), Js: td})
+	}
+
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/query", strings.NewReader(body))
+		if method == "GET" {
+			r = httptest.NewRequest("GET", "/query?q=" + url.QueryEscape(body), nil)
+		}
+		w := httptest.NewRecorder()
+		query(w, r)
+		return w
+	}
+	if w := do("POST", `{}`); w.Code != 404 {
+		t.Errorf("disabled: want 404, got %d", w.Code)
+	}
+	QueryAPI = true
+
+	w := do("POST", `{"filter":"[tag[Task]]","fields":["due"],"sort":"due","links":true,"backlinks":true,"history":true,"tags":true,"limit":1}`)
+	want := `{"total":2,"tiddlers":[{"title":"Call Bob","revision":1,"fields":{"due":"20260101"},"tags":["Task","Phone"],"links":["Home"],"history":[{"revision":2,"modifier":"joe","size":5},{"revision":1,"size":3}]}],"tag_counts":{"Phone":1,"Task":2}}`
+	if w.Body.String() != want {
+		t.Errorf("want %s\ngot  %s", want, w.Body.String())
+	}
+
+	w = do("GET", `{"queries":{"home":{"filter":"Home","text":true,"links":true,"backlinks":true},"bad":{"filter":"[tag[x]"}}}`)
+	if w.Code != 400 {
+		t.Errorf("bad filter: want 400, got %d", w.Code)
+	}
+	w = do("GET", `{"queries":{"home":{"filter":"Home","text":true,"links":true,"backlinks":true},"all":{"offset":2}}}`)
+	var res map[string]*QueryResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	home := res["home"].Tiddlers[0]
+	if home.Revision != 3 || *home.Text != "See [[Tasks]] and [[the list|Buy milk]], {{Footer}}" ||
+		strings.Join(home.Links, ",") != "Tasks,Buy milk,Footer" || strings.Join(home.Backlinks, ",") != "$:/config/x,Buy milk,Call Bob" {
+		t.Errorf("home: got %+v", home)
+	}
+	if all := res["all"]; all.Total != 3 || len(all.Tiddlers) != 1 || all.Tiddlers[0].Title != "Home" {
+		t.Errorf("offset: got %+v", all)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	ms := newMemStore()
+	setStore(ms)
+	resetActivity()
+	defer resetActivity()
+
+	put := func(user string, title string) {
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/" + url.PathEscape(title), strings.NewReader(`{"title":"` + title + `"}`))
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		putTiddler(w, r)
+		if w.Code != 204 {
+			t.Fatalf("PUT %s: got %d", title, w.Code)
+		}
+	}
+	put("joe", "Journal")
+	put("joe", "Journal")
+	put("ann", "Ideas")
+	put("ann", "$:/StoryList")
+	put("ann", "Draft of 'Ideas'")
+
+	get := func(query string) map[string]interface{} {
+		r := httptest.NewRequest("GET", "/stats/activity" + query, nil)
+		r.AddCookie(loginCookie(t, "joe"))
+		w := httptest.NewRecorder()
+		statsActivity(w, r)
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%d %s", w.Code, w.Body.String())
+		}
+		return res
+	}
+	today := time.Now().Format("2006-01-02")
+	res := get("")
+	days, _ := json.Marshal(res["days"])
+	if want := `[{"created":3,"day":"` + today + `","modified":0}]`; string(days) != want {
+		t.Errorf("days: want %s, got %s", want, days)
+	}
+	top, _ := json.Marshal(res["top"])
+	if want := `[{"edits":2,"title":"Journal"},{"edits":1,"title":"Ideas"}]`; string(top) != want {
+		t.Errorf("top: want %s, got %s", want, top)
+	}
+	if res["current_streak"] != 1.0 || res["longest_streak"] != 1.0 {
+		t.Errorf("streaks: got %v %v", res["current_streak"], res["longest_streak"])
+	}
+	users, _ := json.Marshal(get("?user=ann")["users"])
+	if want := `{"ann":{"created":1,"modified":0}}`; string(users) != want {
+		t.Errorf("?user: want %s, got %s", want, users)
+	}
+	if days := get("?year=1999")["days"].([]interface{}); len(days) != 0 {
+		t.Errorf("?year: got %v", days)
+	}
+
+	FlushActivity()
+	if _, err := ms.Get(context.Background(), activityTitle); err != nil {
+		t.Errorf("activity not saved: %v", err)
+	}
+
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	cur, longest := streaks([]activityDay{{Day: "2026-03-01"}, {Day: "2026-03-02"}, {Day: "2026-03-03"}, {Day: "2026-03-08"}, {Day: "2026-03-09"}}, now)
+	if cur != 2 || longest != 3 {
+		t.Errorf("streaks: want 2 3, got %d %d", cur, longest)
+	}
+	if cur, _ := streaks([]activityDay{{Day: "2026-03-07"}}, now); cur != 0 {
+		t.Errorf("broken streak: want 0, got %d", cur)
+	}
+}
+
+func TestDeadMan(t *testing.T) {
+	defer func() { DeadManAfter, DeadManPass, DeadManSend = 0, "", nil }()
+	DeadManAfter = 24 * time.Hour
+	DeadManPass = "correct horse"
+	var sent [][]byte
+	DeadManSend = func(_ context.Context, name string, data []byte) error {
+		sent = append(sent, data)
+		return nil
+	}
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	ms.Put(ctx, store.Tiddler{Key: "Diary", Js: map[string]interface{}{"title": "Diary", "text": "dear diary"}})
+	saveAccount(ctx, "joe", "profile", &Profile{DisplayName: "Joe"})
+
+	t0 := time.Now()
+	for _, c := range []struct {
+		at   time.Duration
+		sent int
+	}{{0, 0}, {23 * time.Hour, 0}, {25 * time.Hour, 1}, {50 * time.Hour, 1}} {
+		if err := checkDeadMan(ctx, t0.Add(c.at)); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != c.sent {
+			t.Fatalf("%v: want %d sent, got %d", c.at, c.sent, len(sent))
+		}
+	}
+
+	plain, err := DecryptExport(sent[0], "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"text":"dear diary","title":"Diary"}]`; string(plain) != want {
+		t.Errorf("want %s, got %s", want, plain)
+	}
+	if _, err := DecryptExport(sent[0], "wrong"); err != ErrBadExport {
+		t.Errorf("wrong passphrase: want ErrBadExport, got %v", err)
+	}
+	if bytes.Contains(sent[0], []byte("diary")) {
+		t.Errorf("export not encrypted")
+	}
+
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.AddCookie(loginCookie(t, "joe"))
+	noteActive(r)
+	checkDeadMan(ctx, time.Now().Add(time.Hour))
+	checkDeadMan(ctx, time.Now().Add(25 * time.Hour))
+	if len(sent) != 2 {
+		t.Errorf("after new activity and inactivity: want 2 sent, got %d", len(sent))
+	}
+}
+
+func TestPublish(t *testing.T) {
+	defer func(base string) { PublishBase, PublishOut, IsAdmin = base, nil, nil }(PublishBase)
+	IsAdmin = func(user string) bool { return user == "boss" }
+	var page []byte
+	PublishOut = func(_ context.Context, data []byte) error {
+		page = data
+		return nil
+	}
+	ms := newMemStore()
+	setStore(ms)
+	ctx := context.Background()
+	for _, td := range []map[string]interface{}{
+		{"title": "About", "tags": []interface{}{"Public"}, "text": "Hi <b>there</b> & </pre>"},
+		{"title": "Secret", "text": "no"},
+		{"title": "$:/SiteTitle", "text": "My wiki"},
+		{"title": "Draft of 'About'", "tags": []interface{}{"Public"}, "fields": map[string]interface{}{"draft.of": "About"}},
+	} {
+		ms.Put(ctx, store.Tiddler{Key: td["title"].(string), Js: td})
+	}
+
+	dir := t.TempDir()
+	PublishBase = filepath.Join(dir, "empty.html")
+	ioutil.WriteFile(PublishBase, []byte(`<html><div id="storeArea" style="display:none;"><div title="$:/core"><pre>core</pre></div></div></html>`), 0644)
+
+	post := func(user string) int {
+		r := httptest.NewRequest("POST", "/admin/publish", nil)
+		r.AddCookie(loginCookie(t, user))
+		w := httptest.NewRecorder()
+		adminPublish(w, r)
+		return w.Code
+	}
+	if code := post("joe"); code != 403 {
+		t.Errorf("user: want 403, got %d", code)
+	}
+	if code := post("boss"); code != 200 {
+		t.Fatalf("admin: want 200, got %d", code)
+	}
+	want := `<html><div id="storeArea" style="display:none;">
+<div title="$:/SiteTitle">
+<pre>My wiki</pre>
+</div>
+<div tags="Public" title="About">
+<pre>Hi &lt;b&gt;there&lt;/b&gt; &amp; &lt;/pre&gt;</pre>
+</div><div title="$:/core"><pre>core</pre></div></div></html>`
+	if string(page) != want {
+		t.Errorf("storeArea: want\n%s\ngot\n%s", want, page)
+	}
+
+	ioutil.WriteFile(PublishBase, []byte(`<script class="tiddlywiki-tiddler-store" type="application/json">[{"title":"$:/core"}]</script><p>`), 0644)
+	if code := post("boss"); code != 200 {
+		t.Fatalf("JSON store: want 200, got %d", code)
+	}
+	want = `<script class="tiddlywiki-tiddler-store" type="application/json">[{"title":"$:/core"}]</script>
+<script class="tiddlywiki-tiddler-store" type="application/json">[{"text":"My wiki","title":"$:/SiteTitle"},{"tags":"Public","text":"Hi \u003cb\u003ethere\u003c/b\u003e \u0026 \u003c/pre\u003e","title":"About"}]</script><p>`
+	if string(page) != want {
+		t.Errorf("JSON store: want\n%s\ngot\n%s", want, page)
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	defer func(max, spill int64) { CacheMaxSize, CacheSpillSize = max, spill }(CacheMaxSize, CacheSpillSize)
+	c := newResponseCache()
+	data := bytes.Repeat([]byte("x"), 1000)
+	CacheMaxSize = 3 * (entryOverhead + 1 + 1000)
+
+	c.set("a", 0, data)
+	c.set("b", 0, data)
+	c.set("c", 0, data)
+	c.get("a") // b is the least recently used now
+	c.set("d", 0, data)
+	if c.get("b") != nil || c.get("a") == nil || c.get("d") == nil {
+		t.Errorf("want b evicted")
+	}
+	if st := c.Stats(); st.Entries != 3 || st.Evicted != 1 || st.Bytes > CacheMaxSize {
+		t.Errorf("stats: got %+v", st)
+	}
+
+	CacheSpillSize = 500
+	e := c.set("big", 0, data)
+	if e.data != nil || e.spill == nil {
+		t.Fatal("want big spilled")
+	}
+	if got, _ := e.bytes(); !bytes.Equal(got, data) {
+		t.Error("spilled data mangled")
+	}
+	zr, err := gzip.NewReader(c.gzipped(e, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(got, data) {
+		t.Error("gzip of spilled data mangled")
+	}
+	if st := c.Stats(); st.Spilled != 1 || st.Bytes > CacheMaxSize {
+		t.Errorf("stats: got %+v", st)
+	}
+
+	c.Invalidate()
+	if st := c.Stats(); st.Entries != 0 || st.Bytes != 0 {
+		t.Errorf("stats after invalidate: got %+v", st)
+	}
+}
@@ -0,0 +1,81 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// archived tiddlers
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"../store"
+)
+
+// archivedField set to "yes" makes a tiddler read-only, see checkArchived.
+const archivedField = "archived"
+
+// isArchived tells whether the tiddler fields js have archived: yes, as a standard or a custom field.
+func isArchived(js map[string]interface{}) (bool) {
+	v, ok := js[archivedField]
+	if fields, isMap := js["fields"].(map[string]interface{}); !ok && isMap {
+		v = fields[archivedField]
+	}
+	s, _ := v.(string)
+	return strings.EqualFold(strings.TrimSpace(s), "yes")
+}
+
+// storedArchived tells whether the stored tiddler key is archived, false when there is none.
+// Stream stores only read its meta.
+func storedArchived(ctx context.Context, key string) (bool, error) {
+	if ss, ok := StoreDb.(store.StreamStore); ok {
+		meta, text, _, err := ss.GetStream(ctx, key)
+		if err == nil {
+			text.Close()
+			var js map[string]interface{}
+			if err := json.Unmarshal(meta, &js); err != nil {
+				return false, err
+			}
+			return isArchived(js), nil
+		}
+	}
+	t, err := StoreDb.Get(ctx, key)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return false, err
+	}
+	return isArchived(js), nil
+}
+
+// checkArchived refuses with 423 Locked changing the archived tiddler key to js, or deleting it (nil js).
+// An archived tiddler only takes a save by an admin clearing its archived field,
+// so reference material is not edited or deleted by accident.
+func checkArchived(w http.ResponseWriter, r *http.Request, key string, js map[string]interface{}) (ok bool) {
+	archived, err := storedArchived(r.Context(), key)
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	if !archived || js != nil && !isArchived(js) && editorIsAdmin(r) {
+		return true
+	}
+	http.Error(w, "archived, an admin must clear its archived field first", http.StatusLocked)
+	return false
+}
@@ -0,0 +1,194 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// transactional multi-tiddler save
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"../store"
+)
+
+// AtomicMaxOps is the most operations POST /recipes/all/atomic takes at once.
+var AtomicMaxOps = 1000
+
+// AtomicItemHeader tells the index of the operation a POST /recipes/all/atomic was refused for.
+const AtomicItemHeader = "X-Atomic-Item"
+
+// atomicOp is an operation of POST /recipes/all/atomic.
+type atomicOp struct {
+	Title   string          `json:"title"`
+	Tiddler json.RawMessage `json:"tiddler"` // the tiddler to put, as for PUT /recipes/all/tiddlers/<title>
+	Delete  bool            `json:"delete"`
+	IfMatch string          `json:"if_match"` // ETag (or revision) the tiddler must have, empty for any
+}
+
+// atomicResult is the result of an operation of POST /recipes/all/atomic.
+type atomicResult struct {
+	Title    string `json:"title"`
+	Revision int    `json:"revision,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// atomicConflict is the answer to an operation whose If-Match failed.
+type atomicConflict struct {
+	Error     string `json:"error"`
+	Index     int    `json:"index"`
+	Title     string `json:"title"`
+	Revision  int    `json:"revision"` // current one, 0 when the tiddler is missing
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// ifMatchRev returns the revision of an ETag as sent by PUT ("bag/<title>/<rev>:<md5>"),
+// or of a bare revision number; 0 for empty.
+func ifMatchRev(etag string) (int, error) {
+	etag = strings.Trim(strings.TrimSpace(etag), `"`)
+	if etag == "" {
+		return 0, nil
+	}
+	if i := strings.LastIndexByte(etag, '/'); i >= 0 {
+		etag = etag[i+1:]
+	}
+	if i := strings.IndexByte(etag, ':'); i >= 0 {
+		etag = etag[:i]
+	}
+	rev, err := strconv.Atoi(etag)
+	if err != nil || rev <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return rev, nil
+}
+
+// atomicSave serves POST /recipes/all/atomic, a JSON list of atomicOp applied all or none
+// in one store transaction (see store.BatchStore), e.g. a data tiddler with its index:
+//
+//	[{"title":"Data","tiddler":{"text":"..."},"if_match":"\"bag/Data/5:...\""},
+//	 {"title":"Data index","tiddler":{"text":"..."}},
+//	 {"title":"Old data","delete":true}]
+//
+// Each operation is checked like its single PUT or DELETE, the first refused one answers for all
+// (its index in AtomicItemHeader), a failed if_match with 412 Precondition Failed.
+// It answers the list of atomicResult. Stores without transactions answer 501 Not Implemented.
+func atomicSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) || !checkWritable(w, r) {
+		return
+	}
+	bs, ok := StoreDb.(store.BatchStore)
+	if !ok {
+		http.Error(w, "the store has no transactions", http.StatusNotImplemented)
+		return
+	}
+
+	var req []atomicOp
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req) == 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req) > AtomicMaxOps {
+		http.Error(w, "too many operations", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := r.Context()
+	ops := make([]store.Op, len(req))
+	sums := make([][]byte, len(req))
+	texts := make([]string, len(req))
+	olds := make([]string, len(req))
+	for i, item := range req {
+		w.Header().Set(AtomicItemHeader, strconv.Itoa(i))
+		ifRev, err := ifMatchRev(item.IfMatch)
+		if item.Title == "" || err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !checkNotPrivate(w, item.Title) || !checkSystemEdit(w, r, item.Title) {
+			return
+		}
+		if item.Delete {
+			if !checkArchived(w, r, item.Title, nil) {
+				return
+			}
+			ops[i] = store.Op{Tiddler: store.Tiddler{Key: item.Title}, Delete: true, IfRev: ifRev}
+			continue
+		}
+
+		var js map[string]interface{}
+		if json.Unmarshal(item.Tiddler, &js) != nil || js == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		js["title"] = item.Title
+		if !checkArchived(w, r, item.Title, js) {
+			return
+		}
+		sanitizeFields(r, js)
+		stripFields(js)
+		olds[i] = oldText(ctx, item.Title, js)
+		texts[i], _ = js["text"].(string)
+		sum := md5.Sum(item.Tiddler)
+		sums[i] = sum[:]
+		ops[i] = store.Op{Tiddler: newPutTiddler(ctx, item.Title, js), IfRev: ifRev}
+	}
+	w.Header().Del(AtomicItemHeader)
+
+	aliases := make([]func(context.Context), 0)
+	for _, item := range req {
+		if item.Delete {
+			aliases = append(aliases, noteDelete(ctx, item.Title))
+		}
+	}
+	revs, err := bs.Batch(ctx, ops)
+	respCache.Invalidate()
+	if ce, ok := err.(*store.ConflictError); ok {
+		w.Header().Set(AtomicItemHeader, strconv.Itoa(ce.Index))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(atomicConflict{Error: "if_match failed", Index: ce.Index, Title: req[ce.Index].Title, Revision: ce.Rev, RequestID: responseID(w)})
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	for _, apply := range aliases {
+		apply(ctx)
+	}
+
+	res := make([]atomicResult, len(req))
+	user, _ := currentUser(r)
+	for i, item := range req {
+		res[i].Title = item.Title
+		if item.Delete {
+			res[i].Deleted = true
+			notify(ctx, user, "delete", item.Title, "", "")
+			dropEdits(item.Title)
+			continue
+		}
+		res[i].Revision = revs[i]
+		res[i].ETag = etagOf(item.Title, revs[i], sums[i])
+		notifyEdit(r, item.Title, texts[i], olds[i])
+		trackEdit(r, item.Title, revs[i] <= 2)
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,102 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// history consistency audit
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"../store"
+)
+
+// auditResult is the answer of /admin/audit.
+type auditResult struct {
+	Repaired bool               `json:"repaired"`
+	Diverged []store.Divergence `json:"diverged"`
+}
+
+// adminAudit serves /admin/audit for admins: GET lists the tiddlers whose history diverges
+// from them (see store.Diverges), POST also repairs them. It answers 501 Not Implemented
+// for stores which cannot audit themselves.
+func adminAudit(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	repair := false
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if !checkWritable(w, r) {
+			return
+		}
+		repair = true
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	as, ok := StoreDb.(store.AuditStore)
+	if !ok {
+		http.Error(w, "the store has no history audit", http.StatusNotImplemented)
+		return
+	}
+
+	divs, err := as.Audit(r.Context(), repair)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if repair && len(divs) > 0 {
+		user, _ := currentUser(r)
+		log.Printf("[audit] %d tiddlers repaired by %s", len(divs), user)
+	}
+	writeJSON(w, auditResult{Repaired: repair, Diverged: divs})
+}
+
+// StartAudit repairs the history of StoreDb at once, then every interval (0 only at once),
+// logging the repaired tiddlers. It does nothing for stores which are no store.AuditStore.
+func StartAudit(ctx context.Context, interval time.Duration) {
+	as, ok := StoreDb.(store.AuditStore)
+	if !ok {
+		return
+	}
+	audit := func() {
+		divs, err := as.Audit(ctx, true)
+		if err != nil {
+			log.Println("[audit]", err)
+			return
+		}
+		for _, d := range divs {
+			log.Printf("[audit] repaired %q: revision %d, newest in history %d", d.Key, d.Head, d.Latest)
+		}
+	}
+	go func() {
+		audit()
+		if interval <= 0 {
+			return
+		}
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				audit()
+			}
+		}
+	}()
+}
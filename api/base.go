@@ -0,0 +1,173 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// serving the base page
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	// IndexFiles are the base page candidates, the first existing one is served and saved by PUT /.
+	IndexFiles = []string{"index.html"}
+
+	// IndexUpload is who may replace the base page with PUT / and PATCH /: "admin", "user" or "off".
+	// The base page runs with the rights of every visitor, so it defaults to admins only.
+	IndexUpload = "admin"
+
+	// IndexCheck rejects uploads of the base page which do not look like a TiddlyWiki.
+	IndexCheck = true
+
+	// MinIndexSize and MaxIndexSize bound the size of an acceptable base page.
+	MinIndexSize = 64 * 1024
+	MaxIndexSize = 64 * 1024 * 1024
+)
+
+// checkIndexUpload refuses PUT / and PATCH / from users IndexUpload does not allow.
+// The caller has checked the login.
+func checkIndexUpload(w http.ResponseWriter, r *http.Request) (ok bool) {
+	switch IndexUpload {
+	case "user":
+		return true
+	case "off":
+		http.Error(w, "uploading the wiki page is disabled", http.StatusForbidden)
+		return false
+	}
+	return checkAdmin(w, r)
+}
+
+// indexPath returns the base page file: the first of IndexFiles that exists, else the first one.
+func indexPath() (string) {
+	for _, fpath := range IndexFiles {
+		if _, err := os.Stat(fpath); err == nil {
+			return fpath
+		}
+	}
+	if len(IndexFiles) == 0 {
+		return "index.html"
+	}
+	return IndexFiles[0]
+}
+
+// notTiddlyWiki returns why data does not look like a TiddlyWiki page, empty if it does.
+func notTiddlyWiki(data []byte) (string) {
+	switch {
+	case len(data) < MinIndexSize:
+		return fmt.Sprintf("too small for a TiddlyWiki (%d < %d bytes)", len(data), MinIndexSize)
+	case len(data) > MaxIndexSize:
+		return fmt.Sprintf("too big (%d > %d bytes)", len(data), MaxIndexSize)
+	}
+	head := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	if !bytes.HasPrefix(bytes.ToLower(head), []byte("<!doctype html")) {
+		return "no <!doctype html>"
+	}
+	if !bytes.Contains(data, []byte(`id="storeArea"`)) && !bytes.Contains(data, []byte(`class="tiddlywiki-tiddler-store"`)) {
+		return "no TiddlyWiki tiddler store"
+	}
+	return ""
+}
+
+// checkIndexPage refuses with 422 Unprocessable Entity a base page upload which does not look
+// like a TiddlyWiki, keeping it as <file>.rejected-<time> for inspection.
+func checkIndexPage(w http.ResponseWriter, data []byte) (ok bool) {
+	if !IndexCheck {
+		return true
+	}
+	reason := notTiddlyWiki(data)
+	if reason == "" {
+		return true
+	}
+	fpath := indexPath() + ".rejected-" + time.Now().UTC().Format("20060102T150405")
+	if err := ioutil.WriteFile(fpath, data, 0600); err != nil {
+		log.Println("[index] quarantine rejected upload", err)
+	}
+	log.Printf("[index] rejected upload, %s, kept as %s", reason, fpath)
+	http.Error(w, "not a TiddlyWiki page: " + reason, http.StatusUnprocessableEntity)
+	return false
+}
+
+// serveIndex is the default ServeBase: it serves the base page file,
+// or its gzip precompressed <file>.gz copy when not older than the file.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	fpath := indexPath()
+	etag, err := indexETag()
+	if os.IsNotExist(err) {
+		setupPage(w, fpath)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag) // also answers If-None-Match with 304
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	if CanAcceptsGzip(r) && servePrecompressed(w, r, fpath) {
+		return
+	}
+	http.ServeFile(w, r, fpath)
+}
+
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fpath string) (bool) {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return false
+	}
+	f, err := os.Open(fpath + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	gi, err := f.Stat()
+	if err != nil || gi.ModTime().Before(fi.ModTime()) { // stale after a save
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Encoding", "gzip")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return true
+}
+
+// setupPage tells what to do when the base page is missing, usually on the first run.
+func setupPage(w http.ResponseWriter, fpath string) {
+	wd, _ := os.Getwd()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>widdly setup</title></head>
+<body>
+<h1>The wiki page is missing</h1>
+<p>widdly serves the TiddlyWiki page from <code>%s</code> (in <code>%s</code>), which does not exist yet.</p>
+<ol>
+<li>Download an empty TiddlyWiki from <a href="https://tiddlywiki.com/#GettingStarted">tiddlywiki.com</a>.</li>
+<li>Save it as <code>%s</code>, or start widdly with <code>-index /path/to/your/empty.html</code>.</li>
+<li>Reload this page.</li>
+</ol>
+<p>See the README for the recommended base image with the TiddlyWeb plugin.</p>
+</body></html>
+`, html.EscapeString(fpath), html.EscapeString(wd), html.EscapeString(fpath))
+}
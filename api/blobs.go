@@ -0,0 +1,190 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// pluggable attachment file backends
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BlobInfo describes a file kept by a BlobBackend.
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobBackend keeps the attachment files served under /files/ away from the server,
+// e.g. on S3 or a WebDAV share. Names are clean slash separated paths without a leading slash.
+type BlobBackend interface {
+	// Get opens the file name, ErrBlobNotFound when there is none.
+	// Readers which are also io.Seekers get Range requests served, for scrubbing audio and video.
+	Get(ctx context.Context, name string) (io.ReadCloser, *BlobInfo, error)
+	Put(ctx context.Context, name string, r io.Reader, size int64) (error)
+	Delete(ctx context.Context, name string) (error)
+
+	// SignedURL returns an URL the client may download name from directly until ttl passed,
+	// empty when the backend cannot sign, then the file is proxied.
+	SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error)
+	Close() (error)
+}
+
+// BlobOpenFn opens a file backend from a backend specific source (URL...).
+type BlobOpenFn func(source string) (BlobBackend, error)
+
+var (
+	ErrBlobBackend  = errors.New("file backend not found")
+	ErrBlobNotFound = errors.New("file not found")
+
+	// Blobs keeps the files served under /files/ instead of FilesDir, nil for FilesDir.
+	Blobs BlobBackend
+
+	// BlobURLTTL is how long the signed download URLs of Blobs are valid, 0 always proxies the files.
+	BlobURLTTL = 15 * time.Minute
+
+	blobBackends = map[string]BlobOpenFn{}
+)
+
+// RegBlobBackend adds a file backend, usually from the init of its package.
+func RegBlobBackend(name string, fn BlobOpenFn) {
+	blobBackends[name] = fn
+}
+
+// ListBlobBackend lists the file backend names.
+func ListBlobBackend() ([]string) {
+	list := make([]string, 0, len(blobBackends))
+	for name := range blobBackends {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// OpenBlobBackend opens the file backend name.
+func OpenBlobBackend(name string, source string) (BlobBackend, error) {
+	fn, ok := blobBackends[name]
+	if !ok {
+		return nil, ErrBlobBackend
+	}
+	return fn(source)
+}
+
+// blobFiles serves /files/<name> from Blobs, like files does from FilesDir.
+// Downloads are redirected to signed URLs when the backend has them.
+func blobFiles(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if width := thumbWidth(r); width > 0 {
+			name = blobThumb(ctx, name, width)
+		}
+		if BlobURLTTL > 0 {
+			u, err := Blobs.SignedURL(ctx, name, BlobURLTTL)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			if u != "" {
+				w.Header().Set("Cache-Control", "private, no-store")
+				http.Redirect(w, r, u, http.StatusFound)
+				return
+			}
+		}
+
+		rc, info, err := Blobs.Get(ctx, name)
+		if err == ErrBlobNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		defer rc.Close()
+
+		setUntrustedHeaders(w, FileContentType(name))
+		if rs, ok := rc.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, path.Base(name), info.ModTime, rs)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "none")
+		if info.Size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		if !info.ModTime.IsZero() {
+			w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		io.Copy(w, rc)
+
+	case "PUT":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		if name == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		f, ok := spoolUpload(w, r, name, r.Body)
+		if !ok {
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+		err = Blobs.Put(ctx, name, f, fi.Size())
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		dropThumbs(ctx, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+
+		err := Blobs.Delete(ctx, name)
+		if err == ErrBlobNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		dropThumbs(ctx, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,337 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// read-only blog of the tiddlers tagged BlogTag, rendered on the server
+package api
+
+import (
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+var (
+	// BlogTag selects the tiddlers published under /blog/, empty for disable.
+	BlogTag = "Public/Blog"
+
+	// BlogTitle is the name of the blog, the host name when empty.
+	BlogTitle = ""
+
+	// BlogPageSize is the number of posts per page and in the feed.
+	BlogPageSize = 10
+)
+
+var blogTmpl = template.Must(template.New("blog").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Post}}{{.Post.Title}} - {{end}}{{.Blog}}</title>
+<link rel="alternate" type="application/atom+xml" title="{{.Blog}}" href="{{.Base}}feed.atom">
+<style>body{max-width:42em;margin:2em auto;padding:0 1em;font:17px/1.6 sans-serif;color:#222}
+a{color:#1a5fb4}.meta{color:#777;font-size:.9em}pre{overflow:auto;background:#f4f4f4;padding:.5em}
+img{max-width:100%}ul.posts{list-style:none;padding:0}ul.posts li{margin:1em 0}nav{margin:2em 0}</style>
+</head><body>
+<header><a href="{{.Base}}">{{.Blog}}</a></header>
+{{if .Post}}<article><h1>{{.Post.Title}}</h1>
+<p class="meta">{{.Post.Date}}{{range .Post.Tags}} · {{.}}{{end}}</p>
+{{.Post.HTML}}</article>
+{{else}}<ul class="posts">{{range .Posts}}
+<li><a href="{{.URL}}">{{.Title}}</a><br><span class="meta">{{.Date}}{{range .Tags}} · {{.}}{{end}}</span></li>{{else}}
+<li>No posts yet.</li>{{end}}
+</ul>
+<nav>{{if .Newer}}<a href="{{.Newer}}">&larr; Newer</a>{{end}} {{if .Older}}<a href="{{.Older}}">Older &rarr;</a>{{end}}</nav>
+{{end}}</body></html>
+`))
+
+// blogPost is a post in the blog pages.
+type blogPost struct {
+	Title string
+	URL   string
+	Date  string
+	Tags  []string
+	HTML  template.HTML
+
+	published time.Time
+	modified  time.Time
+}
+
+type blogPage struct {
+	Blog  string
+	Base  string
+	Post  *blogPost
+	Posts []*blogPost
+	Newer string
+	Older string
+}
+
+// blogURL is the link of a post, relative to /blog/.
+func blogURL(title string) (string) {
+	return "./" + url.PathEscape(title)
+}
+
+// blogPosts returns the published posts visible to the client, newest first.
+func blogPosts(r *http.Request) ([]*blogPost, error) {
+	tiddlers, err := StoreDb.All(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := make([]*blogPost, 0)
+	for _, t := range withoutHidden(tiddlers, hidden) {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		fields := store.FlatFields(js)
+		title := fields["title"]
+		tags := store.ParseTags(fields["tags"])
+		if fields["draft.of"] != "" || strings.HasPrefix(title, "$:/") || !hasTag(tags, BlogTag) {
+			continue
+		}
+
+		p := &blogPost{Title: title, URL: blogURL(title)}
+		for _, tag := range tags {
+			if tag != BlogTag {
+				p.Tags = append(p.Tags, tag)
+			}
+		}
+		p.modified, _, _ = calDate(fields["modified"])
+		p.published = publishTime(fields)
+		if p.published.IsZero() {
+			p.published, _, _ = calDate(fields["created"])
+		}
+		if p.published.IsZero() {
+			p.published = p.modified
+		}
+		if p.modified.IsZero() {
+			p.modified = p.published
+		}
+		if !p.published.IsZero() {
+			p.Date = p.published.Format("2006-01-02")
+		}
+		posts = append(posts, p)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].published.Equal(posts[j].published) {
+			return posts[i].published.After(posts[j].published)
+		}
+		return posts[i].Title < posts[j].Title
+	})
+	return posts, nil
+}
+
+func hasTag(tags []string, tag string) (bool) {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderPost fills the HTML of a post, linking other posts in the blog and the rest to the wiki.
+func renderPost(r *http.Request, p *blogPost, posts map[string]bool) (error) {
+	t, err := StoreDb.Get(r.Context(), p.Title)
+	if err != nil {
+		return err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return err
+	}
+	typ, _ := js["type"].(string)
+	text, _ := js["text"].(string)
+	p.HTML = RenderText(typ, text, func(title string) string {
+		if posts[title] {
+			return blogURL(title)
+		}
+		return "../#" + url.PathEscape(title)
+	})
+	// attachment links are relative to the wiki, one level up
+	p.HTML = template.HTML(strings.NewReplacer(`src="files/`, `src="../files/`, `href="files/`, `href="../files/`).Replace(string(p.HTML)))
+	return nil
+}
+
+// blog serves GET /blog/ (?page=N), /blog/<title> and /blog/feed.atom.
+func blog(w http.ResponseWriter, r *http.Request) {
+	if BlogTag == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	posts, err := blogPosts(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	titles := make(map[string]bool, len(posts))
+	for _, p := range posts {
+		titles[p.Title] = true
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/blog/")
+	page := &blogPage{Blog: BlogTitle, Base: "./"}
+	if page.Blog == "" {
+		page.Blog = r.Host
+	}
+
+	switch {
+	case name == "feed.atom" && !titles[name]:
+		blogFeed(w, r, page.Blog, posts, titles)
+		return
+
+	case name != "":
+		if !titles[name] {
+			http.NotFound(w, r)
+			return
+		}
+		for _, p := range posts {
+			if p.Title == name {
+				page.Post = p
+			}
+		}
+		err = renderPost(r, page.Post, titles)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+	default:
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if n < 1 {
+			n = 1
+		}
+		start := (n - 1) * BlogPageSize
+		if start > len(posts) {
+			start = len(posts)
+		}
+		end := start + BlogPageSize
+		if end > len(posts) {
+			end = len(posts)
+		}
+		page.Posts = posts[start:end]
+		if n > 1 {
+			page.Newer = "?page=" + strconv.Itoa(n - 1)
+		}
+		if end < len(posts) {
+			page.Older = "?page=" + strconv.Itoa(n + 1)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = blogTmpl.Execute(w, page)
+	if err != nil {
+		logError(w, err)
+	}
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Category  []atomCategory `xml:"category"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// blogFeed serves the latest BlogPageSize posts as an Atom feed.
+func blogFeed(w http.ResponseWriter, r *http.Request, name string, posts []*blogPost, titles map[string]bool) {
+	base := wikiURL(r) // .../blog/
+	feed := atomFeed{
+		Title:  name,
+		ID:     base,
+		Links:  []atomLink{{Href: base}, {Rel: "self", Href: base + "feed.atom"}},
+		Author: name,
+	}
+
+	updated := time.Time{}
+	if len(posts) > BlogPageSize {
+		posts = posts[:BlogPageSize]
+	}
+	for _, p := range posts {
+		err := renderPost(r, p, titles)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		link := base + strings.TrimPrefix(p.URL, "./")
+		entry := atomEntry{
+			Title:     p.Title,
+			ID:        link,
+			Link:      atomLink{Rel: "alternate", Href: link},
+			Published: p.published.Format(time.RFC3339),
+			Updated:   p.modified.Format(time.RFC3339),
+			Content:   atomContent{Type: "html", Body: string(p.HTML)},
+		}
+		for _, tag := range p.Tags {
+			entry.Category = append(entry.Category, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+		if p.modified.After(updated) {
+			updated = p.modified
+		}
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	// links inside the content must be absolute in feed readers
+	for i := range feed.Entries {
+		feed.Entries[i].Content.Body = strings.NewReplacer(`href="./`, `href="` + base, `href="../`, `href="` + base + "../", `src="../`, `src="` + base + "../").Replace(feed.Entries[i].Content.Body)
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "\t")
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
@@ -0,0 +1,70 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// build information and the admin stats
+package api
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// BuildInfo tells what is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"` // of the build, UTC
+	GoVersion string `json:"go_version"`
+}
+
+var (
+	// Build is shown by /status and /admin/stats, nil hides it.
+	Build *BuildInfo
+
+	startTime = time.Now()
+)
+
+// adminStats serves GET /admin/stats for admins: the build, uptime, sessions, caches, store and Go runtime.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sess := Sess.Stats()
+	backend := make(map[string]float64)
+	for _, st := range storeStats(r.Context()) {
+		backend[st.Name] = st.Value
+	}
+	writeJSON(w, map[string]interface{}{
+		"build":      Build,
+		"started":    startTime.UTC().Format(time.RFC3339),
+		"uptime_sec": int64(time.Since(startTime).Seconds()),
+		"sessions": map[string]interface{}{
+			"active":  sess.Active,
+			"created": sess.Created,
+			"evicted": sess.Evicted,
+			"expired": sess.Expired,
+		},
+		"cache":      respCache.Stats(),
+		"store":      backend,
+		"goroutines": runtime.NumGoroutine(),
+		"heap_bytes": mem.HeapAlloc,
+		"read_only":  readOnlyReason() != "",
+	})
+}
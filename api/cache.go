@@ -0,0 +1,393 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// in-memory response cache for list & tiddler
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	lru "container/list"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	// CacheList enables caching of the serialized tiddlers.json response.
+	CacheList = true
+
+	// CacheTiddler enables caching of the serialized fat tiddler responses.
+	CacheTiddler = true
+
+	// CacheMaxSize is the memory budget of the response cache in bytes, with their gzip variants;
+	// the least recently used responses are dropped beyond it. 0 for unlimited.
+	CacheMaxSize int64 = 0
+
+	// CacheSpillSize is the size above which a response or its gzip variant is kept
+	// in a temporary file in CacheSpillDir instead of memory, 0 for never.
+	CacheSpillSize int64 = 0
+
+	// CacheSpillDir is the directory of the spilled responses, empty for the system temporary directory.
+	CacheSpillDir = ""
+
+	respCache = newResponseCache()
+)
+
+// entryOverhead is roughly what an entry costs besides its data.
+const entryOverhead = 200
+
+func init() {
+	RegMetric("widdly_cache_bytes", "Memory used by the response cache.", "gauge", func() (float64) {
+		return float64(respCache.Stats().Bytes)
+	})
+	RegMetric("widdly_cache_entries", "Responses in the response cache.", "gauge", func() (float64) {
+		return float64(respCache.Stats().Entries)
+	})
+	RegMetric("widdly_cache_evicted_total", "Responses dropped because of CacheMaxSize.", "counter", func() (float64) {
+		return float64(respCache.Stats().Evicted)
+	})
+	RegMetric("widdly_cache_spilled_total", "Responses kept in a file because of CacheSpillSize.", "counter", func() (float64) {
+		return float64(respCache.Stats().Spilled)
+	})
+	RegMetric("widdly_cache_hits_total", "Responses served from the response cache.", "counter", func() (float64) {
+		return float64(respCache.Stats().Hits)
+	})
+	RegMetric("widdly_cache_misses_total", "Responses not found in the response cache.", "counter", func() (float64) {
+		return float64(respCache.Stats().Misses)
+	})
+	RegMetric("widdly_cache_hit_ratio", "Share of the responses served from the response cache.", "gauge", func() (float64) {
+		return respCache.Stats().HitRatio()
+	})
+}
+
+// spill is a response kept in an unlinked temporary file, closed by the os.File finalizer
+// once no entry or request refers to it anymore.
+type spill struct {
+	f    *os.File
+	size int64
+}
+
+func (sp *spill) reader() (io.Reader) {
+	return io.NewSectionReader(sp.f, 0, sp.size)
+}
+
+// cacheEntry is a serialized response and its gzip variant.
+type cacheEntry struct {
+	gen   uint64
+	data  []byte
+	spill *spill // data in a file when data is nil
+
+	gzLv    int
+	gz      []byte
+	gzSpill *spill
+
+	sum string // textSum of a tiddler, see textSumOf
+
+	key  string
+	elem *lru.Element // position in the LRU list while cached
+}
+
+// mem is how much memory e holds.
+func (e *cacheEntry) mem() (int64) {
+	return int64(entryOverhead + len(e.key) + len(e.data) + len(e.gz))
+}
+
+// size is the length of the response.
+func (e *cacheEntry) size() (int64) {
+	if e.spill != nil {
+		return e.spill.size
+	}
+	return int64(len(e.data))
+}
+
+// reader returns a reader of the response.
+func (e *cacheEntry) reader() (io.Reader) {
+	if e.spill != nil {
+		return e.spill.reader()
+	}
+	return bytes.NewReader(e.data)
+}
+
+// bytes returns the response, read back when spilled.
+func (e *cacheEntry) bytes() ([]byte, error) {
+	if e.spill != nil {
+		return ioutil.ReadAll(e.spill.reader())
+	}
+	return e.data, nil
+}
+
+// CacheStats counts the responses of the response cache.
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Evicted int64 `json:"evicted"`
+	Spilled int64 `json:"spilled"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// HitRatio returns the share of the lookups served from the cache, 0 before any.
+func (st CacheStats) HitRatio() (float64) {
+	if st.Hits + st.Misses == 0 {
+		return 0
+	}
+	return float64(st.Hits) / float64(st.Hits + st.Misses)
+}
+
+// responseCache keeps serialized responses until the store generation changes,
+// or until they are the least recently used ones beyond CacheMaxSize.
+type responseCache struct {
+	lock    sync.Mutex
+	gen     uint64
+	entries map[string]*cacheEntry
+	order   *lru.List // of *cacheEntry, most recently used first
+	stats   CacheStats
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*cacheEntry),
+		order: lru.New(),
+	}
+}
+
+// Generation returns the current store generation.
+func (c *responseCache) Generation() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gen
+}
+
+// Stats returns the counters of the cache.
+func (c *responseCache) Stats() (CacheStats) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Invalidate bumps the store generation and drops all cached responses.
+func (c *responseCache) Invalidate() {
+	c.lock.Lock()
+	c.gen++
+	c.entries = make(map[string]*cacheEntry)
+	c.order.Init()
+	c.stats.Entries, c.stats.Bytes = 0, 0
+	c.lock.Unlock()
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || e.gen != c.gen {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(e.elem)
+	return e
+}
+
+// isCached tells whether e is in the cache, the caller holds c.lock.
+func (c *responseCache) isCached(e *cacheEntry) (bool) {
+	return e.elem != nil && c.entries[e.key] == e
+}
+
+// remove drops e, the caller holds c.lock.
+func (c *responseCache) remove(e *cacheEntry) {
+	delete(c.entries, e.key)
+	c.order.Remove(e.elem)
+	e.elem = nil
+	c.stats.Entries--
+	c.stats.Bytes -= e.mem()
+}
+
+// evict drops the least recently used entries but keep while over CacheMaxSize, the caller holds c.lock.
+func (c *responseCache) evict(keep *cacheEntry) {
+	for CacheMaxSize > 0 && c.stats.Bytes > CacheMaxSize {
+		back := c.order.Back()
+		if back == nil {
+			return
+		}
+		e := back.Value.(*cacheEntry)
+		if e == keep {
+			if c.order.Len() == 1 {
+				return
+			}
+			c.order.MoveToFront(back)
+			continue
+		}
+		c.remove(e)
+		c.stats.Evicted++
+	}
+}
+
+// set stores data for key, unless the store changed since gen was read.
+func (c *responseCache) set(key string, gen uint64, data []byte) *cacheEntry {
+	e := &cacheEntry{gen: gen, data: data, key: key}
+	if sp := spillData(data); sp != nil {
+		e.data, e.spill = nil, sp
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return e
+	}
+	if CacheMaxSize > 0 && e.mem() > CacheMaxSize {
+		return e // served once, never cached
+	}
+	if old, ok := c.entries[key]; ok && c.isCached(old) {
+		c.remove(old)
+	}
+	c.entries[key] = e
+	e.elem = c.order.PushFront(e)
+	c.stats.Entries++
+	c.stats.Bytes += e.mem()
+	if e.spill != nil {
+		c.stats.Spilled++
+	}
+	c.evict(e)
+	return e
+}
+
+// spillData writes data to an unlinked temporary file when it is larger than CacheSpillSize,
+// it returns nil when kept in memory.
+func spillData(data []byte) (*spill) {
+	if CacheSpillSize <= 0 || int64(len(data)) <= CacheSpillSize {
+		return nil
+	}
+	f, err := ioutil.TempFile(CacheSpillDir, "widdly-cache-")
+	if err != nil {
+		log.Println("[cache] spill", err)
+		return nil
+	}
+	os.Remove(f.Name()) // freed once closed; fails on Windows, where the file stays behind
+	if _, err := f.Write(data); err != nil {
+		log.Println("[cache] spill", err)
+		f.Close()
+		return nil
+	}
+	return &spill{f: f, size: int64(len(data))}
+}
+
+// gzipped returns a reader of the gzip variant of e for level, compressing it once.
+func (c *responseCache) gzipped(e *cacheEntry, level int) io.Reader {
+	c.lock.Lock()
+	if e.gzLv == level && (e.gz != nil || e.gzSpill != nil) {
+		r := e.gzReader()
+		c.lock.Unlock()
+		return r
+	}
+	c.lock.Unlock()
+
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		gw = gzip.NewWriter(&buf)
+	}
+	io.Copy(gw, e.reader())
+	if err := gw.Close(); err != nil {
+		return nil
+	}
+	gz := buf.Bytes()
+	sp := spillData(gz)
+	if sp != nil {
+		gz = nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached := c.isCached(e)
+	if cached {
+		c.stats.Bytes -= e.mem()
+	}
+	e.gzLv, e.gz, e.gzSpill = level, gz, sp
+	if cached {
+		c.stats.Bytes += e.mem()
+		c.evict(e)
+	}
+	return e.gzReader()
+}
+
+// gzReader returns a reader of the gzip variant of e, the caller holds c.lock.
+func (e *cacheEntry) gzReader() (io.Reader) {
+	if e.gzSpill != nil {
+		return e.gzSpill.reader()
+	}
+	return bytes.NewReader(e.gz)
+}
+
+// textSumOf returns the textSum of the cached fat tiddler e, hashing it once.
+func (c *responseCache) textSumOf(e *cacheEntry) (string) {
+	c.lock.Lock()
+	sum := e.sum
+	c.lock.Unlock()
+	if sum != "" {
+		return sum
+	}
+	data, err := e.bytes()
+	if err != nil {
+		return ""
+	}
+	sum = fatTextSum(data)
+	c.lock.Lock()
+	e.sum = sum
+	c.lock.Unlock()
+	return sum
+}
+
+// Invalidate drops all cached responses.
+// It must be called after the store is modified outside of the HTTP handlers.
+func Invalidate() {
+	respCache.Invalidate()
+}
+
+// cached returns the cached response for key, or calls fn and caches its result when enabled.
+func cached(key string, enable bool, fn func() ([]byte, error)) (*cacheEntry, error) {
+	if enable {
+		if e := respCache.get(key); e != nil {
+			return e, nil
+		}
+	}
+
+	gen := respCache.Generation()
+	data, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if !enable {
+		return &cacheEntry{gen: gen, data: data, key: key}, nil
+	}
+	return respCache.set(key, gen, data), nil
+}
+
+// writeCached writes e, using the precompressed variant when the client accepts gzip
+// and the body is at least GzipMinSize.
+func writeCached(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	if e.size() >= int64(GzipMinSize) && gzipLevelFor(r) != 0 {
+		gz := respCache.gzipped(e, gzipLevel()) // compressed once, whatever the CPU load
+		if gz != nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			io.Copy(w, gz)
+			return
+		}
+	}
+	io.Copy(w, e.reader())
+}
@@ -0,0 +1,169 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// iCalendar feed of tiddlers with date fields
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+var (
+	// CalendarFields are the date fields which turn a tiddler into a calendar event,
+	// the first one found is used.
+	CalendarFields = []string{"due", "event-date"}
+
+	// CalendarFilter selects the tiddlers of /calendar.ics, nil for all.
+	CalendarFilter *Filter
+)
+
+// calDate parses a date field, TiddlyWiki format (UTC) or ISO 8601.
+// allDay is true when the value has no time of day.
+func calDate(s string) (t time.Time, allDay bool, ok bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"20060102150405", "200601021504", "2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"} {
+		v := s
+		if layout == "20060102150405" && len(v) > 14 { // drop milliseconds
+			v = v[:14]
+		}
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), false, true
+		}
+	}
+	for _, layout := range []string{"20060102", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// icalText escapes a TEXT value.
+func icalText(s string) (string) {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// icalLine writes a content line folded at 75 octets, without splitting UTF-8 sequences.
+func icalLine(buf *bytes.Buffer, line string) {
+	for len(line) > 75 {
+		n := 75
+		for n > 0 && line[n]&0xC0 == 0x80 {
+			n--
+		}
+		buf.WriteString(line[:n])
+		buf.WriteString("\r\n ")
+		line = line[n:]
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// wikiURL returns the URL of the wiki as seen by the client, for a request to a top level path.
+func wikiURL(r *http.Request) (string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	p := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil { // with the -base prefix
+		p = u.Path
+	}
+	base := path.Dir(p)
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return scheme + "://" + r.Host + base
+}
+
+// calendar serves the tiddlers having one of CalendarFields as an iCalendar feed.
+func calendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tiddlers, err := StoreDb.All(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	tiddlers = withoutHidden(tiddlers, hidden)
+
+	wiki := wikiURL(r)
+	now := time.Now().UTC().Format("20060102T150405Z")
+
+	var buf bytes.Buffer
+	icalLine(&buf, "BEGIN:VCALENDAR")
+	icalLine(&buf, "VERSION:2.0")
+	icalLine(&buf, "PRODID:-//widdly//calendar//EN")
+	icalLine(&buf, "X-WR-CALNAME:" + icalText(r.Host))
+	for _, t := range tiddlers {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		fields := store.FlatFields(js)
+		title := fields["title"]
+		if strings.HasPrefix(title, "$:/") || fields["draft.of"] != "" || !CalendarFilter.Match(fields) {
+			continue
+		}
+
+		for _, name := range CalendarFields {
+			start, allDay, ok := calDate(fields[name])
+			if !ok {
+				continue
+			}
+
+			uid := sha1.Sum([]byte(name + "\x00" + title))
+			icalLine(&buf, "BEGIN:VEVENT")
+			icalLine(&buf, fmt.Sprintf("UID:%x@widdly", uid))
+			icalLine(&buf, "DTSTAMP:" + now)
+			if allDay {
+				icalLine(&buf, "DTSTART;VALUE=DATE:" + start.Format("20060102"))
+			} else {
+				icalLine(&buf, "DTSTART:" + start.Format("20060102T150405Z"))
+			}
+			if mod, _, ok := calDate(fields["modified"]); ok {
+				icalLine(&buf, "LAST-MODIFIED:" + mod.Format("20060102T150405Z"))
+			}
+			icalLine(&buf, "SUMMARY:" + icalText(title))
+			if tags := store.ParseTags(fields["tags"]); len(tags) > 0 {
+				for i := range tags {
+					tags[i] = icalText(tags[i])
+				}
+				icalLine(&buf, "CATEGORIES:" + strings.Join(tags, ","))
+			}
+			icalLine(&buf, "URL:" + wiki + "#" + url.PathEscape(title))
+			icalLine(&buf, "END:VEVENT")
+			break
+		}
+	}
+	icalLine(&buf, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(buf.Bytes())
+}
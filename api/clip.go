@@ -0,0 +1,365 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// web clipper endpoint
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"../store"
+)
+
+var (
+	// ClipToken enables POST /clip for the clients sending it, as "Authorization: Bearer <token>"
+	// or the token form field; empty disables /clip.
+	ClipToken = ""
+
+	// ClipUser is the creator and modifier of the clipped tiddlers.
+	ClipUser = "clipper"
+
+	// ClipTag tags the clipped tiddlers, empty for none.
+	ClipTag = "Clipped"
+
+	// ClipMaxSize limits the fetched pages, in bytes.
+	ClipMaxSize int64 = 4 << 20
+
+	// ClipTimeout limits fetching a page.
+	ClipTimeout = 20 * time.Second
+
+	// ClipPrivate allows fetching pages of loopback, private and link-local addresses,
+	// off by default so the clipper can not be used to probe the local network.
+	ClipPrivate = false
+)
+
+var errClipAddr = errors.New("clip: refusing a private address")
+
+// clipClient fetches the clipped pages, checking every address it connects to (redirects too).
+var clipClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) (error) {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ClipPrivate || ip == nil {
+					return nil
+				}
+				if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+					return errClipAddr
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// clipRequest is the body of POST /clip, JSON or form fields.
+type clipRequest struct {
+	URL   string `json:"url"`
+	Title string `json:"title"` // empty takes the title of the page
+	HTML  string `json:"html"`  // the selection, empty fetches the page and extracts its main content
+	Tags  string `json:"tags"`  // TiddlyWiki tag list
+}
+
+// clipResult answers a JSON POST /clip.
+type clipResult struct {
+	Title    string `json:"title"`
+	Revision int    `json:"revision"`
+}
+
+// checkClipToken tells whether r carries ClipToken.
+func checkClipToken(r *http.Request, form string) (bool) {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tok == "" {
+		tok = form
+	}
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(ClipToken)) == 1
+}
+
+// clip serves POST /clip: the selection html of the page url, or the main content of the page
+// fetched by the server when there is none, is cleaned and saved as an HTML tiddler
+// with the page in its source field. A form POST (from a bookmarklet) is redirected to the new tiddler,
+// a JSON one answered with its title and revision.
+func clip(w http.ResponseWriter, r *http.Request) {
+	if ClipToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" { // preflight of the extensions sending the token header
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req clipRequest
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	token := ""
+	if isJSON {
+		if err := json.NewDecoder(io.LimitReader(r.Body, ClipMaxSize)).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, ClipMaxSize)
+		req = clipRequest{URL: r.PostFormValue("url"), Title: r.PostFormValue("title"), HTML: r.PostFormValue("html"), Tags: r.PostFormValue("tags")}
+		token = r.PostFormValue("token")
+	}
+	if !checkClipToken(r, token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !checkWritable(w, r) {
+		return
+	}
+	page, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (page.Scheme != "http" && page.Scheme != "https") || page.Host == "" {
+		http.Error(w, "url must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	title, text := strings.TrimSpace(req.Title), req.HTML
+	if strings.TrimSpace(text) == "" {
+		doc, err := fetchPage(ctx, page.String())
+		if err != nil {
+			log.Println("[clip]", page, err)
+			http.Error(w, "fetching the page failed: " + err.Error(), http.StatusBadGateway)
+			return
+		}
+		if title == "" {
+			title = pageTitle(doc)
+		}
+		text = readable(doc)
+	}
+	text = cleanClip(text, page)
+	if title == "" {
+		title = page.Host + page.Path
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if !checkNotPrivate(w, title) || !checkSystemEdit(w, r, title) {
+		return
+	}
+
+	title, err = freeTitle(ctx, title)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	tags := store.ParseTags(req.Tags)
+	if ClipTag != "" {
+		tags = append([]string{ClipTag}, tags...)
+	}
+	now := twNow()
+	js := map[string]interface{}{
+		"title":    title,
+		"type":     "text/html",
+		"text":     text,
+		"tags":     tags,
+		"created":  now,
+		"modified": now,
+		"creator":  ClipUser,
+		"modifier": ClipUser,
+		"fields":   map[string]interface{}{"source": page.String()},
+	}
+	rev, err := StoreDb.Put(ctx, newPutTiddler(ctx, title, js))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	respCache.Invalidate()
+	log.Printf("[clip] %q from %s", title, page)
+
+	if !isJSON {
+		http.Redirect(w, r, "/#" + url.PathEscape(title), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(clipResult{Title: title, Revision: rev})
+}
+
+// freeTitle returns title, or title with the first free " (n)" suffix when it is taken.
+func freeTitle(ctx context.Context, title string) (string, error) {
+	for n := 1; ; n++ {
+		try := title
+		if n > 1 {
+			try = fmt.Sprintf("%s (%d)", title, n)
+		}
+		_, err := StoreDb.Get(ctx, try)
+		if err == store.ErrNotFound {
+			return try, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// fetchPage returns the HTML page at u, within ClipTimeout and ClipMaxSize.
+func fetchPage(ctx context.Context, u string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ClipTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "widdly-clipper")
+	resp, err := clipClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	typ, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if typ != "text/html" && typ != "application/xhtml+xml" {
+		return "", fmt.Errorf("not an HTML page: %q", typ)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, ClipMaxSize))
+	return string(data), err
+}
+
+var (
+	reTitle   = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	reOGTitle = regexp.MustCompile(`(?is)<meta\s[^>]*property\s*=\s*["']og:title["'][^>]*>`)
+	reContent = regexp.MustCompile(`(?is)\scontent\s*=\s*("[^"]*"|'[^']*')`)
+
+	// reBoiler matches the page parts which are not content: navigation, page header and footer, side bars, forms.
+	reBoiler = regexp.MustCompile(`(?is)<!--.*?-->|<(nav|header|footer|aside|form|svg|button|select|dialog)\b[^>]*>.*?</\s*(?:nav|header|footer|aside|form|svg|button|select|dialog)\s*>`)
+	reBody    = regexp.MustCompile(`(?is)<body\b[^>]*>(.*)</body\s*>`)
+	reMain    = regexp.MustCompile(`(?is)<(article|main)\b[^>]*>(.*?)</\s*(?:article|main)\s*>`)
+	reBlock   = regexp.MustCompile(`(?is)<(p|h[1-6]|ul|ol|pre|blockquote|table|figure)\b[^>]*>.*?</\s*(?:p|h[1-6]|ul|ol|pre|blockquote|table|figure)\s*>`)
+	reAnyTag  = regexp.MustCompile(`(?s)<[^>]*>`)
+	reDropTag = regexp.MustCompile(`(?is)</?(?:div|span|section|font|center|picture|source)\b[^>]*>`)
+	reBlank   = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// pageTitle returns the og:title, or else the title, of the page doc.
+func pageTitle(doc string) (string) {
+	if m := reOGTitle.FindString(doc); m != "" {
+		if c := reContent.FindStringSubmatch(m); c != nil {
+			if t := html.UnescapeString(strings.Trim(c[1], `"'`)); strings.TrimSpace(t) != "" {
+				return t
+			}
+		}
+	}
+	if m := reTitle.FindStringSubmatch(doc); m != nil {
+		return html.UnescapeString(m[1])
+	}
+	return ""
+}
+
+// readable returns the main content of the page doc, a poor man's readability:
+// the longest article or main element, or else the text blocks of the body, without the boilerplate.
+func readable(doc string) (string) {
+	doc = reActiveBlock.ReplaceAllString(doc, "")
+	doc = reBoiler.ReplaceAllString(doc, "")
+	if m := reBody.FindStringSubmatch(doc); m != nil {
+		doc = m[1]
+	}
+	best := ""
+	for _, m := range reMain.FindAllStringSubmatch(doc, -1) {
+		if textLen(m[2]) > textLen(best) {
+			best = m[2]
+		}
+	}
+	if textLen(best) > 200 {
+		return best
+	}
+	var out strings.Builder
+	for _, b := range reBlock.FindAllString(doc, -1) {
+		if textLen(b) == 0 {
+			continue
+		}
+		out.WriteString(b)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// textLen returns the length of the text in the markup s.
+func textLen(s string) (int) {
+	return len(strings.TrimSpace(reAnyTag.ReplaceAllString(s, "")))
+}
+
+// keepAttrs are the attributes left on the clipped markup.
+var keepAttrs = map[string]bool{"href": true, "src": true, "alt": true, "title": true, "colspan": true, "rowspan": true}
+
+// cleanClip strips the active content, the layout wrappers and the presentational attributes
+// from the markup s clipped of the page base, and makes its links absolute.
+func cleanClip(s string, base *url.URL) (string) {
+	s = sanitizeHTML(s)
+	s = reDropTag.ReplaceAllString(s, "")
+	s = reTag.ReplaceAllStringFunc(s, func(tag string) (string) {
+		inner := tag[1 : len(tag)-1]
+		selfClose := strings.HasSuffix(inner, "/")
+		inner = strings.TrimSuffix(inner, "/")
+		i := strings.IndexAny(inner, " \t\r\n\f")
+		if i < 0 {
+			return tag
+		}
+		var out strings.Builder
+		out.WriteString("<" + inner[:i])
+		for _, m := range reAttr.FindAllStringSubmatch(inner[i:], -1) {
+			attr := strings.ToLower(m[1])
+			if !keepAttrs[attr] || m[3] == "" {
+				continue
+			}
+			v := html.UnescapeString(strings.Trim(m[3], `"'`))
+			if attr == "href" || attr == "src" {
+				u, err := base.Parse(v)
+				if err != nil {
+					continue
+				}
+				v = u.String()
+			}
+			out.WriteString(" " + attr + `="` + html.EscapeString(v) + `"`)
+		}
+		if selfClose {
+			out.WriteString("/")
+		}
+		out.WriteString(">")
+		return out.String()
+	})
+	return strings.TrimSpace(reBlank.ReplaceAllString(s, "\n\n"))
+}
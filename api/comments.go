@@ -0,0 +1,320 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// comments on tiddlers, stored as child tiddlers
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+var (
+	// CommentGuests lets guests comment, their comments wait for approval.
+	CommentGuests = false
+
+	// CommentModeration makes the comments of users other than admins wait for approval too.
+	CommentModeration = false
+
+	// CommentTag is the tag of comment tiddlers.
+	CommentTag = "Comment"
+
+	// MaxCommentSize is the max comment text size in bytes.
+	MaxCommentSize = 10000
+
+	reCommentAction = regexp.MustCompile(`^(.+)/comments/([^/]+)/(approve|delete)$`)
+)
+
+// commentInfo is a comment in the API responses.
+type commentInfo struct {
+	Title   string `json:"title"`
+	Of      string `json:"comment-of"`
+	Author  string `json:"author"`
+	Created string `json:"created"`
+	Status  string `json:"status"`
+	Text    string `json:"text"`
+}
+
+func twNow() (string) {
+	now := time.Now().UTC()
+	return now.Format("20060102150405") + now.Format(".000")[1:]
+}
+
+// comment handles the POST requests under /recipes/all/tiddlers/:
+// <title>/comments adds a comment, <title>/comments/<id>/approve and /delete moderate it.
+func comment(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
+	if strings.HasSuffix(key, "/comments") {
+		addComment(w, r, strings.TrimSuffix(key, "/comments"))
+		return
+	}
+	if m := reCommentAction.FindStringSubmatch(key); m != nil {
+		moderateComment(w, r, m[1] + "/comments/" + m[2], m[3])
+		return
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// commentOf loads a comment tiddler, nil when title is not a comment.
+func commentOf(r *http.Request, title string) (*commentInfo, map[string]interface{}, error) {
+	t, err := StoreDb.Get(r.Context(), title)
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := store.FlatFields(js)
+	if fields["comment-of"] == "" {
+		return nil, js, nil
+	}
+	return &commentInfo{
+		Title:   title,
+		Of:      fields["comment-of"],
+		Author:  fields["comment-author"],
+		Created: fields["created"],
+		Status:  fields["comment-status"],
+		Text:    fields["text"],
+	}, js, nil
+}
+
+// checkGuestComment limits the comments of guests like their saves of the public scratchpad:
+// -anon-rate per hour and address, with the -anon-work proof of work.
+func checkGuestComment(w http.ResponseWriter, r *http.Request) (ok bool) {
+	if AnonWork > 0 && !checkWork(r.Header.Get("X-Proof-Of-Work")) {
+		http.Error(w, "missing or wrong proof of work, see /anon/challenge", http.StatusForbidden)
+		return false
+	}
+	if !anonAllow(clientAddr(r), time.Now()) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "too many comments, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func addComment(w http.ResponseWriter, r *http.Request, parent string) {
+	user, logged := currentUser(r)
+	if !logged && !CommentGuests {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkWritable(w, r) {
+		return
+	}
+
+	var req struct {
+		Text string `json:"text"`
+		Name string `json:"name"` // guests only
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(MaxCommentSize) + 4096))
+	if err != nil || json.Unmarshal(body, &req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len(req.Text) > MaxCommentSize {
+		http.Error(w, "comment text is empty or too long", http.StatusBadRequest)
+		return
+	}
+	if !logged && !checkGuestComment(w, r) {
+		return
+	}
+
+	if hide, err := isHidden(r, parent); hide || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := StoreDb.Get(r.Context(), parent); err != nil || isPrivate(parent) {
+		http.NotFound(w, r)
+		return
+	}
+
+	author, creator := user, user
+	status := "approved"
+	if !logged {
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > 64 {
+			name = "anonymous"
+		}
+		author, creator = name + " (guest)", "GUEST"
+		status = "pending"
+	} else if CommentModeration && !isAdmin(r) {
+		status = "pending"
+	}
+
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+	now := twNow()
+	title := parent + "/comments/" + now + "-" + hex.EncodeToString(rnd)
+
+	js := map[string]interface{}{
+		"title":    title,
+		"type":     "text/plain",
+		"tags":     []interface{}{CommentTag},
+		"text":     req.Text,
+		"created":  now,
+		"modified": now,
+		"creator":  creator,
+		"modifier": creator,
+		"fields": map[string]interface{}{
+			"comment-of":     parent,
+			"comment-author": author,
+			"comment-status": status,
+		},
+	}
+	_, err = StoreDb.Put(r.Context(), newPutTiddler(r.Context(), title, js))
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if status == "approved" {
+		notify(r.Context(), author, "comment", parent, req.Text, "")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(commentInfo{
+		Title: title, Of: parent, Author: author, Created: now, Status: status, Text: req.Text,
+	})
+}
+
+// moderateComment approves or deletes a comment. Admins can do both, users can delete their own comments.
+func moderateComment(w http.ResponseWriter, r *http.Request, title string, action string) {
+	user, logged := currentUser(r)
+	if !logged {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkWritable(w, r) {
+		return
+	}
+
+	c, js, err := commentOf(r, title)
+	if err == store.ErrNotFound || (err == nil && c == nil) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	admin := isAdmin(r)
+	own := js["creator"] == user && user != "GUEST"
+	switch {
+	case action == "delete" && (admin || own):
+		err = StoreDb.Delete(r.Context(), title)
+	case action == "approve" && admin:
+		fields, _ := js["fields"].(map[string]interface{})
+		if fields == nil {
+			fields = make(map[string]interface{})
+			js["fields"] = fields
+		}
+		fields["comment-status"] = "approved"
+		js["modified"] = twNow()
+		js["modifier"] = user
+		delete(js, "revision")
+		_, err = StoreDb.Put(r.Context(), newPutTiddler(r.Context(), title, js))
+	default:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if action == "approve" {
+		notify(r.Context(), c.Author, "comment", c.Of, c.Text, "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// comments serves GET /comments?title=<title>, the comments of a tiddler oldest first,
+// and GET /comments?status=pending, the moderation queue for admins.
+// Pending comments are only listed for admins and their authors.
+func comments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	parent := q.Get("title")
+	pendingOnly := q.Get("status") == "pending"
+	if parent == "" && !pendingOnly {
+		http.Error(w, "title required", http.StatusBadRequest)
+		return
+	}
+	admin := isAdmin(r)
+	if pendingOnly && !admin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	user, _ := currentUser(r)
+
+	tiddlers, err := StoreDb.All(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if isHiddenTitle(hidden, parent) {
+		http.NotFound(w, r)
+		return
+	}
+
+	list := make([]*commentInfo, 0)
+	for _, t := range tiddlers {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		fields := store.FlatFields(js)
+		if fields["comment-of"] == "" || (parent != "" && fields["comment-of"] != parent) {
+			continue
+		}
+		pending := fields["comment-status"] == "pending"
+		if pendingOnly && !pending {
+			continue
+		}
+		if pending && !admin && (user == "" || fields["creator"] != user) {
+			continue
+		}
+
+		c, _, err := commentOf(r, fields["title"])
+		if err != nil || c == nil {
+			continue
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,83 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// CSRF tokens for the session changing endpoints
+package api
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// CSRFHeader carries the CSRF token of the session, in the responses of /status and in the requests.
+const CSRFHeader = "X-CSRF-Token"
+
+// csrfToken returns the CSRF token of sess, making one on first use.
+func csrfToken(sess *Store) (string) {
+	if tok, ok := sess.Get("csrf"); ok {
+		if s, ok := tok.(string); ok && s != "" {
+			return s
+		}
+	}
+	tok, err := genSID()
+	if err != nil {
+		return ""
+	}
+	sess.Set("csrf", tok)
+	return tok
+}
+
+// checkCSRF reports whether r is allowed to change sess: it carries the token of sess
+// in the X-CSRF-Token header or the csrf_token form field, or it comes from our own origin.
+// The origin check keeps the stock TiddlyWeb adaptor working, which knows nothing of tokens.
+func checkCSRF(r *http.Request, sess *Store) (bool) {
+	tok := r.Header.Get(CSRFHeader)
+	if tok == "" {
+		tok = r.PostFormValue("csrf_token")
+	}
+	if tok != "" {
+		want, ok := sess.Get("csrf")
+		s, _ := want.(string)
+		return ok && s != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(s)) == 1
+	}
+	return sameOrigin(r)
+}
+
+// sameOrigin reports whether the Origin, or failing that the Referer, of r is this host.
+func sameOrigin(r *http.Request) (bool) {
+	src := r.Header.Get("Origin")
+	if src == "" || src == "null" {
+		src = r.Header.Get("Referer")
+	}
+	if src == "" {
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && u.Host == r.Host
+}
+
+var logoutPage = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Log out</title></head>
+<body>
+<form method="post" action="logout">
+<input type="hidden" name="csrf_token" value="{{.}}">
+<p>Log out of this wiki?</p>
+<button type="submit">Log out</button>
+</form>
+</body></html>
+`))
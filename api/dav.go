@@ -0,0 +1,495 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// minimal WebDAV (class 1 & fake 2) endpoint exposing tiddlers as .tid files
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+var (
+	// DavBasicTTL is how long a successful HTTP Basic login on /dav/ is remembered,
+	// so WebDAV clients do not pay the login delay on every request.
+	DavBasicTTL = 5 * time.Minute
+
+	davLogins = struct {
+		sync.Mutex
+		m map[[sha256.Size]byte]time.Time
+	}{m: make(map[[sha256.Size]byte]time.Time)}
+)
+
+const davPrefix = "/dav/"
+
+// checkDavAuth accepts a logged in session cookie or HTTP Basic credentials.
+func checkDavAuth(w http.ResponseWriter, r *http.Request) (ok bool) {
+	user, pwd, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		if _, err := Sess.GetSID(r); err == nil {
+			return checkAuth(w, r)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="widdly"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if davCached(user, pwd) {
+		return true
+	}
+
+	if Authenticate == nil || !Authenticate(user, pwd) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="widdly"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + pwd))
+	now := time.Now()
+	davLogins.Lock()
+	for k, exp := range davLogins.m {
+		if now.After(exp) {
+			delete(davLogins.m, k)
+		}
+	}
+	davLogins.m[sum] = now.Add(DavBasicTTL)
+	davLogins.Unlock()
+	return true
+}
+
+// davCached tells whether the credentials had a successful /dav/ login less than DavBasicTTL ago.
+func davCached(user string, pwd string) (bool) {
+	sum := sha256.Sum256([]byte(user + "\x00" + pwd))
+	davLogins.Lock()
+	exp, found := davLogins.m[sum]
+	davLogins.Unlock()
+	return found && time.Now().Before(exp)
+}
+
+// davTitle returns the tiddler title for a /dav/ path, "" for the collection itself.
+func davTitle(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(urlPath, davPrefix)
+	if name == "" {
+		return "", true
+	}
+	if strings.Contains(name, "/") || !strings.HasSuffix(name, ".tid") {
+		return "", false
+	}
+	return store.FileToTitle(strings.TrimSuffix(name, ".tid")), true
+}
+
+// davHref returns the escaped /dav/ URL of a tiddler.
+func davHref(base string, title string) (string) {
+	return base + url.PathEscape(store.TitleToFile(title) + ".tid")
+}
+
+// davBase returns the /dav/ URL prefix as the client sees it, with the -base prefix.
+func davBase(r *http.Request) (string) {
+	base := davPrefix
+	if r.RequestURI != "" {
+		if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+			if idx := strings.LastIndex(u.EscapedPath(), davPrefix); idx > 0 {
+				base = u.EscapedPath()[:idx] + davPrefix
+			}
+		}
+	}
+	return base
+}
+
+func dav(w http.ResponseWriter, r *http.Request) {
+	title, ok := davTitle(r.URL.Path)
+	if !ok || isPrivate(title) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MOVE, LOCK, UNLOCK")
+		w.Header().Set("MS-Author-Via", "DAV")
+	case "PROPFIND":
+		davPropfind(w, r, title)
+	case "GET", "HEAD":
+		if title == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		davGet(w, r, title)
+	case "PUT":
+		if title == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkDavAuth(w, r) || !checkWritable(w, r) || !checkSystemEdit(w, r, title) {
+			return
+		}
+		davPut(w, r, title)
+	case "DELETE":
+		if title == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkDavAuth(w, r) || !checkWritable(w, r) || !checkSystemEdit(w, r, title) {
+			return
+		}
+		davDelete(w, r, title)
+	case "MOVE":
+		if title == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkDavAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		davMove(w, r, title)
+	case "LOCK":
+		if !checkDavAuth(w, r) {
+			return
+		}
+		davLock(w, r)
+	case "UNLOCK":
+		if !checkDavAuth(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// davFile loads a tiddler and renders it as a .tid file.
+func davFile(r *http.Request, title string) ([]byte, map[string]interface{}, error) {
+	hide, err := isHidden(r, title)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hide {
+		return nil, nil, store.ErrNotFound
+	}
+	t, err := StoreDb.Get(r.Context(), title)
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.EncodeTid(js), js, nil
+}
+
+// twTime parses a TiddlyWiki date field, zero time when missing or malformed.
+func twTime(v interface{}) (time.Time) {
+	s, _ := v.(string)
+	if len(s) < 14 {
+		return time.Time{}
+	}
+	t, err := time.Parse("20060102150405", s[:14])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func davGet(w http.ResponseWriter, r *http.Request, title string) {
+	data, js, err := davFile(r, title)
+	if err == store.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", fmt.Sprintf(`"%v"`, js["revision"]))
+	if t := twTime(js["modified"]); !t.IsZero() {
+		w.Header().Set("Last-Modified", t.Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(data)
+}
+
+func davPut(w http.ResponseWriter, r *http.Request, title string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	js, err := store.DecodeTid(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	js["title"] = title // the file name wins over the title field
+	if !checkArchived(w, r, title, js) {
+		return
+	}
+	sanitizeFields(r, js)
+	stripFields(js)
+
+	old := oldText(r.Context(), title, js)
+	text, _ := js["text"].(string)
+	_, err = StoreDb.Get(r.Context(), title)
+	created := err == store.ErrNotFound
+
+	_, err = StoreDb.Put(r.Context(), newPutTiddler(r.Context(), title, js))
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	notifyEdit(r, title, text, old)
+	trackEdit(r, title, created)
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func davDelete(w http.ResponseWriter, r *http.Request, title string) {
+	_, err := StoreDb.Get(r.Context(), title)
+	if err == store.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkArchived(w, r, title, nil) {
+		return
+	}
+
+	aliases := noteDelete(r.Context(), title)
+	err = StoreDb.Delete(r.Context(), title)
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	aliases(r.Context())
+	user, _ := currentUser(r)
+	notify(r.Context(), user, "delete", title, "", "")
+	dropEdits(title)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// davMove renames a tiddler: the new title is saved and the old one deleted.
+func davMove(w http.ResponseWriter, r *http.Request, title string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		http.Error(w, "bad destination", http.StatusBadRequest)
+		return
+	}
+	idx := strings.LastIndex(dest.Path, davPrefix)
+	if idx < 0 {
+		http.Error(w, "bad destination", http.StatusBadGateway)
+		return
+	}
+	newTitle, ok := davTitle(dest.Path[idx:])
+	if !ok || newTitle == "" || isPrivate(newTitle) {
+		http.Error(w, "bad destination", http.StatusBadRequest)
+		return
+	}
+	if !checkSystemEdit(w, r, title) || !checkSystemEdit(w, r, newTitle) {
+		return
+	}
+	if newTitle == title {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !checkArchived(w, r, title, nil) || !checkArchived(w, r, newTitle, nil) {
+		return
+	}
+
+	t, err := StoreDb.Get(r.Context(), title)
+	if err == store.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	js, err := t.Fields()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	_, err = StoreDb.Get(r.Context(), newTitle)
+	exists := err == nil
+	if exists && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination exists", http.StatusPreconditionFailed)
+		return
+	}
+
+	js["title"] = newTitle
+	delete(js, "revision")
+	aliasMu.Lock()
+	pendingRenames[title] = pendingRename{to: newTitle, at: time.Now()} // the uuid moves along
+	aliasMu.Unlock()
+	defer func() {
+		aliasMu.Lock()
+		delete(pendingRenames, title)
+		aliasMu.Unlock()
+	}()
+	_, err = StoreDb.Put(r.Context(), newPutTiddler(r.Context(), newTitle, js))
+	if err == nil {
+		err = StoreDb.Delete(r.Context(), title)
+	}
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	addAlias(r.Context(), title, newTitle)
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// davLock hands out a lock token without locking anything,
+// for clients that refuse to write without class 2 support.
+func davLock(w http.ResponseWriter, r *http.Request) {
+	token := fmt.Sprintf("opaquelocktoken:%x", sha256.Sum256([]byte(fmt.Sprint(time.Now().UnixNano(), r.URL.Path))))
+	w.Header().Set("Lock-Token", "<" + token + ">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>
+<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>
+<D:depth>0</D:depth><D:timeout>Second-3600</D:timeout>
+<D:locktoken><D:href>%s</D:href></D:locktoken>
+</D:activelock></D:lockdiscovery></D:prop>`, token)
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+func davFileResponse(r *http.Request, base string, title string) (*davResponse, error) {
+	data, js, err := davFile(r, title)
+	if err != nil {
+		return nil, err
+	}
+
+	prop := davProp{
+		DisplayName:   store.TitleToFile(title) + ".tid",
+		ContentType:   "text/plain; charset=utf-8",
+		ContentLength: fmt.Sprint(len(data)),
+		ETag:          fmt.Sprintf(`"%v"`, js["revision"]),
+	}
+	if t := twTime(js["modified"]); !t.IsZero() {
+		prop.LastModified = t.Format(http.TimeFormat)
+	}
+	return &davResponse{
+		Href:     davHref(base, title),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}, nil
+}
+
+// davPropfind lists the collection (Depth 0 or 1) or a single file,
+// always with all properties.
+func davPropfind(w http.ResponseWriter, r *http.Request, title string) {
+	base := davBase(r)
+	ms := davMultistatus{XMLNS: "DAV:"}
+
+	if title != "" {
+		resp, err := davFileResponse(r, base, title)
+		if err == store.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		ms.Responses = append(ms.Responses, *resp)
+	} else {
+		ms.Responses = append(ms.Responses, davResponse{
+			Href: base,
+			Propstat: davPropstat{
+				Prop:   davProp{DisplayName: "tiddlers", ResourceType: davResourceType{Collection: &struct{}{}}},
+				Status: "HTTP/1.1 200 OK",
+			},
+		})
+
+		if depth := r.Header.Get("Depth"); depth != "0" {
+			tiddlers, err := StoreDb.All(r.Context())
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			for _, t := range tiddlers {
+				js, err := t.Fields()
+				if err != nil {
+					continue
+				}
+				title, _ := js["title"].(string)
+				resp, err := davFileResponse(r, base, title)
+				if err != nil {
+					continue
+				}
+				ms.Responses = append(ms.Responses, *resp)
+			}
+		}
+	}
+
+	data, err := xml.Marshal(ms)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207) // Multi-Status
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
@@ -0,0 +1,243 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// dead man's switch: an encrypted export sent after a long inactivity
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+// deadManTitle is the private tiddler keeping the state of the dead man's switch.
+const deadManTitle = privatePrefix + "deadman"
+
+var (
+	// DeadManAfter is how long without any logged in request fires the switch, 0 for disable.
+	DeadManAfter time.Duration
+
+	// DeadManPass is the passphrase the export is encrypted with, see EncryptExport.
+	DeadManPass string
+
+	// DeadManSend delivers the encrypted export, e.g. by mail or to a bucket.
+	DeadManSend func(ctx context.Context, name string, data []byte) (error)
+
+	// DeadManCheck is how often the inactivity is checked and the last activity saved.
+	DeadManCheck = time.Hour
+
+	lastActive   time.Time // in memory, saved by the checks
+	lastActiveMu sync.Mutex
+)
+
+// deadManState is saved in deadManTitle.
+type deadManState struct {
+	LastActive time.Time `json:"last_active"`
+	Fired      time.Time `json:"fired,omitempty"` // the switch fired for the inactivity since LastActive
+}
+
+// noteActive records a request of a logged in user.
+func noteActive(r *http.Request) {
+	if DeadManAfter <= 0 {
+		return
+	}
+	if _, ok := currentUser(r); !ok {
+		return
+	}
+	lastActiveMu.Lock()
+	lastActive = time.Now()
+	lastActiveMu.Unlock()
+}
+
+// StartDeadMan checks the inactivity every DeadManCheck until ctx is done,
+// and fires the switch once per inactivity longer than DeadManAfter.
+// It does nothing when DeadManAfter, DeadManPass or DeadManSend is not set.
+func StartDeadMan(ctx context.Context) {
+	if DeadManAfter <= 0 || DeadManPass == "" || DeadManSend == nil {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(DeadManCheck)
+		defer tick.Stop()
+		for {
+			if err := checkDeadMan(ctx, time.Now()); err != nil {
+				log.Println("[deadman]", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+}
+
+// checkDeadMan saves the last activity and fires the switch when it is older than DeadManAfter at now.
+func checkDeadMan(ctx context.Context, now time.Time) (error) {
+	var st deadManState
+	if err := loadPrivate(ctx, deadManTitle, &st); err != nil {
+		return err
+	}
+	lastActiveMu.Lock()
+	active := lastActive
+	lastActiveMu.Unlock()
+
+	changed := false
+	switch {
+	case active.After(st.LastActive):
+		st.LastActive, st.Fired = active, time.Time{}
+		changed = true
+	case st.LastActive.IsZero(): // first run: the inactivity starts now
+		st.LastActive = now
+		changed = true
+	}
+
+	if st.Fired.IsZero() && now.Sub(st.LastActive) >= DeadManAfter {
+		data, err := deadManExport(ctx)
+		if err != nil {
+			return err
+		}
+		data, err = EncryptExport(data, DeadManPass)
+		if err != nil {
+			return err
+		}
+		name := "widdly-" + now.Format("20060102") + ".json.enc"
+		if err := DeadManSend(ctx, name, data); err != nil {
+			return err
+		}
+		log.Println("[deadman] no activity since", st.LastActive.Format(time.RFC3339), "sent", name)
+		st.Fired = now
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return savePrivate(ctx, deadManTitle, &st)
+}
+
+// deadManExport returns all the tiddlers but the private ones, with text, as a TiddlyWiki JSON array.
+func deadManExport(ctx context.Context) ([]byte, error) {
+	all, err := StoreDb.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]map[string]string, 0, len(all))
+	for _, t := range all {
+		if isPrivateTiddler(t) {
+			continue
+		}
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		if _, ok := js["text"]; !ok {
+			title, _ := js["title"].(string)
+			td, err := StoreDb.Get(ctx, title)
+			if err != nil {
+				return nil, err
+			}
+			if js, err = td.Fields(); err != nil {
+				return nil, err
+			}
+		}
+		fields := store.FlatFields(js)
+		for k := range fields {
+			if exportSkip[k] {
+				delete(fields, k)
+			}
+		}
+		rows = append(rows, fields)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["title"] < rows[j]["title"] })
+	return json.Marshal(rows)
+}
+
+// exportMagic starts the encrypted exports: magic, 16 bytes salt, 12 bytes nonce,
+// then the AES-256-GCM sealed data with the key derived from the passphrase
+// by PBKDF2-HMAC-SHA256 with exportIter iterations.
+const (
+	exportMagic = "WIDDLY-ENC-1\n"
+	exportIter  = 600000
+)
+
+var ErrBadExport = errors.New("not an encrypted export or wrong passphrase")
+
+// pbkdf2 derives a 32 bytes key from pass and salt (RFC 8018 with HMAC-SHA256, one block).
+func pbkdf2(pass []byte, salt []byte, iter int) ([]byte) {
+	prf := hmac.New(sha256.New, pass)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func exportAEAD(pass string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2([]byte(pass), salt, exportIter))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptExport encrypts data with the passphrase pass, see DecryptExport.
+func EncryptExport(data []byte, pass string) ([]byte, error) {
+	head := make([]byte, len(exportMagic) + 16 + 12)
+	copy(head, exportMagic)
+	if _, err := rand.Read(head[len(exportMagic):]); err != nil {
+		return nil, err
+	}
+	aead, err := exportAEAD(pass, head[len(exportMagic) : len(exportMagic) + 16])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(head, head[len(exportMagic) + 16:], data, []byte(exportMagic)), nil
+}
+
+// DecryptExport decrypts the output of EncryptExport.
+func DecryptExport(data []byte, pass string) ([]byte, error) {
+	n := len(exportMagic)
+	if len(data) < n + 16 + 12 || !bytes.HasPrefix(data, []byte(exportMagic)) {
+		return nil, ErrBadExport
+	}
+	aead, err := exportAEAD(pass, data[n : n + 16])
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, data[n + 16 : n + 28], data[n + 28:], []byte(exportMagic))
+	if err != nil {
+		return nil, ErrBadExport
+	}
+	return plain, nil
+}
@@ -0,0 +1,88 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// compressed request bodies
+package api
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	// MaxDecodedBody caps the decompressed size of a compressed request body, 0 for unlimit.
+	MaxDecodedBody int64 = 256 * 1024 * 1024
+)
+
+// BodyDecoder decompresses a request body sent with a Content-Encoding.
+type BodyDecoder func(r io.Reader) (io.ReadCloser, error)
+
+var decoders = map[string]BodyDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	},
+}
+
+// RegBodyDecoder adds the decoder of a Content-Encoding.
+func RegBodyDecoder(name string, dec BodyDecoder) {
+	decoders[name] = dec
+}
+
+// acceptEncoding lists the supported request Content-Encodings, for the Accept-Encoding response header.
+func acceptEncoding() (string) {
+	list := make([]string, 0, len(decoders))
+	for name := range decoders {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// withDecompress decodes compressed request bodies, so every handler reads plain bodies.
+// Unknown encodings get 415 Unsupported Media Type.
+func withDecompress(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if enc == "" || enc == "identity" {
+			f(w, r)
+			return
+		}
+		dec, ok := decoders[enc]
+		if !ok {
+			w.Header().Set("Accept-Encoding", acceptEncoding())
+			http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := dec(r.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		if MaxDecodedBody > 0 {
+			r.Body = http.MaxBytesReader(w, body, MaxDecodedBody)
+		}
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		f(w, r)
+	}
+}
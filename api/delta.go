@@ -0,0 +1,179 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// versioned and delta uploads of index.html
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// indexMu serializes the writes of index.html and guards indexTag.
+var indexMu sync.Mutex
+
+// indexTag caches the ETag of the base page for its path, size and mtime.
+var indexTag struct {
+	path string
+	size int64
+	mod  time.Time
+	etag string
+}
+
+// indexETag returns the ETag of index.html, the quoted sha256 hex of its content.
+func indexETag() (string, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	return indexETagLocked()
+}
+
+func indexETagLocked() (string, error) {
+	fpath := indexPath()
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return "", err
+	}
+	if indexTag.etag != "" && fpath == indexTag.path && fi.Size() == indexTag.size && fi.ModTime().Equal(indexTag.mod) {
+		return indexTag.etag, nil
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	indexTag.path, indexTag.size, indexTag.mod, indexTag.etag = fpath, fi.Size(), fi.ModTime(), `"` + indexSum(data) + `"`
+	return indexTag.etag, nil
+}
+
+// checkIfMatch answers 412 Precondition Failed when the If-Match header of r is not the ETag of index.html,
+// so a save from a stale page cannot overwrite a newer one. The caller holds indexMu.
+func checkIfMatch(w http.ResponseWriter, r *http.Request) (ok bool) {
+	match := r.Header.Get("If-Match")
+	if match == "" || match == "*" {
+		return true
+	}
+	etag, err := indexETagLocked()
+	if err != nil && !os.IsNotExist(err) {
+		internalError(w, err)
+		return false
+	}
+	if match != etag {
+		http.Error(w, "index.html changed on the server", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// writeIndex saves index.html and sets the ETag of the new version. The caller holds indexMu.
+func writeIndex(w http.ResponseWriter, data []byte) (error) {
+	fpath := indexPath()
+	if err := ioutil.WriteFile(fpath, data, 0644); err != nil {
+		return err
+	}
+	etag := `"` + indexSum(data) + `"`
+	if fi, err := os.Stat(fpath); err == nil {
+		indexTag.path, indexTag.size, indexTag.mod, indexTag.etag = fpath, fi.Size(), fi.ModTime(), etag
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+// IndexEdit replaces Del bytes at offset At of the old index.html with Ins.
+type IndexEdit struct {
+	At  int    `json:"at"`
+	Del int    `json:"del"`
+	Ins string `json:"ins"`
+}
+
+var errBadEdits = errors.New("edits out of range or overlapping")
+
+// applyEdits applies edits, sorted by offset and not overlapping, to old.
+func applyEdits(old []byte, edits []IndexEdit) ([]byte, error) {
+	size := len(old)
+	for _, e := range edits {
+		size += len(e.Ins) - e.Del
+	}
+	if size < 0 {
+		return nil, errBadEdits
+	}
+	out := make([]byte, 0, size)
+	pos := 0
+	for _, e := range edits {
+		if e.At < pos || e.Del < 0 || e.At + e.Del > len(old) {
+			return nil, errBadEdits
+		}
+		out = append(out, old[pos:e.At]...)
+		out = append(out, e.Ins...)
+		pos = e.At + e.Del
+	}
+	return append(out, old[pos:]...), nil
+}
+
+func indexSum(data []byte) (string) {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// patchIndex serves PATCH /, saving index.html from only the changed parts:
+//
+//	{"base": "<sha256 hex of the index.html the edits apply to>", "edits": [{"at": 1234, "del": 56, "ins": "..."}]}
+//
+// A base which is not the current index.html gets 409 Conflict, the client should PUT the whole file then.
+// If-Match is checked like for PUT /.
+// The response is {"sha256": "<hex>"} of the saved file, the base of the next delta.
+func patchIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Base  string      `json:"base"`
+		Edits []IndexEdit `json:"edits"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(body, &req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if !checkIfMatch(w, r) {
+		return
+	}
+
+	old, err := ioutil.ReadFile(indexPath())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if req.Base != indexSum(old) {
+		http.Error(w, "index.html changed, upload it whole", http.StatusConflict)
+		return
+	}
+	data, err := applyEdits(old, req.Edits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkIndexPage(w, data) {
+		return
+	}
+	if err := writeIndex(w, data); err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"sha256": indexSum(data)})
+}
@@ -0,0 +1,74 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// end-to-end checksums of the tiddler text
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentSHA256Header carries the hex SHA-256 of the tiddler text: sent with GET and PUT responses
+// for the text as stored, checked against the text of a PUT request carrying it.
+const ContentSHA256Header = "X-Content-SHA256"
+
+// textSum returns the hex SHA-256 of text.
+func textSum(text string) (string) {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// fatTextSum returns the textSum of the text of the fat tiddler JSON data.
+func fatTextSum(data []byte) (string) {
+	var js struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(data, &js)
+	return textSum(js.Text)
+}
+
+// checkTextSum refuses the PUT request r with 400 Bad Request when it carries
+// a ContentSHA256Header not matching the text it carries.
+func checkTextSum(w http.ResponseWriter, r *http.Request, text string) (ok bool) {
+	want := strings.ToLower(strings.TrimSpace(r.Header.Get(ContentSHA256Header)))
+	if want == "" || want == textSum(text) {
+		return true
+	}
+	http.Error(w, ContentSHA256Header + " does not match the text", http.StatusBadRequest)
+	return false
+}
+
+// checkStreamSum is checkTextSum for the text spooled to f by parseStreamBody, left at its start.
+func checkStreamSum(w http.ResponseWriter, r *http.Request, f io.ReadSeeker) (sum string, ok bool) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		internalError(w, err)
+		return "", false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		internalError(w, err)
+		return "", false
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	want := strings.ToLower(strings.TrimSpace(r.Header.Get(ContentSHA256Header)))
+	if want != "" && want != sum {
+		http.Error(w, ContentSHA256Header + " does not match the text", http.StatusBadRequest)
+		return "", false
+	}
+	return sum, true
+}
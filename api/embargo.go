@@ -0,0 +1,159 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// publish-at embargo: future tiddlers and pending comments are hidden from guests
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+var (
+	// PublishField is the date field hiding a tiddler from guests until that time, empty for disable.
+	PublishField = "publish-at"
+
+	embargo = &embargoIndex{}
+)
+
+// embargoIndex lists the tiddlers with a future PublishField, rebuilt when the store changes.
+type embargoIndex struct {
+	lock  sync.Mutex
+	gen   uint64
+	valid bool
+	until map[string]time.Time
+	next  time.Time // earliest until
+}
+
+// publishTime returns the PublishField of a tiddler, zero when missing or malformed.
+func publishTime(fields map[string]string) (time.Time) {
+	if PublishField == "" {
+		return time.Time{}
+	}
+	t, _, ok := calDate(fields[PublishField])
+	if !ok {
+		return time.Time{}
+	}
+	return t
+}
+
+// hidden returns the embargoed titles and the pending comments by store.StoreKey, nil when there are none.
+func (x *embargoIndex) hidden(ctx context.Context) (map[string]time.Time, error) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	now := time.Now()
+	if x.valid && x.gen == respCache.Generation() {
+		if x.next.IsZero() || now.Before(x.next) {
+			return x.until, nil
+		}
+		respCache.Invalidate() // cached guest responses still hide the published tiddlers
+	}
+
+	gen := respCache.Generation()
+	tiddlers, err := StoreDb.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	until := make(map[string]time.Time)
+	next := time.Time{}
+	for _, t := range tiddlers {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		fields := store.FlatFields(js)
+		if fields["comment-status"] == "pending" {
+			until[store.StoreKey(fields["title"])] = time.Time{}
+			continue
+		}
+		pt := publishTime(fields)
+		if pt.IsZero() || !now.Before(pt) {
+			continue
+		}
+		until[store.StoreKey(fields["title"])] = pt
+		if next.IsZero() || pt.Before(next) {
+			next = pt
+		}
+	}
+	if len(until) == 0 {
+		until = nil
+	}
+
+	x.gen, x.valid, x.until, x.next = gen, true, until, next
+	return until, nil
+}
+
+// isLoggedIn tells whether the request has a logged in session or cached /dav/ credentials,
+// without starting a session.
+func isLoggedIn(r *http.Request) (bool) {
+	if user, pwd, ok := r.BasicAuth(); ok && davCached(user, pwd) {
+		return true
+	}
+	sess := Sess.sessionOf(r)
+	return sess != nil && sess.IsLogin()
+}
+
+// hiddenFor returns the titles hidden from the client of r: the embargoed ones for guests, nil otherwise.
+func hiddenFor(r *http.Request) (map[string]time.Time, error) {
+	if isLoggedIn(r) {
+		return nil, nil
+	}
+	return embargo.hidden(r.Context())
+}
+
+// isHidden tells whether the tiddler title is hidden from the client of r, private tiddlers always are.
+func isHidden(r *http.Request, title string) (bool, error) {
+	if isPrivate(title) {
+		return true, nil
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		return false, err
+	}
+	return isHiddenTitle(hidden, title), nil
+}
+
+// isHiddenTitle tells whether title is in hidden, which is keyed by store.StoreKey.
+func isHiddenTitle(hidden map[string]time.Time, title string) (bool) {
+	_, ok := hidden[store.StoreKey(title)]
+	return ok
+}
+
+// withoutHidden filters the hidden titles and the private tiddlers out of tiddlers.
+func withoutHidden(tiddlers []*store.Tiddler, hidden map[string]time.Time) ([]*store.Tiddler) {
+	list := make([]*store.Tiddler, 0, len(tiddlers))
+	for _, t := range tiddlers {
+		if isPrivateTiddler(t) {
+			continue
+		}
+		if len(hidden) == 0 {
+			list = append(list, t)
+			continue
+		}
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if isHiddenTitle(hidden, title) {
+			continue
+		}
+		list = append(list, t)
+	}
+	return list
+}
@@ -0,0 +1,172 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// export of tiddlers selected by a filter as JSON or CSV
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"../store"
+)
+
+// exportSkip are the server side fields left out of exports.
+var exportSkip = map[string]bool{"bag": true, "revision": true, "permissions": true, "recipe": true, "uri": true}
+
+// export serves GET /export?filter=[tag[Recipe]]&format=json|csv&fields=title,tags,...
+// The filter defaults to [!is[system]], fields to all the fields of the matching tiddlers,
+// JSON is the TiddlyWiki format (an array of string fields), CSV has one column per field.
+func export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	src := q.Get("filter")
+	if src == "" {
+		src = "[!is[system]]"
+	}
+	filter, err := ParseFilter(src)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	var columns []string
+	if f := q.Get("fields"); f != "" {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				columns = append(columns, name)
+			}
+		}
+	}
+
+	all, err := StoreDb.All(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	all = withoutHidden(all, hidden)
+
+	rows := make([]map[string]string, 0)
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		if !filter.MatchJSON(js) {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if _, ok := js["text"]; !ok { // skinny
+			td, err := StoreDb.Get(r.Context(), title)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			js, err = td.Fields()
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+		}
+
+		fields := store.FlatFields(js)
+		for k := range fields {
+			if exportSkip[k] {
+				delete(fields, k)
+			}
+		}
+		rows = append(rows, fields)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["title"] < rows[j]["title"] })
+
+	if columns == nil {
+		columns = exportColumns(rows)
+	} else {
+		for i, fields := range rows {
+			row := make(map[string]string, len(columns))
+			for _, c := range columns {
+				if v, ok := fields[c]; ok {
+					row[c] = v
+				}
+			}
+			rows[i] = row
+		}
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="tiddlers.` + format + `"`)
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.Marshal(rows)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+	for _, fields := range rows {
+		record := make([]string, len(columns))
+		for i, c := range columns {
+			record[i] = fields[c]
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
+
+// exportColumns returns the fields used by rows: title first, text last, the others sorted.
+func exportColumns(rows []map[string]string) ([]string) {
+	seen := make(map[string]bool)
+	for _, fields := range rows {
+		for k := range fields {
+			seen[k] = true
+		}
+	}
+	delete(seen, "title")
+	hasText := seen["text"]
+	delete(seen, "text")
+
+	columns := make([]string, 0, len(seen) + 2)
+	for k := range seen {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	columns = append([]string{"title"}, columns...)
+	if hasText {
+		columns = append(columns, "text")
+	}
+	return columns
+}
@@ -0,0 +1,224 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// HTTP handlers for raw tiddler text and attachment files
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"../store"
+)
+
+var (
+	// FilesDir is the directory served under /files/, empty for disable.
+	FilesDir = ""
+)
+
+// setUntrustedHeaders stops browsers from sniffing or running user content on the wiki origin.
+func setUntrustedHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+}
+
+// raw serves the text of a tiddler with the Content-Type of its type.
+func raw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/raw/")
+	hide, err := isHidden(r, key)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if hide {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := StoreDb.Get(r.Context(), key)
+	if err == store.ErrNotFound {
+		if !serveAlias(w, r, key) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	js, err := t.Fields()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	typ, _ := js["type"].(string)
+	text, _ := js["text"].(string)
+
+	ct := TypeInfo(typ)
+	data := []byte(text)
+	if ct.Base64 {
+		data, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+	}
+
+	if width := thumbWidth(r); width > 0 && ct.Base64 && thumbable(ct.Mime) {
+		thumb, err := tiddlerThumb(key, ct.Mime, text, width)
+		if err == nil {
+			data = thumb
+		}
+	}
+
+	setUntrustedHeaders(w, ct.Mime)
+	http.ServeContent(w, r, "", twTime(js["modified"]), bytes.NewReader(data)) // Range requests for audio and video
+}
+
+// filePath maps an URL path under /files/ into FilesDir.
+func filePath(urlPath string) (string) {
+	name := path.Clean("/" + strings.TrimPrefix(urlPath, "/files/"))
+	return filepath.Join(FilesDir, filepath.FromSlash(name))
+}
+
+// fileName returns the slash separated name of fpath in FilesDir.
+func fileName(fpath string) (string) {
+	rel, _ := filepath.Rel(FilesDir, fpath)
+	return filepath.ToSlash(rel)
+}
+
+// files serves, uploads (PUT) and deletes attachment files in FilesDir, or in Blobs when set.
+func files(w http.ResponseWriter, r *http.Request) {
+	if Blobs != nil {
+		blobFiles(w, r, strings.TrimPrefix(path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/files/")), "/"))
+		return
+	}
+	if FilesDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fpath := filePath(r.URL.Path)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		f, err := os.Open(fpath)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		if width := thumbWidth(r); width > 0 && fileThumb(w, r, fpath, width) {
+			return
+		}
+
+		setUntrustedHeaders(w, FileContentType(fpath))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+
+	case "PUT":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		if fpath == filepath.Clean(FilesDir) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		f, ok := spoolUpload(w, r, fileName(fpath), r.Body)
+		if !ok {
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		err := writeFileAtomic(fpath, f)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		dropThumbs(r.Context(), fileName(fpath))
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+
+		err := os.Remove(fpath)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		dropThumbs(r.Context(), fileName(fpath))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeFileAtomic writes src to a temp file next to fpath and renames it into place.
+func writeFileAtomic(fpath string, src io.Reader) (error) {
+	dir := filepath.Dir(fpath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
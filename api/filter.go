@@ -0,0 +1,247 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// a subset of the TiddlyWiki filter syntax, to select tiddlers on the server
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"../store"
+)
+
+var (
+	ErrFilterSyntax = errors.New("filter syntax error")
+)
+
+// filterStep is one operator of a run, like !tag[Done] or field:status[open].
+type filterStep struct {
+	negate  bool
+	op      string
+	suffix  string
+	operand string
+}
+
+// filterRun is one run of a filter: its steps must all match.
+type filterRun struct {
+	prefix byte // 0 (or), '+' (and), '-' (except)
+	steps  []filterStep
+}
+
+// Filter is a compiled filter, matching a tiddler at a time.
+// Supported: title literals, runs with +/-/~ prefixes and the operators
+// title, tag, prefix, suffix, has, is[system|draft|tiddler], contains, search, field:<name>, all;
+// any other operator compares the field of that name, like TiddlyWiki does.
+// Operands must be literal [..], {..} and <..> are not supported.
+type Filter struct {
+	src  string
+	runs []filterRun
+}
+
+// ParseFilter compiles a filter expression, empty matches every tiddler.
+func ParseFilter(src string) (*Filter, error) {
+	f := &Filter{src: src}
+	s := src
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+
+		var run filterRun
+		switch s[0] {
+		case '+', '-', '~':
+			run.prefix = s[0]
+			if run.prefix == '~' {
+				run.prefix = 0
+			}
+			s = s[1:]
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(s, "[["):
+			end := strings.Index(s, "]]")
+			if end < 0 {
+				return nil, fmt.Errorf("%v: missing ]] in %q", ErrFilterSyntax, src)
+			}
+			run.steps = []filterStep{{op: "title", operand: s[2:end]}}
+			s = s[end+2:]
+		case strings.HasPrefix(s, "["):
+			run.steps, s, err = parseSteps(s[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v in %q", ErrFilterSyntax, err, src)
+			}
+		case s[0] == '"' || s[0] == '\'':
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("%v: missing quote in %q", ErrFilterSyntax, src)
+			}
+			run.steps = []filterStep{{op: "title", operand: s[1:end+1]}}
+			s = s[end+2:]
+		default:
+			end := strings.IndexAny(s, " \t\r\n[")
+			if end < 0 {
+				end = len(s)
+			}
+			run.steps = []filterStep{{op: "title", operand: s[:end]}}
+			s = s[end:]
+		}
+		f.runs = append(f.runs, run)
+	}
+	return f, nil
+}
+
+// parseSteps parses the steps of a run up to its closing ']'.
+func parseSteps(s string) ([]filterStep, string, error) {
+	steps := make([]filterStep, 0, 2)
+	for {
+		if s == "" {
+			return nil, s, errors.New("missing ]")
+		}
+		if s[0] == ']' {
+			return steps, s[1:], nil
+		}
+
+		var step filterStep
+		if s[0] == '!' {
+			step.negate = true
+			s = s[1:]
+		}
+		open := strings.IndexAny(s, "[{<")
+		if open < 0 {
+			return nil, s, errors.New("missing operand")
+		}
+		if s[open] != '[' {
+			return nil, s, errors.New("only literal operands are supported")
+		}
+		step.op = s[:open]
+		if idx := strings.IndexByte(step.op, ':'); idx >= 0 {
+			step.op, step.suffix = step.op[:idx], step.op[idx+1:]
+		}
+		if step.op == "" {
+			step.op = "title"
+		}
+
+		end := strings.IndexByte(s[open:], ']')
+		if end < 0 {
+			return nil, s, errors.New("missing ] after operand")
+		}
+		step.operand = s[open+1 : open+end]
+		s = s[open+end+1:]
+		steps = append(steps, step)
+	}
+}
+
+// String returns the source of the filter.
+func (f *Filter) String() (string) {
+	if f == nil {
+		return ""
+	}
+	return f.src
+}
+
+// Match reports whether a tiddler with the given fields (see store.FlatFields) is selected.
+// A nil or empty filter matches every tiddler.
+func (f *Filter) Match(fields map[string]string) (bool) {
+	if f == nil || len(f.runs) == 0 {
+		return true
+	}
+
+	selected := false
+	for i, run := range f.runs {
+		ok := run.match(fields)
+		switch {
+		case run.prefix == '+' && i > 0:
+			selected = selected && ok
+		case run.prefix == '+' || run.prefix == 0:
+			selected = selected || ok
+		case run.prefix == '-':
+			selected = selected && !ok
+		}
+	}
+	return selected
+}
+
+// MatchJSON is Match for TiddlyWeb JSON fields.
+func (f *Filter) MatchJSON(js map[string]interface{}) (bool) {
+	if f == nil || len(f.runs) == 0 {
+		return true
+	}
+	return f.Match(store.FlatFields(js))
+}
+
+func (run filterRun) match(fields map[string]string) (bool) {
+	for _, step := range run.steps {
+		if step.match(fields) == step.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (step filterStep) match(fields map[string]string) (bool) {
+	title := fields["title"]
+	switch step.op {
+	case "all":
+		return true
+	case "title":
+		return title == step.operand
+	case "tag":
+		for _, tag := range store.ParseTags(fields["tags"]) {
+			if tag == step.operand {
+				return true
+			}
+		}
+		return false
+	case "prefix":
+		return strings.HasPrefix(title, step.operand)
+	case "suffix":
+		return strings.HasSuffix(title, step.operand)
+	case "has":
+		return fields[step.operand] != ""
+	case "is":
+		switch step.operand {
+		case "system":
+			return strings.HasPrefix(title, "$:/")
+		case "draft":
+			return fields["draft.of"] != "" || strings.HasPrefix(title, "Draft of '")
+		case "tiddler":
+			return true
+		}
+		return false
+	case "contains":
+		field := step.suffix
+		if field == "" {
+			field = "list"
+		}
+		for _, v := range store.ParseTags(fields[field]) {
+			if v == step.operand {
+				return true
+			}
+		}
+		return false
+	case "search":
+		field := step.suffix
+		text := fields["title"] + "\n" + fields["text"]
+		if field != "" {
+			text = fields[field]
+		}
+		return strings.Contains(strings.ToLower(text), strings.ToLower(step.operand))
+	case "field":
+		return fields[step.suffix] == step.operand
+	}
+	return fields[step.op] == step.operand
+}
@@ -0,0 +1,58 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	task := map[string]string{"title": "Task", "tags": "todo [[high prio]]", "status": "open", "due": "20240501"}
+	sys := map[string]string{"title": "$:/config/x", "tags": "todo"}
+
+	for _, c := range []struct {
+		filter    string
+		task, sys bool
+	}{
+		{"", true, true},
+		{"[tag[todo]]", true, true},
+		{"[tag[high prio]!is[system]]", true, false},
+		{"[tag[todo]] -[is[system]]", true, false},
+		{"[tag[todo]] +[prefix[$:/]]", false, true},
+		{"[status[open]]", true, false},
+		{"[field:status[closed]]", false, false},
+		{"[has[due]]", true, false},
+		{"Task [[$:/config/x]]", true, true},
+		{"'Task'", true, false},
+		{"[all[tiddlers]search[TAS]]", true, false},
+	} {
+		f, err := ParseFilter(c.filter)
+		if err != nil {
+			t.Errorf("%q: %v", c.filter, err)
+			continue
+		}
+		if got := f.Match(task); got != c.task {
+			t.Errorf("%q on task: want %v, got %v", c.filter, c.task, got)
+		}
+		if got := f.Match(sys); got != c.sys {
+			t.Errorf("%q on system: want %v, got %v", c.filter, c.sys, got)
+		}
+	}
+
+	for _, bad := range []string{"[tag[x]", "[[x", "[tag{x}]", "[tag<x>]", "'x"} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"../store"
+)
+
+func FuzzPutTiddler(f *testing.F) {
+	f.Add("tiddler", `{"title":"tiddler","text":"x"}`)
+	f.Add("$:/core/ui", `{"fields":{"draft.of":"x"}}`)
+	f.Add("a/b%20c", `{"fields":{"a":{"b":{"c":{"d":[[[[]]]]}}}}}`)
+	f.Add("num", `{"revision":1e999,"text":12345678901234567890123}`)
+	f.Add("null", `null`)
+	f.Add("\xff", `[]`)
+
+	cookie := loginCookie(f, "me")
+	f.Fuzz(func(t *testing.T, key string, body string) {
+		if !utf8.ValidString(key) || key == "" {
+			return
+		}
+
+		var got *store.Tiddler
+		setStore(&testStore{
+			put: func(_ context.Context, tiddler store.Tiddler) (int, error) {
+				got = &tiddler
+				return 1, nil
+			},
+		})
+
+		r := httptest.NewRequest("PUT", "/recipes/all/tiddlers/"+url.PathEscape(key), strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		tiddler(w, r)
+
+		switch w.Code {
+		case 204:
+			if got == nil {
+				t.Fatal("204 without Store.Put")
+			}
+			if got.Key != key {
+				t.Errorf("title mangled: want %q, got %q", key, got.Key)
+			}
+			if got.Js["bag"] != "bag" {
+				t.Errorf("want bag \"bag\", got %v", got.Js["bag"])
+			}
+		case 400:
+			if got != nil {
+				t.Fatal("400 after Store.Put")
+			}
+		default:
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+	})
+}
+
+func FuzzParseStreamBody(f *testing.F) {
+	f.Add(`{"title":"a","text":"x\"y\\z\né😀","fields":{"a":[1,{"b":"}"}]}}`)
+	f.Add(`{"text":"","n":-1.5e3,"t":true,"z":null}`)
+	f.Add(`{ "a" : "\ud800" , "text" : "\ud800x" }`)
+	f.Add(`{}`)
+
+	f.Fuzz(func(t *testing.T, body string) {
+		var want map[string]interface{}
+		if json.Unmarshal([]byte(body), &want) != nil || want == nil {
+			return
+		}
+		if _, ok := want["text"].(string); !ok {
+			return
+		}
+
+		js, text, err := parseStreamBody(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("parse %q: %v", body, err)
+		}
+		data, _ := ioutil.ReadAll(text)
+		text.Close()
+		os.Remove(text.Name())
+		js["text"] = string(data)
+
+		// compare through encoding/json, which also normalizes invalid UTF-8
+		a, _ := json.Marshal(want)
+		b, _ := json.Marshal(js)
+		if !bytes.Equal(a, b) {
+			t.Errorf("body %q\nwant %s\ngot  %s", body, a, b)
+		}
+	})
+}
@@ -22,14 +22,55 @@ import (
 
 var (
 	GzipLevel = 5 // disable = 0, DefaultCompression = -1, BestSpeed = 1, BestCompression = 9
+
+	// GzipMinSize is the smallest response which is compressed, smaller ones are not worth the CPU.
+	GzipMinSize = 1024
+
+	// GzipSkipTypes are the Content-Type prefixes of data which is compressed already.
+	GzipSkipTypes = []string{
+		"image/", "video/", "audio/", "font/woff",
+		"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz", "application/x-bzip2",
+		"application/pdf", "application/epub+zip",
+	}
 )
 
+// GzipResponseWriter compresses the response when the client accepts gzip,
+// the body reaches GzipMinSize and its Content-Type is not in GzipSkipTypes.
+// The first bytes are held back until that is known, so Close must be called.
 type GzipResponseWriter struct {
 	http.ResponseWriter
-	gzip *gzip.Writer
+	gzip  *gzip.Writer
+	level int // 0 when the client does not accept gzip
+
+	decided bool
+	buf     []byte // held back until decided
+	code    int    // status held back until decided
+}
+
+// WriteHeader holds the status back until it is known whether the body is compressed.
+func (w *GzipResponseWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.code == 0 {
+		w.code = code
+	}
 }
 
 func (w *GzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < GzipMinSize {
+			return len(p), nil
+		}
+		w.decide(true)
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
 	if w.gzip == nil {
 		return w.ResponseWriter.Write(p)
 	}
@@ -37,35 +78,118 @@ func (w *GzipResponseWriter) Write(p []byte) (int, error) {
 	return w.gzip.Write(p)
 }
 
+// decide starts the compression if big enough and worth it, and sends the held back status.
+func (w *GzipResponseWriter) decide(big bool) {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf)) // sniff the plain bytes, not the gzip
+	}
+	if big && w.level != 0 && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) &&
+		w.code != http.StatusNoContent && w.code != http.StatusNotModified && w.code != http.StatusPartialContent {
+		gw, err := gzip.NewWriterLevel(w.ResponseWriter, w.level)
+		if err != nil {
+			gw = gzip.NewWriter(w.ResponseWriter)
+		}
+		w.gzip = gw
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		if !strings.Contains(h.Get("Vary"), "Accept-Encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+}
+
+func (w *GzipResponseWriter) flushBuf() (error) {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gzip != nil {
+		_, err = w.gzip.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what was written so far, so streamed responses (event streams, big lists) are not held back.
+// A response flushed before GzipMinSize is compressed when it may be, as more is likely to follow.
+func (w *GzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+		w.flushBuf()
+	}
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *GzipResponseWriter) Unwrap() (http.ResponseWriter) {
+	return w.ResponseWriter
+}
+
+// Close sends the held back bytes and ends the gzip stream, it must be called once the handler is done.
 func (w *GzipResponseWriter) Close() (error) {
+	if !w.decided {
+		w.decide(false)
+		if err := w.flushBuf(); err != nil {
+			return err
+		}
+	}
 	if w.gzip != nil {
 		return w.gzip.Close()
 	}
 	return nil
 }
 
+// compressible tells whether the Content-Type ct is not in GzipSkipTypes.
+func compressible(ct string) (bool) {
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if strings.HasPrefix(ct, "image/svg") {
+		return true
+	}
+	for _, skip := range GzipSkipTypes {
+		if strings.HasPrefix(ct, skip) {
+			return false
+		}
+	}
+	return true
+}
+
 func CanAcceptsGzip(r *http.Request) (bool) {
 	s := strings.ToLower(r.Header.Get("Accept-Encoding"))
 	for _, ss := range strings.Split(s, ",") {
-		if strings.HasPrefix(ss, "gzip") {
+		if strings.HasPrefix(strings.TrimSpace(ss), "gzip") {
 			return true
 		}
 	}
 	return false
 }
 
+// TryGzipResponse wraps w to compress the response of r, see GzipResponseWriter.
+// Under withGzip, which every route has, the response is compressed already and the returned writer passes through.
 func TryGzipResponse(w http.ResponseWriter, r *http.Request) (*GzipResponseWriter) {
-	if !CanAcceptsGzip(r) || GzipLevel == 0 {
-		return &GzipResponseWriter{w, nil}
+	if _, ok := w.(*GzipResponseWriter); ok {
+		return &GzipResponseWriter{ResponseWriter: w, decided: true}
 	}
+	return &GzipResponseWriter{ResponseWriter: w, level: gzipLevelFor(r)}
+}
 
-	gw, err := gzip.NewWriterLevel(w, GzipLevel)
-	if err != nil {
-		gw = gzip.NewWriter(w)
+// withGzip is the compressing middleware.
+func withGzip(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gzw := TryGzipResponse(w, r)
+		defer gzw.Close()
+		f(gzw, r)
 	}
-	w.Header().Set("Content-Encoding", "gzip")
-	w.Header().Del("Content-Length")
-
-	return &GzipResponseWriter{w, gw}
 }
-
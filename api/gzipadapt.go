@@ -0,0 +1,102 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// adaptive gzip level by CPU load and client network
+package api
+
+import (
+	"compress/gzip"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// GzipAdaptive lowers the gzip level while the CPU is busy and does not compress for clients
+	// on the loopback or a private network, where the bandwidth is cheaper than the CPU.
+	GzipAdaptive = false
+
+	// GzipBusy is the CPU load (0~1) above which GzipAdaptive stops compressing,
+	// above half of it the fastest level is used.
+	GzipBusy = 0.8
+
+	// CPUSampleInterval is how often the CPU load is sampled for GzipAdaptive.
+	CPUSampleInterval = 5 * time.Second
+)
+
+// cpuBusy is the last sampled CPU load in 1/1000.
+var cpuBusy int32
+
+func init() {
+	RegMetric("widdly_cpu_busy_ratio", "CPU load sampled for the adaptive gzip level.", "gauge", func() (float64) {
+		return float64(atomic.LoadInt32(&cpuBusy)) / 1000
+	})
+}
+
+// StartCPUWatch samples the CPU load every CPUSampleInterval, when GzipAdaptive is set.
+func StartCPUWatch() {
+	if !GzipAdaptive {
+		return
+	}
+	busy0, total0, err := cpuTimes()
+	if err != nil {
+		log.Println("[gzip] CPU load not sampled:", err)
+		return
+	}
+	go func() {
+		tick := time.NewTicker(CPUSampleInterval)
+		defer tick.Stop()
+		for range tick.C {
+			busy, total, err := cpuTimes()
+			if err != nil {
+				log.Println("[gzip] sample CPU load", err)
+				continue
+			}
+			if total > total0 {
+				atomic.StoreInt32(&cpuBusy, int32((busy - busy0) * 1000 / (total - total0)))
+			}
+			busy0, total0 = busy, total
+		}
+	}()
+}
+
+// gzipLevelFor returns the gzip level for the response to r, 0 for none.
+func gzipLevelFor(r *http.Request) (int) {
+	level := gzipLevel()
+	if level == 0 || !CanAcceptsGzip(r) {
+		return 0
+	}
+	if !GzipAdaptive {
+		return level
+	}
+	if nearClient(r) {
+		return 0
+	}
+	load := float64(atomic.LoadInt32(&cpuBusy)) / 1000
+	switch {
+	case load > GzipBusy:
+		return 0
+	case load > GzipBusy / 2 && level != gzip.BestSpeed:
+		return gzip.BestSpeed
+	}
+	return level
+}
+
+// nearClient tells whether the client of r is on the loopback or a private network.
+// Behind a reverse proxy on the same host the first X-Forwarded-For address is the client.
+func nearClient(r *http.Request) (bool) {
+	ip := net.ParseIP(remoteIP(r))
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
@@ -0,0 +1,119 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"../store"
+)
+
+// Config holds the settings for serving a wiki from another program.
+type Config struct {
+	// Store is the backend holding the tiddlers, required unless Open is set.
+	Store store.TiddlerStore
+
+	// Open opens the store on the first request instead of Store (lazy open),
+	// requests wait for it for up to ReadyWait.
+	Open func() (store.TiddlerStore, error)
+
+	// WarmUp reads the tiddler list into the response cache in the background
+	// before serving requests, which wait for it for up to ReadyWait.
+	WarmUp bool
+
+	// OnReady is called once the store is open and warm, to start the jobs using it,
+	// nil for none. It is called right away unless Open or WarmUp is set.
+	OnReady func()
+
+	// Authenticate checks user credentials, nil rejects every login.
+	Authenticate func(user string, pwd string) (bool)
+
+	// IsAdmin tells whether a user is an admin, nil makes every user an admin.
+	IsAdmin func(user string) (bool)
+
+	// UserExists tells whether a user name is known, nil disables @mentions.
+	UserExists func(user string) (bool)
+
+	// ServeBase serves the index page, nil keeps serving the IndexFiles (index.html in the working directory).
+	ServeBase http.HandlerFunc
+
+	// Sessions keeps the login sessions, nil keeps them in memory.
+	Sessions SessionBackend
+
+	// GzipLevel is the gzip compress level, 0 for disable.
+	GzipLevel int
+
+	// NoCache disables the in-memory response cache.
+	NoCache bool
+
+	// Base is the path the handler is mounted at (e.g. "/wiki"), empty for root.
+	Base string
+}
+
+// Handler applies cfg and returns an http.Handler serving the wiki,
+// ready to be mounted under another mux:
+//
+//	mux.Handle("/wiki/", api.Handler(api.Config{Store: db, Base: "/wiki"}))
+//
+// The api package keeps its settings in package variables,
+// so only one wiki can be served per process.
+func Handler(cfg Config) http.Handler {
+	if cfg.Store == nil && cfg.Open == nil {
+		panic("api: Config.Store is nil")
+	}
+
+	StoreDb = cfg.Store
+	gate = nil
+	resetWatchers()
+	resetActivity()
+	Authenticate = cfg.Authenticate
+	IsAdmin = cfg.IsAdmin
+	UserExists = cfg.UserExists
+	if cfg.Sessions != nil {
+		Sess.Close()
+		Sess = NewSessionWith(cfg.Sessions)
+	}
+	if cfg.ServeBase != nil {
+		ServeBase = cfg.ServeBase
+	}
+	GzipLevel = cfg.GzipLevel
+	CacheList = !cfg.NoCache
+	CacheTiddler = !cfg.NoCache
+	Invalidate()
+	switch {
+	case cfg.Open != nil:
+		gate = newReadyGate(cfg.Open, cfg.WarmUp, cfg.OnReady)
+	case cfg.WarmUp:
+		loadSettings(context.Background())
+		db := cfg.Store
+		gate = newReadyGate(func() (store.TiddlerStore, error) { return db, nil }, true, cfg.OnReady)
+		gate.start()
+	default:
+		loadSettings(context.Background())
+		if cfg.OnReady != nil {
+			cfg.OnReady()
+		}
+	}
+
+	mux := NewRootMux()
+	InitHandle(mux)
+
+	base := strings.TrimRight(cfg.Base, "/")
+	if base == "" {
+		return mux
+	}
+	return http.StripPrefix(base, mux)
+}
@@ -0,0 +1,167 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// external commands run on events
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The events of the hooks, the JSON on the stdin of the command has "event", "time" and:
+//
+//	tiddler-saved      title, user
+//	tiddler-deleted    title, user
+//	comment-added      title (commented tiddler), user
+//	user-login         user
+//	publish-finished   tiddlers, bytes
+const (
+	EventSaved     = "tiddler-saved"
+	EventDeleted   = "tiddler-deleted"
+	EventComment   = "comment-added"
+	EventLogin     = "user-login"
+	EventPublished = "publish-finished"
+)
+
+// Hook runs Command (the program and its arguments, no shell) on Event.
+type Hook struct {
+	Event   string
+	Command []string
+}
+
+var (
+	// Hooks are the commands run on events, see RunHooks.
+	Hooks []Hook
+
+	// HookTimeout is how long a hook command may run before it is killed.
+	HookTimeout = 30 * time.Second
+
+	// HookConcurrency is how many hook commands run at once, the others wait.
+	HookConcurrency = 4
+
+	// HookBacklog is how many hook commands may wait, beyond it events are dropped (and logged).
+	HookBacklog = 100
+)
+
+var (
+	hookSlots   chan struct{}
+	hookOnce    sync.Once
+	hookPending int64
+	hookWG      sync.WaitGroup // the running and waiting commands, for tests
+)
+
+// ParseHooks parses the hooks "<event>=<command> [args...]" separated by newlines,
+// e.g. "tiddler-saved=/usr/local/bin/reindex --quiet"; lines starting with # are comments.
+func ParseHooks(s string) ([]Hook, error) {
+	var hooks []Hook
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("hook %q: want <event>=<command>", line)
+		}
+		h := Hook{Event: strings.TrimSpace(line[:i]), Command: strings.Fields(line[i+1:])}
+		switch h.Event {
+		case EventSaved, EventDeleted, EventComment, EventLogin, EventPublished:
+		default:
+			return nil, fmt.Errorf("hook %q: unknown event %q", line, h.Event)
+		}
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("hook %q: no command", line)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// RunHooks starts the commands of the hooks of event in the background, with the JSON of
+// data plus the event and its time on their stdin and the event in $WIDDLY_EVENT.
+// At most HookConcurrency run at once; their output is logged.
+func RunHooks(event string, data map[string]interface{}) {
+	var cmds [][]string
+	for _, h := range Hooks {
+		if h.Event == event {
+			cmds = append(cmds, h.Command)
+		}
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	hookOnce.Do(func() {
+		hookSlots = make(chan struct{}, HookConcurrency)
+	})
+
+	payload := map[string]interface{}{"event": event, "time": time.Now().UTC().Format(time.RFC3339)}
+	for k, v := range data {
+		payload[k] = v
+	}
+	input, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("[hook]", event, err)
+		return
+	}
+	for _, cmd := range cmds {
+		if atomic.AddInt64(&hookPending, 1) > int64(HookBacklog) {
+			atomic.AddInt64(&hookPending, -1)
+			log.Println("[hook] backlog full, dropped", event, cmd[0])
+			continue
+		}
+		hookWG.Add(1)
+		go func(cmd []string) {
+			defer hookWG.Done()
+			hookSlots <- struct{}{}
+			defer func() {
+				<-hookSlots
+				atomic.AddInt64(&hookPending, -1)
+			}()
+			runHook(event, cmd, input)
+		}(cmd)
+	}
+}
+
+// runHook runs cmd with input on its stdin, killing it after HookTimeout.
+func runHook(event string, cmd []string, input []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Stdin = bytes.NewReader(input)
+	c.Env = append(os.Environ(), "WIDDLY_EVENT=" + event)
+	out, err := c.CombinedOutput()
+	if len(out) > 1024 {
+		out = append(out[:1024], "..."...)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("[hook] %s %s: killed after %v %s", event, cmd[0], HookTimeout, out)
+		return
+	}
+	if err != nil {
+		log.Printf("[hook] %s %s: %v %s", event, cmd[0], err, out)
+		return
+	}
+	if len(out) > 0 {
+		log.Printf("[hook] %s %s: %s", event, cmd[0], out)
+	}
+}
@@ -0,0 +1,72 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// idle logout warning: how long the session has left, and keeping it alive
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// sessionTTLState is the answer of /session/ttl and /session/keepalive.
+type sessionTTLState struct {
+	LoggedIn bool   `json:"logged_in"`
+	TTL      int    `json:"ttl"`     // seconds left before the session expires when idle
+	Timeout  int    `json:"timeout"` // seconds a request extends it to
+	Expires  string `json:"expires,omitempty"`
+}
+
+func ttlState(sess *Store) (sessionTTLState) {
+	st := sessionTTLState{Timeout: int(SessionTimeout / time.Second)}
+	if sess == nil || !sess.IsLogin() {
+		return st
+	}
+	exp := sess.expires()
+	st.LoggedIn = true
+	st.TTL = int(time.Until(exp) / time.Second)
+	if st.TTL < 0 {
+		st.TTL = 0
+	}
+	st.Expires = exp.UTC().Format(time.RFC3339)
+	return st
+}
+
+// sessionTTL serves GET /session/ttl: the time left of the session, without extending it,
+// so that a client can warn before an idle logout.
+func sessionTTL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, ttlState(Sess.sessionOf(r)))
+}
+
+// sessionKeepalive serves POST /session/keepalive: it extends the session of a logged in user
+// by SessionTimeout and answers like /session/ttl.
+func sessionKeepalive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sess := Sess.sessionOf(r)
+	if sess == nil || !sess.IsLogin() {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sess.ReNew()
+	setSIDCookie(w, sess.sid)
+	writeJSON(w, ttlState(sess))
+}
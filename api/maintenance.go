@@ -0,0 +1,118 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// maintenance mode, writes refused while backups or migrations run
+package api
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceRetry is the Retry-After of the writes refused in maintenance mode,
+// unless /admin/maintenance was given another.
+var MaintenanceRetry = 5 * time.Minute
+
+// maintenanceState is the answer of /admin/maintenance.
+type maintenanceState struct {
+	On      bool   `json:"on"`
+	Message string `json:"message,omitempty"`
+	Since   string `json:"since,omitempty"` // RFC 3339
+	Retry   int    `json:"retry_after,omitempty"` // seconds
+	By      string `json:"by,omitempty"`
+}
+
+var (
+	maintenanceMu sync.RWMutex
+	maintenance   maintenanceState
+)
+
+// maintenanceReason returns the banner of maintenance mode, empty when off.
+func maintenanceReason() (string) {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	if !maintenance.On {
+		return ""
+	}
+	if maintenance.Message != "" {
+		return "maintenance: " + maintenance.Message
+	}
+	return "down for maintenance, saving is disabled"
+}
+
+// maintenanceRetry returns the Retry-After value in seconds.
+func maintenanceRetry() (string) {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	return strconv.Itoa(maintenance.Retry)
+}
+
+// adminMaintenance serves /admin/maintenance for admins: GET the state, POST with the body
+// "on [message]" or "off" switches it; ?retry=600 sets the Retry-After in seconds.
+// While on, writes get 503 Service Unavailable and /status shows the message as banner.
+// The mode is not kept in the store, which may be what the maintenance is about; a restart ends it.
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		words := strings.SplitN(strings.TrimSpace(string(body)), " ", 2)
+		retry := int(MaintenanceRetry / time.Second)
+		if s := r.URL.Query().Get("retry"); s != "" {
+			retry, err = strconv.Atoi(s)
+			if err != nil || retry < 0 {
+				http.Error(w, "retry must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, _ := currentUser(r)
+		st := maintenanceState{}
+		switch words[0] {
+		case "on":
+			st = maintenanceState{On: true, Since: time.Now().UTC().Format(time.RFC3339), Retry: retry, By: user}
+			if len(words) > 1 {
+				st.Message = strings.TrimSpace(words[1])
+			}
+			log.Printf("[maintenance] on by %s: %q", user, st.Message)
+		case "off":
+			log.Println("[maintenance] off by", user)
+		default:
+			http.Error(w, "want on [message] or off", http.StatusBadRequest)
+			return
+		}
+		maintenanceMu.Lock()
+		maintenance = st
+		maintenanceMu.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maintenanceMu.RLock()
+	st := maintenance
+	maintenanceMu.RUnlock()
+	writeJSON(w, st)
+}
@@ -0,0 +1,115 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Prometheus text format metrics
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"../store"
+)
+
+var (
+	// Metrics enables /metrics.
+	Metrics = false
+
+	// MetricsToken, when set, must be sent as "Authorization: Bearer <token>" by scrapers;
+	// logged in admins can always read /metrics.
+	MetricsToken = ""
+)
+
+type metric struct {
+	name string
+	help string
+	typ  string
+	fn   func() (float64)
+}
+
+var (
+	metricsMu sync.RWMutex
+	metricsList = make(map[string]metric)
+)
+
+// RegMetric adds a metric to /metrics; typ is "counter" or "gauge" and fn reads its value.
+func RegMetric(name string, help string, typ string, fn func() (float64)) {
+	metricsMu.Lock()
+	metricsList[name] = metric{name, help, typ, fn}
+	metricsMu.Unlock()
+}
+
+func init() {
+	RegMetric("widdly_sessions", "Sessions in memory.", "gauge", func() (float64) {
+		return float64(Sess.Stats().Active)
+	})
+	RegMetric("widdly_sessions_created_total", "Sessions created.", "counter", func() (float64) {
+		return float64(Sess.Stats().Created)
+	})
+	RegMetric("widdly_sessions_evicted_total", "Sessions dropped because of SessionCountLimit.", "counter", func() (float64) {
+		return float64(Sess.Stats().Evicted)
+	})
+	RegMetric("widdly_sessions_expired_total", "Sessions dropped after SessionTimeout.", "counter", func() (float64) {
+		return float64(Sess.Stats().Expired)
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !Metrics {
+		http.NotFound(w, r)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	tokenOK := MetricsToken != "" && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer " + MetricsToken)) == 1
+	if MetricsToken != "" && !tokenOK && !isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	metricsMu.RLock()
+	list := make([]metric, 0, len(metricsList))
+	for _, m := range metricsList {
+		list = append(list, m)
+	}
+	metricsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.typ, m.name, m.fn())
+	}
+	for _, st := range storeStats(r.Context()) {
+		name := "widdly_store_" + st.Name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, st.Help, name, name, st.Value)
+	}
+}
+
+// storeStats returns the gauges of StoreDb sorted by name, none when it is no store.StatsStore.
+func storeStats(ctx context.Context) ([]store.Stat) {
+	ss, ok := StoreDb.(store.StatsStore)
+	if !ok {
+		return nil
+	}
+	stats, err := ss.Stats(ctx)
+	if err != nil {
+		log.Println("[metrics] store stats error", err)
+		return nil
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,129 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// mapping between tiddler types and HTTP Content-Types
+package api
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// ContentType describes how a tiddler type is served over HTTP.
+type ContentType struct {
+	Mime   string // HTTP Content-Type
+	Base64 bool   // tiddler text is base64 encoded
+}
+
+var (
+	// DefaultContentType is used for tiddlers without (or with an unknown) type.
+	DefaultContentType = ContentType{"text/plain; charset=utf-8", false}
+
+	// ContentTypes maps TiddlyWiki "type" fields to HTTP Content-Types.
+	ContentTypes = map[string]ContentType{
+		"text/vnd.tiddlywiki":              {"text/plain; charset=utf-8", false},
+		"text/x-tiddlywiki":                {"text/plain; charset=utf-8", false},
+		"application/x-tiddler-dictionary": {"text/plain; charset=utf-8", false},
+		"text/plain":                       {"text/plain; charset=utf-8", false},
+		"text/x-markdown":                  {"text/markdown; charset=utf-8", false},
+		"text/markdown":                    {"text/markdown; charset=utf-8", false},
+		"text/html":                        {"text/html; charset=utf-8", false},
+		"text/css":                         {"text/css; charset=utf-8", false},
+		"text/csv":                         {"text/csv; charset=utf-8", false},
+		"application/javascript":           {"text/javascript; charset=utf-8", false},
+		"application/json":                 {"application/json", false},
+		"image/svg+xml":                    {"image/svg+xml", false},
+		"image/png":                        {"image/png", true},
+		"image/jpeg":                       {"image/jpeg", true},
+		"image/jpg":                        {"image/jpeg", true},
+		"image/gif":                        {"image/gif", true},
+		"image/webp":                       {"image/webp", true},
+		"image/x-icon":                     {"image/x-icon", true},
+		"application/pdf":                  {"application/pdf", true},
+		"application/zip":                  {"application/zip", true},
+		"audio/mpeg":                       {"audio/mpeg", true},
+		"audio/ogg":                        {"audio/ogg", true},
+		"video/mp4":                        {"video/mp4", true},
+		"font/woff":                        {"font/woff", true},
+		"font/woff2":                       {"font/woff2", true},
+	}
+
+	// ExtTypes maps file extensions under /files to tiddler types.
+	ExtTypes = map[string]string{
+		".tid":  "application/x-tiddler",
+		".md":   "text/x-markdown",
+		".js":   "application/javascript",
+		".svg":  "image/svg+xml",
+		".html": "text/html",
+		".css":  "text/css",
+		".json": "application/json",
+		".jpg":  "image/jpeg",
+		".png":  "image/png",
+		".gif":  "image/gif",
+		".webp": "image/webp",
+		".pdf":  "application/pdf",
+		".mp3":  "audio/mpeg",
+		".ogg":  "audio/ogg",
+		".mp4":  "video/mp4",
+	}
+)
+
+// TypeInfo returns how the tiddler type typ is served.
+func TypeInfo(typ string) (ContentType) {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if ct, ok := ContentTypes[typ]; ok {
+		return ct
+	}
+	return DefaultContentType
+}
+
+// FileContentType returns the Content-Type for a file under /files.
+func FileContentType(name string) (string) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if typ, ok := ExtTypes[ext]; ok {
+		if ct, ok := ContentTypes[typ]; ok {
+			return ct.Mime
+		}
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// LoadContentTypes reads extra mappings, one per line:
+// <tiddler type>\t<content type>[\tbase64]
+// comment start with '#'
+func LoadContentTypes(input io.Reader) (error) {
+	r := bufio.NewScanner(input)
+	for r.Scan() {
+		line := strings.TrimSpace(r.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		row := strings.Split(line, "\t")
+		if len(row) < 2 {
+			continue
+		}
+		ct := ContentType{Mime: row[1]}
+		if len(row) > 2 && row[2] == "base64" {
+			ct.Base64 = true
+		}
+		ContentTypes[strings.ToLower(row[0])] = ct
+	}
+	return r.Err()
+}
@@ -0,0 +1,530 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// notifications of watched tiddlers and @mentions
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+var (
+	// NotifyMax is how many notifications are kept per user, the oldest are dropped.
+	NotifyMax = 100
+
+	// SendMail sends a digest of the unread notifications, nil disables digests.
+	SendMail func(to string, subject string, body string) (error)
+
+	// UserEmail returns the email address of a user, "" for none.
+	UserEmail func(user string) (string)
+
+	// DigestURL is the public URL of the wiki linked from digests, empty for none.
+	DigestURL string
+)
+
+// Notification is something a user should know about.
+type Notification struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"` // "change", "delete", "comment" or "mention"
+	Title  string `json:"title"`
+	By     string `json:"by"`
+	Time   string `json:"time"`
+	Read   bool   `json:"read"`
+	Mailed bool   `json:"mailed,omitempty"`
+}
+
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@])@([\w][\w.-]*[\w]|[\w])`)
+
+var notifyMu sync.Mutex
+
+// watchers maps a title to the users watching it, loaded on first use.
+var watchers map[string]map[string]bool
+
+// mentions returns the user names mentioned in text.
+func mentions(text string) (map[string]bool) {
+	if UserExists == nil || !strings.Contains(text, "@") {
+		return nil
+	}
+	users := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		if UserExists(m[1]) {
+			users[m[1]] = true
+		}
+	}
+	return users
+}
+
+// oldText returns the text of title before it is overwritten, only when mentions may need it.
+func oldText(ctx context.Context, title string, js map[string]interface{}) (string) {
+	text, _ := js["text"].(string)
+	if UserExists == nil || !strings.Contains(text, "@") {
+		return ""
+	}
+	t, err := StoreDb.Get(ctx, title)
+	if err != nil {
+		return ""
+	}
+	old, err := t.Fields()
+	if err != nil {
+		return ""
+	}
+	text, _ = old["text"].(string)
+	return text
+}
+
+// streamMentions returns the @mentions of a text too large to hold in memory, read from text,
+// as a text for notify; "" when mentions are off. The text is read in chunks cut at white space.
+func streamMentions(text io.Reader) (string, error) {
+	if UserExists == nil {
+		return "", nil
+	}
+	var out strings.Builder
+	buf := make([]byte, 0, 64 * 1024)
+	chunk := make([]byte, 32 * 1024)
+	for {
+		n, err := text.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		cut := len(buf)
+		if err == nil {
+			cut = bytes.LastIndexAny(buf, " \t\r\n") + 1 // the last word may go on in the next chunk
+			if cut == 0 && len(buf) < cap(buf) {
+				continue
+			}
+			if cut == 0 {
+				cut = len(buf)
+			}
+		}
+		for _, m := range mentionRe.FindAllSubmatch(buf[:cut], -1) {
+			out.WriteString(" @")
+			out.Write(m[1])
+		}
+		buf = append(buf[:0], buf[cut:]...)
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// oldStreamMentions is oldText for a streamed tiddler: the @mentions of its stored text.
+func oldStreamMentions(ctx context.Context, ss store.StreamStore, title string) (string) {
+	if UserExists == nil {
+		return ""
+	}
+	_, text, _, err := ss.GetStream(ctx, title)
+	if err != nil {
+		return ""
+	}
+	defer text.Close()
+	old, _ := streamMentions(text)
+	return old
+}
+
+func loadWatchers(ctx context.Context) (error) {
+	if watchers != nil {
+		return nil
+	}
+	tiddlers, err := StoreDb.All(ctx)
+	if err != nil {
+		return err
+	}
+	list := make(map[string]map[string]bool)
+	for _, t := range tiddlers {
+		if !isPrivateTiddler(t) {
+			continue
+		}
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		user := strings.TrimPrefix(title, accountPrefix)
+		if !strings.HasSuffix(user, "/watch") {
+			continue
+		}
+		user = strings.TrimSuffix(user, "/watch")
+
+		var titles []string
+		if err := loadAccount(ctx, user, "watch", &titles); err != nil {
+			log.Println("[notify] load watch list", user, err)
+			continue
+		}
+		for _, title := range titles {
+			if list[title] == nil {
+				list[title] = make(map[string]bool)
+			}
+			list[title][user] = true
+		}
+	}
+	watchers = list
+	return nil
+}
+
+// watchList returns the titles user watches, sorted.
+func watchList(user string) ([]string) {
+	titles := []string{}
+	for title, users := range watchers {
+		if users[user] {
+			titles = append(titles, title)
+		}
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+func setWatch(ctx context.Context, user string, title string, on bool) (error) {
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	if err := loadWatchers(ctx); err != nil {
+		return err
+	}
+	if watchers[title][user] == on {
+		return nil
+	}
+	if on {
+		if watchers[title] == nil {
+			watchers[title] = make(map[string]bool)
+		}
+		watchers[title][user] = true
+	} else {
+		delete(watchers[title], user)
+	}
+	return saveAccount(ctx, user, "watch", watchList(user))
+}
+
+// addNotification records n for user, an unread one of the same kind and title is replaced.
+func addNotification(ctx context.Context, user string, n Notification) (error) {
+	var list []Notification
+	if err := loadAccount(ctx, user, "notifications", &list); err != nil {
+		return err
+	}
+
+	rnd := make([]byte, 6)
+	rand.Read(rnd)
+	n.ID = hex.EncodeToString(rnd)
+	n.Time = twNow()
+
+	out := []Notification{n}
+	for _, old := range list {
+		if !old.Read && old.Kind == n.Kind && old.Title == n.Title {
+			continue
+		}
+		out = append(out, old)
+	}
+	if len(out) > NotifyMax {
+		out = out[:NotifyMax]
+	}
+	return saveAccount(ctx, user, "notifications", out)
+}
+
+// hookEvents are the events of the kinds of notify.
+var hookEvents = map[string]string{"change": EventSaved, "delete": EventDeleted, "comment": EventComment}
+
+// notify tells the watchers of title about a change, and the users newly mentioned
+// in text about the mention. by never gets notified of its own edits.
+// It runs the hooks of the change too.
+func notify(ctx context.Context, by string, kind string, title string, text string, old string) {
+	if strings.HasPrefix(title, "$:/") || strings.HasPrefix(title, "Draft of '") {
+		return
+	}
+	if event, ok := hookEvents[kind]; ok {
+		RunHooks(event, map[string]interface{}{"title": title, "user": by})
+	}
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	if err := loadWatchers(ctx); err != nil {
+		log.Println("[notify] load watchers", err)
+		return
+	}
+	seen := map[string]bool{by: true}
+	before := mentions(old)
+	for user := range mentions(text) {
+		if seen[user] || before[user] {
+			continue
+		}
+		seen[user] = true
+		err := addNotification(ctx, user, Notification{Kind: "mention", Title: title, By: by})
+		if err != nil {
+			log.Println("[notify]", user, err)
+		}
+	}
+	for user := range watchers[title] {
+		if seen[user] {
+			continue
+		}
+		err := addNotification(ctx, user, Notification{Kind: kind, Title: title, By: by})
+		if err != nil {
+			log.Println("[notify]", user, err)
+		}
+	}
+}
+
+// notifyEdit notifies about a tiddler saved by the client of r.
+func notifyEdit(r *http.Request, title string, text string, old string) {
+	user, _ := currentUser(r)
+	notify(r.Context(), user, "change", title, text, old)
+}
+
+// account serves the per user endpoints of the logged in user:
+//
+//	GET    /account/notifications[?unread=1]  newest first
+//	POST   /account/notifications/read        mark {"ids":[...]} read, all of them when empty
+//	GET    /account/watch                     watched titles
+//	PUT    /account/watch/<title>             watch title
+//	DELETE /account/watch/<title>             stop watching title
+//	GET    /account/profile                   display name, theme and last login
+//	PUT    /account/profile                   set {"display_name":"...","theme":"..."}
+//	GET    /account/preferences               the JSON object saved by PUT, {} at first
+//	PUT    /account/preferences               replace it
+//	GET    /account/sessions                  sessions, newest first
+//	DELETE /account/sessions/<id>             log one out
+//	POST   /account/pair                      mint a code pairing another device
+//	GET    /account/devices                   paired devices, the last used first
+//	DELETE /account/devices/<id>              unpair one
+func account(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	path := strings.TrimPrefix(r.URL.Path, "/account/")
+
+	switch {
+	case path == "notifications" && r.Method == "GET":
+		notifyMu.Lock()
+		var list []Notification
+		err := loadAccount(ctx, user, "notifications", &list)
+		notifyMu.Unlock()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		out := []Notification{}
+		for _, n := range list {
+			if r.URL.Query().Get("unread") != "" && n.Read {
+				continue
+			}
+			out = append(out, n)
+		}
+		writeJSON(w, out)
+
+	case path == "notifications/read" && r.Method == "POST":
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64 * 1024))
+		if err != nil || (len(strings.TrimSpace(string(body))) > 0 && json.Unmarshal(body, &req) != nil) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		ids := make(map[string]bool)
+		for _, id := range req.IDs {
+			ids[id] = true
+		}
+
+		notifyMu.Lock()
+		defer notifyMu.Unlock()
+		var list []Notification
+		if err := loadAccount(ctx, user, "notifications", &list); err != nil {
+			internalError(w, err)
+			return
+		}
+		for i := range list {
+			if len(ids) == 0 || ids[list[i].ID] {
+				list[i].Read = true
+			}
+		}
+		if err := saveAccount(ctx, user, "notifications", list); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "watch" && r.Method == "GET":
+		notifyMu.Lock()
+		err := loadWatchers(ctx)
+		titles := watchList(user)
+		notifyMu.Unlock()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, titles)
+
+	case strings.HasPrefix(path, "watch/") && (r.Method == "PUT" || r.Method == "DELETE"):
+		title := strings.TrimPrefix(path, "watch/")
+		if hide, err := isHidden(r, title); title == "" || hide || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := setWatch(ctx, user, title, r.Method == "PUT"); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "profile":
+		profile(w, r, user)
+
+	case path == "preferences":
+		preferences(w, r, user)
+
+	case path == "sessions" || strings.HasPrefix(path, "sessions/"):
+		accountSessions(w, r, user, strings.TrimPrefix(strings.TrimPrefix(path, "sessions"), "/"))
+
+	case path == "pair":
+		accountPair(w, r, user)
+
+	case path == "devices" || strings.HasPrefix(path, "devices/"):
+		accountDevices(w, r, user, strings.TrimPrefix(strings.TrimPrefix(path, "devices"), "/"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// StartDigests mails every user with an email address the unread notifications
+// not mailed yet, every interval. It does nothing when SendMail is nil.
+func StartDigests(ctx context.Context, interval time.Duration) {
+	if SendMail == nil || UserEmail == nil || interval <= 0 {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				if err := sendDigests(ctx); err != nil {
+					log.Println("[notify] digest", err)
+				}
+			}
+		}
+	}()
+}
+
+func sendDigests(ctx context.Context) (error) {
+	tiddlers, err := StoreDb.All(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tiddlers {
+		if !isPrivateTiddler(t) {
+			continue
+		}
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		user := strings.TrimPrefix(title, accountPrefix)
+		if !strings.HasSuffix(user, "/notifications") {
+			continue
+		}
+		user = strings.TrimSuffix(user, "/notifications")
+		if err := sendDigest(ctx, user); err != nil {
+			log.Println("[notify] digest", user, err)
+		}
+	}
+	return nil
+}
+
+func sendDigest(ctx context.Context, user string) (error) {
+	to := UserEmail(user)
+	if to == "" {
+		return nil
+	}
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	var list []Notification
+	if err := loadAccount(ctx, user, "notifications", &list); err != nil {
+		return err
+	}
+	var body strings.Builder
+	count := 0
+	for _, n := range list {
+		if n.Read || n.Mailed {
+			continue
+		}
+		count++
+		switch n.Kind {
+		case "mention":
+			fmt.Fprintf(&body, "%s mentioned you in %s\n", n.By, n.Title)
+		case "comment":
+			fmt.Fprintf(&body, "%s commented on %s\n", n.By, n.Title)
+		case "delete":
+			fmt.Fprintf(&body, "%s deleted %s\n", n.By, n.Title)
+		default:
+			fmt.Fprintf(&body, "%s changed %s\n", n.By, n.Title)
+		}
+		if DigestURL != "" && n.Kind != "delete" {
+			fmt.Fprintf(&body, "  %s#%s\n", DigestURL, url.PathEscape(n.Title))
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("%d new notification(s)", count)
+	if err := SendMail(to, subject, body.String()); err != nil {
+		return err
+	}
+	for i := range list {
+		if !list[i].Read {
+			list[i].Mailed = true
+		}
+	}
+	return saveAccount(ctx, user, "notifications", list)
+}
+
+// resetWatchers drops the watch index, after the store changed under the api package.
+func resetWatchers() {
+	notifyMu.Lock()
+	watchers = nil
+	notifyMu.Unlock()
+}
@@ -0,0 +1,502 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// pairing a phone with a logged in session, so the password is never typed on it
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// PairCodeTTL is how long a code minted by POST /account/pair may be used.
+	PairCodeTTL = 5 * time.Minute
+
+	// DeviceLifeTime is how long a paired device stays logged in since it was last used, 0 disables pairing.
+	DeviceLifeTime = 90 * 24 * time.Hour
+
+	DeviceCookieName = "device"
+)
+
+// devicesTitle is the private tiddler keeping the paired devices by hex sha256 of their token.
+const devicesTitle = privatePrefix + "devices"
+
+// pairAlphabet leaves out the letters and digits easily mistaken for each other.
+// Its 32 symbols divide 256, so a random byte picks one without bias.
+const pairAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	pairCodeLen = 8
+	maxDevices  = 16 // per user, the least recently used are dropped beyond
+)
+
+type pairCode struct {
+	user    string
+	expires time.Time
+}
+
+var (
+	pairMu    sync.Mutex
+	pairCodes = make(map[string]pairCode) // by normalized code, one per user
+
+	devicesMu sync.Mutex
+)
+
+// pairedDevice is a device logged in by a pairing code.
+type pairedDevice struct {
+	User      string    `json:"user"`
+	Name      string    `json:"name,omitempty"`
+	Created   time.Time `json:"created"`
+	Used      time.Time `json:"used"` // last session resumed
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// pairInfo is the POST /account/pair response.
+type pairInfo struct {
+	Code    string    `json:"code"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// deviceInfo is a device as listed by GET /account/devices.
+type deviceInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	Used      time.Time `json:"used"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current,omitempty"` // the device of the request
+}
+
+// newPairCode mints the pairing code of user, replacing the one minted before.
+func newPairCode(user string) (string, time.Time, error) {
+	b := make([]byte, pairCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, ErrRNG
+	}
+	for i := range b {
+		b[i] = pairAlphabet[int(b[i]) % len(pairAlphabet)]
+	}
+	code := string(b)
+	now := time.Now()
+	expires := now.Add(PairCodeTTL)
+
+	pairMu.Lock()
+	defer pairMu.Unlock()
+	for c, p := range pairCodes {
+		if p.user == user || now.After(p.expires) {
+			delete(pairCodes, c)
+		}
+	}
+	pairCodes[code] = pairCode{user: user, expires: expires}
+	return code[:4] + "-" + code[4:], expires, nil
+}
+
+// takePairCode uses up code, returning the user who minted it.
+func takePairCode(code string) (string, bool) {
+	code = strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if strings.ContainsRune(pairAlphabet, c) {
+			return c
+		}
+		return -1
+	}, code)
+
+	pairMu.Lock()
+	defer pairMu.Unlock()
+	p, ok := pairCodes[code]
+	if !ok {
+		return "", false
+	}
+	delete(pairCodes, code)
+	return p.user, time.Now().Before(p.expires)
+}
+
+// deviceHash returns the key of the device of token in the devices tiddler.
+func deviceHash(token string) (string) {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// deviceID returns the id showing the device of hash.
+func deviceID(hash string) (string) {
+	if len(hash) < 16 {
+		return hash
+	}
+	return hash[:16]
+}
+
+func deviceExpired(d *pairedDevice, now time.Time) (bool) {
+	return now.After(d.Used.Add(DeviceLifeTime))
+}
+
+// loadDevices returns the paired devices, devicesMu held.
+func loadDevices(r *http.Request) (map[string]*pairedDevice, error) {
+	devices := make(map[string]*pairedDevice)
+	if err := loadPrivate(r.Context(), devicesTitle, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// addDevice pairs a new device of user, returning its token.
+func addDevice(r *http.Request, user string, name string) (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", ErrRNG
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash := deviceHash(token)
+	agent := r.UserAgent()
+	if len(agent) > maxUserAgent {
+		agent = agent[:maxUserAgent]
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devices, err := loadDevices(r)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now().UTC()
+	var mine []string
+	for h, d := range devices {
+		if deviceExpired(d, now) {
+			delete(devices, h)
+		} else if d.User == user {
+			mine = append(mine, h)
+		}
+	}
+	if len(mine) >= maxDevices {
+		sort.Slice(mine, func(i, j int) bool { return devices[mine[i]].Used.Before(devices[mine[j]].Used) })
+		for _, h := range mine[:len(mine) - maxDevices + 1] {
+			delete(devices, h)
+		}
+	}
+	devices[hash] = &pairedDevice{User: user, Name: strings.TrimSpace(name), Created: now, Used: now,
+		IP: remoteIP(r), UserAgent: agent}
+	if err := savePrivate(r.Context(), devicesTitle, devices); err != nil {
+		return "", "", err
+	}
+	return token, hash, nil
+}
+
+// deviceOf returns the device of the device cookie of r, with its hash.
+func deviceOf(r *http.Request, devices map[string]*pairedDevice) (*pairedDevice, string) {
+	c, err := r.Cookie(DeviceCookieName)
+	if err != nil || c.Value == "" {
+		return nil, ""
+	}
+	hash := deviceHash(c.Value)
+	d, ok := devices[hash]
+	if !ok || deviceExpired(d, time.Now()) {
+		return nil, ""
+	}
+	return d, hash
+}
+
+func setDeviceCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name: DeviceCookieName,
+		Value: token,
+		Path: "/",
+		HttpOnly: true,
+		Expires: time.Now().Add(DeviceLifeTime),
+		MaxAge: int(DeviceLifeTime.Seconds()),
+	})
+}
+
+func clearDeviceCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name: DeviceCookieName,
+		Path: "/",
+		HttpOnly: true,
+		Expires: time.Now(),
+		MaxAge: -1,
+	})
+}
+
+// withDevice logs in the requests of a paired device whose session expired:
+// a new session is started and the request goes on with its SID.
+func withDevice(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(DeviceCookieName); err == nil && DeviceLifeTime > 0 && Sess.sessionOf(r) == nil {
+			if sid := resumeDevice(w, r); sid != "" {
+				r = withSID(r, sid)
+			}
+		}
+		f(w, r)
+	}
+}
+
+// resumeDevice starts a logged in session for the paired device of r, returning its SID.
+func resumeDevice(w http.ResponseWriter, r *http.Request) (string) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devices, err := loadDevices(r)
+	if err != nil {
+		logError(w, err)
+		return ""
+	}
+	d, hash := deviceOf(r, devices)
+	if d == nil {
+		clearDeviceCookie(w)
+		return ""
+	}
+	sess, err := Sess.Rotate(w, r)
+	if err != nil {
+		logError(w, err)
+		return ""
+	}
+	sess.Set("device", deviceID(hash))
+	sess.Login(d.User)
+	log.Printf("[session] [%s] device %s of %s logged in again from %s", RequestID(r), deviceID(hash), d.User, remoteIP(r))
+
+	d.Used = time.Now().UTC()
+	if err := savePrivate(r.Context(), devicesTitle, devices); err != nil { // still logged in on a read-only store
+		logError(w, err)
+	}
+	c, _ := r.Cookie(DeviceCookieName)
+	setDeviceCookie(w, c.Value)
+	return sess.sid
+}
+
+// withSID returns a copy of r sending the SID cookie sid instead of its own.
+func withSID(r *http.Request, sid string) (*http.Request) {
+	cookies := []string{CookieName + "=" + sid}
+	for _, c := range r.Cookies() {
+		if c.Name != CookieName {
+			cookies = append(cookies, c.Name + "=" + c.Value)
+		}
+	}
+	r2 := r.WithContext(r.Context())
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		r2.Header[k] = v
+	}
+	r2.Header.Set("Cookie", strings.Join(cookies, "; "))
+	return r2
+}
+
+// forgetDevice unpairs the device of r, if any, as it logs out.
+func forgetDevice(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(DeviceCookieName); err != nil {
+		return
+	}
+	clearDeviceCookie(w)
+
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devices, err := loadDevices(r)
+	if err != nil {
+		logError(w, err)
+		return
+	}
+	if d, hash := deviceOf(r, devices); d != nil {
+		delete(devices, hash)
+		if err := savePrivate(r.Context(), devicesTitle, devices); err != nil {
+			logError(w, err)
+		}
+	}
+}
+
+// accountPair serves POST /account/pair, minting a code which logs in another device of user
+// at the url of the response, for the wiki to show as text or a QR code.
+func accountPair(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if DeviceLifeTime <= 0 {
+		http.Error(w, "device pairing is disabled", http.StatusNotImplemented)
+		return
+	}
+	sess := Sess.sessionOf(r)
+	if sess == nil || !checkCSRF(r, sess) {
+		http.Error(w, "missing or wrong CSRF token", http.StatusForbidden)
+		return
+	}
+	code, expires, err := newPairCode(user)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, pairInfo{
+		Code: code,
+		URL: strings.TrimSuffix(wikiURL(r), "account/") + "pair?code=" + code,
+		Expires: expires.UTC(),
+	})
+}
+
+// accountDevices serves /account/devices: GET lists the paired devices of user, the last used first,
+// DELETE /account/devices/<id> unpairs one of them and logs its sessions out.
+func accountDevices(w http.ResponseWriter, r *http.Request, user string, id string) {
+	switch {
+	case id == "" && r.Method == "GET":
+		devicesMu.Lock()
+		devices, err := loadDevices(r)
+		devicesMu.Unlock()
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		_, current := deviceOf(r, devices)
+		now := time.Now()
+		out := []deviceInfo{}
+		for hash, d := range devices {
+			if d.User != user || deviceExpired(d, now) {
+				continue
+			}
+			out = append(out, deviceInfo{
+				ID: deviceID(hash),
+				Name: d.Name,
+				Created: d.Created,
+				Used: d.Used,
+				Expires: d.Used.Add(DeviceLifeTime),
+				IP: d.IP,
+				UserAgent: d.UserAgent,
+				Current: hash == current,
+			})
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if !out[i].Used.Equal(out[j].Used) {
+				return out[i].Used.After(out[j].Used)
+			}
+			return out[i].ID < out[j].ID
+		})
+		writeJSON(w, out)
+
+	case id != "" && r.Method == "DELETE":
+		sess := Sess.sessionOf(r)
+		if sess == nil || !checkCSRF(r, sess) {
+			http.Error(w, "missing or wrong CSRF token", http.StatusForbidden)
+			return
+		}
+		devicesMu.Lock()
+		defer devicesMu.Unlock()
+		devices, err := loadDevices(r)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		for hash, d := range devices {
+			if d.User != user || deviceID(hash) != id {
+				continue
+			}
+			delete(devices, hash)
+			if err := savePrivate(r.Context(), devicesTitle, devices); err != nil {
+				internalError(w, err)
+				return
+			}
+			if list, err := userSessions(user); err == nil {
+				for sid, s := range list {
+					if dev, _ := s.Values["device"].(string); dev == id {
+						Sess.destroy(sid)
+					}
+				}
+			}
+			log.Printf("[session] [%s] %s unpaired device %s of %s", RequestID(r), user, id, d.IP)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pairPage is tiny like quickPage. Opening a link only shows it: the code is used up
+// by the button, never by a GET a link preview or prefetch could send.
+var pairPage = template.Must(template.New("pair").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Pair this device</title></head>
+<body style="font:16px sans-serif;margin:1em auto;max-width:40em;padding:0 .5em">
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+<form method="post" action="pair">
+<p><input name="code" value="{{.Code}}" placeholder="Pairing code" autocapitalize="characters" autocomplete="off" required{{if not .Code}} autofocus{{end}}></p>
+<p><input name="name" placeholder="Device name (optional)"></p>
+<p><button type="submit">Pair this device</button></p>
+</form>
+</body></html>
+`))
+
+type pairPageInfo struct {
+	Code  string
+	Error string
+}
+
+func writePair(w http.ResponseWriter, code int, info pairPageInfo) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	pairPage.Execute(w, info)
+}
+
+// pair serves /pair, where a device types or follows a code of POST /account/pair
+// and gets logged in as the user who minted it, for DeviceLifeTime after its last use.
+func pair(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if DeviceLifeTime <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		writePair(w, http.StatusOK, pairPageInfo{Code: r.URL.Query().Get("code")})
+	case "POST":
+		user, ok := takePairCode(r.PostFormValue("code"))
+		if !ok {
+			log.Printf("[session] [%s] wrong pairing code from %s", RequestID(r), remoteIP(r))
+			writePair(w, http.StatusForbidden, pairPageInfo{Error: "Wrong or expired code, mint a new one."})
+			return
+		}
+		token, hash, err := addDevice(r, user, r.PostFormValue("name"))
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		sess, err := Sess.Rotate(w, r)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		sess.Set("device", deviceID(hash))
+		sess.Login(user)
+		setDeviceCookie(w, token)
+		touchLogin(r.Context(), user)
+		RunHooks(EventLogin, map[string]interface{}{"user": user})
+		log.Printf("[session] [%s] %s paired device %s from %s", RequestID(r), user, deviceID(hash), remoteIP(r))
+		seeOther(w, "./")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
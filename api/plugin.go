@@ -0,0 +1,83 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// registration of optional request middleware and routes
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrPluginExist = errors.New("same plugin exist")
+	ErrPluginEmpty = errors.New("plugin has no middleware or routes")
+
+	pluginlist = make([]*Plugin, 0)
+)
+
+// Middleware wraps a handler.
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Plugin is an optional feature compiled into the server.
+// Plugins register themselves in init() with RegPlugin,
+// and get enabled by importing their package (see plugins.go).
+type Plugin struct {
+	Name string
+
+	// Middleware wraps every route, may be nil.
+	// Middlewares run in registration order, the first registered is the outermost.
+	Middleware Middleware
+
+	// Routes are extra handlers added to the mux by InitHandle, may be nil.
+	// They are wrapped by the logging and plugin middlewares like the core routes.
+	Routes map[string]http.HandlerFunc
+}
+
+// RegPlugin registers p, it must be called before InitHandle.
+func RegPlugin(p *Plugin) (error) {
+	if p.Middleware == nil && len(p.Routes) == 0 {
+		return ErrPluginEmpty
+	}
+	for _, pl := range pluginlist {
+		if strings.EqualFold(pl.Name, p.Name) {
+			return ErrPluginExist
+		}
+	}
+	pluginlist = append(pluginlist, p)
+	return nil
+}
+
+func ListPlugin() ([]string) {
+	list := make([]string, 0, len(pluginlist))
+	for _, p := range pluginlist {
+		list = append(list, p.Name)
+	}
+	return list
+}
+
+// withPlugins applies the registered middlewares to f.
+func withPlugins(f http.HandlerFunc) http.HandlerFunc {
+	for i := len(pluginlist) - 1; i >= 0; i-- {
+		if mw := pluginlist[i].Middleware; mw != nil {
+			f = mw(f)
+		}
+	}
+	return f
+}
+
+// CurrentUser returns the user of a logged in session, for plugins; ok is false for guests.
+func CurrentUser(r *http.Request) (user string, ok bool) {
+	return currentUser(r)
+}
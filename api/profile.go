@@ -0,0 +1,137 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// per user profile, shown by /status
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// MaxPreferences is the size limit of the preferences of a user.
+var MaxPreferences int64 = 64 * 1024
+
+// Profile is the settings record of a user, kept in $:/widdly/account/<user>/profile.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Theme       string `json:"theme,omitempty"`      // title of the theme to apply on load
+	LastLogin   string `json:"last_login,omitempty"` // TiddlyWiki date, set by the server
+}
+
+// profileMu serializes the read-modify-write of the profiles.
+var profileMu sync.Mutex
+
+func loadProfile(ctx context.Context, user string) (*Profile, error) {
+	p := &Profile{}
+	err := loadAccount(ctx, user, "profile", p)
+	return p, err
+}
+
+// touchLogin records the time of a login of user.
+func touchLogin(ctx context.Context, user string) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	p, err := loadProfile(ctx, user)
+	if err == nil {
+		p.LastLogin = twNow()
+		err = saveAccount(ctx, user, "profile", p)
+	}
+	if err != nil {
+		log.Println("[profile]", user, err)
+	}
+}
+
+// userRole is the role of a logged in user shown by /status.
+func userRole(user string) (string) {
+	if IsAdmin == nil || IsAdmin(user) {
+		return "admin"
+	}
+	return "user"
+}
+
+// profile serves GET and PUT /account/profile, PUT changes only the display name and the theme.
+func profile(w http.ResponseWriter, r *http.Request, user string) {
+	ctx := r.Context()
+	switch r.Method {
+	case "GET":
+		p, err := loadProfile(ctx, user)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, p)
+	case "PUT":
+		var req Profile
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64 * 1024))
+		if err != nil || json.Unmarshal(body, &req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		profileMu.Lock()
+		defer profileMu.Unlock()
+		p, err := loadProfile(ctx, user)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		p.DisplayName, p.Theme = req.DisplayName, req.Theme
+		if err := saveAccount(ctx, user, "profile", p); err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// preferences serves GET and PUT /account/preferences, a JSON object the client keeps for the user
+// (editor settings, default tags...), so they follow the user to every device.
+func preferences(w http.ResponseWriter, r *http.Request, user string) {
+	ctx := r.Context()
+	switch r.Method {
+	case "GET":
+		var prefs json.RawMessage
+		if err := loadAccount(ctx, user, "preferences", &prefs); err != nil {
+			internalError(w, err)
+			return
+		}
+		if prefs == nil {
+			prefs = json.RawMessage("{}")
+		}
+		writeJSON(w, prefs)
+	case "PUT":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPreferences))
+		if err != nil {
+			http.Error(w, "preferences too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var obj map[string]interface{}
+		if json.Unmarshal(body, &obj) != nil || obj == nil {
+			http.Error(w, "preferences must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		if err := saveAccount(ctx, user, "preferences", json.RawMessage(body)); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,192 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// publishing a static single-file snapshot of the public tiddlers
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+var (
+	// PublishFilter selects the tiddlers of the snapshot, the embargoed and private ones are always left out.
+	PublishFilter = "[tag[Public]!is[draft]] $:/SiteTitle $:/SiteSubtitle $:/DefaultTiddlers"
+
+	// PublishBase is the TiddlyWiki page the tiddlers are added to, e.g. an empty.html without the TiddlyWeb plugin.
+	PublishBase = "empty.html"
+
+	// PublishOut writes the snapshot (to a file, a bucket...), nil disables POST /admin/publish.
+	PublishOut func(ctx context.Context, page []byte) (error)
+
+	// publishMu serializes the publishing.
+	publishMu sync.Mutex
+
+	errNoStoreArea = errors.New("no TiddlyWiki store area in the base page")
+)
+
+// publishTiddlers returns the fat tiddlers selected by PublishFilter as TiddlyWiki field strings, by title.
+func publishTiddlers(ctx context.Context) ([]map[string]string, error) {
+	filter, err := ParseFilter(PublishFilter)
+	if err != nil {
+		return nil, err
+	}
+	all, err := StoreDb.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := embargo.hidden(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]map[string]string, 0)
+	for _, t := range withoutHidden(all, hidden) {
+		js, err := t.Fields()
+		if err != nil || !filter.MatchJSON(js) {
+			continue
+		}
+		if _, ok := js["text"]; !ok {
+			title, _ := js["title"].(string)
+			td, err := StoreDb.Get(ctx, title)
+			if err != nil {
+				return nil, err
+			}
+			if js, err = td.Fields(); err != nil {
+				return nil, err
+			}
+		}
+		fields := store.FlatFields(js)
+		for k := range fields {
+			if exportSkip[k] {
+				delete(fields, k)
+			}
+		}
+		rows = append(rows, fields)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["title"] < rows[j]["title"] })
+	return rows, nil
+}
+
+// addToStoreArea returns the TiddlyWiki page base with tiddlers added to its store:
+// a JSON store script after the last one for TiddlyWiki 5.2 and later, divs in the storeArea before.
+func addToStoreArea(base []byte, tiddlers []map[string]string) ([]byte, error) {
+	var out bytes.Buffer
+	if i := bytes.LastIndex(base, []byte(`class="tiddlywiki-tiddler-store"`)); i >= 0 {
+		end := bytes.Index(base[i:], []byte("</script>"))
+		if end < 0 {
+			return nil, errNoStoreArea
+		}
+		at := i + end + len("</script>")
+		data, err := json.Marshal(tiddlers) // escapes <, so no </script> in it
+		if err != nil {
+			return nil, err
+		}
+		out.Write(base[:at])
+		out.WriteString("\n<script class=\"tiddlywiki-tiddler-store\" type=\"application/json\">")
+		out.Write(data)
+		out.WriteString("</script>")
+		out.Write(base[at:])
+		return out.Bytes(), nil
+	}
+
+	i := bytes.Index(base, []byte(`<div id="storeArea"`))
+	if i < 0 {
+		return nil, errNoStoreArea
+	}
+	end := bytes.IndexByte(base[i:], '>')
+	if end < 0 {
+		return nil, errNoStoreArea
+	}
+	at := i + end + 1
+	out.Write(base[:at])
+	for _, fields := range tiddlers {
+		names := make([]string, 0, len(fields))
+		for k := range fields {
+			if k != "text" {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		out.WriteString("\n<div")
+		for _, k := range names {
+			out.WriteString(" " + html.EscapeString(k) + "=\"" + html.EscapeString(fields[k]) + "\"")
+		}
+		out.WriteString(">\n<pre>" + html.EscapeString(fields["text"]) + "</pre>\n</div>")
+	}
+	out.Write(base[at:])
+	return out.Bytes(), nil
+}
+
+// Publish writes a snapshot of the PublishFilter tiddlers in PublishBase with PublishOut,
+// and returns how many tiddlers and bytes it has.
+func Publish(ctx context.Context) (int, int, error) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	base, err := ioutil.ReadFile(PublishBase)
+	if err != nil {
+		return 0, 0, err
+	}
+	tiddlers, err := publishTiddlers(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	page, err := addToStoreArea(base, tiddlers)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := PublishOut(ctx, page); err != nil {
+		return 0, 0, err
+	}
+	RunHooks(EventPublished, map[string]interface{}{"tiddlers": len(tiddlers), "bytes": len(page)})
+	return len(tiddlers), len(page), nil
+}
+
+// adminPublish serves POST /admin/publish for admins, see Publish.
+func adminPublish(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if PublishOut == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, size, err := Publish(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	user, _ := currentUser(r)
+	log.Println("[publish]", n, "tiddlers,", size, "bytes by", user)
+	writeJSON(w, map[string]interface{}{
+		"tiddlers":  n,
+		"bytes":     size,
+		"published": time.Now().UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,243 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// saved queries: named server side filters
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"../store"
+)
+
+// queryPrefix starts the private tiddlers keeping the saved queries.
+const queryPrefix = privatePrefix + "queries/"
+
+// SavedQuery is a named filter kept on the server.
+type SavedQuery struct {
+	Name        string `json:"name"`
+	Filter      string `json:"filter"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner"`
+	Modified    string `json:"modified"`
+}
+
+// queryMu serializes the changes of the saved queries.
+var queryMu sync.Mutex
+
+// loadQuery returns the saved query name, nil when there is none.
+func loadQuery(r *http.Request, name string) (*SavedQuery, error) {
+	var q *SavedQuery
+	err := loadPrivate(r.Context(), queryPrefix + name, &q)
+	return q, err
+}
+
+// queries serves the saved queries:
+//
+//	GET     /queries/                        the saved queries
+//	GET     /queries/<name>                  a saved query
+//	PUT     /queries/<name>                  save {"filter": "[tag[Task]!tag[Done]]", "description": "..."}, users only
+//	DELETE  /queries/<name>                  its owner or an admin only
+//	GET     /queries/<name>/tiddlers.json    the (skinny) tiddlers it matches, like /recipes/all/tiddlers.json
+func queries(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/queries/")
+	if name == "" {
+		listQueries(w, r)
+		return
+	}
+	if strings.HasSuffix(name, "/tiddlers.json") {
+		queryTiddlers(w, r, strings.TrimSuffix(name, "/tiddlers.json"))
+		return
+	}
+	if strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		q, err := loadQuery(r, name)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if q == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, q)
+
+	case "PUT":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		var req SavedQuery
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if _, err := ParseFilter(req.Filter); err != nil || strings.TrimSpace(req.Filter) == "" {
+			http.Error(w, "bad filter: " + req.Filter, http.StatusBadRequest)
+			return
+		}
+		user, _ := currentUser(r)
+
+		queryMu.Lock()
+		defer queryMu.Unlock()
+		old, err := loadQuery(r, name)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if old != nil && old.Owner != user && !isAdmin(r) {
+			http.Error(w, "query " + name + " belongs to " + old.Owner, http.StatusForbidden)
+			return
+		}
+		q := &SavedQuery{Name: name, Filter: req.Filter, Description: req.Description, Owner: user, Modified: twNow()}
+		if old != nil {
+			q.Owner = old.Owner
+		}
+		if err := savePrivate(r.Context(), queryPrefix + name, q); err != nil {
+			internalError(w, err)
+			return
+		}
+		respCache.Invalidate()
+		writeJSON(w, q)
+
+	case "DELETE":
+		if !checkAuth(w, r) || !checkWritable(w, r) {
+			return
+		}
+		user, _ := currentUser(r)
+
+		queryMu.Lock()
+		defer queryMu.Unlock()
+		old, err := loadQuery(r, name)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if old == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if old.Owner != user && !isAdmin(r) {
+			http.Error(w, "query " + name + " belongs to " + old.Owner, http.StatusForbidden)
+			return
+		}
+		if err := StoreDb.Delete(r.Context(), queryPrefix + name); err != nil {
+			internalError(w, err)
+			return
+		}
+		respCache.Invalidate()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listQueries serves GET /queries/, sorted by name.
+func listQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	all, err := StoreDb.All(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	list := []*SavedQuery{}
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if !strings.HasPrefix(title, queryPrefix) {
+			continue
+		}
+		q, err := loadQuery(r, strings.TrimPrefix(title, queryPrefix))
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if q != nil {
+			list = append(list, q)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, list)
+}
+
+// queryTiddlers serves GET /queries/<name>/tiddlers.json, cached until the store changes.
+func queryTiddlers(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := loadQuery(r, name)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	filter, err := ParseFilter(q.Filter)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	key := "query/" + name
+	if hidden != nil {
+		key += "/guest"
+	}
+	e, err := cached(key, CacheList, func() ([]byte, error) {
+		all, err := StoreDb.All(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		tiddlers := make([]*store.Tiddler, 0)
+		for _, t := range withoutHidden(all, hidden) {
+			js, err := t.Fields()
+			if err == nil && filter.MatchJSON(js) {
+				tiddlers = append(tiddlers, t)
+			}
+		}
+
+		var buf bytes.Buffer
+		err = json.NewEncoder(&buf).Encode(tiddlers)
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeCached(w, r, e)
+}
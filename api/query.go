@@ -0,0 +1,317 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// JSON query endpoint: tiddlers, fields, tags, links and history in one round trip
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../store"
+)
+
+var (
+	// QueryAPI enables /query.
+	QueryAPI = false
+
+	// QueryMaxLimit caps the limit of a query.
+	QueryMaxLimit = 1000
+)
+
+// Query is a /query request, selecting tiddlers by a filter and the parts of them to return.
+type Query struct {
+	Filter    string   `json:"filter"`    // default [!is[system]]
+	Fields    []string `json:"fields"`    // the fields returned, empty for all (the text only with Text)
+	Text      bool     `json:"text"`      // return the text
+	Links     bool     `json:"links"`     // return the titles the text links to
+	Backlinks bool     `json:"backlinks"` // return the titles linking to the tiddler
+	History   bool     `json:"history"`   // return the revisions kept in the history, when the store keeps them
+	Tags      bool     `json:"tags"`      // return how many of the matching tiddlers have each tag
+	Sort      string   `json:"sort"`      // field to sort by, "-" first for descending, default title
+	Offset    int      `json:"offset"`
+	Limit     int      `json:"limit"` // default and max QueryMaxLimit
+}
+
+// QueryTiddler is a tiddler in a /query result.
+type QueryTiddler struct {
+	Title     string            `json:"title"`
+	Revision  int               `json:"revision"`
+	Fields    map[string]string `json:"fields"`
+	Tags      []string          `json:"tags"`
+	Text      *string           `json:"text,omitempty"`
+	Links     []string          `json:"links,omitempty"`
+	Backlinks []string          `json:"backlinks,omitempty"`
+	History   []store.Revision  `json:"history,omitempty"`
+}
+
+// QueryResult is the answer to a Query.
+type QueryResult struct {
+	Total     int             `json:"total"` // matching tiddlers, before Offset and Limit
+	Tiddlers  []*QueryTiddler `json:"tiddlers"`
+	TagCounts map[string]int  `json:"tag_counts,omitempty"`
+}
+
+// reLink matches the [[Title]] and [[label|Title]] links and {{Title}} transclusions of wikitext.
+var reLink = regexp.MustCompile(`\[\[([^\]|]*\|)?([^\]]+)\]\]|\{\{([^{}|!]+)`)
+
+// wikiLinks returns the titles text links to, in order, without duplicates.
+func wikiLinks(text string) ([]string) {
+	var links []string
+	seen := map[string]bool{}
+	for _, m := range reLink.FindAllStringSubmatch(text, -1) {
+		title := strings.TrimSpace(m[2] + m[3])
+		if title != "" && !seen[title] {
+			seen[title] = true
+			links = append(links, title)
+		}
+	}
+	return links
+}
+
+// query serves /query when QueryAPI is set:
+//
+//	POST /query {"filter": "[tag[Task]]", "fields": ["due"], "links": true, "limit": 20}
+//	POST /query {"queries": {"tasks": {...}, "recent": {...}}}   several at once, answered by name
+//	GET  /query?q=<the same JSON>
+func query(w http.ResponseWriter, r *http.Request) {
+	if !QueryAPI {
+		http.NotFound(w, r)
+		return
+	}
+	var data []byte
+	switch r.Method {
+	case "GET", "HEAD":
+		data = []byte(r.URL.Query().Get("q"))
+	case "POST":
+		var err error
+		data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1 << 20))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Query
+		Queries map[string]Query `json:"queries"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(w, "bad query: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ev, err := newQueryEval(r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if req.Queries == nil {
+		res, err := ev.run(&req.Query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, res)
+		return
+	}
+	out := make(map[string]*QueryResult, len(req.Queries))
+	for name, q := range req.Queries {
+		q := q
+		res, err := ev.run(&q)
+		if err != nil {
+			http.Error(w, name + ": " + err.Error(), http.StatusBadRequest)
+			return
+		}
+		out[name] = res
+	}
+	writeJSON(w, out)
+}
+
+// queryEval runs the queries of a request over one listing of the store.
+type queryEval struct {
+	r         *http.Request
+	all       []map[string]interface{} // skinny fields of the tiddlers visible to the client
+	backlinks map[string][]string      // built on first use
+}
+
+func newQueryEval(r *http.Request) (*queryEval, error) {
+	all, err := StoreDb.All(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := hiddenFor(r)
+	if err != nil {
+		return nil, err
+	}
+	ev := &queryEval{r: r}
+	for _, t := range withoutHidden(all, hidden) {
+		if js, err := t.Fields(); err == nil {
+			ev.all = append(ev.all, js)
+		}
+	}
+	return ev, nil
+}
+
+// fat returns the fields of title with text.
+func (ev *queryEval) fat(title string) (map[string]interface{}, error) {
+	t, err := StoreDb.Get(ev.r.Context(), title)
+	if err != nil {
+		return nil, err
+	}
+	return t.Fields()
+}
+
+// backlinksOf returns the titles linking to title, reading the text of every tiddler on first use.
+func (ev *queryEval) backlinksOf(title string) ([]string, error) {
+	if ev.backlinks == nil {
+		ev.backlinks = make(map[string][]string)
+		for _, js := range ev.all {
+			from, _ := js["title"].(string)
+			text, ok := js["text"].(string)
+			if !ok {
+				fat, err := ev.fat(from)
+				if err != nil {
+					return nil, err
+				}
+				text, _ = fat["text"].(string)
+			}
+			for _, to := range wikiLinks(text) {
+				ev.backlinks[to] = append(ev.backlinks[to], from)
+			}
+		}
+		for _, list := range ev.backlinks {
+			sort.Strings(list)
+		}
+	}
+	return ev.backlinks[title], nil
+}
+
+func (ev *queryEval) run(q *Query) (*QueryResult, error) {
+	src := q.Filter
+	if src == "" {
+		src = "[!is[system]]"
+	}
+	filter, err := ParseFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, fmt.Errorf("negative offset or limit")
+	}
+	limit := q.Limit
+	if limit == 0 || limit > QueryMaxLimit {
+		limit = QueryMaxLimit
+	}
+
+	var matches []map[string]string
+	res := &QueryResult{Tiddlers: []*QueryTiddler{}}
+	if q.Tags {
+		res.TagCounts = map[string]int{}
+	}
+	for _, js := range ev.all {
+		if !filter.MatchJSON(js) {
+			continue
+		}
+		flat := store.FlatFields(js)
+		matches = append(matches, flat)
+		if q.Tags {
+			for _, tag := range store.ParseTags(flat["tags"]) {
+				res.TagCounts[tag]++
+			}
+		}
+	}
+	res.Total = len(matches)
+
+	field, desc := strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+	if field == "" {
+		field = "title"
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i][field], matches[j][field]
+		if a == b {
+			return matches[i]["title"] < matches[j]["title"]
+		}
+		return (a < b) != desc
+	})
+	if q.Offset >= len(matches) {
+		return res, nil
+	}
+	matches = matches[q.Offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	for _, flat := range matches {
+		title := flat["title"]
+		qt := &QueryTiddler{Title: title, Fields: map[string]string{}, Tags: store.ParseTags(flat["tags"])}
+		qt.Revision, _ = strconv.Atoi(flat["revision"])
+
+		needText := q.Text || q.Links
+		if _, ok := flat["text"]; needText && !ok {
+			fat, err := ev.fat(title)
+			if err != nil {
+				return nil, err
+			}
+			flat = store.FlatFields(fat)
+		}
+		if q.Text {
+			text := flat["text"]
+			qt.Text = &text
+		}
+		if q.Links {
+			qt.Links = wikiLinks(flat["text"])
+		}
+		if q.Backlinks {
+			links, err := ev.backlinksOf(title)
+			if err != nil {
+				return nil, err
+			}
+			qt.Backlinks = links
+		}
+		if rs, ok := StoreDb.(store.RevisionStore); ok && q.History {
+			revs, err := rs.ListRevisions(ev.r.Context(), title)
+			if err != nil {
+				return nil, err
+			}
+			qt.History = revs
+		}
+
+		if len(q.Fields) == 0 {
+			for k, v := range flat {
+				if !exportSkip[k] && k != "text" && k != "tags" && k != "title" {
+					qt.Fields[k] = v
+				}
+			}
+		} else {
+			for _, k := range q.Fields {
+				if v, ok := flat[k]; ok && k != "text" {
+					qt.Fields[k] = v
+				}
+			}
+		}
+		res.Tiddlers = append(res.Tiddlers, qt)
+	}
+	return res, nil
+}
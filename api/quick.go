@@ -0,0 +1,162 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// quick note page
+package api
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+// QuickTitle is the time layout of the title of the quick notes saved without one.
+var QuickTitle = "Quick note 2006-01-02 15.04"
+
+// quickPage is kept tiny, no script and no style sheet, to load at once on a weak connection.
+var quickPage = template.Must(template.New("quick").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Quick note</title></head>
+<body style="font:16px sans-serif;margin:1em auto;max-width:40em;padding:0 .5em">
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+{{if .Saved}}<p>Saved <a href="./#{{.Saved}}">{{.Saved}}</a>.</p>{{end}}
+{{if .User}}<form method="post" action="quick">
+<input type="hidden" name="csrf_token" value="{{.CSRF}}">
+<p><input name="title" placeholder="Title (optional)" style="width:100%"></p>
+<p><textarea name="text" rows="8" required autofocus style="width:100%"></textarea></p>
+<p><input name="tags" placeholder="Tags" style="width:100%"></p>
+<p><button type="submit">Save</button> <a href="./">Open the wiki</a></p>
+</form>{{else}}<form method="post" action="quick">
+<p><input name="user" placeholder="User" autocomplete="username" required></p>
+<p><input name="password" type="password" placeholder="Password" autocomplete="current-password" required></p>
+<p><button type="submit">Log in</button></p>
+</form>{{end}}
+</body></html>
+`))
+
+type quickInfo struct {
+	User  string
+	CSRF  string
+	Saved string
+	Error string
+}
+
+// quick serves /quick, a page to add a note without loading the wiki.
+// Its form posts back here: a new tiddler is saved (never replacing one, see freeTitle)
+// and the page shown again with a link to it. Guests get a login form instead.
+func quick(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	sess := Sess.sessionOf(r)
+	user, logged := currentUser(r)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		info := quickInfo{User: user, Saved: r.URL.Query().Get("saved")}
+		if logged {
+			info.CSRF = csrfToken(sess)
+		}
+		writeQuick(w, http.StatusOK, info)
+	case "POST":
+		if !logged {
+			quickLogin(w, r)
+			return
+		}
+		if !checkCSRF(r, sess) {
+			http.Error(w, "missing or wrong CSRF token", http.StatusForbidden)
+			return
+		}
+		if !checkWritable(w, r) {
+			return
+		}
+		quickSave(w, r, user)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeQuick(w http.ResponseWriter, code int, info quickInfo) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	quickPage.Execute(w, info)
+}
+
+// quickLogin logs in with the user and password of the login form of /quick.
+func quickLogin(w http.ResponseWriter, r *http.Request) {
+	user := r.PostFormValue("user")
+	if Authenticate == nil || !Authenticate(user, r.PostFormValue("password")) {
+		writeQuick(w, http.StatusUnauthorized, quickInfo{Error: "Wrong user name or password."})
+		return
+	}
+	sess, err := Sess.Rotate(w, r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	sess.Login(user)
+	touchLogin(r.Context(), user)
+	seeOther(w, "quick")
+}
+
+// quickSave saves the note posted to /quick by user.
+func quickSave(w http.ResponseWriter, r *http.Request, user string) {
+	text := strings.Replace(r.PostFormValue("text"), "\r\n", "\n", -1)
+	if strings.TrimSpace(text) == "" {
+		http.Error(w, "empty note", http.StatusBadRequest)
+		return
+	}
+	title := strings.Join(strings.Fields(r.PostFormValue("title")), " ")
+	if title == "" {
+		title = time.Now().Format(QuickTitle)
+	}
+	if !checkNotPrivate(w, title) || !checkSystemEdit(w, r, title) {
+		return
+	}
+
+	ctx := r.Context()
+	title, err := freeTitle(ctx, title)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	now := twNow()
+	js := map[string]interface{}{
+		"title":    title,
+		"text":     text,
+		"tags":     store.ParseTags(r.PostFormValue("tags")),
+		"type":     "text/vnd.tiddlywiki",
+		"created":  now,
+		"modified": now,
+		"creator":  user,
+		"modifier": user,
+	}
+	rev, err := StoreDb.Put(ctx, newPutTiddler(ctx, title, js))
+	respCache.Invalidate()
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	notifyEdit(r, title, text, "")
+	trackEdit(r, title, rev <= 2)
+	seeOther(w, "quick?saved=" + url.QueryEscape(title))
+}
+
+// seeOther redirects to the relative location loc as is, unlike http.Redirect
+// which resolves it against the path left by the http.StripPrefix of a Config.Base.
+func seeOther(w http.ResponseWriter, loc string) {
+	w.Header().Set("Location", loc)
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,98 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// read-only fallback when the data volume is low on space, or set by an admin
+package api
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// DiskCheckInterval is how often StartDiskWatch checks the free space.
+	DiskCheckInterval = time.Minute
+
+	// ReadOnlyStore tells that the store is a frozen copy (see store/readonly), shown by /status.
+	ReadOnlyStore = false
+
+	lowDisk int32
+)
+
+// StartDiskWatch checks the free space on the volume holding path periodically,
+// and turns the server read-only while it is below minFree bytes.
+func StartDiskWatch(path string, minFree int64) {
+	if minFree <= 0 {
+		return
+	}
+	check := func() {
+		free, err := diskFree(path)
+		if err != nil {
+			log.Println("[disk] check free space error", err)
+			return
+		}
+
+		low := free < minFree
+		if low && atomic.SwapInt32(&lowDisk, 1) == 0 {
+			log.Printf("[disk] free space %d bytes < %d, switch to read-only", free, minFree)
+		}
+		if !low && atomic.SwapInt32(&lowDisk, 0) == 1 {
+			log.Printf("[disk] free space %d bytes, writable again", free)
+		}
+	}
+
+	check()
+	go func() {
+		tick := time.NewTicker(DiskCheckInterval)
+		defer tick.Stop()
+		for range tick.C {
+			check()
+		}
+	}()
+}
+
+// readOnlyReason returns why writes are refused, empty if writable.
+func readOnlyReason() (string) {
+	if reason := maintenanceReason(); reason != "" {
+		return reason
+	}
+	if ReadOnlyStore {
+		return "read-only copy"
+	}
+	if atomic.LoadInt32(&lowDisk) == 1 {
+		return "low disk space, read-only"
+	}
+	if currentSettings().ReadOnly {
+		return "read-only, set by an admin"
+	}
+	return ""
+}
+
+// checkWritable refuses the request when writes are disabled, with 507 Insufficient Storage
+// for low disk space, else 503 Service Unavailable (with a Retry-After in maintenance mode).
+func checkWritable(w http.ResponseWriter, r *http.Request) (ok bool) {
+	reason := readOnlyReason()
+	if reason == "" {
+		return true
+	}
+	code := http.StatusServiceUnavailable
+	if maintenanceReason() != "" {
+		w.Header().Set("Retry-After", maintenanceRetry())
+	} else if atomic.LoadInt32(&lowDisk) == 1 {
+		code = http.StatusInsufficientStorage
+	}
+	http.Error(w, reason, code)
+	return false
+}
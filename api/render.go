@@ -0,0 +1,298 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// server side rendering of a wikitext & Markdown subset, for the read-only pages
+package api
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	reCode     = regexp.MustCompile("`([^`]+)`")
+	reWikiImg  = regexp.MustCompile(`\[img(?: width=\d+)?\[(?:([^|\]]*)\|)?([^\]]+)\]\]`)
+	reWikiExt  = regexp.MustCompile(`\[ext\[(?:([^|\]]*)\|)?([^\]]+)\]\]`)
+	reWikiLink = regexp.MustCompile(`\[\[(?:([^|\]]*)\|)?([^\]]+)\]\]`)
+	reMdImg    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	reMdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	reURL      = regexp.MustCompile(`(^|[\s(])(https?://[^\s<>"]+[^\s<>".,;:!?)])`)
+	reBold     = regexp.MustCompile(`''(.+?)''|\*\*(.+?)\*\*`)
+	reItalic   = regexp.MustCompile(`//(.+?)//`)
+	reMdItalic = regexp.MustCompile(`(^|[^*\w])\*([^*\s][^*]*?)\*`)
+
+	// textEscaper escapes text for HTML content and double quoted attributes, keeping ' for wikitext.
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;")
+	reStrike   = regexp.MustCompile(`~~(.+?)~~`)
+	reOrdered  = regexp.MustCompile(`^\d+\. `)
+)
+
+// renderer renders tiddler text to HTML. link maps a tiddler title to its URL.
+type renderer struct {
+	markdown bool
+	link     func(title string) (string)
+}
+
+// safeURL returns u (already HTML escaped) if it is a relative or http(s)/mailto URL, "#" otherwise.
+func safeURL(u string) (string) {
+	parsed, err := url.Parse(html.UnescapeString(u))
+	if err != nil {
+		return "#"
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "", "http", "https", "mailto":
+		return u
+	}
+	return "#"
+}
+
+// RenderText renders a tiddler text of type typ to HTML.
+// Only a subset of wikitext and Markdown is supported: headings, lists, quotes, code,
+// bold, italic, links and images; macros, widgets and transclusions are left as text.
+func RenderText(typ string, text string, link func(title string) (string)) (template.HTML) {
+	r := &renderer{
+		markdown: typ == "text/x-markdown" || typ == "text/markdown",
+		link:     link,
+	}
+	switch {
+	case typ == "" || typ == "text/vnd.tiddlywiki" || r.markdown:
+		return template.HTML(r.blocks(text))
+	case strings.HasPrefix(typ, "image/"):
+		return ""
+	}
+	return template.HTML("<pre>" + html.EscapeString(text) + "</pre>")
+}
+
+// blocks renders the block level elements line by line.
+func (r *renderer) blocks(text string) (string) {
+	var out strings.Builder
+	var para []string
+	list := ""  // open list tag
+	quote := false
+
+	flushPara := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + r.inline(strings.Join(para, "\n")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	closeQuote := func() {
+		if quote {
+			out.WriteString("</blockquote>\n")
+			quote = false
+		}
+	}
+
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") {
+			flushPara()
+			closeList()
+			closeQuote()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+			continue
+		}
+
+		if trimmed == "" {
+			flushPara()
+			closeList()
+			closeQuote()
+			continue
+		}
+
+		if level, title := r.heading(trimmed); level > 0 {
+			flushPara()
+			closeList()
+			closeQuote()
+			tag := "h" + string(rune('0' + level))
+			out.WriteString("<" + tag + ">" + r.inline(title) + "</" + tag + ">\n")
+			continue
+		}
+
+		if tag, item := r.listItem(trimmed); tag != "" {
+			flushPara()
+			closeQuote()
+			if list != tag {
+				closeList()
+				out.WriteString("<" + tag + ">\n")
+				list = tag
+			}
+			out.WriteString("<li>" + r.inline(item) + "</li>\n")
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "> ") || trimmed == ">" {
+			flushPara()
+			closeList()
+			if !quote {
+				out.WriteString("<blockquote>\n")
+				quote = true
+			}
+			out.WriteString("<p>" + r.inline(strings.TrimPrefix(strings.TrimPrefix(trimmed, ">"), " ")) + "</p>\n")
+			continue
+		}
+
+		if trimmed == "---" || trimmed == "***" {
+			flushPara()
+			closeList()
+			closeQuote()
+			out.WriteString("<hr>\n")
+			continue
+		}
+
+		closeList()
+		closeQuote()
+		para = append(para, trimmed)
+	}
+	flushPara()
+	closeList()
+	closeQuote()
+	return out.String()
+}
+
+func (r *renderer) heading(line string) (int, string) {
+	mark := byte('!')
+	if r.markdown {
+		mark = '#'
+	}
+	level := 0
+	for level < len(line) && line[level] == mark {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0, ""
+	}
+	if r.markdown && (len(line) == level || line[level] != ' ') {
+		return 0, ""
+	}
+	return level, strings.TrimSpace(line[level:])
+}
+
+func (r *renderer) listItem(line string) (string, string) {
+	switch {
+	case strings.HasPrefix(line, "* "):
+		return "ul", line[2:]
+	case r.markdown && strings.HasPrefix(line, "- "):
+		return "ul", line[2:]
+	case !r.markdown && strings.HasPrefix(line, "# "):
+		return "ol", line[2:]
+	case r.markdown && reOrdered.MatchString(line):
+		return "ol", reOrdered.ReplaceAllString(line, "")
+	}
+	return "", ""
+}
+
+// inline renders the inline markup of s, HTML escaped first.
+func (r *renderer) inline(s string) (string) {
+	s = textEscaper.Replace(s)
+
+	// code spans and links are kept out of the other rules
+	var kept []string
+	keep := func(h string) string {
+		kept = append(kept, h)
+		return "\x00" + string(rune('0' + len(kept) - 1)) + "\x00"
+	}
+	s = reCode.ReplaceAllStringFunc(s, func(m string) string {
+		return keep("<code>" + reCode.FindStringSubmatch(m)[1] + "</code>")
+	})
+
+	img := func(alt, src string) string {
+		return keep(`<img src="` + safeURL(src) + `" alt="` + alt + `">`)
+	}
+	a := func(text, href string) string {
+		return keep(`<a href="` + safeURL(href) + `">` + text + `</a>`)
+	}
+
+	if r.markdown {
+		s = reMdImg.ReplaceAllStringFunc(s, func(m string) string {
+			sub := reMdImg.FindStringSubmatch(m)
+			return img(sub[1], sub[2])
+		})
+		s = reMdLink.ReplaceAllStringFunc(s, func(m string) string {
+			sub := reMdLink.FindStringSubmatch(m)
+			href := sub[2]
+			if strings.HasPrefix(href, "#") { // tiddler link
+				title, err := url.PathUnescape(html.UnescapeString(href[1:]))
+				if err == nil {
+					href = textEscaper.Replace(r.link(title))
+				}
+			}
+			return a(sub[1], href)
+		})
+	} else {
+		s = reWikiImg.ReplaceAllStringFunc(s, func(m string) string {
+			sub := reWikiImg.FindStringSubmatch(m)
+			src := sub[2]
+			if !strings.Contains(src, "/") && !strings.Contains(src, ".") {
+				src = textEscaper.Replace(r.link(html.UnescapeString(src)))
+			}
+			return img(sub[1], src)
+		})
+		s = reWikiExt.ReplaceAllStringFunc(s, func(m string) string {
+			sub := reWikiExt.FindStringSubmatch(m)
+			text := sub[1]
+			if text == "" {
+				text = sub[2]
+			}
+			return a(text, sub[2])
+		})
+		s = reWikiLink.ReplaceAllStringFunc(s, func(m string) string {
+			sub := reWikiLink.FindStringSubmatch(m)
+			text, target := sub[1], sub[2]
+			if text == "" {
+				text = target
+			}
+			if strings.Contains(target, "://") {
+				return a(text, target)
+			}
+			return a(text, textEscaper.Replace(r.link(html.UnescapeString(target))))
+		})
+	}
+	s = reURL.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reURL.FindStringSubmatch(m)
+		return sub[1] + a(sub[2], sub[2])
+	})
+
+	s = reBold.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reBold.FindStringSubmatch(m)
+		return "<strong>" + sub[1] + sub[2] + "</strong>"
+	})
+	s = reStrike.ReplaceAllString(s, "<del>$1</del>")
+	if r.markdown {
+		s = reMdItalic.ReplaceAllString(s, "$1<em>$2</em>")
+	} else {
+		s = reItalic.ReplaceAllString(s, "<em>$1</em>")
+	}
+	s = strings.Replace(s, "\n", "<br>\n", -1)
+
+	for i, h := range kept {
+		s = strings.Replace(s, "\x00" + string(rune('0' + i)) + "\x00", h, 1)
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// request ids correlating responses, error reports and log lines
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader carries the id of a request in its response, and in the request
+// from a reverse proxy on the same host, whose id is then kept.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// newRequestID returns a random id, short enough to read out from a screenshot.
+func newRequestID() (string) {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID tells whether a proxy sent id is safe to log: up to 64 letters,
+// digits, '-', '_' and '.'.
+func validRequestID(id string) (bool) {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives r an id, sets it in the response header and returns r with
+// the id in its context.
+func withRequestID(w http.ResponseWriter, r *http.Request) (*http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	ip := net.ParseIP(clientAddr(r))
+	if ip == nil || !ip.IsLoopback() || !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// RequestID returns the id of r, for plugins; empty outside of the handlers.
+func RequestID(r *http.Request) (string) {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// responseID returns the id set in the header of w by withRequestID,
+// for the error helpers which only have w.
+func responseID(w http.ResponseWriter) (string) {
+	return w.Header().Get(RequestIDHeader)
+}
+
+// withResponseID appends the request id of w to the error message msg, so that a user
+// reporting it gives the admin what to look for in the log.
+func withResponseID(w http.ResponseWriter, msg string) (string) {
+	if id := responseID(w); id != "" {
+		return msg + " (request " + id + ")"
+	}
+	return msg
+}
@@ -0,0 +1,162 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// bulk tag rename
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"../store"
+)
+
+// retagRequest is the body of POST /admin/retag.
+type retagRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`     // empty removes the tag
+	DryRun bool   `json:"dry_run"` // only list the tiddlers which would change
+}
+
+// retagResult is the change summary of POST /admin/retag.
+type retagResult struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	DryRun    bool     `json:"dry_run"`
+	Changed   []string `json:"changed"` // titles of the retagged tiddlers, sorted
+	Merged    []string `json:"merged"`  // those of them which already had the tag To
+	Skipped   []string `json:"skipped,omitempty"` // archived tiddlers with the tag From, left alone
+	Error     string   `json:"error,omitempty"`
+	RequestID string   `json:"request_id,omitempty"` // with Error, as in the log
+}
+
+// renameTag returns tags with from replaced by to (dropped when to is empty or already there),
+// and whether to was already there.
+func renameTag(tags []string, from string, to string) ([]string, bool) {
+	out := make([]string, 0, len(tags))
+	merged := false
+	for _, tag := range tags {
+		if tag == to {
+			merged = true
+		}
+	}
+	for _, tag := range tags {
+		if tag != from {
+			out = append(out, tag)
+		} else if to != "" && !merged {
+			out = append(out, to)
+		}
+	}
+	return out, merged
+}
+
+// adminRetag serves POST /admin/retag {"from":"old","to":"new"} for admins:
+// the tag is renamed in the tags of every tiddler, except the private and archived ones, each saved
+// as a new revision (with history) modified by the admin. It answers the change summary.
+func adminRetag(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req retagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req.From, req.To = strings.TrimSpace(req.From), strings.TrimSpace(req.To)
+	if req.From == "" || req.From == req.To {
+		http.Error(w, "from must be set and differ from to", http.StatusBadRequest)
+		return
+	}
+	if !req.DryRun && !checkWritable(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+	all, err := StoreDb.All(ctx)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	var titles []string
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if strings.HasPrefix(title, privatePrefix) {
+			continue
+		}
+		for _, tag := range store.TagsOf(js["tags"]) {
+			if tag == req.From {
+				titles = append(titles, title)
+				break
+			}
+		}
+	}
+	sort.Strings(titles)
+
+	res := retagResult{From: req.From, To: req.To, DryRun: req.DryRun, Changed: []string{}, Merged: []string{}}
+	user, _ := currentUser(r)
+	for _, title := range titles {
+		t, err := StoreDb.Get(ctx, title)
+		if err != nil {
+			res.Error = title + ": " + err.Error()
+			break
+		}
+		js, err := t.Fields()
+		if err != nil {
+			res.Error = title + ": " + err.Error()
+			break
+		}
+		if isArchived(js) {
+			res.Skipped = append(res.Skipped, title)
+			continue
+		}
+		tags, merged := renameTag(store.TagsOf(js["tags"]), req.From, req.To)
+		if merged {
+			res.Merged = append(res.Merged, title)
+		}
+		if !req.DryRun {
+			js["tags"] = tags
+			js["modified"] = twNow()
+			js["modifier"] = user
+			if _, err := StoreDb.Put(ctx, newPutTiddler(ctx, title, js)); err != nil {
+				res.Error = title + ": " + err.Error()
+				break
+			}
+		}
+		res.Changed = append(res.Changed, title)
+	}
+
+	if !req.DryRun && len(res.Changed) > 0 {
+		respCache.Invalidate()
+		log.Printf("[retag] %q -> %q by %s: %d tiddlers", req.From, req.To, user, len(res.Changed))
+	}
+	if res.Error != "" {
+		res.RequestID = RequestID(r)
+		log.Printf("[retag] [%s] stopped: %s", res.RequestID, res.Error)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	writeJSON(w, res)
+}
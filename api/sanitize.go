@@ -0,0 +1,190 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// limits for less trusted editors
+package api
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Sanitize strips scripts from the HTML and SVG tiddlers saved by users who are not admins.
+	Sanitize = false
+
+	// AdminPrefixes are the title prefixes only admins may change, see checkSystemEdit.
+	// A prefix starting with "!" is open to every editor again, the longest matching prefix wins.
+	AdminPrefixes = []string{"$:/", "!$:/StoryList", "!$:/HistoryList", "!$:/Import", "!$:/state/", "!$:/temp/", "!$:/status/"}
+)
+
+// editorOf returns the user of a write request, logged in or authenticated by checkDavAuth.
+// Basic credentials count only once checkDavAuth verified them (davCached), a guest may send any.
+func editorOf(r *http.Request) (string, bool) {
+	if user, ok := currentUser(r); ok {
+		return user, true
+	}
+	if user, pwd, ok := r.BasicAuth(); ok && user != "" && davCached(user, pwd) {
+		return user, true
+	}
+	return "", false
+}
+
+// editorIsAdmin tells whether the editor of r is an admin; guests are not.
+func editorIsAdmin(r *http.Request) (bool) {
+	user, ok := editorOf(r)
+	return ok && (IsAdmin == nil || IsAdmin(user))
+}
+
+// adminOnly tells whether only admins may change title, by AdminPrefixes.
+func adminOnly(title string) (bool) {
+	match, only := -1, false
+	for _, p := range AdminPrefixes {
+		open := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if len(p) > match && strings.HasPrefix(title, p) {
+			match, only = len(p), !open
+		}
+	}
+	return only
+}
+
+// checkSystemEdit refuses with 403 Forbidden the changes of the AdminPrefixes tiddlers by users who are not admins.
+// A system plugin or stylesheet runs in the browser of every user.
+func checkSystemEdit(w http.ResponseWriter, r *http.Request, title string) (ok bool) {
+	if !adminOnly(title) || editorIsAdmin(r) {
+		return true
+	}
+	http.Error(w, "only admins may change " + title, http.StatusForbidden)
+	return false
+}
+
+// mustSanitize tells whether the tiddlers saved by r are sanitized.
+func mustSanitize(r *http.Request) (bool) {
+	return Sanitize && !editorIsAdmin(r)
+}
+
+// sanitizeFields strips the active content from the text of the HTML and SVG tiddlers js, when mustSanitize.
+func sanitizeFields(r *http.Request, js map[string]interface{}) {
+	if !mustSanitize(r) {
+		return
+	}
+	typ, _ := js["type"].(string)
+	switch strings.TrimSpace(strings.SplitN(typ, ";", 2)[0]) {
+	case "text/html", "application/xhtml+xml", "image/svg+xml":
+	default:
+		return
+	}
+	if text, ok := js["text"].(string); ok {
+		js["text"] = sanitizeHTML(text)
+	}
+}
+
+var (
+	// reActiveBlock matches the elements dropped with their content, reActiveTag their lone tags.
+	reActiveBlock = regexp.MustCompile(`(?is)<(?:script|style|iframe|frame|frameset|object|applet|noscript|template)\b[^>]*>.*?</\s*(?:script|style|iframe|frame|frameset|object|applet|noscript|template)\s*>`)
+	reActiveTag   = regexp.MustCompile(`(?is)</?\s*(?:script|style|iframe|frame|frameset|object|applet|noscript|template|embed|base|meta|link|form)\b[^>]*>`)
+
+	reTag  = regexp.MustCompile(`<[a-zA-Z](?:[^<>"']|"[^"]*"|'[^']*')*>`)
+	reAttr = regexp.MustCompile(`([^\s=/>]+)(\s*=\s*("[^"]*"|'[^']*'|[^\s>]+))?`)
+)
+
+// urlAttrs may hold a javascript: URL.
+var urlAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "xlink:href": true, "background": true, "poster": true,
+}
+
+// animAttrs of the SVG animation elements (animate, set...) give the values of the attribute named by attributeName.
+var animAttrs = map[string]bool{
+	"values": true, "from": true, "to": true, "by": true,
+}
+
+// sanitizeHTML drops scripts, frames, plugins and the like, event handler attributes
+// and script URLs from text. It is no full HTML parser, only a guard against the usual tricks.
+func sanitizeHTML(text string) (string) {
+	for {
+		out := reActiveTag.ReplaceAllString(reActiveBlock.ReplaceAllString(text, ""), "")
+		if out == text { // "<scr<script>ipt>" leaves a new tag after one pass
+			break
+		}
+		text = out
+	}
+	return reTag.ReplaceAllStringFunc(text, sanitizeTag)
+}
+
+func sanitizeTag(tag string) (string) {
+	inner := tag[1 : len(tag)-1]
+	selfClose := strings.HasSuffix(inner, "/")
+	inner = strings.TrimSuffix(inner, "/")
+	name := inner
+	if i := strings.IndexAny(inner, " \t\r\n\f/"); i >= 0 {
+		name = inner[:i]
+	} else {
+		return tag
+	}
+
+	attrs := reAttr.FindAllStringSubmatch(inner[len(name):], -1)
+	animURL := false // animates a URL attribute, e.g. <animate attributeName="href" values="javascript:...">
+	for _, m := range attrs {
+		if strings.ToLower(m[1]) == "attributename" {
+			animURL = urlAttrs[strings.ToLower(strings.TrimSpace(html.UnescapeString(strings.Trim(m[3], `"'`))))]
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("<" + name)
+	for _, m := range attrs {
+		attr := strings.ToLower(m[1])
+		if strings.HasPrefix(attr, "on") || attr == "style" && strings.Contains(strings.ToLower(m[3]), "expression(") {
+			continue
+		}
+		if urlAttrs[attr] && scriptURL(m[3]) {
+			continue
+		}
+		if animAttrs[attr] && animURL && scriptURLs(m[3]) {
+			continue
+		}
+		out.WriteString(" " + m[0])
+	}
+	if selfClose {
+		out.WriteString("/")
+	}
+	out.WriteString(">")
+	return out.String()
+}
+
+// scriptURLs tells whether one of the semicolon separated values of the attribute value v runs a script.
+func scriptURLs(v string) (bool) {
+	for _, u := range strings.Split(html.UnescapeString(strings.Trim(v, `"'`)), ";") {
+		if scriptURL(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptURL tells whether the quoted or bare attribute value v runs a script.
+func scriptURL(v string) (bool) {
+	v = strings.Trim(v, `"'`)
+	v = html.UnescapeString(v)
+	v = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, v)
+	v = strings.ToLower(v)
+	return strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "vbscript:") || strings.HasPrefix(v, "data:text/html") || strings.HasPrefix(v, "data:image/svg")
+}
@@ -15,13 +15,15 @@ package api
 
 import (
 	"fmt"
-//	"log"
+	"log"
+	"net"
 	"net/http"
 
 	"errors"
 	"encoding/base64"
 	"crypto/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,24 +39,49 @@ var (
 	SessionTimeout     = 30 * 60 * time.Second
 	SessionGCTime      = 30 * time.Second //15 * time.Minute
 	SessionCountLimit  = 4096
+
+	// SessionBind ties a session to the address it started from: "ip" to that address,
+	// "subnet" to its /24 (IPv4) or /64 (IPv6) network, "" to none. A cookie sent from
+	// elsewhere is ignored, which limits what a stolen one is worth.
+	SessionBind = ""
 )
 
+// maxUserAgent is how much of the User-Agent a session keeps.
+const maxUserAgent = 256
+
 type Store struct {
 	lock  sync.RWMutex
 	t     time.Time               //last access time
 	val   map[string]interface{}  //session store
+
+	sid   string
+	owner *Session  // saves the changes, nil for a detached store
+	saved time.Time // t when last saved
+
+	// the client which started the session, see SessionData
+	created time.Time
+	ip      string
+	agent   string
 }
 
 type Session struct {
-	lock     sync.RWMutex
+	backend  SessionBackend
 	end      chan struct{}
-	clients  map[string]*Store
+
+	created  uint64 // counters for /metrics
+	expired  uint64
 }
 
+// NewSession returns sessions kept in memory.
 func NewSession() (*Session) {
+	return NewSessionWith(newMemSessions())
+}
+
+// NewSessionWith returns sessions kept by backend.
+func NewSessionWith(backend SessionBackend) (*Session) {
 	s := &Session {
+		backend: backend,
 		end: make(chan struct{}),
-		clients: make(map[string]*Store),
 	}
 
 	go s.cleaner()
@@ -73,27 +100,11 @@ func (s *Session) cleaner() {
 			return
 		}
 
-		list := make([]string, 0)
-		s.lock.RLock()
-		for sid, _ := range s.clients {
-			list = append(list, sid)
-		}
-		s.lock.RUnlock()
-
-		for _, sid := range list {
-			s.lock.RLock()
-			u, ok := s.clients[sid]
-			s.lock.RUnlock()
-			if !ok {
-				continue
-			}
-
-			if time.Now().After(u.t) {
-				s.lock.Lock()
-				delete(s.clients, sid)
-				s.lock.Unlock()
-			}
+		n, err := s.backend.Expire(time.Now())
+		if err != nil {
+			log.Println("[session] expire", err)
 		}
+		atomic.AddUint64(&s.expired, uint64(n))
 	}
 }
 
@@ -102,63 +113,199 @@ func (s *Session) Close() {
 	case <-s.end:
 	default:
 		close(s.end)
+		s.backend.Close()
 	}
 }
 
+// GetSID returns the SID cookie of r, if it has the format of genSID.
 func (s *Session) GetSID(r *http.Request) (string, error) {
 	cookie, err := r.Cookie(CookieName)
-	if err != nil || cookie.Value == "" {
+	if err != nil || !validSID(cookie.Value) {
 		return "", ErrCookie
 	}
 
 	return cookie.Value, nil
 }
 
-func (s *Session) newSession(sid string) (*Store) {
+// sidLen is the length of the SIDs made by genSID.
+var sidLen = base64.URLEncoding.EncodedLen(18)
+
+func validSID(sid string) (bool) {
+	if len(sid) != sidLen {
+		return false
+	}
+	for i := 0; i < len(sid); i++ {
+		c := sid[i]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newSession returns the session sid, renewed, or a new one recording the client of r (may be nil).
+func (s *Session) newSession(sid string, r *http.Request) (*Store) {
 	sess := s.getSession(sid)
 	if sess != nil {
 		sess.ReNew()
 		return sess
 	}
 
+	if SessionCountLimit <= 0 {
+		return nil
+	}
 	sess = NewStore()
-
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	if len(s.clients) > SessionCountLimit {
+	sess.sid, sess.owner = sid, s
+	sess.created = time.Now()
+	if r != nil {
+		sess.ip, sess.agent = remoteIP(r), r.UserAgent()
+		if len(sess.agent) > maxUserAgent {
+			sess.agent = sess.agent[:maxUserAgent]
+		}
+	}
+	if err := sess.save(); err != nil {
+		log.Println("[session] save", err)
 		return nil
 	}
-	s.clients[sid] = sess
+	atomic.AddUint64(&s.created, 1)
 
 	return sess
 }
 
+// SessionStats are the session counters shown by /metrics.
+type SessionStats struct {
+	Active  int
+	Created uint64
+	Evicted uint64
+	Expired uint64
+}
+
+func (s *Session) Stats() (SessionStats) {
+	n, _ := s.backend.Len()
+	st := SessionStats{
+		Active:  n,
+		Created: atomic.LoadUint64(&s.created),
+		Expired: atomic.LoadUint64(&s.expired),
+	}
+	if ev, ok := s.backend.(interface{ Evicted() (uint64) }); ok {
+		st.Evicted = ev.Evicted()
+	}
+	return st
+}
+
 func (s *Session) getSession(sid string) (*Store) {
-	s.lock.RLock()
-	sess, ok := s.clients[sid]
-	s.lock.RUnlock()
-	if !ok {
+	d, err := s.backend.Load(sid)
+	if err != nil {
+		log.Println("[session] load", err)
+		return nil
+	}
+	if d == nil || time.Now().After(d.Expires) {
+		return nil
+	}
+	if d.Values == nil {
+		d.Values = make(map[string]interface{})
+	}
+	return &Store{val: d.Values, t: d.Expires, saved: d.Expires, sid: sid, owner: s,
+		created: d.Created, ip: d.IP, agent: d.UserAgent}
+}
+
+// sessionOf returns the session of the SID cookie of r, nil when there is none
+// or r comes from an address SessionBind refuses.
+func (s *Session) sessionOf(r *http.Request) (*Store) {
+	sid, err := s.GetSID(r)
+	if err != nil {
+		return nil
+	}
+	sess := s.getSession(sid)
+	if sess == nil {
+		return nil
+	}
+	if !boundMatch(sess.ip, remoteIP(r)) {
 		return nil
 	}
 	return sess
 }
 
+// boundMatch tells whether a session started from bound may be used from addr under SessionBind.
+func boundMatch(bound string, addr string) (bool) {
+	if SessionBind == "" || bound == "" { // sessions of older versions have no address
+		return true
+	}
+	if bound == addr {
+		return true
+	}
+	if SessionBind != "subnet" {
+		return false
+	}
+	a, b := net.ParseIP(bound), net.ParseIP(addr)
+	if a == nil || b == nil {
+		return false
+	}
+	mask := net.CIDRMask(64, 128)
+	if a.To4() != nil || b.To4() != nil {
+		a, b = a.To4(), b.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	return a != nil && b != nil && a.Mask(mask).Equal(b.Mask(mask))
+}
+
 func (s *Session) Start(w http.ResponseWriter, r *http.Request) (*Store, error) {
 	var session *Store
 
 	sid, err := s.GetSID(r)
-	if err != nil {
+	if err == nil && s.sessionOf(r) == nil {
+		if sess := s.getSession(sid); sess != nil {
+			uid, _ := sess.Get("uid")
+			log.Printf("[session] [%s] cookie of %v from %s sent from %s, ignored", RequestID(r), uid, sess.ip, remoteIP(r))
+		}
+		err = ErrCookie
+	}
+	if err != nil { // never adopt a SID we did not issue
 		sid, err = genSID()
 		if err != nil {
 			return nil, err
 		}
 	}
-	session = s.newSession(sid)
+	session = s.newSession(sid, r)
 	if session == nil {
 		return nil, ErrSessionLimit
 	}
+	setSIDCookie(w, sid)
 
+	return session, nil
+}
+
+// Renew extends the session of r and its cookie, only if the session exists.
+func (s *Session) Renew(w http.ResponseWriter, r *http.Request) {
+	sess := s.sessionOf(r)
+	if sess == nil {
+		return
+	}
+	sess.ReNew()
+	setSIDCookie(w, sess.sid)
+}
+
+// Rotate drops the session the client presented, if any, and starts a new one under a fresh SID,
+// so a SID planted before login (session fixation) is worthless after it.
+func (s *Session) Rotate(w http.ResponseWriter, r *http.Request) (*Store, error) {
+	if old, err := s.GetSID(r); err == nil {
+		s.destroy(old)
+	}
+
+	sid, err := genSID()
+	if err != nil {
+		return nil, err
+	}
+	session := s.newSession(sid, r)
+	if session == nil {
+		return nil, ErrSessionLimit
+	}
+	setSIDCookie(w, sid)
+
+	return session, nil
+}
+
+func setSIDCookie(w http.ResponseWriter, sid string) {
 	cookie := &http.Cookie{
 		Name: CookieName,
 		Value: sid,
@@ -168,21 +315,12 @@ func (s *Session) Start(w http.ResponseWriter, r *http.Request) (*Store, error)
 		MaxAge: int(CookieLifeTime.Seconds()),
 	}
 	http.SetCookie(w, cookie)
-
-	return session, nil
 }
 
 func (s *Session) destroy(sid string) {
-	s.lock.RLock()
-	_, ok := s.clients[sid]
-	s.lock.RUnlock()
-	if !ok {
-		return
+	if err := s.backend.Delete(sid); err != nil {
+		log.Println("[session] delete", err)
 	}
-
-	s.lock.Lock()
-	delete(s.clients, sid)
-	s.lock.Unlock()
 }
 
 func (s *Session) Destroy(w http.ResponseWriter, r *http.Request) {
@@ -191,7 +329,17 @@ func (s *Session) Destroy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.destroy(sid)
+	expireSIDCookie(w)
+}
 
+// DestroySession drops sess, e.g. the one Start returned, which may have a SID
+// other than the cookie of the request, and expires the cookie.
+func (s *Session) DestroySession(w http.ResponseWriter, sess *Store) {
+	s.destroy(sess.sid)
+	expireSIDCookie(w)
+}
+
+func expireSIDCookie(w http.ResponseWriter) {
 	// force cookie timeout
 	cookie := &http.Cookie{
 		Name: CookieName,
@@ -203,11 +351,12 @@ func (s *Session) Destroy(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Session) Dump() {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	for sid, sess := range s.clients {
-		fmt.Println("[dump]", sid, sess)
+	if m, ok := s.backend.(*memSessions); ok {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		for sid, d := range m.m {
+			fmt.Println("[dump]", sid, d)
+		}
 	}
 }
 
@@ -243,18 +392,61 @@ func (s *Store) Set(key string, val interface{}) {
 	s.t = time.Now().Add(SessionTimeout)
 
 	s.lock.Unlock()
+	s.save()
 }
 
 func (s *Store) Del(key string) {
 	s.lock.Lock()
 	delete(s.val, key)
 	s.lock.Unlock()
+	s.save()
+}
+
+func (s *Store) expires() (time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.t
 }
 
 func (s *Store) ReNew() {
 	s.lock.Lock()
 	s.t = time.Now().Add(SessionTimeout)
+	lazy := s.t.Sub(s.saved) < SessionTimeout / 10
+	s.lock.Unlock()
+
+	_, mem := s.owner.backendOf().(*memSessions)
+	if lazy && !mem { // spare shared backends a write per request
+		return
+	}
+	s.save()
+}
+
+func (s *Session) backendOf() (SessionBackend) {
+	if s == nil {
+		return nil
+	}
+	return s.backend
+}
+
+// save writes the store to the backend of its owner.
+func (s *Store) save() (error) {
+	if s.owner == nil {
+		return nil
+	}
+	s.lock.Lock()
+	d := &SessionData{Values: make(map[string]interface{}, len(s.val)), Expires: s.t,
+		Created: s.created, IP: s.ip, UserAgent: s.agent}
+	for k, v := range s.val {
+		d.Values[k] = v
+	}
+	s.saved = s.t
 	s.lock.Unlock()
+
+	err := s.owner.backend.Save(s.sid, d)
+	if err != nil {
+		log.Println("[session] save", err)
+	}
+	return err
 }
 
 func genSID() (string, error) {
@@ -0,0 +1,119 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// the sessions of a user, listed and revoked from /account/sessions
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessionInfo is a session as listed by GET /account/sessions.
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current,omitempty"` // the session of the request
+}
+
+// publicSessionID returns the id showing the session sid, which must not leak the SID itself.
+func publicSessionID(sid string) (string) {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userSessions returns the unexpired sessions of user by SID.
+func userSessions(user string) (map[string]*SessionData, error) {
+	lister, ok := Sess.backendOf().(SessionLister)
+	if !ok {
+		return nil, nil
+	}
+	all, err := lister.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	list := make(map[string]*SessionData)
+	for sid, d := range all {
+		uid, ok := d.Values["uid"]
+		if ok && fmt.Sprint(uid) == user && !now.After(d.Expires) {
+			list[sid] = d
+		}
+	}
+	return list, nil
+}
+
+// accountSessions serves /account/sessions: GET lists the sessions of user, newest first,
+// DELETE /account/sessions/<id> logs one of them out.
+func accountSessions(w http.ResponseWriter, r *http.Request, user string, id string) {
+	if _, ok := Sess.backendOf().(SessionLister); !ok {
+		http.Error(w, "the session backend cannot list sessions", http.StatusNotImplemented)
+		return
+	}
+	list, err := userSessions(user)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	current, _ := Sess.GetSID(r)
+
+	switch {
+	case id == "" && r.Method == "GET":
+		out := make([]sessionInfo, 0, len(list))
+		for sid, d := range list {
+			out = append(out, sessionInfo{
+				ID: publicSessionID(sid),
+				Created: d.Created,
+				Expires: d.Expires,
+				IP: d.IP,
+				UserAgent: d.UserAgent,
+				Current: sid == current,
+			})
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if !out[i].Created.Equal(out[j].Created) {
+				return out[i].Created.After(out[j].Created)
+			}
+			return out[i].ID < out[j].ID
+		})
+		writeJSON(w, out)
+
+	case id != "" && r.Method == "DELETE":
+		sess := Sess.sessionOf(r)
+		if sess == nil || !checkCSRF(r, sess) {
+			http.Error(w, "missing or wrong CSRF token", http.StatusForbidden)
+			return
+		}
+		for sid, d := range list {
+			if publicSessionID(sid) != id {
+				continue
+			}
+			Sess.destroy(sid)
+			log.Printf("[session] [%s] %s logged out session %s of %s", RequestID(r), user, id, d.IP)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,227 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// pluggable session backends
+package api
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionData is what a backend keeps for one session.
+type SessionData struct {
+	Values  map[string]interface{} `json:"values"`
+	Expires time.Time              `json:"expires"`
+
+	// the client which started the session
+	Created   time.Time `json:"created"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// SessionBackend keeps the sessions by SID. Backends shared by several widdly
+// instances (e.g. redis) let them share logins, persistent ones (e.g. bolt) keep them across restarts.
+type SessionBackend interface {
+	// Load returns the session sid, nil without error when there is none.
+	Load(sid string) (*SessionData, error)
+	// Save stores the session sid; saving a new one to a backend holding SessionCountLimit
+	// sessions first drops those EvictSessions returns.
+	Save(sid string, d *SessionData) (error)
+	Delete(sid string) (error)
+
+	// Expire drops the sessions expired at now and returns how many.
+	Expire(now time.Time) (int, error)
+	Len() (int, error)
+	Close() (error)
+}
+
+// SessionLister is a SessionBackend which can list its sessions, for /account/sessions.
+type SessionLister interface {
+	// List returns all sessions by SID, the expired ones may be included.
+	List() (map[string]*SessionData, error)
+}
+
+// SessionOpenFn opens a session backend from a backend specific source (file, address...).
+type SessionOpenFn func(source string) (SessionBackend, error)
+
+var (
+	ErrSessionBackend = errors.New("session backend not found")
+
+	sessionBackends = map[string]SessionOpenFn{
+		"memory": func(string) (SessionBackend, error) { return newMemSessions(), nil },
+	}
+)
+
+// RegSessionBackend adds a session backend, usually from the init of its package.
+func RegSessionBackend(name string, fn SessionOpenFn) {
+	sessionBackends[name] = fn
+}
+
+// ListSessionBackend lists the session backend names.
+func ListSessionBackend() ([]string) {
+	list := make([]string, 0, len(sessionBackends))
+	for name := range sessionBackends {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// OpenSessionBackend opens the session backend name.
+func OpenSessionBackend(name string, source string) (SessionBackend, error) {
+	fn, ok := sessionBackends[name]
+	if !ok {
+		return nil, ErrSessionBackend
+	}
+	return fn(source)
+}
+
+// memSessions keeps the sessions in memory, at most SessionCountLimit of them.
+type memSessions struct {
+	lock    sync.RWMutex
+	m       map[string]SessionData
+	evicted uint64
+}
+
+func newMemSessions() (*memSessions) {
+	return &memSessions{m: make(map[string]SessionData)}
+}
+
+func copyValues(v map[string]interface{}) (map[string]interface{}) {
+	c := make(map[string]interface{}, len(v))
+	for k, x := range v {
+		c[k] = x
+	}
+	return c
+}
+
+func (m *memSessions) Load(sid string) (*SessionData, error) {
+	m.lock.RLock()
+	d, ok := m.m[sid]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	c := d
+	c.Values = copyValues(d.Values)
+	return &c, nil
+}
+
+func (m *memSessions) Save(sid string, d *SessionData) (error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.m[sid]; !ok {
+		for len(m.m) > 0 && len(m.m) >= SessionCountLimit {
+			m.evictLocked()
+		}
+	}
+	c := *d
+	c.Values = copyValues(d.Values)
+	m.m[sid] = c
+	return nil
+}
+
+// evictLocked drops the least recently used session, guests before logged in users.
+func (m *memSessions) evictLocked() {
+	var oldest string
+	var oldestD SessionData
+	for sid, d := range m.m {
+		d := d
+		if oldest == "" || evictsBefore(&d, &oldestD) {
+			oldest, oldestD = sid, d
+		}
+	}
+	delete(m.m, oldest)
+	atomic.AddUint64(&m.evicted, 1)
+}
+
+// evictsBefore tells whether a full backend drops session a before b:
+// guests before logged in users, then the least recently used.
+func evictsBefore(a *SessionData, b *SessionData) (bool) {
+	_, loginA := a.Values["uid"]
+	_, loginB := b.Values["uid"]
+	if loginA != loginB {
+		return !loginA
+	}
+	return a.Expires.Before(b.Expires)
+}
+
+// EvictSessions returns the SIDs of the sessions a backend holding list drops before it saves
+// a new one, to keep at most SessionCountLimit sessions, in the order of the memory backend.
+func EvictSessions(list map[string]*SessionData) ([]string) {
+	n := len(list) - SessionCountLimit + 1
+	if n <= 0 {
+		return nil
+	}
+	sids := make([]string, 0, len(list))
+	for sid := range list {
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool {
+		return evictsBefore(list[sids[i]], list[sids[j]])
+	})
+	if n > len(sids) {
+		n = len(sids)
+	}
+	return sids[:n]
+}
+
+func (m *memSessions) Evicted() (uint64) {
+	return atomic.LoadUint64(&m.evicted)
+}
+
+func (m *memSessions) Delete(sid string) (error) {
+	m.lock.Lock()
+	delete(m.m, sid)
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *memSessions) Expire(now time.Time) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := 0
+	for sid, d := range m.m {
+		if now.After(d.Expires) {
+			delete(m.m, sid)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memSessions) List() (map[string]*SessionData, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	list := make(map[string]*SessionData, len(m.m))
+	for sid, d := range m.m {
+		c := d
+		c.Values = copyValues(d.Values)
+		list[sid] = &c
+	}
+	return list, nil
+}
+
+func (m *memSessions) Len() (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.m), nil
+}
+
+func (m *memSessions) Close() (error) {
+	return nil
+}
@@ -0,0 +1,170 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// settings an admin can change at runtime
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"../store"
+)
+
+var (
+	// MaxHistory and MaxHistorySize (bytes) are the history limits the store was opened with,
+	// see store.TiddlerStore.SetMaxHistory; the defaults of /admin/settings.
+	MaxHistory = -1
+	MaxHistorySize int64 = 0
+)
+
+// settingsTitle is the private tiddler keeping the settings changed at runtime.
+const settingsTitle = privatePrefix + "settings"
+
+// Settings are the settings an admin can change at runtime with /admin/settings.
+type Settings struct {
+	GzipLevel      int   `json:"gzip_level"`
+	ReadOnly       bool  `json:"read_only"`
+	MaxHistory     int   `json:"max_history"`
+	MaxHistorySize int64 `json:"max_history_size"`
+
+	Templates []TemplateRule `json:"templates"` // see serveTemplate
+}
+
+var (
+	settingsMu    sync.RWMutex
+	settingsWrite sync.Mutex // serializes the changes
+	settings      *Settings  // nil until changed at runtime
+)
+
+// currentSettings returns the settings in effect.
+func currentSettings() (Settings) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if settings != nil {
+		return *settings
+	}
+	return Settings{
+		GzipLevel:      GzipLevel,
+		MaxHistory:     MaxHistory,
+		MaxHistorySize: MaxHistorySize,
+		Templates:      Templates,
+	}
+}
+
+func gzipLevel() (int) {
+	return currentSettings().GzipLevel
+}
+
+func (s *Settings) validate() (error) {
+	switch {
+	case s.GzipLevel < -2 || s.GzipLevel > 9:
+		return fmt.Errorf("gzip_level %d not in -2..9", s.GzipLevel)
+	case s.MaxHistory < -1:
+		return fmt.Errorf("max_history %d < -1", s.MaxHistory)
+	case s.MaxHistorySize < 0:
+		return fmt.Errorf("max_history_size %d < 0", s.MaxHistorySize)
+	}
+	for i := range s.Templates {
+		if err := s.Templates[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySettings puts s in effect, nil for the startup settings.
+func applySettings(s *Settings) {
+	settingsMu.Lock()
+	settings = s
+	settingsMu.Unlock()
+
+	cur := currentSettings()
+	StoreDb.SetMaxHistory(cur.MaxHistory)
+	StoreDb.SetMaxHistorySize(cur.MaxHistorySize)
+}
+
+// loadSettings applies the settings saved by an admin, if any.
+func loadSettings(ctx context.Context) {
+	s := currentSettings()
+	if _, err := StoreDb.Get(ctx, settingsTitle); err != nil {
+		applySettings(nil)
+		return
+	}
+	if err := loadPrivate(ctx, settingsTitle, &s); err != nil {
+		log.Println("[settings] load", err)
+		return
+	}
+	if err := s.validate(); err != nil {
+		log.Println("[settings] ignored saved settings:", err)
+		return
+	}
+	applySettings(&s)
+}
+
+// adminSettings serves /admin/settings for admins:
+//
+//	GET     the settings in effect
+//	PUT     change some of them, e.g. {"gzip_level": 0, "read_only": true}; all or none are applied
+//	DELETE  go back to the startup settings
+//
+// Changed settings are kept in the store and survive restarts, until DELETE.
+func adminSettings(w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	settingsWrite.Lock()
+	defer settingsWrite.Unlock()
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, currentSettings())
+
+	case "PUT":
+		s := currentSettings()
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64 * 1024))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			http.Error(w, "bad request: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := savePrivate(r.Context(), settingsTitle, &s); err != nil {
+			internalError(w, err)
+			return
+		}
+		applySettings(&s)
+		log.Printf("[settings] changed %+v", s)
+		writeJSON(w, s)
+
+	case "DELETE":
+		err := StoreDb.Delete(r.Context(), settingsTitle)
+		if err != nil && err != store.ErrNotFound {
+			internalError(w, err)
+			return
+		}
+		applySettings(nil)
+		log.Println("[settings] back to the startup settings")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,300 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// streaming PUT/GET for large tiddlers
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	// StreamThreshold is the size above which tiddler text is streamed
+	// instead of buffered, when the store supports it. 0 for disable.
+	StreamThreshold int64 = 1 << 20
+
+	// MaxMetaSize limits the size of the fields other than text in a streamed tiddler.
+	MaxMetaSize = 1 << 20
+
+	ErrBadJSON = errors.New("malformed tiddler JSON")
+)
+
+// jsonScanner reads a tiddler JSON object one token at a time.
+type jsonScanner struct {
+	r    *bufio.Reader
+	meta int // bytes of non-text values read
+}
+
+// next returns the next non-space byte.
+func (s *jsonScanner) next() (byte, error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return c, nil
+		}
+	}
+}
+
+func (s *jsonScanner) hex4() (rune, error) {
+	var buf [4]byte
+	_, err := io.ReadFull(s.r, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(string(buf[:]), 16, 16)
+	if err != nil {
+		return 0, ErrBadJSON
+	}
+	return rune(n), nil
+}
+
+// readString decodes a JSON string into w, the opening quote is already read.
+func (s *jsonScanner) readString(w *bufio.Writer) (error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			return nil
+		case '\\':
+		default:
+			w.WriteByte(c)
+			continue
+		}
+
+		c, err = s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"', '\\', '/':
+			w.WriteByte(c)
+		case 'b':
+			w.WriteByte('\b')
+		case 'f':
+			w.WriteByte('\f')
+		case 'n':
+			w.WriteByte('\n')
+		case 'r':
+			w.WriteByte('\r')
+		case 't':
+			w.WriteByte('\t')
+		case 'u':
+			r, err := s.hex4()
+			if err != nil {
+				return err
+			}
+			if utf16.IsSurrogate(r) {
+				r = s.lowSurrogate(r)
+			}
+			w.WriteRune(r)
+		default:
+			return ErrBadJSON
+		}
+	}
+}
+
+// lowSurrogate combines the high surrogate hi with a following \uXXXX low surrogate.
+func (s *jsonScanner) lowSurrogate(hi rune) (rune) {
+	peek, err := s.r.Peek(6)
+	if err != nil || peek[0] != '\\' || peek[1] != 'u' {
+		return utf8.RuneError
+	}
+	lo, err := strconv.ParseUint(string(peek[2:]), 16, 16)
+	if err != nil {
+		return utf8.RuneError
+	}
+	r := utf16.DecodeRune(hi, rune(lo))
+	if r != utf8.RuneError {
+		s.r.Discard(6)
+	}
+	return r
+}
+
+// readRaw copies the raw JSON value starting with first into buf.
+func (s *jsonScanner) readRaw(first byte, buf *bytes.Buffer) (error) {
+	buf.WriteByte(first)
+	depth := 0
+	inStr := first == '"'
+	switch first {
+	case '{', '[':
+		depth = 1
+	case '"':
+	default: // number or literal
+		for {
+			c, err := s.r.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch c {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return s.r.UnreadByte()
+			}
+			buf.WriteByte(c)
+		}
+	}
+
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(c)
+		s.meta++
+		if s.meta > MaxMetaSize {
+			return ErrBadJSON
+		}
+
+		if inStr {
+			switch c {
+			case '\\':
+				c, err = s.r.ReadByte()
+				if err != nil {
+					return err
+				}
+				buf.WriteByte(c)
+			case '"':
+				inStr = false
+				if depth == 0 {
+					return nil
+				}
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inStr = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// parseStreamBody parses a tiddler JSON object from r, decoding the fields
+// other than text into js and spooling the text into a temp file.
+// The caller must close and remove text.
+func parseStreamBody(r io.Reader) (js map[string]interface{}, text *os.File, err error) {
+	text, err = ioutil.TempFile("", "widdly-text-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			text.Close()
+			os.Remove(text.Name())
+			text = nil
+		}
+	}()
+
+	s := &jsonScanner{r: bufio.NewReader(r)}
+	js = make(map[string]interface{})
+	tw := bufio.NewWriter(text)
+
+	c, err := s.next()
+	if err != nil || c != '{' {
+		return nil, text, ErrBadJSON
+	}
+	c, err = s.next()
+	if err != nil {
+		return nil, text, err
+	}
+
+	var kbuf bytes.Buffer
+	var raw bytes.Buffer
+	for c != '}' {
+		if c != '"' {
+			return nil, text, ErrBadJSON
+		}
+		kbuf.Reset()
+		kw := bufio.NewWriter(&kbuf)
+		err = s.readString(kw)
+		if err != nil {
+			return nil, text, err
+		}
+		kw.Flush()
+		key := kbuf.String()
+
+		c, err = s.next()
+		if err != nil || c != ':' {
+			return nil, text, ErrBadJSON
+		}
+		c, err = s.next()
+		if err != nil {
+			return nil, text, err
+		}
+
+		if key == "text" && c == '"' {
+			err = s.readString(tw)
+			if err != nil {
+				return nil, text, err
+			}
+		} else {
+			raw.Reset()
+			err = s.readRaw(c, &raw)
+			if err != nil {
+				return nil, text, err
+			}
+			var v interface{}
+			err = json.Unmarshal(raw.Bytes(), &v)
+			if err != nil {
+				return nil, text, err
+			}
+			js[key] = v
+		}
+
+		c, err = s.next()
+		if err != nil {
+			return nil, text, err
+		}
+		if c == ',' {
+			c, err = s.next()
+			if err != nil {
+				return nil, text, err
+			}
+		} else if c != '}' {
+			return nil, text, ErrBadJSON
+		}
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return nil, text, err
+	}
+	_, err = text.Seek(0, io.SeekStart)
+	return js, text, err
+}
@@ -0,0 +1,152 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// templates answering the GET of missing tiddlers
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"../store"
+)
+
+// TemplateRule names the template tiddler a missing tiddler starts from, when its title
+// has the Prefix or the GET asks for the Tag (?tag=Meeting).
+type TemplateRule struct {
+	Prefix   string `json:"prefix,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Template string `json:"template"`
+}
+
+// Templates are the startup template rules, the default of the templates of /admin/settings.
+var Templates []TemplateRule
+
+// ParseTemplates parses the rules "<prefix>=<template>" and "tag:<tag>=<template>"
+// separated by newlines, e.g. "Journal/=$:/templates/Journal".
+func ParseTemplates(s string) ([]TemplateRule, error) {
+	var rules []TemplateRule
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("template rule %q: want <prefix>=<template> or tag:<tag>=<template>", line)
+		}
+		rule := TemplateRule{Prefix: line[:i], Template: line[i+1:]}
+		if strings.HasPrefix(rule.Prefix, "tag:") {
+			rule.Prefix, rule.Tag = "", strings.TrimPrefix(rule.Prefix, "tag:")
+		}
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *TemplateRule) validate() (error) {
+	switch {
+	case rule.Template == "":
+		return fmt.Errorf("template rule %+v without template", *rule)
+	case (rule.Prefix == "") == (rule.Tag == ""):
+		return fmt.Errorf("template rule %+v needs either prefix or tag", *rule)
+	case isPrivate(rule.Template):
+		return fmt.Errorf("template rule %+v: private template", *rule)
+	}
+	return nil
+}
+
+// templateFor returns the template of the missing tiddler title asked for with the tags:
+// the rule of the longest matching prefix, else the first rule of one of the tags.
+func templateFor(rules []TemplateRule, title string, tags []string) (string) {
+	best, match := "", -1
+	for _, rule := range rules {
+		if rule.Prefix != "" && len(rule.Prefix) > match && strings.HasPrefix(title, rule.Prefix) {
+			best, match = rule.Template, len(rule.Prefix)
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for _, rule := range rules {
+		for _, tag := range tags {
+			if rule.Tag != "" && rule.Tag == tag {
+				return rule.Template
+			}
+		}
+	}
+	return ""
+}
+
+// templateFields are not copied from the template.
+var templateFields = []string{"title", "revision", "bag", "created", "creator", "modified", "modifier", "draft.of", "draft.title"}
+
+// serveTemplate answers the GET of the missing tiddler title with the template picked by templateFor,
+// retitled and with the asked tags added, so journals and structured notes start filled in,
+// also for API clients. The X-Template header names the template. It reports false
+// when there is no template, or it is missing or hidden.
+func serveTemplate(w http.ResponseWriter, r *http.Request, title string) (bool) {
+	tags := r.URL.Query()["tag"]
+	tmpl := templateFor(currentSettings().Templates, title, tags)
+	if tmpl == "" || tmpl == title {
+		return false
+	}
+	if hide, err := isHidden(r, tmpl); err != nil || hide {
+		return false
+	}
+	t, err := StoreDb.Get(r.Context(), tmpl)
+	if err != nil {
+		return false
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return false
+	}
+	for _, f := range templateFields {
+		delete(js, f)
+	}
+	if fields, ok := js["fields"].(map[string]interface{}); ok {
+		for _, f := range templateFields {
+			delete(fields, f)
+		}
+	}
+	js["title"] = title
+	js["bag"] = "bag"
+	if len(tags) > 0 {
+		all := store.TagsOf(js["tags"])
+		seen := make(map[string]bool, len(all))
+		for _, tag := range all {
+			seen[tag] = true
+		}
+		for _, tag := range tags {
+			if !seen[tag] {
+				all, seen[tag] = append(all, tag), true
+			}
+		}
+		js["tags"] = all
+	}
+
+	data, err := json.Marshal(js)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Template", tmpl)
+	w.Write(data)
+	return true
+}
@@ -0,0 +1,264 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// resized variants of image files and tiddlers (?w=400)
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ThumbWidths are the widths ?w= is rounded up to, empty for disable.
+	// Asking for a width above the largest one, or for an image not wider than the variant, serves the original.
+	ThumbWidths = []int{160, 400, 800, 1600}
+
+	// ThumbMaxPixels is the largest image (width * height) resized, bigger ones are served as is.
+	ThumbMaxPixels = 50 * 1000 * 1000
+
+	// ThumbQuality is the JPEG quality of the resized variants.
+	ThumbQuality = 85
+
+	// thumbDir is the directory under FilesDir (or the prefix of Blobs) keeping the variants.
+	thumbDir = ".thumbs"
+
+	errNoThumb = errors.New("no resized variant")
+
+	// thumbLock serializes resizing, which takes a lot of memory for large images.
+	thumbLock sync.Mutex
+)
+
+// thumbWidth returns the variant width for the ?w= of r, 0 for the original.
+func thumbWidth(r *http.Request) (int) {
+	q := r.URL.Query().Get("w")
+	if q == "" {
+		return 0
+	}
+	w, err := strconv.Atoi(q)
+	if err != nil || w <= 0 {
+		return 0
+	}
+	for _, tw := range ThumbWidths {
+		if w <= tw {
+			return tw
+		}
+	}
+	return 0
+}
+
+// thumbable tells whether a file name or Content-Type is an image which can be resized.
+func thumbable(ct string) (bool) {
+	ct = strings.ToLower(ct)
+	return ct == "image/jpeg" || ct == "image/png"
+}
+
+// thumbName is the name of the width variant of the file name.
+func thumbName(name string, width int) (string) {
+	return path.Join(thumbDir, strconv.Itoa(width), name)
+}
+
+// resize returns src scaled down to width as a JPEG or PNG (by ct),
+// errNoThumb when it is not wider than width or too large to decode.
+func resize(src io.Reader, ct string, width int) ([]byte, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= width || cfg.Width * cfg.Height > ThumbMaxPixels {
+		return nil, errNoThumb
+	}
+
+	thumbLock.Lock()
+	defer thumbLock.Unlock()
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	height := (cfg.Height * width + cfg.Width / 2) / cfg.Width
+	if height < 1 {
+		height = 1
+	}
+	dst := scaleDown(img, width, height)
+
+	var buf bytes.Buffer
+	if ct == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: ThumbQuality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// scaleDown resizes img to w x h averaging the source pixels covered by each pixel (box filter).
+func scaleDown(img image.Image, w int, h int) (*image.NRGBA) {
+	b := img.Bounds()
+	src, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y * sh / h, (y + 1) * sh / h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x * sw / w, (x + 1) * sw / w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				p := src.Pix[sy * src.Stride + x0 * 4 : sy * src.Stride + x1 * 4]
+				for i := 0; i < len(p); i += 4 {
+					alpha := uint64(p[i + 3])
+					r += uint64(p[i]) * alpha
+					g += uint64(p[i + 1]) * alpha
+					bl += uint64(p[i + 2]) * alpha
+					a += alpha
+					n++
+				}
+			}
+			o := y * dst.Stride + x * 4
+			if a > 0 {
+				dst.Pix[o] = uint8(r / a)
+				dst.Pix[o + 1] = uint8(g / a)
+				dst.Pix[o + 2] = uint8(bl / a)
+			}
+			dst.Pix[o + 3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// fileThumb serves the width variant of the file fpath in FilesDir, made on first request
+// and again when the original is newer. It returns false when the original should be served.
+func fileThumb(w http.ResponseWriter, r *http.Request, fpath string, width int) (bool) {
+	rel, err := filepath.Rel(FilesDir, fpath)
+	if err != nil || !thumbable(FileContentType(fpath)) {
+		return false
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	tpath := filepath.Join(FilesDir, filepath.FromSlash(thumbName(filepath.ToSlash(rel), width)))
+
+	ti, err := os.Stat(tpath)
+	if err != nil || ti.ModTime().Before(fi.ModTime()) {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return false
+		}
+		data, err := resize(f, FileContentType(fpath), width)
+		f.Close()
+		if err != nil {
+			return false
+		}
+		if writeFileAtomic(tpath, bytes.NewReader(data)) != nil {
+			return false
+		}
+	}
+
+	f, err := os.Open(tpath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	ti, err = f.Stat()
+	if err != nil {
+		return false
+	}
+	setUntrustedHeaders(w, FileContentType(fpath))
+	http.ServeContent(w, r, ti.Name(), ti.ModTime(), f)
+	return true
+}
+
+// blobThumb returns the name of the width variant of name in Blobs, made on first request,
+// or name itself when the original should be served.
+func blobThumb(ctx context.Context, name string, width int) (string) {
+	if !thumbable(FileContentType(name)) {
+		return name
+	}
+	tname := thumbName(name, width)
+	rc, _, err := Blobs.Get(ctx, tname)
+	if err == nil {
+		rc.Close()
+		return tname
+	}
+	if err != ErrBlobNotFound {
+		return name
+	}
+
+	rc, _, err = Blobs.Get(ctx, name)
+	if err != nil {
+		return name
+	}
+	data, err := resize(rc, FileContentType(name), width)
+	rc.Close()
+	if err != nil {
+		return name
+	}
+	if Blobs.Put(ctx, tname, bytes.NewReader(data), int64(len(data))) != nil {
+		return name
+	}
+	return tname
+}
+
+// dropThumbs deletes the variants of the file name, after it was replaced or deleted.
+func dropThumbs(ctx context.Context, name string) {
+	for _, width := range ThumbWidths {
+		tname := thumbName(name, width)
+		if Blobs != nil {
+			Blobs.Delete(ctx, tname)
+		} else {
+			os.Remove(filepath.Join(FilesDir, filepath.FromSlash(tname)))
+		}
+	}
+}
+
+// tiddlerThumb returns the width variant of an image tiddler, base64 text, cached until the store changes.
+func tiddlerThumb(title string, mime string, text string, width int) ([]byte, error) {
+	key := "thumb:" + strconv.Itoa(width) + ":" + title
+	e, err := cached(key, true, func() ([]byte, error) {
+		return resize(base64.NewDecoder(base64.StdEncoding, strings.NewReader(text)), mime, width)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.bytes()
+}
@@ -0,0 +1,338 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// upload checks: image metadata stripping and scanners
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Scanner checks an uploaded file before it is accepted. It returns a *ScanRejected
+// when the file must be refused, other errors refuse it too as the check could not be done.
+type Scanner func(ctx context.Context, name string, r io.Reader) (error)
+
+// ScanRejected is the verdict of a Scanner refusing a file.
+type ScanRejected struct {
+	Reason string
+}
+
+func (e *ScanRejected) Error() (string) {
+	return "rejected: " + e.Reason
+}
+
+var (
+	// StripMeta drops the EXIF (GPS, camera...), XMP and text metadata of the uploaded JPEG and PNG images,
+	// the JPEG orientation is kept.
+	StripMeta = true
+
+	// Scanners check every file uploaded under /files/, in order.
+	Scanners []Scanner
+
+	// ScanTimeout bounds each Scanner.
+	ScanTimeout = time.Minute
+)
+
+// spoolUpload copies an uploaded file into a temp file, stripped and scanned, and returns it rewound.
+// The caller closes and removes it. On error the response is written.
+func spoolUpload(w http.ResponseWriter, r *http.Request, name string, body io.Reader) (*os.File, bool) {
+	f, err := ioutil.TempFile("", "widdly-upload-")
+	if err != nil {
+		internalError(w, err)
+		return nil, false
+	}
+	fail := func() (*os.File, bool) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, false
+	}
+
+	if StripMeta && (FileContentType(name) == "image/jpeg" || FileContentType(name) == "image/png") {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return fail()
+		}
+		body = bytes.NewReader(stripImageMeta(data))
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return fail()
+	}
+
+	for _, scan := range Scanners {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			internalError(w, err)
+			return fail()
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), ScanTimeout)
+		err := scan(ctx, name, f)
+		cancel()
+		if rej, ok := err.(*ScanRejected); ok {
+			user, _ := currentUser(r)
+			log.Println("[files]", name, rej, "by", user, clientAddr(r))
+			http.Error(w, "upload " + rej.Error(), http.StatusUnprocessableEntity)
+			return fail()
+		}
+		if err != nil {
+			log.Println("[files] scanning", name, "failed:", err)
+			http.Error(w, "upload could not be scanned", http.StatusServiceUnavailable)
+			return fail()
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		internalError(w, err)
+		return fail()
+	}
+	return f, true
+}
+
+// stripImageMeta returns a JPEG or PNG image without its metadata, data as is for other formats.
+func stripImageMeta(data []byte) ([]byte) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG(data)
+	}
+	return data
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP), APP12 and APP13 (IPTC) segments and comments,
+// keeping the EXIF orientation in a minimal EXIF segment.
+func stripJPEG(data []byte) ([]byte) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	orientation := 0
+	kept := false
+	i := 2
+	for i + 4 <= len(data) {
+		if data[i] != 0xff {
+			return data // not a segment, leave the image alone
+		}
+		marker := data[i + 1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			out = append(out, data[i : i + 2]...)
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(data[i + 2:]))
+		if n < 2 || i + 2 + n > len(data) {
+			return data
+		}
+		seg := data[i : i + 2 + n]
+		if marker == 0xda { // start of scan: the rest is image data
+			if !kept && orientation > 1 {
+				out = append(out, exifOrientation(orientation)...)
+			}
+			return append(out, data[i:]...)
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")):
+			if o := readOrientation(seg[10:]); o > 0 {
+				orientation = o
+			}
+		case marker == 0xe1 || marker == 0xec || marker == 0xed || marker == 0xfe:
+		default:
+			if marker != 0xe0 && !kept && orientation > 1 { // after JFIF
+				out = append(out, exifOrientation(orientation)...)
+				kept = true
+			}
+			out = append(out, seg...)
+		}
+		i += 2 + n
+	}
+	return data
+}
+
+// readOrientation reads the Orientation tag of IFD0 of a TIFF (EXIF) block, 0 when none.
+func readOrientation(tiff []byte) (int) {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd + 2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e + 12 <= len(tiff) && count > 0; e, count = e + 12, count - 1 {
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			return int(bo.Uint16(tiff[e + 8:]))
+		}
+	}
+	return 0
+}
+
+// exifOrientation is an APP1 segment holding only the orientation o.
+func exifOrientation(o int) ([]byte) {
+	seg := []byte("\xff\xe1\x00\x22Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(seg[28:], uint16(o))
+	return seg
+}
+
+// stripPNG drops the eXIf, text and tIME chunks.
+func stripPNG(data []byte) ([]byte) {
+	out := append(make([]byte, 0, len(data)), data[:8]...)
+	for i := 8; i + 12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if n < 0 || i + 12 + n > len(data) {
+			return data
+		}
+		switch string(data[i + 4 : i + 8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i : i + 12 + n]...)
+		}
+		i += 12 + n
+	}
+	return out
+}
+
+// stripFields strips the metadata of the base64 JPEG and PNG image tiddlers js.
+func stripFields(js map[string]interface{}) {
+	if !StripMeta {
+		return
+	}
+	typ, _ := js["type"].(string)
+	if typ != "image/jpeg" && typ != "image/png" {
+		return
+	}
+	text, _ := js["text"].(string)
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return
+	}
+	if stripped := stripImageMeta(data); len(stripped) != len(data) {
+		js["text"] = base64.StdEncoding.EncodeToString(stripped)
+	}
+}
+
+// stripStream is stripFields for a streamed tiddler js with its text spooled to text:
+// ok tells whether it is an image to strip, read into memory and returned stripped.
+func stripStream(js map[string]interface{}, text io.Reader) (stripped string, ok bool, err error) {
+	typ, _ := js["type"].(string)
+	if !StripMeta || (typ != "image/jpeg" && typ != "image/png") {
+		return "", false, nil
+	}
+	buf, err := ioutil.ReadAll(text)
+	if err != nil {
+		return "", false, err
+	}
+	img := map[string]interface{}{"type": typ, "text": string(buf)}
+	stripFields(img)
+	stripped, _ = img["text"].(string)
+	return stripped, true, nil
+}
+
+// ClamdScanner scans with clamd at addr, a unix socket path or host:port, using INSTREAM.
+func ClamdScanner(addr string) (Scanner) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+	return func(ctx context.Context, name string, r io.Reader) (error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+			return err
+		}
+		buf := make([]byte, 32 * 1024)
+		size := make([]byte, 4)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size, uint32(n))
+				if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return err
+		}
+
+		reply, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		res := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+		switch {
+		case strings.HasSuffix(res, " OK"):
+			return nil
+		case strings.HasSuffix(res, " FOUND"):
+			return &ScanRejected{Reason: strings.TrimSuffix(strings.TrimPrefix(res, "stream: "), " FOUND")}
+		}
+		return fmt.Errorf("clamd: %s", res)
+	}
+}
+
+// CommandScanner runs the command line cmd (split at spaces) with the file on stdin and its name in
+// $WIDDLY_UPLOAD_NAME: exit status 0 accepts the file, 1 rejects it (the output is the reason), others fail.
+func CommandScanner(cmd string) (Scanner) {
+	args := strings.Fields(cmd)
+	return func(ctx context.Context, name string, r io.Reader) (error) {
+		c := exec.CommandContext(ctx, args[0], args[1:]...)
+		c.Stdin = r
+		c.Env = append(os.Environ(), "WIDDLY_UPLOAD_NAME=" + name)
+		out, err := c.CombinedOutput()
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			reason := strings.TrimSpace(string(out))
+			if reason == "" {
+				reason = args[0]
+			}
+			return &ScanRejected{Reason: reason}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v: %s", args[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+}
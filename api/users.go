@@ -0,0 +1,155 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// user accounts kept in the data store
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"../store"
+)
+
+// usersPrefix starts the titles of the accounts kept by Accounts.
+const usersPrefix = privatePrefix + "users/"
+
+// UserRecord is a user account, the user.lst row with room for the other credentials.
+type UserRecord struct {
+	Name  string `json:"name"`
+	Salt  string `json:"salt"`
+	Hash  string `json:"hash"`           // hex sha256 of "<password>-:-<salt>", like in user.lst
+	Role  string `json:"role,omitempty"` // admin or user
+	Email string `json:"email,omitempty"`
+
+	TOTPSecret string   `json:"totp_secret,omitempty"` // base32 secret of a second factor
+	Tokens     []string `json:"tokens,omitempty"`      // hex sha256 of API tokens
+}
+
+// Accounts keeps the user accounts in the private tiddlers $:/widdly/users/<name> of a store,
+// so the data store holds everything and its backups cover the accounts too.
+// The accounts are read once by OpenAccounts and then served from memory.
+type Accounts struct {
+	db    store.TiddlerStore
+	lock  sync.RWMutex
+	users map[string]*UserRecord
+}
+
+// OpenAccounts reads the accounts kept in db.
+func OpenAccounts(ctx context.Context, db store.TiddlerStore) (*Accounts, error) {
+	all, err := db.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a := &Accounts{db: db, users: make(map[string]*UserRecord)}
+	for _, t := range all {
+		if !isPrivateTiddler(t) {
+			continue
+		}
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if !strings.HasPrefix(title, usersPrefix) {
+			continue
+		}
+		text, _ := js["text"].(string)
+		if text == "" { // skinny, only the backends without fat system tiddlers
+			full, err := db.Get(ctx, title)
+			if err != nil {
+				return nil, err
+			}
+			if js, err = full.Fields(); err != nil {
+				return nil, err
+			}
+			text, _ = js["text"].(string)
+		}
+		u := &UserRecord{}
+		if err := json.Unmarshal([]byte(text), u); err != nil {
+			return nil, err
+		}
+		u.Name = strings.TrimPrefix(title, usersPrefix)
+		a.users[u.Name] = u
+	}
+	return a, nil
+}
+
+// Get returns a copy of the account of name.
+func (a *Accounts) Get(name string) (*UserRecord, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return nil, false
+	}
+	c := *u
+	c.Tokens = append([]string(nil), u.Tokens...)
+	return &c, true
+}
+
+// Put adds or replaces the account u.Name.
+func (a *Accounts) Put(ctx context.Context, u *UserRecord) (error) {
+	c := *u
+	c.Tokens = append([]string(nil), u.Tokens...)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	title := usersPrefix + c.Name
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Put(ctx, store.Tiddler{
+		Key: title,
+		Js: map[string]interface{}{
+			"title":    title,
+			"type":     "application/json",
+			"text":     string(data),
+			"modified": twNow(),
+		},
+		IsSys: true,
+	})
+	if err != nil {
+		return err
+	}
+	a.users[c.Name] = &c
+	return nil
+}
+
+// Delete removes the account of name.
+func (a *Accounts) Delete(ctx context.Context, name string) (error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.db.Delete(ctx, usersPrefix + name)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	delete(a.users, name)
+	return nil
+}
+
+// Names returns the sorted user names.
+func (a *Accounts) Names() ([]string) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,219 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// stable ids of tiddlers
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+var (
+	// UUIDs assigns a uuid field to every tiddler on its first save, see assignUUID.
+	UUIDs = false
+)
+
+// uuidField is the field keeping the id of a tiddler.
+const uuidField = "uuid"
+
+// uuidIndex maps the uuids to the titles. It is read from the store on first use, and again
+// when a uuid is missing after the store changed; an entry is checked against its tiddler before use.
+var uuidIndex struct {
+	sync.Mutex
+	titles map[string]string
+	gen    uint64 // respCache generation of the last read
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6] & 0x0f | 0x40
+	b[8] = b[8] & 0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// uuidOf returns the uuid field of js.
+func uuidOf(js map[string]interface{}) (string) {
+	fields, _ := js["fields"].(map[string]interface{})
+	id, _ := fields[uuidField].(string)
+	return id
+}
+
+// storedUUID returns the uuid of the stored tiddler title, "" without one.
+func storedUUID(ctx context.Context, title string) (string) {
+	t, err := StoreDb.Get(ctx, title)
+	if err != nil {
+		return ""
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return ""
+	}
+	return uuidOf(js)
+}
+
+// readUUIDs reads the index from the store, the caller holds uuidIndex.
+func readUUIDs(ctx context.Context) (error) {
+	gen := respCache.Generation()
+	tiddlers, err := StoreDb.All(ctx)
+	if err != nil {
+		return err
+	}
+	titles := make(map[string]string)
+	for _, t := range tiddlers {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		if store.FlatFields(js)["draft.of"] != "" {
+			continue
+		}
+		if id := uuidOf(js); id != "" {
+			titles[id] = t.Key
+		}
+	}
+	uuidIndex.titles, uuidIndex.gen = titles, gen
+	return nil
+}
+
+// lookupUUID returns the title of the tiddler with uuid id, store.ErrNotFound without one.
+func lookupUUID(ctx context.Context, id string) (string, error) {
+	uuidIndex.Lock()
+	defer uuidIndex.Unlock()
+	for read := false; ; read = true {
+		if title, ok := uuidIndex.titles[id]; ok && storedUUID(ctx, title) == id {
+			return title, nil
+		}
+		if read || (uuidIndex.titles != nil && uuidIndex.gen == respCache.Generation()) {
+			return "", store.ErrNotFound
+		}
+		if err := readUUIDs(ctx); err != nil {
+			return "", err
+		}
+	}
+}
+
+// isRenaming tells whether the tiddler from is being renamed to to, by a saved draft or a WebDAV MOVE.
+func isRenaming(ctx context.Context, from string, to string) (bool) {
+	aliasMu.Lock()
+	p, ok := pendingRenames[from]
+	aliasMu.Unlock()
+	if ok && p.to == to && time.Since(p.at) <= renameWindow {
+		return true
+	}
+	t, err := StoreDb.Get(ctx, "Draft of '" + from + "'")
+	if err != nil {
+		return false
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return false
+	}
+	of, title, renamed := draftRename(js)
+	return renamed && of == from && title == to
+}
+
+// assignUUID sets the uuid field of js, about to be saved as key. The uuid sent by the client
+// is kept, unless another tiddler has it and is not being renamed to key (a clone);
+// without one the tiddler keeps its stored uuid, or gets a new one.
+func assignUUID(ctx context.Context, key string, js map[string]interface{}) {
+	if !UUIDs || isPrivate(key) {
+		return
+	}
+	id := uuidOf(js)
+	if id != "" {
+		owner, err := lookupUUID(ctx, id)
+		if err == nil && owner != key && !isRenaming(ctx, owner, key) {
+			id = ""
+		}
+	}
+	if id == "" {
+		id = storedUUID(ctx, key)
+	}
+	if id == "" {
+		var err error
+		if id, err = newUUID(); err != nil {
+			log.Println("[uuid]", err)
+			return
+		}
+	}
+
+	fields, ok := js["fields"].(map[string]interface{})
+	if !ok {
+		fields = make(map[string]interface{})
+		js["fields"] = fields
+	}
+	fields[uuidField] = id
+	uuidIndex.Lock()
+	if uuidIndex.titles != nil {
+		uuidIndex.titles[id] = key
+	}
+	uuidIndex.Unlock()
+}
+
+// renamedTo returns the title which took the uuid of the tiddler title, "" when none did.
+func renamedTo(ctx context.Context, title string) (string) {
+	if !UUIDs {
+		return ""
+	}
+	id := storedUUID(ctx, title)
+	if id == "" {
+		return ""
+	}
+	to, err := lookupUUID(ctx, id)
+	if err != nil || to == title {
+		return ""
+	}
+	return to
+}
+
+// uuidHandler serves GET /uuid/<uuid>, redirecting to the tiddler with that uuid whatever its title.
+func uuidHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/uuid/")
+	if !UUIDs || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	title, err := lookupUUID(r.Context(), id)
+	if err == store.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if hide, err := isHidden(r, title); err != nil || hide {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Location", "../recipes/all/tiddlers/" + url.PathEscape(title))
+	w.WriteHeader(http.StatusFound)
+}
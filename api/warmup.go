@@ -0,0 +1,181 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"../store"
+)
+
+// ReadyWait is how long a request waits for the store to open and warm up
+// before it gets 503 Service Unavailable.
+var ReadyWait = 30 * time.Second
+
+// readyGate holds the requests back until the store is open and warmed up.
+type readyGate struct {
+	open    func() (store.TiddlerStore, error)
+	warmUp  bool
+	onReady func()
+
+	mu    sync.Mutex
+	try   chan struct{} // closed when the current open attempt ends, nil when none runs
+	err   error         // error of the last failed attempt
+	ready chan struct{} // closed once StoreDb is set and warm
+}
+
+// gate is nil when the store is ready from the start.
+var gate *readyGate
+
+func newReadyGate(open func() (store.TiddlerStore, error), warmUp bool, onReady func()) (*readyGate) {
+	return &readyGate{open: open, warmUp: warmUp, onReady: onReady, ready: make(chan struct{})}
+}
+
+// isReady tells whether the store is open and warm.
+func (g *readyGate) isReady() (bool) {
+	select {
+	case <-g.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// start starts an open attempt unless one runs, and returns a channel closed when it ends.
+// A failed attempt is retried by the next request.
+func (g *readyGate) start() (chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.try == nil {
+		g.try = make(chan struct{})
+		go g.run(g.try)
+	}
+	return g.try
+}
+
+func (g *readyGate) run(try chan struct{}) {
+	start := time.Now()
+	db, err := g.open()
+	if err != nil {
+		log.Println("[ready] open store:", err)
+		g.mu.Lock()
+		g.err = err
+		g.try = nil
+		g.mu.Unlock()
+		close(try)
+		return
+	}
+
+	ctx := context.Background()
+	if StoreDb != db {
+		StoreDb = db // no request has passed the gate yet
+		loadSettings(ctx)
+	}
+	if g.warmUp {
+		warmUp(ctx)
+	}
+	log.Println("[ready] store ready in", time.Since(start).Round(time.Millisecond))
+	close(g.ready)
+	close(try)
+	if g.onReady != nil {
+		g.onReady()
+	}
+}
+
+// lastErr returns the error of the last failed open attempt.
+func (g *readyGate) lastErr() (error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// warmUp reads the tiddler list into the response cache and the OS page cache,
+// so the first clients don't all wait on a cold store.
+func warmUp(ctx context.Context) {
+	if _, err := cachedList(ctx, nil, store.Order{}); err != nil {
+		log.Println("[ready] warm up:", err)
+		return
+	}
+	hidden, err := embargo.hidden(ctx)
+	if err != nil {
+		log.Println("[ready] warm up:", err)
+		return
+	}
+	if hidden != nil {
+		cachedList(ctx, hidden, store.Order{})
+	}
+}
+
+// withReady is a middleware holding the request until the store is ready,
+// opening it on the first request when opened lazily.
+func withReady(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g := gate
+		if g == nil || g.isReady() {
+			f(w, r)
+			return
+		}
+
+		try := g.start()
+		timer := time.NewTimer(ReadyWait)
+		defer timer.Stop()
+		for {
+			select {
+			case <-g.ready:
+				f(w, r)
+				return
+			case <-try:
+				if g.isReady() {
+					continue
+				}
+				notReady(w, g.lastErr())
+				return
+			case <-timer.C:
+				notReady(w, nil)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// notReady answers 503 Service Unavailable, asking the client to come back shortly.
+func notReady(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(5))
+	msg := "store not ready"
+	if err != nil {
+		logError(w, err)
+		msg = withResponseID(w, "store unavailable")
+	}
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// ready answers 200 once the store is open and warm, 503 before,
+// for load balancers and service managers. It never opens a lazy store.
+func ready(w http.ResponseWriter, r *http.Request) {
+	if g := gate; g != nil && !g.isReady() {
+		w.Header().Set("Retry-After", strconv.Itoa(5))
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ready")
+}
@@ -0,0 +1,82 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// tiddlers of other wikis on the same server
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"../store"
+)
+
+// Wiki is another wiki of the server (its store), whose tiddlers are read here as "<Name>:<title>".
+type Wiki struct {
+	Name   string
+	Store  store.TiddlerStore
+	Guests bool // guests may read it too, else only logged in users
+}
+
+var (
+	// Wikis are the other wikis by name, see serveCrossWiki.
+	Wikis = make(map[string]*Wiki)
+)
+
+// crossWiki splits key into a wiki of Wikis and the title in it, false when its prefix names no wiki.
+func crossWiki(key string) (*Wiki, string, bool) {
+	i := strings.IndexByte(key, ':')
+	if i <= 0 || i == len(key) - 1 {
+		return nil, "", false
+	}
+	wiki, ok := Wikis[key[:i]]
+	return wiki, key[i+1:], ok
+}
+
+// serveCrossWiki serves the GET of the missing tiddler key, "<wiki>:<title>", from that wiki of Wikis:
+// the tiddler titled key in the bag named after the wiki, so that it can be transcluded. Private tiddlers
+// of the wiki are never served, and guests only read the wikis open to them.
+// It reports false when key names no wiki.
+func serveCrossWiki(w http.ResponseWriter, r *http.Request, key string) (bool) {
+	wiki, title, ok := crossWiki(key)
+	if !ok {
+		return false
+	}
+	if _, logged := currentUser(r); !logged && !wiki.Guests {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	if isPrivate(title) {
+		http.NotFound(w, r)
+		return true
+	}
+
+	t, err := wiki.Store.Get(r.Context(), title)
+	if err == store.ErrNotFound {
+		http.NotFound(w, r)
+		return true
+	}
+	if err != nil {
+		internalError(w, err)
+		return true
+	}
+	js, err := t.Fields()
+	if err != nil {
+		internalError(w, err)
+		return true
+	}
+	js["title"] = key
+	js["bag"] = wiki.Name
+	writeJSON(w, js)
+	return true
+}
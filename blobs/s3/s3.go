@@ -0,0 +1,148 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package s3 keeps the widdly attachment files in an S3 (or S3 compatible) bucket.
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"../../api"
+)
+
+const TypeName = "s3"
+
+type s3Blobs struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func init() {
+	api.RegBlobBackend(TypeName, Open)
+}
+
+// Open connects to the bucket of source, s3://host[:port]/bucket[/prefix][?region=...&insecure=1],
+// e.g. s3://s3.amazonaws.com/my-wiki/files. The keys are read from $AWS_ACCESS_KEY_ID and
+// $AWS_SECRET_ACCESS_KEY unless given in the URL (s3://key:secret@host/...).
+func Open(source string) (api.BlobBackend, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.New("s3: source must look like s3://host/bucket[/prefix]")
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, errors.New("s3: no bucket in " + source)
+	}
+
+	creds := credentials.NewEnvAWS()
+	if u.User != nil {
+		secret, _ := u.User.Password()
+		creds = credentials.NewStaticV4(u.User.Username(), secret, "")
+	} else if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		creds = credentials.NewIAM("")
+	}
+	q := u.Query()
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: q.Get("insecure") == "",
+		Region: q.Get("region"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Blobs{client: client, bucket: parts[0]}
+	if len(parts) == 2 {
+		s.prefix = parts[1] + "/"
+	}
+	ok, err := client.BucketExists(context.Background(), s.bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("s3: bucket " + s.bucket + " not found")
+	}
+	return s, nil
+}
+
+func (s *s3Blobs) key(name string) (string) {
+	return s.prefix + name
+}
+
+func notFound(err error) (bool) {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func (s *s3Blobs) Get(ctx context.Context, name string) (io.ReadCloser, *api.BlobInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if notFound(err) {
+			return nil, nil, api.ErrBlobNotFound
+		}
+		return nil, nil, err
+	}
+	return obj, &api.BlobInfo{Size: st.Size, ModTime: st.LastModified}, nil
+}
+
+func (s *s3Blobs) Put(ctx context.Context, name string, r io.Reader, size int64) (error) {
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size, minio.PutObjectOptions{
+		ContentType: api.FileContentType(name),
+	})
+	return err
+}
+
+func (s *s3Blobs) Delete(ctx context.Context, name string) (error) {
+	_, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if notFound(err) {
+		return api.ErrBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+// SignedURL presigns a GET of name, which S3 answers with the untrusted headers widdly sets itself.
+func (s *s3Blobs) SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-type", api.FileContentType(name))
+	params.Set("response-content-disposition", "inline; filename=\"" + strings.ReplaceAll(path.Base(name), "\"", "") + "\"")
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.key(name), ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *s3Blobs) Close() (error) {
+	return nil
+}
@@ -0,0 +1,284 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package webdav keeps the widdly attachment files on a WebDAV share.
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"../../api"
+)
+
+const TypeName = "webdav"
+
+type davBlobs struct {
+	base   *url.URL
+	public string
+	user   string
+	pass   string
+	client *http.Client
+}
+
+func init() {
+	api.RegBlobBackend(TypeName, Open)
+}
+
+// Open uses the share at source, e.g. https://user@dav.example.com/wiki-files/,
+// the password is read from $WIDDLY_FILES_PASS unless given in the URL.
+// With ?public=<URL> downloads are redirected to that URL plus the file name,
+// for shares also published read-only (unsigned) on a web server.
+func Open(source string) (api.BlobBackend, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webdav: source must be an http(s) URL, got %q", source)
+	}
+
+	d := &davBlobs{client: &http.Client{Timeout: 5 * time.Minute}}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.pass, _ = u.User.Password()
+		if d.pass == "" {
+			d.pass = os.Getenv("WIDDLY_FILES_PASS")
+		}
+		u.User = nil
+	}
+	if p := u.Query().Get("public"); p != "" {
+		d.public = strings.TrimSuffix(p, "/") + "/"
+	}
+	u.RawQuery = ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	d.base = u
+
+	resp, err := d.do(context.Background(), "PROPFIND", "", nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("webdav: PROPFIND %s: %s", u, resp.Status)
+	}
+	return d, nil
+}
+
+func (d *davBlobs) url(name string) (string) {
+	ref := &url.URL{Path: name}
+	return d.base.ResolveReference(ref).String()
+}
+
+func (d *davBlobs) do(ctx context.Context, method string, name string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "0")
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.pass)
+	}
+	return d.client.Do(req)
+}
+
+func statusError(method string, name string, resp *http.Response) (error) {
+	return fmt.Errorf("webdav: %s %s: %s", method, name, resp.Status)
+}
+
+func (d *davBlobs) Get(ctx context.Context, name string) (io.ReadCloser, *api.BlobInfo, error) {
+	resp, err := d.do(ctx, "GET", name, nil, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil, api.ErrBlobNotFound
+		}
+		return nil, nil, statusError("GET", name, resp)
+	}
+	info := &api.BlobInfo{Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if info.Size < 0 {
+		return resp.Body, info, nil
+	}
+	return &davFile{d: d, ctx: ctx, name: name, size: info.Size, body: resp.Body}, info, nil
+}
+
+// davFile reads a file of the share, seeking by a new GET with a Range header,
+// so the Range requests of the clients are served without downloading the whole file.
+type davFile struct {
+	d    *davBlobs
+	ctx  context.Context
+	name string
+	size int64
+	off  int64
+	body io.ReadCloser // nil after a seek, opened at off by the next Read
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+// open starts reading at f.off.
+func (f *davFile) open() (error) {
+	req, err := http.NewRequestWithContext(f.ctx, "GET", f.d.url(f.name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.off))
+	if f.d.user != "" {
+		req.SetBasicAuth(f.d.user, f.d.pass)
+	}
+	resp, err := f.d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK: // no Range support, skip to off
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, f.off); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return statusError("GET", f.name, resp)
+	}
+	f.body = resp.Body
+	return nil
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return f.off, fmt.Errorf("webdav: seek %s to %d", f.name, offset)
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *davFile) Close() (error) {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+// Put uploads name, creating its missing parent collections first.
+func (d *davBlobs) Put(ctx context.Context, name string, r io.Reader, size int64) (error) {
+	err := d.mkcol(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(ctx, "PUT", name, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statusError("PUT", name, resp)
+	}
+	return nil
+}
+
+func (d *davBlobs) mkcol(ctx context.Context, dir string) (error) {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	resp, err := d.do(ctx, "PROPFIND", dir + "/", nil, -1)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMultiStatus {
+		return nil
+	}
+
+	err = d.mkcol(ctx, path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	resp, err = d.do(ctx, "MKCOL", dir + "/", nil, -1)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed { // 405: exists
+		return statusError("MKCOL", dir, resp)
+	}
+	return nil
+}
+
+func (d *davBlobs) Delete(ctx context.Context, name string) (error) {
+	resp, err := d.do(ctx, "DELETE", name, nil, -1)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return api.ErrBlobNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return statusError("DELETE", name, resp)
+	}
+	return nil
+}
+
+// SignedURL returns the ?public URL of name, WebDAV has no signed URLs.
+func (d *davBlobs) SignedURL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	if d.public == "" {
+		return "", nil
+	}
+	return d.public + (&url.URL{Path: name}).EscapedPath(), nil
+}
+
+func (d *davBlobs) Close() (error) {
+	d.client.CloseIdleConnections()
+	return nil
+}
@@ -4,7 +4,9 @@
 OUT="./bin/"
 
 VERSION=`date -u +%Y%m%d%H%M`
-LDFLAGS="-X main.VERSION=$VERSION -s -w"
+COMMIT=`git rev-parse --short HEAD 2>/dev/null`
+BUILDDATE=`date -u +%Y-%m-%dT%H:%M:%SZ`
+LDFLAGS="-X main.VERSION=$VERSION -X main.COMMIT=$COMMIT -X main.BUILDDATE=$BUILDDATE -s -w"
 GCFLAGS=""
 
 ARCHS=(x64 arm8 arm7 x86 win64 win32 mipsle)
@@ -0,0 +1,392 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package dirsync keeps a local directory of .tid & .md files in sync with a TiddlerStore,
+// so tiddlers can be edited with external editors.
+package dirsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+// StateFile is the file inside the synced directory remembering the last synced state.
+const StateFile = ".widdly-sync.json"
+
+// fileState is the state of one tiddler at the last sync.
+type fileState struct {
+	File    string `json:"file"`
+	Rev     int    `json:"rev"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+}
+
+// Syncer syncs Dir with Store. The store is the source of truth:
+// when a tiddler changed on both sides, the store wins and the local file is kept as <file>.conflict.
+// System tiddlers and drafts are not synced.
+type Syncer struct {
+	Dir   string
+	Store store.TiddlerStore
+
+	// OnChange is called after the store was modified by a sync pass.
+	OnChange func()
+
+	state map[string]*fileState
+}
+
+// New returns a Syncer for dir, loading the previous sync state if any.
+func New(dir string, db store.TiddlerStore) (*Syncer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Syncer{
+		Dir:   dir,
+		Store: db,
+		state: make(map[string]*fileState),
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, StateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &s.state)
+		if err != nil {
+			return nil, fmt.Errorf("bad sync state %s: %v", StateFile, err)
+		}
+	}
+	return s, nil
+}
+
+// Watch runs a sync pass every interval until ctx is done.
+func (s *Syncer) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			log.Println("[dirsync]", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func skipTitle(title string) (bool) {
+	return title == "" || strings.HasPrefix(title, "$:/") || strings.HasPrefix(title, "Draft of '")
+}
+
+func isMarkdown(typ string) (bool) {
+	return typ == "text/x-markdown" || typ == "text/markdown"
+}
+
+// localFile is a .tid or .md file found in Dir.
+type localFile struct {
+	name    string
+	modTime int64
+	size    int64
+}
+
+// scan lists the tiddler files of Dir by title.
+func (s *Syncer) scan() (map[string]*localFile, error) {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*localFile, len(infos))
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		ext := filepath.Ext(name)
+		if ext != ".tid" && ext != ".md" {
+			continue
+		}
+		title := store.FileToTitle(strings.TrimSuffix(name, ext))
+		if skipTitle(title) {
+			continue
+		}
+		lf := &localFile{name: name, modTime: fi.ModTime().UnixNano(), size: fi.Size()}
+		if ext == ".md" { // .md.meta sidecar changes count too
+			if mi, err := os.Stat(filepath.Join(s.Dir, name + ".meta")); err == nil {
+				lf.modTime += mi.ModTime().UnixNano()
+				lf.size += mi.Size()
+			}
+		}
+		files[title] = lf
+	}
+	return files, nil
+}
+
+// revisions lists the revision of every synced tiddler of the store by title.
+func (s *Syncer) revisions(ctx context.Context) (map[string]int, error) {
+	all, err := s.Store.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make(map[string]int, len(all))
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if skipTitle(title) {
+			continue
+		}
+		rev, _ := js["revision"].(float64)
+		revs[title] = int(rev)
+	}
+	return revs, nil
+}
+
+// Sync runs one sync pass.
+func (s *Syncer) Sync(ctx context.Context) (error) {
+	revs, err := s.revisions(ctx)
+	if err != nil {
+		return err
+	}
+	files, err := s.scan()
+	if err != nil {
+		return err
+	}
+
+	titles := make(map[string]bool, len(revs) + len(files))
+	for title := range revs {
+		titles[title] = true
+	}
+	for title := range files {
+		titles[title] = true
+	}
+
+	changed := false
+	for title := range titles {
+		ch, err := s.syncOne(ctx, title, revs, files)
+		if err != nil {
+			log.Printf("[dirsync] %q: %v", title, err)
+		}
+		changed = changed || ch
+	}
+
+	for title := range s.state {
+		if !titles[title] {
+			delete(s.state, title)
+		}
+	}
+	if changed && s.OnChange != nil {
+		s.OnChange()
+	}
+	return s.saveState()
+}
+
+// syncOne syncs one tiddler and returns whether the store was modified.
+func (s *Syncer) syncOne(ctx context.Context, title string, revs map[string]int, files map[string]*localFile) (bool, error) {
+	rev, inStore := revs[title]
+	lf, inDir := files[title]
+	st := s.state[title]
+
+	storeChanged := st == nil || rev != st.Rev
+	fileChanged := st == nil || (lf != nil && (lf.name != st.File || lf.modTime != st.ModTime || lf.size != st.Size))
+
+	switch {
+	case inStore && !inDir:
+		if st != nil && !storeChanged { // deleted locally
+			delete(s.state, title)
+			return true, s.Store.Delete(ctx, title)
+		}
+		return false, s.export(ctx, title, nil)
+
+	case !inStore && inDir:
+		if st != nil && !fileChanged { // deleted in the store
+			delete(s.state, title)
+			return false, s.removeFile(lf.name)
+		}
+		return true, s.importFile(ctx, title, lf)
+
+	case inStore && inDir:
+		switch {
+		case st == nil, storeChanged && fileChanged:
+			return false, s.export(ctx, title, lf)
+		case storeChanged:
+			return false, s.export(ctx, title, nil)
+		case fileChanged:
+			return true, s.importFile(ctx, title, lf)
+		}
+	}
+	return false, nil
+}
+
+func (s *Syncer) removeFile(name string) (error) {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if strings.HasSuffix(name, ".md") {
+		os.Remove(filepath.Join(s.Dir, name + ".meta"))
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// export writes a tiddler from the store to Dir.
+// A different local version, if any, is kept as <file>.conflict.
+func (s *Syncer) export(ctx context.Context, title string, conflict *localFile) (error) {
+	t, err := s.Store.Get(ctx, title)
+	if err != nil {
+		return err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return err
+	}
+
+	typ, _ := js["type"].(string)
+	name := store.TitleToFile(title) + ".tid"
+	data := store.EncodeTid(js)
+	var meta []byte
+	if isMarkdown(typ) {
+		name = store.TitleToFile(title) + ".md"
+		text, _ := js["text"].(string)
+		meta = store.EncodeTid(withoutText(js))
+		meta = meta[:len(meta) - 1] // no text part in .meta
+		data = []byte(text)
+	}
+
+	if conflict != nil {
+		old, err := ioutil.ReadFile(filepath.Join(s.Dir, conflict.name))
+		if err != nil {
+			return err
+		}
+		if string(old) != string(data) {
+			log.Printf("[dirsync] %q changed on both sides, local copy saved as %s.conflict", title, conflict.name)
+			err = ioutil.WriteFile(filepath.Join(s.Dir, conflict.name + ".conflict"), old, 0644)
+			if err != nil {
+				return err
+			}
+		}
+		if conflict.name != name {
+			s.removeFile(conflict.name)
+		}
+	}
+
+	if meta != nil {
+		err = writeFile(filepath.Join(s.Dir, name + ".meta"), meta)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeFile(filepath.Join(s.Dir, name), data)
+	if err != nil {
+		return err
+	}
+
+	rev, _ := js["revision"].(float64)
+	return s.remember(title, name, int(rev))
+}
+
+func withoutText(js map[string]interface{}) (map[string]interface{}) {
+	m := make(map[string]interface{}, len(js))
+	for k, v := range js {
+		if k != "text" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// importFile saves a local file into the store.
+func (s *Syncer) importFile(ctx context.Context, title string, lf *localFile) (error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, lf.name))
+	if err != nil {
+		return err
+	}
+
+	var js map[string]interface{}
+	if strings.HasSuffix(lf.name, ".md") {
+		js = map[string]interface{}{"type": "text/x-markdown"}
+		if meta, err := ioutil.ReadFile(filepath.Join(s.Dir, lf.name + ".meta")); err == nil {
+			js, err = store.DecodeTid(meta)
+			if err != nil {
+				return err
+			}
+		}
+		js["text"] = string(data)
+	} else {
+		js, err = store.DecodeTid(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	js["title"] = title
+	js["bag"] = "bag"
+	js["modified"] = time.Unix(0, lf.modTime).UTC().Format("20060102150405000")
+	if _, ok := js["created"]; !ok {
+		js["created"] = js["modified"]
+	}
+	delete(js, "revision")
+
+	rev, err := s.Store.Put(ctx, store.Tiddler{Key: title, Js: js})
+	if err != nil {
+		return err
+	}
+	return s.remember(title, lf.name, rev)
+}
+
+// remember records the current state of a synced file.
+func (s *Syncer) remember(title string, name string, rev int) (error) {
+	fi, err := os.Stat(filepath.Join(s.Dir, name))
+	if err != nil {
+		return err
+	}
+	st := &fileState{File: name, Rev: rev, ModTime: fi.ModTime().UnixNano(), Size: fi.Size()}
+	if strings.HasSuffix(name, ".md") {
+		if mi, err := os.Stat(filepath.Join(s.Dir, name + ".meta")); err == nil {
+			st.ModTime += mi.ModTime().UnixNano()
+			st.Size += mi.Size()
+		}
+	}
+	s.state[title] = st
+	return nil
+}
+
+func (s *Syncer) saveState() (error) {
+	data, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.Dir, StateFile), data)
+}
+
+// writeFile replaces fpath atomically.
+func writeFile(fpath string, data []byte) (error) {
+	tmp := fpath + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
@@ -0,0 +1,128 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dirsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../store"
+	"../store/flatFile"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	wd, _ := os.Getwd()
+	dbDir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+
+	put := func(title, text string) {
+		js := map[string]interface{}{"title": title, "text": text, "type": "text/vnd.tiddlywiki"}
+		if _, err := db.Put(ctx, store.Tiddler{Key: title, Js: js}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+	text := func(title string) string {
+		td, err := db.Get(ctx, title)
+		if err != nil {
+			return ""
+		}
+		s, _ := td.Js["text"].(string)
+		return s
+	}
+
+	put("From Store", "one")
+	put("$:/StoryList", "skipped")
+	ioutil.WriteFile(filepath.Join(dir, "From Dir.tid"), []byte("tags: x\n\ntwo"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Notes.md"), []byte("# three"), 0644)
+
+	s, err := New(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := false
+	s.OnChange = func() { changed = true }
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read("From Store.tid"); got != "title: From Store\ntype: text/vnd.tiddlywiki\n\none" {
+		t.Errorf("exported: got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "$%3A%2FStoryList.tid")); err == nil {
+		t.Errorf("system tiddler exported")
+	}
+	if text("From Dir") != "two" || text("Notes") != "# three" || !changed {
+		t.Errorf("imported: got %q %q %v", text("From Dir"), text("Notes"), changed)
+	}
+
+	// local edit goes to the store, store edit goes to the file
+	ioutil.WriteFile(filepath.Join(dir, "From Dir.tid"), []byte("tags: x\n\ntwo edited"), 0644)
+	put("From Store", "one edited")
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if text("From Dir") != "two edited" {
+		t.Errorf("local edit: got %q", text("From Dir"))
+	}
+	if got := read("From Store.tid"); got != "title: From Store\ntype: text/vnd.tiddlywiki\n\none edited" {
+		t.Errorf("store edit: got %q", got)
+	}
+
+	// both sides changed: the store wins
+	ioutil.WriteFile(filepath.Join(dir, "From Store.tid"), []byte("title: From Store\n\nlocal"), 0644)
+	put("From Store", "remote")
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if text("From Store") != "remote" || read("From Store.tid.conflict") != "title: From Store\n\nlocal" {
+		t.Errorf("conflict: got %q %q", text("From Store"), read("From Store.tid.conflict"))
+	}
+
+	// deletes on both sides
+	os.Remove(filepath.Join(dir, "From Dir.tid"))
+	db.Delete(ctx, "Notes")
+	if err := s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, "From Dir"); err != store.ErrNotFound {
+		t.Errorf("local delete: want ErrNotFound, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Notes.md")); !os.IsNotExist(err) {
+		t.Errorf("store delete: Notes.md still exists")
+	}
+
+	// the state survives a restart
+	s, err = New(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed = false
+	s.OnChange = func() { changed = true }
+	if err := s.Sync(ctx); err != nil || changed {
+		t.Errorf("resync: want no changes, got %v %v", err, changed)
+	}
+}
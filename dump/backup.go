@@ -0,0 +1,350 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// incremental backups: content addressed revisions and a snapshot listing them
+package dump
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+// Target keeps the objects of the backups, e.g. a folder (Dir), a bucket or a WebDAV share.
+// Names are slash separated paths.
+type Target interface {
+	// Get opens the object name, an error matching os.ErrNotExist when there is none.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Put(ctx context.Context, name string, r io.Reader, size int64) (error)
+}
+
+// A backup is written as
+//
+//	objects/<ab>/<sha256>        a revision or a file, gzip compressed, written once
+//	snapshots/<time>.json.gz     a Snapshot listing the objects of every tiddler
+//	latest                       the name of the newest snapshot
+//
+// Every snapshot is complete, the objects it shares with the previous one are not written again.
+const (
+	objectsDir   = "objects/"
+	snapshotsDir = "snapshots/"
+	latestName   = "latest"
+)
+
+// Snapshot is the state of a wiki in a backup.
+type Snapshot struct {
+	Format   string            `json:"format"`
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Previous string            `json:"previous,omitempty"`
+	Tiddlers map[string]*Entry `json:"tiddlers"`
+	Files    map[string]string `json:"files,omitempty"` // objects by file name
+}
+
+// Entry is a tiddler in a Snapshot.
+type Entry struct {
+	Rev      int      `json:"rev"` // head revision in the store backed up
+	Modified string   `json:"modified,omitempty"`
+	Objects  []string `json:"objects"` // the revisions of the history, oldest first, then the head
+}
+
+// Dir is a Target keeping the objects in a local folder.
+type Dir string
+
+func (d Dir) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// Put writes a temporary file renamed to name once complete.
+func (d Dir) Put(_ context.Context, name string, r io.Reader, size int64) (error) {
+	p := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p + ".tmp", p)
+	}
+	if err != nil {
+		os.Remove(p + ".tmp")
+	}
+	return err
+}
+
+// LatestSnapshot returns the name of the newest snapshot of t, empty when there is none.
+func LatestSnapshot(ctx context.Context, t Target) (string, error) {
+	rc, err := t.Get(ctx, latestName)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, 1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ReadSnapshot reads the snapshot name of t.
+func ReadSnapshot(ctx context.Context, t Target, name string) (*Snapshot, error) {
+	data, err := getObject(ctx, t, name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil || s.Format != Format {
+		return nil, ErrFormat
+	}
+	if s.Version > Version {
+		return nil, fmt.Errorf("dump version %d is newer than %d, upgrade widdly first", s.Version, Version)
+	}
+	return s, nil
+}
+
+// getObject reads the gzip compressed object name of t.
+func getObject(ctx context.Context, t Target, name string) ([]byte, error) {
+	rc, err := t.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return ioutil.ReadAll(zr)
+}
+
+func putObject(ctx context.Context, t Target, name string, data []byte) (int64, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	n := int64(buf.Len())
+	return n, t.Put(ctx, name, &buf, n)
+}
+
+// objectName returns the name of the object of data.
+func objectName(data []byte) (string) {
+	sum := sha256.Sum256(data)
+	h := hex.EncodeToString(sum[:])
+	return objectsDir + h[:2] + "/" + h
+}
+
+// backup writes the snapshots of one Backup.
+type backup struct {
+	ctx   context.Context
+	t     Target
+	known map[string]bool // objects written by this or the previous snapshot
+	st    *Stats
+}
+
+// object writes data unless known and returns its name.
+func (b *backup) object(data []byte) (string, error) {
+	name := objectName(data)
+	if b.known[name] {
+		return name, nil
+	}
+	n, err := putObject(b.ctx, b.t, name, data)
+	if err != nil {
+		return "", err
+	}
+	b.known[name] = true
+	b.st.Objects++
+	b.st.Bytes += n
+	return name, nil
+}
+
+// Backup writes a snapshot of db and files, by name, to t, and returns its name.
+// Only the tiddlers whose revision or modified field changed since the previous snapshot
+// are read again, and only the revisions and files t does not have yet are written,
+// so a nightly backup of a large wiki is small. Stats counts the tiddlers read (Changed),
+// the objects and bytes written.
+func Backup(ctx context.Context, t Target, db store.TiddlerStore, files map[string][]byte) (string, Stats, error) {
+	var st Stats
+	prevName, err := LatestSnapshot(ctx, t)
+	if err != nil {
+		return "", st, err
+	}
+	prev := &Snapshot{}
+	if prevName != "" {
+		if prev, err = ReadSnapshot(ctx, t, prevName); err != nil {
+			return "", st, err
+		}
+	}
+	b := &backup{ctx: ctx, t: t, known: make(map[string]bool), st: &st}
+	for _, e := range prev.Tiddlers {
+		for _, name := range e.Objects {
+			b.known[name] = true
+		}
+	}
+	for _, name := range prev.Files {
+		b.known[name] = true
+	}
+
+	snap := &Snapshot{Format: Format, Version: Version, Created: time.Now().UTC(), Previous: prevName,
+		Tiddlers: make(map[string]*Entry), Files: make(map[string]string)}
+	all, err := db.All(ctx)
+	if err != nil {
+		return "", st, err
+	}
+	for _, td := range all {
+		js, err := td.Fields()
+		if err != nil {
+			return "", st, err
+		}
+		title, _ := js["title"].(string)
+		rev := intOf(js["revision"])
+		modified, _ := js["modified"].(string)
+		if old, ok := prev.Tiddlers[title]; ok && old.Rev == rev && old.Modified == modified {
+			snap.Tiddlers[title] = old
+			st.Tiddlers++
+			st.Revisions += len(old.Objects) - 1
+			continue
+		}
+
+		rec, err := readTiddler(ctx, db, title)
+		if err == store.ErrNotFound { // deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return "", st, fmt.Errorf("%s: %v", title, err)
+		}
+		e := &Entry{Rev: rev, Modified: modified}
+		for _, fields := range append(rec.History, rec.Tiddler) {
+			data, err := json.Marshal(fields)
+			if err != nil {
+				return "", st, err
+			}
+			name, err := b.object(data)
+			if err != nil {
+				return "", st, err
+			}
+			e.Objects = append(e.Objects, name)
+		}
+		snap.Tiddlers[title] = e
+		st.Tiddlers++
+		st.Revisions += len(rec.History)
+		st.Changed++
+	}
+	for fname, data := range files {
+		name, err := b.object(data)
+		if err != nil {
+			return "", st, err
+		}
+		snap.Files[fname] = name
+		st.Files++
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return "", st, err
+	}
+	name := snapshotsDir + snap.Created.Format("20060102T150405.000Z") + ".json.gz"
+	if _, err := putObject(ctx, t, name, data); err != nil {
+		return "", st, err
+	}
+	if err := t.Put(ctx, latestName, strings.NewReader(name + "\n"), int64(len(name) + 1)); err != nil {
+		return "", st, err
+	}
+	return name, st, nil
+}
+
+// Restore loads the snapshot name of t, the latest one when empty, into db like Read an archive,
+// and returns its files.
+func Restore(ctx context.Context, t Target, name string, db store.TiddlerStore) (Stats, map[string][]byte, error) {
+	var st Stats
+	all, err := db.All(ctx)
+	if err != nil {
+		return st, nil, err
+	}
+	if len(all) > 0 {
+		return st, nil, ErrNotEmpty
+	}
+	if name == "" {
+		if name, err = LatestSnapshot(ctx, t); err != nil {
+			return st, nil, err
+		}
+		if name == "" {
+			return st, nil, errors.New("dump: no backup found")
+		}
+	} else if !strings.Contains(name, "/") {
+		name = path.Join(snapshotsDir, name)
+	}
+	snap, err := ReadSnapshot(ctx, t, name)
+	if err != nil {
+		return st, nil, err
+	}
+
+	titles := make([]string, 0, len(snap.Tiddlers))
+	for title := range snap.Tiddlers {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		objects := snap.Tiddlers[title].Objects
+		for _, obj := range objects {
+			data, err := getObject(ctx, t, obj)
+			if err != nil {
+				return st, nil, fmt.Errorf("%s: %v", title, err)
+			}
+			var js map[string]interface{}
+			if err := json.Unmarshal(data, &js); err != nil || js == nil {
+				return st, nil, fmt.Errorf("%s: %s is not a tiddler", title, obj)
+			}
+			if err := put(ctx, db, title, js); err != nil {
+				return st, nil, fmt.Errorf("%s: %v", title, err)
+			}
+		}
+		st.Tiddlers++
+		st.Revisions += len(objects) - 1
+	}
+
+	files := make(map[string][]byte)
+	for fname, obj := range snap.Files {
+		data, err := getObject(ctx, t, obj)
+		if err != nil {
+			return st, files, fmt.Errorf("%s: %v", fname, err)
+		}
+		files[fname] = data
+		st.Files++
+	}
+	return st, files, nil
+}
@@ -0,0 +1,243 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package dump writes a whole wiki to a portable archive and loads it into another store,
+// of any backend: the tiddlers with their history, the private $:/widdly/ ones too (the
+// accounts kept in the store, the settings, the per user preferences), and server files
+// like the user list.
+//
+// An archive is gzip compressed JSON, a Header followed by one record per tiddler or file.
+// Backup writes incremental backups instead, see Target.
+package dump
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"../store"
+)
+
+// Format and Version identify an archive in its Header.
+const (
+	Format  = "widdly-dump"
+	Version = 1
+)
+
+var (
+	// ErrFormat is returned by Read for data which is not an archive of a known version.
+	ErrFormat = errors.New("not a widdly dump")
+
+	// ErrNotEmpty is returned by Read for a store which already has tiddlers.
+	ErrNotEmpty = errors.New("the store is not empty")
+)
+
+// Header is the first value of an archive.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// record is every other value: a tiddler with its history, or a file.
+type record struct {
+	Tiddler map[string]interface{}   `json:"tiddler,omitempty"` // fat, without revision
+	History []map[string]interface{} `json:"history,omitempty"` // fat, oldest first, the head excluded
+
+	File string `json:"file,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// Stats counts what was written or read.
+type Stats struct {
+	Tiddlers  int
+	Revisions int // of the history, the heads excluded
+	Files     int
+
+	// by Backup
+	Changed int   // tiddlers read again
+	Objects int   // revisions and files written
+	Bytes   int64 // of the objects written
+}
+
+// Write writes db and files, by name, as an archive to w.
+// The history is read from backends which are a store.RevisionStore.
+func Write(ctx context.Context, w io.Writer, db store.TiddlerStore, files map[string][]byte) (Stats, error) {
+	var st Stats
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(Header{Format: Format, Version: Version, Created: time.Now().UTC()}); err != nil {
+		return st, err
+	}
+
+	all, err := db.All(ctx)
+	if err != nil {
+		return st, err
+	}
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			return st, err
+		}
+		title, _ := js["title"].(string)
+		rec, err := readTiddler(ctx, db, title)
+		if err == store.ErrNotFound { // deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return st, fmt.Errorf("%s: %v", title, err)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return st, err
+		}
+		st.Tiddlers++
+		st.Revisions += len(rec.History)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := enc.Encode(record{File: name, Data: files[name]}); err != nil {
+			return st, err
+		}
+		st.Files++
+	}
+	return st, zw.Close()
+}
+
+// readTiddler returns the record of the tiddler title of db.
+func readTiddler(ctx context.Context, db store.TiddlerStore, title string) (*record, error) {
+	t, err := db.Get(ctx, title)
+	if err != nil {
+		return nil, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, err
+	}
+	head := intOf(js["revision"])
+	delete(js, "revision")
+	rec := &record{Tiddler: js}
+
+	revs, err := store.ListRevisions(ctx, db, title)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Rev >= head { // the head itself, written again by its Put
+			continue
+		}
+		old, err := store.GetRevision(ctx, db, title, revs[i].Rev)
+		if err == store.ErrNotFound { // pruned meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields, err := old.Fields()
+		if err != nil {
+			return nil, err
+		}
+		delete(fields, "revision")
+		rec.History = append(rec.History, fields)
+	}
+	return rec, nil
+}
+
+func intOf(v interface{}) (int) {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// Read loads the archive of r into db, which must have no tiddlers, and returns its files.
+// Each tiddler is put once per revision of its history, then once more as it was:
+// db numbers the revisions itself, from 2 on, and keeps as many as its history limits allow.
+func Read(ctx context.Context, r io.Reader, db store.TiddlerStore) (Stats, map[string][]byte, error) {
+	var st Stats
+	all, err := db.All(ctx)
+	if err != nil {
+		return st, nil, err
+	}
+	if len(all) > 0 {
+		return st, nil, ErrNotEmpty
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return st, nil, ErrFormat
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(zr)
+	var h Header
+	if err := dec.Decode(&h); err != nil || h.Format != Format {
+		return st, nil, ErrFormat
+	}
+	if h.Version > Version {
+		return st, nil, fmt.Errorf("dump version %d is newer than %d, upgrade widdly first", h.Version, Version)
+	}
+
+	files := make(map[string][]byte)
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return st, files, err
+		}
+		if rec.File != "" {
+			files[rec.File] = rec.Data
+			st.Files++
+			continue
+		}
+		if rec.Tiddler == nil {
+			continue
+		}
+		title, _ := rec.Tiddler["title"].(string)
+		if title == "" {
+			return st, files, errors.New("dump: a tiddler without title")
+		}
+		for _, js := range append(rec.History, rec.Tiddler) {
+			if err := put(ctx, db, title, js); err != nil {
+				return st, files, fmt.Errorf("%s: %v", title, err)
+			}
+		}
+		st.Tiddlers++
+		st.Revisions += len(rec.History)
+	}
+	return st, files, nil
+}
+
+// put saves the fields js as the tiddler title, with history unless it never gets some.
+func put(ctx context.Context, db store.TiddlerStore, title string, js map[string]interface{}) (error) {
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	_, err = db.Put(ctx, store.Tiddler{Key: title, Js: js, IsSys: store.NoHistory(meta)})
+	return err
+}
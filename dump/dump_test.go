@@ -0,0 +1,163 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dump
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"../store"
+	"../store/flatFile"
+)
+
+func openTemp(t *testing.T) store.TiddlerStore {
+	wd, _ := os.Getwd()
+	dir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDump(t *testing.T) {
+	ctx := context.Background()
+	src := openTemp(t)
+	defer src.Close()
+	put := func(title, text string) {
+		js := map[string]interface{}{"title": title, "text": text, "modified": "2024010100000" + text}
+		meta := []byte(`{"title":"` + title + `"}`)
+		if _, err := src.Put(ctx, store.Tiddler{Key: title, Js: js, IsSys: store.NoHistory(meta)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, text := range []string{"1", "2", "3"} {
+		put("Notes", text)
+	}
+	put("$:/widdly/settings", `{"anon_rate":5}`)
+	put("$:/widdly/account/joe/preferences", `{"editor":"vim"}`)
+
+	var buf bytes.Buffer
+	files := map[string][]byte{"user.lst": []byte("joe\tsalt\thash\n")}
+	st, err := Write(ctx, &buf, src, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tiddlers != 3 || st.Revisions != 2 || st.Files != 1 {
+		t.Errorf("write: unexpected %+v", st)
+	}
+
+	dst := openTemp(t)
+	defer dst.Close()
+	st, got, err := Read(ctx, bytes.NewReader(buf.Bytes()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tiddlers != 3 || st.Revisions != 2 || st.Files != 1 || string(got["user.lst"]) != string(files["user.lst"]) {
+		t.Errorf("read: unexpected %+v %q", st, got)
+	}
+	for _, title := range []string{"Notes", "$:/widdly/settings", "$:/widdly/account/joe/preferences"} {
+		want, _ := src.Get(ctx, title)
+		have, err := dst.Get(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Js["text"] != want.Js["text"] || have.Js["modified"] != want.Js["modified"] {
+			t.Errorf("%s: want %v, got %v", title, want.Js, have.Js)
+		}
+	}
+	revs, err := store.ListRevisions(ctx, dst, "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 || revs[2].Modified != "20240101000001" || revs[0].Modified != "20240101000003" {
+		t.Errorf("want the history loaded, got %+v", revs)
+	}
+	if revs, _ := store.ListRevisions(ctx, dst, "$:/widdly/settings"); len(revs) != 0 {
+		t.Errorf("want no history of system tiddlers, got %+v", revs)
+	}
+
+	if _, _, err := Read(ctx, bytes.NewReader(buf.Bytes()), dst); err != ErrNotEmpty {
+		t.Errorf("want a store with tiddlers refused, got %v", err)
+	}
+	if _, _, err := Read(ctx, bytes.NewReader([]byte("[]")), openTemp(t)); err != ErrFormat {
+		t.Errorf("want ErrFormat, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	src := openTemp(t)
+	defer src.Close()
+	put := func(title, text string) {
+		js := map[string]interface{}{"title": title, "text": text, "modified": "2024010100000" + text}
+		if _, err := src.Put(ctx, store.Tiddler{Key: title, Js: js}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("Notes", "1")
+	put("Notes", "2")
+	put("Other", "1")
+	files := map[string][]byte{"user.lst": []byte("joe\tsalt\thash\n")}
+	dir := Dir(t.TempDir())
+
+	first, st, err := Backup(ctx, dir, src, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tiddlers != 2 || st.Changed != 2 || st.Objects != 4 || st.Revisions != 1 {
+		t.Errorf("first backup: unexpected %+v", st)
+	}
+	if _, st, err = Backup(ctx, dir, src, files); err != nil || st.Changed != 0 || st.Objects != 0 || st.Tiddlers != 2 {
+		t.Errorf("unchanged backup: unexpected %+v %v", st, err)
+	}
+	put("Notes", "3")
+	if _, st, err = Backup(ctx, dir, src, files); err != nil || st.Changed != 1 || st.Objects != 1 || st.Revisions != 2 {
+		t.Errorf("incremental backup: unexpected %+v %v", st, err)
+	}
+
+	text := func(db store.TiddlerStore, title string) string {
+		td, err := db.Get(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := td.Js["text"].(string)
+		return s
+	}
+	dst := openTemp(t)
+	defer dst.Close()
+	st, got, err := Restore(ctx, dir, "", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tiddlers != 2 || st.Revisions != 2 || string(got["user.lst"]) != string(files["user.lst"]) {
+		t.Errorf("restore: unexpected %+v %q", st, got)
+	}
+	if revs, _ := store.ListRevisions(ctx, dst, "Notes"); text(dst, "Notes") != "3" || len(revs) != 3 {
+		t.Errorf("want the latest snapshot with its history, got %q %+v", text(dst, "Notes"), revs)
+	}
+
+	old := openTemp(t)
+	defer old.Close()
+	if _, _, err := Restore(ctx, dir, path.Base(first), old); err != nil {
+		t.Fatal(err)
+	}
+	if text(old, "Notes") != "2" {
+		t.Errorf("want the first snapshot, got %q", text(old, "Notes"))
+	}
+}
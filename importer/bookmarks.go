@@ -0,0 +1,192 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"html"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+func init() {
+	err := RegFormat("bookmarks", []string{".html", ".htm"}, convertBookmarks)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// indexFold is strings.Index ignoring ASCII case.
+func indexFold(s string, sub string) (int) {
+	return strings.Index(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// parseTag splits the inside of a HTML tag into its lower case name and attributes.
+func parseTag(tag string) (string, map[string]string) {
+	tag = strings.TrimSpace(strings.TrimSuffix(tag, "/"))
+	end := strings.IndexAny(tag, " \t\r\n")
+	if end < 0 {
+		return strings.ToLower(tag), nil
+	}
+	name := strings.ToLower(tag[:end])
+	s := tag[end:]
+
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+		eq := strings.IndexAny(s, "= \t\r\n")
+		if eq < 0 {
+			attrs[strings.ToLower(s)] = ""
+			break
+		}
+		key := strings.ToLower(s[:eq])
+		s = strings.TrimLeft(s[eq:], " \t\r\n")
+		if !strings.HasPrefix(s, "=") {
+			attrs[key] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t\r\n")
+
+		var val string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				end = len(s) - 1
+			}
+			val, s = s[1:end+1], s[min(end+2, len(s)):]
+		} else {
+			end := strings.IndexAny(s, " \t\r\n")
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+		}
+		attrs[key] = html.UnescapeString(val)
+	}
+	return name, attrs
+}
+
+func min(a, b int) (int) {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// unixDate converts a unix time attribute to a TiddlyWiki date, "" when invalid.
+func unixDate(s string) (string) {
+	sec, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || sec <= 0 {
+		return ""
+	}
+	if sec > 1e12 { // some browsers export micro seconds
+		sec /= 1e6
+	}
+	return TWDate(time.Unix(sec, 0))
+}
+
+// convertBookmarks reads a browser bookmark export (Netscape bookmark file format).
+// Folders and the TAGS attribute become tags, the <DD> description becomes the text.
+func convertBookmarks(r io.Reader) (*Batch, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+
+	tiddlers := make([]map[string]string, 0)
+	folders := make([]string, 0)
+	pending := ""
+	var last map[string]string
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			break
+		}
+		name, attrs := parseTag(s[:j])
+		s = s[j+1:]
+
+		switch name {
+		case "h3":
+			end := indexFold(s, "</h3")
+			if end < 0 {
+				end = len(s)
+			}
+			pending = html.UnescapeString(strings.TrimSpace(s[:end]))
+			last = nil
+		case "dl":
+			folders = append(folders, pending)
+			pending = ""
+		case "/dl":
+			if len(folders) > 0 {
+				folders = folders[:len(folders) - 1]
+			}
+		case "a":
+			end := indexFold(s, "</a")
+			if end < 0 {
+				end = len(s)
+			}
+			href := attrs["href"]
+			if href == "" || strings.HasPrefix(href, "place:") { // Firefox smart folders
+				last = nil
+				continue
+			}
+
+			tags := make([]string, 0, len(folders))
+			for _, f := range folders {
+				if f != "" {
+					tags = append(tags, f)
+				}
+			}
+			for _, tag := range strings.Split(attrs["tags"], ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+
+			last = map[string]string{
+				"title": html.UnescapeString(strings.TrimSpace(s[:end])),
+				"url": href,
+				"tags": store.StringifyTags(tags),
+				"created": unixDate(attrs["add_date"]),
+				"modified": unixDate(attrs["last_modified"]),
+				"text": "",
+			}
+			tiddlers = append(tiddlers, last)
+		case "dd":
+			if last == nil {
+				continue
+			}
+			end := strings.IndexByte(s, '<')
+			if end < 0 {
+				end = len(s)
+			}
+			last["text"] = html.UnescapeString(strings.TrimSpace(s[:end]))
+			last = nil
+		}
+	}
+	return &Batch{Tiddlers: tiddlers}, nil
+}
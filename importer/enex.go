@@ -0,0 +1,179 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+func init() {
+	err := RegFormat("enex", []string{".enex"}, convertENEX)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type enexResource struct {
+	Data     string `xml:"data"`
+	Mime     string `xml:"mime"`
+	FileName string `xml:"resource-attributes>file-name"`
+}
+
+type enexNote struct {
+	Title     string         `xml:"title"`
+	Content   string         `xml:"content"`
+	Created   string         `xml:"created"`
+	Updated   string         `xml:"updated"`
+	Tags      []string       `xml:"tag"`
+	SourceURL string         `xml:"note-attributes>source-url"`
+	Author    string         `xml:"note-attributes>author"`
+	Resources []enexResource `xml:"resource"`
+}
+
+// enexDate converts an ENEX date (20130730T205204Z) to a TiddlyWiki date, "" when invalid.
+func enexDate(s string) (string) {
+	t, err := time.Parse("20060102T150405Z", strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return TWDate(t)
+}
+
+// convertENEX reads an Evernote export. The note HTML is kept as is inside wikitext,
+// <en-media> turns into images or links to the attachments in files/evernote/<note>/.
+func convertENEX(r io.Reader) (*Batch, error) {
+	batch := &Batch{Files: make(map[string][]byte)}
+
+	dec := xml.NewDecoder(r)
+	dec.Strict = false // DOCTYPE & entities of old exports
+	dec.Entity = xml.HTMLEntity
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+
+		var note enexNote
+		err = dec.DecodeElement(&note, &start)
+		if err != nil {
+			return nil, err
+		}
+
+		media := make(map[string]string) // md5 hash -> <img> or <a>
+		dir := "evernote/" + FileName(note.Title)
+		for i, res := range note.Resources {
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(res.Data), ""))
+			if err != nil {
+				return nil, fmt.Errorf("note %q: %v", note.Title, err)
+			}
+			sum := md5.Sum(data)
+
+			name := FileName(res.FileName)
+			if res.FileName == "" {
+				name = fmt.Sprintf("attachment-%d", i + 1)
+				if exts, _ := mime.ExtensionsByType(res.Mime); len(exts) > 0 {
+					name += exts[0]
+				}
+			}
+			fpath := dir + "/" + name
+			batch.Files[fpath] = data
+
+			link := html.EscapeString(FileURL(fpath))
+			if strings.HasPrefix(res.Mime, "image/") {
+				media[hex.EncodeToString(sum[:])] = `<img src="` + link + `"/>`
+			} else {
+				media[hex.EncodeToString(sum[:])] = `<a href="` + link + `">` + html.EscapeString(name) + `</a>`
+			}
+		}
+
+		fields := map[string]string{
+			"title":    note.Title,
+			"tags":     store.StringifyTags(note.Tags),
+			"created":  enexDate(note.Created),
+			"modified": enexDate(note.Updated),
+			"text":     enexContent(note.Content, media),
+		}
+		if note.SourceURL != "" {
+			fields["url"] = note.SourceURL
+		}
+		if note.Author != "" {
+			fields["creator"] = note.Author
+		}
+		batch.Tiddlers = append(batch.Tiddlers, fields)
+	}
+	return batch, nil
+}
+
+// enexContent returns the inside of <en-note> with <en-media> and <en-todo> replaced.
+func enexContent(content string, media map[string]string) (string) {
+	if start := indexFold(content, "<en-note"); start >= 0 {
+		content = content[start:]
+		if end := strings.IndexByte(content, '>'); end >= 0 {
+			content = content[end+1:]
+		}
+	}
+	if end := indexFold(content, "</en-note>"); end >= 0 {
+		content = content[:end]
+	}
+
+	var buf strings.Builder
+	for {
+		i := indexFold(content, "<en-")
+		if i < 0 {
+			buf.WriteString(content)
+			break
+		}
+		buf.WriteString(content[:i])
+		content = content[i+1:]
+		j := strings.IndexByte(content, '>')
+		if j < 0 {
+			break
+		}
+		name, attrs := parseTag(content[:j])
+		content = content[j+1:]
+
+		switch name {
+		case "en-media":
+			buf.WriteString(media[strings.ToLower(attrs["hash"])])
+			if end := indexFold(content, "</en-media>"); end >= 0 && strings.TrimSpace(content[:end]) == "" {
+				content = content[end+len("</en-media>"):]
+			}
+		case "en-todo":
+			if attrs["checked"] == "true" {
+				buf.WriteString(`<input type="checkbox" checked disabled/>`)
+			} else {
+				buf.WriteString(`<input type="checkbox" disabled/>`)
+			}
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,315 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package importer converts export files of other applications into tiddlers.
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+var (
+	ErrFormatExist = errors.New("same import format exist")
+	ErrFormatNotExist = errors.New("import format not exist")
+
+	formatlist = make(map[string]*Format)
+)
+
+// Batch is the result of a Converter.
+type Batch struct {
+	// Tiddlers as TiddlyWiki fields, see store.FromFlatFields.
+	Tiddlers []map[string]string
+
+	// Files are the attachments linked by the tiddlers as "files/<path>",
+	// by slash separated path inside the files directory.
+	Files map[string][]byte
+}
+
+// Converter reads an export file.
+type Converter func(r io.Reader) (*Batch, error)
+
+// DirConverter reads an export directory.
+type DirConverter func(dir string) (*Batch, error)
+
+// Format is a registered import format, reading either files or directories.
+type Format struct {
+	Name string
+	Exts []string // file extensions with the dot, for guessing the format
+	Convert Converter
+	ConvertDir DirConverter
+}
+
+// RegFormat registers a converter for the format name and file extensions.
+func RegFormat(nameo string, exts []string, fn Converter) (error) {
+	if fn == nil {
+		return ErrFormatNotExist
+	}
+	name := strings.ToLower(nameo)
+	_, ok := formatlist[name]
+	if ok {
+		return ErrFormatExist
+	}
+	formatlist[name] = &Format{
+		Name: nameo,
+		Exts: exts,
+		Convert: fn,
+	}
+	return nil
+}
+
+// RegDirFormat registers a converter of directories for the format name.
+func RegDirFormat(nameo string, fn DirConverter) (error) {
+	if fn == nil {
+		return ErrFormatNotExist
+	}
+	name := strings.ToLower(nameo)
+	_, ok := formatlist[name]
+	if ok {
+		return ErrFormatExist
+	}
+	formatlist[name] = &Format{
+		Name: nameo,
+		ConvertDir: fn,
+	}
+	return nil
+}
+
+// ListFormat returns the registered format names.
+func ListFormat() ([]string) {
+	list := make([]string, 0, len(formatlist))
+	for _, f := range formatlist {
+		list = append(list, f.Name)
+	}
+	return list
+}
+
+// Lookup returns the format by name, or guessed from fileName when name is empty:
+// by extension for files, the first directory format for directories.
+func Lookup(name string, fileName string) (*Format, error) {
+	if name != "" {
+		f, ok := formatlist[strings.ToLower(name)]
+		if !ok {
+			return nil, ErrFormatNotExist
+		}
+		return f, nil
+	}
+
+	if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+		for _, f := range formatlist {
+			if f.ConvertDir != nil {
+				return f, nil
+			}
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, f := range formatlist {
+		for _, e := range f.Exts {
+			if e == ext {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%v: cannot guess the format of %q", ErrFormatNotExist, fileName)
+}
+
+// ConvertFile converts the file or directory fpath with format f.
+func ConvertFile(f *Format, fpath string) (*Batch, error) {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		if f.ConvertDir == nil {
+			return nil, fmt.Errorf("%s does not import directories", f.Name)
+		}
+		return f.ConvertDir(fpath)
+	}
+	if f.Convert == nil {
+		return nil, fmt.Errorf("%s only imports directories", f.Name)
+	}
+
+	r, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return f.Convert(r)
+}
+
+// TWDate formats t as a TiddlyWiki date field.
+func TWDate(t time.Time) (string) {
+	return t.UTC().Format("20060102150405") + fmt.Sprintf("%03d", t.Nanosecond() / 1e6)
+}
+
+// Options of Import.
+type Options struct {
+	// Tag is added to every imported tiddler, empty for none.
+	Tag string
+
+	// Overwrite replaces existing tiddlers, otherwise they are skipped.
+	Overwrite bool
+
+	// FilesDir is the files directory (-files) receiving the attachments, empty to skip them.
+	FilesDir string
+}
+
+// Report tells what Import did.
+type Report struct {
+	Saved int
+	Files int
+
+	// Skipped are the existing titles which were not overwritten.
+	Skipped []string
+
+	// Renamed are the titles repeated in the batch, saved with a " (2)", " (3)"... suffix.
+	Renamed []string
+
+	// FilesSkipped are the attachments not written: existing with another content, or without FilesDir.
+	FilesSkipped []string
+}
+
+// Import saves a batch into db and its attachments into opt.FilesDir.
+func Import(ctx context.Context, db store.TiddlerStore, batch *Batch, opt Options) (*Report, error) {
+	rep := &Report{}
+	err := importFiles(batch.Files, opt.FilesDir, rep)
+	if err != nil {
+		return rep, err
+	}
+
+	now := TWDate(time.Now())
+	seen := make(map[string]int, len(batch.Tiddlers))
+	for _, fields := range batch.Tiddlers {
+		title := strings.TrimSpace(fields["title"])
+		if title == "" {
+			title = fields["url"]
+		}
+		if title == "" {
+			continue
+		}
+		seen[title]++
+		if n := seen[title]; n > 1 {
+			title = fmt.Sprintf("%s (%d)", title, n)
+			rep.Renamed = append(rep.Renamed, title)
+		}
+		fields["title"] = title
+
+		if opt.Tag != "" {
+			tags := store.ParseTags(fields["tags"])
+			tags = append(tags, opt.Tag)
+			fields["tags"] = store.StringifyTags(tags)
+		}
+		if fields["type"] == "" {
+			fields["type"] = "text/vnd.tiddlywiki"
+		}
+		if fields["created"] == "" {
+			fields["created"] = now
+		}
+		if fields["modified"] == "" {
+			fields["modified"] = fields["created"]
+		}
+
+		if !opt.Overwrite {
+			if _, err := db.Get(ctx, title); err == nil {
+				rep.Skipped = append(rep.Skipped, title)
+				continue
+			}
+		}
+
+		js := store.FromFlatFields(fields)
+		js["bag"] = "bag"
+		_, err = db.Put(ctx, store.Tiddler{
+			Key: title,
+			Js: js,
+			IsSys: strings.HasPrefix(title, "$:/"),
+		})
+		if err != nil {
+			return rep, err
+		}
+		rep.Saved++
+	}
+	return rep, nil
+}
+
+// importFiles writes the attachments, never replacing a different existing file.
+func importFiles(files map[string][]byte, dir string, rep *Report) (error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if dir == "" {
+			rep.FilesSkipped = append(rep.FilesSkipped, name)
+			continue
+		}
+
+		fpath := filepath.Join(dir, filepath.FromSlash(path.Clean("/" + name)))
+		old, err := ioutil.ReadFile(fpath)
+		if err == nil {
+			if !bytes.Equal(old, files[name]) {
+				rep.FilesSkipped = append(rep.FilesSkipped, name)
+			}
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(fpath), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(fpath, files[name], 0644)
+		if err != nil {
+			return err
+		}
+		rep.Files++
+	}
+	return nil
+}
+
+// FileName makes s safe as one path element of an attachment.
+func FileName(s string) (string) {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|#%`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if s == "" || s == "." || s == ".." {
+		s = "_"
+	}
+	return s
+}
+
+// FileURL is the link to an attachment, relative to the wiki.
+func FileURL(name string) (string) {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return "files/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,290 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../store"
+	"../store/flatFile"
+)
+
+const bookmarksHTML = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1556000000">Dev &amp; Ops</H3>
+    <DL><p>
+        <DT><A HREF="https://golang.org/" ADD_DATE="1556000001" TAGS="go,lang">The Go Programming Language</A>
+        <DD>Go &lt;home&gt;
+        <DT><A HREF="place:sort=8">Recent Tags</A>
+    </DL><p>
+    <DT><A HREF="https://tiddlywiki.com/">TiddlyWiki</A>
+</DL><p>`
+
+const opmlXML = `<?xml version="1.0"?>
+<opml version="2.0"><head><title>feeds</title></head><body>
+<outline text="Blogs">
+	<outline text="Go Blog" type="rss" xmlUrl="https://blog.golang.org/feed.atom" htmlUrl="https://blog.golang.org/" category="/Tech/Go"/>
+</outline>
+<outline text="Idea" _note="write more"/>
+</body></opml>`
+
+func TestBookmarks(t *testing.T) {
+	batch, err := convertBookmarks(strings.NewReader(bookmarksHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiddlers := batch.Tiddlers
+	if len(tiddlers) != 2 {
+		t.Fatalf("want 2 bookmarks, got %v", tiddlers)
+	}
+	go1 := tiddlers[0]
+	if go1["title"] != "The Go Programming Language" || go1["url"] != "https://golang.org/" ||
+		go1["tags"] != "[[Dev & Ops]] go lang" || go1["text"] != "Go <home>" || go1["created"] != "20190423061321000" {
+		t.Errorf("got %v", go1)
+	}
+	if tiddlers[1]["tags"] != "" {
+		t.Errorf("want no tags outside folders, got %q", tiddlers[1]["tags"])
+	}
+}
+
+func TestOPML(t *testing.T) {
+	batch, err := convertOPML(strings.NewReader(opmlXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiddlers := batch.Tiddlers
+	if len(tiddlers) != 2 {
+		t.Fatalf("want 2 outlines, got %v", tiddlers)
+	}
+	blog := tiddlers[0]
+	if blog["url"] != "https://blog.golang.org/" || blog["feed"] != "https://blog.golang.org/feed.atom" || blog["tags"] != "Blogs Tech Go" {
+		t.Errorf("got %v", blog)
+	}
+	if tiddlers[1]["title"] != "Idea" || tiddlers[1]["text"] != "write more" {
+		t.Errorf("got %v", tiddlers[1])
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	wd, _ := os.Getwd()
+	dir, _ := filepath.Rel(wd, t.TempDir())
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := Lookup("", "export.HTML")
+	if err != nil || f.Name != "bookmarks" {
+		t.Fatalf("want bookmarks format, got %v %v", f, err)
+	}
+
+	list := []map[string]string{
+		{"title": "Home", "url": "https://a.example/"},
+		{"title": "Home", "url": "https://b.example/"},
+		{"title": "", "url": "https://c.example/"},
+	}
+	rep, err := Import(ctx, db, &Batch{Tiddlers: list}, Options{Tag: "imported"})
+	if err != nil || rep.Saved != 3 || len(rep.Renamed) != 1 {
+		t.Fatalf("want 3 saved, 1 renamed, got %+v %v", rep, err)
+	}
+
+	td, err := db.Get(ctx, "Home (2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := store.FlatFields(td.Js)
+	if fields["url"] != "https://b.example/" || fields["tags"] != "imported" {
+		t.Errorf("got %v", fields)
+	}
+	if _, err := db.Get(ctx, "https://c.example/"); err != nil {
+		t.Errorf("want title from url, got %v", err)
+	}
+
+	rep, _ = Import(ctx, db, &Batch{Tiddlers: []map[string]string{{"title": "Home"}}}, Options{})
+	if rep.Saved != 0 || len(rep.Skipped) != 1 {
+		t.Errorf("want existing tiddler skipped, got %+v", rep)
+	}
+
+	files := t.TempDir()
+	ioutil.WriteFile(filepath.Join(files, "b.txt"), []byte("other"), 0644)
+	rep, err = Import(ctx, db, &Batch{Files: map[string][]byte{"x/a.txt": []byte("a"), "b.txt": []byte("b"), "../c": []byte("c")}}, Options{FilesDir: files})
+	if err != nil || rep.Files != 2 || len(rep.FilesSkipped) != 1 {
+		t.Errorf("want 2 files saved, 1 skipped, got %+v %v", rep, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(files, "c")); string(data) != "c" {
+		t.Errorf("want ../c inside the files directory, got %q", data)
+	}
+}
+
+const enexXML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export3.dtd">
+<en-export>
+<note><title>Trip</title>
+<content><![CDATA[<?xml version="1.0" encoding="UTF-8"?><!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note><div><en-todo checked="true"/>Pack</div><en-media hash="900150983cd24fb0d6963f7d28e17f72" type="image/png"/></en-note>]]></content>
+<created>20130730T205204Z</created>
+<tag>travel</tag><tag>summer 2013</tag>
+<note-attributes><source-url>https://example.com/</source-url></note-attributes>
+<resource><data encoding="base64">YWJj</data><mime>image/png</mime><resource-attributes><file-name>map 1.png</file-name></resource-attributes></resource>
+</note>
+</en-export>`
+
+func TestENEX(t *testing.T) {
+	batch, err := convertENEX(strings.NewReader(enexXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Tiddlers) != 1 {
+		t.Fatalf("want 1 note, got %v", batch.Tiddlers)
+	}
+	note := batch.Tiddlers[0]
+	want := `<div><input type="checkbox" checked disabled/>Pack</div><img src="files/evernote/Trip/map%201.png"/>`
+	if note["text"] != want {
+		t.Errorf("want text %q, got %q", want, note["text"])
+	}
+	if note["tags"] != "travel [[summer 2013]]" || note["created"] != "20130730205204000" || note["url"] != "https://example.com/" {
+		t.Errorf("got %v", note)
+	}
+	if string(batch.Files["evernote/Trip/map 1.png"]) != "abc" {
+		t.Errorf("want attachment, got %v", batch.Files)
+	}
+}
+
+func TestNotion(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"Books 0123456789abcdef0123456789abcdef.md": "# Books\n\n[Dune](Books%200123456789abcdef0123456789abcdef/Dune%20fedcba9876543210fedcba9876543210.md)\n",
+		"Books 0123456789abcdef0123456789abcdef/Dune fedcba9876543210fedcba9876543210.md": "# Dune\n\nAuthor: Frank Herbert\nTags: sf, classic\nCreated: July 30, 2021\n\n![cover](Dune/cover.png)\n",
+		"Books 0123456789abcdef0123456789abcdef/Dune/cover.png": "png",
+		"Books 0123456789abcdef0123456789abcdef.csv": "Name,Author\n",
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	batch, err := convertNotion(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := make(map[string]map[string]string)
+	for _, fields := range batch.Tiddlers {
+		pages[fields["title"]] = fields
+	}
+	if len(pages) != 2 {
+		t.Fatalf("want 2 pages, got %v", batch.Tiddlers)
+	}
+	if text := pages["Books"]["text"]; text != "[Dune](#Dune)" {
+		t.Errorf("want page link rewritten, got %q", text)
+	}
+	dune := pages["Dune"]
+	if dune["author"] != "Frank Herbert" || dune["tags"] != "Books sf classic" || dune["notion-created"] != "July 30, 2021" || dune["created"] != "" {
+		t.Errorf("got %v", dune)
+	}
+	if dune["text"] != "![cover](files/notion/Books/Dune/cover.png)" || dune["type"] != "text/x-markdown" {
+		t.Errorf("got %q", dune["text"])
+	}
+	if string(batch.Files["notion/Books/Dune/cover.png"]) != "png" || len(batch.Files) != 1 {
+		t.Errorf("want cover attachment only, got %v", batch.Files)
+	}
+}
+
+func TestNotionOrder(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"c 3.md", "a 1.md", "d 4.md", "b 2.md"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("# Same\n\n" + name))
+	}
+	zw.Close()
+
+	batch, err := convertNotion(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, fields := range batch.Tiddlers {
+		order = append(order, fields["text"])
+	}
+	if got := strings.Join(order, ","); got != "a 1.md,b 2.md,c 3.md,d 4.md" {
+		t.Errorf("want the pages in name order, got %s", got)
+	}
+}
+
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"Home.md": "---\ntitle: Welcome\ntags: [start, \"#index\"]\naliases:\n  - Start page\ncreated: 2021-07-30\n---\nSee [[Projects/Plan|the plan]], [[Plan#Goals]] and [[Missing]].\n![[diagram.png]]\n[spec](Projects/Spec%20v2.md)\n",
+		"Projects/Plan.md": "![d](../attachments/diagram.png)",
+		"Projects/Spec v2.md": "spec",
+		"attachments/diagram.png": "png",
+		".obsidian/app.json": "{}",
+	} {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		ioutil.WriteFile(fpath, []byte(content), 0644)
+	}
+
+	f, err := Lookup("", dir)
+	if err != nil || f.Name != "obsidian" {
+		t.Fatalf("want obsidian format for a directory, got %v %v", f, err)
+	}
+	batch, err := ConvertFile(f, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := make(map[string]map[string]string)
+	for _, fields := range batch.Tiddlers {
+		notes[fields["title"]] = fields
+	}
+	if len(notes) != 3 {
+		t.Fatalf("want 3 notes, got %v", batch.Tiddlers)
+	}
+
+	home := notes["Home"]
+	want := "See [the plan](#Plan), [Plan](#Plan) and [Missing](#Missing).\n![diagram.png](files/obsidian/attachments/diagram.png)\n[spec](#Spec%20v2)\n"
+	if home["text"] != want {
+		t.Errorf("want text %q, got %q", want, home["text"])
+	}
+	if home["caption"] != "Welcome" || home["tags"] != "start index" || home["aliases"] != "[[Start page]]" ||
+		home["created"] != "20210730000000000" || home["type"] != "text/x-markdown" {
+		t.Errorf("got %v", home)
+	}
+	if notes["Plan"]["text"] != "![d](files/obsidian/attachments/diagram.png)" || notes["Plan"]["folder"] != "Projects" {
+		t.Errorf("got %v", notes["Plan"])
+	}
+	if string(batch.Files["obsidian/attachments/diagram.png"]) != "png" || len(batch.Files) != 1 {
+		t.Errorf("want the linked image only, got %v", batch.Files)
+	}
+
+	LinkFiles = false
+	defer func() { LinkFiles = true }()
+	batch, _ = ConvertFile(f, dir)
+	if len(batch.Files) != 0 {
+		t.Errorf("want no files without LinkFiles, got %v", batch.Files)
+	}
+}
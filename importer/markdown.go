@@ -0,0 +1,57 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var mdLink = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)(\s+"[^"]*")?\)`)
+
+// rewriteLinks calls fn with the unescaped target of every Markdown link and image of text,
+// and replaces the target with its result, unchanged when "".
+func rewriteLinks(text string, fn func(target string, image bool) (string)) (string) {
+	return mdLink.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mdLink.FindStringSubmatch(m)
+		target := sub[3]
+		if strings.HasPrefix(target, "<") && strings.HasSuffix(target, ">") {
+			target = target[1 : len(target)-1]
+		}
+		if u, err := url.PathUnescape(target); err == nil {
+			target = u
+		}
+
+		repl := fn(target, sub[1] == "!")
+		if repl == "" {
+			return m
+		}
+		return sub[1] + "[" + sub[2] + "](" + repl + sub[4] + ")"
+	})
+}
+
+// tiddlerLink is the Markdown link target of a tiddler.
+func tiddlerLink(title string) (string) {
+	return "#" + url.PathEscape(title)
+}
+
+// isExternal tells whether a link target is an absolute URL or an anchor.
+func isExternal(target string) (bool) {
+	if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "//") {
+		return true
+	}
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme != ""
+}
@@ -0,0 +1,202 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"../store"
+)
+
+func init() {
+	err := RegFormat("notion", []string{".zip"}, convertNotion)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// notionID is the page id Notion appends to exported file and directory names.
+var notionID = regexp.MustCompile(` ?[0-9a-f]{32}(\.[^./]*)?$`)
+
+// notionClean strips the page ids from a slash separated path.
+func notionClean(p string) (string) {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = notionID.ReplaceAllString(parts[i], "$1")
+	}
+	return strings.Join(parts, "/")
+}
+
+// readZip returns the files of a zip archive, with the archives nested in it flattened.
+func readZip(data []byte, files map[string][]byte) (error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(strings.ToLower(f.Name), ".zip") {
+			err = readZip(content, files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		files[f.Name] = content
+	}
+	return nil
+}
+
+// convertNotion reads a Notion "Markdown & CSV" export zip.
+// Each page is a Markdown tiddler tagged with its parent page, the properties of database rows
+// become fields ("Tags" become tags), links to pages are rewritten to tiddler links
+// and the other files go to files/notion/. CSV files are not imported.
+func convertNotion(r io.Reader) (*Batch, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	err = readZip(data, files)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &Batch{Files: make(map[string][]byte)}
+
+	// in name order, so the same pages of an export get the same " (2)" suffixes on every run
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// page titles by path, from the "# Title" first line or the file name
+	titles := make(map[string]string)
+	for _, name := range names {
+		content := files[name]
+		if path.Ext(name) != ".md" {
+			continue
+		}
+		title := strings.TrimSuffix(path.Base(notionClean(name)), ".md")
+		line, _ := bufio.NewReader(bytes.NewReader(content)).ReadString('\n')
+		if strings.HasPrefix(line, "# ") {
+			title = strings.TrimSpace(line[2:])
+		}
+		titles[name] = title
+	}
+
+	for _, name := range names {
+		content := files[name]
+		switch path.Ext(name) {
+		case ".md":
+		case ".csv":
+			continue
+		default:
+			batch.Files["notion/" + notionClean(name)] = content
+			continue
+		}
+
+		fields := notionPage(string(content))
+		fields["title"] = titles[name]
+		fields["type"] = "text/x-markdown"
+
+		tags := store.ParseTags(fields["tags"])
+		if parent, ok := titles[path.Dir(name) + ".md"]; ok {
+			tags = append([]string{parent}, tags...)
+		}
+		fields["tags"] = store.StringifyTags(tags)
+
+		dir := path.Dir(name)
+		fields["text"] = rewriteLinks(fields["text"], func(target string, image bool) string {
+			if isExternal(target) {
+				return ""
+			}
+			p := path.Join(dir, target)
+			if title, ok := titles[p]; ok {
+				return tiddlerLink(title)
+			}
+			if _, ok := files[p]; ok {
+				return FileURL("notion/" + notionClean(p))
+			}
+			return ""
+		})
+		batch.Tiddlers = append(batch.Tiddlers, fields)
+	}
+	return batch, nil
+}
+
+// notionPage splits a page into its text and the "Key: Value" property lines after the title.
+func notionPage(content string) (map[string]string) {
+	fields := make(map[string]string)
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "# ") {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	props := 0
+	for _, line := range lines {
+		idx := strings.Index(line, ": ")
+		if idx <= 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			break
+		}
+		key := strings.ToLower(strings.Replace(strings.TrimSpace(line[:idx]), " ", "-", -1))
+		val := strings.TrimSpace(line[idx+2:])
+		if key == "tags" {
+			tags := make([]string, 0)
+			for _, tag := range strings.Split(val, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			val = store.StringifyTags(tags)
+		}
+		switch key {
+		case "title", "text", "type", "created", "modified", "creator", "modifier", "revision", "bag":
+			key = "notion-" + key // not in TiddlyWiki format
+		}
+		fields[key] = val
+		props++
+	}
+	if props > 0 && props < len(lines) && strings.TrimSpace(lines[props]) != "" { // not a property block
+		fields = make(map[string]string)
+		props = 0
+	}
+
+	fields["text"] = strings.TrimSpace(strings.Join(lines[props:], "\n"))
+	return fields
+}
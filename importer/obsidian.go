@@ -0,0 +1,353 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+var (
+	// LinkFiles copies the images and files linked by imported Markdown folders to files/obsidian/
+	// and rewrites the links to them, otherwise the links are left alone.
+	LinkFiles = true
+
+	wikiLink = regexp.MustCompile(`(!?)\[\[([^\]\|]+?)(\|[^\]]*)?\]\]`)
+)
+
+func init() {
+	err := RegDirFormat("obsidian", convertVault)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// vault indexes the notes and files of a Markdown folder.
+type vault struct {
+	dir   string
+	notes map[string]bool   // slash separated paths of .md files
+	files map[string]bool   // paths of the other files
+	names map[string]string // lower case base name (without .md for notes) -> first path
+}
+
+// resolve finds a link target, by path relative to the vault or by base name like Obsidian.
+func (v *vault) resolve(target string, note bool) (string, bool) {
+	target = strings.TrimPrefix(path.Clean("/" + target), "/")
+	if note && !strings.HasSuffix(strings.ToLower(target), ".md") {
+		if v.notes[target + ".md"] {
+			return target + ".md", true
+		}
+	}
+	if v.notes[target] || v.files[target] {
+		return target, true
+	}
+
+	name := strings.ToLower(path.Base(target))
+	if note {
+		name = strings.TrimSuffix(name, ".md")
+	}
+	p, ok := v.names[name]
+	return p, ok
+}
+
+// noteTitle is the title of a note: its file name without .md.
+func noteTitle(p string) (string) {
+	return strings.TrimSuffix(path.Base(p), path.Ext(p))
+}
+
+// convertVault reads a folder of Markdown files, like an Obsidian vault.
+// Front matter becomes fields ("tags" become tags, "title" the caption),
+// [[wikilinks]] and links to notes become tiddler links and,
+// with LinkFiles, linked images and files go to files/obsidian/.
+func convertVault(dir string) (*Batch, error) {
+	v := &vault{
+		dir:   dir,
+		notes: make(map[string]bool),
+		files: make(map[string]bool),
+		names: make(map[string]string),
+	}
+	paths := make([]string, 0)
+	err := filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") && fpath != dir { // .obsidian, .trash, .git
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// shortest paths first, so base name links go to the top most file
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+	for _, p := range paths {
+		name := strings.ToLower(path.Base(p))
+		if strings.HasSuffix(name, ".md") {
+			v.notes[p] = true
+			name = strings.TrimSuffix(name, ".md")
+		} else {
+			v.files[p] = true
+		}
+		if _, ok := v.names[name]; !ok {
+			v.names[name] = p
+		}
+	}
+
+	batch := &Batch{Files: make(map[string][]byte)}
+	for _, p := range paths {
+		if !v.notes[p] {
+			continue
+		}
+		fpath := filepath.Join(dir, filepath.FromSlash(p))
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return nil, err
+		}
+
+		fm, body := splitFrontMatter(string(data))
+		fields := frontMatterFields(fm)
+		fields["title"] = noteTitle(p)
+		fields["type"] = "text/x-markdown"
+		if d := path.Dir(p); d != "." {
+			fields["folder"] = d
+		}
+		if fields["modified"] == "" {
+			if fi, err := os.Stat(fpath); err == nil {
+				fields["modified"] = TWDate(fi.ModTime())
+			}
+		}
+		fields["text"] = v.rewrite(body, path.Dir(p), batch)
+		batch.Tiddlers = append(batch.Tiddlers, fields)
+	}
+	return batch, nil
+}
+
+// fileLink adds a vault file to the batch and returns its link, "" when LinkFiles is off.
+func (v *vault) fileLink(p string, batch *Batch) (string) {
+	if !LinkFiles {
+		return ""
+	}
+	name := "obsidian/" + p
+	if _, ok := batch.Files[name]; !ok {
+		data, err := ioutil.ReadFile(filepath.Join(v.dir, filepath.FromSlash(p)))
+		if err != nil {
+			return ""
+		}
+		batch.Files[name] = data
+	}
+	return FileURL(name)
+}
+
+// rewrite converts the wikilinks of a note to Markdown links and rewrites the relative links.
+func (v *vault) rewrite(text string, dir string, batch *Batch) (string) {
+	text = wikiLink.ReplaceAllStringFunc(text, func(m string) string {
+		sub := wikiLink.FindStringSubmatch(m)
+		embed := sub[1] == "!"
+		target := sub[2]
+		label := strings.TrimPrefix(sub[3], "|")
+		if idx := strings.IndexAny(target, "#^"); idx >= 0 { // heading or block
+			target = target[:idx]
+		}
+		target = strings.TrimSpace(target)
+
+		p, ok := v.resolve(target, true)
+		if ok && v.files[p] {
+			link := v.fileLink(p, batch)
+			if link == "" {
+				return m
+			}
+			if embed {
+				return "![" + path.Base(p) + "](" + link + ")"
+			}
+			if label == "" {
+				label = path.Base(p)
+			}
+			return "[" + label + "](" + link + ")"
+		}
+
+		title := target
+		if ok {
+			title = noteTitle(p)
+		}
+		if label == "" {
+			label = title
+		}
+		return "[" + label + "](" + tiddlerLink(title) + ")"
+	})
+
+	return rewriteLinks(text, func(target string, image bool) string {
+		if isExternal(target) {
+			return ""
+		}
+		if idx := strings.IndexByte(target, '#'); idx >= 0 {
+			target = target[:idx]
+		}
+		p, ok := v.resolve(path.Join(dir, target), false)
+		if !ok {
+			p, ok = v.resolve(target, strings.HasSuffix(target, ".md"))
+		}
+		if !ok {
+			return ""
+		}
+		if v.notes[p] {
+			return tiddlerLink(noteTitle(p))
+		}
+		return v.fileLink(p, batch)
+	})
+}
+
+// splitFrontMatter splits the YAML front matter between --- lines from the body.
+func splitFrontMatter(s string) (string, string) {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	if !strings.HasPrefix(s, "---\n") {
+		return "", s
+	}
+	rest := s[4:]
+	for _, sep := range []string{"\n---\n", "\n...\n"} {
+		if idx := strings.Index(rest, sep); idx >= 0 {
+			return rest[:idx], strings.TrimLeft(rest[idx+len(sep):], "\n")
+		}
+	}
+	if strings.HasSuffix(rest, "\n---") {
+		return strings.TrimSuffix(rest, "\n---"), ""
+	}
+	return "", s
+}
+
+// frontMatterFields converts a simple YAML front matter (scalars and lists) to fields.
+func frontMatterFields(fm string) (map[string]string) {
+	values := make(map[string][]string)
+	keys := make([]string, 0)
+	isList := make(map[string]bool)
+	key := ""
+	for _, line := range strings.Split(fm, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && key != "" && line != trimmed { // block list item
+			values[key] = append(values[key], yamlScalar(trimmed[2:]))
+			isList[key] = true
+			continue
+		}
+
+		idx := strings.Index(line, ":")
+		if idx <= 0 || line != strings.TrimLeft(line, " \t") {
+			continue
+		}
+		key = strings.ToLower(strings.Replace(strings.TrimSpace(line[:idx]), " ", "-", -1))
+		keys = append(keys, key)
+		val := strings.TrimSpace(line[idx+1:])
+		switch {
+		case val == "":
+			values[key] = nil
+		case strings.HasPrefix(val, "[") && strings.HasSuffix(val, "]"):
+			for _, item := range strings.Split(val[1:len(val)-1], ",") {
+				if item = yamlScalar(item); item != "" {
+					values[key] = append(values[key], item)
+				}
+			}
+			isList[key] = true
+		default:
+			values[key] = []string{yamlScalar(val)}
+		}
+	}
+
+	fields := make(map[string]string, len(keys))
+	for _, key := range keys {
+		vals := values[key]
+		list := isList[key]
+		switch key {
+		case "tags", "tag":
+			tags := make([]string, 0, len(vals))
+			for _, val := range vals {
+				for _, tag := range strings.Fields(strings.Replace(val, ",", " ", -1)) {
+					tags = append(tags, strings.TrimPrefix(tag, "#"))
+				}
+			}
+			fields["tags"] = store.StringifyTags(tags)
+			continue
+		case "title":
+			key = "caption"
+		case "created", "modified", "date", "updated":
+			if len(vals) == 1 {
+				if t, ok := parseDate(vals[0]); ok {
+					if key == "date" {
+						key = "created"
+					} else if key == "updated" {
+						key = "modified"
+					}
+					fields[key] = t
+					continue
+				}
+			}
+			key = "obsidian-" + key
+		case "text", "type", "revision", "bag":
+			key = "obsidian-" + key
+		}
+
+		if list {
+			fields[key] = store.StringifyTags(vals)
+		} else {
+			fields[key] = strings.Join(vals, " ")
+		}
+	}
+	return fields
+}
+
+// yamlScalar unquotes a YAML scalar.
+func yamlScalar(s string) (string) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseDate converts a front matter date to a TiddlyWiki date.
+func parseDate(s string) (string, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return TWDate(t), true
+		}
+	}
+	return "", false
+}
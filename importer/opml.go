@@ -0,0 +1,114 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+func init() {
+	err := RegFormat("opml", []string{".opml"}, convertOPML)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr"`
+	URL      string    `xml:"url,attr"`
+	HTMLURL  string    `xml:"htmlUrl,attr"`
+	XMLURL   string    `xml:"xmlUrl,attr"`
+	Category string    `xml:"category,attr"`
+	Created  string    `xml:"created,attr"`
+	Note     string    `xml:"_note,attr"`
+	Outlines []outline `xml:"outline"`
+}
+
+type opmlDoc struct {
+	Outlines []outline `xml:"body>outline"`
+}
+
+// rfc822Date converts an OPML date to a TiddlyWiki date, "" when invalid.
+func rfc822Date(s string) (string) {
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC822Z, time.RFC822, time.RFC3339} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return TWDate(t)
+		}
+	}
+	return ""
+}
+
+// convertOPML reads an OPML outline. Every outline with an URL, or without children, is a tiddler;
+// the parent outlines and the category attribute become tags.
+func convertOPML(r io.Reader) (*Batch, error) {
+	var doc opmlDoc
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := make([]map[string]string, 0)
+	var walk func(list []outline, parents []string)
+	walk = func(list []outline, parents []string) {
+		for _, o := range list {
+			title := o.Text
+			if title == "" {
+				title = o.Title
+			}
+			url := o.HTMLURL
+			if url == "" {
+				url = o.URL
+			}
+			if url == "" {
+				url = o.XMLURL
+			}
+
+			if url == "" && len(o.Outlines) > 0 { // folder
+				walk(o.Outlines, append(parents[:len(parents):len(parents)], title))
+				continue
+			}
+
+			tags := append([]string{}, parents...)
+			for _, cat := range strings.Split(o.Category, ",") {
+				for _, tag := range strings.Split(cat, "/") {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						tags = append(tags, tag)
+					}
+				}
+			}
+			fields := map[string]string{
+				"title": title,
+				"tags": store.StringifyTags(tags),
+				"created": rfc822Date(o.Created),
+				"text": o.Note,
+			}
+			if url != "" {
+				fields["url"] = url
+			}
+			if o.XMLURL != "" {
+				fields["feed"] = o.XMLURL
+			}
+			tiddlers = append(tiddlers, fields)
+			walk(o.Outlines, parents)
+		}
+	}
+	walk(doc.Outlines, nil)
+	return &Batch{Tiddlers: tiddlers}, nil
+}
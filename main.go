@@ -25,6 +25,10 @@ import (
 
 	"flag"
 	"log"
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/textproto"
 	"bufio"
 	"context"
 	"crypto/tls"
@@ -34,52 +38,214 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"syscall"
 	"strings"
 	"time"
 
 
 	"./api"
+	"./dirsync"
+	"./dump"
+	"./importer"
 	"./store"
+	"./store/cached"
+	"./store/compress"
+	"./store/mirror"
+	"./store/readonly"
+	"./upstream"
 	_ "./store/bolt"
 	_ "./store/sqlite"
+	_ "./store/mysql"
+	_ "./store/redis"
+	_ "./store/badger"
+	_ "./store/gitstore"
+	_ "./store/couchdb"
+	_ "./store/dynamodb"
+	_ "./store/webdav"
 	_ "./store/flatFile"
+	_ "./blobs/s3"
+	_ "./blobs/webdav"
+	_ "./sessions/bolt"
+	_ "./sessions/redis"
 
 )
 
 var (
 	VERSION = "SELFBUILD" // injected by buildflags
+	COMMIT = "" // git commit, injected by buildflags
+	BUILDDATE = "" // injected by buildflags
 
 	addr       = flag.String("http", "127.0.0.1:8080", "HTTP service address")
 	dataSource = flag.String("db", "widdly.db", "Database path/file")
 	dataType   = flag.String("dbt", "flatFile", "Database type")
+	dataOpts   = flag.String("db-opt", "", "backend options, comma separated name=value, e.g. nosync,mmap=256M for bbolt or busy_timeout=10s for sqlite")
+	titleCase  = flag.String("title-case", "native", "title case policy: native, sensitive or insensitive; pick it when the database is created")
 
 	crtFile    = flag.String("crt", "", "PEM encoded certificate file")
 	keyFile    = flag.String("key", "", "PEM encoded private key file")
 	genKey     = flag.Bool("genkey", false, "generate self-sign EC certificate")
+	showVersion = flag.Bool("version", false, "print the version and build info, then exit")
+	decryptFile = flag.String("decrypt", "", "decrypt an export sent by -deadman-days to stdout with the passphrase in $WIDDLY_DEADMAN_PASS, then exit")
 
 	gziplv   = flag.Int("gz", 1, "gzip compress level, 0 for disable")
+	gzMin   = flag.Int("gz-min", 1024, "responses smaller than this many bytes are not compressed")
+	gzAdaptive   = flag.Bool("gz-adaptive", false, "do not compress for LAN clients, compress less or not at all while the CPU is busy")
+	gzBusy   = flag.Float64("gz-busy", 0.8, "CPU load (0~1) above which -gz-adaptive stops compressing, above half of it the fastest level is used")
 	rev   = flag.Int("rev", -1, "Max keeping history count, 0 for disable, -1 for unlimit")
+	revSize   = flag.Int64("revsize", 0, "Max total history size in MiB, oldest revisions are pruned when exceeded, 0 for unlimit")
+	indexFiles   = flag.String("index", "index.html", "base page file served at /, comma separated fallbacks, the first existing one is served")
+	indexUpload   = flag.String("index-upload", "admin", "who may replace the -index page with PUT /: admin, user or off")
+	indexCheck   = flag.Bool("index-check", true, "reject PUT / uploads which do not look like a TiddlyWiki page")
+	filesDir   = flag.String("files", "", "attachment files directory served under /files/, empty for disable")
+	filesDb   = flag.String("files-db", "", "keep the /files/ attachments on s3 or webdav instead of -files, use -files-db list to list all")
+	filesSource   = flag.String("files-source", "", "bucket (s3://host/bucket/prefix) or share (https://user@host/path/) of -files-db")
+	filesURLTTL   = flag.Duration("files-url-ttl", 15 * time.Minute, "how long the signed download URLs of -files-db are valid, 0 for proxy the files")
+	stripMeta   = flag.Bool("strip-meta", true, "drop the EXIF (GPS, camera...), XMP and text metadata of uploaded JPEG and PNG images")
+	scanClamd   = flag.String("scan-clamd", "", "scan /files/ uploads with clamd at this unix socket or host:port, infected files are refused")
+	scanCmd   = flag.String("scan-cmd", "", "scan /files/ uploads with this command: the file on stdin, exit 0 accepts, 1 refuses")
+	thumbWidths   = flag.String("thumb-widths", "160 400 800 1600", "widths of the resized images served for ?w=, the asked width is rounded up to one of them, empty for disable")
+	mimeFile   = flag.String("mime", "", "extra tiddler type to Content-Type mapping file")
+	minFree   = flag.Int64("minfree", 0, "switch to read-only when free space of the database volume is below this MiB, 0 for disable")
+	fatTags   = flag.String("fat", store.StringifyTags(store.FatTags), "tags of tiddlers sent with text in the tiddler list, TiddlyWiki tags format")
+	streamKB   = flag.Int64("stream", 1024, "stream tiddlers larger than this KiB instead of buffering them (flatFile only), 0 for disable")
+	maxBody   = flag.Int64("max-body", 256, "max decompressed size of gzip/deflate/zstd request bodies in MiB, 0 for unlimit")
+	metrics   = flag.Bool("metrics", false, "serve Prometheus metrics at /metrics, set $WIDDLY_METRICS_TOKEN to require it as bearer token")
+	sessStore   = flag.String("sessions-db", "memory", "session backend: memory, bbolt or redis; use -sessions-db '' to list all")
+	sessSource   = flag.String("sessions-source", "", "session backend file (bbolt) or URL (redis://host:6379/0)")
+	maxSessions   = flag.Int("sessions", 4096, "max sessions kept by the session backend, the least recently used are dropped beyond")
+	sessBind   = flag.String("session-bind", "", "ignore session cookies sent from another address than the session started from: ip, or subnet (/24 for IPv4, /64 for IPv6); empty for disable")
+	deviceDays   = flag.Int("device-days", 90, "how many days a device paired with /account/pair stays logged in since its last use, 0 for disable pairing")
+	rcache   = flag.Bool("rcache", true, "cache list & tiddler responses in memory")
+	cacheMax   = flag.Int64("cache-max", 0, "memory budget of the response cache in MiB, the least recently used responses are dropped beyond it, 0 for unlimit")
+	cacheSpill   = flag.Int64("cache-spill", 0, "keep cached responses larger than this KiB in temporary files instead of memory, 0 for disable")
+	cacheSpillDir   = flag.String("cache-spill-dir", "", "directory of the -cache-spill files, empty for the system temporary directory")
+	storeCache   = flag.Int("cache", 0, "keep the tiddler list and up to this many tiddlers of the store in memory, for slow backends; 0 for disable")
+	compressWith   = flag.String("compress", "", "compress tiddler texts in the store: gzip, zstd (built with -tags zstd), or off to read compressed texts but write plain ones; empty for disable")
+	compressMin   = flag.Int("compress-min", 4, "compress only texts of at least this KiB, with -compress")
+	queryAPI   = flag.Bool("query-api", false, "serve the JSON query endpoint /query")
+	calFields   = flag.String("cal-fields", "due event-date", "date fields of tiddlers listed in /calendar.ics, space separated")
+	calFilter   = flag.String("cal-filter", "", "TiddlyWiki filter selecting the tiddlers of /calendar.ics, empty for all")
+	importFile   = flag.String("import", "", "import this file into the store and exit")
+	importFormat   = flag.String("import-format", "", "format of -import, empty for guess by file extension")
+	importEnex   = flag.String("import-enex", "", "same as -import <file> -import-format enex")
+	importNotion   = flag.String("import-notion", "", "same as -import <file> -import-format notion")
+	importLinkFiles   = flag.Bool("import-link-files", true, "copy the images of imported Markdown folders to -files and link them there")
+	importTag   = flag.String("import-tag", "", "tag added to every tiddler of -import")
+	importOverwrite   = flag.Bool("import-overwrite", false, "replace existing tiddlers on -import instead of skipping them")
+	dumpFile   = flag.String("dump", "", "write the whole wiki (tiddlers with their history, accounts, settings, preferences and the -acc file) to this archive and exit")
+	loadFile   = flag.String("load", "", "load an archive of -dump, - for stdin, into the empty store and exit")
+	backupDir   = flag.String("backup", "", "write an incremental backup of the whole wiki (like -dump) to this folder, s3://host/bucket/prefix or https://user@dav.example.com/path/ and exit; only what changed since the last one is written")
+	restoreDir   = flag.String("restore", "", "load a backup of -backup from this folder or URL into the empty store and exit")
+	restoreSnapshot   = flag.String("restore-snapshot", "", "the snapshot of -restore, e.g. 20260101T030000.000Z.json.gz; empty for the latest")
+	publishField   = flag.String("publish-field", "publish-at", "date field hiding a tiddler from guests until that time, empty for disable")
+	blogTag   = flag.String("blog-tag", "Public/Blog", "tiddlers with this tag are published read-only under /blog/, empty for disable")
+	blogTitle   = flag.String("blog-title", "", "name of the /blog/ pages and feed, empty for the host name")
+	commentGuests   = flag.Bool("comment-guests", false, "let guests comment, their comments wait for approval")
+	commentModerate   = flag.Bool("comment-moderate", false, "comments of users who are not admin wait for approval too")
+	anonPrefix   = flag.String("anon-prefix", "", "guests may create and edit the tiddlers with titles starting with this, empty for disable")
+	anonRate   = flag.Int("anon-rate", 20, "how many tiddlers a guest address may save per hour")
+	anonMax   = flag.Int64("anon-max", 16, "max size of a tiddler saved by a guest in KiB")
+	anonWork   = flag.Int("anon-work", 0, "proof of work in leading zero bits guests must send with each save, 0 for none")
+	sanitize   = flag.Bool("sanitize", false, "strip scripts from HTML/SVG tiddlers saved by users who are not admins")
+	uuids   = flag.Bool("uuid", false, "give every tiddler a stable uuid field on its first save, served at /uuid/<uuid> whatever its title")
+	hooks   = flag.String("hooks", "", "file of the hooks <event>=<command> [args...], one per line, run with the event as JSON on stdin, empty for disable")
+	hookTimeout   = flag.Duration("hook-timeout", 30 * time.Second, "how long a -hooks command may run before it is killed")
+	hookConcurrency   = flag.Int("hook-concurrency", 4, "how many -hooks commands run at once")
+	templates   = flag.String("templates", "", "file of the rules <prefix>=<template> and tag:<tag>=<template>, one per line, answering the GET of missing tiddlers with a template, empty for disable")
+	adminPrefixes   = flag.String("admin-prefixes", strings.Join(api.AdminPrefixes, " "), "only admins may change tiddlers with these title prefixes, !prefix opens one again, empty for disable")
+	smtpAddr   = flag.String("smtp", "", "SMTP server host:port for notification digests, empty for disable")
+	smtpFrom   = flag.String("smtp-from", "", "sender address of notification digests")
+	smtpUser   = flag.String("smtp-user", "", "SMTP login user, the password is read from $WIDDLY_SMTP_PASS")
+	digestEvery   = flag.Duration("digest", 24 * time.Hour, "how often unread notifications are mailed to users with an email")
+	publicURL   = flag.String("public-url", "", "public URL of the wiki, linked from notification digests")
+	upstreamURL   = flag.String("upstream", "", "URL of a widdly/TiddlyWeb server to mirror tiddlers with, empty for disable")
+	upstreamUser   = flag.String("upstream-user", "", "login of -upstream, the password is read from $WIDDLY_UPSTREAM_PASS")
+	upstreamMode   = flag.String("upstream-mode", "both", "sync direction of -upstream: both, push or pull")
+	upstreamInterval   = flag.Duration("upstream-interval", 5 * time.Minute, "how often -upstream is synced")
+	publishTo   = flag.String("publish-to", "", "POST /admin/publish writes a single-file snapshot of the public tiddlers to this file, s3://host/bucket/prefix or https://user@dav.example.com/path/ (as index.html), empty for disable")
+	publishFilter   = flag.String("publish-filter", api.PublishFilter, "the tiddlers of -publish-to")
+	publishBase   = flag.String("publish-base", "empty.html", "TiddlyWiki page the -publish-to tiddlers are added to, without the TiddlyWeb plugin")
+	deadmanDays   = flag.Int("deadman-days", 0, "after this many days without any request of a logged in user, send an encrypted export of the wiki to -deadman-to once, 0 for disable")
+	deadmanTo   = flag.String("deadman-to", "", "where -deadman-days sends the export: mailto:<address> (with -smtp), s3://host/bucket/prefix or https://user@dav.example.com/path/")
+	auditEvery   = flag.Duration("audit", 0, "how often the history is checked against the tiddlers and repaired (see /admin/audit), 0 only at start, negative for never")
+	syncDir   = flag.String("sync-dir", "", "keep .tid/.md files in this directory in sync with the store, empty for disable")
+	syncInterval   = flag.Duration("sync-interval", 5 * time.Second, "how often -sync-dir is synced")
+	warmUp   = flag.Bool("warm-up", false, "read the tiddler list into the response cache in the background at start, requests wait for it (see /ready)")
+	xwiki   = flag.String("xwiki", "", "other wikis of the server whose tiddlers are read as <name>:<title>, space separated name=dbtype:datasource, empty for disable")
+	xwikiGuests   = flag.String("xwiki-guests", "", "space separated names of the -xwiki wikis guests may read too")
+	mirrorTo   = flag.String("mirror", "", "also write every change to this second store, dbtype:datasource (e.g. flatFile:backup), synced from the store at start; empty for disable")
+	readOnly   = flag.Bool("readonly", false, "serve a frozen copy: every write to the store is refused; not with -import, -acc-store, -sync-dir or -upstream")
+	lazyOpen   = flag.Bool("lazy-open", false, "open the store on the first request instead of at start, for socket activation; not with -import, -acc-store, -sync-dir or -upstream")
 
 	accounts   = flag.String("acc", "user.lst", "user list file")
-	// eache line end with '\n': <user>\t<salt>\t<sha256(pwd)>
+	// eache line end with '\n': <user>\t<salt>\t<sha256(pwd)>[\t<role>]
+	// role is "admin" (default) or "user"
 	// comment start with '#'
 
 	user   = flag.String("u", "", "encode user name to user.lst format")
 	pass   = flag.String("p", "", "encode user password to user.lst format")
+	role   = flag.String("role", "", "role of -u: admin or user, empty for admin")
+	email   = flag.String("email", "", "email address of -u, for notification digests")
+	accStore   = flag.Bool("acc-store", false, "keep the user accounts in the data store, -acc is imported when it has none, -u/-p add to it")
 )
 
 func main() {
 	flag.Parse()
 
-	if *user != "" && *pass != "" {
+	build := buildInfo()
+	if *showVersion {
+		fmt.Printf("widdly %s\ncommit %s\nbuilt %s\n%s\n", build.Version, build.Commit, build.Date, build.GoVersion)
+		return
+	}
+	if *decryptFile != "" {
+		data, err := ioutil.ReadFile(*decryptFile)
+		if err == nil {
+			data, err = api.DecryptExport(data, os.Getenv("WIDDLY_DEADMAN_PASS"))
+		}
+		if err != nil {
+			fmt.Println("[Decrypt error]", *decryptFile, err)
+			return
+		}
+		os.Stdout.Write(data)
+		return
+	}
+	api.Build = build
+
+	// When upgrading (see upgrade_unix.go), wait for the old process to exit before opening anything.
+	inherited, err := inheritListener()
+	if err != nil {
+		fmt.Println("[upgrade error]", err)
+		return
+	}
+
+	if *user != "" && *pass != "" && !*accStore {
 		uid := *user
 		salt := genSalt()
 		hash := pwdHashStr(*pass, salt)
 
+		if *email != "" {
+			if *role == "" {
+				*role = "admin"
+			}
+			fmt.Println("# user\tsalt\thash\trole\temail")
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", uid, salt, hash, *role, *email)
+			return
+		}
+		if *role != "" {
+			fmt.Println("# user\tsalt\thash\trole")
+			fmt.Printf("%s\t%s\t%s\t%s\n", uid, salt, hash, *role)
+			return
+		}
 		fmt.Println("# user\tsalt\thash")
 		fmt.Printf("%s\t%s\t%s\n", uid, salt, hash)
 		return
@@ -92,47 +258,337 @@ func main() {
 		return
 	}
 
-	fmt.Println("[server] version =", VERSION)
+	fmt.Println("[server] version =", VERSION, build.Commit, build.Date, build.GoVersion)
 	fmt.Println("[server] gzip level =", *gziplv)
 	fmt.Println("[server] max history count =", *rev)
+	fmt.Println("[server] max history size (MiB) =", *revSize)
+	fmt.Println("[server] plugins =", api.ListPlugin())
 
-	// read in accounts
+	// read in accounts, optional when they are kept in the store
+	userlist := make(map[string]*User)
 	af, err := os.Open(*accounts)
-	if err != nil {
+	if err != nil && !((*accStore || *loadFile != "" || *restoreDir != "") && os.IsNotExist(err)) {
 		fmt.Println("[Open Accounts error]", err)
 		return
 	}
+	if err == nil {
+		userlist, err = readTSV(af)
+		if err != nil {
+			fmt.Println("[Parse Accounts error]", *accounts, err)
+			return
+		}
+	}
+	if !*accStore {
+		fmt.Println("[user] count =", len(userlist))
+	}
+
 
-	userlist, err := readTSV(af)
+	if *mimeFile != "" {
+		mf, err := os.Open(*mimeFile)
+		if err != nil {
+			fmt.Println("[Open mime error]", err)
+			return
+		}
+		err = api.LoadContentTypes(mf)
+		mf.Close()
+		if err != nil {
+			fmt.Println("[Parse mime error]", *mimeFile, err)
+			return
+		}
+	}
+	api.FilesDir = *filesDir
+	api.StripMeta = *stripMeta
+	if *scanClamd != "" {
+		api.Scanners = append(api.Scanners, api.ClamdScanner(*scanClamd))
+	}
+	if strings.TrimSpace(*scanCmd) != "" {
+		api.Scanners = append(api.Scanners, api.CommandScanner(*scanCmd))
+	}
+	api.ThumbWidths = nil
+	for _, f := range strings.Fields(*thumbWidths) {
+		width, err := strconv.Atoi(f)
+		if err != nil || width <= 0 {
+			fmt.Println("[Parse thumb-widths error]", f)
+			return
+		}
+		api.ThumbWidths = append(api.ThumbWidths, width)
+	}
+	sort.Ints(api.ThumbWidths)
+	if *filesDb != "" {
+		api.Blobs, err = api.OpenBlobBackend(*filesDb, *filesSource)
+		if err != nil {
+			fmt.Println("[Open files-db error]", err)
+			fmt.Println("[files backend list]", api.ListBlobBackend())
+			return
+		}
+		defer api.Blobs.Close()
+		api.BlobURLTTL = *filesURLTTL
+		fmt.Println("[server] files =", *filesDb, *filesSource)
+	}
+	api.IndexFiles = strings.Split(*indexFiles, ",")
+	api.IndexCheck = *indexCheck
+	switch *indexUpload {
+	case "admin", "user", "off":
+		api.IndexUpload = *indexUpload
+	default:
+		fmt.Println("[index-upload error] want admin, user or off, got", *indexUpload)
+		return
+	}
+	api.PublishField = *publishField
+	api.BlogTag = *blogTag
+	api.BlogTitle = *blogTitle
+	api.CommentGuests = *commentGuests
+	api.CommentModeration = *commentModerate
+	if strings.HasPrefix(*anonPrefix, "$:/") {
+		fmt.Println("[anon-prefix error] system tiddlers can not be open to guests:", *anonPrefix)
+		return
+	}
+	api.AnonPrefix = *anonPrefix
+	api.AnonRate = *anonRate
+	api.AnonMaxSize = *anonMax * 1024
+	api.AnonWork = *anonWork
+	api.Sanitize = *sanitize
+	api.UUIDs = *uuids
+	api.AdminPrefixes = strings.Fields(*adminPrefixes)
+	if *templates != "" {
+		data, err := ioutil.ReadFile(*templates)
+		if err == nil {
+			api.Templates, err = api.ParseTemplates(string(data))
+		}
+		if err != nil {
+			fmt.Println("[Read templates error]", err)
+			return
+		}
+	}
+	if *hooks != "" {
+		data, err := ioutil.ReadFile(*hooks)
+		if err == nil {
+			api.Hooks, err = api.ParseHooks(string(data))
+		}
+		if err != nil {
+			fmt.Println("[Read hooks error]", err)
+			return
+		}
+		api.HookTimeout, api.HookConcurrency = *hookTimeout, *hookConcurrency
+	}
+	api.QueryAPI = *queryAPI
+	api.CalendarFields = strings.Fields(*calFields)
+	api.CalendarFilter, err = api.ParseFilter(*calFilter)
 	if err != nil {
-		fmt.Println("[Parse Accounts error]", *accounts, err)
+		fmt.Println("[Parse cal-filter error]", err)
+		return
+	}
+	api.StreamThreshold = *streamKB * 1024
+	api.MaxHistory = *rev
+	api.Metrics = *metrics
+	api.MetricsToken = os.Getenv("WIDDLY_METRICS_TOKEN")
+	api.ClipToken = os.Getenv("WIDDLY_CLIP_TOKEN")
+	api.SessionCountLimit = *maxSessions
+	switch *sessBind {
+	case "", "ip", "subnet":
+		api.SessionBind = *sessBind
+	default:
+		fmt.Println("[session-bind error] want ip or subnet, got", *sessBind)
+		return
+	}
+	api.DeviceLifeTime = time.Duration(*deviceDays) * 24 * time.Hour
+	api.GzipMinSize = *gzMin
+	api.GzipAdaptive = *gzAdaptive
+	api.GzipBusy = *gzBusy
+	api.StartCPUWatch()
+	api.MaxHistorySize = *revSize * 1024 * 1024
+	api.MaxDecodedBody = *maxBody * 1024 * 1024
+	api.CacheMaxSize = *cacheMax * 1024 * 1024
+	api.CacheSpillSize = *cacheSpill * 1024
+	api.CacheSpillDir = *cacheSpillDir
+
+	store.FatTags = store.ParseTags(*fatTags)
+	fmt.Println("[server] fat tags =", store.FatTags)
+
+	store.TitleCase, err = store.ParseCase(*titleCase)
+	if err != nil {
+		fmt.Println("[Parse title-case error]", err)
 		return
 	}
-	fmt.Println("[user] count =", len(userlist))
-
 
-	mux := api.NewRootMux()
-	api.InitHandle(mux)
+	store.BackendOptions, err = store.ParseOptions(*dataOpts)
+	if err != nil {
+		fmt.Println("[Parse db-opt error]", err)
+		return
+	}
 
 	// Open the data store and tell HTTP handlers to use it.
-	db, err := store.Open(*dataType, *dataSource)
-	if err != nil {
-		list := store.ListBackend()
-		fmt.Println("[Open backend error]", err)
-		fmt.Println("[backend list]", list)
+	openStore := func() (store.TiddlerStore, error) {
+		db, err := store.Open(*dataType, *dataSource)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxHistory(*rev)
+		db.SetMaxHistorySize(*revSize * 1024 * 1024)
+		if *compressWith != "" {
+			cdb, err := compress.New(db, *compressWith, *compressMin * 1024)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			db = cdb
+		}
+		if *mirrorTo != "" {
+			parts := strings.SplitN(*mirrorTo, ":", 2)
+			if len(parts) != 2 {
+				db.Close()
+				return nil, fmt.Errorf("-mirror wants dbtype:datasource, got %q", *mirrorTo)
+			}
+			// -db-opt is for the main store, the mirror has the defaults
+			opts := store.BackendOptions
+			store.BackendOptions = nil
+			mdb, err := store.Open(parts[0], parts[1])
+			store.BackendOptions = opts
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			mdb.SetMaxHistory(*rev)
+			mdb.SetMaxHistorySize(*revSize * 1024 * 1024)
+			put, deleted, err := mirror.Sync(context.Background(), db, mdb)
+			if err != nil {
+				fmt.Println("[mirror] sync error, the mirror may miss tiddlers:", err)
+			} else if put + deleted > 0 {
+				fmt.Printf("[mirror] synced %d tiddlers, deleted %d\n", put, deleted)
+			}
+			db = mirror.New(db, mdb)
+		}
+		if *readOnly {
+			db = readonly.New(db)
+		}
+		if *storeCache > 0 {
+			db = cached.New(db, *storeCache)
+		}
+		return db, nil
+	}
+	if *readOnly {
+		if *importFile != "" || *importEnex != "" || *importNotion != "" || *loadFile != "" || *restoreDir != "" || *accStore || *syncDir != "" || *upstreamURL != "" {
+			fmt.Println("[readonly error] -readonly does not work with -import, -load, -restore, -acc-store, -sync-dir or -upstream, they write the store")
+			return
+		}
+		api.ReadOnlyStore = true
+	}
+	var db store.TiddlerStore
+	if *lazyOpen {
+		if *importFile != "" || *importEnex != "" || *importNotion != "" || *dumpFile != "" || *loadFile != "" || *backupDir != "" || *restoreDir != "" || *accStore || *syncDir != "" || *upstreamURL != "" {
+			fmt.Println("[lazy-open error] -lazy-open does not work with -import, -dump, -load, -backup, -restore, -acc-store, -sync-dir or -upstream, they need the store at start")
+			return
+		}
+		fmt.Println("[server] the store is opened on the first request")
+		defer func() {
+			if api.StoreDb != nil {
+				api.StoreDb.Close()
+			}
+		}()
+	} else {
+		db, err = openStore()
+		if err != nil {
+			list := store.ListBackend()
+			fmt.Println("[Open backend error]", err)
+			fmt.Println("[backend list]", list)
+			return
+		}
+		defer db.Close()
+	}
+
+	// Open the other wikis read by cross-wiki transclusion.
+	guests := make(map[string]bool)
+	for _, name := range strings.Fields(*xwikiGuests) {
+		guests[name] = true
+	}
+	for _, spec := range strings.Fields(*xwiki) {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !strings.Contains(parts[1], ":") {
+			fmt.Println("[xwiki error] want name=dbtype:datasource, got", spec)
+			return
+		}
+		name := parts[0]
+		parts = strings.SplitN(parts[1], ":", 2)
+		typ, source := parts[0], parts[1]
+		xdb, err := store.Open(typ, source)
+		if err != nil {
+			fmt.Println("[Open xwiki error]", name, err)
+			return
+		}
+		defer xdb.Close()
+		api.Wikis[name] = &api.Wiki{Name: name, Store: xdb, Guests: guests[name]}
+		fmt.Println("[server] xwiki", name, "=", typ, source)
+	}
+
+	if *importEnex != "" {
+		*importFile, *importFormat = *importEnex, "enex"
+	}
+	if *importNotion != "" {
+		*importFile, *importFormat = *importNotion, "notion"
+	}
+	importer.LinkFiles = *importLinkFiles
+	if *importFile != "" {
+		importTo(db)
+		return
+	}
+	if *dumpFile != "" {
+		dumpTo(db)
+		return
+	}
+	if *loadFile != "" {
+		loadFrom(db)
+		return
+	}
+	if *backupDir != "" {
+		backupTo(db)
+		return
+	}
+	if *restoreDir != "" {
+		restoreFrom(db)
 		return
 	}
-	defer db.Close()
-	db.SetMaxHistory(*rev)
 
-	api.StoreDb = db
-	api.GzipLevel = *gziplv
+	lookupUser := func(user string) (*User, bool) {
+		u, ok := userlist[user]
+		return u, ok
+	}
+	if *accStore {
+		accs, err := openAccounts(db, userlist)
+		if err != nil {
+			fmt.Println("[Open store accounts error]", err)
+			return
+		}
+		if *user != "" && *pass != "" {
+			salt := genSalt()
+			if *role == "" {
+				*role = "admin"
+			}
+			u := &api.UserRecord{Name: *user, Salt: salt, Hash: pwdHashStr(*pass, salt), Role: *role, Email: *email}
+			if old, ok := accs.Get(*user); ok { // keep the other credentials
+				u.TOTPSecret, u.Tokens = old.TOTPSecret, old.Tokens
+			}
+			if err := accs.Put(context.Background(), u); err != nil {
+				fmt.Println("[Save store account error]", err)
+				return
+			}
+			fmt.Println("[user] saved", *user)
+			return
+		}
+		fmt.Println("[user] count =", len(accs.Names()), "in the store")
+		lookupUser = func(user string) (*User, bool) {
+			u, ok := accs.Get(user)
+			if !ok {
+				return nil, false
+			}
+			return &User{UID: u.Name, Salt: u.Salt, Hash: u.Hash, Role: u.Role, Email: u.Email}, true
+		}
+	}
 
-	api.Authenticate = func(user string, pwd string) (bool) {
+	authenticate := func(user string, pwd string) (bool) {
 		t0 := time.Now().Add(time.Second)
 		defer time.Sleep(time.Until(t0)) // prevent brute force & timing attacks
 
-		u, ok := userlist[user]
+		u, ok := lookupUser(user)
 		if !ok {
 			return false
 		}
@@ -144,7 +600,140 @@ func main() {
 		return false
 	}
 
-	srv := &http.Server{Addr: *addr, Handler: mux}
+	api.StartDiskWatch(*dataSource, *minFree * 1024 * 1024)
+
+	isAdmin := func(user string) (bool) {
+		u, ok := lookupUser(user)
+		return ok && u.Role != "user"
+	}
+	userExists := func(user string) (bool) {
+		_, ok := lookupUser(user)
+		return ok
+	}
+
+	var sessions api.SessionBackend
+	if *sessStore != "memory" {
+		sessions, err = api.OpenSessionBackend(*sessStore, *sessSource)
+		if err != nil {
+			fmt.Println("[Open sessions error]", err)
+			fmt.Println("[session backend list]", api.ListSessionBackend())
+			return
+		}
+		fmt.Println("[server] sessions =", *sessStore, *sessSource)
+	}
+
+	var jobs []func() // started once the store is ready
+
+	if *syncDir != "" {
+		syncer, err := dirsync.New(*syncDir, db)
+		if err != nil {
+			fmt.Println("[Open sync-dir error]", err)
+			return
+		}
+		syncer.OnChange = api.Invalidate
+		fmt.Println("[server] sync dir =", *syncDir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go syncer.Watch(ctx, *syncInterval)
+	}
+
+	if *upstreamURL != "" {
+		syncer, err := upstream.New(*upstreamURL, db, *dataSource + ".upstream.json")
+		if err != nil {
+			fmt.Println("[Open upstream error]", err)
+			return
+		}
+		syncer.User = *upstreamUser
+		syncer.Password = os.Getenv("WIDDLY_UPSTREAM_PASS")
+		syncer.Push = *upstreamMode != "pull"
+		syncer.Pull = *upstreamMode != "push"
+		syncer.OnChange = api.Invalidate
+		fmt.Println("[server] upstream =", *upstreamURL, *upstreamMode)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go syncer.Watch(ctx, *upstreamInterval)
+	}
+
+	if *smtpAddr != "" {
+		api.UserEmail = func(user string) (string) {
+			if u, ok := lookupUser(user); ok {
+				return u.Email
+			}
+			return ""
+		}
+		api.SendMail = sendMail
+		api.DigestURL = *publicURL
+		fmt.Println("[server] notification digests via", *smtpAddr, "every", *digestEvery)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		jobs = append(jobs, func() { api.StartDigests(ctx, *digestEvery) })
+	}
+
+	if *publishTo != "" {
+		if _, err := api.ParseFilter(*publishFilter); err != nil {
+			fmt.Println("[Parse publish-filter error]", err)
+			return
+		}
+		api.PublishFilter = *publishFilter
+		api.PublishBase = *publishBase
+		api.PublishOut, err = publishWriter(*publishTo)
+		if err != nil {
+			fmt.Println("[Open publish-to error]", err)
+			return
+		}
+		fmt.Println("[server] publish to", *publishTo)
+	}
+
+	if *deadmanDays > 0 {
+		api.DeadManAfter = time.Duration(*deadmanDays) * 24 * time.Hour
+		api.DeadManPass = os.Getenv("WIDDLY_DEADMAN_PASS")
+		if api.DeadManPass == "" {
+			fmt.Println("[deadman error] -deadman-days needs a passphrase in $WIDDLY_DEADMAN_PASS")
+			return
+		}
+		api.DeadManSend, err = deadManSender(*deadmanTo)
+		if err != nil {
+			fmt.Println("[deadman error]", err)
+			return
+		}
+		fmt.Println("[server] dead man's switch after", *deadmanDays, "days to", *deadmanTo)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		jobs = append(jobs, func() { api.StartDeadMan(ctx) })
+	}
+
+	if *auditEvery >= 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		jobs = append(jobs, func() { api.StartAudit(ctx, *auditEvery) })
+	}
+
+	var open func() (store.TiddlerStore, error)
+	if *lazyOpen {
+		open = openStore
+	}
+	handler := api.Handler(api.Config{
+		Store: db,
+		Open: open,
+		WarmUp: *warmUp,
+		OnReady: func() {
+			for _, start := range jobs {
+				start()
+			}
+		},
+		Sessions: sessions,
+		Authenticate: authenticate,
+		IsAdmin: isAdmin,
+		UserExists: userExists,
+		GzipLevel: *gziplv,
+		NoCache: !*rcache,
+	})
+
+	srv := &http.Server{Addr: *addr, Handler: handler}
 
 	waitClosed := make(chan struct{})
 	sigint := make(chan os.Signal, 1)
@@ -160,7 +749,7 @@ func main() {
 		close(waitClosed)
 	}()
 
-	startServer(srv)
+	startServer(srv, inherited, sigint)
 
 	select {
 	case <-sigint:
@@ -168,13 +757,324 @@ func main() {
 		close(sigint)
 	}
 	<-waitClosed // block until server shutdown
+	api.FlushActivity()
+}
+
+func importTo(db store.TiddlerStore) {
+	format, err := importer.Lookup(*importFormat, *importFile)
+	if err != nil {
+		fmt.Println("[Import error]", err)
+		fmt.Println("[import formats]", importer.ListFormat())
+		return
+	}
+
+	batch, err := importer.ConvertFile(format, *importFile)
+	if err != nil {
+		fmt.Println("[Import error]", format.Name, *importFile, err)
+		return
+	}
+
+	rep, err := importer.Import(context.Background(), db, batch, importer.Options{
+		Tag: *importTag,
+		Overwrite: *importOverwrite,
+		FilesDir: *filesDir,
+	})
+	fmt.Printf("[import] %s: %d tiddlers saved, %d files saved\n", format.Name, rep.Saved, rep.Files)
+	for _, title := range rep.Skipped {
+		fmt.Println("[import] exists, skipped:", title)
+	}
+	for _, title := range rep.Renamed {
+		fmt.Println("[import] repeated title, saved as:", title)
+	}
+	for _, name := range rep.FilesSkipped {
+		if *filesDir == "" {
+			fmt.Println("[import] no -files directory, skipped file:", name)
+		} else {
+			fmt.Println("[import] another file exists, skipped:", name)
+		}
+	}
+	if err != nil {
+		fmt.Println("[Import error]", err)
+	}
+}
+
+// dumpFiles returns the server files -dump and -backup take along: the -acc file.
+func dumpFiles() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	acc, err := ioutil.ReadFile(*accounts)
+	if err == nil {
+		files["user.lst"] = acc
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
 }
 
-func startServer(srv *http.Server) {
+// loadFiles writes the files of -load and -restore: the user list to -acc unless that exists.
+func loadFiles(files map[string][]byte) {
+	acc, ok := files["user.lst"]
+	if !ok {
+		return
+	}
+	path := *accounts
+	if _, err := os.Stat(path); err == nil {
+		path += ".dump"
+		fmt.Println("[load]", *accounts, "exists, the user list of the archive is written to", path)
+	}
+	if err := ioutil.WriteFile(path, acc, 0600); err != nil {
+		fmt.Println("[Load error]", err)
+	}
+}
+
+// dumpTo writes db and the -acc file to the archive -dump, through a temporary file.
+func dumpTo(db store.TiddlerStore) {
+	files, err := dumpFiles()
+	if err != nil {
+		fmt.Println("[Dump error]", err)
+		return
+	}
+
+	tmp := *dumpFile + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Println("[Dump error]", err)
+		return
+	}
+	st, err := dump.Write(context.Background(), out, db, files)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *dumpFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Println("[Dump error]", err)
+		return
+	}
+	fmt.Printf("[dump] %d tiddlers, %d revisions of history, %d files\n", st.Tiddlers, st.Revisions, st.Files)
+}
+
+// loadFrom loads the archive -load into db.
+func loadFrom(db store.TiddlerStore) {
+	in := os.Stdin
+	if *loadFile != "-" {
+		f, err := os.Open(*loadFile)
+		if err != nil {
+			fmt.Println("[Load error]", err)
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+	st, files, err := dump.Read(context.Background(), in, db)
+	fmt.Printf("[load] %d tiddlers, %d revisions of history, %d files\n", st.Tiddlers, st.Revisions, st.Files)
+	if err != nil {
+		fmt.Println("[Load error]", err)
+		return
+	}
+	loadFiles(files)
+}
+
+// blobTarget keeps the backups in a file backend.
+type blobTarget struct {
+	api.BlobBackend
+}
+
+func (b blobTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, _, err := b.BlobBackend.Get(ctx, name)
+	if err == api.ErrBlobNotFound {
+		return nil, os.ErrNotExist
+	}
+	return rc, err
+}
+
+// backupTarget returns the target of -backup and -restore: a bucket or share, else a folder.
+func backupTarget(to string) (dump.Target, error) {
+	blobs, err := openRemote(to)
+	if err != nil {
+		return nil, err
+	}
+	if blobs != nil {
+		return blobTarget{blobs}, nil
+	}
+	return dump.Dir(to), nil
+}
+
+// backupTo writes an incremental backup of db and the -acc file to -backup.
+func backupTo(db store.TiddlerStore) {
+	files, err := dumpFiles()
+	if err != nil {
+		fmt.Println("[Backup error]", err)
+		return
+	}
+	t, err := backupTarget(*backupDir)
+	if err != nil {
+		fmt.Println("[Backup error]", err)
+		return
+	}
+	name, st, err := dump.Backup(context.Background(), t, db, files)
+	if err != nil {
+		fmt.Println("[Backup error]", err)
+		return
+	}
+	fmt.Printf("[backup] %s: %d tiddlers (%d changed), %d revisions of history, %d files; %d objects, %d bytes written\n",
+		name, st.Tiddlers, st.Changed, st.Revisions, st.Files, st.Objects, st.Bytes)
+}
+
+// restoreFrom loads the backup -restore-snapshot, the latest one by default, of -restore into db.
+func restoreFrom(db store.TiddlerStore) {
+	t, err := backupTarget(*restoreDir)
+	if err != nil {
+		fmt.Println("[Restore error]", err)
+		return
+	}
+	st, files, err := dump.Restore(context.Background(), t, *restoreSnapshot, db)
+	fmt.Printf("[restore] %d tiddlers, %d revisions of history, %d files\n", st.Tiddlers, st.Revisions, st.Files)
+	if err != nil {
+		fmt.Println("[Restore error]", err)
+		return
+	}
+	loadFiles(files)
+}
+
+// sendMail sends a plain text mail through -smtp.
+func sendMail(to string, subject string, body string) (error) {
+	var auth smtp.Auth
+	if *smtpUser != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		auth = smtp.PlainAuth("", *smtpUser, os.Getenv("WIDDLY_SMTP_PASS"), host)
+	}
+	msg := "From: " + *smtpFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(*smtpAddr, auth, *smtpFrom, []string{to}, []byte(msg))
+}
+
+// sendMailFile sends a mail with the attachment data named name through -smtp.
+func sendMailFile(to string, subject string, body string, name string, data []byte) (error) {
+	var auth smtp.Auth
+	if *smtpUser != "" {
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		auth = smtp.PlainAuth("", *smtpUser, os.Getenv("WIDDLY_SMTP_PASS"), host)
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString("From: " + *smtpFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/octet-stream"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+	})
+	if err != nil {
+		return err
+	}
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		part.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	part.Write([]byte(enc + "\r\n"))
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return smtp.SendMail(*smtpAddr, auth, *smtpFrom, []string{to}, buf.Bytes())
+}
+
+// deadManSender returns how -deadman-days delivers the export to the -deadman-to URL.
+func deadManSender(to string) (func(ctx context.Context, name string, data []byte) (error), error) {
+	if strings.HasPrefix(to, "mailto:") {
+		if *smtpAddr == "" {
+			return nil, errors.New("-deadman-to mailto: needs -smtp")
+		}
+		addr := strings.TrimPrefix(to, "mailto:")
+		return func(ctx context.Context, name string, data []byte) (error) {
+			body := "No one logged in to the wiki for " + strconv.Itoa(*deadmanDays) + " days, its content is attached.\n" +
+				"Decrypt it with: widdly -decrypt " + name + " > tiddlers.json (the passphrase in $WIDDLY_DEADMAN_PASS),\n" +
+				"then drop tiddlers.json into any TiddlyWiki.\n"
+			return sendMailFile(addr, "Wiki archive: " + name, body, name, data)
+		}, nil
+	}
+	blobs, err := openRemote(to)
+	if err != nil {
+		return nil, err
+	}
+	if blobs == nil {
+		return nil, errors.New("-deadman-to must be mailto:, s3:// or http(s):// URL")
+	}
+	return func(ctx context.Context, name string, data []byte) (error) {
+		return blobs.Put(ctx, name, bytes.NewReader(data), int64(len(data)))
+	}, nil
+}
+
+// openRemote opens the file backend of an s3:// or http(s):// (WebDAV) URL, nil for other URLs.
+func openRemote(to string) (api.BlobBackend, error) {
+	switch {
+	case strings.HasPrefix(to, "s3://"):
+		return api.OpenBlobBackend("s3", to)
+	case strings.HasPrefix(to, "http://") || strings.HasPrefix(to, "https://"):
+		return api.OpenBlobBackend("webdav", to)
+	}
+	return nil, nil
+}
+
+// publishWriter returns how POST /admin/publish writes the snapshot to -publish-to:
+// index.html in a bucket or share, else the file.
+func publishWriter(to string) (func(ctx context.Context, page []byte) (error), error) {
+	blobs, err := openRemote(to)
+	if err != nil {
+		return nil, err
+	}
+	if blobs != nil {
+		return func(ctx context.Context, page []byte) (error) {
+			return blobs.Put(ctx, "index.html", bytes.NewReader(page), int64(len(page)))
+		}, nil
+	}
+	return func(ctx context.Context, page []byte) (error) {
+		tmp := to + ".tmp"
+		if err := ioutil.WriteFile(tmp, page, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, to)
+	}, nil
+}
+
+// startServer serves on ln, or on a new socket when nil; a SIGUSR2 hands the socket over
+// to a new process and sends on stop.
+func startServer(srv *http.Server, ln net.Listener, stop chan<- os.Signal) {
 	var err error
+	useTLS := *crtFile != "" && *keyFile != ""
+	if ln == nil {
+		addr := srv.Addr
+		if addr == "" {
+			addr = ":http"
+			if useTLS {
+				addr = ":https"
+			}
+		}
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Printf("HTTP server Listen: %v", err)
+			return
+		}
+	}
+	watchUpgrade(ln, stop)
 
 	// check tls
-	if *crtFile != "" && *keyFile != "" {
+	if useTLS {
 		cfg := &tls.Config{
 			MinVersion:               tls.VersionTLS12,
 			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -203,9 +1103,9 @@ func startServer(srv *http.Server) {
 		srv.TLSConfig = cfg
 		//srv.TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0) // disable http/2
 
-		err = srv.ListenAndServeTLS(*crtFile, *keyFile)
+		err = srv.ServeTLS(ln, *crtFile, *keyFile)
 	} else {
-		err = srv.ListenAndServe()
+		err = srv.Serve(ln)
 	}
 
 	if err != http.ErrServerClosed {
@@ -238,7 +1138,7 @@ func genCert(crtPath string, keyPath string) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 64)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("failed to generate serial number:", err)
+		log.Fatalf("failed to generate serial number: %s", err)
 	}
 
 	tmpl := &x509.Certificate{
@@ -271,10 +1171,49 @@ func genCert(crtPath string, keyPath string) {
 
 }
 
+// openAccounts opens the accounts kept in db, importing userlist into it when it has none.
+func openAccounts(db store.TiddlerStore, userlist map[string]*User) (*api.Accounts, error) {
+	ctx := context.Background()
+	accs, err := api.OpenAccounts(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if len(accs.Names()) > 0 || len(userlist) == 0 {
+		return accs, nil
+	}
+	for _, u := range userlist {
+		err := accs.Put(ctx, &api.UserRecord{Name: u.UID, Salt: u.Salt, Hash: u.Hash, Role: u.Role, Email: u.Email})
+		if err != nil {
+			return nil, err
+		}
+	}
+	fmt.Println("[user] imported", len(userlist), "accounts of", *accounts, "into the store")
+	return accs, nil
+}
+
+// buildInfo returns the version and build info injected by buildflags,
+// the commit and date recorded by the go tool when they were not.
+func buildInfo() (*api.BuildInfo) {
+	b := &api.BuildInfo{Version: VERSION, Commit: COMMIT, Date: BUILDDATE, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+	return b
+}
+
 type User struct {
 	UID            string
 	Salt           string
 	Hash           string
+	Role           string
+	Email          string
 }
 
 func readTSV(input io.ReadCloser) (map[string]*User, error) {
@@ -307,10 +1246,22 @@ func readTSV(input io.ReadCloser) (map[string]*User, error) {
 		salt := row[1]
 		hash := row[2]
 
+		role := "admin"
+		if len(row) > 3 && row[3] != "" {
+			role = row[3]
+		}
+
+		email := ""
+		if len(row) > 4 {
+			email = row[4]
+		}
+
 		list[uid] = &User{
 			UID: uid,
 			Salt: salt,
 			Hash: hash,
+			Role: role,
+			Email: email,
 		}
 	}
 
@@ -0,0 +1,21 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Optional features living in their own packages are compiled in here.
+// Each plugin registers itself with api.RegPlugin() in its init(),
+// gate them with build tags to keep the default binary small, e.g.
+//
+//	_ "./plugins/webhook" // in a plugins_webhook.go with "// +build webhook"
+import ()
@@ -0,0 +1,466 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package scripting runs the Starlark scripts of a directory on the tiddlers saved and served,
+// so admins can tag, rename or validate tiddlers without recompiling.
+// It is compiled in with -tags scripting, see plugins_scripting.go.
+package scripting
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"../../api"
+)
+
+const tiddlersPath = "/recipes/all/tiddlers/"
+
+var (
+	// Dir holds the *.star scripts, run in name order; empty for none.
+	Dir string
+
+	// Timeout bounds each call of a script which does not set its own timeout (in seconds).
+	Timeout = time.Second
+
+	// MaxSteps bounds the computation steps of each call, whatever the clock says.
+	MaxSteps uint64 = 10000000
+
+	once    sync.Once
+	scripts []*script
+)
+
+// script is a loaded *.star file. Its globals are frozen after loading,
+// so the calls share nothing and may run at once.
+type script struct {
+	name    string
+	timeout time.Duration
+	onSave  starlark.Callable // on_save(tiddler, user), may be nil
+	onGet   starlark.Callable // on_get(tiddler), may be nil
+}
+
+// Rejected is the refusal of a tiddler by reject() in a script.
+type Rejected struct {
+	Script string
+	Reason string
+}
+
+func (e *Rejected) Error() (string) {
+	return e.Script + ": " + e.Reason
+}
+
+func init() {
+	flag.StringVar(&Dir, "scripts", "", "directory of Starlark scripts (*.star) transforming the tiddlers saved and served, empty for none")
+	flag.DurationVar(&Timeout, "script-timeout", time.Second, "how long a script may run on one tiddler, unless it sets its own timeout")
+	err := api.RegPlugin(&api.Plugin{Name: "scripting", Middleware: middleware})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// middleware loads the scripts of Dir once, on the first route wrapped after the flags are parsed.
+func middleware(next http.HandlerFunc) http.HandlerFunc {
+	once.Do(func() {
+		if Dir == "" {
+			return
+		}
+		var err error
+		scripts, err = load(Dir)
+		if err != nil {
+			log.Fatalln("[scripts]", err)
+		}
+		log.Println("[scripts] loaded", len(scripts), "scripts from", Dir)
+	})
+	return wrap(scripts, next)
+}
+
+// wrap runs list on the tiddlers put to and got from next.
+func wrap(list []*script, next http.HandlerFunc) http.HandlerFunc {
+	if len(list) == 0 {
+		return next
+	}
+	serve := false
+	for _, s := range list {
+		serve = serve || s.onGet != nil
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, tiddlersPath) {
+			next(w, r)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			transformPut(w, r, list, next)
+		case "GET":
+			if !serve {
+				next(w, r)
+				return
+			}
+			transformGet(w, r, list, next)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+var predeclared = starlark.StringDict{
+	"reject": starlark.NewBuiltin("reject", reject),
+}
+
+// reject(reason) refuses the tiddler, the reason is sent to the browser.
+func reject(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var reason string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &reason); err != nil {
+		return nil, err
+	}
+	thread.SetLocal("reject", reason)
+	return nil, fmt.Errorf("rejected: %s", reason)
+}
+
+func printLog(thread *starlark.Thread, msg string) {
+	log.Println("[scripts]", thread.Name + ":", msg)
+}
+
+// load runs the *.star files of dir, in name order. Each must define on_save(tiddler, user),
+// on_get(tiddler) or both, and may set timeout to its own limit in seconds.
+func load(dir string) ([]*script, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.star"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	list := make([]*script, 0, len(names))
+	for _, name := range names {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		s := &script{name: filepath.Base(name), timeout: Timeout}
+		thread := s.thread()
+		timer := time.AfterFunc(Timeout, func() { thread.Cancel("timeout") })
+		globals, err := starlark.ExecFile(thread, s.name, src, predeclared)
+		timer.Stop()
+		if err != nil {
+			return nil, err
+		}
+
+		if v, ok := globals["timeout"]; ok {
+			secs, ok := starlark.AsFloat(v)
+			if !ok || secs <= 0 {
+				return nil, fmt.Errorf("%s: timeout must be a positive number of seconds, got %s", s.name, v)
+			}
+			s.timeout = time.Duration(secs * float64(time.Second))
+		}
+		s.onSave, _ = globals["on_save"].(starlark.Callable)
+		s.onGet, _ = globals["on_get"].(starlark.Callable)
+		if s.onSave == nil && s.onGet == nil {
+			return nil, fmt.Errorf("%s: defines neither on_save nor on_get", s.name)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// thread is a sandbox for one call: no load(), print goes to the log, a bounded number of steps.
+func (s *script) thread() (*starlark.Thread) {
+	thread := &starlark.Thread{Name: s.name, Print: printLog}
+	thread.SetMaxExecutionSteps(MaxSteps)
+	return thread
+}
+
+// call runs fn of s with the tiddler js and args, js is changed to what fn leaves or returns.
+func (s *script) call(ctx context.Context, fn starlark.Callable, js map[string]interface{}, args ...starlark.Value) (error) {
+	tiddler, err := toStarlark(js)
+	if err != nil {
+		return err
+	}
+
+	thread := s.thread()
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+
+	v, err := starlark.Call(thread, fn, append(starlark.Tuple{tiddler}, args...), nil)
+	if reason, ok := thread.Local("reject").(string); ok {
+		return &Rejected{Script: s.name, Reason: reason}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	if v == starlark.None { // changed in place
+		v = tiddler
+	}
+	if _, ok := v.(*starlark.Dict); !ok {
+		return fmt.Errorf("%s: %s returned %s, want a dict or None", s.name, fn.Name(), v.Type())
+	}
+	out, err := fromStarlark(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	for k := range js {
+		delete(js, k)
+	}
+	for k, x := range out.(map[string]interface{}) {
+		js[k] = x
+	}
+	return nil
+}
+
+// toStarlark converts decoded JSON, integral numbers become ints.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case int64: // left by an earlier script
+		return starlark.MakeInt64(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1 << 53 {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case []interface{}:
+		list := make([]starlark.Value, len(v))
+		for i, x := range v {
+			sv, err := toStarlark(x)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = sv
+		}
+		return starlark.NewList(list), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(v))
+		for _, k := range keys {
+			sv, err := toStarlark(v[k])
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(starlark.String(k), sv)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("cannot convert %T", v)
+}
+
+// fromStarlark converts a value left by a script back to JSON.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("int %s out of range", v)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", item[0])
+			}
+			x, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)] = x
+		}
+		return m, nil
+	case starlark.Indexable: // list, tuple
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			x, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = x
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("cannot store a %s", v.Type())
+}
+
+// isDraft tells whether js is the draft of a tiddler being edited, which scripts never see.
+func isDraft(js map[string]interface{}) (bool) {
+	fields, _ := js["fields"].(map[string]interface{})
+	_, ok := fields["draft.of"]
+	return ok
+}
+
+func textSum(js map[string]interface{}) (string) {
+	text, _ := js["text"].(string)
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// transformPut runs on_save on the tiddler put; a changed title saves it under that title.
+func transformPut(w http.ResponseWriter, r *http.Request, list []*script, next http.HandlerFunc) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var js map[string]interface{}
+	if json.Unmarshal(body, &js) != nil || js == nil || isDraft(js) {
+		next(w, r) // refused or saved as is
+		return
+	}
+	sum := strings.ToLower(strings.TrimSpace(r.Header.Get(api.ContentSHA256Header)))
+	if sum != "" && sum != textSum(js) {
+		next(w, r) // refused for the checksum
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, tiddlersPath)
+	user, _ := api.CurrentUser(r)
+	for _, s := range list {
+		if s.onSave == nil {
+			continue
+		}
+		err := s.call(r.Context(), s.onSave, js, starlark.String(user))
+		if rej, ok := err.(*Rejected); ok {
+			log.Println("[scripts]", key, "refused by", rej, "for", user)
+			http.Error(w, "refused by " + rej.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Printf("[scripts] [%s] %s: %v", api.RequestID(r), key, err)
+			http.Error(w, "a script failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	body, err = json.Marshal(js)
+	if err != nil {
+		http.Error(w, "a script failed", http.StatusInternalServerError)
+		return
+	}
+	r = r.Clone(r.Context())
+	if title, _ := js["title"].(string); title != "" && title != key {
+		r.URL.Path = tiddlersPath + title
+		r.URL.RawPath = ""
+	}
+	if sum != "" {
+		r.Header.Set(api.ContentSHA256Header, textSum(js))
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	next(w, r)
+}
+
+// recorder keeps a response for transformGet.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() (http.Header) {
+	return rec.header
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// transformGet runs on_get on the tiddler served, uncompressed so the outer gzip sees the result.
+func transformGet(w http.ResponseWriter, r *http.Request, list []*script, next http.HandlerFunc) {
+	r = r.Clone(r.Context())
+	r.Header.Del("Accept-Encoding")
+	rec := &recorder{header: w.Header().Clone()} // with the request id
+	next(rec, r)
+
+	js := make(map[string]interface{})
+	ok := rec.status == http.StatusOK && strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") &&
+		json.Unmarshal(rec.body.Bytes(), &js) == nil
+	if ok {
+		key := strings.TrimPrefix(r.URL.Path, tiddlersPath)
+		for _, s := range list {
+			if s.onGet == nil {
+				continue
+			}
+			if err := s.call(r.Context(), s.onGet, js); err != nil {
+				log.Printf("[scripts] [%s] %s: %v", api.RequestID(r), key, err)
+				http.Error(w, "a script failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		body, err := json.Marshal(js)
+		if err != nil {
+			http.Error(w, "a script failed", http.StatusInternalServerError)
+			return
+		}
+		rec.body.Reset()
+		rec.body.Write(body)
+		rec.header.Del("Content-Length")
+		rec.header.Set(api.ContentSHA256Header, textSum(js))
+	}
+
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	if rec.status != 0 {
+		w.WriteHeader(rec.status)
+	}
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,141 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scripting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../../api"
+)
+
+// writeScripts writes the scripts by file name into a new directory and loads them.
+func writeScripts(t *testing.T, files map[string]string) ([]*script, error) {
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return load(dir)
+}
+
+// backend saves the last tiddler put and serves it back.
+type backend struct {
+	path string
+	body []byte
+	sum  string
+}
+
+func (b *backend) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		b.path = r.URL.Path
+		b.body, _ = ioutil.ReadAll(r.Body)
+		b.sum = r.Header.Get(api.ContentSHA256Header)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b.body)
+}
+
+func put(h http.HandlerFunc, title string, js map[string]interface{}) (*httptest.ResponseRecorder) {
+	body, _ := json.Marshal(js)
+	req := httptest.NewRequest("PUT", tiddlersPath + url.PathEscape(title), strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+func TestTransforms(t *testing.T) {
+	list, err := writeScripts(t, map[string]string{
+		"10-tag.star": `
+def on_save(tiddler, user):
+    if "todo" in tiddler.get("text", "").lower():
+        tiddler["tags"] = tiddler.get("tags", []) + ["Todo"]
+    tiddler["title"] = tiddler["title"].strip()
+`,
+		"20-check.star": `
+def on_save(tiddler, user):
+    if tiddler.get("type") == "text/html":
+        reject("no HTML tiddlers, " + user)
+`,
+		"30-get.star": `
+def on_get(tiddler):
+    return dict(tiddler, served = "yes")
+`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend{}
+	h := wrap(list, b.serve)
+
+	w := put(h, " Shopping ", map[string]interface{}{"title": " Shopping ", "text": "TODO: milk", "tags": []interface{}{"list"}, "revision": 3})
+	if w.Code != http.StatusNoContent || b.path != tiddlersPath + "Shopping" {
+		t.Fatalf("want the normalized title saved, got %d at %q", w.Code, b.path)
+	}
+	var saved map[string]interface{}
+	json.Unmarshal(b.body, &saved)
+	if tags, _ := json.Marshal(saved["tags"]); string(tags) != `["list","Todo"]` || saved["revision"] != 3.0 {
+		t.Errorf("want the Todo tag added and the rest kept, got %s", b.body)
+	}
+
+	w = put(h, "Page", map[string]interface{}{"title": "Page", "type": "text/html"})
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "20-check.star: no HTML tiddlers") {
+		t.Errorf("want the tiddler refused by 20-check.star, got %d %q", w.Code, w.Body.String())
+	}
+
+	draft := map[string]interface{}{"title": "Draft of ' x'", "fields": map[string]interface{}{"draft.of": " x"}}
+	if put(h, "Draft of ' x'", draft); !strings.HasSuffix(b.path, "Draft of ' x'") {
+		t.Errorf("want drafts saved as is, got %q", b.path)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", tiddlersPath + url.PathEscape("Draft of ' x'"), nil))
+	var served map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &served)
+	if served["served"] != "yes" || w.Header().Get(api.ContentSHA256Header) != textSum(served) {
+		t.Errorf("want the field added by on_get and the text checksum, got %s", w.Body.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	list, err := writeScripts(t, map[string]string{"loop.star": `
+timeout = 0.05
+
+def on_save(tiddler, user):
+    for i in range(1 << 40):
+        pass
+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend{}
+	if w := put(wrap(list, b.serve), "A", map[string]interface{}{"title": "A"}); w.Code != http.StatusInternalServerError || b.path != "" {
+		t.Errorf("want a failed script to refuse the save, got %d", w.Code)
+	}
+
+	for _, src := range []string{"x = (", "y = 1", `load("other.star", "f")`, "timeout = -1\ndef on_get(t):\n    pass"} {
+		if _, err := writeScripts(t, map[string]string{"bad.star": src}); err == nil {
+			t.Errorf("want an error loading %q", src)
+		}
+	}
+}
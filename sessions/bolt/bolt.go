@@ -0,0 +1,167 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package bolt keeps the widdly login sessions in a BoltDB file, so they survive restarts.
+package bolt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"../../api"
+)
+
+const (
+	TypeName = "bbolt"
+)
+
+var bucket = []byte("sessions")
+
+type boltSessions struct {
+	db      *bolt.DB
+	evicted uint64
+}
+
+func init() {
+	api.RegSessionBackend(TypeName, Open)
+}
+
+// Open opens or creates the session file at path.
+func Open(path string) (api.SessionBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltSessions{db: db}, nil
+}
+
+func (s *boltSessions) Load(sid string) (*api.SessionData, error) {
+	var d *api.SessionData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(sid))
+		if data == nil {
+			return nil
+		}
+		d = new(api.SessionData)
+		return json.Unmarshal(data, d)
+	})
+	return d, err
+}
+
+func (s *boltSessions) Save(sid string, d *api.SessionData) (error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(sid)) == nil {
+			if err := s.evict(b); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(sid), data)
+	})
+}
+
+// evict drops the sessions api.EvictSessions picks when the bucket is full.
+func (s *boltSessions) evict(b *bolt.Bucket) (error) {
+	if b.Stats().KeyN < api.SessionCountLimit {
+		return nil
+	}
+	list := make(map[string]*api.SessionData)
+	err := b.ForEach(func(k, v []byte) error {
+		d := new(api.SessionData)
+		if json.Unmarshal(v, d) == nil {
+			list[string(k)] = d
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sid := range api.EvictSessions(list) {
+		if err := b.Delete([]byte(sid)); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.evicted, 1)
+	}
+	return nil
+}
+
+func (s *boltSessions) Evicted() (uint64) {
+	return atomic.LoadUint64(&s.evicted)
+}
+
+func (s *boltSessions) Delete(sid string) (error) {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(sid))
+	})
+}
+
+func (s *boltSessions) Expire(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var d api.SessionData
+			if json.Unmarshal(v, &d) == nil && !now.After(d.Expires) {
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltSessions) List() (map[string]*api.SessionData, error) {
+	list := make(map[string]*api.SessionData)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			d := new(api.SessionData)
+			if json.Unmarshal(v, d) == nil {
+				list[string(k)] = d
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltSessions) Len() (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltSessions) Close() (error) {
+	return s.db.Close()
+}
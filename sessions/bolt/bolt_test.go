@@ -0,0 +1,31 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"../../api"
+	"../sessiontest"
+)
+
+func openTemp(dir string) (api.SessionBackend, error) {
+	return Open(filepath.Join(dir, "sessions.db"))
+}
+
+func TestSessions(t *testing.T) {
+	sessiontest.Run(t, openTemp)
+	sessiontest.RunLimit(t, openTemp)
+}
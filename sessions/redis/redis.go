@@ -0,0 +1,194 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package redis keeps the widdly login sessions in Redis, so several instances can share them.
+package redis
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"../../api"
+)
+
+const (
+	TypeName = "redis"
+
+	// KeyPrefix starts the keys of the sessions.
+	KeyPrefix = "widdly:session:"
+)
+
+type redisSessions struct {
+	pool    *redis.Pool
+	evicted uint64
+}
+
+func init() {
+	api.RegSessionBackend(TypeName, Open)
+}
+
+// Open connects to the server at url, e.g. redis://:password@localhost:6379/0.
+func Open(url string) (api.SessionBackend, error) {
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url)
+		},
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &redisSessions{pool: pool}, nil
+}
+
+func (s *redisSessions) Load(sid string) (*api.SessionData, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", KeyPrefix + sid))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := new(api.SessionData)
+	return d, json.Unmarshal(data, d)
+}
+
+// Save stores the session with a TTL, so Redis expires it by itself.
+// The instances sharing the server may briefly hold a few sessions over api.SessionCountLimit together.
+func (s *redisSessions) Save(sid string, d *api.SessionData) (error) {
+	ttl := time.Until(d.Expires)
+	if ttl <= 0 {
+		return s.Delete(sid)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("EXISTS", KeyPrefix + sid))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := s.evict(); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("SET", KeyPrefix + sid, data, "PX", int64(ttl / time.Millisecond))
+	return err
+}
+
+// evict drops the sessions api.EvictSessions picks when the server holds api.SessionCountLimit of them.
+func (s *redisSessions) evict() (error) {
+	n, err := s.Len()
+	if err != nil || n < api.SessionCountLimit {
+		return err
+	}
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, sid := range api.EvictSessions(list) {
+		if err := s.Delete(sid); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.evicted, 1)
+	}
+	return nil
+}
+
+func (s *redisSessions) Evicted() (uint64) {
+	return atomic.LoadUint64(&s.evicted)
+}
+
+func (s *redisSessions) Delete(sid string) (error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", KeyPrefix + sid)
+	return err
+}
+
+// Expire does nothing, the keys have a TTL.
+func (s *redisSessions) Expire(now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *redisSessions) List() (map[string]*api.SessionData, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	list := make(map[string]*api.SessionData)
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", KeyPrefix + "*", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, k := range keys {
+				args[i] = k
+			}
+			values, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return nil, err
+			}
+			for i, data := range values {
+				d := new(api.SessionData)
+				if data != nil && json.Unmarshal(data, d) == nil { // nil when expired since SCAN
+					list[keys[i][len(KeyPrefix):]] = d
+				}
+			}
+		}
+		if cursor == 0 {
+			return list, nil
+		}
+	}
+}
+
+func (s *redisSessions) Len() (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n := 0
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", KeyPrefix + "*", "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		n += len(keys)
+		if cursor == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (s *redisSessions) Close() (error) {
+	return s.pool.Close()
+}
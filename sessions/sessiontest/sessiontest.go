@@ -0,0 +1,106 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sessiontest contains shared tests for api.SessionBackend implementations.
+package sessiontest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"../../api"
+)
+
+// OpenFn opens a fresh, empty session backend inside dir.
+type OpenFn func(dir string) (api.SessionBackend, error)
+
+func open(t *testing.T, fn OpenFn) api.SessionBackend {
+	b, err := fn(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func session(login bool, expires time.Time) *api.SessionData {
+	d := &api.SessionData{Values: map[string]interface{}{}, Expires: expires}
+	if login {
+		d.Values["uid"] = "me"
+	}
+	return d
+}
+
+// Run checks the Save/Load/Delete contract of a backend.
+func Run(t *testing.T, fn OpenFn) {
+	b := open(t, fn)
+	defer b.Close()
+
+	if d, err := b.Load("nope"); d != nil || err != nil {
+		t.Errorf("missing session: got %v, %v", d, err)
+	}
+	if err := b.Save("a", session(true, time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	d, err := b.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Values["uid"] != "me" {
+		t.Errorf("want the saved session, got %+v", d)
+	}
+	if err := b.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := b.Load("a"); d != nil {
+		t.Errorf("deleted session loaded")
+	}
+}
+
+// RunLimit checks that a backend keeps at most api.SessionCountLimit sessions,
+// dropping guests before logged in users and then the least recently used, like the memory backend.
+func RunLimit(t *testing.T, fn OpenFn) {
+	defer func(n int) { api.SessionCountLimit = n }(api.SessionCountLimit)
+	api.SessionCountLimit = 3
+
+	b := open(t, fn)
+	defer b.Close()
+
+	now := time.Now().Add(time.Hour)
+	save := func(sid string, d *api.SessionData) {
+		if err := b.Save(sid, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("user1", session(true, now))
+	save("user2", session(true, now.Add(time.Minute)))
+	save("guest", session(false, now.Add(time.Hour)))
+	save("user1", session(true, now)) // saving an existing session drops none
+
+	for i, want := range []string{"guest", "user1", "user2"} {
+		sid := fmt.Sprintf("new%d", i)
+		save(sid, session(true, now.Add(time.Duration(10 + i) * time.Minute)))
+		if d, _ := b.Load(want); d != nil {
+			t.Errorf("saving %s: %s not evicted", sid, want)
+		}
+		if d, _ := b.Load(sid); d == nil {
+			t.Errorf("%s not saved", sid)
+		}
+		if n, err := b.Len(); err != nil || n != 3 {
+			t.Errorf("saving %s: want 3 sessions, got %d, %v", sid, n, err)
+		}
+	}
+	if ev, ok := b.(interface{ Evicted() (uint64) }); ok && ev.Evicted() != 3 {
+		t.Errorf("want 3 evicted, got %d", ev.Evicted())
+	}
+}
@@ -0,0 +1,551 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package badger is a BadgerDB TiddlerStore backend, faster than bolt for frequent writes.
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+
+	"../../store"
+)
+
+const (
+	TypeName = "badger"
+)
+
+var (
+	// GCInterval is how often the value log is garbage collected, besides on Close.
+	GCInterval = 10 * time.Minute
+
+	// GCDiscardRatio is the share of stale data which makes a value log file rewritten.
+	GCDiscardRatio = 0.5
+)
+
+// badgerStore keeps, in byte order of the keys:
+//
+//	h:<key>\x00<revision, 8 bytes big endian>   the history, fat JSON
+//	m:<key>                                     the meta (JSON without text)
+//	t:<key>                                     the text
+type badgerStore struct {
+	db       *badger.DB
+	maxRev   int
+	histSize store.HistorySize
+
+	done      chan struct{}
+	gcDone    sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open opens the BadgerDB directory specified as dataSource, creating it when missing,
+// and starts the value log garbage collection.
+func Open(dataSource string) (store.TiddlerStore, error) {
+	opts := badger.DefaultOptions(dataSource).WithLoggingLevel(badger.WARNING)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &badgerStore{db: db, maxRev: -1, done: make(chan struct{})}
+	s.gcDone.Add(1)
+	go s.gcLoop()
+	return s, nil
+}
+
+// gcLoop runs the value log garbage collection every GCInterval until Close.
+func (s *badgerStore) gcLoop() {
+	defer s.gcDone.Done()
+	tick := time.NewTicker(GCInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+			s.runGC()
+		}
+	}
+}
+
+// runGC rewrites value log files until none is worth it.
+func (s *badgerStore) runGC() {
+	for {
+		err := s.db.RunValueLogGC(GCDiscardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			return
+		}
+		if err != nil {
+			log.Println("[badger] value log GC error", err)
+			return
+		}
+	}
+}
+
+// Close stops the periodic garbage collection, runs it a last time and closes the database.
+func (s *badgerStore) Close() error {
+	err := error(nil)
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.gcDone.Wait()
+		s.runGC()
+		err = s.db.Close()
+	})
+	return err
+}
+
+func metaKey(key string) ([]byte) {
+	return []byte("m:" + key)
+}
+
+func textKey(key string) ([]byte) {
+	return []byte("t:" + key)
+}
+
+// historyPrefix is the prefix of the history keys of key, ending at the NUL byte.
+func historyPrefix(key string) ([]byte) {
+	return []byte("h:" + key + "\x00")
+}
+
+func historyKey(key string, rev int) ([]byte) {
+	k := historyPrefix(key)
+	return binary.BigEndian.AppendUint64(k, uint64(rev))
+}
+
+// parseHistoryKey returns the tiddler key and revision of a history key.
+func parseHistoryKey(k []byte) (string, int, bool) {
+	if len(k) < 2 + 9 || !bytes.HasPrefix(k, []byte("h:")) || k[len(k)-9] != 0 {
+		return "", 0, false
+	}
+	return string(k[2:len(k)-9]), int(binary.BigEndian.Uint64(k[len(k)-8:])), true
+}
+
+// getValue returns a copy of the value of k, nil when missing.
+func getValue(txn *badger.Txn, k []byte) ([]byte, error) {
+	item, err := txn.Get(k)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *badgerStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
+	key = store.StoreKey(key)
+	var meta, text []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		meta, err = getValue(txn, metaKey(key))
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			return store.ErrNotFound
+		}
+		text, err = getValue(txn, textKey(key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if text == nil {
+		text = []byte{}
+	}
+	return store.NewTiddler(meta, text)
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store, in key order.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+func (s *badgerStore) All(_ context.Context) ([]*store.Tiddler, error) {
+	tiddlers := make([]*store.Tiddler, 0)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("m:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			meta, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			var text []byte
+			if store.IsFat(meta) {
+				text, err = getValue(txn, textKey(string(item.Key()[2:])))
+				if err != nil {
+					return err
+				}
+				if text == nil {
+					text = []byte{}
+				}
+			}
+			t, err := store.NewTiddler(meta, text)
+			if err != nil {
+				continue
+			}
+			tiddlers = append(tiddlers, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// revisionOf returns the revision in meta, 1 when missing.
+func revisionOf(meta []byte) (int) {
+	var m struct{ Revision int }
+	if meta != nil && json.Unmarshal(meta, &m) == nil && m.Revision > 0 {
+		return m.Revision
+	}
+	return 1
+}
+
+// historyRevs lists the revisions in the history of key.
+func historyRevs(txn *badger.Txn, key string) ([]int) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = historyPrefix(key)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	revs := make([]int, 0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if _, rev, ok := parseHistoryKey(it.Item().Key()); ok {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// Concurrent Puts of a title conflict and are retried, so they get distinct revisions.
+// The tiddler is also written to the history.
+func (s *badgerStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+
+	for {
+		var rev int
+		var added int64
+		err := s.db.Update(func(txn *badger.Txn) error {
+			var err error
+			rev, added, err = s.put(txn, tiddler, text)
+			return err
+		})
+		if err == badger.ErrConflict {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if added > 0 {
+			s.checkHistorySize(added)
+		}
+		return rev, nil
+	}
+}
+
+// put is Put inside txn, with the text taken out of tiddler.Js (so it can be retried).
+// It also returns the size added to the history.
+func (s *badgerStore) put(txn *badger.Txn, tiddler store.Tiddler, text string) (int, int64, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	old, err := getValue(txn, metaKey(tiddler.Key))
+	if err != nil {
+		return 0, 0, err
+	}
+	rev := revisionOf(old) + 1
+	tiddler.Js["revision"] = rev
+	meta, err := json.Marshal(tiddler.Js)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := txn.Set(metaKey(tiddler.Key), meta); err != nil {
+		return 0, 0, err
+	}
+	if err := txn.Set(textKey(tiddler.Key), []byte(text)); err != nil {
+		return 0, 0, err
+	}
+
+	// skip Draft & system key history
+	if s.maxRev == 0 || tiddler.IsDraft || tiddler.IsSys {
+		return rev, 0, nil
+	}
+	// remove old history
+	if s.maxRev > 0 && rev - s.maxRev > 1 {
+		for _, hrev := range historyRevs(txn, tiddler.Key) {
+			if hrev > rev - 1 - s.maxRev {
+				continue
+			}
+			if err := txn.Delete(historyKey(tiddler.Key, hrev)); err != nil {
+				return 0, 0, err
+			}
+		}
+		s.histSize.Reset()
+	}
+	var data bytes.Buffer
+	if err := store.WriteFatJSON(&data, meta, bytes.NewReader([]byte(text))); err != nil {
+		return 0, 0, err
+	}
+	hkey := historyKey(tiddler.Key, rev)
+	if err := txn.Set(hkey, data.Bytes()); err != nil {
+		return 0, 0, err
+	}
+	return rev, int64(len(hkey) + data.Len()), nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *badgerStore) Delete(_ context.Context, key string) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return del(txn, key)
+	})
+	if err != nil {
+		return err
+	}
+	s.histSize.Reset()
+	return nil
+}
+
+// del is Delete inside txn.
+func del(txn *badger.Txn, key string) error {
+	key = store.StoreKey(key)
+	for _, rev := range historyRevs(txn, key) {
+		if err := txn.Delete(historyKey(key, rev)); err != nil {
+			return err
+		}
+	}
+	if err := txn.Delete(metaKey(key)); err != nil {
+		return err
+	}
+	return txn.Delete(textKey(key))
+}
+
+// Batch applies ops in one transaction, retried when it conflicts with another one.
+func (s *badgerStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	texts := make([]string, len(ops))
+	for i, op := range ops {
+		if !op.Delete {
+			texts[i], _ = op.Tiddler.Js["text"].(string)
+			delete(op.Tiddler.Js, "text")
+		}
+	}
+
+	for {
+		revs := make([]int, len(ops))
+		var added int64
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for i, op := range ops {
+				meta, err := getValue(txn, metaKey(store.StoreKey(op.Tiddler.Key)))
+				if err != nil {
+					return err
+				}
+				cur := 0
+				if meta != nil {
+					cur = revisionOf(meta)
+				}
+				if err := store.CheckRev(ops, i, cur); err != nil {
+					return err
+				}
+
+				if op.Delete {
+					err = del(txn, op.Tiddler.Key)
+				} else {
+					var n int64
+					revs[i], n, err = s.put(txn, op.Tiddler, texts[i])
+					added += n
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == badger.ErrConflict {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.histSize.Reset()
+		if added > 0 {
+			s.checkHistorySize(added)
+		}
+		return revs, nil
+	}
+}
+
+func (s *badgerStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *badgerStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// Audit checks the newest revision in the history of every tiddler against the tiddler.
+func (s *badgerStore) Audit(_ context.Context, repair bool) ([]store.Divergence, error) {
+	divs := make([]store.Divergence, 0)
+	audit := func(txn *badger.Txn) error {
+		latest := make(map[string]int)
+		for _, e := range historyEntries(txn) {
+			if e.Rev > latest[e.Key] {
+				latest[e.Key] = e.Rev
+			}
+		}
+
+		metas := make(map[string][]byte)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("m:")
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			meta, err := item.ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			key := string(item.Key()[2:])
+			head := revisionOf(meta)
+			if store.Diverges(meta, head, latest[key], s.maxRev != 0) {
+				divs = append(divs, store.Divergence{Key: key, Head: head, Latest: latest[key]})
+				metas[key] = meta
+			}
+		}
+		it.Close()
+		if !repair {
+			return nil
+		}
+
+		for _, d := range divs {
+			for _, rev := range historyRevs(txn, d.Key) {
+				if rev < d.Head {
+					continue
+				}
+				if err := txn.Delete(historyKey(d.Key, rev)); err != nil {
+					return err
+				}
+			}
+			if s.maxRev == 0 || store.NoHistory(metas[d.Key]) {
+				continue
+			}
+			text, err := getValue(txn, textKey(d.Key))
+			if err != nil {
+				return err
+			}
+			var data bytes.Buffer
+			if err := store.WriteFatJSON(&data, metas[d.Key], bytes.NewReader(text)); err != nil {
+				return err
+			}
+			if err := txn.Set(historyKey(d.Key, d.Head), data.Bytes()); err != nil {
+				return err
+			}
+		}
+		s.histSize.Reset()
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = s.db.Update(audit)
+	} else {
+		err = s.db.View(audit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history, Seq is the commit version of each.
+func historyEntries(txn *badger.Txn) ([]store.HistoryEntry) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte("h:")
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	entries := make([]store.HistoryEntry, 0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key, rev, ok := parseHistoryKey(item.Key())
+		if !ok {
+			continue
+		}
+		entries = append(entries, store.HistoryEntry{
+			Key: key,
+			Rev: rev,
+			Size: int64(len(item.Key())) + int64(item.ValueSize()),
+			Seq: int64(item.Version()),
+		})
+	}
+	return entries
+}
+
+func (s *badgerStore) historySize() (int64, error) {
+	var total int64
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, e := range historyEntries(txn) {
+			total += e.Size
+		}
+		return nil
+	})
+	return total, err
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *badgerStore) checkHistorySize(added int64) {
+	if !s.histSize.Grow(added, s.historySize) {
+		return
+	}
+
+	var del []store.HistoryEntry
+	var total int64
+	err := s.db.Update(func(txn *badger.Txn) error {
+		del, total = s.histSize.Prune(historyEntries(txn))
+		for _, e := range del {
+			if err := txn.Delete(historyKey(e.Key, e.Rev)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("[badger] prune history error", err)
+		s.histSize.Reset()
+		return
+	}
+	log.Printf("[badger] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
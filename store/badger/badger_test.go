@@ -0,0 +1,40 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package badger
+
+import (
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../storetest"
+)
+
+func openTemp(dir string) (store.TiddlerStore, error) {
+	return Open(filepath.Join(dir, "widdly.badger"))
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp)
+}
@@ -0,0 +1,56 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// Op is a Put or a Delete of a batch, see BatchStore.
+type Op struct {
+	Tiddler Tiddler // Key is the title, Js the tiddler to put (unused by Delete)
+	Delete  bool
+	IfRev   int // when not 0, the revision the tiddler must have; 0 for any
+}
+
+// ConflictError is returned by BatchStore.Batch when the IfRev of an Op does not match.
+type ConflictError struct {
+	Index int    // of the Op
+	Key   string
+	Rev   int    // the current revision, 0 when the tiddler is missing
+}
+
+func (e *ConflictError) Error() (string) {
+	if e.Rev == 0 {
+		return fmt.Sprintf("op %d: %q does not exist", e.Index, e.Key)
+	}
+	return fmt.Sprintf("op %d: %q is at revision %d", e.Index, e.Key, e.Rev)
+}
+
+// CheckRev checks the IfRev of ops[i] against rev, the current revision of its tiddler (0 when missing).
+func CheckRev(ops []Op, i int, rev int) (error) {
+	if ops[i].IfRev != 0 && ops[i].IfRev != rev {
+		return &ConflictError{Index: i, Key: ops[i].Tiddler.Key, Rev: rev}
+	}
+	return nil
+}
+
+// BatchStore is implemented by backends which can apply several operations in one transaction.
+type BatchStore interface {
+	// Batch applies ops in order, all or none of them. It returns the revision of each put
+	// (0 for deletes), or a *ConflictError when the IfRev of one does not match.
+	// Deleting a missing tiddler is no error.
+	Batch(ctx context.Context, ops []Op) ([]int, error)
+}
@@ -19,6 +19,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"sort"
 	"strconv"
 
 	bolt "go.etcd.io/bbolt"
@@ -34,6 +36,7 @@ const (
 type boltStore struct {
 	db *bolt.DB
 	maxRev int
+	histSize store.HistorySize
 }
 
 func init() {
@@ -49,13 +52,55 @@ func copyOf(p []byte) []byte {
 	return q
 }
 
+// options returns the bbolt options of store.BackendOptions:
+//
+//	readonly        open the file read-only, saves fail (other processes may read it too)
+//	nosync          skip fsync after each save, much faster bulk imports, a power loss may corrupt the file
+//	freelist        array (default) or hashmap, faster for large files with much free space
+//	mmap            initial memory map size, e.g. 256M, avoids remapping while the file grows
+func options() (*bolt.Options, error) {
+	o := store.BackendOptions
+	if err := o.Check(TypeName, "readonly", "nosync", "freelist", "mmap"); err != nil {
+		return nil, err
+	}
+	opts := &bolt.Options{Timeout: bolt.DefaultOptions.Timeout, NoGrowSync: bolt.DefaultOptions.NoGrowSync, FreelistType: bolt.FreelistArrayType}
+	var err error
+	if opts.ReadOnly, err = o.Bool("readonly", false); err != nil {
+		return nil, err
+	}
+	if opts.NoSync, err = o.Bool("nosync", false); err != nil {
+		return nil, err
+	}
+	switch f := o.String("freelist", "array"); f {
+	case "array":
+	case "hashmap", "map":
+		opts.FreelistType = bolt.FreelistMapType
+	default:
+		return nil, fmt.Errorf("%s: option freelist: want array or hashmap, got %q", TypeName, f)
+	}
+	mmap, err := o.Size("mmap", 0)
+	if err != nil {
+		return nil, err
+	}
+	opts.InitialMmapSize = int(mmap)
+	return opts, nil
+}
+
 // Open opens the BoltDB file specified as dataSource,
 // creates the necessary buckets and returns a TiddlerStore.
+// It is tuned by store.BackendOptions, see options.
 func Open(dataSource string) (store.TiddlerStore, error) {
-	db, err := bolt.Open(dataSource, 0600, nil)
+	opts, err := options()
 	if err != nil {
 		return nil, err
 	}
+	db, err := bolt.Open(dataSource, 0600, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReadOnly {
+		return &boltStore{db: db, maxRev: -1}, nil
+	}
 	err = db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("tiddler"))
 		if err != nil {
@@ -70,7 +115,7 @@ func Open(dataSource string) (store.TiddlerStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &boltStore{db, -1}, nil
+	return &boltStore{db: db, maxRev: -1}, nil
 }
 
 func (s *boltStore) Close() error {
@@ -82,6 +127,7 @@ func (s *boltStore) Close() error {
 
 // Get retrieves a tiddler from the store by key (title).
 func (s *boltStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
+	key = store.StoreKey(key)
 	var meta []byte
 	var tiddler []byte
 	err := s.db.View(func(tx *bolt.Tx) error {
@@ -105,7 +151,7 @@ func (s *boltStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
 
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
-// Special tiddlers (like global macros) are returned fat.
+// Tiddlers tagged with one of store.FatTags are returned fat.
 func (s *boltStore) All(_ context.Context) ([]*store.Tiddler, error) {
 	tiddlers := make([]*store.Tiddler, 0)
 	err := s.db.View(func(tx *bolt.Tx) error {
@@ -119,7 +165,7 @@ func (s *boltStore) All(_ context.Context) ([]*store.Tiddler, error) {
 
 			var tiddler []byte
 			_, text := c.Next()
-			if bytes.Contains(meta, []byte(`"$:/tags/Macro"`)) {
+			if store.IsFat(meta) {
 				tiddler = copyOf(text)
 			}
 
@@ -131,6 +177,71 @@ func (s *boltStore) All(_ context.Context) ([]*store.Tiddler, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the cursor order is close, but "ab|1" comes before "a|1"
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// AllPage is All from the first key after the cursor after, at most limit tiddlers.
+// The bucket keeps a key as "<key>|1", so a key sorts after the longer keys it starts
+// when they go on with a byte below "|": the cursor walks from after until the page is
+// full and a key sorts after its last one, then the keys starting that one are looked up.
+func (s *boltStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	if limit <= 0 {
+		tiddlers, err := s.All(ctx)
+		return store.PageOf(tiddlers, after, limit), err
+	}
+	type entry struct {
+		key string
+		t   *store.Tiddler
+	}
+	page := make([]entry, 0, limit) // sorted by key
+	add := func(b *bolt.Bucket, key string, meta []byte) {
+		if key <= after || len(meta) == 0 {
+			return
+		}
+		i := sort.Search(len(page), func(i int) bool { return page[i].key >= key })
+		if i == limit || (i < len(page) && page[i].key == key) {
+			return
+		}
+		var text []byte
+		if store.IsFat(meta) {
+			text = copyOf(b.Get([]byte(key + "|2")))
+		}
+		t, _ := store.NewTiddler(copyOf(meta), text)
+		if len(page) < limit {
+			page = append(page, entry{})
+		}
+		copy(page[i+1:], page[i:])
+		page[i] = entry{key, t}
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tiddler"))
+		c := b.Cursor()
+		for k, meta := c.Seek([]byte(after)); k != nil; k, meta = c.Next() {
+			if !bytes.HasSuffix(k, []byte("|1")) {
+				continue // text
+			}
+			key := string(k[:len(k) - 2])
+			if len(page) == limit && key >= page[limit - 1].key {
+				// the keys left sort after key, but the ones key starts with
+				for n := 1; n < len(key); n++ {
+					add(b, key[:n], b.Get([]byte(key[:n] + "|1")))
+				}
+				break
+			}
+			add(b, key, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tiddlers := make([]*store.Tiddler, len(page))
+	for i, e := range page {
+		tiddlers[i] = e.t
+	}
 	return tiddlers, nil
 }
 
@@ -149,8 +260,8 @@ func (s *boltStore) trimRevision(b *bolt.Bucket, key string, rev int) (err error
 	prefix := []byte(fmt.Sprintf("%s#", key))
 	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
 		idx := bytes.LastIndexByte(k, byte('#'))
-		if idx < 0 {
-			return
+		if idx != len(prefix) - 1 { // the history of a longer title, "a#b#2" for "a"
+			continue
 		}
 
 		krev64, _ := strconv.ParseInt(string(k[idx+1:]), 10, 64)
@@ -170,92 +281,336 @@ func (s *boltStore) trimRevision(b *bolt.Bucket, key string, rev int) (err error
 func (s *boltStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
 	var rev int
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(tiddler.Key + "|1")
+		var err error
+		rev, err = s.put(tx, tiddler)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
 
-		rev = getLastRevision(b, mkey) + 1
-		tiddler.Js["revision"] = rev
+// put is Put inside tx.
+func (s *boltStore) put(tx *bolt.Tx, tiddler store.Tiddler) (int, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	b := tx.Bucket([]byte("tiddler"))
+	mkey := []byte(tiddler.Key + "|1")
 
-		var data []byte
-		var err error
-		if s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys { // skip Draft & system key history
-			data, err = tiddler.MarshalJSON() // meta with text & rev
-			if err != nil {
-				return err
-			}
-		}
+	rev := getLastRevision(b, mkey) + 1
+	tiddler.Js["revision"] = rev
 
-		text, _ := tiddler.Js["text"].(string)
-		delete(tiddler.Js, "text")
-		meta, err := json.Marshal(tiddler.Js)
+	var data []byte
+	var err error
+	if s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys { // skip Draft & system key history
+		data, err = tiddler.MarshalJSON() // meta with text & rev
 		if err != nil {
-			return err
+			return 0, err
+		}
+	}
+
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	meta, err := json.Marshal(tiddler.Js)
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.Put(mkey, meta)
+	if err != nil {
+		return 0, err
+	}
+	err = b.Put([]byte(tiddler.Key+"|2"), []byte(text))
+	if err != nil {
+		return 0, err
+	}
+
+	// skip Draft & system key history
+	if s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys {
+		history := tx.Bucket([]byte("tiddler_history"))
+
+		// remove old history
+		if s.maxRev > 0 && rev - s.maxRev > 1 {
+			s.trimRevision(history, tiddler.Key, rev - 1 - s.maxRev)
+			s.histSize.Reset()
 		}
 
-		err = b.Put(mkey, meta)
+		hkey := []byte(fmt.Sprintf("%s#%d", tiddler.Key, rev))
+		err = history.Put(hkey, data)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		err = b.Put([]byte(tiddler.Key+"|2"), []byte(text))
+
+		err = s.checkHistorySize(history, int64(len(hkey) + len(data)))
 		if err != nil {
-			return err
+			return 0, err
 		}
+	}
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *boltStore) Delete(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.del(tx, key)
+	})
+}
 
-		// skip Draft & system key history
-		if s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys {
-			history := tx.Bucket([]byte("tiddler_history"))
+// del is Delete inside tx.
+func (s *boltStore) del(tx *bolt.Tx, key string) error {
+	key = store.StoreKey(key)
+	b := tx.Bucket([]byte("tiddler"))
+	mkey := []byte(key + "|1")
 
-			// remove old history
-			if s.maxRev > 0 && rev - s.maxRev > 1 {
-				s.trimRevision(history, tiddler.Key, rev - 1 - s.maxRev)
+	rev := getLastRevision(b, mkey)
+
+	err := b.Delete(mkey)
+	if err != nil {
+		return err
+	}
+	err = b.Delete([]byte(key+"|2"))
+	if err != nil {
+		return err
+	}
+
+	// remove all history
+	history := tx.Bucket([]byte("tiddler_history"))
+	err = s.trimRevision(history, key, rev)
+	if err != nil {
+		return err
+	}
+	s.histSize.Reset()
+	return nil
+}
+
+// Batch applies ops in one transaction.
+func (s *boltStore) Batch(_ context.Context, ops []store.Op) ([]int, error) {
+	revs := make([]int, len(ops))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tiddler"))
+		for i, op := range ops {
+			mkey := []byte(store.StoreKey(op.Tiddler.Key) + "|1")
+			cur := 0
+			if b.Get(mkey) != nil {
+				cur = getLastRevision(b, mkey)
+			}
+			if err := store.CheckRev(ops, i, cur); err != nil {
+				return err
 			}
 
-			err = history.Put([]byte(fmt.Sprintf("%s#%d", tiddler.Key, rev)), data)
+			var err error
+			if op.Delete {
+				err = s.del(tx, op.Tiddler.Key)
+			} else {
+				revs[i], err = s.put(tx, op.Tiddler)
+			}
 			if err != nil {
 				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		s.histSize.Reset()
+		return nil, err
+	}
+	return revs, nil
+}
+
+func (s *boltStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *boltStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
 
+// ListRevisions returns the revisions of key in the tiddler_history bucket, newest first.
+func (s *boltStore) ListRevisions(_ context.Context, key string) ([]store.Revision, error) {
+	key = store.StoreKey(key)
+	revs := make([]store.Revision, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("tiddler_history")).Cursor()
+		prefix := []byte(key + "#")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rev, err := strconv.Atoi(string(k[len(prefix):]))
+			if err != nil { // the history of a longer title, "a#b#2" for "a"
+				continue
+			}
+			_, r, err := store.ParseRevision(rev, v)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, r)
+		}
 		return nil
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return rev, nil
+	store.SortRevisions(revs)
+	return revs, nil
 }
 
-// Delete deletes a tiddler with the given key (title) from the store.
-func (s *boltStore) Delete(ctx context.Context, key string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// GetRevision returns the revision rev of key in the tiddler_history bucket.
+func (s *boltStore) GetRevision(_ context.Context, key string, rev int) (*store.Tiddler, error) {
+	var data []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		data = tx.Bucket([]byte("tiddler_history")).Get([]byte(fmt.Sprintf("%s#%d", store.StoreKey(key), rev)))
+		if data != nil {
+			data = copyOf(data)
+		}
+		return nil
+	})
+	if data == nil {
+		return nil, store.ErrNotFound
+	}
+	t, _, err := store.ParseRevision(rev, data)
+	return t, err
+}
+
+// Audit checks the newest revision in the tiddler_history bucket of every tiddler against the tiddler.
+func (s *boltStore) Audit(_ context.Context, repair bool) ([]store.Divergence, error) {
+	divs := make([]store.Divergence, 0)
+	audit := func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("tiddler"))
-		mkey := []byte(key + "|1")
+		history := tx.Bucket([]byte("tiddler_history"))
 
-		rev := getLastRevision(b, mkey)
+		revs := make(map[string][]int)
+		for _, e := range historyEntries(history) {
+			revs[e.Key] = append(revs[e.Key], e.Rev)
+		}
 
-		err := b.Delete(mkey)
-		if err != nil {
-			return err
+		// collect first, the buckets must not change under their cursors
+		c := b.Cursor()
+		for k, meta := c.First(); k != nil; k, meta = c.Next() {
+			if !bytes.HasSuffix(k, []byte("|1")) {
+				continue
+			}
+			key := string(k[:len(k)-2])
+			head := getLastRevision(b, k)
+			latest := 0
+			for _, rev := range revs[key] {
+				if rev > latest {
+					latest = rev
+				}
+			}
+			if store.Diverges(meta, head, latest, s.maxRev != 0) {
+				divs = append(divs, store.Divergence{Key: key, Head: head, Latest: latest})
+			}
 		}
-		err = b.Delete([]byte(key+"|2"))
-		if err != nil {
-			return err
+		if !repair {
+			return nil
 		}
 
-		// remove all history
-		history := tx.Bucket([]byte("tiddler_history"))
-		err = s.trimRevision(history, key, rev)
+		for _, d := range divs {
+			for _, rev := range revs[d.Key] {
+				if rev < d.Head {
+					continue
+				}
+				if err := history.Delete([]byte(fmt.Sprintf("%s#%d", d.Key, rev))); err != nil {
+					return err
+				}
+			}
+			meta := b.Get([]byte(d.Key + "|1"))
+			if s.maxRev == 0 || store.NoHistory(meta) {
+				continue
+			}
+			var data bytes.Buffer
+			err := store.WriteFatJSON(&data, meta, bytes.NewReader(b.Get([]byte(d.Key + "|2"))))
+			if err != nil {
+				return err
+			}
+			err = history.Put([]byte(fmt.Sprintf("%s#%d", d.Key, d.Head)), data.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		s.histSize.Reset()
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = s.db.Update(audit)
+	} else {
+		err = s.db.View(audit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history bucket, ordered by their modified field.
+func historyEntries(b *bolt.Bucket) ([]store.HistoryEntry) {
+	entries := make([]store.HistoryEntry, 0)
+	b.ForEach(func(k, v []byte) error {
+		idx := bytes.LastIndexByte(k, byte('#'))
+		if idx < 0 {
+			return nil
+		}
+		rev, err := strconv.Atoi(string(k[idx+1:]))
 		if err != nil {
-			return err
+			return nil
 		}
+
+		var meta struct{ Modified string }
+		json.Unmarshal(v, &meta)
+		seq, _ := strconv.ParseInt(meta.Modified, 10, 64)
+
+		entries = append(entries, store.HistoryEntry{
+			Key: string(k[:idx]),
+			Rev: rev,
+			Size: int64(len(k) + len(v)),
+			Seq: seq,
+		})
 		return nil
 	})
-	if err != nil {
-		return err
+	return entries
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *boltStore) checkHistorySize(b *bolt.Bucket, added int64) (error) {
+	scan := func() (int64, error) {
+		var total int64
+		err := b.ForEach(func(k, v []byte) error {
+			total += int64(len(k) + len(v))
+			return nil
+		})
+		return total, err
+	}
+	if !s.histSize.Grow(added, scan) {
+		return nil
+	}
+
+	del, total := s.histSize.Prune(historyEntries(b))
+	for _, e := range del {
+		err := b.Delete([]byte(fmt.Sprintf("%s#%d", e.Key, e.Rev)))
+		if err != nil {
+			s.histSize.Reset()
+			return err
+		}
 	}
+	log.Printf("[bbolt] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
 	return nil
 }
 
-func (s *boltStore) SetMaxHistory(rev int) {
-	s.maxRev = rev
-}
 
+// Stats reports the size of the file and its free pages, which bolt reuses but never gives back.
+func (s *boltStore) Stats(_ context.Context) ([]store.Stat, error) {
+	bs := s.db.Stats()
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []store.Stat{
+		{Name: "file_bytes", Help: "Size of the bolt file.", Value: float64(size)},
+		{Name: "freelist_pages", Help: "Free and pending pages of the bolt file.", Value: float64(bs.FreePageN + bs.PendingPageN)},
+		{Name: "freelist_bytes", Help: "Bytes allocated by the bolt freelist.", Value: float64(bs.FreeAlloc)},
+	}, nil
+}
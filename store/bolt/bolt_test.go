@@ -0,0 +1,77 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../storetest"
+)
+
+func openTemp(dir string) (store.TiddlerStore, error) {
+	return Open(filepath.Join(dir, "widdly.db"))
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunRevisions(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp)
+}
+
+func TestOptions(t *testing.T) {
+	defer func() { store.BackendOptions = nil }()
+	path := filepath.Join(t.TempDir(), "widdly.db")
+	ctx := context.Background()
+
+	store.BackendOptions = store.Options{"nosync": "true", "freelist": "hashmap", "mmap": "1M"}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(ctx, storetest.NewTiddler(1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store.BackendOptions = store.Options{"readonly": "true"}
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(ctx, storetest.NewTiddler(1).Key); err != nil {
+		t.Errorf("read-only get: %v", err)
+	}
+	if _, err := db.Put(ctx, storetest.NewTiddler(2)); err == nil {
+		t.Error("want read-only put refused")
+	}
+
+	store.BackendOptions = store.Options{"nosnyc": "true"}
+	if _, err := Open(filepath.Join(t.TempDir(), "x.db")); err == nil {
+		t.Error("want unknown option refused")
+	}
+}
@@ -0,0 +1,478 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cached is a TiddlerStore wrapping another one, keeping the tiddler list and
+// the most read tiddlers in memory, for backends where every read is a round trip to a server.
+package cached
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	lru "container/list"
+
+	"../../store"
+)
+
+// MaxText is the largest text of a tiddler kept in memory, bigger ones are always read from the backend.
+var MaxText = 1024 * 1024
+
+// cachedStore keeps the list of All (by StoreKey of the title, as the backend returned it)
+// and up to size fat tiddlers read by Get. Every write goes through it, so nothing expires:
+// a Put or Delete updates the list and drops the tiddler. Only one widdly should write the backend.
+type cachedStore struct {
+	db   store.TiddlerStore
+	size int
+
+	mu     sync.Mutex
+	list   map[string]*store.Tiddler // nil until the first All
+	sorted []*store.Tiddler          // list sorted by key, nil when stale
+	fat    map[string]*lru.Element   // of *entry
+	lru    *lru.List                 // most recently used at front
+	gen    uint64                    // bumped by every write, what was read before is not kept
+
+	hits   uint64
+	misses uint64
+}
+
+type entry struct {
+	key string
+	js  map[string]interface{}
+}
+
+// New wraps db, keeping its tiddler list and up to size fat tiddlers in memory.
+// It is a store.StreamStore, a store.StatsStore and a store.RevisionStore, and a
+// store.AuditStore or store.BatchStore when db is one.
+func New(db store.TiddlerStore, size int) (store.TiddlerStore) {
+	s := &cachedStore{db: db, size: size, fat: make(map[string]*lru.Element), lru: lru.New()}
+	_, audit := db.(store.AuditStore)
+	_, batch := db.(store.BatchStore)
+	switch {
+	case audit && batch:
+		return auditBatchStore{s}
+	case audit:
+		return auditStore{s}
+	case batch:
+		return batchStore{s}
+	}
+	return s
+}
+
+type auditStore struct{ *cachedStore }
+
+func (s auditStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.audit(ctx, repair)
+}
+
+type batchStore struct{ *cachedStore }
+
+func (s batchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+type auditBatchStore struct{ *cachedStore }
+
+func (s auditBatchStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.audit(ctx, repair)
+}
+
+func (s auditBatchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+// Get returns the tiddler from memory, or reads it from the backend and keeps it.
+// A key missing from a loaded list is not found without asking the backend.
+func (s *cachedStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	skey := store.StoreKey(key)
+	s.mu.Lock()
+	if el, ok := s.fat[skey]; ok {
+		s.lru.MoveToFront(el)
+		s.hits++
+		js := el.Value.(*entry).js
+		s.mu.Unlock()
+		return &store.Tiddler{Js: clone(js).(map[string]interface{})}, nil
+	}
+	if s.list != nil {
+		if _, ok := s.list[skey]; !ok {
+			s.hits++
+			s.mu.Unlock()
+			return nil, store.ErrNotFound
+		}
+	}
+	s.misses++
+	gen := s.gen
+	s.mu.Unlock()
+
+	t, err := s.db.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, err
+	}
+	if text, _ := js["text"].(string); len(text) <= MaxText && s.size > 0 {
+		s.mu.Lock()
+		if s.gen == gen {
+			s.keep(skey, clone(js).(map[string]interface{}))
+		}
+		s.mu.Unlock()
+	}
+	return t, nil
+}
+
+// keep adds a fat tiddler, dropping the least recently used beyond size.
+func (s *cachedStore) keep(key string, js map[string]interface{}) {
+	if el, ok := s.fat[key]; ok {
+		el.Value.(*entry).js = js
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.fat[key] = s.lru.PushFront(&entry{key: key, js: js})
+	for s.lru.Len() > s.size {
+		el := s.lru.Back()
+		s.lru.Remove(el)
+		delete(s.fat, el.Value.(*entry).key)
+	}
+}
+
+// All returns copies of the kept list, read from the backend the first time.
+func (s *cachedStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	s.mu.Lock()
+	if s.list != nil {
+		s.hits++
+		all := s.copyList()
+		s.mu.Unlock()
+		return all, nil
+	}
+	s.misses++
+	gen := s.gen
+	s.mu.Unlock()
+
+	all, err := s.db.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]*store.Tiddler, len(all))
+	for _, t := range all {
+		key, err := keyOf(t)
+		if err != nil {
+			return all, nil // not kept, the backend knows better
+		}
+		list[key] = copyTiddler(t)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == gen && s.list == nil {
+		s.list, s.sorted = list, nil
+	}
+	return all, nil
+}
+
+// copyList returns the list sorted by key, the caller may change the tiddlers.
+func (s *cachedStore) copyList() ([]*store.Tiddler) {
+	if s.sorted == nil {
+		keys := make([]string, 0, len(s.list))
+		for key := range s.list {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		s.sorted = make([]*store.Tiddler, len(keys))
+		for i, key := range keys {
+			s.sorted[i] = s.list[key]
+		}
+	}
+	all := make([]*store.Tiddler, len(s.sorted))
+	for i, t := range s.sorted {
+		all[i] = copyTiddler(t)
+	}
+	return all
+}
+
+// keyOf returns the StoreKey of the title of a tiddler returned by the backend.
+func keyOf(t *store.Tiddler) (string, error) {
+	js, err := t.Fields()
+	if err != nil {
+		return "", err
+	}
+	title, ok := js["title"].(string)
+	if !ok {
+		return "", store.ErrBadTiddler
+	}
+	return store.StoreKey(title), nil
+}
+
+// copyTiddler copies a tiddler of the list: the meta of skinny ones is never changed in place,
+// the fields of fat ones may be.
+func copyTiddler(t *store.Tiddler) (*store.Tiddler) {
+	c := *t
+	if t.Js != nil {
+		c.Js = clone(t.Js).(map[string]interface{})
+	}
+	return &c
+}
+
+// clone deep copies decoded JSON.
+func clone(v interface{}) (interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[k] = clone(x)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, x := range v {
+			a[i] = clone(x)
+		}
+		return a
+	case []string:
+		return append([]string(nil), v...)
+	}
+	return v
+}
+
+// saved updates the list with the tiddler js saved as rev, and drops it from memory.
+func (s *cachedStore) saved(key string, js map[string]interface{}, rev int) {
+	s.gen++
+	s.forget(key)
+	if s.list == nil {
+		return
+	}
+	js["revision"] = rev
+	text, ok := js["text"]
+	if !ok {
+		text = ""
+	}
+	delete(js, "text")
+	meta, err := json.Marshal(js)
+	if err != nil {
+		s.list, s.sorted = nil, nil
+		return
+	}
+	t := &store.Tiddler{Meta: meta}
+	if store.IsFat(meta) { // returned fat by All
+		js["text"] = text
+		t = &store.Tiddler{Js: js}
+	}
+	s.list[key] = t
+	s.sorted = nil
+}
+
+// forget drops a tiddler from memory.
+func (s *cachedStore) forget(key string) {
+	if el, ok := s.fat[key]; ok {
+		s.lru.Remove(el)
+		delete(s.fat, key)
+	}
+}
+
+// reset drops everything, after a write whose outcome is unknown.
+func (s *cachedStore) reset() {
+	s.gen++
+	s.list, s.sorted = nil, nil
+	s.fat = make(map[string]*lru.Element)
+	s.lru.Init()
+}
+
+func (s *cachedStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	key := store.StoreKey(tiddler.Key)
+	js := clone(tiddler.Js).(map[string]interface{}) // the backend may change tiddler.Js
+	s.mu.Lock()
+	s.gen++ // a Get or All running meanwhile may read either version
+	s.mu.Unlock()
+
+	rev, err := s.db.Put(ctx, tiddler)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.reset()
+		return rev, err
+	}
+	s.saved(key, js, rev)
+	return rev, nil
+}
+
+func (s *cachedStore) Delete(ctx context.Context, key string) error {
+	skey := store.StoreKey(key)
+	s.mu.Lock()
+	s.gen++
+	s.mu.Unlock()
+
+	err := s.db.Delete(ctx, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	s.forget(skey)
+	if err != nil && err != store.ErrNotFound {
+		s.reset()
+		return err
+	}
+	if s.list != nil {
+		delete(s.list, skey)
+		s.sorted = nil
+	}
+	return err
+}
+
+// PutStream streams the text to the backend if it is a store.StreamStore, else reads it for Put.
+func (s *cachedStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
+	ss, ok := s.db.(store.StreamStore)
+	if !ok {
+		b, err := ioutil.ReadAll(text)
+		if err != nil {
+			return 0, err
+		}
+		tiddler.Js["text"] = string(b)
+		return s.Put(ctx, tiddler)
+	}
+
+	key := store.StoreKey(tiddler.Key)
+	js := clone(tiddler.Js).(map[string]interface{})
+	s.mu.Lock()
+	s.gen++
+	s.mu.Unlock()
+
+	rev, err := ss.PutStream(ctx, tiddler, text)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.reset()
+		return rev, err
+	}
+	if meta, _ := json.Marshal(js); store.IsFat(meta) { // the list needs its text
+		s.gen++
+		s.forget(key)
+		s.list, s.sorted = nil, nil
+		return rev, nil
+	}
+	s.saved(key, js, rev)
+	return rev, nil
+}
+
+// GetStream streams the text from the backend if it is a store.StreamStore; such big texts are never kept.
+func (s *cachedStore) GetStream(ctx context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	if ss, ok := s.db.(store.StreamStore); ok {
+		return ss.GetStream(ctx, key)
+	}
+	t, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return meta, ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
+}
+
+func (s *cachedStore) batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	type saved struct {
+		key string
+		js  map[string]interface{}
+	}
+	before := make([]saved, len(ops))
+	for i, op := range ops {
+		before[i].key = store.StoreKey(op.Tiddler.Key)
+		if !op.Delete {
+			before[i].js = clone(op.Tiddler.Js).(map[string]interface{})
+		}
+	}
+	s.mu.Lock()
+	s.gen++
+	s.mu.Unlock()
+
+	revs, err := s.db.(store.BatchStore).Batch(ctx, ops)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.reset()
+		return revs, err
+	}
+	for i, op := range ops {
+		if op.Delete {
+			s.gen++
+			s.forget(before[i].key)
+			if s.list != nil {
+				delete(s.list, before[i].key)
+				s.sorted = nil
+			}
+			continue
+		}
+		s.saved(before[i].key, before[i].js, revs[i])
+	}
+	return revs, nil
+}
+
+func (s *cachedStore) audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	divs, err := s.db.(store.AuditStore).Audit(ctx, repair)
+	if repair {
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+	}
+	return divs, err
+}
+
+// Stats reports the cache, then the gauges of the backend if it has some.
+func (s *cachedStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	s.mu.Lock()
+	stats := []store.Stat{
+		{Name: "cached_tiddlers", Help: "Fat tiddlers kept in memory by -cache.", Value: float64(s.lru.Len())},
+		{Name: "cached_hits", Help: "Reads answered from memory by -cache.", Value: float64(s.hits)},
+		{Name: "cached_misses", Help: "Reads passed to the backend by -cache.", Value: float64(s.misses)},
+	}
+	s.mu.Unlock()
+	if ss, ok := s.db.(store.StatsStore); ok {
+		more, err := ss.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, more...)
+	}
+	return stats, nil
+}
+
+// ListRevisions reads the history of db, which is not cached.
+func (s *cachedStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	return store.ListRevisions(ctx, s.db, key)
+}
+
+func (s *cachedStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	return store.GetRevision(ctx, s.db, key, rev)
+}
+
+func (s *cachedStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *cachedStore) SetMaxHistory(rev int) {
+	s.db.SetMaxHistory(rev)
+}
+
+func (s *cachedStore) SetMaxHistorySize(size int64) {
+	s.db.SetMaxHistorySize(size)
+}
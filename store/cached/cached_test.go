@@ -0,0 +1,125 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cached
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../flatFile"
+	"../storetest"
+)
+
+// openTemp wraps a flatFile store in dir, relative to the working directory as flatFile.Open wants.
+func openTemp(dir string) (store.TiddlerStore, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := flatFile.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, 10), nil
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunRevisions(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := db.(auditStore).cachedStore
+	textOf := func(key string) string {
+		td, err := db.Get(ctx, key)
+		if err != nil {
+			return err.Error()
+		}
+		js, _ := td.Fields()
+		text, _ := js["text"].(string)
+		return text
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, err := db.Put(ctx, storetest.NewTiddler(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.All(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key := storetest.NewTiddler(0).Key
+	textOf(key)
+	td, _ := db.Get(ctx, key)
+	td.Js["text"] = "changed by the caller"
+	if s.misses != 2 || s.hits != 1 || textOf(key) == "changed by the caller" {
+		t.Errorf("want misses for All and Get, then a copy from memory, got %d misses %d hits", s.misses, s.hits)
+	}
+
+	mark := storetest.NewTiddler(0)
+	mark.Js["text"] = "saved"
+	mark.Js["tags"] = "$:/tags/Macro"
+	if _, err := db.Put(ctx, mark); err != nil {
+		t.Fatal(err)
+	}
+	if got := textOf(key); got != "saved" {
+		t.Errorf("want the saved text after Put, got %q", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		textOf(storetest.NewTiddler(i).Key)
+	}
+	if s.lru.Len() != 10 {
+		t.Errorf("want 10 tiddlers kept, got %d", s.lru.Len())
+	}
+
+	if err := db.Delete(ctx, storetest.NewTiddler(1).Key); err != nil {
+		t.Fatal(err)
+	}
+	misses := s.misses
+	all, err := db.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 19 || s.misses != misses {
+		t.Errorf("want 19 tiddlers from memory, got %d and %d misses", len(all), s.misses - misses)
+	}
+	if js, _ := all[0].Fields(); js["text"] != "saved" || fmt.Sprint(js["revision"]) != "3" {
+		t.Errorf("want the saved tiddler fat in the list, got %v", js)
+	}
+	if _, err := db.Get(ctx, storetest.NewTiddler(1).Key); err != store.ErrNotFound || s.misses != misses {
+		t.Errorf("want ErrNotFound from the list, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Title case policies, see TitleCase.
+const (
+	// CaseNative keeps what each backend does: flatFile follows its file system,
+	// which may merge "Foo" and "foo", the databases keep them apart.
+	CaseNative = "native"
+
+	// CaseSensitive keeps "Foo" and "foo" apart with every backend,
+	// flatFile names the files of such titles collision-safe.
+	CaseSensitive = "sensitive"
+
+	// CaseInsensitive makes "Foo" and "foo" the same tiddler with every backend,
+	// which keeps the title as last saved.
+	CaseInsensitive = "insensitive"
+)
+
+// TitleCase is the title case policy of the backends. Choose it when creating a store:
+// the tiddlers saved under another policy may not be found anymore.
+var TitleCase = CaseNative
+
+// ParseCase checks a title case policy name.
+func ParseCase(policy string) (string, error) {
+	switch policy {
+	case CaseNative, CaseSensitive, CaseInsensitive:
+		return policy, nil
+	case "":
+		return CaseNative, nil
+	}
+	return "", fmt.Errorf("unknown title case policy %q, want native, sensitive or insensitive", policy)
+}
+
+// StoreKey returns the key the backends keep a tiddler titled title under.
+func StoreKey(title string) (string) {
+	if TitleCase == CaseInsensitive {
+		return strings.ToLower(title)
+	}
+	return title
+}
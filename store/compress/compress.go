@@ -0,0 +1,384 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package compress is a TiddlerStore compressing the large tiddler texts before they reach
+// another backend, e.g. JSON data tiddlers in a bbolt or SQLite file.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"../../store"
+)
+
+// Codec is a compression format, see RegCodec.
+type Codec struct {
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]Codec{
+	"gzip": {
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+}
+
+// RegCodec adds the codec name (without ':'), usually from an init built with a tag.
+func RegCodec(name string, c Codec) {
+	codecs[name] = c
+}
+
+// ListCodec lists the codec names.
+func ListCodec() ([]string) {
+	list := make([]string, 0, len(codecs))
+	for name := range codecs {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Off is the codec name of New which only decompresses, writing the texts plain,
+// to leave compression without rewriting the store first.
+const Off = "off"
+
+// A compressed text is marker, the codec name, ':' and the base64 of the compressed text:
+// the backends keep texts as strings (and in JSON history). Plain texts starting with
+// marker are always compressed, so that they read back the same.
+const marker = "\x00"
+
+// compressStore compresses the texts of at least minSize bytes with codec before writing
+// them to db, when that makes them smaller, and decompresses the texts read.
+type compressStore struct {
+	db      store.TiddlerStore
+	name    string
+	codec   *Codec // nil for Off
+	minSize int
+
+	texts uint64 // compressed since start
+	saved int64  // bytes spared by them
+}
+
+// New compresses the texts of db with the codec name, from minSize bytes on.
+// It is a store.StreamStore, a store.OrderedStore, a store.PagedStore, a store.StatsStore
+// and a store.RevisionStore, and a store.AuditStore or store.BatchStore when db is one.
+func New(db store.TiddlerStore, name string, minSize int) (store.TiddlerStore, error) {
+	s := &compressStore{db: db, name: name, minSize: minSize}
+	if name != Off {
+		c, ok := codecs[name]
+		if !ok {
+			return nil, fmt.Errorf("compress: unknown codec %q, have %s", name, strings.Join(ListCodec(), ", "))
+		}
+		s.codec = &c
+	}
+	_, audit := db.(store.AuditStore)
+	_, batch := db.(store.BatchStore)
+	switch {
+	case audit && batch:
+		return auditBatchStore{s}, nil
+	case audit:
+		return auditStore{s}, nil
+	case batch:
+		return batchStore{s}, nil
+	}
+	return s, nil
+}
+
+type auditStore struct{ *compressStore }
+
+func (s auditStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.db.(store.AuditStore).Audit(ctx, repair)
+}
+
+type batchStore struct{ *compressStore }
+
+func (s batchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+type auditBatchStore struct{ *compressStore }
+
+func (s auditBatchStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.db.(store.AuditStore).Audit(ctx, repair)
+}
+
+func (s auditBatchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+// encode returns text as written to the backend.
+func (s *compressStore) encode(text string) (string, error) {
+	escape := strings.HasPrefix(text, marker)
+	name, codec := s.name, s.codec
+	if escape && codec == nil { // Off
+		gz := codecs["gzip"]
+		name, codec = "gzip", &gz
+	}
+	if !escape && (codec == nil || len(text) < s.minSize) {
+		return text, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(marker + name + ":")
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw, err := codec.NewWriter(enc)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(zw, text); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	enc.Close()
+	if !escape && buf.Len() >= len(text) { // e.g. base64 images
+		return text, nil
+	}
+	atomic.AddUint64(&s.texts, 1)
+	atomic.AddInt64(&s.saved, int64(len(text) - buf.Len()))
+	return buf.String(), nil
+}
+
+// decode returns the text of what the backend keeps.
+func decode(text string) (string, error) {
+	if !strings.HasPrefix(text, marker) {
+		return text, nil
+	}
+	i := strings.IndexByte(text, ':')
+	if i < 0 {
+		return "", fmt.Errorf("compress: bad compressed text")
+	}
+	name := text[len(marker):i]
+	codec, ok := codecs[name]
+	if !ok {
+		return "", fmt.Errorf("compress: text compressed with %q, which is not built in", name)
+	}
+	zr, err := codec.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(text[i+1:])))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// decodeTiddler decodes the text of t in place, if t is fat.
+func decodeTiddler(t *store.Tiddler) (error) {
+	if t == nil || t.Js == nil {
+		return nil
+	}
+	text, ok := t.Js["text"].(string)
+	if !ok {
+		return nil
+	}
+	text, err := decode(text)
+	if err != nil {
+		return err
+	}
+	t.Js["text"] = text
+	return nil
+}
+
+// encodeTiddler returns tiddler with its text encoded, in a copy of its fields.
+func (s *compressStore) encodeTiddler(tiddler store.Tiddler) (store.Tiddler, error) {
+	text, ok := tiddler.Js["text"].(string)
+	if !ok {
+		return tiddler, nil
+	}
+	enc, err := s.encode(text)
+	if err != nil {
+		return tiddler, err
+	}
+	js := make(map[string]interface{}, len(tiddler.Js))
+	for k, v := range tiddler.Js {
+		js[k] = v
+	}
+	js["text"] = enc
+	tiddler.Js = js
+	return tiddler, nil
+}
+
+func (s *compressStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	t, err := s.db.Get(ctx, key)
+	if err != nil {
+		return t, err
+	}
+	return t, decodeTiddler(t)
+}
+
+// decodeAll decodes the fat tiddlers of a list.
+func decodeAll(list []*store.Tiddler, err error) ([]*store.Tiddler, error) {
+	if err != nil {
+		return list, err
+	}
+	for _, t := range list {
+		if err := decodeTiddler(t); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (s *compressStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	return decodeAll(s.db.All(ctx))
+}
+
+func (s *compressStore) AllOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	return decodeAll(store.AllOrdered(ctx, s.db, o))
+}
+
+func (s *compressStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	return decodeAll(store.AllPage(ctx, s.db, after, limit))
+}
+
+func (s *compressStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tiddler, err := s.encodeTiddler(tiddler)
+	if err != nil {
+		return 0, err
+	}
+	return s.db.Put(ctx, tiddler)
+}
+
+// PutStream reads the whole text, which is compressed in memory.
+func (s *compressStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
+	data, err := ioutil.ReadAll(text)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := s.encode(string(data))
+	if err != nil {
+		return 0, err
+	}
+	if ss, ok := s.db.(store.StreamStore); ok {
+		return ss.PutStream(ctx, tiddler, strings.NewReader(enc))
+	}
+	tiddler.Js["text"] = enc
+	return s.db.Put(ctx, tiddler)
+}
+
+// GetStream streams plain texts from db if it is a store.StreamStore; compressed ones,
+// and all of the other backends, are read into memory.
+func (s *compressStore) GetStream(ctx context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	if ss, ok := s.db.(store.StreamStore); ok {
+		meta, text, size, err := ss.GetStream(ctx, key)
+		if err != nil {
+			return meta, text, size, err
+		}
+		br := bufio.NewReader(text)
+		if head, _ := br.Peek(len(marker)); string(head) != marker {
+			return meta, struct{ io.Reader; io.Closer }{br, text}, size, nil
+		}
+		data, err := ioutil.ReadAll(br)
+		text.Close()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		plain, err := decode(string(data))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return meta, ioutil.NopCloser(strings.NewReader(plain)), int64(len(plain)), nil
+	}
+
+	t, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	meta, err := (&store.Tiddler{Js: js}).MarshalJSON()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return meta, ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
+}
+
+func (s *compressStore) Delete(ctx context.Context, key string) error {
+	return s.db.Delete(ctx, key)
+}
+
+func (s *compressStore) batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	enc := make([]store.Op, len(ops))
+	for i, op := range ops {
+		enc[i] = op
+		if op.Delete {
+			continue
+		}
+		t, err := s.encodeTiddler(op.Tiddler)
+		if err != nil {
+			return nil, err
+		}
+		enc[i].Tiddler = t
+	}
+	return s.db.(store.BatchStore).Batch(ctx, enc)
+}
+
+// Stats reports the compressed texts, then the gauges of db if it has some.
+func (s *compressStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	stats := []store.Stat{
+		{Name: "compress_texts", Help: "Texts compressed since start.", Value: float64(atomic.LoadUint64(&s.texts))},
+		{Name: "compress_saved_bytes", Help: "Bytes spared by compressing texts since start.", Value: float64(atomic.LoadInt64(&s.saved))},
+	}
+	if ss, ok := s.db.(store.StatsStore); ok {
+		more, err := ss.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, more...)
+	}
+	return stats, nil
+}
+
+// ListRevisions lists the history of db, with the sizes of the texts as compressed.
+func (s *compressStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	return store.ListRevisions(ctx, s.db, key)
+}
+
+func (s *compressStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	t, err := store.GetRevision(ctx, s.db, key, rev)
+	if err != nil {
+		return nil, err
+	}
+	return t, decodeTiddler(t)
+}
+
+func (s *compressStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *compressStore) SetMaxHistory(rev int) {
+	s.db.SetMaxHistory(rev)
+}
+
+func (s *compressStore) SetMaxHistorySize(size int64) {
+	s.db.SetMaxHistorySize(size)
+}
@@ -0,0 +1,168 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package compress
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../../store"
+	"../flatFile"
+	"../storetest"
+)
+
+// openFlat opens a flatFile store in dir, relative to the working directory as flatFile.Open wants.
+func openFlat(dir string) (store.TiddlerStore, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return nil, err
+	}
+	return flatFile.Open(rel)
+}
+
+// openTemp wraps a flatFile store in dir, compressing the texts of the test tiddlers.
+func openTemp(dir string) (store.TiddlerStore, error) {
+	db, err := openFlat(dir)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, "gzip", 64)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunRevisions(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+func TestCompress(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	inner, err := openFlat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(inner, "gzip", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Repeat(`{"name":"widdly","tags":["a","b"]},`, 100)
+	texts := map[string]string{
+		"Data": data, // compressed
+		"Short": "short text", // under minSize
+		"Image": "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg==" +
+			"R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7", // does not shrink
+		"Nul": "\x00gzip:not compressed", // escaped
+	}
+	for title, text := range texts {
+		td := store.Tiddler{Key: title, Js: map[string]interface{}{"title": title, "text": text}}
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for title, text := range texts {
+		got, err := db.Get(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Js["text"] != text {
+			t.Errorf("%s: want the text back, got %q", title, got.Js["text"])
+		}
+		raw, err := inner.Get(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := raw.Js["text"].(string)
+		compressed := strings.HasPrefix(stored, marker + "gzip:")
+		if want := title == "Data" || title == "Nul"; compressed != want {
+			t.Errorf("%s: want compressed %v, got %q", title, want, stored)
+		}
+		if title == "Data" && len(stored) > len(data) / 5 {
+			t.Errorf("want the data compressed, got %d of %d bytes", len(stored), len(data))
+		}
+		old, err := db.(store.RevisionStore).GetRevision(ctx, title, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if old.Js["text"] != text {
+			t.Errorf("%s: want the text of the history back, got %q", title, old.Js["text"])
+		}
+
+		_, rc, size, err := db.(store.StreamStore).GetStream(ctx, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(streamed) != text || size != int64(len(text)) {
+			t.Errorf("%s: want the text streamed, got %q of %d bytes", title, streamed, size)
+		}
+	}
+
+	stats, err := db.(store.StatsStore).Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Name != "compress_texts" || stats[0].Value != 2 || stats[1].Value <= 0 {
+		t.Errorf("want 2 texts compressed, got %+v", stats[:2])
+	}
+
+	// leaving compression: the texts still read, new ones are plain
+	off, err := New(inner, Off, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := off.Get(ctx, "Data"); err != nil || got.Js["text"] != data {
+		t.Errorf("off: want the compressed text read, got %v", err)
+	}
+	off.Put(ctx, store.Tiddler{Key: "Data", Js: map[string]interface{}{"title": "Data", "text": data}})
+	if raw, _ := inner.Get(ctx, "Data"); raw.Js["text"] != data {
+		t.Error("off: want the text written plain")
+	}
+
+	if _, err := New(inner, "lzma", 64); err == nil {
+		t.Error("want an unknown codec refused")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	text := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	for _, name := range ListCodec() {
+		c := codecs[name]
+		s := &compressStore{name: name, codec: &c, minSize: 64}
+		enc, err := s.encode(text)
+		if err != nil || !strings.HasPrefix(enc, marker + name + ":") {
+			t.Fatalf("%s: want the text compressed, got %v", name, err)
+		}
+		if got, err := decode(enc); err != nil || got != text {
+			t.Errorf("%s: want the text back, got %v", name, err)
+		}
+	}
+}
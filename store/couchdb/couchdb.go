@@ -0,0 +1,547 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package couchdb is a CouchDB TiddlerStore backend, over its HTTP API.
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"../../store"
+)
+
+const TypeName = "couchdb"
+
+// The documents of the database:
+//
+//	tiddler:<key>                  the tiddler: meta (fields without text), text, revision
+//	history:<key>#<revision>       a revision of its history, the revision has 10 digits
+//
+// The widdly revision is a field of the document, its CouchDB _rev only guards
+// the concurrent updates: a Put losing the race reads the document again.
+const (
+	tiddlerPrefix = "tiddler:"
+	historyPrefix = "history:"
+	revDigits     = 10
+)
+
+type couchStore struct {
+	base     string // database URL, without credentials
+	user     string
+	pass     string
+	client   *http.Client
+	maxRev   int
+	histSize store.HistorySize
+}
+
+// doc is a tiddler or history document.
+type doc struct {
+	ID       string          `json:"_id"`
+	Rev      string          `json:"_rev,omitempty"`
+	Type     string          `json:"type"` // "tiddler" or "history"
+	Title    string          `json:"title"`
+	Revision int             `json:"revision"`
+	Seq      int64           `json:"seq,omitempty"` // orders the history across tiddlers
+	Meta     json.RawMessage `json:"meta"`
+	Text     string          `json:"text"`
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open uses the database at dataSource, e.g. http://widdly@localhost:5984/wiki, creating it if missing
+// (the password is read from $WIDDLY_DB_PASS unless given in the URL).
+func Open(dataSource string) (store.TiddlerStore, error) {
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("couchdb: source must be an http(s) URL, got %q", dataSource)
+	}
+	s := &couchStore{client: &http.Client{Timeout: time.Minute}, maxRev: -1}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+		u.User = nil
+	}
+	if s.pass == "" {
+		s.pass = os.Getenv("WIDDLY_DB_PASS")
+	}
+	u.RawQuery = ""
+	s.base = strings.TrimRight(u.String(), "/")
+
+	ctx := context.Background()
+	status, err := s.do(ctx, "GET", "", nil, nil, nil)
+	if err == nil && status == http.StatusNotFound {
+		status, err = s.do(ctx, "PUT", "", nil, nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status >= 300 {
+		return nil, fmt.Errorf("couchdb: open %s: status %d", s.base, status)
+	}
+	return s, nil
+}
+
+// do sends a request for the document path (escaped, empty for the database) with body encoded as JSON,
+// and decodes a successful response into out. It answers the status, which is no error for 404 and 409.
+func (s *couchStore) do(ctx context.Context, method string, path string, q url.Values, body interface{}, out interface{}) (int, error) {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewReader(data)
+	}
+	target := s.base
+	if path != "" {
+		target += "/" + path
+	}
+	if len(q) > 0 {
+		target += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, rd)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		var e struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, fmt.Errorf("couchdb: %s %s: %s %s %s", method, path, resp.Status, e.Error, e.Reason)
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func tiddlerID(key string) (string) {
+	return tiddlerPrefix + key
+}
+
+func historyID(key string, rev int) (string) {
+	return fmt.Sprintf("%s%s#%0*d", historyPrefix, key, revDigits, rev)
+}
+
+// parseHistoryID returns the key and revision of a history document id.
+func parseHistoryID(id string) (string, int, bool) {
+	if !strings.HasPrefix(id, historyPrefix) || len(id) < len(historyPrefix) + revDigits + 1 {
+		return "", 0, false
+	}
+	i := len(id) - revDigits
+	if id[i-1] != '#' {
+		return "", 0, false
+	}
+	rev, err := strconv.Atoi(id[i:])
+	if err != nil {
+		return "", 0, false
+	}
+	return id[len(historyPrefix):i-1], rev, true
+}
+
+// getDoc reads the document id, nil when missing.
+func (s *couchStore) getDoc(ctx context.Context, id string) (*doc, error) {
+	var d doc
+	status, err := s.do(ctx, "GET", url.PathEscape(id), nil, nil, &d)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+type row struct {
+	ID    string `json:"id"`
+	Value struct {
+		Rev string `json:"rev"`
+	} `json:"value"`
+	Doc *doc `json:"doc"`
+}
+
+// docs lists the documents whose id starts with prefix, in id order, with their content when withDocs.
+func (s *couchStore) docs(ctx context.Context, prefix string, withDocs bool) ([]row, error) {
+	start, _ := json.Marshal(prefix)
+	end, _ := json.Marshal(prefix + "\ufff0")
+	q := url.Values{"startkey": {string(start)}, "endkey": {string(end)}}
+	if withDocs {
+		q.Set("include_docs", "true")
+	}
+	var res struct {
+		Rows []row `json:"rows"`
+	}
+	if _, err := s.do(ctx, "GET", "_all_docs", q, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Rows, nil
+}
+
+// historyOf lists the history documents of key, in revision order.
+func (s *couchStore) historyOf(ctx context.Context, key string) ([]row, error) {
+	rows, err := s.docs(ctx, historyPrefix + key + "#", false)
+	if err != nil {
+		return nil, err
+	}
+	list := rows[:0]
+	for _, r := range rows {
+		if k, _, ok := parseHistoryID(r.ID); ok && k == key { // not "<key>#x" of another title
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+// deleteDocs deletes the listed documents at once.
+func (s *couchStore) deleteDocs(ctx context.Context, rows []row) (error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	type deleted struct {
+		ID      string `json:"_id"`
+		Rev     string `json:"_rev"`
+		Deleted bool   `json:"_deleted"`
+	}
+	body := struct {
+		Docs []deleted `json:"docs"`
+	}{}
+	for _, r := range rows {
+		body.Docs = append(body.Docs, deleted{r.ID, r.Value.Rev, true})
+	}
+	_, err := s.do(ctx, "POST", "_bulk_docs", nil, body, nil)
+	return err
+}
+
+// putHistory writes a revision of the history, replacing a revision left behind.
+func (s *couchStore) putHistory(ctx context.Context, key string, rev int, meta []byte, text string) (int64, error) {
+	d := doc{ID: historyID(key, rev), Type: "history", Title: key, Revision: rev, Seq: time.Now().UnixNano(), Meta: meta, Text: text}
+	for {
+		status, err := s.do(ctx, "PUT", url.PathEscape(d.ID), nil, d, nil)
+		if err != nil {
+			return 0, err
+		}
+		if status != http.StatusConflict {
+			return int64(len(meta) + len(text)), nil
+		}
+		old, err := s.getDoc(ctx, d.ID)
+		if err != nil {
+			return 0, err
+		}
+		if old != nil {
+			d.Rev = old.Rev
+		}
+	}
+}
+
+func (s *couchStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *couchStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	d, err := s.getDoc(ctx, tiddlerID(store.StoreKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, store.ErrNotFound
+	}
+	return store.NewTiddler(d.Meta, []byte(d.Text))
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+func (s *couchStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	rows, err := s.docs(ctx, tiddlerPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+	tiddlers := make([]*store.Tiddler, 0, len(rows))
+	for _, r := range rows {
+		if r.Doc == nil {
+			continue
+		}
+		var text []byte
+		if store.IsFat(r.Doc.Meta) {
+			text = []byte(r.Doc.Text)
+		}
+		t, err := store.NewTiddler(r.Doc.Meta, text)
+		if err != nil {
+			continue
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	// _all_docs is in CouchDB's id collation
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The document is read and written again when another Put changed it meanwhile.
+// The tiddler is also added to its history.
+func (s *couchStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	id := tiddlerID(tiddler.Key)
+
+	var rev int
+	var meta []byte
+	for {
+		cur, err := s.getDoc(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		d := doc{ID: id, Type: "tiddler", Title: tiddler.Key, Revision: 2, Text: text}
+		if cur != nil {
+			d.Rev, d.Revision = cur.Rev, cur.Revision + 1
+		}
+		rev = d.Revision
+		tiddler.Js["revision"] = rev
+		meta, err = json.Marshal(tiddler.Js)
+		if err != nil {
+			return 0, err
+		}
+		d.Meta = meta
+
+		status, err := s.do(ctx, "PUT", url.PathEscape(id), nil, d, nil)
+		if err != nil {
+			return 0, err
+		}
+		if status != http.StatusConflict {
+			break
+		}
+	}
+
+	// skip Draft & system key history
+	if s.maxRev == 0 || tiddler.IsDraft || tiddler.IsSys {
+		return rev, nil
+	}
+	if s.maxRev > 0 && rev - s.maxRev > 1 { // remove old history
+		rows, err := s.historyOf(ctx, tiddler.Key)
+		if err != nil {
+			return rev, err
+		}
+		old := make([]row, 0)
+		for _, r := range rows {
+			if _, hrev, _ := parseHistoryID(r.ID); hrev <= rev - 1 - s.maxRev {
+				old = append(old, r)
+			}
+		}
+		if err := s.deleteDocs(ctx, old); err != nil {
+			return rev, err
+		}
+		s.histSize.Reset()
+	}
+	size, err := s.putHistory(ctx, tiddler.Key, rev, meta, text)
+	if err != nil {
+		return rev, err
+	}
+	s.checkHistorySize(size)
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *couchStore) Delete(ctx context.Context, key string) error {
+	key = store.StoreKey(key)
+	id := tiddlerID(key)
+	for {
+		cur, err := s.getDoc(ctx, id)
+		if err != nil {
+			return err
+		}
+		if cur == nil {
+			break
+		}
+		status, err := s.do(ctx, "DELETE", url.PathEscape(id), url.Values{"rev": {cur.Rev}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusConflict {
+			break
+		}
+	}
+
+	rows, err := s.historyOf(ctx, key)
+	if err == nil {
+		err = s.deleteDocs(ctx, rows)
+	}
+	s.histSize.Reset()
+	return err
+}
+
+func (s *couchStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *couchStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// Audit checks the newest revision in the history of every tiddler against the tiddler.
+func (s *couchStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	tiddlers, err := s.docs(ctx, tiddlerPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.docs(ctx, historyPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string][]row)
+	latest := make(map[string]int)
+	for _, r := range history {
+		key, rev, ok := parseHistoryID(r.ID)
+		if !ok {
+			continue
+		}
+		byKey[key] = append(byKey[key], r)
+		if rev > latest[key] {
+			latest[key] = rev
+		}
+	}
+
+	divs := make([]store.Divergence, 0)
+	docs := make([]*doc, 0)
+	for _, r := range tiddlers {
+		if r.Doc == nil {
+			continue
+		}
+		d := store.Divergence{Key: r.Doc.Title, Head: r.Doc.Revision, Latest: latest[r.Doc.Title]}
+		if store.Diverges(r.Doc.Meta, d.Head, d.Latest, s.maxRev != 0) {
+			divs = append(divs, d)
+			docs = append(docs, r.Doc)
+		}
+	}
+	if !repair {
+		return divs, nil
+	}
+
+	for i, d := range divs {
+		newer := make([]row, 0)
+		for _, r := range byKey[d.Key] {
+			if _, rev, _ := parseHistoryID(r.ID); rev >= d.Head {
+				newer = append(newer, r)
+			}
+		}
+		if err := s.deleteDocs(ctx, newer); err != nil {
+			return nil, err
+		}
+		if s.maxRev == 0 || store.NoHistory(docs[i].Meta) {
+			continue
+		}
+		if _, err := s.putHistory(ctx, d.Key, d.Head, docs[i].Meta, docs[i].Text); err != nil {
+			return nil, err
+		}
+	}
+	s.histSize.Reset()
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history.
+func (s *couchStore) historyEntries(ctx context.Context) ([]store.HistoryEntry, error) {
+	rows, err := s.docs(ctx, historyPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]store.HistoryEntry, 0, len(rows))
+	for _, r := range rows {
+		key, rev, ok := parseHistoryID(r.ID)
+		if !ok || r.Doc == nil {
+			continue
+		}
+		entries = append(entries, store.HistoryEntry{Key: key, Rev: rev, Size: int64(len(r.Doc.Meta) + len(r.Doc.Text)), Seq: r.Doc.Seq})
+	}
+	return entries, nil
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *couchStore) checkHistorySize(added int64) {
+	ctx := context.Background()
+	var entries []store.HistoryEntry
+	scan := func() (int64, error) {
+		var err error
+		entries, err = s.historyEntries(ctx)
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		return total, err
+	}
+	if !s.histSize.Grow(added, scan) {
+		return
+	}
+
+	if entries == nil {
+		var err error
+		entries, err = s.historyEntries(ctx)
+		if err != nil {
+			log.Println("[couchdb] list history error", err)
+			return
+		}
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		d, err := s.getDoc(ctx, historyID(e.Key, e.Rev))
+		if err == nil && d != nil {
+			_, err = s.do(ctx, "DELETE", url.PathEscape(d.ID), url.Values{"rev": {d.Rev}}, nil, nil)
+		}
+		if err != nil {
+			log.Println("[couchdb] prune history error", err)
+			s.histSize.Reset()
+			return
+		}
+	}
+	log.Printf("[couchdb] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
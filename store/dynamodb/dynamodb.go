@@ -0,0 +1,568 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package dynamodb is an Amazon DynamoDB TiddlerStore backend, for containers without a disk.
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"../../store"
+)
+
+const (
+	TypeName = "dynamodb"
+
+	// headRev is the sort key of the tiddler, its history is under the revision numbers.
+	headRev = 0
+
+	// maxItemSize is the largest item DynamoDB takes, less room for the attribute names.
+	maxItemSize = 400 * 1024 - 1024
+)
+
+// dynamoStore keeps every tiddler as the item (title, rev 0) with the attributes meta
+// (JSON without text), text and revision, and each revision of its history as the item
+// (title, revision) with meta, text, seq (ordering the history across tiddlers) and size.
+type dynamoStore struct {
+	client   *dynamodb.Client
+	table    string
+	maxRev   int
+	histSize store.HistorySize
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open uses the table of dataSource, e.g. dynamodb://widdly?region=eu-west-1, creating it if missing
+// (on demand capacity). The credentials come from the usual AWS environment variables, files
+// or the role of the instance or task; ?endpoint=http://localhost:8000 talks to DynamoDB Local.
+func Open(dataSource string) (store.TiddlerStore, error) {
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "dynamodb" || u.Host == "" {
+		return nil, fmt.Errorf("dynamodb: source must be dynamodb://<table>, got %q", dataSource)
+	}
+	q := u.Query()
+
+	ctx := context.Background()
+	var opts []func(*config.LoadOptions) error
+	if region := q.Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint := q.Get("endpoint"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	s := &dynamoStore{client: client, table: u.Host, maxRev: -1}
+	if err := s.createTable(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createTable creates the table unless it exists, and waits until it is usable.
+func (s *dynamoStore) createTable(ctx context.Context) (error) {
+	_, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.table)})
+	var missing *types.ResourceNotFoundException
+	if !errors.As(err, &missing) {
+		return err
+	}
+	_, err = s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(s.table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("title"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("rev"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("title"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("rev"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("[dynamodb] created table", s.table)
+	return dynamodb.NewTableExistsWaiter(s.client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.table)}, 5 * time.Minute)
+}
+
+func str(s string) (types.AttributeValue) {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+func num(n int64) (types.AttributeValue) {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+// itemKey returns the primary key of revision rev of title, headRev for the tiddler.
+func itemKey(title string, rev int) (map[string]types.AttributeValue) {
+	return map[string]types.AttributeValue{"title": str(title), "rev": num(int64(rev))}
+}
+
+func getS(item map[string]types.AttributeValue, name string) (string) {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func getN(item map[string]types.AttributeValue, name string) (int64) {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// names are the attribute names in expressions, some are reserved words.
+var names = map[string]string{"#k": "title", "#r": "rev", "#v": "revision", "#m": "meta", "#x": "text", "#q": "seq", "#z": "size"}
+
+// namesOf returns the attribute names used by the expressions exprs, DynamoDB refuses unused ones.
+func namesOf(exprs ...string) (map[string]string) {
+	used := make(map[string]string)
+	for _, e := range exprs {
+		for i := 0; i+1 < len(e); i++ {
+			if e[i] == '#' {
+				if name, ok := names[e[i:i+2]]; ok {
+					used[e[i:i+2]] = name
+				}
+			}
+		}
+	}
+	return used
+}
+
+func (s *dynamoStore) Close() error {
+	return nil
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *dynamoStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: itemKey(store.StoreKey(key), headRev),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, store.ErrNotFound
+	}
+	return store.NewTiddler([]byte(getS(out.Item, "meta")), []byte(getS(out.Item, "text")))
+}
+
+// scan calls fn with every item matching filter, reading only the attributes of proj.
+func (s *dynamoStore) scan(ctx context.Context, filter string, values map[string]types.AttributeValue, proj string, fn func(map[string]types.AttributeValue)) (error) {
+	in := &dynamodb.ScanInput{
+		TableName: aws.String(s.table),
+		ProjectionExpression: aws.String(proj),
+		ExpressionAttributeNames: namesOf(filter, proj),
+		ConsistentRead: aws.Bool(true),
+	}
+	if filter != "" {
+		in.FilterExpression = aws.String(filter)
+		in.ExpressionAttributeValues = values
+	}
+	p := dynamodb.NewScanPaginator(s.client, in)
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			fn(item)
+		}
+	}
+	return nil
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Tiddlers tagged with one of store.FatTags are returned fat, their texts read in batches.
+func (s *dynamoStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	metas := make(map[string][]byte)
+	fat := make([]string, 0)
+	err := s.scan(ctx, "#r = :head", map[string]types.AttributeValue{":head": num(headRev)}, "#k, #m", func(item map[string]types.AttributeValue) {
+		title, meta := getS(item, "title"), []byte(getS(item, "meta"))
+		metas[title] = meta
+		if store.IsFat(meta) {
+			fat = append(fat, title)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	texts, err := s.texts(ctx, fat)
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := make([]*store.Tiddler, 0, len(metas))
+	for title, meta := range metas {
+		var text []byte
+		if t, ok := texts[title]; ok {
+			text = []byte(t)
+		}
+		t, err := store.NewTiddler(meta, text)
+		if err != nil {
+			continue
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// texts reads the texts of the tiddlers titled titles, 100 a request.
+func (s *dynamoStore) texts(ctx context.Context, titles []string) (map[string]string, error) {
+	texts := make(map[string]string, len(titles))
+	for len(titles) > 0 {
+		n := len(titles)
+		if n > 100 {
+			n = 100
+		}
+		keys := make([]map[string]types.AttributeValue, 0, n)
+		for _, title := range titles[:n] {
+			keys = append(keys, itemKey(title, headRev))
+		}
+		titles = titles[n:]
+
+		req := map[string]types.KeysAndAttributes{s.table: {
+			Keys: keys,
+			ProjectionExpression: aws.String("#k, #x"),
+			ExpressionAttributeNames: namesOf("#k, #x"),
+			ConsistentRead: aws.Bool(true),
+		}}
+		for wait := 50 * time.Millisecond; len(req) > 0; wait *= 2 {
+			out, err := s.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: req})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Responses[s.table] {
+				texts[getS(item, "title")] = getS(item, "text")
+			}
+			req = out.UnprocessedKeys
+			if len(req) > 0 {
+				time.Sleep(wait) // throttled
+			}
+		}
+	}
+	return texts, nil
+}
+
+// keysOf lists the keys of the items of title with a sort key from min to max.
+func (s *dynamoStore) keysOf(ctx context.Context, title string, min int, max int) ([]map[string]types.AttributeValue, error) {
+	cond := "#k = :t AND #r BETWEEN :min AND :max"
+	p := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName: aws.String(s.table),
+		KeyConditionExpression: aws.String(cond),
+		ProjectionExpression: aws.String("#k, #r"),
+		ExpressionAttributeNames: namesOf(cond),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":t": str(title), ":min": num(int64(min)), ":max": num(int64(max))},
+		ConsistentRead: aws.Bool(true),
+	})
+	keys := make([]map[string]types.AttributeValue, 0)
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page.Items...)
+	}
+	return keys, nil
+}
+
+// deleteKeys deletes the items of keys, 25 a request.
+func (s *dynamoStore) deleteKeys(ctx context.Context, keys []map[string]types.AttributeValue) (error) {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 25 {
+			n = 25
+		}
+		reqs := make([]types.WriteRequest, 0, n)
+		for _, k := range keys[:n] {
+			reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: k}})
+		}
+		keys = keys[n:]
+
+		req := map[string][]types.WriteRequest{s.table: reqs}
+		for wait := 50 * time.Millisecond; len(req) > 0; wait *= 2 {
+			out, err := s.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: req})
+			if err != nil {
+				return err
+			}
+			req = out.UnprocessedItems
+			if len(req) > 0 {
+				time.Sleep(wait) // throttled
+			}
+		}
+	}
+	return nil
+}
+
+// historyItem returns the history item of revision rev.
+func historyItem(title string, rev int, meta []byte, text string) (map[string]types.AttributeValue) {
+	item := itemKey(title, rev)
+	item["meta"] = str(string(meta))
+	item["text"] = str(text)
+	item["seq"] = num(time.Now().UnixNano())
+	item["size"] = num(int64(len(meta) + len(text)))
+	return item
+}
+
+// conflict tells whether err is a transaction canceled by a concurrent change.
+func conflict(err error) (bool) {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return false
+	}
+	for _, r := range tce.CancellationReasons {
+		if code := aws.ToString(r.Code); code == "ConditionalCheckFailed" || code == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The tiddler and its history item are written in one transaction, on the condition
+// that the revision did not change meanwhile, else it is read and written again.
+func (s *dynamoStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	history := s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys
+
+	var rev int
+	var size int64
+	for {
+		cur, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(s.table),
+			Key: itemKey(tiddler.Key, headRev),
+			ProjectionExpression: aws.String("#v"),
+			ExpressionAttributeNames: namesOf("#v"),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return 0, err
+		}
+		prev := int(getN(cur.Item, "revision"))
+		rev = prev + 1
+		if cur.Item == nil {
+			rev = 2
+		}
+
+		tiddler.Js["revision"] = rev
+		meta, err := json.Marshal(tiddler.Js)
+		if err != nil {
+			return 0, err
+		}
+		size = int64(len(meta) + len(text))
+		if size > maxItemSize {
+			return 0, fmt.Errorf("dynamodb: tiddler %q is %d bytes, over the 400 KB item limit", tiddler.Key, size)
+		}
+
+		head := itemKey(tiddler.Key, headRev)
+		head["meta"] = str(string(meta))
+		head["text"] = str(text)
+		head["revision"] = num(int64(rev))
+		put := &types.Put{TableName: aws.String(s.table), Item: head}
+		if cur.Item == nil {
+			put.ConditionExpression = aws.String("attribute_not_exists(#k)")
+		} else {
+			put.ConditionExpression = aws.String("#v = :prev")
+			put.ExpressionAttributeValues = map[string]types.AttributeValue{":prev": num(int64(prev))}
+		}
+		put.ExpressionAttributeNames = namesOf(*put.ConditionExpression)
+		items := []types.TransactWriteItem{{Put: put}}
+		if history {
+			items = append(items, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(s.table), Item: historyItem(tiddler.Key, rev, meta, text)}})
+		}
+
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if conflict(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		break
+	}
+
+	if !history {
+		return rev, nil
+	}
+	// remove old history
+	if s.maxRev > 0 && rev - s.maxRev > 1 {
+		keys, err := s.keysOf(ctx, tiddler.Key, 1, rev - 1 - s.maxRev)
+		if err == nil {
+			err = s.deleteKeys(ctx, keys)
+		}
+		if err != nil {
+			return rev, err
+		}
+		s.histSize.Reset()
+	}
+	s.checkHistorySize(size)
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *dynamoStore) Delete(ctx context.Context, key string) error {
+	keys, err := s.keysOf(ctx, store.StoreKey(key), headRev, int(^uint32(0) >> 1))
+	if err != nil {
+		return err
+	}
+	err = s.deleteKeys(ctx, keys)
+	s.histSize.Reset()
+	return err
+}
+
+func (s *dynamoStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *dynamoStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// Audit checks the newest revision in the history of every tiddler against the tiddler.
+func (s *dynamoStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	heads := make(map[string]int)
+	metas := make(map[string][]byte)
+	latest := make(map[string]int)
+	err := s.scan(ctx, "", nil, "#k, #r, #v, #m", func(item map[string]types.AttributeValue) {
+		title, rev := getS(item, "title"), int(getN(item, "rev"))
+		if rev == headRev {
+			heads[title] = int(getN(item, "revision"))
+			metas[title] = []byte(getS(item, "meta"))
+		} else if rev > latest[title] {
+			latest[title] = rev
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	divs := make([]store.Divergence, 0)
+	for title, head := range heads {
+		d := store.Divergence{Key: title, Head: head, Latest: latest[title]}
+		if store.Diverges(metas[title], d.Head, d.Latest, s.maxRev != 0) {
+			divs = append(divs, d)
+		}
+	}
+	if !repair {
+		return divs, nil
+	}
+
+	for _, d := range divs {
+		from := d.Head
+		if from <= headRev { // never the tiddler itself
+			from = headRev + 1
+		}
+		keys, err := s.keysOf(ctx, d.Key, from, int(^uint32(0) >> 1))
+		if err == nil {
+			err = s.deleteKeys(ctx, keys)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.maxRev == 0 || store.NoHistory(metas[d.Key]) {
+			continue
+		}
+		cur, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(s.table), Key: itemKey(d.Key, headRev), ConsistentRead: aws.Bool(true)})
+		if err != nil {
+			return nil, err
+		}
+		if cur.Item == nil { // deleted meanwhile
+			continue
+		}
+		item := historyItem(d.Key, d.Head, []byte(getS(cur.Item, "meta")), getS(cur.Item, "text"))
+		if _, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item}); err != nil {
+			return nil, err
+		}
+	}
+	s.histSize.Reset()
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history.
+func (s *dynamoStore) historyEntries(ctx context.Context) ([]store.HistoryEntry, error) {
+	entries := make([]store.HistoryEntry, 0)
+	err := s.scan(ctx, "#r > :head", map[string]types.AttributeValue{":head": num(headRev)}, "#k, #r, #q, #z", func(item map[string]types.AttributeValue) {
+		entries = append(entries, store.HistoryEntry{Key: getS(item, "title"), Rev: int(getN(item, "rev")), Size: getN(item, "size"), Seq: getN(item, "seq")})
+	})
+	return entries, err
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *dynamoStore) checkHistorySize(added int64) {
+	ctx := context.Background()
+	var entries []store.HistoryEntry
+	scan := func() (int64, error) {
+		var err error
+		entries, err = s.historyEntries(ctx)
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		return total, err
+	}
+	if !s.histSize.Grow(added, scan) {
+		return
+	}
+
+	if entries == nil {
+		var err error
+		entries, err = s.historyEntries(ctx)
+		if err != nil {
+			log.Println("[dynamodb] list history error", err)
+			return
+		}
+	}
+	del, total := s.histSize.Prune(entries)
+	keys := make([]map[string]types.AttributeValue, 0, len(del))
+	for _, e := range del {
+		keys = append(keys, itemKey(e.Key, e.Rev))
+	}
+	if err := s.deleteKeys(ctx, keys); err != nil {
+		log.Println("[dynamodb] prune history error", err)
+		s.histSize.Reset()
+		return
+	}
+	log.Printf("[dynamodb] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
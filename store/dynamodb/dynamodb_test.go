@@ -0,0 +1,121 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"../../store"
+	"../storetest"
+)
+
+// The tests need a table they may empty, e.g. on DynamoDB Local
+//
+//	WIDDLY_TEST_DYNAMODB='dynamodb://widdly_test?region=us-east-1&endpoint=http://localhost:8000' go test
+//
+// it is emptied by every test.
+func openTemp(tb testing.TB) storetest.OpenFn {
+	source := os.Getenv("WIDDLY_TEST_DYNAMODB")
+	if source == "" {
+		tb.Skip("$WIDDLY_TEST_DYNAMODB not set")
+	}
+	return func(dir string) (store.TiddlerStore, error) {
+		db, err := Open(source)
+		if err != nil {
+			return nil, err
+		}
+		s := db.(*dynamoStore)
+		ctx := context.Background()
+		keys := make([]map[string]types.AttributeValue, 0)
+		err = s.scan(ctx, "", nil, "#k, #r", func(item map[string]types.AttributeValue) {
+			keys = append(keys, item)
+		})
+		if err == nil {
+			err = s.deleteKeys(ctx, keys)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+func TestStore(t *testing.T) {
+	open := openTemp(t)
+	storetest.Run(t, open)
+	storetest.RunSystem(t, open)
+	storetest.RunOrder(t, open)
+	storetest.RunPage(t, open)
+	storetest.RunAudit(t, open)
+	storetest.RunBatch(t, open)
+	storetest.RunCase(t, open)
+}
+
+func TestMaxHistory(t *testing.T) {
+	db, err := openTemp(t)("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := db.(*dynamoStore)
+
+	ctx := context.Background()
+	db.SetMaxHistory(2)
+	td := storetest.NewTiddler(1)
+	for i := 0; i < 5; i++ {
+		if _, err := db.Put(ctx, storetest.NewTiddler(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := s.keysOf(ctx, td.Key, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || getN(keys[0], "rev") != 5 || getN(keys[1], "rev") != 6 {
+		t.Errorf("want revisions 5 and 6 kept, got %v", keys)
+	}
+
+	if err := db.Delete(ctx, td.Key); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s.keysOf(ctx, td.Key, headRev, 100)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("want every item deleted, got %d (%v)", len(keys), err)
+	}
+}
+
+func TestItemLimit(t *testing.T) {
+	db, err := openTemp(t)("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := make([]byte, maxItemSize)
+	for i := range big {
+		big[i] = 'x'
+	}
+	td := store.Tiddler{Key: "big", Js: map[string]interface{}{"title": "big", "text": string(big)}}
+	if _, err := db.Put(context.Background(), td); err == nil {
+		t.Error("want a tiddler over the item limit refused")
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp(b))
+}
@@ -20,10 +20,16 @@ import (
 	"strings"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
 
 	"../../store"
 )
@@ -32,12 +38,18 @@ const (
 	TypeName = "flatFile"
 )
 
+// Workers is how many files All reads at once, which hides the latency of
+// spinning disks and network file systems.
+var Workers = 8
+
 // flatFileStore is a file base store for tiddlers.
 type flatFileStore struct {
 	storePath string
 	tiddlersPath string
 	tiddlerHistoryPath string
 	maxRev int
+	histSize store.HistorySize
+	native bool // tiddlers are single .tid files, see convert
 }
 
 func init() {
@@ -69,7 +81,25 @@ func checkExt(pathS string, ext string) []string {
 
 // Open opens the flatFile path specified as dataSource,
 // creates the necessary directory and returns a TiddlerStore.
+// store.BackendOptions may set:
+//
+//	format    meta (default) for a JSON .meta and a .tid text file per tiddler, tid for native TiddlyWiki .tid files
+//
+// The tiddlers saved in the other format are converted.
 func Open(dataSource string) (store.TiddlerStore, error) {
+	o := store.BackendOptions
+	if err := o.Check(TypeName, "format"); err != nil {
+		return nil, err
+	}
+	var native bool
+	switch format := o.String("format", "meta"); format {
+	case "meta":
+	case "tid":
+		native = true
+	default:
+		return nil, fmt.Errorf("%s: format must be meta or tid, got %q", TypeName, format)
+	}
+
 	storePath := filepath.Join(".", dataSource)
 	tiddlersPath := filepath.Join(storePath, "tiddlers")
 	if _, err := os.Stat(tiddlersPath); os.IsNotExist(err) {
@@ -86,7 +116,51 @@ func Open(dataSource string) (store.TiddlerStore, error) {
 			return nil, err
 		}
 	}
-	return &flatFileStore{storePath, tiddlersPath, tiddlerHistoryPath, -1}, nil
+	s := &flatFileStore{
+		storePath: storePath,
+		tiddlersPath: tiddlersPath,
+		tiddlerHistoryPath: tiddlerHistoryPath,
+		maxRev: -1,
+		native: native,
+	}
+	if err := s.convert(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// format is the name of the format option of the store.
+func (s *flatFileStore) format() string {
+	if s.native {
+		return "tid"
+	}
+	return "meta"
+}
+
+// ext is the extension of the file listing a tiddler: .tid for native stores, else .meta.
+func (s *flatFileStore) ext() string {
+	if s.native {
+		return ".tid"
+	}
+	return ".meta"
+}
+
+// readMeta reads the skinny meta of the tiddler of the clean key.
+func (s *flatFileStore) readMeta(key string) ([]byte, error) {
+	if s.native {
+		meta, _, err := readNativeHeader(filepath.Join(s.tiddlersPath, key + ".tid"))
+		return meta, err
+	}
+	return ioutil.ReadFile(filepath.Join(s.tiddlersPath, key + ".meta"))
+}
+
+// openText opens the text of the tiddler of the clean key.
+func (s *flatFileStore) openText(key string) (io.ReadCloser, error) {
+	if s.native {
+		_, f, _, err := openNative(filepath.Join(s.tiddlersPath, key + ".tid"))
+		return f, err
+	}
+	return os.Open(filepath.Join(s.tiddlersPath, key + ".tid"))
 }
 
 func (s *flatFileStore) Close() error {
@@ -109,11 +183,41 @@ func cleanPath(key string) string {
 	return filepath.FromSlash(path.Clean("/" + key))
 }
 
+// fileKey returns the clean file name, without extension, of the tiddler titled key.
+// Under store.CaseSensitive the names which a case-insensitive file system or key2File
+// could merge with others get a hash of the title appended.
+func fileKey(key string) string {
+	key = store.StoreKey(key)
+	name := key2File(key)
+	if store.TitleCase == store.CaseSensitive && (name != key || strings.ToLower(name) != name) {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		name = fmt.Sprintf("%s~%08x", name, h.Sum32())
+	}
+	return cleanPath(name)
+}
+
+// TiddlerPaths returns the paths of the meta and the text file of the tiddler titled key,
+// relative to the store directory. A store of the format tid only has the text file.
+func TiddlerPaths(key string) (meta string, text string) {
+	name := filepath.Join("tiddlers", fileKey(key))
+	return name + ".meta", name + ".tid"
+}
+
 // Get retrieves a tiddler from the store by key (title).
 func (s *flatFileStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
-	isSys := strings.HasPrefix(key, "$:/")
-	key = cleanPath(key2File(key))
+	key = fileKey(key)
 	tiddlerPath := filepath.Join(s.tiddlersPath, key + ".tid")
+	if s.native {
+		meta, text, err := readNative(tiddlerPath)
+		if os.IsNotExist(err) {
+			return nil, store.ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return store.NewTiddler(meta, text)
+	}
 	tiddlerMetaPath := filepath.Join(s.tiddlersPath, key + ".meta")
 	if _, err := os.Stat(tiddlerMetaPath); os.IsNotExist(err) {
 		return nil, store.ErrNotFound
@@ -124,52 +228,151 @@ func (s *flatFileStore) Get(_ context.Context, key string) (*store.Tiddler, erro
 		return nil, err
 	}
 
-	var tiddler []byte
-	if !isSys {
-		tiddler, err = ioutil.ReadFile(tiddlerPath)
-		if err != nil {
-			return nil, err
-		}
+	tiddler, err := ioutil.ReadFile(tiddlerPath)
+	if os.IsNotExist(err) {
+		// system tiddlers of older versions keep the text inside meta
+		return store.NewTiddler(meta, nil)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	return store.NewTiddler(meta, tiddler)
 }
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
-// Special tiddlers (like global macros) are returned fat.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+// The files are read by Workers goroutines at once.
 func (s *flatFileStore) All(_ context.Context) ([]*store.Tiddler, error) {
-	tiddlers := make([]*store.Tiddler, 0)
-	files := checkExt(s.tiddlersPath, ".meta")
+	files := checkExt(s.tiddlersPath, s.ext())
+	tiddlers := make([]*store.Tiddler, len(files))
+
+	workers := Workers
+	if workers > len(files) {
+		workers = len(files)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var metaBuf, textBuf bytes.Buffer // reused for every file of the worker
+			for i := range next {
+				tiddlers[i] = s.readListed(files[i], &metaBuf, &textBuf)
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	// the file names are mapped titles, in Walk order
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// AllPage is All from the first key after the cursor after, at most limit tiddlers.
+// Only the files of the page are read: the key of a tiddler is the name of its file,
+// unless key2File or the title case policy changed it, then it is read from the file.
+func (s *flatFileStore) AllPage(_ context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	type entry struct {
+		key  string
+		file string
+		t    *store.Tiddler // when read for its key
+	}
+	var metaBuf, textBuf bytes.Buffer
+	files := checkExt(s.tiddlersPath, s.ext())
+	entries := make([]entry, 0, len(files))
 	for _, file := range files {
-		var tiddler []byte
-		meta, _ := ioutil.ReadFile(filepath.Join(s.tiddlersPath, file))
-		if bytes.Contains(meta, []byte(`"$:/tags/Macro"`)) {
-			var extension = filepath.Ext(file)
-			var tiddlerPath = file[0:len(file)-len(extension)]
-			tiddler, _ = ioutil.ReadFile(tiddlerPath + ".tid")
+		name := strings.TrimSuffix(file, s.ext())
+		e := entry{key: name, file: file}
+		if strings.ContainsRune(name, '_') || fileKey(name) != cleanPath(name) {
+			e.t = s.readListed(file, &metaBuf, &textBuf)
+			e.key = store.KeyOf(e.t)
+		}
+		if e.key > after {
+			entries = append(entries, e)
 		}
-		t, _ := store.NewTiddler(meta, tiddler)
-		tiddlers = append(tiddlers, t)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	tiddlers := make([]*store.Tiddler, len(entries))
+	for i, e := range entries {
+		if e.t == nil {
+			e.t = s.readListed(e.file, &metaBuf, &textBuf)
+		}
+		tiddlers[i] = e.t
 	}
 	return tiddlers, nil
 }
 
+// readListed reads the tiddler of the .meta file for the list, skinny unless store.IsFat.
+func (s *flatFileStore) readListed(file string, metaBuf *bytes.Buffer, textBuf *bytes.Buffer) (*store.Tiddler) {
+	if s.native {
+		path := filepath.Join(s.tiddlersPath, file)
+		meta, _, _ := readNativeHeader(path)
+		if store.IsFat(meta) {
+			if meta, text, err := readNative(path); err == nil {
+				t, _ := store.NewTiddler(meta, text)
+				return t
+			}
+		}
+		t, _ := store.NewTiddler(meta, nil)
+		return t
+	}
+	meta, _ := readFile(filepath.Join(s.tiddlersPath, file), metaBuf)
+	if store.IsFat(meta) {
+		var extension = filepath.Ext(file)
+		var tiddlerPath = filepath.Join(s.tiddlersPath, file[0:len(file)-len(extension)])
+		tiddler, err := readFile(tiddlerPath + ".tid", textBuf)
+		if err == nil {
+			// decoded into Js, the buffers are not kept
+			t, _ := store.NewTiddler(meta, tiddler)
+			return t
+		}
+	}
+	meta = append([]byte(nil), meta...) // kept as Meta
+	meta = store.Skinny(meta) // system tiddlers of older versions
+	t, _ := store.NewTiddler(meta, nil)
+	return t
+}
+
+// readFile reads the file at path into buf, reusing its memory;
+// the returned bytes are valid until buf is used again.
+func readFile(path string, buf *bytes.Buffer) ([]byte, error) {
+	buf.Reset()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return []byte{}, nil
+	}
+	return buf.Bytes(), nil
+}
+
 // key MUST be clean
 func getLastRevision(s *flatFileStore, key string) int {
 	rev := 1 // start with 1
-	tiddlerMetaPath := filepath.Join(s.tiddlersPath, key + ".meta")
-	if _, err := os.Stat(tiddlerMetaPath); os.IsNotExist(err) {
+	meta, err := s.readMeta(key)
+	if err != nil {
 		return rev
-	}else {
-		meta, err := ioutil.ReadFile(tiddlerMetaPath)
-		if err != nil {
-			return rev
-		}
-
-		t, _ := store.NewTiddler(meta, nil)
-		rev = t.GetRevision()
 	}
-	return rev
+	t, _ := store.NewTiddler(meta, nil)
+	return t.GetRevision()
 }
 
 // delete all revision <= rev, key MUST be clean
@@ -206,79 +409,191 @@ func (s *flatFileStore) trimRevision(key string, rev int) (err error) {
 // Put saves tiddler to the store, incrementing and returning revision.
 // The tiddler is also written to the tiddler_history bucket.
 func (s *flatFileStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	return s.PutStream(ctx, tiddler, strings.NewReader(text))
+}
+
+// PutStream is Put with the text read from text.
+func (s *flatFileStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
 	var err error
-	key := cleanPath(key2File(tiddler.Key))
+	key := fileKey(tiddler.Key)
 
 	rev := getLastRevision(s, key) + 1
 	tiddler.Js["revision"] = rev
 
 	metaPath := filepath.Join(s.tiddlersPath, key + ".meta")
+	tidPath := filepath.Join(s.tiddlersPath, key + ".tid")
 
-	// skip system history, only save meta & data to single file
-	if tiddler.IsSys {
-		meta, err := tiddler.MarshalJSON() // meta with text & rev
+	meta, err := json.Marshal(tiddler.Js) // meta without text
+	if err != nil {
+		return 0, err
+	}
+
+	if s.native {
+		err = writeNative(tidPath, meta, text)
 		if err != nil {
 			return 0, err
 		}
-
-		err = ioutil.WriteFile(metaPath, meta, 0644)
+	} else {
+		f, err := os.Create(tidPath)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(f, text)
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		err = f.Close()
 		if err != nil {
 			return 0, err
 		}
-		return rev, nil
 	}
 
-	// skip Draft history
-	if !tiddler.IsDraft {
+	// skip Draft & system key history
+	if !tiddler.IsDraft && !tiddler.IsSys {
 		switch s.maxRev {
 		case 0: // disable
 		default: // > 0, remove old history
 			if rev - s.maxRev > 1 {
 				s.trimRevision(key, rev - 1 - s.maxRev)
+				s.histSize.Reset()
 			}
 			fallthrough
 		case -1: // unlimit
-			data, err := tiddler.MarshalJSON()
-			err = ioutil.WriteFile(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, rev)), data, 0644)
+			size, err := s.writeHistory(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, rev)), meta, key)
 			if err != nil {
 				return rev, err
 			}
+			s.checkHistorySize(size)
 		}
 	}
 
-	text, _ := tiddler.Js["text"].(string)
-	delete(tiddler.Js, "text")
-	meta, err := json.Marshal(tiddler.Js) // meta without text
+	if s.native {
+		return rev, nil
+	}
+	err = ioutil.WriteFile(metaPath, meta, 0644)
 	if err != nil {
 		return 0, err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(s.tiddlersPath, key + ".tid"), []byte(text), 0644)
+	return rev, nil
+}
+
+// writeHistory writes meta with the text of the clean key as a fat tiddler to hpath, returning its size.
+func (s *flatFileStore) writeHistory(hpath string, meta []byte, key string) (int64, error) {
+	tf, err := s.openText(key)
 	if err != nil {
 		return 0, err
 	}
-	err = ioutil.WriteFile(metaPath, meta, 0644)
+	defer tf.Close()
+
+	hf, err := os.Create(hpath)
+	if err != nil {
+		return 0, err
+	}
+	err = store.WriteFatJSON(hf, meta, tf)
 	if err != nil {
+		hf.Close()
 		return 0, err
 	}
 
-	return rev, nil
+	fi, err := hf.Stat()
+	if err != nil {
+		hf.Close()
+		return 0, err
+	}
+	return fi.Size(), hf.Close()
 }
 
-// Delete deletes a tiddler with the given key (title) from the store.
+// GetStream returns the skinny meta of a tiddler and its text file.
+func (s *flatFileStore) GetStream(_ context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	key = fileKey(key)
+	if s.native {
+		meta, f, size, err := openNative(filepath.Join(s.tiddlersPath, key + ".tid"))
+		if os.IsNotExist(err) {
+			return nil, nil, 0, store.ErrNotFound
+		}
+		return meta, f, size, err
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(s.tiddlersPath, key + ".meta"))
+	if os.IsNotExist(err) {
+		return nil, nil, 0, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	f, err := os.Open(filepath.Join(s.tiddlersPath, key + ".tid"))
+	if os.IsNotExist(err) {
+		// system tiddlers of older versions keep the text inside meta
+		t, err := store.NewTiddler(meta, nil)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		js, err := t.Fields()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		text, _ := js["text"].(string)
+		return store.Skinny(meta), ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	return meta, f, fi.Size(), nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
 func (s *flatFileStore) Delete(ctx context.Context, key string) error {
-	key = cleanPath(key2File(key))
-	rev := getLastRevision(s, key)
-	err := os.Remove(filepath.Join(s.tiddlersPath, key + ".meta"))
+	key = fileKey(key)
+	err := os.Remove(filepath.Join(s.tiddlersPath, key + s.ext()))
 	if err != nil {
 		return err
 	}
 	err = os.Remove(filepath.Join(s.tiddlersPath, key + ".tid"))
+	if err != nil && !os.IsNotExist(err) { // system tiddlers have no .tid
+		return err
+	}
+
+	err = s.removeHistory(key)
+	s.histSize.Reset()
+	return err
+}
+
+// removeHistory deletes all revisions of key, including the ones left behind gaps.
+// key MUST be clean
+func (s *flatFileStore) removeHistory(key string) error {
+	dir, err := os.Open(s.tiddlerHistoryPath)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
 	if err != nil {
 		return err
 	}
 
-	s.trimRevision(key, rev)
+	prefix := strings.TrimPrefix(key, string(filepath.Separator)) + "#"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := strconv.Atoi(name[len(prefix):]); err != nil {
+			continue
+		}
+		err = os.Remove(filepath.Join(s.tiddlerHistoryPath, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -286,3 +601,204 @@ func (s *flatFileStore) SetMaxHistory(rev int) {
 	s.maxRev = rev
 }
 
+func (s *flatFileStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// ListRevisions returns the revisions of key in the history directory, newest first.
+func (s *flatFileStore) ListRevisions(_ context.Context, key string) ([]store.Revision, error) {
+	hpath := filepath.Join(s.tiddlerHistoryPath, fileKey(key) + "#")
+	names, err := readDirNames(filepath.Dir(hpath))
+	if os.IsNotExist(err) {
+		return []store.Revision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(hpath)
+	revs := make([]store.Revision, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rev, err := strconv.Atoi(name[len(prefix):])
+		if err != nil { // the history of a longer title, "a#b#2" for "a"
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(hpath), name))
+		if os.IsNotExist(err) { // pruned meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, r, err := store.ParseRevision(rev, data)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, r)
+	}
+	store.SortRevisions(revs)
+	return revs, nil
+}
+
+// GetRevision returns the revision rev of key in the history directory.
+func (s *flatFileStore) GetRevision(_ context.Context, key string, rev int) (*store.Tiddler, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", fileKey(key), rev)))
+	if os.IsNotExist(err) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, _, err := store.ParseRevision(rev, data)
+	return t, err
+}
+
+// Audit checks the newest revision in the history directory of every tiddler against the tiddler.
+func (s *flatFileStore) Audit(_ context.Context, repair bool) ([]store.Divergence, error) {
+	entries, err := s.historyEntries()
+	if err != nil {
+		return nil, err
+	}
+	revs := make(map[string][]int)
+	for _, e := range entries {
+		revs[e.Key] = append(revs[e.Key], e.Rev)
+	}
+
+	divs := make([]store.Divergence, 0)
+	for _, file := range checkExt(s.tiddlersPath, s.ext()) {
+		key := strings.TrimSuffix(file, s.ext())
+		meta, err := s.readMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		t, _ := store.NewTiddler(meta, nil)
+		head := t.GetRevision()
+		latest := 0
+		for _, rev := range revs[key] {
+			if rev > latest {
+				latest = rev
+			}
+		}
+		if !store.Diverges(meta, head, latest, s.maxRev != 0) {
+			continue
+		}
+		divs = append(divs, store.Divergence{Key: key, Head: head, Latest: latest})
+		if !repair {
+			continue
+		}
+
+		for _, rev := range revs[key] {
+			if rev < head {
+				continue
+			}
+			err := os.Remove(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, rev)))
+			if err != nil && !os.IsNotExist(err) {
+				return divs, err
+			}
+		}
+		if s.maxRev == 0 || store.NoHistory(meta) {
+			continue
+		}
+		hpath := filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", key, head))
+		if _, err := s.writeHistory(hpath, meta, key); err != nil {
+			return divs, err
+		}
+	}
+	if repair {
+		s.histSize.Reset()
+	}
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history directory, ordered by modify time.
+func (s *flatFileStore) historyEntries() ([]store.HistoryEntry, error) {
+	files, err := ioutil.ReadDir(s.tiddlerHistoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]store.HistoryEntry, 0, len(files))
+	for _, fi := range files {
+		name := fi.Name()
+		idx := strings.LastIndexByte(name, '#')
+		if idx < 0 || fi.IsDir() {
+			continue
+		}
+		rev, err := strconv.Atoi(name[idx+1:])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, store.HistoryEntry{
+			Key: name[:idx],
+			Rev: rev,
+			Size: fi.Size(),
+			Seq: fi.ModTime().UnixNano(),
+		})
+	}
+	return entries, nil
+}
+
+func (s *flatFileStore) historySize() (int64, error) {
+	entries, err := s.historyEntries()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	return total, nil
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *flatFileStore) checkHistorySize(added int64) {
+	if !s.histSize.Grow(added, s.historySize) {
+		return
+	}
+
+	entries, err := s.historyEntries()
+	if err != nil {
+		log.Println("[flatFile] list history error", err)
+		return
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		os.Remove(filepath.Join(s.tiddlerHistoryPath, fmt.Sprintf("%s#%d", e.Key, e.Rev)))
+	}
+	log.Printf("[flatFile] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
+
+
+// Stats reports the files of the tiddlers and of the history, which
+// slow down All and the backups once there are many.
+func (s *flatFileStore) Stats(_ context.Context) ([]store.Stat, error) {
+	files, err := ioutil.ReadDir(s.tiddlersPath)
+	if err != nil {
+		return nil, err
+	}
+	var tiddlers, size int64
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) == s.ext() {
+			tiddlers++
+		}
+		size += fi.Size()
+	}
+	hist, err := s.historyEntries()
+	if err != nil {
+		return nil, err
+	}
+	var histSize int64
+	for _, e := range hist {
+		histSize += e.Size
+	}
+	return []store.Stat{
+		{Name: "files", Help: "Files in the tiddlers folder.", Value: float64(len(files))},
+		{Name: "tiddlers", Help: "Tiddlers in the tiddlers folder.", Value: float64(tiddlers)},
+		{Name: "file_bytes", Help: "Size of the files in the tiddlers folder.", Value: float64(size)},
+		{Name: "history_files", Help: "Revisions in the history folder.", Value: float64(len(hist))},
+		{Name: "history_bytes", Help: "Size of the revisions in the history folder.", Value: float64(histSize)},
+	}, nil
+}
@@ -0,0 +1,374 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatFile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../storetest"
+)
+
+// openTemp opens dir relative to the working directory, as Open joins dataSource onto ".".
+func openTemp(dir string) (store.TiddlerStore, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return nil, err
+	}
+	return Open(rel)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunRevisions(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp)
+}
+
+func TestHistorySize(t *testing.T) {
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := db.(*flatFileStore)
+
+	ctx := context.Background()
+	td := storetest.NewTiddler(0)
+	one, _ := td.MarshalJSON()
+	db.SetMaxHistorySize(int64(len(one)) * 5)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if _, err := db.Put(ctx, storetest.NewTiddler(j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	entries, err := s.historyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	latest := make(map[string]int)
+	for _, e := range entries {
+		total += e.Size
+		if e.Rev > latest[e.Key] {
+			latest[e.Key] = e.Rev
+		}
+	}
+	if total > int64(len(one))*6 {
+		t.Errorf("history not pruned: %d bytes in %d revisions", total, len(entries))
+	}
+	if len(latest) != 3 {
+		t.Errorf("want latest revision of 3 tiddlers kept, got %d", len(latest))
+	}
+}
+
+func TestDeleteHistory(t *testing.T) {
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := db.(*flatFileStore)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		db.Put(ctx, storetest.NewTiddler(1))
+	}
+	db.SetMaxHistory(0) // keep the history written so far
+	db.Put(ctx, storetest.NewTiddler(1))
+	db.SetMaxHistory(-1) // leave a gap
+	db.Put(ctx, storetest.NewTiddler(1))
+
+	sys := store.Tiddler{Key: "$:/config/x", IsSys: true, Js: map[string]interface{}{"text": "x"}}
+	db.Put(ctx, sys)
+
+	for _, key := range []string{storetest.NewTiddler(1).Key, sys.Key} {
+		if err := db.Delete(ctx, key); err != nil {
+			t.Fatalf("delete %q: %v", key, err)
+		}
+	}
+
+	entries, err := s.historyEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("want history removed, got %d revisions left", len(entries))
+	}
+}
+
+func TestAuditNewerHistory(t *testing.T) {
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := db.(*flatFileStore)
+
+	ctx := context.Background()
+	td := storetest.NewTiddler(1)
+	db.Put(ctx, td)
+	// a crash between writing the history and the meta of revision 3
+	stale := filepath.Join(s.tiddlerHistoryPath, td.Key + "#3")
+	if err := ioutil.WriteFile(stale, []byte(`{"title":"x","revision":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	divs, err := s.Audit(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) != 1 || divs[0].Head != 2 || divs[0].Latest != 3 {
+		t.Errorf("want history newer than revision 2, got %+v", divs)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("want revision 3 dropped, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.tiddlerHistoryPath, td.Key + "#2")); err != nil {
+		t.Errorf("want revision 2 kept: %v", err)
+	}
+}
+
+func TestAllWorkers(t *testing.T) {
+	defer func(n int) { Workers = n }(Workers)
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		td := storetest.NewTiddler(i)
+		if i % 5 == 0 {
+			td.Js["tags"] = "$:/tags/Macro"
+		}
+		db.Put(ctx, td)
+	}
+
+	var lists [][]byte
+	for _, n := range []int{1, 8, 100} {
+		Workers = n
+		tiddlers, err := db.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tiddlers) != 50 {
+			t.Fatalf("%d workers: want 50 tiddlers, got %d", n, len(tiddlers))
+		}
+		data, _ := json.Marshal(tiddlers)
+		lists = append(lists, data)
+	}
+	for i := 1; i < len(lists); i++ {
+		if !bytes.Equal(lists[i], lists[0]) {
+			t.Errorf("list %d differs from the sequential one", i)
+		}
+	}
+	if !bytes.Contains(lists[0], []byte(`"text":"lorem`)) {
+		t.Error("want the macro tiddlers fat")
+	}
+}
+
+func TestStats(t *testing.T) {
+	db, err := openTemp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		db.Put(ctx, storetest.NewTiddler(1))
+		db.Put(ctx, storetest.NewTiddler(2))
+	}
+
+	stats, err := db.(store.StatsStore).Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, st := range stats {
+		got[st.Name] = st.Value
+	}
+	if got["tiddlers"] != 2 || got["files"] != 4 || got["history_files"] != 4 || got["file_bytes"] <= 0 {
+		t.Errorf("want 2 tiddlers in 4 files and 4 revisions, got %v", got)
+	}
+}
+
+// openTid opens dir like openTemp with the option format=tid.
+func openTid(dir string) (store.TiddlerStore, error) {
+	defer func() { store.BackendOptions = nil }()
+	store.BackendOptions = store.Options{"format": "tid"}
+	return openTemp(dir)
+}
+
+func TestNativeStore(t *testing.T) {
+	storetest.Run(t, openTid)
+	storetest.RunSystem(t, openTid)
+	storetest.RunOrder(t, openTid)
+	storetest.RunPage(t, openTid)
+	storetest.RunAudit(t, openTid)
+	storetest.RunRevisions(t, openTid)
+	storetest.RunCase(t, openTid)
+	storetest.RunStats(t, openTid)
+}
+
+func TestNativeFile(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openTid(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	td := store.Tiddler{Key: "Note", Js: map[string]interface{}{
+		"title": "Note", "bag": "bag", "tags": []interface{}{"a b", "c"},
+		"fields": map[string]interface{}{"color": "red"}, "text": "line 1\n\nline 2",
+	}}
+	if _, err := db.Put(ctx, td); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "tiddlers", "Note.tid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "bag: bag\ncolor: red\nrevision: 2\ntags: [[a b]] c\ntitle: Note\n\nline 1\n\nline 2"
+	if string(data) != want {
+		t.Errorf("want .tid file\n%s\ngot\n%s", want, data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tiddlers", "Note.meta")); !os.IsNotExist(err) {
+		t.Errorf("want no .meta file, got %v", err)
+	}
+
+	meta, f, size, err := db.(store.StreamStore).GetStream(ctx, "Note")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(text) != "line 1\n\nline 2" || size != int64(len(text)) {
+		t.Errorf("want the text after the header, got %q of %d bytes", text, size)
+	}
+	if !bytes.Contains(meta, []byte(`"revision":2`)) {
+		t.Errorf("want the revision a number, got %s", meta)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openTemp(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		db.Put(ctx, storetest.NewTiddler(i))
+	}
+	db.Put(ctx, storetest.NewTiddler(1))
+	want, err := db.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, _ := json.Marshal(want)
+
+	for _, open := range []storetest.OpenFn{openTid, openTemp} {
+		db, err = open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := db.(*flatFileStore)
+		got, err := db.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := json.Marshal(got); !bytes.Equal(data, wantJSON) {
+			t.Errorf("format %s: want the tiddlers kept\n%s\ngot\n%s", s.format(), wantJSON, data)
+		}
+		names, _ := readDirNames(s.tiddlersPath)
+		for _, name := range names {
+			if ext := filepath.Ext(name); ext != ".tid" && (s.native || ext != ".meta") {
+				t.Errorf("format %s: left %s", s.format(), name)
+			}
+		}
+		td, err := db.Get(ctx, storetest.NewTiddler(1).Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev := fmt.Sprint(td.Js["revision"]); rev != "3" {
+			t.Errorf("format %s: want revision 3, got %s", s.format(), rev)
+		}
+	}
+}
+
+func TestConvertResume(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openTemp(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	td := storetest.NewTiddler(1)
+	db.Put(ctx, td)
+	s := db.(*flatFileStore)
+
+	// a conversion to .tid interrupted after removing the .meta
+	base := filepath.Join(s.tiddlersPath, fileKey(td.Key))
+	meta, _ := ioutil.ReadFile(base + ".meta")
+	if err := writeNativeFile(base + ".tid~", meta, bytes.NewReader([]byte("lorem"))); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(base + ".meta")
+
+	db, err = openTid(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get(ctx, td.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := got.Js["text"].(string); text != "lorem" {
+		t.Errorf("want the converted text, got %q", text)
+	}
+	if _, err := os.Stat(base + ".tid~"); !os.IsNotExist(err) {
+		t.Errorf("want the temporary file renamed, got %v", err)
+	}
+}
+
+func TestFormatOption(t *testing.T) {
+	defer func() { store.BackendOptions = nil }()
+	for _, o := range []store.Options{{"format": "json"}, {"fromat": "tid"}} {
+		store.BackendOptions = o
+		if _, err := openTemp(t.TempDir()); err == nil {
+			t.Errorf("want %v refused", o)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatFile
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzKey2File(f *testing.F) {
+	for _, key := range []string{"", ".", "..", "../../etc/passwd", "a/b\\c", "$:/core", "C:\\x", "\xff\xfe", "a\x00b"} {
+		f.Add(key)
+	}
+
+	base := filepath.Join("data", "tiddlers")
+	f.Fuzz(func(t *testing.T, key string) {
+		name := cleanPath(key2File(key))
+		for _, ext := range []string{".tid", ".meta"} {
+			p := filepath.Join(base, name+ext)
+			if !strings.HasPrefix(p, base+string(filepath.Separator)) {
+				t.Fatalf("key %q escapes store: %q", key, p)
+			}
+			if filepath.Dir(p) != base {
+				t.Fatalf("key %q maps into sub directory: %q", key, p)
+			}
+		}
+	})
+}
@@ -0,0 +1,278 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package flatFile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"../../store"
+)
+
+// The tiddlers of a store opened with the option format=tid are single native
+// TiddlyWiki .tid files: the fields, revision and bag included, as "name: value"
+// lines, a blank line, then the text. Such a tiddlers folder loads with
+// `tiddlywiki --load`; the history stays in JSON.
+
+// nativeMeta turns the fields of a .tid header into skinny meta JSON.
+func nativeMeta(js map[string]interface{}) ([]byte, error) {
+	delete(js, "text")
+	if rev, ok := js["revision"].(string); ok {
+		if n, err := strconv.Atoi(rev); err == nil {
+			js["revision"] = n
+		}
+	}
+	return json.Marshal(js)
+}
+
+// readNative reads the whole .tid file at path, returning the meta and the text.
+func readNative(path string) ([]byte, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := store.DecodeTid(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	text, _ := js["text"].(string)
+	meta, err := nativeMeta(js)
+	return meta, []byte(text), err
+}
+
+// readNativeHeader reads the header of the .tid file at path, returning the meta
+// and the offset of the text.
+func readNativeHeader(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var header bytes.Buffer
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		header.WriteString(line)
+		if strings.TrimRight(line, "\r\n") == "" || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	js, err := store.DecodeTid(header.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	meta, err := nativeMeta(js)
+	return meta, int64(header.Len()), err
+}
+
+// openNative reads the meta of the .tid file at path and opens it positioned at
+// the text, returning the text size.
+func openNative(path string) ([]byte, io.ReadCloser, int64, error) {
+	meta, offset, err := readNativeHeader(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	return meta, f, fi.Size() - offset, nil
+}
+
+// writeNative writes meta and text as the .tid file at path, through a temporary
+// file renamed over it so that readers never see half a header.
+func writeNative(path string, meta []byte, text io.Reader) error {
+	tmp := path + ".tmp"
+	err := writeNativeFile(tmp, meta, text)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeNativeFile(path string, meta []byte, text io.Reader) error {
+	var js map[string]interface{}
+	if err := json.Unmarshal(meta, &js); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(store.TidHeader(js))
+	if err == nil {
+		_, err = io.Copy(f, text)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// convert rewrites the tiddlers saved in the other format than the one the store
+// is opened with, one by one, so that an interrupted conversion resumes on the
+// next Open.
+//
+// To .tid: "x.tid~" is written, "x.meta" removed, "x.tid~" renamed to "x.tid".
+// To .meta: "x.tid~" (the text) and "x.meta~" are written, "x.tid~" renamed to
+// "x.tid", "x.meta~" to "x.meta".
+func (s *flatFileStore) convert() error {
+	names, err := readDirNames(s.tiddlersPath)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool, len(names))
+	for _, name := range names {
+		files[name] = true
+	}
+
+	converted := 0
+	for _, name := range names {
+		path := filepath.Join(s.tiddlersPath, name)
+		switch {
+		case s.native && strings.HasSuffix(name, ".tid~"):
+			// the old files are gone once .meta is, finish the rename
+			key := strings.TrimSuffix(name, ".tid~")
+			if !files[key + ".meta"] {
+				if err := os.Rename(path, filepath.Join(s.tiddlersPath, key + ".tid")); err != nil {
+					return err
+				}
+			}
+		case !s.native && strings.HasSuffix(name, ".meta~"):
+			key := strings.TrimSuffix(name, ".meta~")
+			if !files[key + ".tid~"] {
+				if err := os.Rename(path, filepath.Join(s.tiddlersPath, key + ".meta")); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		key := strings.TrimSuffix(name, filepath.Ext(name))
+		base := filepath.Join(s.tiddlersPath, key)
+		switch {
+		case s.native && filepath.Ext(name) == ".meta":
+			meta, err := ioutil.ReadFile(base + ".meta")
+			if err != nil {
+				return err
+			}
+			var text io.Reader = bytes.NewReader(nil)
+			f, err := os.Open(base + ".tid")
+			switch {
+			case err == nil:
+				text = f
+			case os.IsNotExist(err):
+				// system tiddlers of older versions keep the text inside meta
+				t, err := store.NewTiddler(meta, nil)
+				if err != nil {
+					return err
+				}
+				js, err := t.Fields()
+				if err != nil {
+					return err
+				}
+				str, _ := js["text"].(string)
+				text = strings.NewReader(str)
+				meta = store.Skinny(meta)
+			default:
+				return err
+			}
+			err = convertToNative(base, meta, text)
+			if f != nil {
+				f.Close()
+			}
+			if err != nil {
+				return err
+			}
+			converted++
+		case !s.native && filepath.Ext(name) == ".tid" && !files[key + ".meta"]:
+			meta, text, err := readNative(base + ".tid")
+			if err == nil && !hasTitle(meta) {
+				err = errors.New("no title field")
+			}
+			if err != nil {
+				// e.g. the text of a save interrupted before its .meta
+				log.Printf("[flatFile] %s is no .tid file, not converted: %v", name, err)
+				continue
+			}
+			err = ioutil.WriteFile(base + ".tid~", text, 0644)
+			if err == nil {
+				err = ioutil.WriteFile(base + ".meta~", meta, 0644)
+			}
+			if err == nil {
+				err = os.Rename(base + ".tid~", base + ".tid")
+			}
+			if err == nil {
+				err = os.Rename(base + ".meta~", base + ".meta")
+			}
+			if err != nil {
+				return err
+			}
+			converted++
+		}
+	}
+	if converted > 0 {
+		log.Printf("[flatFile] converted %d tiddlers of %s to the %s format", converted, s.tiddlersPath, s.format())
+	}
+	return nil
+}
+
+// convertToNative replaces the .meta and .tid files at base by one native .tid file.
+func convertToNative(base string, meta []byte, text io.Reader) error {
+	err := writeNativeFile(base + ".tid~", meta, text)
+	if err == nil {
+		err = os.Remove(base + ".meta")
+	}
+	if err == nil {
+		err = os.Rename(base + ".tid~", base + ".tid")
+	}
+	return err
+}
+
+func hasTitle(meta []byte) bool {
+	var js struct{ Title string }
+	return json.Unmarshal(meta, &js) == nil && js.Title != ""
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
@@ -0,0 +1,290 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package gitstore is a flatFile TiddlerStore backend committing every save to a git repository
+// in the store directory, for the full history, blame and a remote to push to as backup.
+package gitstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	"../../store"
+	"../flatFile"
+)
+
+const (
+	TypeName = "git"
+
+	// ignore is the .gitignore of a new repository, the history of flatFile is in git already.
+	ignore = "tiddlerHistory/\n"
+)
+
+// PushInterval is how long the commits are gathered before they are pushed to the remote.
+var PushInterval = time.Minute
+
+// gitStore is a flatFile store whose Put and Delete commit the changed files.
+type gitStore struct {
+	store.TiddlerStore // the flatFile store
+	files store.StreamStore
+	audit store.AuditStore
+	stats store.StatsStore
+
+	mu   sync.Mutex // one save and its commit at a time, the git index is not safe for concurrent use
+	repo *git.Repository
+	wt   *git.Worktree
+
+	remote  string // pushed to, empty for none
+	auth    transport.AuthMethod
+	pending chan struct{} // a commit waits to be pushed
+	done    chan struct{}
+	pushed  chan struct{} // closed when the pusher is done
+	close   sync.Once
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open opens the flatFile store in the directory dataSource, and the git repository in it,
+// which is created if missing. With ?remote=origin the commits are pushed to that remote
+// of the repository every PushInterval; the password of an HTTPS remote is read from $WIDDLY_GIT_PASS,
+// SSH remotes use the SSH agent.
+func Open(dataSource string) (store.TiddlerStore, error) {
+	dir, remote := dataSource, ""
+	if i := strings.IndexByte(dataSource, '?'); i >= 0 {
+		q, err := url.ParseQuery(dataSource[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		dir, remote = dataSource[:i], q.Get("remote")
+	}
+
+	db, err := flatFile.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &gitStore{
+		TiddlerStore: db,
+		files: db.(store.StreamStore),
+		audit: db.(store.AuditStore),
+		stats: db.(store.StatsStore),
+		remote: remote,
+		pending: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		pushed: make(chan struct{}),
+	}
+
+	path := filepath.Join(".", dir)
+	s.repo, err = git.PlainOpen(path)
+	if err == git.ErrRepositoryNotExists {
+		s.repo, err = initRepo(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.wt, err = s.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == "" {
+		close(s.pushed)
+		return s, nil
+	}
+	r, err := s.repo.Remote(remote)
+	if err != nil {
+		return nil, fmt.Errorf("remote %q: %v", remote, err)
+	}
+	if pass := os.Getenv("WIDDLY_GIT_PASS"); pass != "" {
+		user := "git"
+		if u, err := url.Parse(r.Config().URLs[0]); err == nil && u.User != nil {
+			user = u.User.Username()
+		}
+		s.auth = &http.BasicAuth{Username: user, Password: pass}
+	}
+	go s.pushLoop()
+	return s, nil
+}
+
+// initRepo creates a repository in path, committing the tiddlers already there.
+func initRepo(path string) (*git.Repository, error) {
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, ".gitignore"), []byte(ignore), 0644); err != nil {
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{".gitignore", "tiddlers"} {
+		if err := wt.AddWithOptions(&git.AddOptions{Path: p}); err != nil {
+			return nil, err
+		}
+	}
+	_, err = wt.Commit("Create the widdly store", &git.CommitOptions{Author: signature("")})
+	return repo, err
+}
+
+// signature returns the commit author for the tiddler modifier user.
+func signature(user string) (*object.Signature) {
+	if user == "" {
+		user = "widdly"
+	}
+	return &object.Signature{Name: user, When: time.Now()}
+}
+
+// commit stages the files of the tiddler titled key, or removes them when they are gone, and commits them.
+func (s *gitStore) commit(key string, user string, msg string) (error) {
+	meta, text := flatFile.TiddlerPaths(key)
+	for _, p := range []string{meta, text} {
+		p = filepath.ToSlash(p)
+		_, err := os.Stat(filepath.Join(s.wt.Filesystem.Root(), p))
+		switch {
+		case err == nil:
+			err = s.wt.AddWithOptions(&git.AddOptions{Path: p, SkipStatus: true})
+		case os.IsNotExist(err):
+			_, err = s.wt.Remove(p)
+			if err == index.ErrEntryNotFound { // system tiddlers have no .tid
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.wt.Commit(msg, &git.CommitOptions{Author: signature(user)})
+	if err == git.ErrEmptyCommit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case s.pending <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Put saves tiddler to the flatFile store and commits it.
+func (s *gitStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	return s.PutStream(ctx, tiddler, strings.NewReader(text))
+}
+
+// PutStream is Put with the text read from text.
+func (s *gitStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, _ := tiddler.Js["modifier"].(string)
+	rev, err := s.files.PutStream(ctx, tiddler, text)
+	if err != nil {
+		return rev, err
+	}
+	return rev, s.commit(tiddler.Key, user, fmt.Sprintf("Save %s (revision %d)", tiddler.Key, rev))
+}
+
+// GetStream returns the meta of the tiddler and a reader of its text.
+func (s *gitStore) GetStream(ctx context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	return s.files.GetStream(ctx, key)
+}
+
+// Delete deletes the tiddler from the flatFile store and commits the removal.
+func (s *gitStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.TiddlerStore.Delete(ctx, key); err != nil {
+		return err
+	}
+	return s.commit(key, "", "Delete " + store.StoreKey(key))
+}
+
+// Audit checks the history of the flatFile store, which is not in git.
+func (s *gitStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.audit.Audit(ctx, repair)
+}
+
+// Stats reports the files of the flatFile store.
+func (s *gitStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	return s.stats.Stats(ctx)
+}
+
+// pushLoop pushes the commits to the remote, at most once every PushInterval, and once more on Close.
+func (s *gitStore) pushLoop() {
+	defer close(s.pushed)
+	for {
+		select {
+		case <-s.done:
+			select {
+			case <-s.pending:
+				s.push()
+			default:
+			}
+			return
+		case <-s.pending:
+		}
+
+		select {
+		case <-s.done:
+		case <-time.After(PushInterval):
+		}
+		s.push()
+	}
+}
+
+func (s *gitStore) push() {
+	s.mu.Lock() // no commit halfway
+	defer s.mu.Unlock()
+	err := s.repo.Push(&git.PushOptions{RemoteName: s.remote, Auth: s.auth})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		log.Println("[git] push", s.remote, err)
+		select {
+		case s.pending <- struct{}{}: // try again with the next commit or interval
+		default:
+		}
+	}
+}
+
+// Close pushes the last commits and closes the store.
+func (s *gitStore) Close() error {
+	s.close.Do(func() { close(s.done) })
+	<-s.pushed
+	return s.TiddlerStore.Close()
+}
@@ -0,0 +1,149 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gitstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"../../store"
+	"../storetest"
+)
+
+// openTemp opens dir relative to the working directory, as flatFile joins dataSource onto ".".
+func openTemp(dir string) (store.TiddlerStore, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return nil, err
+	}
+	return Open(rel)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+// commits returns the messages and authors of the commits in dir, newest first.
+func commits(t *testing.T, dir string) (msgs []string, authors []string) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter.ForEach(func(c *object.Commit) error {
+		msgs = append(msgs, c.Message)
+		authors = append(authors, c.Author.Name)
+		return nil
+	})
+	return msgs, authors
+}
+
+func TestCommits(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openTemp(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	td := storetest.NewTiddler(1)
+	td.Js["modifier"] = "alice"
+	db.Put(ctx, td)
+	db.Put(ctx, storetest.NewTiddler(1))
+	db.Put(ctx, store.Tiddler{Key: "$:/config/x", IsSys: true, Js: map[string]interface{}{"text": "x"}})
+	if err := db.Delete(ctx, "$:/config/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, td.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, authors := commits(t, dir)
+	want := []string{
+		"Delete Tiddler 000001",
+		"Delete $:/config/x",
+		"Save $:/config/x (revision 2)",
+		"Save Tiddler 000001 (revision 3)",
+		"Save Tiddler 000001 (revision 2)",
+		"Create the widdly store",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("want %d commits, got %q", len(want), msgs)
+	}
+	for i := range want {
+		if msgs[i] != want[i] {
+			t.Errorf("commit %d: want %q, got %q", i, want[i], msgs[i])
+		}
+	}
+	if authors[4] != "alice" || authors[3] != "widdly" {
+		t.Errorf("want authors alice then widdly, got %q", authors)
+	}
+
+	st, err := db.(*gitStore).wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.IsClean() {
+		t.Errorf("want a clean worktree, got\n%s", st)
+	}
+}
+
+func TestPush(t *testing.T) {
+	remote := t.TempDir()
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}})
+
+	wd, _ := os.Getwd()
+	rel, _ := filepath.Rel(wd, dir)
+	db, err := Open(rel + "?remote=origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put(context.Background(), storetest.NewTiddler(1))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, _ := commits(t, remote)
+	if len(msgs) != 1 || msgs[0] != "Save Tiddler 000001 (revision 2)" {
+		t.Errorf("want the save pushed on close, got %q", msgs)
+	}
+}
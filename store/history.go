@@ -0,0 +1,220 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Revision describes a revision kept in the history of a tiddler.
+type Revision struct {
+	Rev      int    `json:"revision"`
+	Modified string `json:"modified,omitempty"`
+	Modifier string `json:"modifier,omitempty"`
+	Size     int64  `json:"size"` // of the text as stored
+}
+
+// RevisionStore is implemented by backends which can read back the history they write.
+// Like StreamStore and OrderedStore it is optional rather than part of TiddlerStore, as some
+// backends (badger, redis, couchdb, dynamodb, gitstore, webdav) write a history they cannot
+// list; use the ListRevisions and GetRevision helpers, which answer for them as for a tiddler
+// without history.
+type RevisionStore interface {
+	// ListRevisions returns the revisions of key kept in the history, newest first,
+	// none for a tiddler without history or a missing one.
+	ListRevisions(ctx context.Context, key string) ([]Revision, error)
+
+	// GetRevision returns the fat tiddler of the revision rev of key kept in the history,
+	// ErrNotFound when it is not kept.
+	GetRevision(ctx context.Context, key string, rev int) (*Tiddler, error)
+}
+
+// ListRevisions returns the revisions of key kept by db, none when it is not a RevisionStore.
+func ListRevisions(ctx context.Context, db TiddlerStore, key string) ([]Revision, error) {
+	if rs, ok := db.(RevisionStore); ok {
+		return rs.ListRevisions(ctx, key)
+	}
+	return nil, nil
+}
+
+// GetRevision returns the revision rev of key kept by db, ErrNotFound when it is not a RevisionStore.
+func GetRevision(ctx context.Context, db TiddlerStore, key string, rev int) (*Tiddler, error) {
+	if rs, ok := db.(RevisionStore); ok {
+		return rs.GetRevision(ctx, key, rev)
+	}
+	return nil, ErrNotFound
+}
+
+// ParseRevision reads data, the revision rev kept in a history as the tiddler serialized to JSON
+// with its text, returning the fat tiddler and its description.
+func ParseRevision(rev int, data []byte) (*Tiddler, Revision, error) {
+	js := make(map[string]interface{})
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, Revision{}, err
+	}
+	if js == nil {
+		return nil, Revision{}, ErrBadTiddler
+	}
+	upgradeFields(js)
+	text, _ := js["text"].(string)
+	js["text"] = text
+	modified, _ := js["modified"].(string)
+	modifier, _ := js["modifier"].(string)
+	return &Tiddler{Js: js}, Revision{Rev: rev, Modified: modified, Modifier: modifier, Size: int64(len(text))}, nil
+}
+
+// SortRevisions sorts revs newest first.
+func SortRevisions(revs []Revision) {
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Rev > revs[j].Rev
+	})
+}
+
+// Divergence is a tiddler whose history does not end with its current (head) revision,
+// e.g. after a crash between writing the two.
+type Divergence struct {
+	Key    string `json:"key"` // backend key of the tiddler
+	Head   int    `json:"head"`
+	Latest int    `json:"latest"` // newest revision in the history, 0 when none
+}
+
+// AuditStore is implemented by backends which can check their history against the tiddlers.
+type AuditStore interface {
+	// Audit lists the tiddlers whose history diverges from them, see Diverges.
+	// With repair, the revisions from the head on are dropped from their history
+	// and the head is written to it again (unless history is disabled).
+	Audit(ctx context.Context, repair bool) ([]Divergence, error)
+}
+
+// NoHistory tells whether a tiddler, by its stored meta, never gets history:
+// system tiddlers and drafts, see Tiddler.IsSys and Tiddler.IsDraft.
+func NoHistory(meta []byte) (bool) {
+	var m struct {
+		Title  string                 `json:"title"`
+		Fields map[string]interface{} `json:"fields"`
+	}
+	json.Unmarshal(meta, &m)
+	_, draft := m.Fields["draft.of"]
+	return draft || strings.HasPrefix(m.Title, "$:/")
+}
+
+// Diverges tells whether the history of a tiddler, whose newest revision is latest (0 when none),
+// diverges from its head revision. It is newer than the head or, when history is enabled
+// and the tiddler gets history, it lacks the head.
+func Diverges(meta []byte, head int, latest int, history bool) (bool) {
+	if latest > head {
+		return true
+	}
+	return latest != head && history && !NoHistory(meta)
+}
+
+// HistoryEntry is a revision kept in the history store of a backend.
+type HistoryEntry struct {
+	Key  string // backend key of the tiddler
+	Rev  int
+	Size int64
+	Seq  int64 // ordering inside the backend, smaller is older
+}
+
+// HistorySize tracks the total size of a history store against a limit.
+type HistorySize struct {
+	lock  sync.Mutex
+	max   int64
+	total int64 // < 0 unknown
+}
+
+func (h *HistorySize) SetMax(max int64) {
+	h.lock.Lock()
+	h.max = max
+	h.total = -1
+	h.lock.Unlock()
+}
+
+// Enabled reports whether a limit is set.
+func (h *HistorySize) Enabled() (bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.max > 0
+}
+
+// Grow accounts n new bytes and reports whether the limit is exceeded.
+// An unknown total is computed with scan first.
+func (h *HistorySize) Grow(n int64, scan func() (int64, error)) (bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.max <= 0 {
+		return false
+	}
+
+	if h.total < 0 {
+		total, err := scan()
+		if err != nil {
+			return false
+		}
+		h.total = total
+	} else {
+		h.total += n
+	}
+	return h.total > h.max
+}
+
+// Reset marks the total unknown, it must be called after revisions are deleted.
+func (h *HistorySize) Reset() {
+	h.lock.Lock()
+	h.total = -1
+	h.lock.Unlock()
+}
+
+// Prune selects the oldest revisions to delete so the total size fits into the limit.
+// The latest revision of each tiddler is never selected.
+// It returns the selected revisions and the total size left.
+func (h *HistorySize) Prune(entries []HistoryEntry) ([]HistoryEntry, int64) {
+	h.lock.Lock()
+	max := h.max
+	h.lock.Unlock()
+
+	var total int64
+	latest := make(map[string]int)
+	for _, e := range entries {
+		total += e.Size
+		if e.Rev > latest[e.Key] {
+			latest[e.Key] = e.Rev
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+
+	del := make([]HistoryEntry, 0)
+	for _, e := range entries {
+		if total <= max {
+			break
+		}
+		if e.Rev == latest[e.Key] {
+			continue
+		}
+		del = append(del, e)
+		total -= e.Size
+	}
+
+	h.lock.Lock()
+	h.total = total
+	h.lock.Unlock()
+	return del, total
+}
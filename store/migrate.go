@@ -0,0 +1,80 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// UpgradeMeta brings the meta of a tiddler written by an older version to the current layout,
+// see upgradeFields. Current metas are returned as is without being parsed, so reads stay cheap;
+// the upgraded layout is written to the store by the next Put of the tiddler.
+func UpgradeMeta(meta []byte) ([]byte) {
+	if !oldLayout(meta) {
+		return meta
+	}
+	var js map[string]interface{}
+	if json.Unmarshal(meta, &js) != nil || js == nil {
+		return meta
+	}
+	if !upgradeFields(js) {
+		return meta
+	}
+	data, err := json.Marshal(js)
+	if err != nil {
+		return meta
+	}
+	return data
+}
+
+// oldLayout tells whether meta may need upgradeFields.
+func oldLayout(meta []byte) (bool) {
+	return !bytes.Contains(meta, []byte(`"bag"`)) || !bytes.Contains(meta, []byte(`"revision"`)) ||
+		bytes.Contains(meta, []byte(`"revision":"`)) || bytes.Contains(meta, []byte(`"revision": "`)) ||
+		bytes.Contains(meta, []byte(`"tags":"`)) || bytes.Contains(meta, []byte(`"tags": "`))
+}
+
+// upgradeFields fixes the fields of older versions in place and reports whether it changed any:
+// a missing "bag" or "revision" is added, a revision string becomes a number
+// and a tags string (the .tid layout) becomes the TiddlyWeb list.
+func upgradeFields(js map[string]interface{}) (bool) {
+	changed := false
+	if _, ok := js["bag"]; !ok {
+		js["bag"] = "bag"
+		changed = true
+	}
+	switch rev := js["revision"].(type) {
+	case nil:
+		js["revision"] = 1
+		changed = true
+	case string:
+		n, err := strconv.Atoi(rev)
+		if err != nil || n < 1 {
+			n = 1
+		}
+		js["revision"] = n
+		changed = true
+	}
+	if tags, ok := js["tags"].(string); ok {
+		list := make([]interface{}, 0)
+		for _, tag := range ParseTags(tags) {
+			list = append(list, tag)
+		}
+		js["tags"] = list
+		changed = true
+	}
+	return changed
+}
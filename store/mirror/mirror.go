@@ -0,0 +1,332 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mirror is a TiddlerStore writing to two backends and reading from the first,
+// e.g. SQLite mirrored to flatFile files for a live, human readable backup.
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"../../store"
+)
+
+// mirrorStore reads from primary and writes to both. A write failing on primary fails;
+// one failing on secondary is only logged and counted, the wiki keeps working without its mirror
+// (Sync catches up at the next start). Revisions are numbered by each backend on its own.
+type mirrorStore struct {
+	primary   store.TiddlerStore
+	secondary store.TiddlerStore
+
+	writes uint64
+	errors uint64
+}
+
+// New mirrors the writes of primary to secondary. It is a store.StreamStore,
+// a store.OrderedStore, a store.PagedStore, a store.StatsStore and a store.RevisionStore (of primary),
+// and a store.AuditStore (of primary) or store.BatchStore when primary is one.
+func New(primary store.TiddlerStore, secondary store.TiddlerStore) (store.TiddlerStore) {
+	s := &mirrorStore{primary: primary, secondary: secondary}
+	_, audit := primary.(store.AuditStore)
+	_, batch := primary.(store.BatchStore)
+	switch {
+	case audit && batch:
+		return auditBatchStore{s}
+	case audit:
+		return auditStore{s}
+	case batch:
+		return batchStore{s}
+	}
+	return s
+}
+
+type auditStore struct{ *mirrorStore }
+
+func (s auditStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.primary.(store.AuditStore).Audit(ctx, repair)
+}
+
+type batchStore struct{ *mirrorStore }
+
+func (s batchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+type auditBatchStore struct{ *mirrorStore }
+
+func (s auditBatchStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	return s.primary.(store.AuditStore).Audit(ctx, repair)
+}
+
+func (s auditBatchStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	return s.batch(ctx, ops)
+}
+
+// Sync makes secondary a copy of primary: the tiddlers missing or different in secondary
+// (by the fields listed by All but the revision, the text only of fat ones; an edit changes
+// the modified field) are put, the ones primary does not have are deleted.
+// It returns how many tiddlers were put and deleted.
+func Sync(ctx context.Context, primary store.TiddlerStore, secondary store.TiddlerStore) (put int, deleted int, err error) {
+	fieldsOf := func(db store.TiddlerStore) (map[string]map[string]interface{}, error) {
+		all, err := db.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+		byKey := make(map[string]map[string]interface{}, len(all))
+		for _, t := range all {
+			js, err := t.Fields()
+			if err != nil {
+				return nil, err
+			}
+			title, _ := js["title"].(string)
+			delete(js, "revision")
+			byKey[title] = js
+		}
+		return byKey, nil
+	}
+	want, err := fieldsOf(primary)
+	if err != nil {
+		return 0, 0, err
+	}
+	have, err := fieldsOf(secondary)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for title, js := range want {
+		if old, ok := have[title]; ok && reflect.DeepEqual(old, js) {
+			continue
+		}
+		t, err := primary.Get(ctx, title)
+		if err != nil {
+			return put, deleted, err
+		}
+		fields, err := t.Fields()
+		if err != nil {
+			return put, deleted, err
+		}
+		delete(fields, "revision")
+		meta, _ := json.Marshal(js)
+		td := store.Tiddler{Key: title, Js: fields, IsSys: store.NoHistory(meta)}
+		if _, err := secondary.Put(ctx, td); err != nil {
+			return put, deleted, err
+		}
+		put++
+	}
+	for title := range have {
+		if _, ok := want[title]; ok {
+			continue
+		}
+		if err := secondary.Delete(ctx, title); err != nil && err != store.ErrNotFound {
+			return put, deleted, err
+		}
+		deleted++
+	}
+	return put, deleted, nil
+}
+
+// mirrored counts a write to secondary, logging its error.
+func (s *mirrorStore) mirrored(op string, key string, err error) {
+	atomic.AddUint64(&s.writes, 1)
+	if err != nil && err != store.ErrNotFound {
+		atomic.AddUint64(&s.errors, 1)
+		log.Println("[mirror]", op, key, err)
+	}
+}
+
+func (s *mirrorStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	return s.primary.Get(ctx, key)
+}
+
+func (s *mirrorStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	return s.primary.All(ctx)
+}
+
+func (s *mirrorStore) AllOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	return store.AllOrdered(ctx, s.primary, o)
+}
+
+func (s *mirrorStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	return store.AllPage(ctx, s.primary, after, limit)
+}
+
+// copyOf copies the fields of tiddler for the second Put, the backends change them.
+func copyOf(tiddler store.Tiddler) (store.Tiddler) {
+	js := make(map[string]interface{}, len(tiddler.Js))
+	for k, v := range tiddler.Js {
+		js[k] = v
+	}
+	tiddler.Js = js
+	return tiddler
+}
+
+func (s *mirrorStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	second := copyOf(tiddler)
+	rev, err := s.primary.Put(ctx, tiddler)
+	if err != nil {
+		return rev, err
+	}
+	_, err = s.secondary.Put(ctx, second)
+	s.mirrored("put", tiddler.Key, err)
+	return rev, nil
+}
+
+func (s *mirrorStore) Delete(ctx context.Context, key string) error {
+	err := s.primary.Delete(ctx, key)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	s.mirrored("delete", key, s.secondary.Delete(ctx, key))
+	return err
+}
+
+// PutStream spools the text to a temporary file, which is read once for each backend.
+func (s *mirrorStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
+	f, err := ioutil.TempFile("", "widdly-mirror-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, text); err != nil {
+		return 0, err
+	}
+
+	second := copyOf(tiddler)
+	rev, err := putStream(ctx, s.primary, tiddler, f)
+	if err != nil {
+		return rev, err
+	}
+	_, err = putStream(ctx, s.secondary, second, f)
+	s.mirrored("put", tiddler.Key, err)
+	return rev, nil
+}
+
+// putStream puts tiddler with the text in f, streamed if db is a store.StreamStore.
+func putStream(ctx context.Context, db store.TiddlerStore, tiddler store.Tiddler, f *os.File) (int, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if ss, ok := db.(store.StreamStore); ok {
+		return ss.PutStream(ctx, tiddler, f)
+	}
+	text, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	tiddler.Js["text"] = string(text)
+	return db.Put(ctx, tiddler)
+}
+
+// GetStream streams the text from primary if it is a store.StreamStore, else reads it with Get.
+func (s *mirrorStore) GetStream(ctx context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	if ss, ok := s.primary.(store.StreamStore); ok {
+		return ss.GetStream(ctx, key)
+	}
+	t, err := s.primary.Get(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	meta, err := (&store.Tiddler{Js: js}).MarshalJSON()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return meta, ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
+}
+
+// batch applies ops to primary in one transaction, then to secondary, in one too if it can.
+func (s *mirrorStore) batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	second := make([]store.Op, len(ops))
+	for i, op := range ops {
+		second[i] = op
+		second[i].IfRev = 0 // the revisions of secondary are its own
+		if !op.Delete {
+			second[i].Tiddler = copyOf(op.Tiddler)
+		}
+	}
+	revs, err := s.primary.(store.BatchStore).Batch(ctx, ops)
+	if err != nil {
+		return revs, err
+	}
+
+	if bs, ok := s.secondary.(store.BatchStore); ok {
+		_, err := bs.Batch(ctx, second)
+		s.mirrored("batch", "", err)
+		return revs, nil
+	}
+	for _, op := range second {
+		if op.Delete {
+			s.mirrored("delete", op.Tiddler.Key, s.secondary.Delete(ctx, op.Tiddler.Key))
+			continue
+		}
+		_, err := s.secondary.Put(ctx, op.Tiddler)
+		s.mirrored("put", op.Tiddler.Key, err)
+	}
+	return revs, nil
+}
+
+// Stats reports the mirrored writes, then the gauges of primary if it has some.
+func (s *mirrorStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	stats := []store.Stat{
+		{Name: "mirror_writes", Help: "Writes mirrored to the secondary store.", Value: float64(atomic.LoadUint64(&s.writes))},
+		{Name: "mirror_errors", Help: "Writes which failed on the secondary store.", Value: float64(atomic.LoadUint64(&s.errors))},
+	}
+	if ss, ok := s.primary.(store.StatsStore); ok {
+		more, err := ss.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, more...)
+	}
+	return stats, nil
+}
+
+func (s *mirrorStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	return store.ListRevisions(ctx, s.primary, key)
+}
+
+func (s *mirrorStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	return store.GetRevision(ctx, s.primary, key, rev)
+}
+
+func (s *mirrorStore) Close() error {
+	err := s.secondary.Close()
+	if perr := s.primary.Close(); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func (s *mirrorStore) SetMaxHistory(rev int) {
+	s.primary.SetMaxHistory(rev)
+	s.secondary.SetMaxHistory(rev)
+}
+
+func (s *mirrorStore) SetMaxHistorySize(size int64) {
+	s.primary.SetMaxHistorySize(size)
+	s.secondary.SetMaxHistorySize(size)
+}
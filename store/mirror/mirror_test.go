@@ -0,0 +1,104 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mirror
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../flatFile"
+	"../readonly"
+	"../storetest"
+)
+
+// openFlat opens a flatFile store in dir, relative to the working directory as flatFile.Open wants.
+func openFlat(tb testing.TB, dir string) (store.TiddlerStore) {
+	wd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	db, err := flatFile.Open(rel)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+func TestStore(t *testing.T) {
+	open := func(dir string) (store.TiddlerStore, error) {
+		return New(openFlat(t, filepath.Join(dir, "primary")), openFlat(t, filepath.Join(dir, "secondary"))), nil
+	}
+	storetest.Run(t, open)
+	storetest.RunSystem(t, open)
+	storetest.RunOrder(t, open)
+	storetest.RunPage(t, open)
+	storetest.RunAudit(t, open)
+	storetest.RunRevisions(t, open)
+	storetest.RunCase(t, open)
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary, secondary := openFlat(t, filepath.Join(dir, "primary")), openFlat(t, filepath.Join(dir, "secondary"))
+	db := New(primary, secondary)
+	for i := 0; i < 3; i++ {
+		if _, err := db.Put(ctx, storetest.NewTiddler(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(ctx, storetest.NewTiddler(0).Key); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := secondary.All(ctx); len(all) != 2 {
+		t.Errorf("want 2 tiddlers mirrored, got %d", len(all))
+	}
+
+	// written while the mirror was off
+	primary.Put(ctx, storetest.NewTiddler(3))
+	changed := storetest.NewTiddler(1)
+	changed.Js["text"] = "changed"
+	changed.Js["modified"] = "20190102000000000"
+	primary.Put(ctx, changed)
+	secondary.Put(ctx, storetest.NewTiddler(4))
+	put, deleted, err := Sync(ctx, primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put != 2 || deleted != 1 {
+		t.Errorf("want 2 put and 1 deleted, got %d and %d", put, deleted)
+	}
+	if td, err := secondary.Get(ctx, changed.Key); err != nil || td.Js["text"] != "changed" {
+		t.Errorf("want the changed text mirrored, got %v %v", td, err)
+	}
+	if put, deleted, _ := Sync(ctx, primary, secondary); put + deleted != 0 {
+		t.Errorf("want nothing to sync twice, got %d put and %d deleted", put, deleted)
+	}
+
+	broken := New(primary, readonly.New(secondary))
+	if _, err := broken.Put(ctx, storetest.NewTiddler(5)); err != nil {
+		t.Errorf("want a failing mirror ignored, got %v", err)
+	}
+	stats, _ := broken.(store.StatsStore).Stats(ctx)
+	if stats[1].Name != "mirror_errors" || stats[1].Value != 1 {
+		t.Errorf("want 1 mirror error, got %+v", stats)
+	}
+}
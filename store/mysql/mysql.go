@@ -0,0 +1,475 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mysql is a MySQL/MariaDB TiddlerStore backend.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+
+	"../../store"
+)
+
+const (
+	TypeName = "mysql"
+)
+
+// mysqlStore keeps the tiddlers in the tables tiddler and tiddler_history of a MySQL or MariaDB database.
+type mysqlStore struct {
+	db *sql.DB
+	maxRev int
+	histSize store.HistorySize
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// The titles are binary, so they compare byte by byte whatever the collation of the database
+// (store.StoreKey folds them for -title-case insensitive); 3072 bytes is the InnoDB key limit.
+var initStmts = []string{
+	`CREATE TABLE IF NOT EXISTS tiddler (
+		title VARBINARY(3072) NOT NULL PRIMARY KEY,
+		meta LONGBLOB NOT NULL,
+		content LONGBLOB NOT NULL,
+		revision INT NOT NULL
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS tiddler_history (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		title VARBINARY(3072) NOT NULL,
+		meta LONGBLOB NOT NULL,
+		content LONGBLOB NOT NULL,
+		revision INT NOT NULL,
+		KEY title_revision (title(255), revision)
+	) ENGINE=InnoDB`,
+}
+
+// Open connects to the database of the DSN dataSource, e.g. widdly@tcp(127.0.0.1:3306)/widdly,
+// and creates the tables when missing. The password is read from $WIDDLY_DB_PASS unless given in the DSN.
+func Open(dataSource string) (store.TiddlerStore, error) {
+	cfg, err := mysql.ParseDSN(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Passwd == "" {
+		cfg.Passwd = os.Getenv("WIDDLY_DB_PASS")
+	}
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	if _, ok := cfg.Params["charset"]; !ok {
+		cfg.Params["charset"] = "utf8mb4"
+	}
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range initStmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &mysqlStore{db: db, maxRev: -1}, nil
+}
+
+func (s *mysqlStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *mysqlStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	key = store.StoreKey(key)
+	var meta, content []byte
+	err := s.db.QueryRowContext(ctx, `SELECT meta, content FROM tiddler WHERE title = ?`, key).Scan(&meta, &content)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return store.NewTiddler(meta, content)
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+func (s *mysqlStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	return s.AllOrdered(ctx, store.Order{})
+}
+
+// AllOrdered is All sorted by o, with the dates read from meta by JSON_EXTRACT.
+func (s *mysqlStore) AllOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	return s.list(ctx, `SELECT meta, content FROM tiddler ` + orderBy(o))
+}
+
+// AllPage is All from the first title after the cursor after, at most limit tiddlers.
+func (s *mysqlStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	if limit <= 0 {
+		return s.list(ctx, `SELECT meta, content FROM tiddler WHERE title > ? ORDER BY title ASC`, after)
+	}
+	return s.list(ctx, `SELECT meta, content FROM tiddler WHERE title > ? ORDER BY title ASC LIMIT ?`, after, limit)
+}
+
+// list reads the (mostly skinny) tiddlers of a query of meta and content.
+func (s *mysqlStore) list(ctx context.Context, query string, args ...interface{}) ([]*store.Tiddler, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiddlers := make([]*store.Tiddler, 0)
+	for rows.Next() {
+		var meta, content []byte
+		if err := rows.Scan(&meta, &content); err != nil {
+			return nil, err
+		}
+
+		var text []byte
+		if store.IsFat(meta) {
+			text = append([]byte{}, content...)
+		}
+		t, err := store.NewTiddler(meta, text)
+		if err != nil {
+			continue
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	return tiddlers, rows.Err()
+}
+
+// orderBy returns the ORDER BY clause of o, titles are binary so they sort in byte order.
+func orderBy(o store.Order) (string) {
+	dir := "ASC"
+	if o.Desc {
+		dir = "DESC"
+	}
+	switch o.By {
+	case store.SortModified, store.SortCreated:
+		return fmt.Sprintf(`ORDER BY JSON_UNQUOTE(JSON_EXTRACT(CONVERT(meta USING utf8mb4), '$.%s')) %s, title ASC`, o.By, dir)
+	}
+	return `ORDER BY title ` + dir
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The current revision is locked while saving, so concurrent Puts of a title get distinct revisions.
+// The tiddler is also written to the tiddler_history table.
+func (s *mysqlStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rev, histAdded, err := s.put(ctx, tx, tiddler)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if histAdded > 0 {
+		s.checkHistorySize(histAdded)
+	}
+	return rev, nil
+}
+
+// revisionOf locks the row of key and returns its revision, 0 when missing.
+func revisionOf(ctx context.Context, tx *sql.Tx, key string) (int, error) {
+	rev := 0
+	err := tx.QueryRowContext(ctx, `SELECT revision FROM tiddler WHERE title = ? FOR UPDATE`, key).Scan(&rev)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rev, err
+}
+
+// put is Put inside tx, it also returns the size added to the history.
+func (s *mysqlStore) put(ctx context.Context, tx *sql.Tx, tiddler store.Tiddler) (int, int64, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	rev, err := revisionOf(ctx, tx, tiddler.Key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rev == 0 {
+		rev = 1
+	}
+	rev++
+
+	tiddler.Js["revision"] = rev
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	meta, err := json.Marshal(tiddler.Js)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO tiddler(title, meta, content, revision) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE meta = ?, content = ?, revision = ?`, tiddler.Key, meta, text, rev, meta, text, rev)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// skip Draft & system key history
+	if s.maxRev == 0 || tiddler.IsDraft || tiddler.IsSys {
+		return rev, 0, nil
+	}
+	// remove old history
+	if s.maxRev > 0 && rev - s.maxRev > 1 {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tiddler_history WHERE title = ? AND revision <= ?`, tiddler.Key, rev - 1 - s.maxRev)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.histSize.Reset()
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO tiddler_history(title, meta, content, revision) VALUES (?, ?, ?, ?)`, tiddler.Key, meta, text, rev)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rev, int64(len(meta) + len(text)), nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *mysqlStore) Delete(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.del(ctx, tx, key); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.histSize.Reset()
+	return nil
+}
+
+// del is Delete inside tx.
+func (s *mysqlStore) del(ctx context.Context, tx *sql.Tx, key string) error {
+	key = store.StoreKey(key)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tiddler WHERE title = ?`, key); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM tiddler_history WHERE title = ?`, key)
+	return err
+}
+
+// Batch applies ops in one transaction, the rows of their tiddlers locked as they go.
+func (s *mysqlStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	revs := make([]int, len(ops))
+	var added int64
+	for i, op := range ops {
+		cur, err := revisionOf(ctx, tx, store.StoreKey(op.Tiddler.Key))
+		if err != nil {
+			return nil, err
+		}
+		if err := store.CheckRev(ops, i, cur); err != nil {
+			return nil, err
+		}
+
+		if op.Delete {
+			err = s.del(ctx, tx, op.Tiddler.Key)
+		} else {
+			var n int64
+			revs[i], n, err = s.put(ctx, tx, op.Tiddler)
+			added += n
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.histSize.Reset()
+	if added > 0 {
+		s.checkHistorySize(added)
+	}
+	return revs, nil
+}
+
+func (s *mysqlStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *mysqlStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// ListRevisions returns the revisions of key in the tiddler_history table, newest first.
+func (s *mysqlStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT revision,
+		COALESCE(JSON_UNQUOTE(JSON_EXTRACT(CONVERT(meta USING utf8mb4), '$.modified')), ''),
+		COALESCE(JSON_UNQUOTE(JSON_EXTRACT(CONVERT(meta USING utf8mb4), '$.modifier')), ''), LENGTH(content)
+		FROM tiddler_history WHERE title = ? ORDER BY revision DESC`, store.StoreKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := make([]store.Revision, 0)
+	for rows.Next() {
+		var r store.Revision
+		if err := rows.Scan(&r.Rev, &r.Modified, &r.Modifier, &r.Size); err != nil {
+			return nil, err
+		}
+		revs = append(revs, r)
+	}
+	return revs, rows.Err()
+}
+
+// GetRevision returns the revision rev of key in the tiddler_history table.
+func (s *mysqlStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	var meta, content []byte
+	err := s.db.QueryRowContext(ctx, `SELECT meta, content FROM tiddler_history WHERE title = ? AND revision = ? ORDER BY id DESC LIMIT 1`,
+		store.StoreKey(key), rev).Scan(&meta, &content)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return store.NewTiddler(meta, content)
+}
+
+// Audit checks the newest revision in the tiddler_history table of every tiddler against the tiddler.
+func (s *mysqlStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT title, meta, revision,
+		COALESCE((SELECT MAX(h.revision) FROM tiddler_history h WHERE h.title = t.title), 0) FROM tiddler t`)
+	if err != nil {
+		return nil, err
+	}
+	divs := make([]store.Divergence, 0)
+	metas := make([][]byte, 0)
+	for rows.Next() {
+		var d store.Divergence
+		var meta []byte
+		if err := rows.Scan(&d.Key, &meta, &d.Head, &d.Latest); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if store.Diverges(meta, d.Head, d.Latest, s.maxRev != 0) {
+			divs = append(divs, d)
+			metas = append(metas, meta)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !repair || len(divs) == 0 {
+		return divs, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i, d := range divs {
+		_, err := tx.ExecContext(ctx, `DELETE FROM tiddler_history WHERE title = ? AND revision >= ?`, d.Key, d.Head)
+		if err != nil {
+			return nil, err
+		}
+		if s.maxRev == 0 || store.NoHistory(metas[i]) {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO tiddler_history(title, meta, content, revision) SELECT title, meta, content, revision FROM tiddler WHERE title = ?`, d.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.histSize.Reset()
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history table, ordered by insertion.
+func (s *mysqlStore) historyEntries() ([]store.HistoryEntry, error) {
+	rows, err := s.db.Query(`SELECT id, title, revision, LENGTH(meta) + LENGTH(content) FROM tiddler_history ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]store.HistoryEntry, 0)
+	for rows.Next() {
+		var e store.HistoryEntry
+		if err := rows.Scan(&e.Seq, &e.Key, &e.Rev, &e.Size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *mysqlStore) historySize() (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(LENGTH(meta) + LENGTH(content)), 0) FROM tiddler_history`).Scan(&total)
+	return total, err
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *mysqlStore) checkHistorySize(added int64) {
+	if !s.histSize.Grow(added, s.historySize) {
+		return
+	}
+
+	entries, err := s.historyEntries()
+	if err != nil {
+		log.Println("[mysql] list history error", err)
+		return
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		_, err := s.db.Exec(`DELETE FROM tiddler_history WHERE id = ?`, e.Seq)
+		if err != nil {
+			log.Println("[mysql] prune history error", err)
+			s.histSize.Reset()
+			return
+		}
+	}
+	log.Printf("[mysql] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
@@ -0,0 +1,62 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mysql
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"../../store"
+	"../storetest"
+)
+
+// The tests need an empty database, e.g.
+//
+//	WIDDLY_TEST_MYSQL='root:pass@tcp(127.0.0.1:3306)/widdly_test' go test
+//
+// its tables are dropped by every test.
+func openTemp(tb testing.TB) storetest.OpenFn {
+	dsn := os.Getenv("WIDDLY_TEST_MYSQL")
+	if dsn == "" {
+		tb.Skip("$WIDDLY_TEST_MYSQL not set")
+	}
+	return func(dir string) (store.TiddlerStore, error) {
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		if _, err := db.Exec(`DROP TABLE IF EXISTS tiddler, tiddler_history`); err != nil {
+			return nil, err
+		}
+		return Open(dsn)
+	}
+}
+
+func TestStore(t *testing.T) {
+	open := openTemp(t)
+	storetest.Run(t, open)
+	storetest.RunSystem(t, open)
+	storetest.RunOrder(t, open)
+	storetest.RunPage(t, open)
+	storetest.RunAudit(t, open)
+	storetest.RunRevisions(t, open)
+	storetest.RunBatch(t, open)
+	storetest.RunCase(t, open)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp(b))
+}
@@ -0,0 +1,131 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the backend specific settings, name=value pairs the backend reads in Open.
+type Options map[string]string
+
+// BackendOptions are the Options of the backend opened next, nil for the defaults.
+var BackendOptions Options
+
+// ParseOptions parses comma separated name=value pairs, a bare name is name=true.
+func ParseOptions(s string) (Options, error) {
+	o := make(Options)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, value := f, "true"
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name, value = strings.TrimSpace(f[:i]), strings.TrimSpace(f[i+1:])
+		}
+		if name == "" {
+			return nil, fmt.Errorf("option %q has no name", f)
+		}
+		o[strings.ToLower(name)] = value
+	}
+	return o, nil
+}
+
+// Check returns an error naming the options which are not known by the backend.
+func (o Options) Check(backend string, known ...string) (error) {
+	var unknown []string
+	for name := range o {
+		found := false
+		for _, k := range known {
+			if name == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("%s: unknown options %s, known are %s", backend, strings.Join(unknown, ", "), strings.Join(known, ", "))
+}
+
+// String returns the option name, def when not set.
+func (o Options) String(name string, def string) (string) {
+	if v, ok := o[name]; ok {
+		return v
+	}
+	return def
+}
+
+// Bool returns the boolean option name, def when not set.
+func (o Options) Bool(name string, def bool) (bool, error) {
+	v, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("option %s: want true or false, got %q", name, v)
+	}
+	return b, nil
+}
+
+// Duration returns the duration option name, like 5s or 10m, def when not set.
+func (o Options) Duration(name string, def time.Duration) (time.Duration, error) {
+	v, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def, fmt.Errorf("option %s: want a duration like 5s, got %q", name, v)
+	}
+	return d, nil
+}
+
+// Size returns the size option name in bytes, def when not set.
+// The value may end with K, M or G (or KiB, MiB, GiB), powers of 1024.
+func (o Options) Size(name string, def int64) (int64, error) {
+	v, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(v), "B"), "I")
+	var mul int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mul = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mul = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mul = 1 << 30
+	}
+	if mul > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return def, fmt.Errorf("option %s: want a size like 64M, got %q", name, v)
+	}
+	return n * mul, nil
+}
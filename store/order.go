@@ -0,0 +1,144 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Fields the tiddlers can be sorted by, see Order.
+const (
+	SortTitle    = "title"
+	SortModified = "modified"
+	SortCreated  = "created"
+)
+
+// Order is a sort order of tiddlers. The zero Order is by title, ascending.
+// Ties (e.g. equal modified) are broken by title, ascending.
+type Order struct {
+	By   string // SortTitle, SortModified or SortCreated; empty is SortTitle
+	Desc bool
+}
+
+// ParseOrder checks the sort field and the "asc"/"desc" order names, empty ones are the defaults.
+func ParseOrder(by string, order string) (Order, error) {
+	o := Order{By: SortTitle}
+	switch by {
+	case "", SortTitle:
+	case SortModified, SortCreated:
+		o.By = by
+	default:
+		return o, fmt.Errorf("unknown sort %q, want title, modified or created", by)
+	}
+	switch order {
+	case "", "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return o, fmt.Errorf("unknown order %q, want asc or desc", order)
+	}
+	return o, nil
+}
+
+// IsDefault tells whether o is the order of TiddlerStore.All.
+func (o Order) IsDefault() (bool) {
+	return (o.By == "" || o.By == SortTitle) && !o.Desc
+}
+
+// OrderedStore is implemented by the stores which can sort the tiddlers themselves,
+// e.g. with the ORDER BY of a database.
+type OrderedStore interface {
+	// AllOrdered is All sorted by o.
+	AllOrdered(ctx context.Context, o Order) ([]*Tiddler, error)
+}
+
+// AllOrdered retrieves all the tiddlers of db sorted by o, with AllOrdered if db is an OrderedStore.
+func AllOrdered(ctx context.Context, db TiddlerStore, o Order) ([]*Tiddler, error) {
+	if ordered, ok := db.(OrderedStore); ok {
+		return ordered.AllOrdered(ctx, o)
+	}
+	tiddlers, err := db.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !o.IsDefault() {
+		SortTiddlers(tiddlers, o)
+	}
+	return tiddlers, nil
+}
+
+// SortTiddlers sorts tiddlers read from a store by o.
+// Titles compare by StoreKey in byte order, dates as the TiddlyWiki date strings they are;
+// a missing date sorts before all others.
+func SortTiddlers(tiddlers []*Tiddler, o Order) {
+	type sortKey struct {
+		key  string
+		date string
+	}
+	keys := make([]sortKey, len(tiddlers))
+	for i, t := range tiddlers {
+		m := sortFields(t)
+		keys[i].key = StoreKey(m.Title)
+		switch o.By {
+		case SortModified:
+			keys[i].date = m.Modified
+		case SortCreated:
+			keys[i].date = m.Created
+		}
+	}
+
+	idx := make([]int, len(tiddlers))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		a, b := keys[idx[i]], keys[idx[j]]
+		if a.date != b.date {
+			return (a.date < b.date) != o.Desc
+		}
+		if o.By == SortModified || o.By == SortCreated {
+			return a.key < b.key
+		}
+		return (a.key < b.key) != o.Desc
+	})
+
+	sorted := make([]*Tiddler, len(tiddlers))
+	for i, n := range idx {
+		sorted[i] = tiddlers[n]
+	}
+	copy(tiddlers, sorted)
+}
+
+type orderFields struct {
+	Title    string `json:"title"`
+	Modified string `json:"modified"`
+	Created  string `json:"created"`
+}
+
+// sortFields returns the fields tiddlers sort by, from Js for fat tiddlers (whose Meta is nil).
+func sortFields(t *Tiddler) (m orderFields) {
+	switch {
+	case t == nil:
+	case t.Js != nil:
+		m.Title, _ = t.Js["title"].(string)
+		m.Modified, _ = t.Js["modified"].(string)
+		m.Created, _ = t.Js["created"].(string)
+	default:
+		json.Unmarshal(t.Meta, &m)
+	}
+	return m
+}
@@ -0,0 +1,61 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"sort"
+)
+
+// PagedStore is implemented by the stores which can read the tiddler list a page at a time,
+// e.g. with the LIMIT of a database, so a large wiki is not loaded at once.
+type PagedStore interface {
+	// AllPage is All from the first key after the cursor after ("" for the start),
+	// at most limit tiddlers.
+	AllPage(ctx context.Context, after string, limit int) ([]*Tiddler, error)
+}
+
+// AllPage retrieves at most limit tiddlers of db in the order of All, those with a key
+// (StoreKey of the title) after the cursor after; the key of the last one is the cursor
+// of the next page. It uses AllPage if db is a PagedStore, else it pages All.
+func AllPage(ctx context.Context, db TiddlerStore, after string, limit int) ([]*Tiddler, error) {
+	if paged, ok := db.(PagedStore); ok {
+		return paged.AllPage(ctx, after, limit)
+	}
+	tiddlers, err := db.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return PageOf(tiddlers, after, limit), nil
+}
+
+// PageOf returns the page of AllPage of the tiddlers of All.
+func PageOf(tiddlers []*Tiddler, after string, limit int) ([]*Tiddler) {
+	if after != "" {
+		i := sort.Search(len(tiddlers), func(i int) bool {
+			return KeyOf(tiddlers[i]) > after
+		})
+		tiddlers = tiddlers[i:]
+	}
+	if limit > 0 && len(tiddlers) > limit {
+		tiddlers = tiddlers[:limit]
+	}
+	return tiddlers
+}
+
+// KeyOf returns the key of a tiddler read from a store, the cursor of AllPage.
+// Fat tiddlers have their title in Js.
+func KeyOf(t *Tiddler) (string) {
+	return StoreKey(sortFields(t).Title)
+}
@@ -0,0 +1,117 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package readonly is a TiddlerStore wrapping another one and refusing every write,
+// to serve a frozen copy of a wiki.
+package readonly
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"../../store"
+)
+
+// readOnlyStore reads from db, its writes return store.ErrReadOnly. It hides the optional
+// interfaces of db which write (store.BatchStore, store.AuditStore), so the server does
+// not try them; it is a store.StreamStore, store.OrderedStore, store.PagedStore, store.StatsStore
+// and store.RevisionStore.
+type readOnlyStore struct {
+	db store.TiddlerStore
+}
+
+// New wraps db read-only.
+func New(db store.TiddlerStore) (store.TiddlerStore) {
+	return &readOnlyStore{db: db}
+}
+
+func (s *readOnlyStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	return s.db.Get(ctx, key)
+}
+
+func (s *readOnlyStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	return s.db.All(ctx)
+}
+
+func (s *readOnlyStore) AllOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	return store.AllOrdered(ctx, s.db, o)
+}
+
+func (s *readOnlyStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	return store.AllPage(ctx, s.db, after, limit)
+}
+
+func (s *readOnlyStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	return 0, store.ErrReadOnly
+}
+
+func (s *readOnlyStore) Delete(ctx context.Context, key string) error {
+	return store.ErrReadOnly
+}
+
+func (s *readOnlyStore) PutStream(ctx context.Context, tiddler store.Tiddler, text io.Reader) (int, error) {
+	return 0, store.ErrReadOnly
+}
+
+// GetStream streams the text from db if it is a store.StreamStore, else reads it with Get.
+func (s *readOnlyStore) GetStream(ctx context.Context, key string) ([]byte, io.ReadCloser, int64, error) {
+	if ss, ok := s.db.(store.StreamStore); ok {
+		return ss.GetStream(ctx, key)
+	}
+	t, err := s.db.Get(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	meta, err := json.Marshal(js)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return meta, ioutil.NopCloser(strings.NewReader(text)), int64(len(text)), nil
+}
+
+// Stats returns the gauges of db, none when it has no store.StatsStore.
+func (s *readOnlyStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	if ss, ok := s.db.(store.StatsStore); ok {
+		return ss.Stats(ctx)
+	}
+	return nil, nil
+}
+
+func (s *readOnlyStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	return store.ListRevisions(ctx, s.db, key)
+}
+
+func (s *readOnlyStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	return store.GetRevision(ctx, s.db, key, rev)
+}
+
+func (s *readOnlyStore) Close() error {
+	return s.db.Close()
+}
+
+// SetMaxHistory does nothing, the history is never written.
+func (s *readOnlyStore) SetMaxHistory(rev int) {
+}
+
+// SetMaxHistorySize does nothing, the history is never pruned.
+func (s *readOnlyStore) SetMaxHistorySize(size int64) {
+}
@@ -0,0 +1,74 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package readonly
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../../store"
+	"../flatFile"
+	"../storetest"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := filepath.Rel(wd, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := flatFile.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := rw.Put(ctx, storetest.NewTiddler(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := New(rw)
+	defer db.Close()
+
+	key := storetest.NewTiddler(0).Key
+	if _, err := db.Put(ctx, storetest.NewTiddler(4)); err != store.ErrReadOnly {
+		t.Errorf("Put: want ErrReadOnly, got %v", err)
+	}
+	if err := db.Delete(ctx, key); err != store.ErrReadOnly {
+		t.Errorf("Delete: want ErrReadOnly, got %v", err)
+	}
+	if _, ok := db.(store.BatchStore); ok {
+		t.Errorf("want no store.BatchStore")
+	}
+
+	if all, err := db.All(ctx); err != nil || len(all) != 3 {
+		t.Errorf("want 3 tiddlers, got %d %v", len(all), err)
+	}
+	meta, text, _, err := db.(store.StreamStore).GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer text.Close()
+	b, _ := ioutil.ReadAll(text)
+	if bytes.Contains(meta, []byte(`"text"`)) || string(b) != storetest.NewTiddler(0).Js["text"] {
+		t.Errorf("want the tiddler streamed, got %s %q", meta, b)
+	}
+}
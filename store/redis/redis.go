@@ -0,0 +1,446 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package redis is a Redis TiddlerStore backend, for hosts without a persistent file system.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"../../store"
+)
+
+const (
+	TypeName = "redis"
+
+	// DefaultPrefix starts the keys of the store, unless changed with ?prefix= in the URL.
+	DefaultPrefix = "widdly:"
+)
+
+// redisStore keeps, under its prefix:
+//
+//	titles              set of the stored keys
+//	t:<key>             hash of the tiddler: meta (JSON without text), text, revision
+//	h:<key>             sorted set of its history, scored by revision
+//	seq                 counter ordering the history across tiddlers
+//
+// A history member is the 20 digit seq, the meta, a NUL byte and the text.
+type redisStore struct {
+	pool     *redis.Pool
+	prefix   string
+	maxRev   int
+	histSize store.HistorySize
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open connects to the server at dataSource, e.g. redis://:password@localhost:6379/0?prefix=wiki:
+// (the password is read from $WIDDLY_DB_PASS unless given in the URL).
+func Open(dataSource string) (store.TiddlerStore, error) {
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	prefix := DefaultPrefix
+	q := u.Query()
+	if p := q.Get("prefix"); p != "" {
+		prefix = p
+	}
+	q.Del("prefix")
+	u.RawQuery = q.Encode()
+	var opts []redis.DialOption
+	if _, ok := u.User.Password(); !ok {
+		if pass := os.Getenv("WIDDLY_DB_PASS"); pass != "" {
+			opts = append(opts, redis.DialPassword(pass))
+		}
+	}
+	source := u.String()
+
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(source, opts...)
+		},
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &redisStore{pool: pool, prefix: prefix, maxRev: -1}, nil
+}
+
+func (s *redisStore) titlesKey() (string) {
+	return s.prefix + "titles"
+}
+
+func (s *redisStore) tiddlerKey(key string) (string) {
+	return s.prefix + "t:" + key
+}
+
+func (s *redisStore) historyKey(key string) (string) {
+	return s.prefix + "h:" + key
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *redisStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	key = store.StoreKey(key)
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	vals, err := redis.ByteSlices(conn.Do("HMGET", s.tiddlerKey(key), "meta", "text"))
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] == nil {
+		return nil, store.ErrNotFound
+	}
+	if vals[1] == nil {
+		vals[1] = []byte{}
+	}
+	return store.NewTiddler(vals[0], vals[1])
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+func (s *redisStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", s.titlesKey()))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		conn.Send("HGET", s.tiddlerKey(key), "meta")
+	}
+	conn.Flush()
+	metas := make([][]byte, 0, len(keys))
+	fat := make([]int, 0)
+	for i := range keys {
+		meta, err := redis.Bytes(conn.Receive())
+		if err == redis.ErrNil { // deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if store.IsFat(meta) {
+			fat = append(fat, len(metas))
+			conn.Send("HGET", s.tiddlerKey(keys[i]), "text")
+		}
+		metas = append(metas, meta)
+	}
+
+	texts := make(map[int][]byte, len(fat))
+	if len(fat) > 0 {
+		conn.Flush()
+		for _, i := range fat {
+			text, err := redis.Bytes(conn.Receive())
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if text == nil {
+				text = []byte{}
+			}
+			texts[i] = text
+		}
+	}
+
+	tiddlers := make([]*store.Tiddler, 0, len(metas))
+	for i, meta := range metas {
+		t, err := store.NewTiddler(meta, texts[i])
+		if err != nil {
+			continue
+		}
+		tiddlers = append(tiddlers, t)
+	}
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The revision is read under WATCH, so concurrent Puts of a title retry instead of sharing a revision.
+// The tiddler is also added to its history.
+func (s *redisStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	tkey, hkey := s.tiddlerKey(tiddler.Key), s.historyKey(tiddler.Key)
+	history := s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if _, err := conn.Do("WATCH", tkey); err != nil {
+			return 0, err
+		}
+		rev, err := redis.Int(conn.Do("HGET", tkey, "revision"))
+		if err == redis.ErrNil {
+			rev, err = 1, nil
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+		rev++
+
+		tiddler.Js["revision"] = rev
+		meta, err := json.Marshal(tiddler.Js)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+		var member []byte
+		if history {
+			seq, err := redis.Int64(conn.Do("INCR", s.prefix + "seq"))
+			if err != nil {
+				conn.Do("UNWATCH")
+				return 0, err
+			}
+			member = historyMember(seq, meta, text)
+		}
+
+		conn.Send("MULTI")
+		conn.Send("HSET", tkey, "meta", meta, "text", text, "revision", rev)
+		conn.Send("SADD", s.titlesKey(), tiddler.Key)
+		trimmed := false
+		if history {
+			// remove old history
+			if s.maxRev > 0 && rev - s.maxRev > 1 {
+				conn.Send("ZREMRANGEBYSCORE", hkey, "-inf", rev - 1 - s.maxRev)
+				trimmed = true
+			}
+			conn.Send("ZADD", hkey, rev, member)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return 0, err
+		}
+		if reply == nil { // changed under WATCH
+			continue
+		}
+		if trimmed {
+			s.histSize.Reset()
+		}
+		if history {
+			s.checkHistorySize(conn, int64(len(member)))
+		}
+		return rev, nil
+	}
+}
+
+// historyMember encodes a revision of the history.
+func historyMember(seq int64, meta []byte, text string) ([]byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%020d", seq)
+	buf.Write(meta)
+	buf.WriteByte(0)
+	buf.WriteString(text)
+	return buf.Bytes()
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	key = store.StoreKey(key)
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", s.tiddlerKey(key), s.historyKey(key))
+	conn.Send("SREM", s.titlesKey(), key)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	s.histSize.Reset()
+	return nil
+}
+
+func (s *redisStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *redisStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// Audit checks the newest revision in the history of every tiddler against the tiddler.
+func (s *redisStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", s.titlesKey()))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		conn.Send("HMGET", s.tiddlerKey(key), "meta", "revision")
+		conn.Send("ZREVRANGE", s.historyKey(key), 0, 0, "WITHSCORES")
+	}
+	conn.Flush()
+	divs := make([]store.Divergence, 0)
+	metas := make([][]byte, 0)
+	for _, key := range keys {
+		vals, err := redis.ByteSlices(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		newest, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if vals[0] == nil { // deleted meanwhile
+			continue
+		}
+		d := store.Divergence{Key: key}
+		d.Head, _ = strconv.Atoi(string(vals[1]))
+		if len(newest) == 2 {
+			d.Latest, _ = strconv.Atoi(newest[1])
+		}
+		if store.Diverges(vals[0], d.Head, d.Latest, s.maxRev != 0) {
+			divs = append(divs, d)
+			metas = append(metas, vals[0])
+		}
+	}
+	if !repair {
+		return divs, nil
+	}
+
+	for i, d := range divs {
+		if _, err := conn.Do("ZREMRANGEBYSCORE", s.historyKey(d.Key), d.Head, "+inf"); err != nil {
+			return nil, err
+		}
+		if s.maxRev == 0 || store.NoHistory(metas[i]) {
+			continue
+		}
+		text, err := redis.String(conn.Do("HGET", s.tiddlerKey(d.Key), "text"))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		seq, err := redis.Int64(conn.Do("INCR", s.prefix + "seq"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("ZADD", s.historyKey(d.Key), d.Head, historyMember(seq, metas[i], text)); err != nil {
+			return nil, err
+		}
+	}
+	s.histSize.Reset()
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history, Seq read from the member prefix.
+func (s *redisStore) historyEntries(conn redis.Conn) ([]store.HistoryEntry, error) {
+	keys, err := redis.Strings(conn.Do("SMEMBERS", s.titlesKey()))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		conn.Send("ZRANGE", s.historyKey(key), 0, -1, "WITHSCORES")
+	}
+	conn.Flush()
+	entries := make([]store.HistoryEntry, 0)
+	for _, key := range keys {
+		vals, err := redis.ByteSlices(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(vals); i += 2 {
+			member := vals[i]
+			if len(member) < 20 {
+				continue
+			}
+			seq, _ := strconv.ParseInt(string(member[:20]), 10, 64)
+			rev, _ := strconv.Atoi(string(vals[i+1]))
+			entries = append(entries, store.HistoryEntry{Key: key, Rev: rev, Size: int64(len(member)), Seq: seq})
+		}
+	}
+	return entries, nil
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *redisStore) checkHistorySize(conn redis.Conn, added int64) {
+	var entries []store.HistoryEntry
+	scan := func() (int64, error) {
+		var err error
+		entries, err = s.historyEntries(conn)
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		return total, err
+	}
+	if !s.histSize.Grow(added, scan) {
+		return
+	}
+
+	if entries == nil {
+		var err error
+		entries, err = s.historyEntries(conn)
+		if err != nil {
+			log.Println("[redis] list history error", err)
+			return
+		}
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		_, err := conn.Do("ZREMRANGEBYSCORE", s.historyKey(e.Key), e.Rev, e.Rev)
+		if err != nil {
+			log.Println("[redis] prune history error", err)
+			s.histSize.Reset()
+			return
+		}
+	}
+	log.Printf("[redis] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
@@ -0,0 +1,62 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package redis
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+
+	"../../store"
+	"../storetest"
+)
+
+// The tests need an empty database, e.g.
+//
+//	WIDDLY_TEST_REDIS='redis://localhost:6379/15' go test
+//
+// it is flushed by every test.
+func openTemp(tb testing.TB) storetest.OpenFn {
+	source := os.Getenv("WIDDLY_TEST_REDIS")
+	if source == "" {
+		tb.Skip("$WIDDLY_TEST_REDIS not set")
+	}
+	return func(dir string) (store.TiddlerStore, error) {
+		conn, err := redis.DialURL(source)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if _, err := conn.Do("FLUSHDB"); err != nil {
+			return nil, err
+		}
+		return Open(source)
+	}
+}
+
+func TestStore(t *testing.T) {
+	open := openTemp(t)
+	storetest.Run(t, open)
+	storetest.RunSystem(t, open)
+	storetest.RunOrder(t, open)
+	storetest.RunPage(t, open)
+	storetest.RunAudit(t, open)
+	storetest.RunBatch(t, open)
+	storetest.RunCase(t, open)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp(b))
+}
@@ -15,24 +15,38 @@
 package sqlite
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
 
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 
 	"../../store"
 )
 
 const (
 	TypeName = "sqlite"
+
+	// busyRetries is how many times an operation is tried again when the database
+	// stays locked past the busy timeout, e.g. by a large import.
+	busyRetries = 4
 )
 
 // sqliteStore is a sqliteDB store for tiddlers.
 type sqliteStore struct {
 	db *sql.DB
 	maxRev int
+	histSize store.HistorySize
+
+	done chan struct{} // stops the checkpoint loop
+	wg   sync.WaitGroup
+	close sync.Once
 }
 
 func init() {
@@ -44,7 +58,24 @@ func init() {
 
 // Open opens the SQLite3 file specified as dataSource,
 // creates the necessary tables and returns a TiddlerStore.
+// store.BackendOptions may set:
+//
+//	busy_timeout    how long a statement waits for a locked database before failing, default 5s
+//	checkpoint      how often the WAL file is written back and truncated, default 5m, 0 for SQLite's automatic checkpoints only
 func Open(dataSource string) (store.TiddlerStore, error) {
+	o := store.BackendOptions
+	if err := o.Check(TypeName, "busy_timeout", "checkpoint"); err != nil {
+		return nil, err
+	}
+	busy, err := o.Duration("busy_timeout", 5 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := o.Duration("checkpoint", 5 * time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
 	// open url: _journal_mode
 	// SQL: PRAGMA journal_mode = DELETE | TRUNCATE | MEMORY | WAL
 	// reduce disk IO for sdcard/NAND(rpi, router etc) : MEMORY > WAL, TRUNCATE, DELETE
@@ -56,7 +87,11 @@ func Open(dataSource string) (store.TiddlerStore, error) {
 	// with UPS: OFF, 0
 	// more safety but without UPS: EXTRA, 3 > FULL, 2
 	// https://www.sqlite.org/pragma.html#pragma_synchronous
-	db, err := sql.Open("sqlite3", dataSource + "?_journal_mode=WAL")
+	// transactions take the write lock at BEGIN (waiting for it), so reading the revision
+	// and writing the tiddler cannot race with another writer
+	// readers never wait for the writer in WAL mode, but the writers wait for each other
+	// and the checkpoints for the readers up to _busy_timeout
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_txlock=immediate&_busy_timeout=%d", dataSource, busy.Milliseconds()))
 	if err != nil {
 		return nil, err
 	}
@@ -68,22 +103,93 @@ func Open(dataSource string) (store.TiddlerStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &sqliteStore{db, -1}, nil
+	s := &sqliteStore{db: db, maxRev: -1, done: make(chan struct{})}
+	if checkpoint > 0 {
+		s.wg.Add(1)
+		go s.checkpointLoop(checkpoint)
+	}
+	return s, nil
 }
 
 func (s *sqliteStore) Close() error {
 	if s.db == nil {
 		return nil
 	}
+	s.close.Do(func() { close(s.done) })
+	s.wg.Wait()
+	s.checkpoint(context.Background())
 	return s.db.Close()
 }
 
+// checkpointLoop checkpoints the WAL file every interval until Close,
+// so it does not grow without bound while readers keep SQLite's automatic checkpoints from completing.
+func (s *sqliteStore) checkpointLoop(interval time.Duration) {
+	defer s.wg.Done()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+			s.checkpoint(context.Background())
+		}
+	}
+}
+
+// checkpoint writes the WAL file back into the database and truncates it.
+func (s *sqliteStore) checkpoint(ctx context.Context) {
+	var busy, frames, done int
+	err := retryBusy(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &frames, &done)
+	})
+	if err != nil {
+		log.Println("[sqlite] checkpoint error", err)
+		return
+	}
+	if busy != 0 {
+		log.Printf("[sqlite] checkpoint incomplete, %d of %d pages written back, readers kept the rest", done, frames)
+	}
+}
+
+// isBusy tells whether err is SQLite's "database is locked".
+func isBusy(err error) (bool) {
+	var se sqlite3.Error
+	if errors.As(err, &se) {
+		return se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// retryBusy calls fn, again after a growing pause while it fails with a locked database,
+// up to busyRetries times.
+func retryBusy(ctx context.Context, fn func() error) (error) {
+	wait := 50 * time.Millisecond
+	for i := 0; ; i++ {
+		err := fn()
+		if i == busyRetries || !isBusy(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
 // Get retrieves a tiddler from the store by key (title).
-func (s *sqliteStore) Get(_ context.Context, key string) (*store.Tiddler, error) {
-	getStmt, err := s.db.Prepare(`SELECT meta, content FROM tiddler WHERE title = ?`)
+func (s *sqliteStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	key = store.StoreKey(key)
 	var meta string
 	var content string
-	err = getStmt.QueryRow(key).Scan(&meta, &content)
+	err := retryBusy(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT meta, content FROM tiddler WHERE title = ?`, key).Scan(&meta, &content)
+	})
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -97,10 +203,45 @@ func copyOf(p []byte) []byte {
 }
 
 // All retrieves all the tiddlers (mostly skinny) from the store.
-// Special tiddlers (like global macros) are returned fat.
-func (s *sqliteStore) All(_ context.Context) ([]*store.Tiddler, error) {
+// Tiddlers tagged with one of store.FatTags are returned fat.
+func (s *sqliteStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	return s.AllOrdered(ctx, store.Order{})
+}
+
+// AllOrdered is All sorted by o, with the dates read from meta by json_extract.
+func (s *sqliteStore) AllOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	var tiddlers []*store.Tiddler
+	err := retryBusy(ctx, func() (err error) {
+		tiddlers, err = s.allOrdered(ctx, o)
+		return err
+	})
+	return tiddlers, err
+}
+
+// AllPage is All from the first title after the cursor after, at most limit tiddlers.
+func (s *sqliteStore) AllPage(ctx context.Context, after string, limit int) ([]*store.Tiddler, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	var tiddlers []*store.Tiddler
+	err := retryBusy(ctx, func() (err error) {
+		tiddlers, err = s.list(ctx, `SELECT meta, content FROM tiddler WHERE title > ? ORDER BY title ASC LIMIT ?`, after, limit)
+		return err
+	})
+	return tiddlers, err
+}
+
+func (s *sqliteStore) allOrdered(ctx context.Context, o store.Order) ([]*store.Tiddler, error) {
+	return s.list(ctx, `SELECT meta, content FROM tiddler ` + orderBy(o))
+}
+
+// list reads the (mostly skinny) tiddlers of a query of meta and content.
+func (s *sqliteStore) list(ctx context.Context, query string, args ...interface{}) ([]*store.Tiddler, error) {
 	tiddlers := make([]*store.Tiddler, 0)
-	rows, err := s.db.Query(`SELECT meta, content FROM tiddler`)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 	for rows.Next() {
 		var meta string
@@ -111,122 +252,375 @@ func (s *sqliteStore) All(_ context.Context) ([]*store.Tiddler, error) {
 
 		var tiddler []byte
 		metabuf := []byte(meta)
-		if bytes.Contains(metabuf, []byte(`"$:/tags/Macro"`)) {
+		if store.IsFat(metabuf) {
 			tiddler = []byte(content)
 		}
 
 		t, _ := store.NewTiddler(metabuf, tiddler)
 		tiddlers = append(tiddlers, t)
 	}
-	if err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 	return tiddlers, nil
 }
 
-func getLastRevision(db *sql.DB, mkey string) int {
+// orderBy returns the ORDER BY clause of o.
+func orderBy(o store.Order) (string) {
+	dir := "ASC"
+	if o.Desc {
+		dir = "DESC"
+	}
+	switch o.By {
+	case store.SortModified, store.SortCreated:
+		return fmt.Sprintf(`ORDER BY json_extract(meta, '$.%s') %s, title ASC`, o.By, dir)
+	}
+	return `ORDER BY title ` + dir
+}
+
+// revisionOf returns the revision of mkey, 0 when missing.
+func revisionOf(tx *sql.Tx, mkey string) (int, error) {
 	var revision int
-	getStmt, err := db.Prepare(`SELECT revision FROM tiddler WHERE title = ?`)
-	err = getStmt.QueryRow(mkey).Scan(&revision)
-	if err != nil {
-		return 1
+	err := tx.QueryRow(`SELECT revision FROM tiddler WHERE title = ?`, mkey).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-	return revision
+	return revision, err
 }
 
 // delete all revision <= rev
-func (s *sqliteStore) trimRevision(key string, rev int) (err error) {
-	deleteStmt, err := s.db.Prepare(`DELETE FROM tiddler_history WHERE title = ? AND revision <= ?`)
-	if err != nil {
-		return err
-	}
-	_, err = deleteStmt.Exec(key, rev)
-	if err != nil {
-		return err
-	}
-	return
+func (s *sqliteStore) trimRevision(tx *sql.Tx, key string, rev int) (err error) {
+	_, err = tx.Exec(`DELETE FROM tiddler_history WHERE title = ? AND revision <= ?`, key, rev)
+	return err
 }
 
 // Put saves tiddler to the store, incrementing and returning revision.
 // The tiddler is also written to the tiddler_history bucket.
 func (s *sqliteStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
-	tx, err := s.db.Begin()
+	var rev int
+	var added int64
+	err := retryBusy(ctx, func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		rev, added, err = s.put(tx, tiddler)
+		if err != nil {
+			return err
+		}
+
+		// Commit the transaction.
+		return tx.Commit()
+	})
 	if err != nil {
-		return 1, err
+		return 0, err
 	}
-	defer tx.Rollback()
+	if added > 0 {
+		s.checkHistorySize(added)
+	}
+	return rev, nil
+}
 
-	rev := getLastRevision(s.db, tiddler.Key) + 1
-	insertStmt, err := s.db.Prepare(`INSERT INTO tiddler(title, meta, content, revision) VALUES (?, ?, ?, ?) ON CONFLICT(title) DO UPDATE SET meta = ?, content = ?, revision = ?`)
+// put is Put inside tx, it also returns the size added to the history.
+// It leaves tiddler.Js unchanged, for the transaction to be tried again.
+func (s *sqliteStore) put(tx *sql.Tx, tiddler store.Tiddler) (int, int64, error) {
+	tiddler.Key = store.StoreKey(tiddler.Key)
+	rev, err := revisionOf(tx, tiddler.Key)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	if rev == 0 {
+		rev = 1
 	}
+	rev++
 
-	tiddler.Js["revision"] = rev
-	text, _ := tiddler.Js["text"].(string)
-	delete(tiddler.Js, "text")
-	meta, err := json.Marshal(tiddler.Js)
+	js := make(map[string]interface{}, len(tiddler.Js))
+	for k, v := range tiddler.Js {
+		js[k] = v
+	}
+	js["revision"] = rev
+	text, _ := js["text"].(string)
+	delete(js, "text")
+	meta, err := json.Marshal(js)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	_, err = insertStmt.Exec(tiddler.Key, meta, text, rev, meta, text, rev)
+	_, err = tx.Exec(`INSERT INTO tiddler(title, meta, content, revision) VALUES (?, ?, ?, ?) ON CONFLICT(title) DO UPDATE SET meta = ?, content = ?, revision = ?`,
+		tiddler.Key, meta, text, rev, meta, text, rev)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	// skip Draft & system key history
-	if s.maxRev != 0 && !tiddler.IsDraft && !tiddler.IsSys {
-		// remove old history
-		if s.maxRev > 0 && rev - s.maxRev > 1 {
-			s.trimRevision(tiddler.Key, rev - 1 - s.maxRev)
+	if s.maxRev == 0 || tiddler.IsDraft || tiddler.IsSys {
+		return rev, 0, nil
+	}
+	// remove old history
+	if s.maxRev > 0 && rev - s.maxRev > 1 {
+		if err := s.trimRevision(tx, tiddler.Key, rev - 1 - s.maxRev); err != nil {
+			return 0, 0, err
 		}
+		s.histSize.Reset()
+	}
+	_, err = tx.Exec(`INSERT INTO tiddler_history(title, meta, content, revision) VALUES (?, ?, ?, ?)`, tiddler.Key, meta, text, rev)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rev, int64(len(meta) + len(text)), nil
+}
 
-		insertStmt, err := s.db.Prepare(`INSERT INTO tiddler_history(title, meta, content, revision) VALUES (?, ?, ?, ?)`)
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *sqliteStore) Delete(ctx context.Context, key string) error {
+	err := retryBusy(ctx, func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
-			return 0, err
+			return err
 		}
-		_, err = insertStmt.Exec(tiddler.Key, meta, text, rev)
-		if err != nil {
-			return 0, err
+		defer tx.Rollback()
+		if err := s.del(tx, key); err != nil {
+			return err
 		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
 	}
+	s.histSize.Reset()
+	return nil
+}
 
-	// Commit the transaction.
-	if err := tx.Commit(); err != nil {
-		return rev, err
+// del is Delete inside tx.
+func (s *sqliteStore) del(tx *sql.Tx, key string) error {
+	key = store.StoreKey(key)
+	if _, err := tx.Exec(`DELETE FROM tiddler WHERE title = ?`, key); err != nil {
+		return err
 	}
-	return rev, nil
+	_, err := tx.Exec(`DELETE FROM tiddler_history WHERE title = ?`, key)
+	return err
 }
 
-// Delete deletes a tiddler with the given key (title) from the store.
-func (s *sqliteStore) Delete(ctx context.Context, key string) error {
-	deleteStmt, err := s.db.Prepare(`DELETE FROM tiddler WHERE title = ?`)
+// Batch applies ops in one transaction.
+func (s *sqliteStore) Batch(ctx context.Context, ops []store.Op) ([]int, error) {
+	revs := make([]int, len(ops))
+	var added int64
+	err := retryBusy(ctx, func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		added = 0
+		for i, op := range ops {
+			cur, err := revisionOf(tx, store.StoreKey(op.Tiddler.Key))
+			if err != nil {
+				return err
+			}
+			if err := store.CheckRev(ops, i, cur); err != nil {
+				return err
+			}
+
+			if op.Delete {
+				err = s.del(tx, op.Tiddler.Key)
+			} else {
+				var n int64
+				revs[i], n, err = s.put(tx, op.Tiddler)
+				added += n
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s.histSize.Reset()
+	if added > 0 {
+		s.checkHistorySize(added)
 	}
-	_, err = deleteStmt.Exec(key)
+	return revs, nil
+}
+
+func (s *sqliteStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *sqliteStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// ListRevisions returns the revisions of key in the tiddler_history table, newest first.
+func (s *sqliteStore) ListRevisions(ctx context.Context, key string) ([]store.Revision, error) {
+	var revs []store.Revision
+	err := retryBusy(ctx, func() error {
+		rows, err := s.db.QueryContext(ctx, `SELECT revision, COALESCE(json_extract(meta, '$.modified'), ''), COALESCE(json_extract(meta, '$.modifier'), ''), length(CAST(content AS BLOB))
+			FROM tiddler_history WHERE title = ? ORDER BY revision DESC`, store.StoreKey(key))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		revs = make([]store.Revision, 0)
+		for rows.Next() {
+			var r store.Revision
+			if err := rows.Scan(&r.Rev, &r.Modified, &r.Modifier, &r.Size); err != nil {
+				return err
+			}
+			revs = append(revs, r)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return revs, nil
+}
 
-	// skip if no history keeping
-	if s.maxRev == 0 {
-		return nil
+// GetRevision returns the revision rev of key in the tiddler_history table.
+func (s *sqliteStore) GetRevision(ctx context.Context, key string, rev int) (*store.Tiddler, error) {
+	var meta string
+	var content string
+	err := retryBusy(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT meta, content FROM tiddler_history WHERE title = ? AND revision = ? ORDER BY id DESC LIMIT 1`,
+			store.StoreKey(key), rev).Scan(&meta, &content)
+	})
+	if err == sql.ErrNoRows {
+		return nil, store.ErrNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+	return store.NewTiddler([]byte(meta), []byte(content))
+}
 
-	deleteStmt, err = s.db.Prepare(`DELETE FROM tiddler_history WHERE title = ?`)
+// Audit checks the newest revision in the tiddler_history table of every tiddler against the tiddler.
+func (s *sqliteStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT t.title, t.meta, t.revision, COALESCE(MAX(h.revision), 0)
+		FROM tiddler t LEFT JOIN tiddler_history h ON h.title = t.title GROUP BY t.id`)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	divs := make([]store.Divergence, 0)
+	metas := make([][]byte, 0)
+	for rows.Next() {
+		var d store.Divergence
+		var meta []byte
+		if err := rows.Scan(&d.Key, &meta, &d.Head, &d.Latest); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if store.Diverges(meta, d.Head, d.Latest, s.maxRev != 0) {
+			divs = append(divs, d)
+			metas = append(metas, meta)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !repair || len(divs) == 0 {
+		return divs, nil
 	}
-	_, err = deleteStmt.Exec(key)
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer tx.Rollback()
+	for i, d := range divs {
+		_, err := tx.Exec(`DELETE FROM tiddler_history WHERE title = ? AND revision >= ?`, d.Key, d.Head)
+		if err != nil {
+			return nil, err
+		}
+		if s.maxRev == 0 || store.NoHistory(metas[i]) {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO tiddler_history(title, meta, content, revision) SELECT title, meta, content, revision FROM tiddler WHERE title = ?`, d.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.histSize.Reset()
+	return divs, nil
 }
 
-func (s *sqliteStore) SetMaxHistory(rev int) {
-	s.maxRev = rev
+// historyEntries lists all revisions in the history table, ordered by insertion.
+func (s *sqliteStore) historyEntries() ([]store.HistoryEntry, error) {
+	rows, err := s.db.Query(`SELECT id, title, revision, length(meta) + length(content) FROM tiddler_history`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]store.HistoryEntry, 0)
+	for rows.Next() {
+		var e store.HistoryEntry
+		if err := rows.Scan(&e.Seq, &e.Key, &e.Rev, &e.Size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
 }
 
+func (s *sqliteStore) historySize() (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(length(meta) + length(content)), 0) FROM tiddler_history`).Scan(&total)
+	return total, err
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *sqliteStore) checkHistorySize(added int64) {
+	if !s.histSize.Grow(added, s.historySize) {
+		return
+	}
+
+	entries, err := s.historyEntries()
+	if err != nil {
+		log.Println("[sqlite] list history error", err)
+		return
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		_, err := s.db.Exec(`DELETE FROM tiddler_history WHERE id = ?`, e.Seq)
+		if err != nil {
+			log.Println("[sqlite] prune history error", err)
+			s.histSize.Reset()
+			return
+		}
+	}
+	log.Printf("[sqlite] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
+
+
+// Stats reports the pages of the database and the size of its write-ahead log,
+// which grows while the checkpoints are blocked by readers.
+func (s *sqliteStore) Stats(ctx context.Context) ([]store.Stat, error) {
+	var pages, free, pageSize int64
+	row := s.db.QueryRowContext(ctx, `SELECT * FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`)
+	if err := row.Scan(&pages, &free, &pageSize); err != nil {
+		return nil, err
+	}
+	var seq int
+	var name, file string
+	if err := s.db.QueryRowContext(ctx, `PRAGMA database_list`).Scan(&seq, &name, &file); err != nil {
+		return nil, err
+	}
+	var wal int64
+	if fi, err := os.Stat(file + "-wal"); err == nil {
+		wal = fi.Size()
+	}
+	return []store.Stat{
+		{Name: "sqlite_pages", Help: "Pages of the SQLite database.", Value: float64(pages)},
+		{Name: "sqlite_free_pages", Help: "Unused pages of the SQLite database.", Value: float64(free)},
+		{Name: "file_bytes", Help: "Size of the SQLite database.", Value: float64(pages * pageSize)},
+		{Name: "wal_bytes", Help: "Size of the SQLite write-ahead log.", Value: float64(wal)},
+	}, nil
+}
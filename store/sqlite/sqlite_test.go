@@ -0,0 +1,85 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../../store"
+	"../storetest"
+)
+
+func openTemp(dir string) (store.TiddlerStore, error) {
+	return Open(filepath.Join(dir, "widdly.db"))
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, openTemp)
+	storetest.RunSystem(t, openTemp)
+	storetest.RunOrder(t, openTemp)
+	storetest.RunPage(t, openTemp)
+	storetest.RunAudit(t, openTemp)
+	storetest.RunRevisions(t, openTemp)
+	storetest.RunBatch(t, openTemp)
+	storetest.RunCase(t, openTemp)
+	storetest.RunStats(t, openTemp)
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp)
+}
+
+func TestBusyRetry(t *testing.T) {
+	defer func() { store.BackendOptions = nil }()
+	store.BackendOptions = store.Options{"busy_timeout": "20ms", "checkpoint": "10ms"}
+	path := filepath.Join(t.TempDir(), "widdly.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// another process importing holds the write lock longer than the busy timeout
+	other, err := sql.Open("sqlite3", path + "?_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Commit()
+	}()
+
+	ctx := context.Background()
+	if _, err := db.Put(ctx, storetest.NewTiddler(1)); err != nil {
+		t.Fatalf("want the save retried, got %v", err)
+	}
+	if _, err := db.Get(ctx, storetest.NewTiddler(1).Key); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if fi, err := os.Stat(path + "-wal"); err != nil || fi.Size() != 0 {
+		t.Errorf("want the WAL file truncated by the checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+)
+
+// Stat is a gauge of the internals of a store, e.g. the size of its file.
+type Stat struct {
+	Name  string  // lower case with underscores, e.g. "file_bytes"
+	Help  string
+	Value float64
+}
+
+// StatsStore is implemented by backends which report their internals, shown by /metrics
+// (as widdly_store_<name>) and /admin/stats, so a growing file or freelist is seen early.
+type StatsStore interface {
+	// Stats reads the gauges; it is called on every scrape, so it must be cheap.
+	Stats(ctx context.Context) ([]Stat, error)
+}
@@ -15,6 +15,7 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"strings"
@@ -25,6 +26,12 @@ var (
 	// ErrNotFound is the error returned by the TiddlerStore when no tiddlers with a given key are found.
 	ErrNotFound = errors.New("not found")
 
+	// ErrBadTiddler is returned when tiddler meta is not a JSON object.
+	ErrBadTiddler = errors.New("malformed tiddler")
+
+	// ErrReadOnly is returned by the writes of a store opened read-only, see store/readonly.
+	ErrReadOnly = errors.New("the store is read-only")
+
 	ErrDBExist = errors.New("same backend exist")
 	ErrDBNotExist = errors.New("backend not exist")
 
@@ -47,10 +54,12 @@ type Tiddler struct {
 	Js map[string]interface{} // for proc
 }
 
+// NewTiddler makes a tiddler read from a store, skinny when text is nil.
+// Metas of older versions are upgraded, see UpgradeMeta.
 func NewTiddler(meta []byte, text []byte) (*Tiddler, error) {
 	t := &Tiddler{}
 	if text == nil {
-		t.Meta = meta
+		t.Meta = UpgradeMeta(meta)
 		return t, nil
 	}
 
@@ -59,6 +68,10 @@ func NewTiddler(meta []byte, text []byte) (*Tiddler, error) {
 	if err != nil {
 		return nil, err
 	}
+	if t.Js == nil { // meta was `null`
+		return nil, ErrBadTiddler
+	}
+	upgradeFields(t.Js)
 	t.Js["text"] = string(text)
 
 	return t, nil
@@ -74,6 +87,46 @@ func (t *Tiddler) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.Js)
 }
 
+// Skinny returns meta without the "text" field.
+// Metas without text are returned as is.
+func Skinny(meta []byte) ([]byte) {
+	if !bytes.Contains(meta, []byte(`"text"`)) {
+		return meta
+	}
+
+	var js map[string]interface{}
+	if json.Unmarshal(meta, &js) != nil || js == nil {
+		return meta
+	}
+	if _, ok := js["text"]; !ok {
+		return meta
+	}
+	delete(js, "text")
+	skinny, err := json.Marshal(js)
+	if err != nil {
+		return meta
+	}
+	return skinny
+}
+
+// Fields returns the decoded tiddler fields, skinny tiddlers have no "text".
+// The returned map may be t.Js itself.
+func (t *Tiddler) Fields() (map[string]interface{}, error) {
+	if t.Js != nil {
+		return t.Js, nil
+	}
+
+	var js map[string]interface{}
+	err := json.Unmarshal(t.Meta, &js)
+	if err != nil {
+		return nil, err
+	}
+	if js == nil {
+		return nil, ErrBadTiddler
+	}
+	return js, nil
+}
+
 func (t *Tiddler) GetRevision() (rev int) {
 	var meta struct{ Revision int }
 	if json.Unmarshal(t.Meta, &meta) == nil {
@@ -85,30 +138,43 @@ func (t *Tiddler) GetRevision() (rev int) {
 
 // TiddlerStore provides an interface for retrieving, storing and deleting tiddlers.
 type TiddlerStore interface {
-	// Get retrieves a tiddler from the store by key (title).
+	// Get retrieves a fat tiddler (with text) from the store by key (title).
+	// System tiddlers are stored and returned the same way as the others.
 	// Get should return ErrNotFound error when no tiddlers with the given key are found.
 	Get(ctx context.Context, key string) (*Tiddler, error)
 
 	// All retrieves all the tiddlers from the store.
 	// Most tiddlers should be returned skinny, except for special tiddlers,
-	// like global macros (tiddlers tagged $:/tags/Macro), which should be
-	// returned fat.
+	// like global macros (tiddlers tagged with one of FatTags, see IsFat),
+	// which should be returned fat.
 	// All must not return deleted tiddlers.
+	// The tiddlers are sorted by key (StoreKey of the title) in byte order, see SortTiddlers.
 	All(ctx context.Context) ([]*Tiddler, error)
 
 	// Put saves tiddler to the store and returns its revision.
+	// The revision of a new tiddler is 2, and grows by 1 on every Put.
+	// Unless history is disabled, the saved tiddler (with text and revision)
+	// is also appended to the history, except for drafts (IsDraft) and
+	// system tiddlers (IsSys), which never get history.
 	Put(ctx context.Context, tiddler Tiddler) (int, error)
 
-	// Delete deletes a tiddler by key.
+	// Delete deletes a tiddler by key, together with all of its history.
 	Delete(ctx context.Context, key string) error
 
 	// Safety close backend.
 	Close() error
 
-	// Max keeping history count
+	// Max keeping history count per tiddler, on Put all revisions older
+	// than the newest rev ones are removed.
 	// -1 => unlimit
-	// 0 => disable
+	// 0 => disable, no new history is written, existing history is kept
+	// until the tiddler is deleted
 	SetMaxHistory(rev int)
+
+	// Max total size of the history in bytes, the oldest revisions across
+	// all tiddlers (except the latest one of each tiddler) are pruned when exceeded.
+	// 0 => unlimit
+	SetMaxHistorySize(size int64)
 }
 
 type TiddlerBackend struct {
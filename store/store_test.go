@@ -0,0 +1,197 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func FuzzNewTiddler(f *testing.F) {
+	f.Add([]byte(`{"title":"a","tags":"x [[y z]]"}`), []byte("text"), true)
+	f.Add([]byte(`{"fields":{"a":{"b":{"c":[1,2,3]}}}}`), []byte(""), true)
+	f.Add([]byte(`{"revision":1e400}`), []byte(nil), false)
+	f.Add([]byte(`null`), []byte("x"), true)
+	f.Add([]byte(`{"title":"\xff\xfe"}`), []byte("\xff"), true)
+
+	f.Fuzz(func(t *testing.T, meta []byte, text []byte, fat bool) {
+		if !fat {
+			text = nil
+		}
+		td, err := NewTiddler(meta, text)
+		if err != nil {
+			return
+		}
+		td.GetRevision()
+
+		data, err := td.MarshalJSON()
+		if err != nil {
+			return
+		}
+		if text == nil {
+			return
+		}
+		if !json.Valid(data) {
+			t.Fatalf("invalid JSON from fat tiddler: %q", data)
+		}
+
+		var js map[string]interface{}
+		if err := json.Unmarshal(data, &js); err != nil {
+			t.Fatal(err)
+		}
+		if utf8.Valid(text) && js["text"] != string(text) {
+			t.Errorf("text mangled: want %q, got %q", text, js["text"])
+		}
+	})
+}
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(" $:/tags/Macro [[two words]]  x\t[[unclosed")
+	want := []string{"$:/tags/Macro", "two words", "x", "[[unclosed"}
+	if len(tags) != len(want) {
+		t.Fatalf("want %q, got %q", want, tags)
+	}
+	for i := range want {
+		if tags[i] != want[i] {
+			t.Errorf("want %q, got %q", want[i], tags[i])
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	o, err := ParseOptions("nosync, Freelist=hashmap ,mmap=64MiB,,size=2k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := o.Bool("nosync", false); !b || err != nil {
+		t.Errorf("nosync: got %v %v", b, err)
+	}
+	if f := o.String("freelist", ""); f != "hashmap" {
+		t.Errorf("freelist: got %q", f)
+	}
+	for name, want := range map[string]int64{"mmap": 64 << 20, "size": 2 << 10, "missing": 7} {
+		if n, err := o.Size(name, 7); n != want || err != nil {
+			t.Errorf("%s: want %d, got %d %v", name, want, n, err)
+		}
+	}
+	if err := o.Check("x", "nosync", "freelist", "mmap"); err == nil {
+		t.Error("want size reported unknown")
+	}
+	if d, err := (Options{"wait": "1m30s"}).Duration("wait", 0); d != 90 * time.Second || err != nil {
+		t.Errorf("wait: got %v %v", d, err)
+	}
+	if _, err := (Options{"mmap": "64X"}).Size("mmap", 0); err == nil {
+		t.Error("want bad size refused")
+	}
+}
+
+func TestIsFat(t *testing.T) {
+	for meta, want := range map[string]bool{
+		`{"tags":"$:/tags/Macro"}`:                    true,
+		`{"tags":["x","$:/tags/RawMarkup"]}`:          true,
+		`{"tags":"[[$:/tags/Global]] y"}`:             true,
+		`{"tags":"x","caption":"see $:/tags/Macro"}`:  false,
+		`{"tags":"[[$:/tags/Macro/View]]"}`:           false,
+		`{"title":"$:/tags/Macro"}`:                   false,
+	} {
+		if got := IsFat([]byte(meta)); got != want {
+			t.Errorf("%s: want %v, got %v", meta, want, got)
+		}
+	}
+}
+
+func TestWriteFatJSON(t *testing.T) {
+	for _, meta := range []string{`{}`, `{"title":"a"}`, " {\"a\":[1,2]} \n"} {
+		text := "line\n\"quoted\" <b>&</b> \t \x01   \xff é"
+		var buf bytes.Buffer
+		if err := WriteFatJSON(&buf, []byte(meta), strings.NewReader(text)); err != nil {
+			t.Fatal(err)
+		}
+
+		var js map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &js); err != nil {
+			t.Fatalf("%s: %v", buf.Bytes(), err)
+		}
+		if want := strings.ToValidUTF8(text, "�"); js["text"] != want {
+			t.Errorf("want %q, got %q", want, js["text"])
+		}
+	}
+}
+
+func TestTid(t *testing.T) {
+	js := map[string]interface{}{
+		"title":    "$:/config/Test",
+		"tags":     []interface{}{"a", "b c"},
+		"modified": "20190101000000000",
+		"revision": 3,
+		"fields":   map[string]interface{}{"caption": "Test"},
+		"text":     "line 1\n\nline 3\n",
+	}
+	data := EncodeTid(js)
+	want := "caption: Test\nmodified: 20190101000000000\ntags: a [[b c]]\ntitle: $:/config/Test\n\nline 1\n\nline 3\n"
+	if string(data) != want {
+		t.Fatalf("want %q, got %q", want, data)
+	}
+
+	back, err := DecodeTid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(js, "revision")
+	a, _ := json.Marshal(js)
+	b, _ := json.Marshal(back)
+	if !bytes.Equal(a, b) {
+		t.Errorf("want %s, got %s", a, b)
+	}
+
+	for _, title := range []string{"$:/config/Test", "a%b", "..", "", "x:y\\z?"} {
+		name := TitleToFile(title)
+		if strings.ContainsAny(name, "/\\:?") || name == ".." || name == "" {
+			t.Errorf("%q: unsafe file name %q", title, name)
+		}
+		if back := FileToTitle(name); back != title {
+			t.Errorf("%q: round trip got %q", title, back)
+		}
+	}
+}
+
+func TestUpgradeMeta(t *testing.T) {
+	current := []byte(`{"bag":"bag","revision":3,"tags":["a"],"title":"T"}`)
+	if got := UpgradeMeta(current); &got[0] != &current[0] {
+		t.Errorf("current meta copied")
+	}
+
+	td, err := NewTiddler([]byte(`{"title":"T","tags":"x [[y z]]","revision":"4"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"bag":"bag","revision":4,"tags":["x","y z"],"title":"T"}`; string(td.Meta) != want {
+		t.Errorf("want %s, got %s", want, td.Meta)
+	}
+	if td.GetRevision() != 4 {
+		t.Errorf("want revision 4, got %d", td.GetRevision())
+	}
+
+	td, err = NewTiddler([]byte(`{"title":"T"}`), []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td.Js["bag"] != "bag" || td.Js["revision"] != 1 || td.Js["text"] != "hi" {
+		t.Errorf("fat: got %v", td.Js)
+	}
+}
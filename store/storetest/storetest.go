@@ -0,0 +1,596 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package storetest contains shared tests and benchmarks for TiddlerStore backends.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"../../store"
+)
+
+// OpenFn opens a fresh, empty store inside dir.
+type OpenFn func(dir string) (store.TiddlerStore, error)
+
+// Sizes are the store sizes used by Bench.
+var Sizes = []int{1000, 10000, 100000}
+
+// NewTiddler returns the i-th test tiddler.
+func NewTiddler(i int) store.Tiddler {
+	key := fmt.Sprintf("Tiddler %06d", i)
+	return store.Tiddler{
+		Key: key,
+		Js: map[string]interface{}{
+			"title":    key,
+			"tags":     "bench [[test data]]",
+			"modified": "20190101000000000",
+			"type":     "text/vnd.tiddlywiki",
+			"text":     strings.Repeat("lorem ipsum dolor sit amet ", 20),
+		},
+	}
+}
+
+func open(tb testing.TB, fn OpenFn) store.TiddlerStore {
+	db, err := fn(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+func fill(tb testing.TB, db store.TiddlerStore, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if _, err := db.Put(ctx, NewTiddler(i)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// Run checks the basic Put/Get/All/Delete contract of a backend.
+func Run(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+
+	rev, err := db.Put(ctx, NewTiddler(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := db.Put(ctx, NewTiddler(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev2 != rev+1 {
+		t.Errorf("want revision %d, got %d", rev+1, rev2)
+	}
+
+	td, err := db.Get(ctx, NewTiddler(1).Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := td.Js["text"].(string); text != NewTiddler(1).Js["text"] {
+		t.Errorf("want text %q, got %q", NewTiddler(1).Js["text"], text)
+	}
+
+	fill(t, db, 3)
+	all, err := db.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("want 3 tiddlers, got %d", len(all))
+	}
+
+	err = db.Delete(ctx, NewTiddler(1).Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get(ctx, NewTiddler(1).Key)
+	if err == nil {
+		t.Errorf("want error for deleted tiddler, got nil")
+	}
+}
+
+// Bench runs the Put/Get/All benchmarks on stores of every size in Sizes.
+// Sizes over 10k are skipped in -short mode.
+func Bench(b *testing.B, fn OpenFn) {
+	ctx := context.Background()
+	for _, n := range Sizes {
+		n := n
+		withStore := func(name string, f func(b *testing.B, db store.TiddlerStore)) {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				if testing.Short() && n > 10000 {
+					b.Skip("skipping large store in short mode")
+				}
+				db := open(b, fn)
+				defer db.Close()
+				fill(b, db, n)
+				b.ResetTimer()
+				f(b, db)
+			})
+		}
+
+		withStore("Put", func(b *testing.B, db store.TiddlerStore) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Put(ctx, NewTiddler(i%n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		withStore("Get", func(b *testing.B, db store.TiddlerStore) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(ctx, NewTiddler(i%n).Key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		withStore("All", func(b *testing.B, db store.TiddlerStore) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.All(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// RunOrder checks the title order of All and the orders of store.AllOrdered.
+func RunOrder(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+
+	// put out of order, with modified going down as titles go up;
+	// tiddler 1 is fat, read back by All with text and without Meta
+	for _, i := range []int{2, 0, 3, 1} {
+		td := NewTiddler(i)
+		td.Js["modified"] = fmt.Sprintf("2019010100000000%d", 9-i)
+		if i == 1 {
+			td.Js["tags"] = "$:/tags/Macro"
+		}
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		order store.Order
+		want  []int
+	}{
+		{store.Order{}, []int{0, 1, 2, 3}},
+		{store.Order{By: store.SortTitle, Desc: true}, []int{3, 2, 1, 0}},
+		{store.Order{By: store.SortModified}, []int{3, 2, 1, 0}},
+		{store.Order{By: store.SortModified, Desc: true}, []int{0, 1, 2, 3}},
+	} {
+		all, err := store.AllOrdered(ctx, db, c.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != len(c.want) {
+			t.Fatalf("%+v: want %d tiddlers, got %d", c.order, len(c.want), len(all))
+		}
+		for i, td := range all {
+			if key, got := NewTiddler(c.want[i]).Key, titleOf(td); got != key {
+				t.Errorf("%+v: want %q at %d, got %q", c.order, key, i, got)
+			}
+		}
+	}
+}
+
+// titleOf returns the title of a tiddler read from a store, fat or not.
+func titleOf(td *store.Tiddler) (string) {
+	js, err := td.Fields()
+	if err != nil {
+		return ""
+	}
+	title, _ := js["title"].(string)
+	return title
+}
+
+// RunPage checks that store.AllPage walks all the tiddlers in the order of All.
+func RunPage(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+
+	// tiddler 1 is fat and ends the first page, its title only in Js
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		td := NewTiddler(i)
+		if i == 1 {
+			td.Js["tags"] = "$:/tags/Macro"
+		}
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := db.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paged []*store.Tiddler
+	after := ""
+	for n := 0; n < 10; n++ {
+		page, err := store.AllPage(ctx, db, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("want at most 2 tiddlers, got %d", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = store.KeyOf(page[len(page)-1])
+	}
+	if len(paged) != len(all) {
+		t.Fatalf("want %d tiddlers, got %d", len(all), len(paged))
+	}
+	for i := range all {
+		if titleOf(paged[i]) != titleOf(all[i]) || store.KeyOf(paged[i]) != store.StoreKey(titleOf(all[i])) {
+			t.Errorf("want %q at %d, got %q", titleOf(all[i]), i, titleOf(paged[i]))
+		}
+	}
+
+	// keys starting each other, sorted apart by the backends which add a suffix to them
+	for _, title := range []string{"b", "bz", "b b", "b}", "b|c", "b_c", "b~", "bA", "c"} {
+		td := NewTiddler(0)
+		td.Key, td.Js["title"] = title, title
+		if title == "b b" {
+			td.Js["tags"] = "$:/tags/Macro"
+		}
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if all, err = db.All(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{1, 2, 3, 4} {
+		var keys []string
+		after := ""
+		for n := 0; n < 100; n++ {
+			page, err := store.AllPage(ctx, db, after, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, td := range page {
+				keys = append(keys, store.KeyOf(td))
+			}
+			after = keys[len(keys)-1]
+		}
+		if len(keys) != len(all) {
+			t.Fatalf("limit %d: want %d tiddlers, got %d: %q", limit, len(all), len(keys), keys)
+		}
+		for i := range all {
+			if keys[i] != store.KeyOf(all[i]) {
+				t.Errorf("limit %d: want %q at %d, got %q", limit, store.KeyOf(all[i]), i, keys[i])
+			}
+		}
+	}
+
+	rest, err := store.AllPage(ctx, db, store.KeyOf(all[1]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != len(all)-2 {
+		t.Errorf("want %d tiddlers without a limit, got %d", len(all)-2, len(rest))
+	}
+}
+
+// RunAudit checks the store.AuditStore of a backend: a tiddler saved while history was disabled
+// lacks its head revision in the history until repaired.
+func RunAudit(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+	as, ok := db.(store.AuditStore)
+	if !ok { // not Skip, the other checks of the caller still run
+		t.Log("not a store.AuditStore")
+		return
+	}
+
+	sys := NewTiddler(0)
+	sys.Key, sys.IsSys = "$:/config/Test", true
+	sys.Js["title"] = sys.Key
+	for _, td := range []store.Tiddler{NewTiddler(1), sys} {
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.SetMaxHistory(0)
+	if _, err := db.Put(ctx, NewTiddler(2)); err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxHistory(-1)
+
+	for _, repair := range []bool{false, true} {
+		divs, err := as.Audit(ctx, repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(divs) != 1 || divs[0].Head != 2 || divs[0].Latest != 0 {
+			t.Errorf("repair %v: want one divergence of revision 2, got %+v", repair, divs)
+		}
+	}
+	divs, err := as.Audit(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divs) != 0 {
+		t.Errorf("want no divergence after repair, got %+v", divs)
+	}
+	if _, err := db.Put(ctx, NewTiddler(2)); err != nil {
+		t.Fatal(err)
+	}
+	if divs, _ := as.Audit(ctx, false); len(divs) != 0 {
+		t.Errorf("want no divergence after a Put, got %+v", divs)
+	}
+}
+
+// RunRevisions checks the store.RevisionStore of a backend: every Put of a tiddler can be read back
+// from the history, which system tiddlers never get and a Delete drops.
+func RunRevisions(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+	rs, ok := db.(store.RevisionStore)
+	if !ok {
+		t.Log("not a store.RevisionStore")
+		return
+	}
+
+	td := NewTiddler(1)
+	texts := []string{"first", "second, longer", ""}
+	for i, text := range texts {
+		td := NewTiddler(1)
+		td.Js["text"] = text
+		td.Js["modifier"] = fmt.Sprintf("user%d", i)
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := NewTiddler(1)
+	other.Key += "#2" // shares the prefix of the history keys of td
+	other.Js["title"] = other.Key
+	sys := NewTiddler(0)
+	sys.Key, sys.IsSys = "$:/config/Test", true
+	sys.Js["title"] = sys.Key
+	for _, td := range []store.Tiddler{other, sys} {
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revs, err := rs.ListRevisions(ctx, td.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != len(texts) {
+		t.Fatalf("want %d revisions, got %+v", len(texts), revs)
+	}
+	for i, r := range revs {
+		n := len(texts) - 1 - i
+		if r.Rev != n + 2 || r.Modifier != fmt.Sprintf("user%d", n) || r.Modified != "20190101000000000" || r.Size != int64(len(texts[n])) {
+			t.Errorf("revision %d: unexpected %+v", i, r)
+		}
+		old, err := rs.GetRevision(ctx, td.Key, r.Rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err := old.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if js["text"] != texts[n] || js["title"] != td.Key || fmt.Sprint(js["revision"]) != fmt.Sprint(r.Rev) {
+			t.Errorf("revision %d: unexpected %v", r.Rev, js)
+		}
+	}
+	if _, err := rs.GetRevision(ctx, td.Key, 99); err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound for a missing revision, got %v", err)
+	}
+	if revs, err := rs.ListRevisions(ctx, sys.Key); err != nil || len(revs) != 0 {
+		t.Errorf("want no history of a system tiddler, got %+v %v", revs, err)
+	}
+	if err := db.Delete(ctx, td.Key); err != nil {
+		t.Fatal(err)
+	}
+	if revs, err := rs.ListRevisions(ctx, td.Key); err != nil || len(revs) != 0 {
+		t.Errorf("want no history after Delete, got %+v %v", revs, err)
+	}
+	if revs, err := rs.ListRevisions(ctx, other.Key); err != nil || len(revs) != 1 {
+		t.Errorf("want the history of %q kept, got %+v %v", other.Key, revs, err)
+	}
+}
+
+// RunBatch checks the store.BatchStore of a backend: all operations or none are applied.
+func RunBatch(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+	bs, ok := db.(store.BatchStore)
+	if !ok { // not Skip, the other checks of the caller still run
+		t.Log("not a store.BatchStore")
+		return
+	}
+	fill(t, db, 2)
+	put := func(i int, ifRev int) store.Op {
+		return store.Op{Tiddler: NewTiddler(i), IfRev: ifRev}
+	}
+	exists := func(i int) bool {
+		_, err := db.Get(ctx, NewTiddler(i).Key)
+		return err == nil
+	}
+
+	revs, err := bs.Batch(ctx, []store.Op{put(0, 2), {Tiddler: store.Tiddler{Key: NewTiddler(1).Key}, Delete: true}, put(2, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(revs) != "[3 0 2]" {
+		t.Errorf("want revisions [3 0 2], got %v", revs)
+	}
+	if exists(1) || !exists(2) {
+		t.Errorf("want tiddler 1 deleted and 2 added")
+	}
+
+	for _, ops := range [][]store.Op{{put(0, 2), put(3, 0)}, {put(3, 0), put(0, 99)}} {
+		_, err := bs.Batch(ctx, ops)
+		ce, ok := err.(*store.ConflictError)
+		if !ok || ce.Rev != 3 {
+			t.Errorf("want conflict at revision 3, got %v", err)
+		}
+		if exists(3) {
+			t.Errorf("want no tiddler 3 after a conflict")
+		}
+	}
+	if rev, _ := db.Put(ctx, NewTiddler(0)); rev != 4 {
+		t.Errorf("want revision 4 after the conflicts, got %d", rev)
+	}
+}
+
+// RunSystem checks that system tiddlers look the same as normal ones:
+// fat from Get, skinny from All, and ErrNotFound for missing keys.
+func RunSystem(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+
+	sys := NewTiddler(1)
+	sys.Key = "$:/config/Test"
+	sys.IsSys = true
+	sys.Js["title"] = sys.Key
+	if _, err := db.Put(ctx, sys); err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := db.Get(ctx, sys.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := td.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := js["text"]; !ok {
+		t.Errorf("want fat system tiddler from Get, got %v", js)
+	}
+
+	all, err := db.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, td := range all {
+		js, err := td.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := js["text"]; ok {
+			t.Errorf("want skinny system tiddler from All, got %v", js)
+		}
+	}
+
+	_, err = db.Get(ctx, "missing")
+	if err != store.ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+// RunCase checks the store.CaseSensitive and store.CaseInsensitive title policies.
+func RunCase(t *testing.T, fn OpenFn) {
+	defer func(policy string) { store.TitleCase = policy }(store.TitleCase)
+	ctx := context.Background()
+	titled := func(title string, text string) store.Tiddler {
+		return store.Tiddler{Key: title, Js: map[string]interface{}{"title": title, "text": text}}
+	}
+	textOf := func(db store.TiddlerStore, title string) string {
+		td, err := db.Get(ctx, title)
+		if err != nil {
+			return err.Error()
+		}
+		js, _ := td.Fields()
+		text, _ := js["text"].(string)
+		return text
+	}
+
+	store.TitleCase = store.CaseSensitive
+	db := open(t, fn)
+	for _, td := range []store.Tiddler{titled("Foo", "upper"), titled("foo", "lower"), titled("a:b", "colon"), titled("a_b", "underscore")} {
+		if _, err := db.Put(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for title, want := range map[string]string{"Foo": "upper", "foo": "lower", "a:b": "colon", "a_b": "underscore"} {
+		if got := textOf(db, title); got != want {
+			t.Errorf("sensitive %q: want %q, got %q", title, want, got)
+		}
+	}
+	db.Close()
+
+	store.TitleCase = store.CaseInsensitive
+	db = open(t, fn)
+	defer db.Close()
+	db.Put(ctx, titled("Foo", "first"))
+	db.Put(ctx, titled("FOO", "second"))
+	if got := textOf(db, "foo"); got != "second" {
+		t.Errorf("insensitive: want %q, got %q", "second", got)
+	}
+	if all, _ := db.All(ctx); len(all) != 1 {
+		t.Errorf("insensitive: want 1 tiddler, got %d", len(all))
+	}
+	if err := db.Delete(ctx, "fOO"); err != nil {
+		t.Errorf("insensitive delete: %v", err)
+	}
+}
+
+// RunStats checks the store.StatsStore of a backend: well formed gauge names, and the size of its files.
+func RunStats(t *testing.T, fn OpenFn) {
+	ctx := context.Background()
+	db := open(t, fn)
+	defer db.Close()
+	ss, ok := db.(store.StatsStore)
+	if !ok { // not Skip, the other checks of the caller still run
+		t.Log("not a store.StatsStore")
+		return
+	}
+
+	for i := 0; i < 50; i++ {
+		if _, err := db.Put(ctx, NewTiddler(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := ss.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]float64)
+	for _, st := range stats {
+		if st.Name == "" || strings.Trim(st.Name, "abcdefghijklmnopqrstuvwxyz_") != "" || st.Help == "" {
+			t.Errorf("bad gauge %+v", st)
+		}
+		if _, dup := seen[st.Name]; dup {
+			t.Errorf("gauge %q twice", st.Name)
+		}
+		seen[st.Name] = st.Value
+	}
+	if seen["file_bytes"] <= 0 {
+		t.Errorf("want the size of the files, got %v", seen)
+	}
+}
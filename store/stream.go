@@ -0,0 +1,88 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"unicode/utf8"
+)
+
+// StreamStore is implemented by backends that can save and load tiddler text
+// without holding it in memory, for multi-megabyte tiddlers.
+type StreamStore interface {
+	// PutStream is Put with the text read from text, tiddler.Js must not have "text".
+	PutStream(ctx context.Context, tiddler Tiddler, text io.Reader) (int, error)
+
+	// GetStream returns the skinny meta of a tiddler, a reader for its text and the text size.
+	// The caller must close text.
+	GetStream(ctx context.Context, key string) (meta []byte, text io.ReadCloser, size int64, err error)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// WriteFatJSON writes the JSON object meta with a "text" field read from text,
+// escaping the text on the fly.
+func WriteFatJSON(w io.Writer, meta []byte, text io.Reader) (error) {
+	meta = bytes.TrimSpace(meta)
+	if len(meta) < 2 || meta[len(meta)-1] != '}' {
+		return ErrBadTiddler
+	}
+	head := meta[:len(meta)-1]
+
+	bw := bufio.NewWriter(w)
+	bw.Write(head)
+	if len(bytes.TrimSpace(head)) > 1 { // not "{"
+		bw.WriteByte(',')
+	}
+	bw.WriteString(`"text":"`)
+
+	br := bufio.NewReader(text)
+	for {
+		r, size, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			bw.WriteString(`\ufffd`)
+		case r == '"' || r == '\\':
+			bw.WriteByte('\\')
+			bw.WriteByte(byte(r))
+		case r == '\n':
+			bw.WriteString(`\n`)
+		case r == '\r':
+			bw.WriteString(`\r`)
+		case r == '\t':
+			bw.WriteString(`\t`)
+		case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+			bw.WriteString(`\u`)
+			bw.WriteByte(hexDigits[r>>12&0xf])
+			bw.WriteByte(hexDigits[r>>8&0xf])
+			bw.WriteByte(hexDigits[r>>4&0xf])
+			bw.WriteByte(hexDigits[r&0xf])
+		default:
+			bw.WriteRune(r)
+		}
+	}
+
+	bw.WriteString(`"}`)
+	return bw.Flush()
+}
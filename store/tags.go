@@ -0,0 +1,114 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+var (
+	// FatTags are the tags of the tiddlers All returns fat (with text),
+	// because the wiki needs them at startup before lazy loading kicks in.
+	FatTags = []string{"$:/tags/Macro", "$:/tags/Global", "$:/tags/RawMarkup"}
+)
+
+// ParseTags splits a TiddlyWiki tags field: space separated, [[with space]] for titles with spaces.
+func ParseTags(s string) ([]string) {
+	tags := make([]string, 0)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return tags
+		}
+
+		if strings.HasPrefix(s, "[[") {
+			end := strings.Index(s, "]]")
+			if end >= 0 {
+				tags = append(tags, s[2:end])
+				s = s[end+2:]
+				continue
+			}
+		}
+
+		end := strings.IndexAny(s, " \t\r\n")
+		if end < 0 {
+			end = len(s)
+		}
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+}
+
+// StringifyTags joins tags into a TiddlyWiki tags field.
+func StringifyTags(tags []string) (string) {
+	list := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if strings.ContainsAny(tag, " \t\r\n") {
+			tag = "[[" + tag + "]]"
+		}
+		list = append(list, tag)
+	}
+	return strings.Join(list, " ")
+}
+
+// TagsOf returns the tags in the tags field value v,
+// which is a string in .tid files and an array in TiddlyWeb JSON.
+func TagsOf(v interface{}) ([]string) {
+	switch t := v.(type) {
+	case string:
+		return ParseTags(t)
+	case []interface{}:
+		tags := make([]string, 0, len(t))
+		for _, tag := range t {
+			if s, ok := tag.(string); ok {
+				tags = append(tags, s)
+			}
+		}
+		return tags
+	case []string:
+		return t
+	}
+	return nil
+}
+
+// IsFat reports whether the tiddler with JSON meta is tagged with one of FatTags.
+func IsFat(meta []byte) (bool) {
+	found := false
+	for _, tag := range FatTags {
+		if bytes.Contains(meta, []byte(tag)) {
+			found = true
+			break
+		}
+	}
+	if !found { // fast path, no tag text anywhere
+		return false
+	}
+
+	var m struct {
+		Tags interface{} `json:"tags"`
+	}
+	if json.Unmarshal(meta, &m) != nil {
+		return false
+	}
+	for _, tag := range TagsOf(m.Tags) {
+		for _, fat := range FatTags {
+			if tag == fat {
+				return true
+			}
+		}
+	}
+	return false
+}
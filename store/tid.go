@@ -0,0 +1,206 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tiddlyWebFields are the fields TiddlyWeb JSON keeps at the top level,
+// the others live in the "fields" object.
+var tiddlyWebFields = map[string]bool{
+	"bag": true, "created": true, "creator": true, "modified": true, "modifier": true,
+	"permissions": true, "recipe": true, "revision": true, "tags": true, "text": true,
+	"title": true, "type": true, "uri": true,
+}
+
+// skipTidFields are server side fields not written into .tid files.
+var skipTidFields = map[string]bool{
+	"bag": true, "revision": true, "permissions": true, "recipe": true, "uri": true, "text": true,
+}
+
+// FlatFields returns the fields of TiddlyWeb JSON js as TiddlyWiki field strings,
+// with the "fields" object merged in and tags stringified.
+func FlatFields(js map[string]interface{}) (map[string]string) {
+	flat := make(map[string]string, len(js))
+	for k, v := range js {
+		switch k {
+		case "fields":
+			if fields, ok := v.(map[string]interface{}); ok {
+				for fk, fv := range fields {
+					flat[fk] = fieldString(fv)
+				}
+			}
+		case "tags":
+			flat[k] = StringifyTags(TagsOf(v))
+		default:
+			flat[k] = fieldString(v)
+		}
+	}
+	return flat
+}
+
+// FromFlatFields is the reverse of FlatFields.
+func FromFlatFields(flat map[string]string) (map[string]interface{}) {
+	js := make(map[string]interface{}, len(flat))
+	fields := make(map[string]interface{})
+	for k, v := range flat {
+		switch {
+		case k == "tags":
+			tags := make([]interface{}, 0)
+			for _, tag := range ParseTags(v) {
+				tags = append(tags, tag)
+			}
+			js[k] = tags
+		case tiddlyWebFields[k]:
+			js[k] = v
+		default:
+			fields[k] = v
+		}
+	}
+	if len(fields) > 0 {
+		js["fields"] = fields
+	}
+	return js
+}
+
+func fieldString(v interface{}) (string) {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return fmt.Sprint(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// EncodeTid serializes TiddlyWeb JSON js into the TiddlyWiki .tid format:
+// "name: value" lines, a blank line, then the text.
+// Line breaks inside field values are not representable and turn into spaces.
+func EncodeTid(js map[string]interface{}) ([]byte) {
+	var buf bytes.Buffer
+	writeTidHeader(&buf, js, skipTidFields)
+	text, _ := js["text"].(string)
+	buf.WriteString(text)
+	return buf.Bytes()
+}
+
+// TidHeader is the header of EncodeTid, up to and including the blank line,
+// keeping the server side fields but "text" so that a store can read them back.
+func TidHeader(js map[string]interface{}) ([]byte) {
+	var buf bytes.Buffer
+	writeTidHeader(&buf, js, map[string]bool{"text": true})
+	return buf.Bytes()
+}
+
+func writeTidHeader(buf *bytes.Buffer, js map[string]interface{}, skip map[string]bool) {
+	flat := FlatFields(js)
+	names := make([]string, 0, len(flat))
+	for k := range flat {
+		if skip[k] || k == "" {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		v := strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(flat[k])
+		buf.WriteString(k)
+		buf.WriteString(": ")
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+}
+
+// DecodeTid parses .tid data into TiddlyWeb JSON, with "text".
+func DecodeTid(data []byte) (map[string]interface{}, error) {
+	flat := make(map[string]string)
+	r := bufio.NewReader(bytes.NewReader(data))
+	read := 0
+	for {
+		line, err := r.ReadString('\n')
+		read += len(line)
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+
+		idx := strings.Index(trimmed, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("bad .tid header line %q", trimmed)
+		}
+		flat[strings.TrimSpace(trimmed[:idx])] = strings.TrimSpace(trimmed[idx+1:])
+		if err != nil { // header without text
+			break
+		}
+	}
+
+	js := FromFlatFields(flat)
+	if read < len(data) {
+		js["text"] = string(data[read:])
+	} else {
+		js["text"] = ""
+	}
+	return js, nil
+}
+
+// fileUnsafe are the characters not allowed in file names on common file systems.
+const fileUnsafe = "%/\\<>:\"|?*"
+
+// TitleToFile maps a tiddler title to a file name (without extension), reversible by FileToTitle.
+func TitleToFile(title string) (string) {
+	var buf strings.Builder
+	for i := 0; i < len(title); i++ {
+		c := title[i]
+		if c < 0x20 || strings.IndexByte(fileUnsafe, c) >= 0 {
+			fmt.Fprintf(&buf, "%%%02X", c)
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	name := buf.String()
+	if name == "" || name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1) + "%"
+	}
+	return name
+}
+
+// FileToTitle is the reverse of TitleToFile.
+func FileToTitle(name string) (string) {
+	if strings.HasSuffix(name, "%") && strings.Trim(strings.TrimSuffix(name, "%"), "%2E") == "" {
+		name = strings.Replace(strings.TrimSuffix(name, "%"), "%2E", ".", -1)
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			var c byte
+			if _, err := fmt.Sscanf(name[i+1:i+3], "%02X", &c); err == nil {
+				buf.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(name[i])
+	}
+	return buf.String()
+}
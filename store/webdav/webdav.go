@@ -0,0 +1,628 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package webdav is a TiddlerStore backend keeping the files of the flatFile store
+// on a WebDAV server (Nextcloud, ownCloud, Apache mod_dav...).
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../../store"
+	"../flatFile"
+)
+
+const (
+	TypeName = "webdav"
+
+	tiddlersDir = "tiddlers"
+	historyDir  = "tiddlerHistory"
+)
+
+// Workers is how many files All reads at once, hiding the latency of the server.
+var Workers = 8
+
+// davStore keeps the tiddlers as the flatFile store does, <key>.meta and <key>.tid in
+// tiddlers/ and the history as <key>#<revision> in tiddlerHistory/, so a folder synced
+// by the client of the server can be opened by the flatFile backend too.
+type davStore struct {
+	base     string // folder URL, without credentials and trailing slash
+	user     string
+	pass     string
+	client   *http.Client
+	maxRev   int
+	histSize store.HistorySize
+
+	mu sync.Mutex // one Put or Delete at a time, the revision is read and written back
+
+	cacheMu sync.Mutex
+	metas   map[string]cachedMeta // by file name, read by All
+}
+
+// cachedMeta is a .meta file as of its ETag.
+type cachedMeta struct {
+	etag string
+	meta []byte
+}
+
+// davFile is a file listed by PROPFIND.
+type davFile struct {
+	name     string
+	size     int64
+	etag     string
+	modified time.Time
+}
+
+func init() {
+	err := store.RegBackend(TypeName, Open)
+	if err != nil {
+		panic("multi backends with same type at the same time!")
+	}
+}
+
+// Open uses the folder at dataSource, e.g. https://me@cloud.example.com/remote.php/dav/files/me/widdly,
+// creating it and its subfolders if missing (the password is read from $WIDDLY_DB_PASS unless given in the URL).
+func Open(dataSource string) (store.TiddlerStore, error) {
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webdav: source must be an http(s) URL, got %q", dataSource)
+	}
+	s := &davStore{client: &http.Client{Timeout: time.Minute}, maxRev: -1, metas: make(map[string]cachedMeta)}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+		u.User = nil
+	}
+	if s.pass == "" {
+		s.pass = os.Getenv("WIDDLY_DB_PASS")
+	}
+	u.RawQuery = ""
+	s.base = strings.TrimRight(u.String(), "/")
+
+	ctx := context.Background()
+	for _, dir := range []string{"", tiddlersDir, historyDir} {
+		if err := s.mkcol(ctx, dir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *davStore) Close() error {
+	return nil
+}
+
+// request sends method for the escaped name, relative to the folder. A status of 300 and above
+// is an error, except 404 Not Found which the caller checks.
+func (s *davStore) request(ctx context.Context, method string, name string, header http.Header, body io.Reader) (*http.Response, error) {
+	target := s.base + "/" + name
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("webdav: %s %s: %s", method, name, resp.Status)
+	}
+	return resp, nil
+}
+
+// mkcol creates the folder dir unless it exists.
+func (s *davStore) mkcol(ctx context.Context, dir string) (error) {
+	resp, err := s.request(ctx, "PROPFIND", dir, http.Header{"Depth": {"0"}}, nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		return nil
+	}
+	resp, err = s.request(ctx, "MKCOL", dir, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get reads the file name, nil when missing.
+func (s *davStore) get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.request(ctx, "GET", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && data == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+// put writes data to the file name.
+func (s *davStore) put(ctx context.Context, name string, data []byte) (error) {
+	resp, err := s.request(ctx, "PUT", name, nil, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound { // the folder is gone
+		return fmt.Errorf("webdav: PUT %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// remove deletes the file name, reporting whether it existed.
+func (s *davStore) remove(ctx context.Context, name string) (bool, error) {
+	resp, err := s.request(ctx, "DELETE", name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getetag/><d:getlastmodified/></d:prop></d:propfind>`
+
+// multistatus is the answer of PROPFIND, matched without namespaces.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				Collection *struct{} `xml:"resourcetype>collection"`
+				Length     int64     `xml:"getcontentlength"`
+				ETag       string    `xml:"getetag"`
+				Modified   string    `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// list returns the files of the folder dir.
+func (s *davStore) list(ctx context.Context, dir string) ([]davFile, error) {
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := s.request(ctx, "PROPFIND", dir + "/", header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("webdav: folder %s is missing", dir)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	files := make([]davFile, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		f := davFile{name: path.Base(u.Path)}
+		dir := false
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			dir = dir || ps.Prop.Collection != nil
+			f.size, f.etag = ps.Prop.Length, ps.Prop.ETag
+			f.modified, _ = http.ParseTime(ps.Prop.Modified)
+		}
+		if !dir {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// fileKey returns the file name, without extension, of the tiddler titled key; the one of flatFile.
+func fileKey(key string) (string) {
+	meta, _ := flatFile.TiddlerPaths(key)
+	return strings.TrimSuffix(filepath.Base(meta), ".meta")
+}
+
+func tiddlerFile(name string, ext string) (string) {
+	return tiddlersDir + "/" + url.PathEscape(name + ext)
+}
+
+func historyFile(name string, rev int) (string) {
+	return historyDir + "/" + url.PathEscape(fmt.Sprintf("%s#%d", name, rev))
+}
+
+// Get retrieves a tiddler from the store by key (title).
+func (s *davStore) Get(ctx context.Context, key string) (*store.Tiddler, error) {
+	name := fileKey(key)
+	meta, err := s.get(ctx, tiddlerFile(name, ".meta"))
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, store.ErrNotFound
+	}
+	text, err := s.get(ctx, tiddlerFile(name, ".tid"))
+	if err != nil {
+		return nil, err
+	}
+	if text == nil {
+		// system tiddlers of older versions keep the text inside meta
+		return store.NewTiddler(meta, nil)
+	}
+	return store.NewTiddler(meta, text)
+}
+
+// readMetas reads the .meta files of files, Workers at once, from the cache when their ETag did not change.
+func (s *davStore) readMetas(ctx context.Context, files []davFile) (map[string][]byte, error) {
+	metas := make(map[string][]byte, len(files))
+	todo := make([]davFile, 0)
+	s.cacheMu.Lock()
+	for _, f := range files {
+		if c, ok := s.metas[f.name]; ok && f.etag != "" && c.etag == f.etag {
+			metas[f.name] = c.meta
+		} else {
+			todo = append(todo, f)
+		}
+	}
+	s.cacheMu.Unlock()
+
+	var mu sync.Mutex
+	var firstErr error
+	next := make(chan davFile)
+	var wg sync.WaitGroup
+	for w := 0; w < Workers && w < len(todo); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range next {
+				meta, err := s.get(ctx, tiddlerFile(strings.TrimSuffix(f.name, ".meta"), ".meta"))
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if meta != nil {
+					metas[f.name] = meta
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range todo {
+		next <- f
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	cache := make(map[string]cachedMeta, len(files))
+	for _, f := range files {
+		if meta, ok := metas[f.name]; ok {
+			cache[f.name] = cachedMeta{etag: f.etag, meta: meta}
+		}
+	}
+	s.cacheMu.Lock()
+	s.metas = cache // drops the deleted files
+	s.cacheMu.Unlock()
+	return metas, nil
+}
+
+// metaFiles lists the .meta files.
+func (s *davStore) metaFiles(ctx context.Context) ([]davFile, error) {
+	files, err := s.list(ctx, tiddlersDir)
+	if err != nil {
+		return nil, err
+	}
+	metas := files[:0]
+	for _, f := range files {
+		if strings.HasSuffix(f.name, ".meta") {
+			metas = append(metas, f)
+		}
+	}
+	return metas, nil
+}
+
+// All retrieves all the tiddlers (mostly skinny) from the store.
+// Tiddlers tagged with one of store.FatTags are returned fat.
+// Only the .meta files changed since the last call are read again.
+func (s *davStore) All(ctx context.Context) ([]*store.Tiddler, error) {
+	files, err := s.metaFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := s.readMetas(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := make([]*store.Tiddler, 0, len(metas))
+	for file, meta := range metas {
+		if store.IsFat(meta) {
+			text, err := s.get(ctx, tiddlerFile(strings.TrimSuffix(file, ".meta"), ".tid"))
+			if err != nil {
+				return nil, err
+			}
+			if text != nil {
+				if t, err := store.NewTiddler(meta, text); err == nil {
+					tiddlers = append(tiddlers, t)
+				}
+				continue
+			}
+		}
+		t, _ := store.NewTiddler(store.Skinny(meta), nil)
+		tiddlers = append(tiddlers, t)
+	}
+	store.SortTiddlers(tiddlers, store.Order{})
+	return tiddlers, nil
+}
+
+// lastRevision returns the revision of the tiddler stored as name, 1 when missing.
+func (s *davStore) lastRevision(ctx context.Context, name string) (int, error) {
+	meta, err := s.get(ctx, tiddlerFile(name, ".meta"))
+	if err != nil || meta == nil {
+		return 1, err
+	}
+	t, _ := store.NewTiddler(meta, nil)
+	return t.GetRevision(), nil
+}
+
+// trimRevision deletes the maxRev + 1 newest revisions from rev down, stopping at a missing one.
+func (s *davStore) trimRevision(ctx context.Context, name string, rev int) (error) {
+	for i, n := rev, 0; i > 0 && n <= s.maxRev; i, n = i - 1, n + 1 {
+		found, err := s.remove(ctx, historyFile(name, i))
+		if err != nil || !found {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put saves tiddler to the store, incrementing and returning revision.
+// The text is written first and the meta last, as the flatFile store does.
+func (s *davStore) Put(ctx context.Context, tiddler store.Tiddler) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text, _ := tiddler.Js["text"].(string)
+	delete(tiddler.Js, "text")
+	name := fileKey(tiddler.Key)
+	rev, err := s.lastRevision(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	rev++
+	tiddler.Js["revision"] = rev
+	meta, err := json.Marshal(tiddler.Js) // meta without text
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.put(ctx, tiddlerFile(name, ".tid"), []byte(text)); err != nil {
+		return 0, err
+	}
+
+	// skip Draft & system key history
+	if !tiddler.IsDraft && !tiddler.IsSys && s.maxRev != 0 {
+		if s.maxRev > 0 && rev - s.maxRev > 1 {
+			if err := s.trimRevision(ctx, name, rev - 1 - s.maxRev); err != nil {
+				return 0, err
+			}
+			s.histSize.Reset()
+		}
+		var hist bytes.Buffer
+		if err := store.WriteFatJSON(&hist, meta, strings.NewReader(text)); err != nil {
+			return 0, err
+		}
+		if err := s.put(ctx, historyFile(name, rev), hist.Bytes()); err != nil {
+			return 0, err
+		}
+		s.checkHistorySize(int64(hist.Len()))
+	}
+
+	if err := s.put(ctx, tiddlerFile(name, ".meta"), meta); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// Delete deletes a tiddler with the given key (title) and all its history from the store.
+func (s *davStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fileKey(key)
+	if _, err := s.remove(ctx, tiddlerFile(name, ".meta")); err != nil {
+		return err
+	}
+	if _, err := s.remove(ctx, tiddlerFile(name, ".tid")); err != nil { // system tiddlers may have no .tid
+		return err
+	}
+
+	entries, err := s.historyEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Key != name {
+			continue
+		}
+		if _, err := s.remove(ctx, historyFile(name, e.Rev)); err != nil {
+			return err
+		}
+	}
+	s.histSize.Reset()
+	return nil
+}
+
+func (s *davStore) SetMaxHistory(rev int) {
+	s.maxRev = rev
+}
+
+func (s *davStore) SetMaxHistorySize(size int64) {
+	s.histSize.SetMax(size)
+}
+
+// Audit checks the newest revision in the history of every tiddler against the tiddler.
+func (s *davStore) Audit(ctx context.Context, repair bool) ([]store.Divergence, error) {
+	entries, err := s.historyEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	revs := make(map[string][]int)
+	for _, e := range entries {
+		revs[e.Key] = append(revs[e.Key], e.Rev)
+	}
+	files, err := s.metaFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := s.readMetas(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	divs := make([]store.Divergence, 0)
+	for file, meta := range metas {
+		name := strings.TrimSuffix(file, ".meta")
+		t, _ := store.NewTiddler(meta, nil)
+		head := t.GetRevision()
+		latest := 0
+		for _, rev := range revs[name] {
+			if rev > latest {
+				latest = rev
+			}
+		}
+		if !store.Diverges(meta, head, latest, s.maxRev != 0) {
+			continue
+		}
+		divs = append(divs, store.Divergence{Key: name, Head: head, Latest: latest})
+		if !repair {
+			continue
+		}
+
+		for _, rev := range revs[name] {
+			if rev < head {
+				continue
+			}
+			if _, err := s.remove(ctx, historyFile(name, rev)); err != nil {
+				return divs, err
+			}
+		}
+		if s.maxRev == 0 || store.NoHistory(meta) {
+			continue
+		}
+		text, err := s.get(ctx, tiddlerFile(name, ".tid"))
+		if err != nil {
+			return divs, err
+		}
+		var hist bytes.Buffer
+		if err := store.WriteFatJSON(&hist, store.Skinny(meta), bytes.NewReader(text)); err != nil {
+			return divs, err
+		}
+		if err := s.put(ctx, historyFile(name, head), hist.Bytes()); err != nil {
+			return divs, err
+		}
+	}
+	if repair {
+		s.histSize.Reset()
+	}
+	return divs, nil
+}
+
+// historyEntries lists all revisions in the history folder.
+func (s *davStore) historyEntries(ctx context.Context) ([]store.HistoryEntry, error) {
+	files, err := s.list(ctx, historyDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]store.HistoryEntry, 0, len(files))
+	for _, f := range files {
+		idx := strings.LastIndexByte(f.name, '#')
+		if idx < 0 {
+			continue
+		}
+		rev, err := strconv.Atoi(f.name[idx+1:])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, store.HistoryEntry{Key: f.name[:idx], Rev: rev, Size: f.size, Seq: f.modified.UnixNano()})
+	}
+	return entries, nil
+}
+
+// checkHistorySize prunes the oldest revisions when the history is over its size limit.
+func (s *davStore) checkHistorySize(added int64) {
+	ctx := context.Background()
+	scan := func() (int64, error) {
+		entries, err := s.historyEntries(ctx)
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		return total, err
+	}
+	if !s.histSize.Grow(added, scan) {
+		return
+	}
+
+	entries, err := s.historyEntries(ctx)
+	if err != nil {
+		log.Println("[webdav] list history error", err)
+		return
+	}
+	del, total := s.histSize.Prune(entries)
+	for _, e := range del {
+		s.remove(ctx, historyFile(e.Key, e.Rev))
+	}
+	log.Printf("[webdav] history size limit exceeded, pruned %d oldest revisions, %d bytes left", len(del), total)
+}
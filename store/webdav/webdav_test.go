@@ -0,0 +1,106 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"../../store"
+	"../storetest"
+)
+
+// serve starts a WebDAV server on a temporary folder, counting the GETs.
+func serve(tb testing.TB, gets *int64) (string) {
+	h := &webdav.Handler{FileSystem: webdav.Dir(tb.TempDir()), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "me" || pass != "pw" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "GET" && gets != nil {
+			atomic.AddInt64(gets, 1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	tb.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "http://me:pw@", 1) + "/wiki"
+}
+
+func openTemp(tb testing.TB) storetest.OpenFn {
+	return func(dir string) (store.TiddlerStore, error) {
+		return Open(serve(tb, nil))
+	}
+}
+
+func TestStore(t *testing.T) {
+	open := openTemp(t)
+	storetest.Run(t, open)
+	storetest.RunSystem(t, open)
+	storetest.RunOrder(t, open)
+	storetest.RunPage(t, open)
+	storetest.RunAudit(t, open)
+	storetest.RunCase(t, open)
+}
+
+func TestListCache(t *testing.T) {
+	var gets int64
+	db, err := Open(serve(t, &gets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		db.Put(ctx, storetest.NewTiddler(i))
+	}
+
+	list := func() int64 {
+		before := atomic.LoadInt64(&gets)
+		tiddlers, err := db.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tiddlers) != 10 {
+			t.Fatalf("want 10 tiddlers, got %d", len(tiddlers))
+		}
+		return atomic.LoadInt64(&gets) - before
+	}
+	if n := list(); n != 10 {
+		t.Errorf("first list: want 10 GETs, got %d", n)
+	}
+	if n := list(); n != 0 {
+		t.Errorf("unchanged: want no GET, got %d", n)
+	}
+	db.Put(ctx, storetest.NewTiddler(3))
+	if n := list(); n != 1 {
+		t.Errorf("one changed: want 1 GET, got %d", n)
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	source := strings.Replace(serve(t, nil), "me:pw@", "me:nope@", 1)
+	if _, err := Open(source); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("want 401 Unauthorized, got %v", err)
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	storetest.Bench(b, openTemp(b))
+}
@@ -0,0 +1,30 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows plan9
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// inheritListener returns nil, sockets cannot be handed over here.
+func inheritListener() (net.Listener, error) {
+	return nil, nil
+}
+
+// watchUpgrade does nothing, there is no SIGUSR2 here.
+func watchUpgrade(ln net.Listener, stop chan<- os.Signal) {
+}
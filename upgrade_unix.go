@@ -0,0 +1,144 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows,!plan9
+
+package main
+
+// Zero-downtime upgrades: on SIGUSR2 widdly starts its binary again and hands it the listening
+// socket. The new process tells it started, the old one finishes its requests, closes the stores
+// and exits, then the new one opens them and serves the connections queued meanwhile.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv is set for the new process, which gets the socket as fd 3,
+// the pipe telling it started as fd 4 and the one closed when the old process exits as fd 5.
+const upgradeEnv = "WIDDLY_UPGRADE"
+
+// upgradeTimeout is how long the new process may take to start.
+const upgradeTimeout = 30 * time.Second
+
+// released is the pipe the new process waits on, kept open until this process exits.
+var released *os.File
+
+// inheritListener returns the socket handed over by the old process, nil when not upgrading.
+// It waits until the old process has exited, so the stores are free to open.
+func inheritListener() (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	ln, err := net.FileListener(os.NewFile(3, "listener"))
+	if err != nil {
+		return nil, err
+	}
+	ready, release := os.NewFile(4, "ready"), os.NewFile(5, "release")
+	ready.Write([]byte{1})
+	ready.Close()
+	log.Println("[upgrade] waiting for the old process to finish its requests")
+	ioutil.ReadAll(release) // until it exits
+	release.Close()
+	log.Println("[upgrade] taking over")
+	return ln, nil
+}
+
+// watchUpgrade starts the new process on SIGUSR2, and sends on stop once it has started.
+// When it fails, the error is logged and this process keeps serving.
+func watchUpgrade(ln net.Listener, stop chan<- os.Signal) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := upgrade(ln); err != nil {
+				log.Println("[upgrade] failed, still serving:", err)
+				continue
+			}
+			log.Println("[upgrade] the new process started, finishing the requests")
+			signal.Stop(usr2)
+			stop <- syscall.SIGUSR2
+			return
+		}
+	}()
+}
+
+// upgrade starts the binary again with the same arguments and ln, and waits until it has started.
+func upgrade(ln net.Listener) (error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("the listener has no file")
+	}
+	f, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	releaseR, releaseW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv + "=1")
+	cmd.ExtraFiles = []*os.File{f, readyW, releaseR}
+	err = cmd.Start()
+	readyW.Close()
+	releaseR.Close()
+	if err != nil {
+		releaseW.Close()
+		return err
+	}
+	log.Println("[upgrade] started", exe, "as pid", cmd.Process.Pid)
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1)) // EOF when it exits first
+		started <- err
+	}()
+	select {
+	case err = <-started:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		releaseW.Close()
+		return fmt.Errorf("the new process did not start: %v", err)
+	}
+	go cmd.Wait() // not waited for if it outlives this process, as it should
+	released = releaseW
+	return nil
+}
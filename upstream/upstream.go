@@ -0,0 +1,442 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package upstream mirrors the tiddlers of a TiddlerStore with a remote widdly
+// or TiddlyWeb compatible server, pushing and pulling changes on a schedule.
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"../store"
+)
+
+// tidState is the state of one tiddler at the last sync.
+type tidState struct {
+	Local  int    `json:"local"`  // revision in the local store
+	Remote string `json:"remote"` // revision on the remote server
+}
+
+// Syncer syncs Store with the server at URL. When a tiddler changed on both sides
+// the one modified last wins, the remote one on a tie.
+// Drafts, state tiddlers like $:/StoryList and private $:/widdly/ tiddlers are not synced.
+type Syncer struct {
+	URL      string // base URL of the remote wiki, e.g. https://example.com/wiki
+	User     string // remote login, empty for none
+	Password string
+	Recipe   string // remote recipe, "all" for widdly
+	Store    store.TiddlerStore
+
+	// Push and Pull choose the directions changes flow, both by default.
+	Push bool
+	Pull bool
+
+	// OnChange is called after the store was modified by a sync pass.
+	OnChange func()
+
+	stateFile string
+	state     map[string]*tidState
+	client    *http.Client
+	logged    bool
+}
+
+// New returns a Syncer for the server at remote, keeping its state in stateFile.
+func New(remote string, db store.TiddlerStore, stateFile string) (*Syncer, error) {
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("bad upstream URL %q", remote)
+	}
+	jar, _ := cookiejar.New(nil)
+
+	s := &Syncer{
+		URL:       strings.TrimRight(remote, "/"),
+		Recipe:    "all",
+		Store:     db,
+		Push:      true,
+		Pull:      true,
+		stateFile: stateFile,
+		state:     make(map[string]*tidState),
+		client:    &http.Client{Jar: jar, Timeout: time.Minute},
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err == nil {
+		err = json.Unmarshal(data, &s.state)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream state %s: %v", stateFile, err)
+		}
+	}
+	return s, nil
+}
+
+// Watch runs a sync pass every interval until ctx is done.
+func (s *Syncer) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			log.Println("[upstream]", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+var skipPrefix = []string{"Draft of '", "$:/StoryList", "$:/HistoryList", "$:/status/", "$:/state/", "$:/temp/", "$:/widdly/"}
+
+func skipTitle(title string) (bool) {
+	if title == "" {
+		return true
+	}
+	for _, p := range skipPrefix {
+		if strings.HasPrefix(title, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// version is the revision and modified time of a tiddler.
+type version struct {
+	rev      string
+	modified string
+	bag      string
+}
+
+func revString(v interface{}) (string) {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return fmt.Sprintf("%d", int64(v))
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// local lists the versions of the synced tiddlers of the store by title.
+func (s *Syncer) local(ctx context.Context) (map[string]version, error) {
+	all, err := s.Store.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[string]version, len(all))
+	for _, t := range all {
+		js, err := t.Fields()
+		if err != nil {
+			continue
+		}
+		title, _ := js["title"].(string)
+		if skipTitle(title) {
+			continue
+		}
+		modified, _ := js["modified"].(string)
+		list[title] = version{rev: revString(js["revision"]), modified: modified}
+	}
+	return list, nil
+}
+
+// remote lists the versions of the synced tiddlers on the server by title.
+func (s *Syncer) remote(ctx context.Context) (map[string]version, error) {
+	var all []map[string]interface{}
+	if err := s.getJSON(ctx, "/recipes/" + s.Recipe + "/tiddlers.json", &all); err != nil {
+		return nil, err
+	}
+
+	list := make(map[string]version, len(all))
+	for _, js := range all {
+		title, _ := js["title"].(string)
+		if skipTitle(title) {
+			continue
+		}
+		modified, _ := js["modified"].(string)
+		bag, _ := js["bag"].(string)
+		list[title] = version{rev: revString(js["revision"]), modified: modified, bag: bag}
+	}
+	return list, nil
+}
+
+// Sync runs one sync pass.
+func (s *Syncer) Sync(ctx context.Context) (error) {
+	if err := s.login(ctx); err != nil {
+		return err
+	}
+	local, err := s.local(ctx)
+	if err != nil {
+		return err
+	}
+	remote, err := s.remote(ctx)
+	if err != nil {
+		return err
+	}
+
+	titles := make(map[string]bool, len(local) + len(remote))
+	for title := range local {
+		titles[title] = true
+	}
+	for title := range remote {
+		titles[title] = true
+	}
+
+	changed := false
+	for title := range titles {
+		ch, err := s.syncOne(ctx, title, local, remote)
+		if err != nil {
+			log.Printf("[upstream] %q: %v", title, err)
+		}
+		changed = changed || ch
+	}
+
+	for title := range s.state {
+		if !titles[title] {
+			delete(s.state, title)
+		}
+	}
+	if changed && s.OnChange != nil {
+		s.OnChange()
+	}
+	return s.saveState()
+}
+
+// syncOne syncs one tiddler and returns whether the store was modified.
+func (s *Syncer) syncOne(ctx context.Context, title string, local map[string]version, remote map[string]version) (bool, error) {
+	lv, inLocal := local[title]
+	rv, inRemote := remote[title]
+	st := s.state[title]
+
+	localChanged := st == nil || lv.rev != fmt.Sprint(st.Local)
+	remoteChanged := st == nil || rv.rev != st.Remote
+
+	switch {
+	case inLocal && !inRemote:
+		if st != nil && !localChanged { // deleted remotely
+			if !s.Pull {
+				return false, nil
+			}
+			delete(s.state, title)
+			return true, s.Store.Delete(ctx, title)
+		}
+		return false, s.push(ctx, title, "")
+
+	case !inLocal && inRemote:
+		if st != nil && !remoteChanged { // deleted locally
+			if !s.Push {
+				return false, nil
+			}
+			delete(s.state, title)
+			return false, s.remove(ctx, title, rv.bag)
+		}
+		return s.pull(ctx, title)
+
+	case inLocal && inRemote:
+		switch {
+		case localChanged && remoteChanged:
+			if st != nil {
+				log.Printf("[upstream] %q changed on both sides, keeping the one modified last", title)
+			}
+			if lv.modified > rv.modified {
+				return false, s.push(ctx, title, rv.bag)
+			}
+			return s.pull(ctx, title)
+		case remoteChanged:
+			return s.pull(ctx, title)
+		case localChanged:
+			return false, s.push(ctx, title, rv.bag)
+		}
+	}
+	return false, nil
+}
+
+// pull saves the remote tiddler into the store.
+func (s *Syncer) pull(ctx context.Context, title string) (bool, error) {
+	if !s.Pull {
+		return false, nil
+	}
+	var js map[string]interface{}
+	if err := s.getJSON(ctx, s.tiddlerPath(title), &js); err != nil {
+		return false, err
+	}
+	remoteRev := revString(js["revision"])
+
+	js["title"] = title
+	js["bag"] = "bag"
+	delete(js, "revision")
+	rev, err := s.Store.Put(ctx, store.Tiddler{
+		Key:     title,
+		Js:      js,
+		IsSys:   strings.HasPrefix(title, "$:/"),
+	})
+	if err != nil {
+		return false, err
+	}
+	s.state[title] = &tidState{Local: rev, Remote: remoteRev}
+	return true, nil
+}
+
+// push saves the local tiddler on the server.
+func (s *Syncer) push(ctx context.Context, title string, bag string) (error) {
+	if !s.Push {
+		return nil
+	}
+	t, err := s.Store.Get(ctx, title)
+	if err != nil {
+		return err
+	}
+	js, err := t.Fields()
+	if err != nil {
+		return err
+	}
+	localRev, _ := js["revision"].(float64)
+
+	delete(js, "revision")
+	if bag != "" {
+		js["bag"] = bag
+	} else {
+		delete(js, "bag")
+	}
+	data, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, "PUT", s.tiddlerPath(title), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 {
+		return fmt.Errorf("PUT: %s", resp.Status)
+	}
+	s.state[title] = &tidState{Local: int(localRev), Remote: etagRev(resp.Header.Get("ETag"))}
+	return nil
+}
+
+// remove deletes the tiddler on the server.
+func (s *Syncer) remove(ctx context.Context, title string, bag string) (error) {
+	if bag == "" {
+		bag = "bag"
+	}
+	resp, err := s.do(ctx, "DELETE", "/bags/" + url.PathEscape(bag) + "/tiddlers/" + url.PathEscape(title), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE: %s", resp.Status)
+	}
+	return nil
+}
+
+// etagRev returns the revision of a TiddlyWeb ETag, "bag/title/rev:hash".
+// An unknown revision makes the next pass pull the tiddler back, which is harmless.
+func etagRev(etag string) (string) {
+	etag = strings.Trim(etag, `"`)
+	if i := strings.LastIndex(etag, ":"); i >= 0 {
+		etag = etag[:i]
+	}
+	if i := strings.LastIndex(etag, "/"); i >= 0 {
+		return etag[i + 1:]
+	}
+	return ""
+}
+
+func (s *Syncer) tiddlerPath(title string) (string) {
+	return "/recipes/" + s.Recipe + "/tiddlers/" + url.PathEscape(title)
+}
+
+// login starts a session on the server, once.
+func (s *Syncer) login(ctx context.Context) (error) {
+	if s.User == "" || s.logged {
+		return nil
+	}
+	form := url.Values{"user": {s.User}, "password": {s.Password}}
+	req, err := http.NewRequest("POST", s.URL + "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 {
+		return fmt.Errorf("login: %s", resp.Status)
+	}
+	s.logged = true
+	return nil
+}
+
+func (s *Syncer) do(ctx context.Context, method string, path string, body *bytes.Reader) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, s.URL + path, body)
+	} else {
+		req, err = http.NewRequest(method, s.URL + path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Requested-With", "TiddlyWiki")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		s.logged = false // session expired, log in again next pass
+	}
+	return resp, err
+}
+
+func (s *Syncer) getJSON(ctx context.Context, path string, v interface{}) (error) {
+	resp, err := s.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *Syncer) saveState() (error) {
+	data, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.stateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.stateFile)
+}
@@ -0,0 +1,112 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../api"
+	"../store"
+	"../store/flatFile"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	wd, _ := os.Getwd()
+	open := func() store.TiddlerStore {
+		dir, _ := filepath.Rel(wd, t.TempDir())
+		db, err := flatFile.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	local, remote := open(), open()
+	defer local.Close()
+	defer remote.Close()
+
+	srv := httptest.NewServer(api.Handler(api.Config{
+		Store: remote,
+		Authenticate: func(user string, pwd string) bool { return user == "u" && pwd == "p" },
+		NoCache: true,
+	}))
+	defer srv.Close()
+
+	put := func(db store.TiddlerStore, title string, text string, modified string) {
+		js := map[string]interface{}{"title": title, "text": text, "modified": modified}
+		if _, err := db.Put(ctx, store.Tiddler{Key: title, Js: js}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := func(db store.TiddlerStore, title string) string {
+		td, err := db.Get(ctx, title)
+		if err != nil {
+			return "<missing>"
+		}
+		js, _ := td.Fields()
+		s, _ := js["text"].(string)
+		return s
+	}
+
+	put(remote, "A", "a", "20200101000000000")
+	put(local, "B", "b", "20200101000000000")
+	put(local, "$:/StoryList", "skipped", "20200101000000000")
+
+	s, err := New(srv.URL, local, filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.User, s.Password = "u", "p"
+	sync := func() {
+		if err := s.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sync()
+	if text(local, "A") != "a" || text(remote, "B") != "b" {
+		t.Fatalf("first sync: local A %q, remote B %q", text(local, "A"), text(remote, "B"))
+	}
+	if text(remote, "$:/StoryList") != "<missing>" {
+		t.Errorf("state tiddler pushed")
+	}
+
+	put(local, "A", "a2", "20200102000000000")
+	sync()
+	if text(remote, "A") != "a2" {
+		t.Errorf("push: remote A %q", text(remote, "A"))
+	}
+
+	remote.Delete(ctx, "B")
+	sync()
+	if text(local, "B") != "<missing>" {
+		t.Errorf("remote delete: local B %q", text(local, "B"))
+	}
+
+	put(local, "A", "local edit", "20200103000000000")
+	put(remote, "A", "remote edit", "20200104000000000")
+	sync()
+	if text(local, "A") != "remote edit" || text(remote, "A") != "remote edit" {
+		t.Errorf("conflict: want the newer remote edit, got local %q, remote %q", text(local, "A"), text(remote, "A"))
+	}
+
+	sync() // nothing left to do
+	if text(local, "A") != "remote edit" || text(remote, "A") != "remote edit" {
+		t.Errorf("second pass: local %q, remote %q", text(local, "A"), text(remote, "A"))
+	}
+}